@@ -0,0 +1,343 @@
+#include "alerts.hpp"
+#include "process.hpp"
+#include "logs.hpp"
+#include "logger.hpp"
+#include "registry.hpp"
+#include <algorithm>
+#include <cstdio>
+#include <cstdlib>
+#include <mutex>
+#include <regex>
+#include <set>
+#include <sstream>
+#include <stdexcept>
+#include <thread>
+
+namespace vp {
+
+static const std::set<std::string> NUMERIC_METRICS = {"cpu_percent", "rss", "threads", "fds", "restart_count"};
+
+AlertCondition parseAlertCondition(const std::string& condition) {
+    static const std::regex pattern(R"(^\s*(\w+)\s*(>=|<=|==|!=|>|<|=)\s*(\S+)\s*$)");
+    std::smatch m;
+    if (!std::regex_match(condition, m, pattern)) {
+        throw std::invalid_argument("invalid condition: " + condition + " (expected <metric> <op> <value>)");
+    }
+
+    AlertCondition cond;
+    cond.metric = m[1];
+    cond.op = m[2] == "=" ? "==" : std::string(m[2]);
+    std::string value = m[3];
+
+    if (cond.metric == "health") {
+        if (cond.op != "==" && cond.op != "!=") {
+            throw std::invalid_argument("health only supports == and !=");
+        }
+        if (value != "healthy" && value != "unhealthy") {
+            throw std::invalid_argument("health must be healthy or unhealthy");
+        }
+        cond.text = value;
+    } else if (cond.metric == "status") {
+        if (cond.op != "==" && cond.op != "!=") {
+            throw std::invalid_argument("status only supports == and !=");
+        }
+        const auto& statuses = instanceStatuses();
+        if (std::find(statuses.begin(), statuses.end(), value) == statuses.end()) {
+            throw std::invalid_argument("unknown status: " + value);
+        }
+        cond.text = value;
+    } else if (NUMERIC_METRICS.count(cond.metric)) {
+        cond.number = cond.metric == "rss" ? parseSize(value) : std::stod(value);
+    } else {
+        throw std::invalid_argument("unknown metric: " + cond.metric +
+                                    " (cpu_percent, rss, threads, fds, restart_count, health, status)");
+    }
+    return cond;
+}
+
+void validateAlertRule(const AlertRule& rule) {
+    if (rule.id.empty()) {
+        throw std::invalid_argument("alert rule id required");
+    }
+    parseAlertCondition(rule.condition);
+    if (rule.action != "restart" && rule.action != "webhook" && rule.action != "command") {
+        throw std::invalid_argument("action must be restart, webhook or command");
+    }
+    if (rule.action != "restart" && rule.target.empty()) {
+        throw std::invalid_argument(rule.action + " needs a target");
+    }
+    if (rule.action == "webhook") {
+        validateWebhookUrl(rule.target);
+    }
+    if (rule.duration < 0 || rule.cooldown < 0) {
+        throw std::invalid_argument("for and cooldown must not be negative");
+    }
+}
+
+static bool isWebhookUrl(const std::string& url) {
+    std::string lower = url;
+    std::transform(lower.begin(), lower.end(), lower.begin(), ::tolower);
+    return lower.rfind("http://", 0) == 0 || lower.rfind("https://", 0) == 0;
+}
+
+void validateWebhookUrl(const std::string& url) {
+    if (!isWebhookUrl(url)) {
+        throw std::invalid_argument("webhook must be an http:// or https:// URL: " + url);
+    }
+}
+
+static double numericValue(const AlertCondition& cond, const Instance& inst, double cpuPercent) {
+    if (cond.metric == "cpu_percent") return cpuPercent;
+    if (cond.metric == "rss") return inst.rss;
+    if (cond.metric == "threads") return inst.threads;
+    if (cond.metric == "fds") return inst.fds;
+    return inst.restarts;
+}
+
+bool conditionHolds(const AlertCondition& cond, const Instance& inst, double cpuPercent,
+                    const std::function<bool()>& healthy) {
+    if (cond.metric == "health") {
+        bool matches = (healthy() ? "healthy" : "unhealthy") == cond.text;
+        return cond.op == "==" ? matches : !matches;
+    }
+    if (cond.metric == "status") {
+        return cond.op == "==" ? inst.status == cond.text : inst.status != cond.text;
+    }
+
+    double value = numericValue(cond, inst, cpuPercent);
+    if (cond.op == ">") return value > cond.number;
+    if (cond.op == ">=") return value >= cond.number;
+    if (cond.op == "<") return value < cond.number;
+    if (cond.op == "<=") return value <= cond.number;
+    if (cond.op == "==") return value == cond.number;
+    return value != cond.number;
+}
+
+Event appendEvent(State& state, Event event) {
+    auto data = state.lock();
+    auto& events = state.events;
+    event.id = events.empty() ? 1 : events.back().id + 1;
+    events.push_back(event);
+    if (events.size() > MAX_EVENTS) {
+        events.erase(events.begin(), events.end() - MAX_EVENTS);
+    }
+    return event;
+}
+
+Event recordEvent(std::shared_ptr<State> state, Event event) {
+    auto data = state->lock();
+    event = appendEvent(*state, event);
+    state->save();
+    return event;
+}
+
+bool postWebhook(const std::string& url, const json& payload) {
+    // Rules and limits are checked when set, but state files can be edited
+    if (!isWebhookUrl(url)) {
+        return false;
+    }
+    std::string cmd = "curl -fsS --max-time 10 -X POST -H 'Content-Type: application/json' "
+                      "--data-binary @- -- " + shellQuote(url) + " >/dev/null";
+    FILE* pipe = popen(cmd.c_str(), "w");
+    if (!pipe) {
+        return false;
+    }
+    std::string body = payload.dump();
+    fwrite(body.data(), 1, body.size(), pipe);
+    return pclose(pipe) == 0;
+}
+
+std::vector<std::string> exceededLimits(const Instance& inst) {
+    std::vector<std::string> over;
+    if (!inst.limits) {
+        return over;
+    }
+    const Limits& limits = *inst.limits;
+    if (limits.max_rss > 0 && inst.rss > limits.max_rss) over.push_back("max_rss");
+    if (limits.max_cpu_percent > 0 && inst.cpu_percent > limits.max_cpu_percent) over.push_back("max_cpu_percent");
+    if (limits.max_fds > 0 && inst.fds > limits.max_fds) over.push_back("max_fds");
+    return over;
+}
+
+// "rss 2100MB over max_rss 2000MB"
+static std::string limitMessage(const Instance& inst, const std::string& limit) {
+    std::ostringstream out;
+    if (limit == "max_rss") {
+        out << "rss " << inst.rss / (1024 * 1024) << "MB over max_rss " << inst.limits->max_rss / (1024 * 1024) << "MB";
+    } else if (limit == "max_cpu_percent") {
+        out << "cpu " << (int)inst.cpu_percent << "% over max_cpu_percent " << inst.limits->max_cpu_percent << "%";
+    } else {
+        out << "fds " << inst.fds << " over max_fds " << inst.limits->max_fds;
+    }
+    return out.str();
+}
+
+bool checkLimits(State& state, Instance& inst, time_t now) {
+    auto data = state.lock();
+    std::vector<std::string> over = exceededLimits(inst);
+    if (over == inst.over_limit) {
+        return false;
+    }
+
+    for (const auto& limit : over) {
+        if (std::find(inst.over_limit.begin(), inst.over_limit.end(), limit) != inst.over_limit.end()) continue;
+
+        Event event;
+        event.time = now;
+        event.kind = "limit";
+        event.instance = inst.name;
+        event.rule = limit;
+        event.message = limitMessage(inst, limit);
+        event = appendEvent(state, event);
+        logWarn("instance over its limit", {{"name", inst.name}, {"limit", limit}, {"message", event.message}});
+
+        if (!inst.limits->webhook.empty()) {
+            json payload = {
+                {"instance", inst.name},
+                {"limit", limit},
+                {"message", event.message},
+                {"time", now}
+            };
+            std::thread([url = inst.limits->webhook, payload, name = inst.name]() {
+                if (!postWebhook(url, payload)) {
+                    logWarn("limit webhook failed", {{"instance", name}, {"url", url}});
+                }
+            }).detach();
+        }
+    }
+    for (const auto& limit : inst.over_limit) {
+        if (std::find(over.begin(), over.end(), limit) == over.end()) {
+            logInfo("instance back under its limit", {{"name", inst.name}, {"limit", limit}});
+        }
+    }
+    inst.over_limit = over;
+    return true;
+}
+
+// Run a fired rule's action. Called on its own thread: restarts and webhooks block.
+// pid and status are the instance's when the rule fired.
+static void runAlertAction(std::shared_ptr<State> state, const AlertRule& rule, std::shared_ptr<Instance> inst,
+                           int pid, const std::string& status, const std::string& value) {
+    auto data = state->lock();
+    bool ok = false;
+
+    if (rule.action == "restart") {
+        // Stopped, deleted or restarted since it fired: leave it be
+        auto current = state->instances.find(inst->name);
+        if (current == state->instances.end() || current->second != inst || inst->pid != pid ||
+            inst->status != status) {
+            logInfo("alert action skipped: instance changed", {{"rule", rule.id}, {"instance", inst->name}});
+            return;
+        }
+        ok = recycleProcess(state, inst);
+        if (ok) {
+            inst->restarted_at = time(nullptr);
+            inst->restart_reason = "alert " + rule.id + ": " + rule.condition;
+            state->save();
+        }
+    } else if (rule.action == "webhook") {
+        json payload = {
+            {"rule", rule.id},
+            {"instance", inst->name},
+            {"condition", rule.condition},
+            {"value", value},
+            {"time", time(nullptr)}
+        };
+        State::Unlocked unlocked(*state);
+        ok = postWebhook(rule.target, payload);
+    } else if (rule.action == "command") {
+        // The instance and rule are passed in the environment
+        std::string cmd = "export VP_INSTANCE=" + shellQuote(inst->name) +
+                          " VP_ALERT=" + shellQuote(rule.id) +
+                          " VP_VALUE=" + shellQuote(value) + "; " + rule.target;
+        State::Unlocked unlocked(*state);
+        ok = system(cmd.c_str()) == 0;
+    }
+
+    if (ok) {
+        logInfo("alert action done", {{"rule", rule.id}, {"instance", inst->name}, {"action", rule.action}});
+    } else {
+        logWarn("alert action failed", {{"rule", rule.id}, {"instance", inst->name}, {"action", rule.action}});
+    }
+}
+
+std::vector<Event> AlertEngine::evaluate(std::shared_ptr<State> state, const MetricsHistory* metrics, time_t now) {
+    auto data = state->lock();
+    std::vector<Event> fired;
+    std::set<std::string> holding;
+
+    // Copies: actions run in the background and rules may be edited meanwhile
+    std::map<std::string, AlertRule> rules = state->alerts;
+    std::map<std::string, std::shared_ptr<Instance>> instances = state->instances;
+
+    for (const auto& [id, rule] : rules) {
+        if (!rule.enabled) continue;
+
+        AlertCondition cond;
+        try {
+            cond = parseAlertCondition(rule.condition);
+        } catch (const std::exception& e) {
+            logWarn("skipping invalid alert rule", {{"rule", id}, {"error", e.what()}});
+            continue;
+        }
+
+        for (const auto& [name, inst] : instances) {
+            // Status conditions watch instances that are down too
+            if ((cond.metric != "status" && !instanceRunning(*inst)) || !matchesSelector(*inst, rule.selector)) continue;
+
+            MetricSample sample = {};
+            double cpu = metrics && metrics->latest(name, sample) ? sample.cpu_percent : 0;
+            bool healthy = true;
+            if (!conditionHolds(cond, *inst, cpu, [&]() {
+                    Instance probe = *inst;
+                    State::Unlocked unlocked(*state);
+                    return healthy = checkHealth(probe);
+                })) {
+                continue;
+            }
+
+            std::string key = id + "\n" + name;
+            holding.insert(key);
+            since_.emplace(key, now);
+            if (now - since_[key] < rule.duration) continue;
+
+            auto last = fired_.find(key);
+            if (last != fired_.end() && now - last->second < rule.cooldown) continue;
+            fired_[key] = now;
+
+            std::ostringstream value;
+            if (cond.metric == "health") {
+                value << (healthy ? "healthy" : "unhealthy");
+            } else if (cond.metric == "status") {
+                value << inst->status;
+            } else {
+                value << numericValue(cond, *inst, cpu);
+            }
+
+            Event event;
+            event.time = now;
+            event.kind = "alert";
+            event.instance = name;
+            event.rule = id;
+            event.message = rule.condition + " (" + value.str() + ")" +
+                            (rule.duration > 0 ? " for " + std::to_string(rule.duration) + "s" : "") +
+                            ": " + rule.action;
+            fired.push_back(recordEvent(state, event));
+            logWarn("alert fired", {{"rule", id}, {"instance", name}, {"value", value.str()}, {"action", rule.action}});
+
+            std::thread(runAlertAction, state, rule, inst, inst->pid, inst->status, value.str()).detach();
+        }
+    }
+
+    // Conditions that stopped holding start over
+    for (auto it = since_.begin(); it != since_.end();) {
+        if (holding.count(it->first)) {
+            ++it;
+        } else {
+            it = since_.erase(it);
+        }
+    }
+    return fired;
+}
+
+} // namespace vp
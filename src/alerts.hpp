@@ -0,0 +1,79 @@
+#ifndef VP_ALERTS_HPP
+#define VP_ALERTS_HPP
+
+#include "types.hpp"
+#include "state.hpp"
+#include "metrics.hpp"
+#include <functional>
+#include <map>
+#include <memory>
+#include <string>
+#include <vector>
+
+namespace vp {
+
+// Events kept in state
+constexpr size_t MAX_EVENTS = 500;
+
+// AlertCondition is a parsed AlertRule::condition, "<metric> <op> <value>":
+//   cpu_percent > 90     rss > 2GB     threads >= 500     fds > 1000
+//   restart_count > 3    health == unhealthy     status == crash-loop
+struct AlertCondition {
+    std::string metric;
+    std::string op;          // > >= < <= == !=
+    double number = 0;       // Threshold for numeric metrics
+    std::string text;        // healthy|unhealthy for health, an instance status for status
+};
+
+// Parse a condition; throws std::invalid_argument on unknown metrics or operators
+AlertCondition parseAlertCondition(const std::string& condition);
+
+// Check a rule's ID, condition, action and target; throws std::invalid_argument
+void validateAlertRule(const AlertRule& rule);
+
+// Check a webhook URL is http:// or https://; throws std::invalid_argument
+void validateWebhookUrl(const std::string& url);
+
+// Check a condition against an instance. cpuPercent comes from the metrics
+// history; healthy() is only called for health conditions (it may be slow).
+bool conditionHolds(const AlertCondition& cond, const Instance& inst, double cpuPercent,
+                    const std::function<bool()>& healthy);
+
+// Append an event to state.events (assigning its ID), dropping the oldest
+// beyond MAX_EVENTS. The caller saves.
+Event appendEvent(State& state, Event event);
+
+// appendEvent, then save
+Event recordEvent(std::shared_ptr<State> state, Event event);
+
+// POST payload as JSON to url (curl, 10s timeout). Blocks: call it with the
+// state unlocked. Returns true on a 2xx answer; false without trying for
+// anything but an http(s) URL.
+bool postWebhook(const std::string& url, const json& payload);
+
+// The template limits inst's last sample is over ("max_rss", "max_cpu_percent",
+// "max_fds"), in that order
+std::vector<std::string> exceededLimits(const Instance& inst);
+
+// Update inst.over_limit from its last sample, recording a "limit" event for
+// each limit it has just gone over (and POSTing it to the limits' webhook in
+// the background). Returns true if over_limit changed.
+bool checkLimits(State& state, Instance& inst, time_t now);
+
+// AlertEngine evaluates state->alerts against running instances. A rule fires
+// once its condition has held for the rule's duration, then not again for that
+// instance until its cooldown has passed.
+class AlertEngine {
+public:
+    // Check rules at time now and run the actions of those that fire (in the
+    // background). Returns the events recorded.
+    std::vector<Event> evaluate(std::shared_ptr<State> state, const MetricsHistory* metrics, time_t now);
+
+private:
+    std::map<std::string, time_t> since_;  // rule + instance -> when the condition started holding
+    std::map<std::string, time_t> fired_;  // rule + instance -> last firing
+};
+
+} // namespace vp
+
+#endif // VP_ALERTS_HPP
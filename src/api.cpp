@@ -2,15 +2,33 @@
 #include "process.hpp"
 #include "resource.hpp"
 #include "types.hpp"
+#include "logs.hpp"
+#include "logger.hpp"
+#include "pty.hpp"
+#include "websocket.hpp"
+#include "alerts.hpp"
+#include "systemd.hpp"
+#include "procutil.hpp"
+#include "secrets.hpp"
+#include <sys/stat.h>
+#include <climits>
 #include <sys/socket.h>
 #include <netinet/in.h>
 #include <arpa/inet.h>
 #include <unistd.h>
 #include <cstring>
+#include <strings.h>
+#include <cerrno>
+#include <algorithm>
+#include <iomanip>
 #include <sstream>
-#include <iostream>
+#include <set>
+#include <cstdint>
 #include <thread>
+#include <chrono>
+#include <cmath>
 #include <fstream>
+#include <regex>
 
 namespace vp {
 
@@ -25,123 +43,1395 @@ std::string readFile(const std::string& path) {
     return oss.str();
 }
 
+std::string staticFilePath(const std::string& webDir, const std::string& path) {
+    std::string route = path.substr(0, path.find('?'));
+    if (route.empty() || route[0] != '/') {
+        return "";
+    }
+    if (route == "/") {
+        route = "/index.html";
+    }
+
+    char root[PATH_MAX], resolved[PATH_MAX];
+    if (!realpath(webDir.c_str(), root) || !realpath((webDir + route).c_str(), resolved)) {
+        return "";
+    }
+
+    // Symlinks and ../ must not lead out of the directory
+    std::string rootDir = std::string(root) + "/";
+    struct stat st;
+    if (std::string(resolved).rfind(rootDir, 0) != 0 || stat(resolved, &st) != 0 || !S_ISREG(st.st_mode)) {
+        return "";
+    }
+    return resolved;
+}
+
+std::string staticContentType(const std::string& file) {
+    static const std::map<std::string, std::string> types = {
+        {".html", "text/html"}, {".js", "text/javascript"}, {".mjs", "text/javascript"},
+        {".css", "text/css"}, {".json", "application/json"}, {".svg", "image/svg+xml"},
+        {".png", "image/png"}, {".jpg", "image/jpeg"}, {".ico", "image/x-icon"},
+        {".woff2", "font/woff2"}, {".txt", "text/plain"}, {".map", "application/json"}};
+    size_t dot = file.rfind('.');
+    auto it = dot == std::string::npos ? types.end() : types.find(file.substr(dot));
+    return it != types.end() ? it->second : "application/octet-stream";
+}
+
+// Served at /login when vp has users; posts to /api/v1/login and goes on to ?next=
+static const char* LOGIN_HTML = R"HTML(<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Sign in - Visual Processmanager</title>
+    <style>
+        * { margin: 0; padding: 0; box-sizing: border-box; }
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', sans-serif; background: #f5f5f5; padding: 20px; }
+        form { max-width: 320px; margin: 80px auto; background: white; padding: 24px; border-radius: 8px; box-shadow: 0 2px 4px rgba(0,0,0,0.1); }
+        h1 { font-size: 20px; margin-bottom: 20px; }
+        label { display: block; font-size: 14px; color: #666; margin-bottom: 4px; }
+        input { width: 100%; padding: 8px; margin-bottom: 14px; border: 1px solid #ddd; border-radius: 4px; font-size: 14px; }
+        button { width: 100%; padding: 10px; border: none; border-radius: 4px; background: #007bff; color: white; font-size: 14px; cursor: pointer; }
+        .hint { font-size: 12px; color: #999; margin-top: -10px; margin-bottom: 14px; }
+        .error { color: #dc3545; font-size: 14px; margin-top: 12px; min-height: 1em; }
+    </style>
+</head>
+<body>
+    <form id="login">
+        <h1>Vibe Processmanager</h1>
+        <label for="username">Username</label>
+        <input id="username" autocomplete="username" autofocus>
+        <p class="hint">Leave empty to sign in with an API token</p>
+        <label for="password">Password or token</label>
+        <input id="password" type="password" autocomplete="current-password">
+        <button type="submit">Sign in</button>
+        <p class="error" id="error"></p>
+    </form>
+    <script>
+        document.getElementById('login').addEventListener('submit', async (e) => {
+            e.preventDefault();
+            const username = document.getElementById('username').value;
+            const password = document.getElementById('password').value;
+            const body = username ? { username, password } : { token: password };
+            const csrf = (document.cookie.match(/(?:^|; )vp_csrf=([^;]*)/) || [])[1] || '';
+            const res = await fetch('/api/v1/login', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json', 'X-VP-CSRF': csrf },
+                body: JSON.stringify(body)
+            });
+            if (!res.ok) {
+                document.getElementById('error').textContent = (await res.json()).error || 'Sign in failed';
+                return;
+            }
+            // Only local paths, so a crafted link can't send the session elsewhere
+            const next = new URLSearchParams(location.search).get('next') || '/';
+            location = /^\/(?![\/\\])/.test(next) ? next : '/';
+        });
+    </script>
+</body>
+</html>
+)HTML";
+
 static std::shared_ptr<State> g_state;
+static std::shared_ptr<MetricsHistory> g_metrics;
+static ServeOptions g_options;
+static JobStore g_jobs;                // Async starts, for GET /api/jobs
+static std::string g_bootId = std::to_string(time(nullptr)); // Revisions restart with vp
+
+// Get a query string parameter from a request path ("" if absent)
+std::string queryParam(const std::string& path, const std::string& key) {
+    size_t q = path.find('?');
+    if (q == std::string::npos) return "";
+
+    std::istringstream iss(path.substr(q + 1));
+    std::string pair;
+    while (std::getline(iss, pair, '&')) {
+        size_t eq = pair.find('=');
+        if (pair.substr(0, eq) == key) {
+            return eq == std::string::npos ? "true" : pair.substr(eq + 1);
+        }
+    }
+    return "";
+}
+
+// Undo %XX escapes in a query value (e.g. ?origin=http%3A%2F%2Fhost)
+static std::string percentDecode(const std::string& value) {
+    std::string out;
+    for (size_t i = 0; i < value.size(); i++) {
+        if (value[i] == '%' && i + 2 < value.size() && isxdigit((unsigned char)value[i + 1]) &&
+            isxdigit((unsigned char)value[i + 2])) {
+            out += (char)std::stoi(value.substr(i + 1, 2), nullptr, 16);
+            i += 2;
+        } else {
+            out += value[i] == '+' ? ' ' : value[i];
+        }
+    }
+    return out;
+}
+
+// Escape a value for a query string: all but unreserved characters become %XX
+static std::string percentEncode(const std::string& value) {
+    std::ostringstream out;
+    for (unsigned char c : value) {
+        if (isalnum(c) || c == '-' || c == '_' || c == '.' || c == '~') {
+            out << c;
+        } else {
+            out << '%' << std::uppercase << std::hex << std::setw(2) << std::setfill('0') << (int)c;
+        }
+    }
+    return out.str();
+}
+
+static std::set<std::string> splitList(const std::string& value) {
+    std::set<std::string> items;
+    std::stringstream ss(value);
+    for (std::string item; std::getline(ss, item, ',');) {
+        if (!item.empty()) items.insert(item);
+    }
+    return items;
+}
+
+static size_t countParam(const std::string& path, const std::string& key, size_t fallback) {
+    std::string value = queryParam(path, key);
+    if (value.empty()) return fallback;
+    if (value.find_first_not_of("0123456789") != std::string::npos || value.size() > 9) {
+        throw std::invalid_argument("invalid " + key + ": " + value);
+    }
+    return std::stoul(value);
+}
+
+json shapeList(const json& items, const std::string& path, size_t& total) {
+    auto fields = splitList(queryParam(path, "fields"));
+    auto omit = splitList(queryParam(path, "omit"));
+    size_t offset = countParam(path, "offset", 0);
+    size_t limit = countParam(path, "limit", SIZE_MAX);
+
+    auto shape = [&](const json& item) {
+        if (!item.is_object() || (fields.empty() && omit.empty())) return item;
+        json shaped = json::object();
+        for (const auto& [key, value] : item.items()) {
+            if ((fields.empty() || fields.count(key)) && !omit.count(key)) {
+                shaped[key] = value;
+            }
+        }
+        return shaped;
+    };
+
+    total = items.size();
+    json result = items.is_array() ? json::array() : json::object();
+    size_t i = 0;
+    for (auto it = items.begin(); it != items.end(); ++it, ++i) {
+        if (i < offset) continue;
+        if (i - offset >= limit) break;
+        if (items.is_array()) {
+            result.push_back(shape(*it));
+        } else {
+            result[it.key()] = shape(*it);
+        }
+    }
+    return result;
+}
+
+std::string negotiateVersion(Request& req, bool& deprecated) {
+    deprecated = false;
+    if (req.path.rfind("/api/", 0) != 0) {
+        return "";
+    }
+
+    std::string requested;
+    auto header = req.headers.find("x-vp-api-version");
+    if (header != req.headers.end()) {
+        requested = header->second;
+    }
+
+    // /api/v<N>/rest -> /api/rest
+    const std::string current = "/api/v" + std::to_string(API_VERSION) + "/";
+    if (req.path.rfind(current, 0) == 0) {
+        req.path = "/api/" + req.path.substr(current.size());
+    } else if (req.path.size() > 6 && req.path[5] == 'v' && isdigit((unsigned char)req.path[6])) {
+        size_t end = req.path.find_first_not_of("0123456789", 6);
+        if (end == std::string::npos || req.path[end] == '/' || req.path[end] == '?') {
+            requested = req.path.substr(6, end == std::string::npos ? std::string::npos : end - 6);
+        }
+    } else {
+        deprecated = true;
+    }
+
+    if (!requested.empty() && requested != std::to_string(API_VERSION)) {
+        std::string error_body = json{{"error", "Unsupported API version " + requested},
+                                      {"supported", {std::to_string(API_VERSION)}}}.dump();
+        std::ostringstream response;
+        response << "HTTP/1.1 400 Bad Request\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << error_body.length() << "\r\n";
+        response << "\r\n";
+        response << error_body;
+        return response.str();
+    }
+    return "";
+}
+
+json watchResult(State& state, unsigned long long since) {
+    bool complete = false;
+    auto changes = state.changesSince(since, complete);
+    json result = {{"revision", state.revision()}};
+    if (!complete) {
+        result["reset"] = true;
+        return result;
+    }
+
+    result["changes"] = json::array();
+    for (const auto& [revision, change] : changes) {
+        json entry = {{"revision", revision}, {"kind", change.kind}, {"name", change.name}, {"op", change.op}};
+        if (change.op != "removed") {
+            if (change.kind == "instance" && state.instances.count(change.name)) {
+                entry["value"] = *state.instances.at(change.name);
+            } else if (change.kind == "template" && state.templates.count(change.name)) {
+                entry["value"] = *state.templates[change.name];
+            } else if (change.kind == "type" && state.types.count(change.name)) {
+                entry["value"] = *state.types[change.name];
+            } else if (change.kind == "alert" && state.alerts.count(change.name)) {
+                entry["value"] = state.alerts[change.name];
+            }
+        }
+        result["changes"].push_back(entry);
+    }
+    return result;
+}
+
+bool etagRoute(const std::string& path) {
+    std::string route = path.substr(0, path.find('?'));
+    return route == "/api/instances" || route == "/api/templates" || route == "/api/config";
+}
+
+std::string applyETag(const Request& req, const std::string& etag, const std::string& response) {
+    if (response.rfind("HTTP/1.1 200 ", 0) != 0) {
+        return response;
+    }
+
+    // If-None-Match may list several tags, or be "*"
+    auto match = req.headers.find("if-none-match");
+    if (match != req.headers.end()) {
+        std::stringstream tags(match->second);
+        for (std::string tag; std::getline(tags, tag, ',');) {
+            tag.erase(0, tag.find_first_not_of(' '));
+            tag.erase(tag.find_last_not_of(' ') + 1);
+            if (tag == etag || tag == "W/" + etag || tag == "*") {
+                return "HTTP/1.1 304 Not Modified\r\nETag: " + etag + "\r\nCache-Control: no-cache\r\n\r\n";
+            }
+        }
+    }
+
+    std::string with = response;
+    with.insert(with.find("\r\n") + 2, "ETag: " + etag + "\r\nCache-Control: no-cache\r\n");
+    return with;
+}
+
+Request parseRequest(const std::string& raw) {
+    Request req;
+
+    size_t headerEnd = raw.find("\r\n\r\n");
+    std::istringstream iss(raw.substr(0, headerEnd));
+    std::string line, version;
+    std::getline(iss, line);
+    std::istringstream(line) >> req.method >> req.path >> version;
+
+    while (std::getline(iss, line)) {
+        if (!line.empty() && line.back() == '\r') line.pop_back();
+        size_t colon = line.find(':');
+        if (colon == std::string::npos) continue;
+
+        std::string name = line.substr(0, colon);
+        std::transform(name.begin(), name.end(), name.begin(), ::tolower);
+        size_t start = line.find_first_not_of(' ', colon + 1);
+        req.headers[name] = start == std::string::npos ? "" : line.substr(start);
+    }
+
+    if (headerEnd != std::string::npos) {
+        req.body = raw.substr(headerEnd + 4);
+    }
+    return req;
+}
+
+bool isTerminalPath(const std::string& path) {
+    std::string p = path.substr(0, path.find('?'));
+    const std::string prefix = "/api/instances/", suffix = "/terminal";
+    return p.size() > prefix.size() + suffix.size() && p.rfind(prefix, 0) == 0 &&
+           p.compare(p.size() - suffix.size(), suffix.size(), suffix) == 0;
+}
+
+std::string requiredRole(const std::string& method, const std::string& path) {
+    // Terminal input runs arbitrary commands
+    if (isTerminalPath(path)) {
+        return "admin";
+    }
+    if (method == "GET" || method == "OPTIONS") {
+        return "viewer";
+    }
+    std::string p = path.substr(0, path.find('?'));
+    // The batch endpoint does what POST /api/instances does, for many at once
+    if (p == "/api/instances" || p == "/api/instances/batch" || p == "/api/execute-action" || p == "/api/monitor") {
+        return "operator";
+    }
+    if (p.rfind("/api/instances/", 0) == 0 && p.size() > 23 && p.compare(p.size() - 8, 8, "/refresh") == 0) {
+        return "operator";
+    }
+    return "admin";
+}
+
+bool roleAllows(const std::string& role, const std::string& required) {
+    static const std::map<std::string, int> rank = {{"viewer", 1}, {"operator", 2}, {"admin", 3}};
+    auto have = rank.find(role);
+    auto need = rank.find(required);
+    return have != rank.end() && need != rank.end() && have->second >= need->second;
+}
+
+std::string requestToken(const Request& req) {
+    auto auth = req.headers.find("authorization");
+    if (auth != req.headers.end() && auth->second.rfind("Bearer ", 0) == 0) {
+        return auth->second.substr(7);
+    }
+
+    std::string query = queryParam(req.path, "token");
+    if (!query.empty()) {
+        return query;
+    }
+
+    return requestCookie(req, "vp_token");
+}
+
+std::string requestCookie(const Request& req, const std::string& name) {
+    auto cookie = req.headers.find("cookie");
+    if (cookie != req.headers.end()) {
+        std::istringstream iss(cookie->second);
+        std::string pair;
+        while (std::getline(iss, pair, ';')) {
+            size_t start = pair.find_first_not_of(' ');
+            if (start != std::string::npos && pair.compare(start, name.size() + 1, name + "=") == 0) {
+                return pair.substr(start + name.size() + 1);
+            }
+        }
+    }
+
+    return "";
+}
+
+std::string generateToken() {
+    unsigned char bytes[16];
+    std::ifstream urandom("/dev/urandom", std::ios::binary);
+    if (!urandom.read(reinterpret_cast<char*>(bytes), sizeof(bytes))) {
+        throw std::runtime_error("cannot read /dev/urandom");
+    }
+
+    std::ostringstream oss;
+    for (unsigned char b : bytes) {
+        oss << std::hex << std::setw(2) << std::setfill('0') << (int)b;
+    }
+    return oss.str();
+}
+
+// Constant-time comparison so response timing doesn't leak token prefixes
+static bool tokenEquals(const std::string& a, const std::string& b) {
+    if (a.size() != b.size()) return false;
+    unsigned char diff = 0;
+    for (size_t i = 0; i < a.size(); i++) {
+        diff |= a[i] ^ b[i];
+    }
+    return diff == 0;
+}
+
+bool originAllowed(const std::map<std::string, bool>& remotesAllowed, const std::string& origin) {
+    auto it = remotesAllowed.find(origin);
+    if (it != remotesAllowed.end()) {
+        return it->second;
+    }
+    auto any = remotesAllowed.find("*");
+    return any != remotesAllowed.end() && any->second;
+}
+
+// Address as 16 bytes, IPv4 mapped into ::ffff:0:0/96
+static bool parseAddress(const std::string& text, unsigned char out[16]) {
+    struct in_addr v4;
+    if (inet_pton(AF_INET, text.c_str(), &v4) == 1) {
+        memset(out, 0, 10);
+        out[10] = out[11] = 0xff;
+        memcpy(out + 12, &v4, 4);
+        return true;
+    }
+    return inet_pton(AF_INET6, text.c_str(), out) == 1;
+}
+
+bool cidrContains(const std::string& cidr, const std::string& ip) {
+    size_t slash = cidr.find('/');
+    std::string base = cidr.substr(0, slash);
+    bool v4 = base.find(':') == std::string::npos;
+    unsigned char net[16], addr[16];
+    if (!parseAddress(base, net)) {
+        throw std::invalid_argument("not a network: " + cidr);
+    }
+
+    int bits = v4 ? 32 : 128;
+    if (slash != std::string::npos) {
+        std::string len = cidr.substr(slash + 1);
+        if (len.empty() || len.size() > 3 || len.find_first_not_of("0123456789") != std::string::npos || std::stoi(len) > bits) {
+            throw std::invalid_argument("not a network: " + cidr);
+        }
+        bits = std::stoi(len);
+    }
+    if (v4) {
+        bits += 96;
+    }
+
+    if (!parseAddress(ip, addr)) {
+        return false;
+    }
+    for (int i = 0; i < bits; i++) {
+        if ((net[i / 8] ^ addr[i / 8]) & (0x80 >> (i % 8))) {
+            return false;
+        }
+    }
+    return true;
+}
+
+bool remoteAllowed(const std::vector<std::string>& cidrs, const std::string& ip) {
+    if (cidrs.empty() || ip.empty() || cidrContains("127.0.0.0/8", ip) || cidrContains("::1", ip)) {
+        return true;
+    }
+    for (const auto& cidr : cidrs) {
+        if (cidrContains(cidr, ip)) {
+            return true;
+        }
+    }
+    return false;
+}
+
+std::string csrfError(const Request& req, const std::map<std::string, bool>& remotesAllowed) {
+    // A token the client sent itself can't have been attached by another page
+    auto auth = req.headers.find("authorization");
+    if ((auth != req.headers.end() && auth->second.rfind("Bearer ", 0) == 0) || !queryParam(req.path, "token").empty()) {
+        return "";
+    }
+
+    // Browsers name the page a request comes from; other sites only get in through the allowlist
+    auto origin = req.headers.find("origin");
+    if (origin != req.headers.end()) {
+        auto host = req.headers.find("host");
+        size_t scheme = origin->second.find("://");
+        bool sameOrigin = host != req.headers.end() && scheme != std::string::npos &&
+                          strcasecmp(origin->second.substr(scheme + 3).c_str(), host->second.c_str()) == 0;
+        if (!sameOrigin) {
+            if (!originAllowed(remotesAllowed, origin->second)) {
+                return "Cross-site request from " + origin->second + " refused";
+            }
+            // Explicitly listed origins are trusted with cookies (see applyCors);
+            // ones "*" lets in still need the token when they bring any
+            if (remotesAllowed.count(origin->second)) {
+                return "";
+            }
+        }
+    }
+
+    // Cookies are attached by the browser whoever asks, so with them the
+    // request must also echo the vp_csrf cookie, which only our pages can read
+    if (requestCookie(req, "vp_session").empty() && requestCookie(req, "vp_token").empty()) {
+        return "";
+    }
+    std::string cookie = requestCookie(req, "vp_csrf");
+    auto header = req.headers.find("x-vp-csrf");
+    if (cookie.empty() || header == req.headers.end() || !tokenEquals(header->second, cookie)) {
+        return "Missing or invalid CSRF token (X-VP-CSRF must echo the vp_csrf cookie)";
+    }
+    return "";
+}
+
+std::string normalizeOrigin(const std::string& origin) {
+    if (origin == "*") {
+        return origin;
+    }
+    std::string lower;
+    for (char c : origin) lower += (char)tolower((unsigned char)c);
+    if (!lower.empty() && lower.back() == '/') lower.pop_back();
+
+    static const std::regex valid("[a-z][a-z0-9+.-]*://[a-z0-9.-]+(:[0-9]{1,5})?|[a-z][a-z0-9+.-]*://\\[[0-9a-f:.]+\\](:[0-9]{1,5})?");
+    if (!std::regex_match(lower, valid)) {
+        throw std::invalid_argument("not an origin: " + origin + " (scheme://host[:port], or *)");
+    }
+    return lower;
+}
+
+// Add CORS headers for allowed cross-origin requests. Same-origin requests
+// (no Origin header) need none; disallowed origins get none, so browsers block them.
+static std::string applyCors(const Request& req, std::string response) {
+    auto origin = req.headers.find("origin");
+    if (origin == req.headers.end() || !originAllowed(g_state->remotesAllowed, origin->second)) {
+        return response;
+    }
+
+    // Only explicitly listed origins may send cookies; "*" gets anonymous access
+    std::string headers = "Vary: Origin\r\n";
+    if (g_state->remotesAllowed.count(origin->second)) {
+        headers += "Access-Control-Allow-Origin: " + origin->second + "\r\n"
+                   "Access-Control-Allow-Credentials: true\r\n";
+    } else {
+        headers += "Access-Control-Allow-Origin: *\r\n";
+    }
+    headers += "Access-Control-Expose-Headers: X-Total-Count, ETag, X-VP-API-Version, Deprecation, Link\r\n";
+    if (req.method == "OPTIONS") {
+        headers += "Access-Control-Allow-Methods: GET, POST, DELETE, OPTIONS\r\n"
+                   "Access-Control-Allow-Headers: Content-Type, Authorization, X-VP-API-Version\r\n";
+    }
+    response.insert(response.find("\r\n") + 2, headers);
+    return response;
+}
+
+// Configured token matching the request's token, or nullptr
+static const ApiToken* findToken(const Request& req) {
+    std::string token = requestToken(req);
+    const ApiToken* match = nullptr;
+    for (const auto& [name, t] : g_state->tokens) {
+        if (!token.empty() && tokenEquals(token, t.token)) {
+            match = &t;
+        }
+    }
+    return match;
+}
+
+std::string SessionStore::create(Session session, long ttl, time_t now) {
+    std::string id = generateToken() + generateToken();
+    session.expires = now + ttl;
+
+    std::lock_guard<std::mutex> lock(mutex_);
+    for (auto it = sessions_.begin(); it != sessions_.end();) {
+        it = it->second.expires <= now ? sessions_.erase(it) : std::next(it);
+    }
+    sessions_[id] = session;
+    return id;
+}
+
+bool SessionStore::find(const std::string& id, time_t now, Session& session) {
+    std::lock_guard<std::mutex> lock(mutex_);
+    auto it = sessions_.find(id);
+    if (it == sessions_.end()) {
+        return false;
+    }
+    if (it->second.expires <= now) {
+        sessions_.erase(it);
+        return false;
+    }
+    session = it->second;
+    return true;
+}
+
+void SessionStore::remove(const std::string& id) {
+    std::lock_guard<std::mutex> lock(mutex_);
+    sessions_.erase(id);
+}
+
+static SessionStore g_sessions;
+
+// Role the request's credentials grant: its token's, or its login session's
+// while that session's user or token still exists unchanged. "" if none.
+static std::string requestRole(const Request& req, Session* session = nullptr) {
+    if (const ApiToken* match = findToken(req)) {
+        return match->role;
+    }
+
+    Session found;
+    std::string id = requestCookie(req, "vp_session");
+    if (id.empty() || !g_sessions.find(id, time(nullptr), found)) {
+        return "";
+    }
+    if (session) {
+        *session = found;
+    }
+    // Users and tokens change in the state file (vp user passwd, vp token add),
+    // so compare what the session started with rather than wait to be told
+    if (!found.user.empty()) {
+        auto user = g_state->users.find(found.user);
+        if (user != g_state->users.end() && user->second.password_hash == found.credential) {
+            return user->second.role;
+        }
+    } else {
+        auto token = g_state->tokens.find(found.token);
+        if (token != g_state->tokens.end() && token->second.token == found.credential) {
+            return token->second.role;
+        }
+    }
+    g_sessions.remove(id);
+    return "";
+}
+
+// Check the request's token or session against its required role. Returns an
+// error response, or "" if allowed. With no tokens or users configured the API is open.
+static std::string authorize(const Request& req) {
+    if (g_state->tokens.empty() && g_state->users.empty()) {
+        return "";
+    }
+
+    // Preflights carry no credentials, and monitors probing health hold none.
+    // The UI page is static, so with tokens only it is served to anyone and its
+    // API calls are checked; with users it takes a login first.
+    std::string route = req.path.substr(0, req.path.find('?'));
+    std::string role = requestRole(req);
+    bool page = req.method == "GET" && route.rfind("/api/", 0) != 0;
+    bool open = route == "/login" || route == "/healthz" || route == "/readyz";
+    if (req.method == "OPTIONS" || route == "/api/login" || route == "/api/logout" || route == "/api/session" ||
+        (role.empty() && page && (open || g_state->users.empty()))) {
+        return "";
+    }
+
+    std::ostringstream response;
+    if (role.empty() && page) {
+        response << "HTTP/1.1 303 See Other\r\n";
+        response << "Location: /login?next=" << percentEncode(route) << "\r\n";
+        response << "Content-Length: 0\r\n";
+        response << "\r\n";
+        return response.str();
+    }
+    if (role.empty()) {
+        std::string error_body = R"({"error": "Missing or invalid token"})";
+        response << "HTTP/1.1 401 Unauthorized\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "WWW-Authenticate: Bearer\r\n";
+        response << "Content-Length: " << error_body.length() << "\r\n";
+        response << "\r\n";
+        response << error_body;
+        return response.str();
+    }
+
+    std::string required = requiredRole(req.method, req.path);
+    if (!roleAllows(role, required)) {
+        std::string error_body = R"({"error": "Token role does not allow this request"})";
+        response << "HTTP/1.1 403 Forbidden\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << error_body.length() << "\r\n";
+        response << "\r\n";
+        response << error_body;
+        logWarn("forbidden", {{"method", req.method}, {"path", req.path}, {"role", role}, {"required", required}});
+        return response.str();
+    }
+
+    return "";
+}
+
+static std::string jsonResponse(const std::string& status, const json& body, const std::string& headers = "") {
+    std::string body_str = body.dump(2);
+    std::ostringstream response;
+    response << "HTTP/1.1 " << status << "\r\n";
+    response << "Content-Type: application/json\r\n";
+    response << headers;
+    response << "Content-Length: " << body_str.length() << "\r\n";
+    response << "\r\n";
+    response << body_str;
+    return response.str();
+}
+
+// POST /api/login {"username", "password"} or {"token"}: start a session and
+// set its cookie. POST /api/logout ends it. GET /api/session says who the
+// request's credentials belong to. Returns "" for other requests.
+static std::string handleSession(const Request& req) {
+    std::string route = req.path.substr(0, req.path.find('?'));
+
+    if (route == "/api/login" && req.method == "POST") {
+        if (g_state->tokens.empty() && g_state->users.empty()) {
+            return jsonResponse("400 Bad Request", {{"error", "Login is not enabled: add a user with vp user add"}});
+        }
+        json body = json::parse(req.body, nullptr, false);
+        if (!body.is_object()) {
+            return jsonResponse("400 Bad Request", {{"error", "Invalid JSON"}});
+        }
+
+        Session session;
+        std::string role;
+        std::string username = body.value("username", "");
+        if (!username.empty()) {
+            auto user = g_state->users.find(username);
+            if (user != g_state->users.end() && verifyPassword(body.value("password", ""), user->second.password_hash)) {
+                session.user = username;
+                session.credential = user->second.password_hash;
+                role = user->second.role;
+            }
+        } else {
+            std::string token = body.value("token", "");
+            for (const auto& [name, t] : g_state->tokens) {
+                if (!token.empty() && tokenEquals(token, t.token)) {
+                    session.token = name;
+                    session.credential = t.token;
+                    role = t.role;
+                }
+            }
+        }
+        if (role.empty()) {
+            // Slow down guessing; the rate limit (--rate) caps it per client
+            {
+                State::Unlocked unlocked(*g_state);
+                std::this_thread::sleep_for(std::chrono::seconds(1));
+            }
+            logWarn("login failed", {{"user", username}, {"remote", req.remote}});
+            return jsonResponse("401 Unauthorized", {{"error", "Invalid username or password"}});
+        }
+
+        time_t now = time(nullptr);
+        std::string id = g_sessions.create(session, g_options.sessionTtl, now);
+        logInfo("login", {{"user", session.user}, {"token", session.token}, {"remote", req.remote}});
+        json result = {{"role", role}, {"expires_at", now + g_options.sessionTtl}};
+        result[session.user.empty() ? "token" : "user"] = session.user.empty() ? session.token : session.user;
+        return jsonResponse("200 OK", result,
+                            "Set-Cookie: vp_session=" + id + "; HttpOnly; SameSite=Strict; Path=/; Max-Age=" +
+                                std::to_string(g_options.sessionTtl) + "\r\n");
+    }
+
+    if (route == "/api/logout" && req.method == "POST") {
+        g_sessions.remove(requestCookie(req, "vp_session"));
+        return jsonResponse("200 OK", {{"success", true}},
+                            "Set-Cookie: vp_session=; HttpOnly; SameSite=Strict; Path=/; Max-Age=0\r\n"
+                            "Set-Cookie: vp_token=; HttpOnly; SameSite=Strict; Path=/; Max-Age=0\r\n");
+    }
+
+    if (route == "/api/session" && req.method == "GET") {
+        if (g_state->tokens.empty() && g_state->users.empty()) {
+            return jsonResponse("200 OK", {{"auth", false}, {"role", "admin"}});
+        }
+        Session session;
+        std::string role = requestRole(req, &session);
+        if (role.empty()) {
+            return jsonResponse("401 Unauthorized", {{"error", "Not logged in"}});
+        }
+        json result = {{"auth", true}, {"role", role}};
+        if (!session.user.empty()) result["user"] = session.user;
+        if (!session.token.empty()) result["token"] = session.token;
+        if (session.expires) result["expires_at"] = session.expires;
+        return jsonResponse("200 OK", result);
+    }
+
+    return "";
+}
 
 std::string handleRequest(const std::string& method, const std::string& path, const std::string& body) {
     std::ostringstream response;
 
-    // Handle CORS preflight
-    if (method == "OPTIONS") {
-        response << "HTTP/1.1 204 No Content\r\n";
-        response << "Access-Control-Allow-Origin: *\r\n";
-        response << "Access-Control-Allow-Methods: GET, POST, DELETE, OPTIONS\r\n";
-        response << "Access-Control-Allow-Headers: Content-Type\r\n";
-        response << "\r\n";
-        return response.str();
+    // Handle CORS preflight (allow headers are added by applyCors)
+    if (method == "OPTIONS") {
+        response << "HTTP/1.1 204 No Content\r\n";
+        response << "\r\n";
+        return response.str();
+    }
+
+    // --web-dir: the user's own frontend, file by file
+    if (!g_options.webDir.empty() && method == "GET" && path.rfind("/api/", 0) != 0) {
+        std::string file = staticFilePath(g_options.webDir, path);
+        if (file.empty() && (path == "/" || path.rfind("/?", 0) == 0)) {
+            file = staticFilePath(g_options.webDir, "/web.html");
+        }
+        if (!file.empty()) {
+            std::string content = readFile(file);
+            response << "HTTP/1.1 200 OK\r\n";
+            response << "Content-Type: " << staticContentType(file) << "\r\n";
+            response << "Content-Length: " << content.length() << "\r\n";
+            response << "\r\n";
+            response << content;
+            return response.str();
+        }
+    }
+
+    // Serve web.html from file
+    if ((path == "/" || path.rfind("/?", 0) == 0) && method == "GET") {
+        std::string html = readFile("web.html");
+        if (html.empty()) {
+            html = "<html><body><h1>VP Process Manager</h1><p>Error: web.html not found</p></body></html>";
+        }
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: text/html\r\n";
+        response << "Content-Length: " << html.length() << "\r\n";
+        response << "\r\n";
+        response << html;
+        return response.str();
+    }
+
+    // GET /login - Sign-in page for vp user accounts (or an API token)
+    if (path.substr(0, path.find('?')) == "/login" && method == "GET") {
+        std::string html = LOGIN_HTML;
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: text/html\r\n";
+        response << "Content-Length: " << html.length() << "\r\n";
+        response << "\r\n";
+        response << html;
+        return response.str();
+    }
+
+    // GET /healthz, /readyz - For external monitors: 503 when vp is wedged or can't save
+    if ((path == "/healthz" || path == "/readyz") && method == "GET") {
+        json result = selfCheck(path == "/readyz", time(nullptr));
+        std::string body_str = result.dump(2);
+        bool ok = result["status"] == "ok";
+        response << (ok ? "HTTP/1.1 200 OK\r\n" : "HTTP/1.1 503 Service Unavailable\r\n");
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // GET /api/self - vp's own resource use, with vp serve --debug
+    if (path == "/api/self" && method == "GET" && g_options.debug) {
+        std::string body_str = selfStats(*g_state).dump(2);
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // GET /api/instances/<name>/metrics?range=1h - Sampled history for sparklines
+    std::string route = path.substr(0, path.find('?'));
+    if (route.rfind("/api/instances/", 0) == 0 && route.size() > 23 &&
+        route.compare(route.size() - 8, 8, "/metrics") == 0 && method == "GET") {
+        std::string name = route.substr(15, route.size() - 15 - 8);
+        std::string range = queryParam(path, "range");
+
+        if (g_state->instances.find(name) == g_state->instances.end()) {
+            std::string error_body = R"({"error": "Instance not found"})";
+            response << "HTTP/1.1 404 Not Found\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+
+        long seconds = 3600;
+        try {
+            if (!range.empty()) seconds = parseDuration(range);
+        } catch (const std::exception&) {
+            seconds = 0;
+        }
+        if (seconds <= 0) {
+            std::string error_body = R"({"error": "Invalid range, e.g. 15m, 1h or 1d"})";
+            response << "HTTP/1.1 400 Bad Request\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+
+        json samples = json::array();
+        if (g_metrics) {
+            for (const auto& sample : g_metrics->query(name, seconds, time(nullptr))) {
+                samples.push_back({
+                    {"t", sample.t},
+                    {"cpu", sample.cpu_percent},
+                    {"rss", sample.rss},
+                    {"read", sample.read_rate},
+                    {"write", sample.write_rate}
+                });
+            }
+        }
+        json result = {
+            {"instance", name},
+            {"range", seconds},
+            {"interval", g_metrics ? g_metrics->interval() : 0},
+            {"samples", samples}
+        };
+        std::string body_str = result.dump();
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // GET /api/instances/<name>/timeline?since=12h - Status changes with their causes
+    if (route.rfind("/api/instances/", 0) == 0 && route.size() > 24 &&
+        route.compare(route.size() - 9, 9, "/timeline") == 0 && method == "GET") {
+        std::string name = route.substr(15, route.size() - 15 - 9);
+        std::string since = queryParam(path, "since");
+
+        if (g_state->instances.find(name) == g_state->instances.end()) {
+            std::string error_body = R"({"error": "Instance not found"})";
+            response << "HTTP/1.1 404 Not Found\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+
+        long seconds = 0;
+        try {
+            if (!since.empty()) seconds = parseDuration(since);
+        } catch (const std::exception&) {
+            seconds = -1;
+        }
+        if (seconds < 0 || (!since.empty() && seconds == 0)) {
+            std::string error_body = R"({"error": "Invalid since, e.g. 15m, 12h or 1d"})";
+            response << "HTTP/1.1 400 Bad Request\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+
+        json timeline = json::array();
+        auto it = g_state->timelines.find(name);
+        if (it != g_state->timelines.end()) {
+            time_t cutoff = seconds ? time(nullptr) - seconds : 0;
+            for (const auto& change : it->second) {
+                if (change.time >= cutoff) {
+                    timeline.push_back(change);
+                }
+            }
+        }
+        json result = {{"instance", name}, {"timeline", timeline}};
+        std::string body_str = result.dump();
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // POST /api/instances/<name>/refresh - Re-read its process, claim new ports, report changes
+    if (route.rfind("/api/instances/", 0) == 0 && route.size() > 23 &&
+        route.compare(route.size() - 8, 8, "/refresh") == 0 && method == "POST") {
+        std::string name = route.substr(15, route.size() - 15 - 8);
+        auto it = g_state->instances.find(name);
+        if (it == g_state->instances.end()) {
+            std::string error_body = R"({"error": "Instance not found"})";
+            response << "HTTP/1.1 404 Not Found\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+
+        try {
+            json changes = json::array();
+            for (const auto& change : refreshInstance(g_state, it->second)) {
+                changes.push_back({{"field", change.field}, {"from", change.a}, {"to", change.b}});
+            }
+            json result = {{"instance", *it->second}, {"changes", changes}};
+            std::string body_str = result.dump(2);
+
+            response << "HTTP/1.1 200 OK\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << body_str.length() << "\r\n";
+            response << "\r\n";
+            response << body_str;
+        } catch (const std::exception& e) {
+            std::string error_body = json{{"error", e.what()}}.dump();
+            response << "HTTP/1.1 409 Conflict\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+        }
+        return response.str();
+    }
+
+    // GET /api/instances[?project=P][&selector=k=v,...]
+    if (path.find("/api/instances") == 0 && method == "GET") {
+        matchAndUpdateInstances(g_state);
+        std::string project = queryParam(path, "project");
+        std::string selector = queryParam(path, "selector");
+
+        // Serialize instances to JSON
+        json instances_json = json::object();
+        for (const auto& [key, value] : g_state->instances) {
+            if ((project.empty() || value->project == project) && matchesSelector(*value, selector)) {
+                instances_json[key] = *value;
+            }
+        }
+
+        // [&fields=a,b][&omit=a,b][&offset=N][&limit=N]
+        size_t total = 0;
+        try {
+            instances_json = shapeList(instances_json, path, total);
+        } catch (const std::invalid_argument& e) {
+            std::string error_body = json{{"error", e.what()}}.dump();
+            response << "HTTP/1.1 400 Bad Request\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+        std::string body = instances_json.dump(2);
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "X-Total-Count: " << total << "\r\n";
+        response << "Content-Length: " << body.length() << "\r\n";
+        response << "\r\n";
+        response << body;
+        return response.str();
+    }
+
+    if (path == "/api/templates" && method == "GET") {
+        // Serialize templates to JSON
+        json templates_json = json::object();
+        for (const auto& [key, value] : g_state->templates) {
+            templates_json[key] = *value;
+        }
+        std::string body_str = templates_json.dump(2);
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // GET /api/resources - List allocated resources
+    if (path == "/api/resources" && method == "GET") {
+        json resources_json = json::array();
+        for (const auto& [key, value] : g_state->resources) {
+            json res_obj = *value;
+            res_obj["key"] = key;  // Add the key for reference
+            resources_json.push_back(res_obj);
+        }
+        std::string body_str = resources_json.dump(2);
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // GET /api/resources/usage - Per type: range, claimed (and by whom), remaining
+    if (path == "/api/resources/usage" && method == "GET") {
+        json usage_json = resourceUsage(*g_state);
+        std::string body_str = usage_json.dump(2);
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // GET /api/resource-types - List resource types
+    if (path == "/api/resource-types" && method == "GET") {
+        json types_json = json::object();
+        for (const auto& [key, value] : g_state->types) {
+            types_json[key] = *value;
+        }
+        std::string body_str = types_json.dump(2);
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // GET /api/alerts - Alert rules
+    if (path == "/api/alerts" && method == "GET") {
+        std::string body_str = json(g_state->alerts).dump(2);
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // POST /api/alerts - Add or replace a rule ("for" and "cooldown" take seconds or "5m")
+    if (path == "/api/alerts" && method == "POST") {
+        try {
+            json req = json::parse(body);
+            for (const char* key : {"for", "cooldown"}) {
+                if (req.contains(key) && req[key].is_string()) {
+                    req[key] = parseDuration(req[key].get<std::string>());
+                }
+            }
+            AlertRule rule = req.get<AlertRule>();
+            validateAlertRule(rule);
+
+            g_state->alerts[rule.id] = rule;
+            g_state->save();
+
+            json result = {{"success", true}, {"alert", rule}};
+            std::string body_str = result.dump(2);
+            response << "HTTP/1.1 200 OK\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << body_str.length() << "\r\n";
+            response << "\r\n";
+            response << body_str;
+            return response.str();
+        } catch (const std::exception& e) {
+            logWarn("invalid request", {{"method", method}, {"path", path}, {"error", e.what()}});
+            std::string error_body = json({{"error", std::string("Invalid alert rule: ") + e.what()}}).dump();
+            response << "HTTP/1.1 400 Bad Request\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+    }
+
+    // DELETE /api/alerts?id=X - Remove a rule
+    if (path.find("/api/alerts") == 0 && method == "DELETE") {
+        if (!g_state->alerts.erase(queryParam(path, "id"))) {
+            std::string error_body = R"({"error": "Alert not found"})";
+            response << "HTTP/1.1 404 Not Found\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+        g_state->save();
+
+        json result = {{"success", true}};
+        std::string body_str = result.dump(2);
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // GET /api/events[?instance=X][&limit=N] - Alert firings and other events, newest first
+    if (path.find("/api/events") == 0 && method == "GET") {
+        std::string instance = queryParam(path, "instance");
+        std::string limit = queryParam(path, "limit");
+        size_t max = limit.empty() ? 100 : std::max(0, std::atoi(limit.c_str()));
+
+        json events = json::array();
+        for (auto it = g_state->events.rbegin(); it != g_state->events.rend() && events.size() < max; ++it) {
+            if (instance.empty() || it->instance == instance) {
+                events.push_back(*it);
+            }
+        }
+        std::string body_str = events.dump(2);
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // GET /api/remotes - Origins allowed (true) or blocked (false) cross-origin access
+    if (route == "/api/remotes" && method == "GET") {
+        std::string body_str = json(g_state->remotesAllowed).dump(2);
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // POST /api/remotes {"origin": "http://dash.local:3000", "allowed": true|false} - Allow or block one
+    if (route == "/api/remotes" && method == "POST") {
+        try {
+            json req = json::parse(body);
+            std::string origin = normalizeOrigin(req.at("origin").get<std::string>());
+            bool allowed = req.value("allowed", true);
+            g_state->remotesAllowed[origin] = allowed;
+            g_state->save();
+
+            json result = {{"success", true}, {"origin", origin}, {"allowed", allowed}};
+            std::string body_str = result.dump(2);
+            response << "HTTP/1.1 200 OK\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << body_str.length() << "\r\n";
+            response << "\r\n";
+            response << body_str;
+            return response.str();
+        } catch (const std::exception& e) {
+            std::string error_body = json({{"error", std::string("Invalid remote: ") + e.what()}}).dump();
+            response << "HTTP/1.1 400 Bad Request\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
     }
 
-    // Serve web.html from file
-    if (path == "/" && method == "GET") {
-        std::string html = readFile("web.html");
-        if (html.empty()) {
-            html = "<html><body><h1>VP Process Manager</h1><p>Error: web.html not found</p></body></html>";
+    // DELETE /api/remotes?origin=X - Forget an origin (back to the "*" entry, else blocked)
+    if (route == "/api/remotes" && method == "DELETE") {
+        std::string origin = percentDecode(queryParam(path, "origin"));
+        try {
+            origin = normalizeOrigin(origin);
+        } catch (const std::invalid_argument&) {
+            // Hand-edited entries may not be normalized: remove as given
         }
+        if (!g_state->remotesAllowed.erase(origin)) {
+            std::string error_body = R"({"error": "Origin not listed"})";
+            response << "HTTP/1.1 404 Not Found\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+        g_state->save();
+
+        json result = {{"success", true}};
+        std::string body_str = result.dump(2);
         response << "HTTP/1.1 200 OK\r\n";
-        response << "Content-Type: text/html\r\n";
-        response << "Content-Length: " << html.length() << "\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
         response << "\r\n";
-        response << html;
+        response << body_str;
         return response.str();
     }
 
-    if (path == "/api/instances" && method == "GET") {
-        matchAndUpdateInstances(g_state);
-
-        // Serialize instances to JSON
-        json instances_json = json::object();
-        for (const auto& [key, value] : g_state->instances) {
-            instances_json[key] = *value;
-        }
-        std::string body = instances_json.dump(2);
+    // GET /api/config - Get configuration
+    if (path == "/api/config" && method == "GET") {
+        json config_json;
+        config_json["auto_refresh_interval"] = 5000;
+        std::string body_str = config_json.dump(2);
 
         response << "HTTP/1.1 200 OK\r\n";
         response << "Content-Type: application/json\r\n";
-        response << "Access-Control-Allow-Origin: *\r\n";
-        response << "Content-Length: " << body.length() << "\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
         response << "\r\n";
-        response << body;
+        response << body_str;
         return response.str();
     }
 
-    if (path == "/api/templates" && method == "GET") {
-        // Serialize templates to JSON
-        json templates_json = json::object();
-        for (const auto& [key, value] : g_state->templates) {
-            templates_json[key] = *value;
-        }
-        std::string body_str = templates_json.dump(2);
+    // GET /api/tree - Instances with their child process trees
+    if (path == "/api/tree" && method == "GET") {
+        matchAndUpdateInstances(g_state);
+
+        std::string body_str = instanceTrees(g_state).dump(2);
 
         response << "HTTP/1.1 200 OK\r\n";
         response << "Content-Type: application/json\r\n";
-        response << "Access-Control-Allow-Origin: *\r\n";
         response << "Content-Length: " << body_str.length() << "\r\n";
         response << "\r\n";
         response << body_str;
         return response.str();
     }
 
-    // GET /api/resources - List allocated resources
-    if (path == "/api/resources" && method == "GET") {
-        json resources_json = json::array();
-        for (const auto& [key, value] : g_state->resources) {
-            json res_obj = *value;
-            res_obj["key"] = key;  // Add the key for reference
-            resources_json.push_back(res_obj);
+    // GET /api/logs?name=<instance>&lines=N - Tail captured output
+    if (path.find("/api/logs") == 0 && method == "GET") {
+        std::string name = queryParam(path, "name");
+        std::string lines = queryParam(path, "lines");
+
+        if (g_state->instances.find(name) == g_state->instances.end()) {
+            std::string error_body = R"({"error": "Instance not found"})";
+            response << "HTTP/1.1 404 Not Found\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
         }
-        std::string body_str = resources_json.dump(2);
+
+        std::string body_str = tailLog(logPath(name), lines.empty() ? 200 : std::atoi(lines.c_str()));
 
         response << "HTTP/1.1 200 OK\r\n";
-        response << "Content-Type: application/json\r\n";
-        response << "Access-Control-Allow-Origin: *\r\n";
+        response << "Content-Type: text/plain\r\n";
         response << "Content-Length: " << body_str.length() << "\r\n";
         response << "\r\n";
         response << body_str;
         return response.str();
     }
 
-    // GET /api/resource-types - List resource types
-    if (path == "/api/resource-types" && method == "GET") {
-        json types_json = json::object();
-        for (const auto& [key, value] : g_state->types) {
-            types_json[key] = *value;
+    // GET /api/watch?since=REV&timeout=N - Long-poll until state passes revision REV,
+    // then return what changed (without since: the current revision, to start from)
+    if (path.find("/api/watch") == 0 && method == "GET") {
+        std::string since = queryParam(path, "since");
+        std::string timeout = queryParam(path, "timeout");
+        if (!since.empty() && (since.find_first_not_of("0123456789") != std::string::npos || since.size() > 18)) {
+            std::string error_body = R"({"error": "since must be a revision number"})";
+            response << "HTTP/1.1 400 Bad Request\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+
+        unsigned long long revision = since.empty() ? 0 : std::stoull(since);
+        if (!since.empty()) {
+            int seconds = timeout.empty() ? 30 : std::min(std::max(std::atoi(timeout.c_str()), 1), 300);
+            g_state->waitForRevision(revision, seconds * 1000);
         }
-        std::string body_str = types_json.dump(2);
 
+        std::string body_str = watchResult(*g_state, revision).dump(2);
         response << "HTTP/1.1 200 OK\r\n";
         response << "Content-Type: application/json\r\n";
-        response << "Access-Control-Allow-Origin: *\r\n";
         response << "Content-Length: " << body_str.length() << "\r\n";
         response << "\r\n";
         response << body_str;
         return response.str();
     }
 
-    // GET /api/config - Get configuration
-    if (path == "/api/config" && method == "GET") {
-        json config_json;
-        config_json["auto_refresh_interval"] = 5000;
-        std::string body_str = config_json.dump(2);
+    // GET /api/wait?name=X&for=running|stopped|healthy&timeout=N - Long-poll until state reached
+    if (path.find("/api/wait") == 0 && method == "GET") {
+        std::string name = queryParam(path, "name");
+        std::string condition = queryParam(path, "for");
+        std::string timeout = queryParam(path, "timeout");
+        if (condition.empty()) condition = "running";
+
+        if (g_state->instances.find(name) == g_state->instances.end()) {
+            std::string error_body = R"({"error": "Instance not found"})";
+            response << "HTTP/1.1 404 Not Found\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+
+        if (condition != "running" && condition != "stopped" && condition != "healthy") {
+            std::string error_body = R"({"error": "for must be running, stopped or healthy"})";
+            response << "HTTP/1.1 400 Bad Request\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
 
+        // Bounded so clients re-poll instead of holding a thread forever
+        int seconds = timeout.empty() ? 30 : std::min(std::max(std::atoi(timeout.c_str()), 1), 300);
+        auto lookup = [&name]() -> std::shared_ptr<Instance> {
+            auto data = g_state->lock();
+            auto inst = g_state->findInstance(name);
+            return inst ? std::make_shared<Instance>(*inst) : nullptr;
+        };
+        bool reached;
+        {
+            State::Unlocked unlocked(*g_state);
+            reached = waitForInstance(lookup, condition, seconds * 1000);
+        }
+
+        json result = {{"name", name}, {"for", condition}, {"reached", reached}};
+        std::string body_str = result.dump(2);
         response << "HTTP/1.1 200 OK\r\n";
         response << "Content-Type: application/json\r\n";
-        response << "Access-Control-Allow-Origin: *\r\n";
         response << "Content-Length: " << body_str.length() << "\r\n";
         response << "\r\n";
         response << body_str;
         return response.str();
     }
 
-    // GET /api/discover - Discover processes
+    // GET /api/discover[?ports_only=true][&fields=...][&omit=...][&offset=N][&limit=N] - Discover processes
     if (path.find("/api/discover") == 0 && method == "GET") {
         bool portsOnly = path.find("ports_only=true") != std::string::npos;
         auto discovered = discoverProcesses(g_state, portsOnly);
@@ -168,18 +1458,56 @@ std::string handleRequest(const std::string& method, const std::string& path, co
             result_json.push_back(proc_json);
         }
 
+        size_t total = 0;
+        try {
+            result_json = shapeList(result_json, path, total);
+        } catch (const std::invalid_argument& e) {
+            std::string error_body = json{{"error", e.what()}}.dump();
+            response << "HTTP/1.1 400 Bad Request\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
         std::string body_str = result_json.dump(2);
 
         response << "HTTP/1.1 200 OK\r\n";
         response << "Content-Type: application/json\r\n";
-        response << "Access-Control-Allow-Origin: *\r\n";
+        response << "X-Total-Count: " << total << "\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // GET /api/processes/<pid>/chain - Parent chain up to init and the launch script
+    if (route.rfind("/api/processes/", 0) == 0 && route.size() > 21 &&
+        route.compare(route.size() - 6, 6, "/chain") == 0 && method == "GET") {
+        std::string pidStr = route.substr(15, route.size() - 15 - 6);
+        char* end;
+        long pid = strtol(pidStr.c_str(), &end, 10);
+        json result = !*end && pid > 0 ? parentChainJson(*g_state, (int)pid) : json(nullptr);
+        if (result.is_null()) {
+            std::string error_body = R"({"error": "Process not found"})";
+            response << "HTTP/1.1 404 Not Found\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+        std::string body_str = result.dump(2);
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
         response << "Content-Length: " << body_str.length() << "\r\n";
         response << "\r\n";
         response << body_str;
         return response.str();
     }
 
-    // POST /api/monitor - Monitor existing process
+    // POST /api/monitor - Monitor existing process ({"pid", "name", "launch_script": bool})
     if (path == "/api/monitor" && method == "POST") {
         try {
             json req = json::parse(body);
@@ -195,8 +1523,17 @@ std::string handleRequest(const std::string& method, const std::string& path, co
                 response << error_body;
                 return response.str();
             }
+            if (!nameError(name).empty()) {
+                std::string error_body = json{{"error", nameError(name)}}.dump();
+                response << "HTTP/1.1 400 Bad Request\r\n";
+                response << "Content-Type: application/json\r\n";
+                response << "Content-Length: " << error_body.length() << "\r\n";
+                response << "\r\n";
+                response << error_body;
+                return response.str();
+            }
 
-            auto inst = monitorProcess(g_state, pid, name);
+            auto inst = monitorProcess(g_state, pid, name, req.value("launch_script", false));
             if (inst) {
                 json result = *inst;
                 std::string body_str = result.dump(2);
@@ -215,6 +1552,7 @@ std::string handleRequest(const std::string& method, const std::string& path, co
             }
             return response.str();
         } catch (const std::exception& e) {
+            logWarn("invalid request", {{"method", method}, {"path", path}, {"error", e.what()}});
             std::string error_body = R"({"error": "Invalid request"})";
             response << "HTTP/1.1 400 Bad Request\r\n";
             response << "Content-Type: application/json\r\n";
@@ -225,6 +1563,27 @@ std::string handleRequest(const std::string& method, const std::string& path, co
         }
     }
 
+    // GET /api/action-runs[?instance=X][&id=N] - Action history, newest first
+    if (path.find("/api/action-runs") == 0 && method == "GET") {
+        std::string instance = queryParam(path, "instance");
+        std::string id = queryParam(path, "id");
+
+        json result_json = json::array();
+        for (auto it = g_state->actionRuns.rbegin(); it != g_state->actionRuns.rend(); ++it) {
+            if ((instance.empty() || it->instance == instance) && (id.empty() || std::to_string(it->id) == id)) {
+                result_json.push_back(*it);
+            }
+        }
+        std::string body_str = result_json.dump(2);
+
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
     // POST /api/execute-action - Execute action for an instance
     if (path == "/api/execute-action" && method == "POST") {
         try {
@@ -241,8 +1600,9 @@ std::string handleRequest(const std::string& method, const std::string& path, co
                 return response.str();
             }
 
-            auto inst = g_state->instances[instanceName];
-            if (inst->action.empty()) {
+            auto inst = g_state->instances.at(instanceName);
+            std::string action = resolveAction(*inst, req.value("action", ""));
+            if (action.empty()) {
                 std::string error_body = R"({"error": "No action defined"})";
                 response << "HTTP/1.1 400 Bad Request\r\n";
                 response << "Content-Type: application/json\r\n";
@@ -252,8 +1612,11 @@ std::string handleRequest(const std::string& method, const std::string& path, co
                 return response.str();
             }
 
-            bool success = executeAction(inst->action);
-            json result = {{"success", success}};
+            // Run in the background; poll /api/action-runs?id=N for the result
+            ActionRun run = recordAction(g_state, instanceName, req.value("action", ""), action);
+            std::thread([run]() { runAction(g_state, run); }).detach();
+
+            json result = {{"success", true}, {"run", run.id}};
             std::string body_str = result.dump(2);
             response << "HTTP/1.1 200 OK\r\n";
             response << "Content-Type: application/json\r\n";
@@ -262,6 +1625,7 @@ std::string handleRequest(const std::string& method, const std::string& path, co
             response << body_str;
             return response.str();
         } catch (const std::exception& e) {
+            logWarn("invalid request", {{"method", method}, {"path", path}, {"error", e.what()}});
             std::string error_body = R"({"error": "Invalid request"})";
             response << "HTTP/1.1 400 Bad Request\r\n";
             response << "Content-Type: application/json\r\n";
@@ -287,25 +1651,30 @@ std::string handleRequest(const std::string& method, const std::string& path, co
                 response << error_body;
                 return response.str();
             }
-
-            auto tmpl = std::make_shared<Template>();
-            tmpl->id = id;
-            tmpl->label = req.value("label", "");
-            tmpl->command = req.value("command", "");
-
-            if (req.contains("resources")) {
-                for (const auto& res : req["resources"]) {
-                    tmpl->resources.push_back(res.get<std::string>());
-                }
+            if (!nameError(id, false).empty()) {
+                std::string error_body = json{{"error", "template " + nameError(id, false)}}.dump();
+                response << "HTTP/1.1 400 Bad Request\r\n";
+                response << "Content-Type: application/json\r\n";
+                response << "Content-Length: " << error_body.length() << "\r\n";
+                response << "\r\n";
+                response << error_body;
+                return response.str();
             }
 
-            if (req.contains("vars")) {
-                for (auto& [key, value] : req["vars"].items()) {
-                    tmpl->vars[key] = value.get<std::string>();
-                }
+            // The same parse as vp add, so no field is dropped; the API
+            // has always let the rest default
+            for (const char* key : {"label", "command"}) {
+                if (!req.contains(key)) req[key] = "";
+            }
+            if (!req.contains("resources")) req["resources"] = json::array();
+            if (!req.contains("vars")) req["vars"] = json::object();
+            auto tmpl = std::make_shared<Template>(req.get<Template>());
+            for (const auto& decl : tmpl->resources) {
+                parseResourceDecl(decl);  // Throws on a bad range
+            }
+            if (tmpl->limits && !tmpl->limits->webhook.empty()) {
+                validateWebhookUrl(tmpl->limits->webhook);
             }
-
-            tmpl->action = req.value("action", "");
 
             g_state->templates[id] = tmpl;
             g_state->save();
@@ -319,6 +1688,7 @@ std::string handleRequest(const std::string& method, const std::string& path, co
             response << body_str;
             return response.str();
         } catch (const std::exception& e) {
+            logWarn("invalid request", {{"method", method}, {"path", path}, {"error", e.what()}});
             std::string error_body = R"({"error": "Invalid request"})";
             response << "HTTP/1.1 400 Bad Request\r\n";
             response << "Content-Type: application/json\r\n";
@@ -335,8 +1705,158 @@ std::string handleRequest(const std::string& method, const std::string& path, co
             json req = json::parse(body);
             std::string name = req.value("name", "");
 
-            if (name.empty()) {
-                std::string error_body = R"({"error": "Resource type name required"})";
+            if (name.empty()) {
+                std::string error_body = R"({"error": "Resource type name required"})";
+                response << "HTTP/1.1 400 Bad Request\r\n";
+                response << "Content-Type: application/json\r\n";
+                response << "Content-Length: " << error_body.length() << "\r\n";
+                response << "\r\n";
+                response << error_body;
+                return response.str();
+            }
+
+            auto rt = std::make_shared<ResourceType>();
+            rt->name = name;
+            rt->check = req.value("check", "");
+            rt->counter = req.value("counter", false);
+            rt->start = req.value("start", 0);
+            rt->end = req.value("end", 0);
+            rt->allocator = req.value("allocator", "");
+            rt->ephemeral = req.value("ephemeral", false);
+
+            g_state->types[name] = rt;
+            g_state->save();
+
+            json result = {{"success", true}};
+            std::string body_str = result.dump(2);
+            response << "HTTP/1.1 200 OK\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << body_str.length() << "\r\n";
+            response << "\r\n";
+            response << body_str;
+            return response.str();
+        } catch (const std::exception& e) {
+            logWarn("invalid request", {{"method", method}, {"path", path}, {"error", e.what()}});
+            std::string error_body = R"({"error": "Invalid request"})";
+            response << "HTTP/1.1 400 Bad Request\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+    }
+
+    // GET /api/jobs - Async starts still running and the last finished ones
+    if (path == "/api/jobs" && method == "GET") {
+        std::string body_str = json(g_jobs.list()).dump(2);
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // GET /api/jobs/<id> - One async start: its phase, and error once failed
+    if (path.rfind("/api/jobs/", 0) == 0 && method == "GET") {
+        std::string idText = path.substr(10);
+        Job job;
+        bool numeric = !idText.empty() && idText.size() < 10 && idText.find_first_not_of("0123456789") == std::string::npos;
+        if (!numeric || !g_jobs.get(std::stoi(idText), job)) {
+            std::string error_body = R"({"error": "Job not found"})";
+            response << "HTTP/1.1 404 Not Found\r\n";
+            response << "Content-Type: application/json\r\n";
+            response << "Content-Length: " << error_body.length() << "\r\n";
+            response << "\r\n";
+            response << error_body;
+            return response.str();
+        }
+        std::string body_str = json(job).dump(2);
+        response << "HTTP/1.1 200 OK\r\n";
+        response << "Content-Type: application/json\r\n";
+        response << "Content-Length: " << body_str.length() << "\r\n";
+        response << "\r\n";
+        response << body_str;
+        return response.str();
+    }
+
+    // POST /api/instances/batch - {"action": "stop|restart|delete", and "names",
+    // "selector", "template", "status" or "all": true, optional "project"}; or
+    // {"operations": [{"name", "action": "start|stop|restart|delete", "force"}]}
+    // with a result per operation, in order. Either way state is saved once.
+    if (path == "/api/instances/batch" && method == "POST") {
+        try {
+            json req = json::parse(body);
+            SaveBatch batch(*g_state);
+
+            if (req.contains("operations")) {
+                json results = json::array();
+                for (const auto& op : req.at("operations")) {
+                    std::string name = qualifiedName(op.value("project", req.value("project", "")), op.at("name").get<std::string>());
+                    std::string action = op.at("action").get<std::string>();
+                    auto it = g_state->instances.find(name);
+
+                    // start is restart of one that isn't running
+                    std::string error;
+                    if (it == g_state->instances.end()) {
+                        error = "not found";
+                    } else if (action == "start" && instanceUp(*it->second)) {
+                        error = "already running";
+                    } else if (action == "start" || action == "stop" || action == "restart" || action == "delete") {
+                        error = instanceOperation(g_state, name, action == "start" ? "restart" : action,
+                                                  op.value("force", req.value("force", false)));
+                    } else {
+                        error = "unknown action: " + action;
+                    }
+
+                    json result = {{"name", name}, {"action", action}, {"ok", error.empty()}};
+                    if (!error.empty()) result["error"] = error;
+                    results.push_back(result);
+                }
+
+                json result = {{"results", results}};
+                std::string body_str = result.dump(2);
+                response << "HTTP/1.1 200 OK\r\n";
+                response << "Content-Type: application/json\r\n";
+                response << "Content-Length: " << body_str.length() << "\r\n";
+                response << "\r\n";
+                response << body_str;
+                return response.str();
+            }
+
+            std::string action = req.value("action", "");
+            std::string project = req.value("project", "");
+            std::string selector = req.value("selector", "");
+            std::string templateId = req.value("template", "");
+            std::string status = req.value("status", "");
+            bool all = req.value("all", false);
+            const auto& statuses = instanceStatuses();
+            if (!status.empty() && std::find(statuses.begin(), statuses.end(), status) == statuses.end()) {
+                std::string error_body = json{{"error", "unknown status: " + status}}.dump();
+                response << "HTTP/1.1 400 Bad Request\r\n";
+                response << "Content-Type: application/json\r\n";
+                response << "Content-Length: " << error_body.length() << "\r\n";
+                response << "\r\n";
+                response << error_body;
+                return response.str();
+            }
+
+            std::vector<std::string> names;
+            if (req.contains("names")) {
+                for (const auto& name : req["names"]) {
+                    std::string key = qualifiedName(project, name.get<std::string>());
+                    if (g_state->instances.count(key)) {
+                        names.push_back(key);
+                    }
+                }
+            } else if (all || !selector.empty() || !templateId.empty() || !status.empty()) {
+                names = filterInstances(*g_state, project, selector, templateId, status);
+            }
+
+            if ((action != "stop" && action != "restart" && action != "delete") ||
+                (!req.contains("names") && !all && selector.empty() && templateId.empty() && status.empty())) {
+                std::string error_body = R"({"error": "action must be stop, restart or delete, with names, selector, template, status or all"})";
                 response << "HTTP/1.1 400 Bad Request\r\n";
                 response << "Content-Type: application/json\r\n";
                 response << "Content-Length: " << error_body.length() << "\r\n";
@@ -345,17 +1865,22 @@ std::string handleRequest(const std::string& method, const std::string& path, co
                 return response.str();
             }
 
-            auto rt = std::make_shared<ResourceType>();
-            rt->name = name;
-            rt->check = req.value("check", "");
-            rt->counter = req.value("counter", false);
-            rt->start = req.value("start", 0);
-            rt->end = req.value("end", 0);
-
-            g_state->types[name] = rt;
-            g_state->save();
+            // Each operation may give up the state lock: skip what was deleted meanwhile
+            json results = json::object();
+            for (const auto& name : names) {
+                auto it = g_state->instances.find(name);
+                if (it == g_state->instances.end()) {
+                    continue;
+                }
+                // Stopping in bulk leaves what isn't running alone
+                if (action == "stop" && !instanceUp(*it->second)) {
+                    continue;
+                }
+                std::string error = instanceOperation(g_state, name, action, req.value("force", false));
+                results[name] = error.empty() ? json{{"ok", true}} : json{{"ok", false}, {"error", error}};
+            }
 
-            json result = {{"success", true}};
+            json result = {{"results", results}};
             std::string body_str = result.dump(2);
             response << "HTTP/1.1 200 OK\r\n";
             response << "Content-Type: application/json\r\n";
@@ -364,6 +1889,7 @@ std::string handleRequest(const std::string& method, const std::string& path, co
             response << body_str;
             return response.str();
         } catch (const std::exception& e) {
+            logWarn("invalid request", {{"method", method}, {"path", path}, {"error", e.what()}});
             std::string error_body = R"({"error": "Invalid request"})";
             response << "HTTP/1.1 400 Bad Request\r\n";
             response << "Content-Type: application/json\r\n";
@@ -384,6 +1910,71 @@ std::string handleRequest(const std::string& method, const std::string& path, co
             if (name.empty()) {
                 name = req.value("instance_id", "");
             }
+            name = qualifiedName(req.value("project", ""), name);
+
+            // Bulk stop/restart/delete by label selector
+            std::string selector = req.value("selector", "");
+            if (!selector.empty() && (action == "stop" || action == "restart" || action == "delete")) {
+                std::string project = req.value("project", "");
+                json results = json::object();
+                std::vector<std::string> names;
+                for (const auto& [key, inst] : g_state->instances) {
+                    if ((project.empty() || inst->project == project) && matchesSelector(*inst, selector)) {
+                        names.push_back(key);
+                    }
+                }
+                for (const auto& key : names) {
+                    // Stops give up the state lock: skip what was deleted meanwhile
+                    auto it = g_state->instances.find(key);
+                    if (it == g_state->instances.end()) {
+                        continue;
+                    }
+                    auto inst = it->second;
+                    if (inst->protect && !req.value("force", false) &&
+                        !(action == "restart" && !instanceUp(*inst))) {
+                        results[key] = false;
+                        continue;
+                    }
+                    if (action == "stop") {
+                        results[key] = stopProcess(g_state, inst);
+                    } else if (action == "restart") {
+                        results[key] = restartProcess(g_state, inst);
+                    } else {
+                        if (instanceUp(*inst)) stopProcess(g_state, inst);
+                        it = g_state->instances.find(key);
+                        if (it != g_state->instances.end() && it->second == inst) {
+                            g_state->releaseResources(key);
+                            g_state->instances.erase(it);
+                        }
+                        results[key] = true;
+                    }
+                }
+                g_state->save();
+
+                json result = {{"results", results}};
+                std::string body_str = result.dump(2);
+                response << "HTTP/1.1 200 OK\r\n";
+                response << "Content-Type: application/json\r\n";
+                response << "Content-Length: " << body_str.length() << "\r\n";
+                response << "\r\n";
+                response << body_str;
+                return response.str();
+            }
+
+            // Locked instances (vp lock) need "force": true
+            if ((action == "stop" || action == "restart" || action == "delete") && !req.value("force", false)) {
+                auto found = g_state->instances.find(name);
+                if (found != g_state->instances.end() && found->second->protect &&
+                    !(action == "restart" && !instanceUp(*found->second))) {
+                    std::string error_body = R"({"error": "Instance is protected; unlock it or pass force"})";
+                    response << "HTTP/1.1 409 Conflict\r\n";
+                    response << "Content-Type: application/json\r\n";
+                    response << "Content-Length: " << error_body.length() << "\r\n";
+                    response << "\r\n";
+                    response << error_body;
+                    return response.str();
+                }
+            }
 
             if (action == "start") {
                 std::string templateId = req.value("template", "");
@@ -404,7 +1995,89 @@ std::string handleRequest(const std::string& method, const std::string& path, co
                     }
                 }
 
-                auto inst = startProcess(g_state, *g_state->templates[templateId], name, vars);
+                // No name: make one up; the response (or the job) carries it
+                if (name.empty()) {
+                    name = generateInstanceName(*g_state, templateId, req.value("project", ""));
+                }
+                if (!nameError(name).empty()) {
+                    std::string error_body = json{{"error", nameError(name)}}.dump();
+                    response << "HTTP/1.1 400 Bad Request\r\n";
+                    response << "Content-Type: application/json\r\n";
+                    response << "Content-Length: " << error_body.length() << "\r\n";
+                    response << "\r\n";
+                    response << error_body;
+                    return response.str();
+                }
+
+                Template tmpl = *g_state->templates[templateId];
+                tmpl.pty = req.value("pty", tmpl.pty);
+                int timeout = std::min(std::max(req.value("timeout", 30), 1), 300);
+
+                // Labels, lock and notes from the request, once it has started
+                auto annotate = [req](Instance& inst) {
+                    if (req.contains("labels") || req.value("protected", false) || req.contains("notes")) {
+                        if (req.contains("labels")) {
+                            inst.labels = req["labels"].get<std::map<std::string, std::string>>();
+                        }
+                        inst.protect = req.value("protected", false);
+                        inst.notes = req.value("notes", "");
+                        g_state->save();
+                    }
+                };
+
+                // "async": answer 202 with a job at once and start in the background
+                if (req.value("async", false)) {
+                    int id = g_jobs.create("start", name);
+                    bool wait = req.value("wait", false);
+                    std::thread([id, tmpl, name, vars, annotate, wait, timeout]() {
+                        auto data = g_state->lock();
+                        try {
+                            auto inst = startProcess(g_state, tmpl, name, vars, [id](const std::string& phase) {
+                                g_jobs.update(id, phase);
+                            });
+                            if (!inst) {
+                                g_jobs.update(id, "failed", "Failed to start process");
+                                return;
+                            }
+                            annotate(*inst);
+                            if (wait) {
+                                g_jobs.update(id, "waiting-healthy");
+                                if (!awaitReady(g_state, inst, timeout * 1000)) {
+                                    g_jobs.update(id, "failed", "Instance not ready within timeout, rolled back");
+                                    return;
+                                }
+                            }
+                            g_jobs.update(id, "done");
+                        } catch (const std::exception& e) {
+                            g_jobs.update(id, "failed", e.what());
+                        }
+                    }).detach();
+
+                    Job job;
+                    g_jobs.get(id, job);
+                    std::string body_str = json(job).dump(2);
+                    response << "HTTP/1.1 202 Accepted\r\n";
+                    response << "Content-Type: application/json\r\n";
+                    response << "Location: /api/v" << API_VERSION << "/jobs/" << id << "\r\n";
+                    response << "Content-Length: " << body_str.length() << "\r\n";
+                    response << "\r\n";
+                    response << body_str;
+                    return response.str();
+                }
+
+                auto inst = startProcess(g_state, tmpl, name, vars);
+                if (inst) {
+                    annotate(*inst);
+                }
+                if (inst && req.value("wait", false) && !awaitReady(g_state, inst, timeout * 1000)) {
+                    std::string error_body = R"({"error": "Instance not ready within timeout, rolled back"})";
+                    response << "HTTP/1.1 503 Service Unavailable\r\n";
+                    response << "Content-Type: application/json\r\n";
+                    response << "Content-Length: " << error_body.length() << "\r\n";
+                    response << "\r\n";
+                    response << error_body;
+                    return response.str();
+                }
                 if (inst) {
                     json result = *inst;
                     std::string body_str = result.dump(2);
@@ -434,7 +2107,7 @@ std::string handleRequest(const std::string& method, const std::string& path, co
                     return response.str();
                 }
 
-                bool success = stopProcess(g_state, g_state->instances[name]);
+                bool success = stopProcess(g_state, g_state->instances.at(name));
                 json result = {{"success", success}};
                 std::string body_str = result.dump(2);
                 response << "HTTP/1.1 200 OK\r\n";
@@ -455,7 +2128,7 @@ std::string handleRequest(const std::string& method, const std::string& path, co
                     return response.str();
                 }
 
-                bool success = restartProcess(g_state, g_state->instances[name]);
+                bool success = restartProcess(g_state, g_state->instances.at(name));
                 json result = {{"success", success}};
                 std::string body_str = result.dump(2);
                 response << "HTTP/1.1 200 OK\r\n";
@@ -465,6 +2138,85 @@ std::string handleRequest(const std::string& method, const std::string& path, co
                 response << body_str;
                 return response.str();
             }
+            else if (action == "label") {
+                if (g_state->instances.find(name) == g_state->instances.end()) {
+                    std::string error_body = R"({"error": "Instance not found"})";
+                    response << "HTTP/1.1 404 Not Found\r\n";
+                    response << "Content-Type: application/json\r\n";
+                    response << "Content-Length: " << error_body.length() << "\r\n";
+                    response << "\r\n";
+                    response << error_body;
+                    return response.str();
+                }
+
+                // {"labels": {"env": "dev", "old": null}} sets env, removes old
+                auto& labels = g_state->instances.at(name)->labels;
+                for (auto& [key, value] : req.value("labels", json::object()).items()) {
+                    if (value.is_null()) {
+                        labels.erase(key);
+                    } else {
+                        labels[key] = value.get<std::string>();
+                    }
+                }
+                g_state->save();
+
+                json result = {{"labels", labels}};
+                std::string body_str = result.dump(2);
+                response << "HTTP/1.1 200 OK\r\n";
+                response << "Content-Type: application/json\r\n";
+                response << "Content-Length: " << body_str.length() << "\r\n";
+                response << "\r\n";
+                response << body_str;
+                return response.str();
+            }
+            else if (action == "annotate") {
+                if (g_state->instances.find(name) == g_state->instances.end()) {
+                    std::string error_body = R"({"error": "Instance not found"})";
+                    response << "HTTP/1.1 404 Not Found\r\n";
+                    response << "Content-Type: application/json\r\n";
+                    response << "Content-Length: " << error_body.length() << "\r\n";
+                    response << "\r\n";
+                    response << error_body;
+                    return response.str();
+                }
+
+                // {"notes": ""} clears them
+                auto inst = g_state->instances.at(name);
+                inst->notes = req.value("notes", "");
+                g_state->save();
+
+                json result = {{"notes", inst->notes}};
+                std::string body_str = result.dump(2);
+                response << "HTTP/1.1 200 OK\r\n";
+                response << "Content-Type: application/json\r\n";
+                response << "Content-Length: " << body_str.length() << "\r\n";
+                response << "\r\n";
+                response << body_str;
+                return response.str();
+            }
+            else if (action == "lock" || action == "unlock") {
+                if (g_state->instances.find(name) == g_state->instances.end()) {
+                    std::string error_body = R"({"error": "Instance not found"})";
+                    response << "HTTP/1.1 404 Not Found\r\n";
+                    response << "Content-Type: application/json\r\n";
+                    response << "Content-Length: " << error_body.length() << "\r\n";
+                    response << "\r\n";
+                    response << error_body;
+                    return response.str();
+                }
+
+                g_state->instances.at(name)->protect = action == "lock";
+                g_state->save();
+
+                json result = {{"protected", action == "lock"}};
+                std::string body_str = result.dump(2);
+                response << "HTTP/1.1 200 OK\r\n";
+                response << "Content-Type: application/json\r\n";
+                response << "Content-Length: " << body_str.length() << "\r\n";
+                response << "\r\n";
+                response << body_str;
+                return response.str();
+            }
             else if (action == "delete") {
                 if (g_state->instances.find(name) != g_state->instances.end()) {
                     g_state->instances.erase(name);
@@ -480,6 +2232,7 @@ std::string handleRequest(const std::string& method, const std::string& path, co
                 return response.str();
             }
         } catch (const std::exception& e) {
+            logWarn("invalid request", {{"method", method}, {"path", path}, {"error", e.what()}});
             std::string error_body = R"({"error": "Invalid request"})";
             response << "HTTP/1.1 400 Bad Request\r\n";
             response << "Content-Type: application/json\r\n";
@@ -499,51 +2252,508 @@ std::string handleRequest(const std::string& method, const std::string& path, co
     return response.str();
 }
 
-void handleClient(int clientSocket) {
+int JobStore::create(const std::string& action, const std::string& instance) {
+    std::lock_guard<std::mutex> lock(mutex_);
+    Job job;
+    job.id = next_++;
+    job.action = action;
+    job.instance = instance;
+    job.phase = "queued";
+    job.created = job.updated = time(nullptr);
+    jobs_[job.id] = job;
+    return job.id;
+}
+
+void JobStore::update(int id, const std::string& phase, const std::string& error) {
+    std::lock_guard<std::mutex> lock(mutex_);
+    auto it = jobs_.find(id);
+    if (it == jobs_.end()) {
+        return;
+    }
+    it->second.phase = phase;
+    it->second.error = error;
+    it->second.updated = time(nullptr);
+
+    // Forget the oldest finished jobs beyond MAX_FINISHED
+    size_t finished = 0;
+    for (const auto& [key, job] : jobs_) {
+        finished += job.phase == "done" || job.phase == "failed";
+    }
+    for (auto old = jobs_.begin(); old != jobs_.end() && finished > MAX_FINISHED;) {
+        if (old->second.phase == "done" || old->second.phase == "failed") {
+            old = jobs_.erase(old);
+            finished--;
+        } else {
+            ++old;
+        }
+    }
+}
+
+bool JobStore::get(int id, Job& job) {
+    std::lock_guard<std::mutex> lock(mutex_);
+    auto it = jobs_.find(id);
+    if (it == jobs_.end()) {
+        return false;
+    }
+    job = it->second;
+    return true;
+}
+
+std::vector<Job> JobStore::list() {
+    std::lock_guard<std::mutex> lock(mutex_);
+    std::vector<Job> jobs;
+    for (const auto& [id, job] : jobs_) {
+        jobs.push_back(job);
+    }
+    return jobs;
+}
+
+bool RateLimiter::allow(const std::string& key, double now) {
+    if (rate_ <= 0) return true;
+
+    std::lock_guard<std::mutex> lock(mutex_);
+    auto it = buckets_.find(key);
+    if (it == buckets_.end()) {
+        it = buckets_.emplace(key, Bucket{burst_, now}).first;
+    }
+
+    Bucket& b = it->second;
+    b.tokens = std::min(burst_, b.tokens + (now - b.last) * rate_);
+    b.last = now;
+    if (b.tokens < 1) {
+        return false;
+    }
+    b.tokens -= 1;
+    return true;
+}
+
+static std::unique_ptr<RateLimiter> g_limiter;
+
+struct LoopBeat {
+    time_t last;
+    long maxAge;
+};
+
+static std::mutex g_selfMutex;
+static std::map<std::string, LoopBeat> g_loops;
+static double g_discoverySeconds = -1; // No pass yet
+
+void loopAlive(const std::string& loop, long maxAge) {
+    std::lock_guard<std::mutex> lock(g_selfMutex);
+    g_loops[loop] = {time(nullptr), maxAge};
+}
+
+void discoveryTook(double seconds) {
+    std::lock_guard<std::mutex> lock(g_selfMutex);
+    g_discoverySeconds = seconds;
+}
+
+// Write and remove a probe file next to state.json: catches read-only mounts
+// and full disks, not just permissions
+static std::string stateWriteError() {
+    std::string probe = State::getStateDir() + "/.healthz";
+    FILE* f = fopen(probe.c_str(), "w");
+    if (!f) {
+        return strerror(errno);
+    }
+    bool ok = fputs("ok\n", f) >= 0;
+    ok = fclose(f) == 0 && ok;
+    unlink(probe.c_str());
+    if (!ok) {
+        return "write failed";
+    }
+    std::string stateFile = State::getStateDir() + "/state.json";
+    if (access(stateFile.c_str(), F_OK) == 0 && access(stateFile.c_str(), W_OK) != 0) {
+        return strerror(errno);
+    }
+    return "";
+}
+
+json selfStats(const State& state) {
+    json self = {{"pid", getpid()}};
+    if (auto stat = readProcessStat(getpid())) {
+        self["threads"] = stat->threads;
+        self["rss"] = stat->rss;
+        self["cpu_time"] = stat->cpu_time;
+    }
+    ProcessInfo fds;
+    if (readFdUsage(getpid(), fds)) {
+        self["fds"] = fds.fds;
+        self["fd_limit"] = fds.fd_limit;
+    }
+
+    struct stat st;
+    std::string stateFile = State::getStateDir() + "/state.json";
+    self["state"] = {
+        {"instances", state.instances.size()},
+        {"templates", state.templates.size()},
+        {"resource_types", state.types.size()},
+        {"events", state.events.size()},
+        {"action_runs", state.actionRuns.size()},
+        {"file_bytes", stat(stateFile.c_str(), &st) == 0 ? (long long)st.st_size : 0},
+        {"encrypted", stateEncryptionEnabled()}
+    };
+
+    auto cache = discoveryCacheStats();
+    size_t lookups = cache.hits + cache.fullReads;
+    self["process_cache"] = {
+        {"refreshes", cache.refreshes},
+        {"entries", cache.entries},
+        {"hits", cache.hits},
+        {"full_reads", cache.fullReads},
+        {"hit_rate", lookups > 0 ? std::round(1000.0 * cache.hits / lookups) / 1000 : 0.0}
+    };
+
+    std::lock_guard<std::mutex> lock(g_selfMutex);
+    if (g_discoverySeconds >= 0) {
+        self["discovery_latency_ms"] = std::round(g_discoverySeconds * 10000) / 10;
+    }
+    return self;
+}
+
+json selfCheck(bool ready, time_t now) {
+    std::lock_guard<std::mutex> lock(g_selfMutex);
+    bool ok = true;
+    json checks = json::object();
+
+    for (const auto& [name, beat] : g_loops) {
+        long age = (long)(now - beat.last);
+        bool alive = age <= beat.maxAge;
+        checks["loop:" + name] = {{"ok", alive}, {"last_seconds_ago", age}};
+        ok = ok && alive;
+    }
+
+    if (ready) {
+        std::string error = stateWriteError();
+        checks["state_writable"] = error.empty() ? json{{"ok", true}} : json{{"ok", false}, {"error", error}};
+        ok = ok && error.empty();
+
+        bool fast = g_discoverySeconds >= 0 && g_discoverySeconds <= DISCOVERY_SLOW_SECONDS;
+        json discovery = {{"ok", fast}};
+        if (g_discoverySeconds >= 0) {
+            discovery["latency_ms"] = std::round(g_discoverySeconds * 10000) / 10;
+        } else {
+            discovery["error"] = "not run yet";
+        }
+        checks["discovery"] = discovery;
+        ok = ok && fast;
+    }
+
+    return {{"status", ok ? "ok" : "fail"}, {"checks", checks}};
+}
+
+static double monotonicSeconds() {
+    using namespace std::chrono;
+    return duration<double>(steady_clock::now().time_since_epoch()).count();
+}
+
+// Reads are never limited; everything else changes state or runs commands
+static bool isMutating(const std::string& method) {
+    return method != "GET" && method != "OPTIONS" && method != "HEAD";
+}
+
+// Status code from the response line ("HTTP/1.1 404 Not Found" -> 404)
+static int responseStatus(const std::string& response) {
+    size_t sp = response.find(' ');
+    if (sp == std::string::npos) return 0;
+    try {
+        return std::stoi(response.substr(sp + 1, 3));
+    } catch (...) {
+        return 0;
+    }
+}
+
+// Bridge a WebSocket to an instance's PTY: binary frames are keyboard input,
+// text frames are JSON control messages ({"cols": 120, "rows": 32}).
+static void serveTerminal(int clientSocket, const Request& req) {
+    std::string path = req.path.substr(0, req.path.find('?'));
+    std::string name = path.substr(15, path.size() - 15 - 9); // /api/instances/<name>/terminal
+    auto session = findPty(name);
+
+    // Browsers don't apply CORS to WebSockets: only the UI's own origin and
+    // explicitly listed ones may attach
+    auto origin = req.headers.find("origin");
+    auto host = req.headers.find("host");
+    bool sameOrigin = origin != req.headers.end() && host != req.headers.end() &&
+                      (origin->second == "http://" + host->second || origin->second == "https://" + host->second);
+    bool originOk = origin == req.headers.end() || sameOrigin;
+    if (!originOk) {
+        auto data = g_state->lock();
+        auto allowed = g_state->remotesAllowed.find(origin->second);
+        originOk = allowed != g_state->remotesAllowed.end() && allowed->second;
+    }
+
+    auto key = req.headers.find("sec-websocket-key");
+    std::string error;
+    if (!session) {
+        error = "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n";
+    } else if (!originOk) {
+        error = "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n";
+    } else if (key == req.headers.end()) {
+        error = "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n";
+    }
+    if (!error.empty()) {
+        ssize_t written = write(clientSocket, error.c_str(), error.length());
+        (void)written;
+        return;
+    }
+
+    std::ostringstream response;
+    response << "HTTP/1.1 101 Switching Protocols\r\n";
+    response << "Upgrade: websocket\r\n";
+    response << "Connection: Upgrade\r\n";
+    response << "Sec-WebSocket-Accept: " << websocketAccept(key->second) << "\r\n";
+    response << "\r\n";
+
+    // The PTY reader thread and this one both write to the socket
+    auto writeMutex = std::make_shared<std::mutex>();
+    auto send = [clientSocket, writeMutex](const std::string& data) {
+        std::lock_guard<std::mutex> lock(*writeMutex);
+        ssize_t written = write(clientSocket, data.c_str(), data.length());
+        (void)written;
+    };
+    send(response.str() + websocketFrame(session->scrollback(), WS_BINARY));
+    logInfo("terminal attached", {{"instance", name}, {"remote", req.remote}});
+
+    int id = session->subscribe([clientSocket, send](const std::string& data) {
+        if (data.empty()) {
+            send(websocketFrame("", WS_CLOSE)); // Process exited
+            shutdown(clientSocket, SHUT_RD);
+            return;
+        }
+        send(websocketFrame(data, WS_BINARY));
+    });
+
+    int opcode;
+    std::string payload;
+    while (readWebsocketFrame(clientSocket, opcode, payload)) {
+        if (opcode == WS_BINARY || opcode == WS_CONTINUATION) {
+            session->write(payload);
+        } else if (opcode == WS_TEXT) {
+            try {
+                json control = json::parse(payload);
+                if (control.contains("cols") && control.contains("rows")) {
+                    session->resize(control["cols"].get<int>(), control["rows"].get<int>());
+                }
+            } catch (const std::exception&) {
+                // Ignore malformed control messages
+            }
+        } else if (opcode == WS_PING) {
+            send(websocketFrame(payload, WS_PONG));
+        } else if (opcode == WS_CLOSE) {
+            send(websocketFrame("", WS_CLOSE));
+            break;
+        }
+    }
+
+    session->unsubscribe(id);
+    logInfo("terminal detached", {{"instance", name}, {"remote", req.remote}});
+}
+
+void handleClient(int clientSocket, std::string remote) {
     char buffer[4096];
     ssize_t bytesRead = read(clientSocket, buffer, sizeof(buffer) - 1);
 
     if (bytesRead > 0) {
         buffer[bytesRead] = '\0';
+        double started = monotonicSeconds();
 
         // Parse HTTP request
-        std::string request(buffer);
-        std::istringstream iss(request);
-        std::string method, path, version;
-        iss >> method >> path >> version;
-
-        // Find request body
-        std::string body;
-        size_t bodyPos = request.find("\r\n\r\n");
-        if (bodyPos != std::string::npos) {
-            body = request.substr(bodyPos + 4);
+        Request req = parseRequest(std::string(buffer));
+        req.remote = remote;
+
+        // Route /api/v1/... like /api/...; the bare paths still work but say so
+        bool deprecated = false;
+        std::string successor = "/api/v" + std::to_string(API_VERSION) + req.path.substr(std::min<size_t>(4, req.path.size()));
+        std::string response = negotiateVersion(req, deprecated);
+
+        // vp serve --allow: clients from other networks get nothing else
+        if (!remoteAllowed(g_options.allowCidrs, req.remote)) {
+            std::string error_body = R"({"error": "Client address not allowed"})";
+            std::ostringstream refused;
+            refused << "HTTP/1.1 403 Forbidden\r\n";
+            refused << "Content-Type: application/json\r\n";
+            refused << "Content-Length: " << error_body.length() << "\r\n";
+            refused << "\r\n";
+            refused << error_body;
+            response = refused.str();
         }
 
+        // Handlers read and change the state: one request at a time holds it,
+        // except while they wait (State::Unlocked)
+        auto data = g_state->lock();
+
         // Handle request
-        std::string response = handleRequest(method, path, body);
+        if (response.empty()) {
+            response = authorize(req);
+        }
+        if (response.empty() && isMutating(req.method) && !g_limiter->allow(req.remote, started)) {
+            std::string error_body = R"({"error": "Rate limit exceeded"})";
+            std::ostringstream limited;
+            limited << "HTTP/1.1 429 Too Many Requests\r\n";
+            limited << "Content-Type: application/json\r\n";
+            limited << "Retry-After: 1\r\n";
+            limited << "Content-Length: " << error_body.length() << "\r\n";
+            limited << "\r\n";
+            limited << error_body;
+            response = limited.str();
+        }
+        if (response.empty() && isMutating(req.method)) {
+            std::string reason = csrfError(req, g_state->remotesAllowed);
+            if (!reason.empty()) {
+                std::string error_body = json({{"error", reason}}).dump();
+                std::ostringstream refused;
+                refused << "HTTP/1.1 403 Forbidden\r\n";
+                refused << "Content-Type: application/json\r\n";
+                refused << "Content-Length: " << error_body.length() << "\r\n";
+                refused << "\r\n";
+                refused << error_body;
+                response = refused.str();
+                logWarn("csrf", {{"method", req.method}, {"path", req.path.substr(0, req.path.find('?'))}, {"reason", reason}});
+            }
+        }
+        if (response.empty()) {
+            response = handleSession(req);
+        }
+        auto upgrade = req.headers.find("upgrade");
+        if (response.empty() && isTerminalPath(req.path) && upgrade != req.headers.end() && upgrade->second == "websocket") {
+            data.unlock();
+            serveTerminal(clientSocket, req); // Holds the connection until either side closes
+            close(clientSocket);
+            return;
+        }
+        if (response.empty()) {
+            // Taken before the handler runs, so a change it races with only
+            // costs the client one more full response, never a stale 304
+            std::string etag;
+            if (req.method == "GET" && etagRoute(req.path)) {
+                etag = "\"" + g_bootId + "-" + std::to_string(g_state->revision()) + "\"";
+            }
+            response = handleRequest(req.method, req.path, req.body);
+            if (!etag.empty()) {
+                response = applyETag(req, etag, response);
+            }
+
+            // ?token= on the UI page: remember it so the page's API calls carry it
+            std::string token = queryParam(req.path, "token");
+            if (!token.empty() && req.path.substr(0, req.path.find('?')) == "/" && findToken(req)) {
+                response.insert(response.find("\r\n") + 2, "Set-Cookie: vp_token=" + token + "; HttpOnly; SameSite=Strict; Path=/\r\n");
+            }
+        }
+
+        // Pages (and /api/session, for custom frontends) hand out the CSRF
+        // cookie that mutating requests carrying cookies echo in X-VP-CSRF
+        std::string route = req.path.substr(0, req.path.find('?'));
+        if (req.method == "GET" && (route.rfind("/api/", 0) != 0 || route == "/api/session") &&
+            requestCookie(req, "vp_csrf").empty()) {
+            response.insert(response.find("\r\n") + 2, "Set-Cookie: vp_csrf=" + generateToken() + "; SameSite=Strict; Path=/\r\n");
+        }
+        data.unlock();
+
+        if (req.path.rfind("/api/", 0) == 0) {
+            std::string headers = "X-VP-API-Version: " + std::to_string(API_VERSION) + "\r\n";
+            if (deprecated) {
+                headers += "Deprecation: true\r\nLink: <" + successor.substr(0, successor.find('?')) + ">; rel=\"successor-version\"\r\n";
+            }
+            response.insert(response.find("\r\n") + 2, headers);
+        }
+        response = applyCors(req, response);
 
         // Send response
         ssize_t written = write(clientSocket, response.c_str(), response.length());
         (void)written; // Suppress unused warning
+
+        if (g_options.accessLog) {
+            auto origin = req.headers.find("origin");
+            logInfo("request", {
+                {"method", req.method},
+                {"path", req.path.substr(0, req.path.find('?'))}, // Query may carry ?token=
+                {"status", responseStatus(response)},
+                {"latency_ms", std::round((monotonicSeconds() - started) * 10000) / 10},
+                {"remote", req.remote},
+                {"origin", origin != req.headers.end() ? origin->second : ""}
+            });
+        }
     }
 
     close(clientSocket);
 }
 
-bool serveHTTP(const std::string& addr, std::shared_ptr<State> state) {
+// Accept connections, one thread each. Inherited sockets may be IPv6 or Unix.
+static void acceptLoop(int serverSocket) {
+    while (true) {
+        struct sockaddr_storage clientAddr;
+        socklen_t clientAddrLen = sizeof(clientAddr);
+
+        int clientSocket = accept(serverSocket, (struct sockaddr*)&clientAddr, &clientAddrLen);
+        if (clientSocket == -1) {
+            continue;
+        }
+
+        char ip[INET6_ADDRSTRLEN] = "";
+        if (clientAddr.ss_family == AF_INET) {
+            inet_ntop(AF_INET, &((struct sockaddr_in*)&clientAddr)->sin_addr, ip, sizeof(ip));
+        } else if (clientAddr.ss_family == AF_INET6) {
+            inet_ntop(AF_INET6, &((struct sockaddr_in6*)&clientAddr)->sin6_addr, ip, sizeof(ip));
+        }
+
+        std::thread(handleClient, clientSocket, std::string(ip)).detach();
+    }
+}
+
+bool serveHTTP(const std::string& addr, std::shared_ptr<State> state, const ServeOptions& options) {
     g_state = state;
+    g_options = options;
+    g_metrics = options.metrics;
+    g_limiter = std::make_unique<RateLimiter>(options.rate, options.burst);
 
-    // Parse address (format: ":8080" or "0.0.0.0:8080")
+    // Parse address (format: ":8080", "0.0.0.0:8080" or "[::1]:8080")
     int port = 8080;
-    size_t colonPos = addr.find(':');
+    size_t colonPos = addr.rfind(':');
+    std::string host = colonPos != std::string::npos ? addr.substr(0, colonPos) : "";
     if (colonPos != std::string::npos) {
         port = std::stoi(addr.substr(colonPos + 1));
     }
+    if (host.size() > 1 && host.front() == '[' && host.back() == ']') {
+        host = host.substr(1, host.size() - 2);
+    }
+
+    int serverSocket = options.listenFd;
+    if (serverSocket != -1) {
+        logInfo("HTTP server listening on inherited socket", {{"fd", serverSocket}, {"rate", options.rate}, {"burst", options.burst}});
+        sdNotify("READY=1\nSTATUS=Serving API on inherited socket");
+        acceptLoop(serverSocket);
+        return true;
+    }
+
+    // Bind address: IPv4 unless it has a colon
+    struct sockaddr_storage serverAddr;
+    socklen_t serverAddrLen;
+    memset(&serverAddr, 0, sizeof(serverAddr));
+    if (host.find(':') != std::string::npos) {
+        auto* v6 = (struct sockaddr_in6*)&serverAddr;
+        v6->sin6_family = AF_INET6;
+        v6->sin6_port = htons(port);
+        serverAddrLen = sizeof(*v6);
+        if (inet_pton(AF_INET6, host.c_str(), &v6->sin6_addr) != 1) {
+            logError("invalid bind address", {{"address", host}});
+            return false;
+        }
+    } else {
+        auto* v4 = (struct sockaddr_in*)&serverAddr;
+        v4->sin_family = AF_INET;
+        v4->sin_port = htons(port);
+        serverAddrLen = sizeof(*v4);
+        if (inet_pton(AF_INET, host.empty() ? "0.0.0.0" : host.c_str(), &v4->sin_addr) != 1) {
+            logError("invalid bind address", {{"address", host}});
+            return false;
+        }
+    }
 
     // Create socket
-    int serverSocket = socket(AF_INET, SOCK_STREAM, 0);
+    serverSocket = socket(serverAddr.ss_family, SOCK_STREAM, 0);
     if (serverSocket == -1) {
-        std::cerr << "Failed to create socket\n";
+        logError("failed to create socket", {{"error", strerror(errno)}});
         return false;
     }
 
@@ -552,40 +2762,24 @@ bool serveHTTP(const std::string& addr, std::shared_ptr<State> state) {
     setsockopt(serverSocket, SOL_SOCKET, SO_REUSEADDR, &opt, sizeof(opt));
 
     // Bind socket
-    struct sockaddr_in serverAddr;
-    memset(&serverAddr, 0, sizeof(serverAddr));
-    serverAddr.sin_family = AF_INET;
-    serverAddr.sin_addr.s_addr = INADDR_ANY;
-    serverAddr.sin_port = htons(port);
-
-    if (bind(serverSocket, (struct sockaddr*)&serverAddr, sizeof(serverAddr)) == -1) {
-        std::cerr << "Failed to bind socket\n";
+    if (bind(serverSocket, (struct sockaddr*)&serverAddr, serverAddrLen) == -1) {
+        logError("failed to bind socket", {{"address", host}, {"port", port}, {"error", strerror(errno)}});
         close(serverSocket);
         return false;
     }
 
     // Listen
     if (listen(serverSocket, 10) == -1) {
-        std::cerr << "Failed to listen on socket\n";
+        logError("failed to listen on socket", {{"port", port}, {"error", strerror(errno)}});
         close(serverSocket);
         return false;
     }
 
-    std::cout << "HTTP server listening on port " << port << std::endl;
-
-    // Accept connections
-    while (true) {
-        struct sockaddr_in clientAddr;
-        socklen_t clientAddrLen = sizeof(clientAddr);
-
-        int clientSocket = accept(serverSocket, (struct sockaddr*)&clientAddr, &clientAddrLen);
-        if (clientSocket == -1) {
-            continue;
-        }
+    logInfo("HTTP server listening", {{"address", host.empty() ? "0.0.0.0" : host}, {"port", port},
+                                      {"rate", options.rate}, {"burst", options.burst}});
+    sdNotify("READY=1\nSTATUS=Serving API on port " + std::to_string(port));
 
-        // Handle client in a new thread
-        std::thread(handleClient, clientSocket).detach();
-    }
+    acceptLoop(serverSocket);
 
     close(serverSocket);
     return true;
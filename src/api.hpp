@@ -2,16 +2,228 @@
 #define VP_API_HPP
 
 #include "state.hpp"
+#include "metrics.hpp"
+#include <map>
 #include <memory>
+#include <mutex>
 #include <string>
+#include <vector>
 
 namespace vp {
 
 // Embedded web HTML content
 extern const char* WEB_HTML;
 
-// Start HTTP server
-bool serveHTTP(const std::string& addr, std::shared_ptr<State> state);
+// Request is a parsed HTTP request
+struct Request {
+    std::string method;
+    std::string path;                           // Including query string
+    std::map<std::string, std::string> headers; // Names lowercased
+    std::string body;
+    std::string remote;                         // Client IP
+};
+
+// Apply a list endpoint's ?fields=a,b (keep only these keys), ?omit=a,b (drop
+// them), ?offset=N and ?limit=N to its items: an array, or an object keyed by
+// name (paged in key order). total gets the count before paging. Throws
+// std::invalid_argument on a bad offset or limit.
+json shapeList(const json& items, const std::string& path, size_t& total);
+
+// API version served. /api/v1/... is canonical; the unversioned /api/... paths
+// are deprecated aliases of it.
+constexpr int API_VERSION = 1;
+
+// Map req.path from /api/v1/... to the internal /api/... route, setting
+// deprecated when a client used an unversioned alias. Returns an error response
+// for another version in the path or in an X-VP-API-Version header, else "".
+std::string negotiateVersion(Request& req, bool& deprecated);
+
+// Body of /api/watch: {"revision", "changes": [{"revision", "kind", "name", "op",
+// "value"}]} for the changes after since, or {"revision", "reset": true} when they
+// are no longer known (since 0, or too old) and the client should re-read.
+// Values are current, and left out for tokens and removed items.
+json watchResult(State& state, unsigned long long since);
+
+// File under webDir for a request path ("/" -> index.html), or "" if there is
+// none or it would resolve outside webDir
+std::string staticFilePath(const std::string& webDir, const std::string& path);
+
+// Content-Type for a static file, by extension
+std::string staticContentType(const std::string& file);
+
+// Check if a GET of path is answered with an ETag (/api/instances, /api/templates, /api/config)
+bool etagRoute(const std::string& path);
+
+// Add the ETag header to a 200 response, or turn it into 304 Not Modified
+// when the request's If-None-Match already names that ETag
+std::string applyETag(const Request& req, const std::string& etag, const std::string& response);
+
+// Parse the request line, headers and body of a raw HTTP request
+Request parseRequest(const std::string& raw);
+
+// Check an Origin against the allowlist (origin -> allowed; "*" matches any)
+bool originAllowed(const std::map<std::string, bool>& remotesAllowed, const std::string& origin);
+
+// Why a mutating request may be a cross-site forgery, or "" if it is fine.
+// Bearer and ?token= requests are; a foreign Origin must be on the allowlist;
+// requests with the session or token cookie (unless from an origin listed by
+// name, not just let in by "*") must echo the vp_csrf cookie in an X-VP-CSRF
+// header (double submit).
+std::string csrfError(const Request& req, const std::map<std::string, bool>& remotesAllowed);
+
+// An origin as browsers send it, for the allowlist: "*" or scheme://host[:port],
+// lowercased, trailing slash dropped. Throws std::invalid_argument otherwise.
+std::string normalizeOrigin(const std::string& origin);
+
+// Check if ip (IPv4 or IPv6; IPv4-mapped IPv6 counts as IPv4) is inside cidr:
+// "10.0.0.0/8", "fd00::/8", or a single address. Throws std::invalid_argument
+// on a malformed cidr.
+bool cidrContains(const std::string& cidr, const std::string& ip);
+
+// Check a client against vp serve --allow: loopback, and clients without an IP
+// (Unix sockets), always pass, so the host can't lock itself out
+bool remoteAllowed(const std::vector<std::string>& cidrs, const std::string& ip);
+
+// Check if path is an instance's web terminal (/api/instances/<name>/terminal)
+bool isTerminalPath(const std::string& path);
+
+// Role a request needs: "viewer" (reads), "operator" (lifecycle, actions) or "admin"
+std::string requiredRole(const std::string& method, const std::string& path);
+
+// Check if a token's role covers the required role (admin > operator > viewer)
+bool roleAllows(const std::string& role, const std::string& required);
+
+// Value of a cookie in the request's Cookie header, or ""
+std::string requestCookie(const Request& req, const std::string& name);
+
+// Token from "Authorization: Bearer ...", ?token= or the vp_token cookie
+std::string requestToken(const Request& req);
+
+// Random 32-hex-digit token from /dev/urandom
+std::string generateToken();
+
+// Session is a web UI login: by a user's password, or by exchanging an API
+// token. Its role is looked up again on each request, so removing the user
+// or token ends it, and so does changing the password or token.
+struct Session {
+    std::string user;       // WebUser name, for password logins
+    std::string token;      // ApiToken name, for token logins
+    std::string credential; // The password hash or token it was started with
+    time_t expires = 0;
+};
+
+// SessionStore holds sessions by random ID (the vp_session cookie) until they expire
+class SessionStore {
+public:
+    // Start a session lasting ttl seconds from now; returns its ID
+    std::string create(Session session, long ttl, time_t now);
+
+    // Session with this ID, if it exists and hasn't expired
+    bool find(const std::string& id, time_t now, Session& session);
+
+    void remove(const std::string& id);
+
+private:
+    std::mutex mutex_;
+    std::map<std::string, Session> sessions_;
+};
+
+// Job is an instance start run in the background (POST /api/instances with
+// "async": true), polled at GET /api/jobs/<id>. phase goes queued, allocating,
+// starting, waiting-healthy (with "wait"), then done or failed.
+struct Job {
+    int id = 0;
+    std::string action;   // "start"
+    std::string instance; // Qualified instance name
+    std::string phase;
+    std::string error;    // Why it failed
+    time_t created = 0;
+    time_t updated = 0;   // Last phase change
+};
+
+inline void to_json(json& j, const Job& job) {
+    j = json{{"id", job.id}, {"action", job.action}, {"instance", job.instance}, {"phase", job.phase},
+             {"created", job.created}, {"updated", job.updated}};
+    if (!job.error.empty()) j["error"] = job.error;
+}
+
+// JobStore keeps jobs by ID: every unfinished one, and the last MAX_FINISHED finished
+class JobStore {
+public:
+    static constexpr size_t MAX_FINISHED = 100;
+
+    // New job in phase "queued"; returns its ID
+    int create(const std::string& action, const std::string& instance);
+
+    // Move a job to phase; error is kept for "failed"
+    void update(int id, const std::string& phase, const std::string& error = "");
+
+    // Job by ID; false if unknown (or long finished)
+    bool get(int id, Job& job);
+
+    // All kept jobs, oldest first
+    std::vector<Job> list();
+
+private:
+    std::mutex mutex_;
+    int next_ = 1;
+    std::map<int, Job> jobs_;
+};
+
+// RateLimiter is a token bucket per client: each key holds up to burst
+// tokens, refilled at rate per second. rate <= 0 disables limiting.
+class RateLimiter {
+public:
+    RateLimiter(double rate = 0, double burst = 0) : rate_(rate), burst_(burst) {}
+
+    // Take a token for key at time now (seconds); false if the bucket is empty
+    bool allow(const std::string& key, double now);
+
+private:
+    struct Bucket {
+        double tokens;
+        double last;
+    };
+
+    double rate_;
+    double burst_;
+    std::mutex mutex_;
+    std::map<std::string, Bucket> buckets_;
+};
+
+// Background loops of vp serve check in after each pass; /healthz reports a
+// loop as stalled once maxAge seconds go by without one
+void loopAlive(const std::string& loop, long maxAge);
+
+// Record how long a discovery pass (matchAndUpdateInstances) took
+void discoveryTook(double seconds);
+
+// Body of /healthz, or of /readyz when ready: {"status": "ok"|"fail", "checks"}.
+// Both cover loop liveness; readiness adds that the state file is writable and
+// that discovery has run, within DISCOVERY_SLOW_SECONDS.
+json selfCheck(bool ready, time_t now);
+
+constexpr double DISCOVERY_SLOW_SECONDS = 10;
+
+// Body of /api/self (vp serve --debug): vp's own threads, memory, fds, state
+// size, discovery cache hit rate and last discovery latency
+json selfStats(const State& state);
+
+// ServeOptions configures the HTTP server
+struct ServeOptions {
+    double rate = 0;        // Mutating requests per second per client (0 = unlimited)
+    double burst = 10;      // Requests allowed in a burst
+    bool accessLog = true;  // Log one line per request at info level
+    std::shared_ptr<MetricsHistory> metrics; // Served at /api/instances/<name>/metrics
+    int listenFd = -1;      // Already-listening socket to accept on (systemd socket activation)
+    bool debug = false;     // Serve /api/self
+    std::string webDir;     // Serve the UI from here ("/" -> index.html, else web.html); "" = built in
+    long sessionTtl = 12 * 3600; // Lifetime of a web UI login, in seconds
+    std::vector<std::string> allowCidrs; // Networks clients may connect from (empty = any)
+};
+
+// Start HTTP server on addr: ":8080" (all IPv4 interfaces), "127.0.0.1:8080" or "[::1]:8080"
+bool serveHTTP(const std::string& addr, std::shared_ptr<State> state, const ServeOptions& options = {});
 
 } // namespace vp
 
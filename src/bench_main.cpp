@@ -0,0 +1,43 @@
+#include "procutil.hpp"
+#include <chrono>
+#include <iostream>
+#include <iomanip>
+#include <functional>
+
+using namespace vp;
+
+// Run fn `iterations` times and return average milliseconds per run
+double bench(int iterations, const std::function<void()>& fn) {
+    auto start = std::chrono::steady_clock::now();
+    for (int i = 0; i < iterations; i++) {
+        fn();
+    }
+    auto elapsed = std::chrono::steady_clock::now() - start;
+    return std::chrono::duration<double, std::milli>(elapsed).count() / iterations;
+}
+
+int main(int argc, char* argv[]) {
+    int iterations = argc > 1 ? std::stoi(argv[1]) : 5;
+    auto pids = listPids();
+
+    std::cout << "Reading " << pids.size() << " processes, " << iterations << " iterations\n\n";
+
+    double perPid = bench(1, [&]() {
+        for (int pid : pids) {
+            readProcessInfo(pid);
+        }
+    });
+    double serial = bench(iterations, [&]() { readProcessInfos(pids, 1); });
+    double pooled = bench(iterations, [&]() { readProcessInfos(pids); });
+    size_t ports = 0;
+    double portMap = bench(iterations, [&]() { ports = buildPortToProcessMap().size(); });
+
+    std::cout << std::fixed << std::setprecision(1)
+              << std::left << std::setw(36) << "readProcessInfo per pid (1 run)" << perPid << " ms\n"
+              << std::left << std::setw(36) << "readProcessInfos, 1 worker" << serial << " ms\n"
+              << std::left << std::setw(36) << "readProcessInfos, worker pool" << pooled << " ms\n"
+              << std::left << std::setw(36) << ("buildPortToProcessMap (" + std::to_string(ports) + " ports)")
+              << portMap << " ms\n";
+
+    return 0;
+}
@@ -0,0 +1,533 @@
+#include "config.hpp"
+#include "logs.hpp"
+#include "state.hpp"
+#include <algorithm>
+#include <cstdlib>
+#include <fstream>
+#include <mutex>
+#include <pwd.h>
+#include <sstream>
+#include <stdexcept>
+#include <sys/stat.h>
+#include <unistd.h>
+
+namespace vp {
+
+const std::vector<ConfigKey>& configKeys() {
+    static const std::vector<ConfigKey> keys = {
+        {"serve.port", "int", "vp serve's port (8080; a profile's own wins)"},
+        {"serve.bind", "string", "Address vp serve listens on (0.0.0.0)"},
+        {"serve.allow", "list", "Networks clients may connect from (CIDRs; any)"},
+        {"serve.rate", "string", "Mutating requests per second per client (unlimited)"},
+        {"serve.burst", "int", "Requests allowed in a burst (10)"},
+        {"serve.access-log", "bool", "Log one line per request (true)"},
+        {"serve.web-dir", "string", "Serve the UI from this directory (built in)"},
+        {"serve.metrics-interval", "duration", "How often usage is sampled (15s)"},
+        {"serve.metrics-retention", "duration", "How long samples are kept (24h)"},
+        {"discovery.interval", "duration", "How often vp serve matches processes (the metrics interval)"},
+        {"discovery.ignore", "list", "Regexes on command lines discovery never lists"},
+        {"ports.start", "int", "Start of the tcpport counter's range (3000)"},
+        {"ports.end", "int", "End of the tcpport counter's range (start + 999, or 9999)"},
+        {"logs.max-size", "size", "Rotate instance logs past this size (10M)"},
+        {"logs.max-files", "int", "Rotated logs to keep (5)"},
+        {"logs.max-age", "duration", "Delete rotated logs older than this (never)"},
+        {"logs.compress", "bool", "gzip rotated logs (false)"},
+        {"logs.prune-after", "duration", "vp serve prunes instances stopped this long (never)"},
+        {"auth.session-ttl", "duration", "Lifetime of a web UI login (12h)"},
+        {"auth.origins", "list", "Browser origins allowed cross-origin API access"},
+        {"state.dir", "string", "Where state lives instead of ~/.vibeprocess"},
+        {"state.keyfile", "string", "Key encrypting state.json (<state dir>/state.key)"},
+    };
+    return keys;
+}
+
+static std::string homeDir() {
+    const char* home = getenv("HOME");
+    if (home && *home) {
+        return home;
+    }
+    struct passwd* pw = getpwuid(getuid());
+    return pw ? pw->pw_dir : "/tmp";
+}
+
+static bool isYaml(const std::string& path) {
+    auto dot = path.rfind('.');
+    std::string ext = dot == std::string::npos ? "" : path.substr(dot);
+    return ext == ".yaml" || ext == ".yml";
+}
+
+std::string configPath() {
+    if (const char* path = getenv("VP_CONFIG")) {
+        if (*path) return path;
+    }
+    std::string dir = homeDir() + "/.config/vp";
+    std::string toml = dir + "/config.toml", yaml = dir + "/config.yaml";
+    if (access(toml.c_str(), F_OK) != 0 && access(yaml.c_str(), F_OK) == 0) {
+        return yaml;
+    }
+    return toml;
+}
+
+// A key's lines (more than one for a YAML block list) and its value
+struct ConfigEntry {
+    std::string key;  // "section.key"
+    std::string value;
+    size_t first, last;
+};
+
+// The file as lines plus where each key and section sits in them
+struct ConfigFile {
+    std::vector<std::string> lines;
+    std::vector<ConfigEntry> entries;
+    std::map<std::string, size_t> sectionEnd;  // Last line of each section ("" = top level)
+};
+
+static std::string trim(const std::string& s) {
+    size_t start = s.find_first_not_of(" \t\r");
+    if (start == std::string::npos) return "";
+    return s.substr(start, s.find_last_not_of(" \t\r") - start + 1);
+}
+
+static std::runtime_error syntaxError(size_t line, const std::string& what) {
+    return std::runtime_error("line " + std::to_string(line + 1) + ": " + what);
+}
+
+// A quoted string at s[pos] (which holds the quote); pos ends past the closing one
+static std::string readQuoted(const std::string& s, size_t& pos, size_t line) {
+    char quote = s[pos++];
+    std::string out;
+    while (pos < s.size() && s[pos] != quote) {
+        char c = s[pos++];
+        if (c == '\\' && quote == '"' && pos < s.size()) {
+            char e = s[pos++];
+            out += e == 'n' ? '\n' : e == 't' ? '\t' : e;
+        } else {
+            out += c;
+        }
+    }
+    if (pos >= s.size()) {
+        throw syntaxError(line, "unterminated string");
+    }
+    pos++;
+    return out;
+}
+
+// Whether the rest of s from pos is blank or a comment
+static bool restIsEmpty(const std::string& s, size_t pos) {
+    std::string rest = trim(s.substr(std::min(pos, s.size())));
+    return rest.empty() || rest[0] == '#';
+}
+
+// A scalar or [list] (joined with ","). Bare words end at a comment.
+static std::string readValue(const std::string& s, size_t line, bool yaml) {
+    std::string text = trim(s);
+    if (text.empty()) {
+        throw syntaxError(line, "missing value");
+    }
+    size_t pos = 0;
+    if (text[0] == '"' || text[0] == '\'') {
+        std::string value = readQuoted(text, pos, line);
+        if (!restIsEmpty(text, pos)) {
+            throw syntaxError(line, "unexpected text after string");
+        }
+        return value;
+    }
+    if (text[0] == '[') {
+        std::vector<std::string> items;
+        pos = 1;
+        while (true) {
+            while (pos < text.size() && (text[pos] == ' ' || text[pos] == '\t')) pos++;
+            if (pos >= text.size()) {
+                throw syntaxError(line, "unterminated list (lists must fit on one line)");
+            }
+            if (text[pos] == ']') break;
+            if (text[pos] == '"' || text[pos] == '\'') {
+                items.push_back(readQuoted(text, pos, line));
+            } else {
+                size_t end = text.find_first_of(",]", pos);
+                if (end == std::string::npos) {
+                    throw syntaxError(line, "unterminated list (lists must fit on one line)");
+                }
+                items.push_back(trim(text.substr(pos, end - pos)));
+                pos = end;
+            }
+            while (pos < text.size() && (text[pos] == ' ' || text[pos] == '\t')) pos++;
+            if (pos < text.size() && text[pos] == ',') pos++;
+            else if (pos >= text.size() || text[pos] != ']') throw syntaxError(line, "expected , or ] in list");
+        }
+        if (!restIsEmpty(text, pos + 1)) {
+            throw syntaxError(line, "unexpected text after list");
+        }
+        std::string joined;
+        for (const auto& item : items) joined += (joined.empty() ? "" : ",") + item;
+        return joined;
+    }
+    // A comment starts at a '#' after whitespace
+    for (size_t i = 1; i < text.size(); i++) {
+        if (text[i] == '#' && (text[i - 1] == ' ' || text[i - 1] == '\t')) {
+            text = trim(text.substr(0, i));
+            break;
+        }
+    }
+    if (!yaml && text.find_first_of(" \t\"'=") != std::string::npos) {
+        throw syntaxError(line, "strings must be quoted");
+    }
+    return text;
+}
+
+static std::string unquoteKey(const std::string& key, size_t line) {
+    std::string k = trim(key);
+    if (!k.empty() && (k[0] == '"' || k[0] == '\'')) {
+        size_t pos = 0;
+        k = readQuoted(k, pos, line);
+    }
+    if (k.empty()) {
+        throw syntaxError(line, "missing key");
+    }
+    return k;
+}
+
+static ConfigFile scanConfig(const std::string& text, bool yaml) {
+    ConfigFile file;
+    std::stringstream ss(text);
+    for (std::string line; std::getline(ss, line);) {
+        file.lines.push_back(line);
+    }
+
+    std::string section;
+    size_t listEntry = std::string::npos;  // Entry of the YAML key whose "- item" lines follow
+    size_t listIndent = 0;
+    for (size_t i = 0; i < file.lines.size(); i++) {
+        const std::string& raw = file.lines[i];
+        std::string line = trim(raw);
+        if (line.empty() || line[0] == '#') {
+            continue;
+        }
+        size_t indent = raw.find_first_not_of(' ');
+
+        if (!yaml) {
+            if (line[0] == '[') {
+                size_t close = line.find(']');
+                if (line.rfind("[[", 0) == 0 || close == std::string::npos || !restIsEmpty(line, close + 1)) {
+                    throw syntaxError(i, "bad section header");
+                }
+                section = trim(line.substr(1, close - 1));
+                file.sectionEnd[section] = i;
+                continue;
+            }
+            size_t eq = line.find('=');
+            if (eq == std::string::npos) {
+                throw syntaxError(i, "expected key = value");
+            }
+            std::string key = unquoteKey(line.substr(0, eq), i);
+            file.entries.push_back({section.empty() ? key : section + "." + key, readValue(line.substr(eq + 1), i, false), i, i});
+            file.sectionEnd[section] = i;
+            continue;
+        }
+
+        if (raw.find('\t') < indent) {
+            throw syntaxError(i, "indent with spaces, not tabs");
+        }
+        if (line[0] == '-') {
+            if (listEntry == std::string::npos || indent <= listIndent || (line.size() > 1 && line[1] != ' ')) {
+                throw syntaxError(i, "list item outside a list");
+            }
+            std::string item = readValue(line.substr(1), i, true);
+            auto& entry = file.entries[listEntry];
+            entry.value += (entry.value.empty() ? "" : ",") + item;
+            entry.last = i;
+            file.sectionEnd[section] = i;
+            continue;
+        }
+        listEntry = std::string::npos;
+
+        size_t colon = line.find(": ");
+        if (colon == std::string::npos && line.back() == ':') colon = line.size() - 1;
+        if (colon == std::string::npos) {
+            throw syntaxError(i, "expected key: value");
+        }
+        std::string key = unquoteKey(line.substr(0, colon), i);
+        std::string rest = trim(line.substr(colon + 1));
+        bool empty = rest.empty() || rest[0] == '#';
+        if (indent == 0) {
+            if (empty) {
+                // A section, unless "- item" lines follow (a top-level list)
+                section = key;
+                file.sectionEnd[section] = i;
+                file.entries.push_back({key, "", i, i});
+                listEntry = file.entries.size() - 1;
+                listIndent = 0;
+                continue;
+            }
+            section = "";
+            file.entries.push_back({key, readValue(rest, i, true), i, i});
+        } else {
+            if (section.empty()) {
+                throw syntaxError(i, "indented key outside a section");
+            }
+            file.entries.push_back({section + "." + key, empty ? "" : readValue(rest, i, true), i, i});
+            if (empty) {
+                listEntry = file.entries.size() - 1;
+                listIndent = indent;
+            }
+        }
+        file.sectionEnd[section] = i;
+    }
+
+    // Section headers were entries only in case a list followed
+    std::vector<ConfigEntry> entries;
+    for (const auto& entry : file.entries) {
+        bool header = yaml && entry.key.find('.') == std::string::npos && entry.value.empty() &&
+                      file.sectionEnd.count(entry.key) && entry.first == entry.last;
+        if (!header) entries.push_back(entry);
+    }
+    file.entries = entries;
+    return file;
+}
+
+Config parseConfig(const std::string& text, bool yaml) {
+    Config config;
+    for (const auto& entry : scanConfig(text, yaml).entries) {
+        config[entry.key] = entry.value;
+    }
+    return config;
+}
+
+static std::string readFile(const std::string& path, bool& exists) {
+    std::ifstream file(path);
+    exists = file.is_open();
+    std::stringstream buffer;
+    buffer << file.rdbuf();
+    return buffer.str();
+}
+
+Config loadConfig() {
+    static std::mutex mutex;
+    static std::string cachedPath;
+    static time_t cachedTime = 0;
+    static ino_t cachedInode = 0;
+    static off_t cachedSize = -1;
+    static Config cached;
+
+    std::string path = configPath();
+    struct stat st;
+    if (stat(path.c_str(), &st) != 0) {
+        return {};
+    }
+    std::lock_guard<std::mutex> lock(mutex);
+    // vp config set renames a new file in, so a new inode catches quick rewrites
+    if (path == cachedPath && st.st_mtime == cachedTime && st.st_ino == cachedInode && st.st_size == cachedSize) {
+        return cached;
+    }
+    bool exists;
+    std::string text = readFile(path, exists);
+    try {
+        cached = parseConfig(text, isYaml(path));
+    } catch (const std::exception& e) {
+        cachedPath = "";
+        throw std::runtime_error(path + ", " + e.what());
+    }
+    cachedPath = path;
+    cachedTime = st.st_mtime;
+    cachedInode = st.st_ino;
+    cachedSize = st.st_size;
+    return cached;
+}
+
+std::string configValue(const std::string& key, const std::string& fallback) {
+    try {
+        auto config = loadConfig();
+        auto it = config.find(key);
+        return it != config.end() && !it->second.empty() ? it->second : fallback;
+    } catch (const std::exception&) {
+        return fallback;
+    }
+}
+
+void validateConfigValue(const std::string& key, const std::string& value) {
+    const ConfigKey* known = nullptr;
+    for (const auto& k : configKeys()) {
+        if (k.key == key) known = &k;
+    }
+    if (!known) {
+        throw std::runtime_error("unknown setting: " + key + " (see vp config get)");
+    }
+    bool ok = true;
+    try {
+        if (known->kind == "int") {
+            ok = !value.empty() && value.find_first_not_of("0123456789") == std::string::npos;
+        } else if (known->kind == "bool") {
+            ok = value == "true" || value == "false";
+        } else if (known->kind == "duration") {
+            ok = parseDuration(value) >= 0;
+        } else if (known->kind == "size") {
+            ok = parseSize(value) >= 0;
+        }
+    } catch (const std::exception&) {
+        ok = false;
+    }
+    if (!ok) {
+        throw std::runtime_error(key + " must be a " + known->kind + ", not \"" + value + "\"");
+    }
+}
+
+static std::string kindOf(const std::string& key) {
+    for (const auto& k : configKeys()) {
+        if (k.key == key) return k.kind;
+    }
+    return "string";
+}
+
+static std::string quote(const std::string& s) {
+    std::string out = "\"";
+    for (char c : s) {
+        if (c == '"' || c == '\\') out += '\\';
+        if (c == '\n') out += "\\n";
+        else out += c;
+    }
+    return out + "\"";
+}
+
+// value as it is written for key
+static std::string formatValue(const std::string& key, const std::string& value) {
+    std::string kind = kindOf(key);
+    if (kind == "int" || kind == "bool") {
+        return value;
+    }
+    if (kind == "list") {
+        std::stringstream ss(value);
+        std::string out;
+        for (std::string item; std::getline(ss, item, ',');) {
+            out += (out.empty() ? "" : ", ") + quote(trim(item));
+        }
+        return "[" + out + "]";
+    }
+    return quote(value);
+}
+
+void setConfigValue(const std::string& key, const std::string& value) {
+    if (!value.empty()) {
+        validateConfigValue(key, value);
+    }
+    std::string path = configPath();
+    bool yaml = isYaml(path), exists;
+    std::string text = readFile(path, exists);
+    ConfigFile file;
+    try {
+        file = scanConfig(text, yaml);
+    } catch (const std::exception& e) {
+        throw std::runtime_error(path + ", " + e.what() + "; fix it by hand first");
+    }
+
+    auto dot = key.find('.');
+    std::string section = dot == std::string::npos ? "" : key.substr(0, dot);
+    std::string name = dot == std::string::npos ? key : key.substr(dot + 1);
+    std::string line = yaml ? (section.empty() ? "" : "  ") + name + ": " + formatValue(key, value)
+                            : name + " = " + formatValue(key, value);
+
+    auto& lines = file.lines;
+    auto entry = std::find_if(file.entries.begin(), file.entries.end(), [&](const ConfigEntry& e) { return e.key == key; });
+    if (entry != file.entries.end()) {
+        lines.erase(lines.begin() + entry->first, lines.begin() + entry->last + 1);
+        if (!value.empty()) {
+            lines.insert(lines.begin() + entry->first, line);
+        }
+    } else if (value.empty()) {
+        return;
+    } else if (file.sectionEnd.count(section) && (!section.empty() || !yaml)) {
+        lines.insert(lines.begin() + file.sectionEnd[section] + 1, line);
+    } else if (section.empty()) {
+        // Top-level keys go before the first section
+        lines.insert(lines.begin(), line);
+    } else {
+        if (!lines.empty() && !trim(lines.back()).empty()) lines.push_back("");
+        lines.push_back(yaml ? section + ":" : "[" + section + "]");
+        lines.push_back(line);
+    }
+
+    std::string out;
+    for (const auto& l : lines) out += l + "\n";
+    auto slash = path.rfind('/');
+    if (slash != std::string::npos && slash > 0) {
+        std::string dir = path.substr(0, slash);
+        std::string parent = dir.substr(0, dir.rfind('/'));
+        mkdir(parent.c_str(), 0755);
+        mkdir(dir.c_str(), 0755);
+    }
+    std::string tmp = path + ".tmp";
+    std::ofstream f(tmp);
+    if (!f.is_open()) {
+        throw std::runtime_error("cannot write " + path);
+    }
+    f << out;
+    f.close();
+    if (rename(tmp.c_str(), path.c_str()) != 0) {
+        throw std::runtime_error("cannot write " + path);
+    }
+}
+
+void applyConfig(State& state) {
+    Config config = loadConfig();
+    auto get = [&](const std::string& key) {
+        auto it = config.find(key);
+        return it != config.end() ? it->second : "";
+    };
+    auto number = [&](const std::string& key, auto parse) {
+        try {
+            return parse(get(key));
+        } catch (const std::exception&) {
+            throw std::runtime_error(configPath() + ": invalid " + key + ": " + get(key));
+        }
+    };
+
+    auto& overlay = state.configOverlay;
+    overlay = State::ConfigOverlay();
+
+    auto tcpport = state.types.find("tcpport");
+    if (!get("ports.start").empty() && tcpport != state.types.end()) {
+        // A copy, so the file's type stays as it was
+        auto rt = std::make_shared<ResourceType>(*tcpport->second);
+        overlay.ports = true;
+        overlay.savedStart = rt->start;
+        overlay.savedEnd = rt->end;
+        overlay.savedCounter = state.counters["tcpport"];
+        rt->start = number("ports.start", [](const std::string& s) { return std::stoi(s); });
+        rt->end = get("ports.end").empty() ? rt->start + 999 : number("ports.end", [](const std::string& s) { return std::stoi(s); });
+        overlay.start = rt->start;
+        overlay.end = rt->end;
+        tcpport->second = rt;
+        int next = state.counters["tcpport"];
+        if (next < rt->start || next > rt->end) {
+            state.counters["tcpport"] = 0;
+        }
+    }
+
+    LogPolicy saved = state.logPolicy;
+    if (!get("logs.max-size").empty()) state.logPolicy.max_size = number("logs.max-size", parseSize);
+    if (!get("logs.max-files").empty()) {
+        state.logPolicy.max_files = number("logs.max-files", [](const std::string& s) { return std::stoi(s); });
+    }
+    if (!get("logs.max-age").empty()) state.logPolicy.max_age = number("logs.max-age", parseDuration);
+    if (!get("logs.compress").empty()) state.logPolicy.compress = get("logs.compress") == "true";
+    if (json(saved) != json(state.logPolicy)) {
+        overlay.logs = saved;
+        overlay.configLogs = state.logPolicy;
+    }
+    if (!get("logs.prune-after").empty()) {
+        overlay.pruneAfter = state.pruneAfter;
+        state.pruneAfter = number("logs.prune-after", parseDuration);
+        overlay.configPruneAfter = state.pruneAfter;
+    }
+
+    // Origins the file already has keep its answer, so a block wins
+    std::stringstream origins(get("auth.origins"));
+    for (std::string origin; std::getline(origins, origin, ',');) {
+        origin = trim(origin);
+        if (!origin.empty() && !state.remotesAllowed.count(origin)) {
+            state.remotesAllowed[origin] = true;
+            overlay.origins.push_back(origin);
+        }
+    }
+}
+
+} // namespace vp
@@ -0,0 +1,63 @@
+#ifndef VP_CONFIG_HPP
+#define VP_CONFIG_HPP
+
+#include <map>
+#include <string>
+#include <vector>
+
+namespace vp {
+
+class State;
+
+// Daemon defaults that would otherwise be hardcoded or scattered through
+// state.json live in ~/.config/vp/config.toml (or config.yaml; $VP_CONFIG
+// names another file). Only a subset of each format is read: sections of
+// key = value (TOML) or key: value (YAML) pairs holding strings, numbers,
+// booleans and lists of strings:
+//   [serve]
+//   port = 8090
+//   allow = ["127.0.0.1/32", "10.0.0.0/8"]
+// Flags win over the file, and the file over what state.json holds.
+
+// "section.key" -> value; lists are joined with ","
+using Config = std::map<std::string, std::string>;
+
+// A key vp reads, for vp config get/set
+struct ConfigKey {
+    std::string key;          // "serve.port"
+    std::string kind;         // int|duration|size|bool|string|list
+    std::string description;
+};
+
+// Every key vp reads, in display order
+const std::vector<ConfigKey>& configKeys();
+
+// $VP_CONFIG, else ~/.config/vp/config.toml, or config.yaml if only it exists
+std::string configPath();
+
+// Parse config text (YAML when yaml, else TOML). Throws std::runtime_error
+// naming the line on syntax it doesn't read.
+Config parseConfig(const std::string& text, bool yaml);
+
+// The config file's settings (empty when there is none), re-read when it
+// changes. Throws std::runtime_error when it can't be parsed.
+Config loadConfig();
+
+// One setting, or fallback when unset (or the file is unreadable)
+std::string configValue(const std::string& key, const std::string& fallback = "");
+
+// Check value against key's kind; throws std::runtime_error if it's unknown
+// or the value doesn't fit
+void validateConfigValue(const std::string& key, const std::string& value);
+
+// Set (or with an empty value, remove) key in the config file, creating it if
+// needed. Other lines, comments included, are kept. Throws std::runtime_error.
+void setConfigValue(const std::string& key, const std::string& value);
+
+// Apply the file's [ports], [logs] and [auth] settings over what state.json
+// loaded. Throws std::runtime_error when the file is unreadable.
+void applyConfig(State& state);
+
+} // namespace vp
+
+#endif // VP_CONFIG_HPP
@@ -0,0 +1,69 @@
+#include "discovery.hpp"
+#include <cstdio>
+#include <stdexcept>
+
+namespace vp {
+
+std::vector<std::shared_ptr<ProcessInfo>> parseDiscoveredProcesses(const std::string& output) {
+    json j = json::parse(output);
+    if (!j.is_array()) {
+        throw std::runtime_error("expected a JSON array of processes");
+    }
+
+    std::vector<std::shared_ptr<ProcessInfo>> result;
+    for (const auto& p : j) {
+        if (!p.is_object() || !p.contains("pid") || !p.contains("command")) {
+            throw std::runtime_error("every process needs pid and command");
+        }
+        auto info = std::make_shared<ProcessInfo>();
+        info->pid = p["pid"].get<int>();
+        info->ppid = p.value("ppid", 0);
+        info->cmdline = p["command"].get<std::string>();
+        info->name = p.value("name", info->cmdline.substr(0, info->cmdline.find(' ')));
+        info->exe = p.value("exe", "");
+        info->cwd = p.value("cwd", "");
+        info->ports = p.value("ports", std::vector<int>{});
+        info->container = p.value("container", "");
+        info->container_runtime = p.value("container_runtime", "");
+        info->foreign_net = false;
+        info->cpu_time = 0;
+        info->rss = 0;
+        info->start_time = 0;
+        info->threads = 0;
+        info->fds = 0;
+        info->fd_limit = 0;
+        info->io_read = 0;
+        info->io_write = 0;
+        result.push_back(info);
+    }
+    return result;
+}
+
+std::vector<std::shared_ptr<ProcessInfo>> ExecDiscoverySource::list() {
+    FILE* pipe = popen(command_.c_str(), "r");
+    if (!pipe) {
+        throw std::runtime_error("cannot run " + command_);
+    }
+
+    std::string output;
+    char buffer[4096];
+    size_t n;
+    while ((n = fread(buffer, 1, sizeof(buffer), pipe)) > 0) {
+        output.append(buffer, n);
+    }
+    if (pclose(pipe) != 0) {
+        throw std::runtime_error("command failed: " + command_);
+    }
+    return parseDiscoveredProcesses(output);
+}
+
+std::vector<std::unique_ptr<DiscoverySource>> discoverySources(const State& state, ProcessCache& cache) {
+    std::vector<std::unique_ptr<DiscoverySource>> sources;
+    sources.push_back(std::make_unique<LocalDiscoverySource>(cache));
+    for (const auto& [name, command] : state.discoverySources) {
+        sources.push_back(std::make_unique<ExecDiscoverySource>(name, command));
+    }
+    return sources;
+}
+
+} // namespace vp
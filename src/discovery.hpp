@@ -0,0 +1,66 @@
+#ifndef VP_DISCOVERY_HPP
+#define VP_DISCOVERY_HPP
+
+#include "procutil.hpp"
+#include "state.hpp"
+#include <memory>
+#include <string>
+#include <vector>
+
+namespace vp {
+
+// DiscoverySource is somewhere vp can find running processes. The local process
+// table is built in; others (docker, remote agents, scripts) are commands that
+// print process JSON. Everything a source returns goes through the same
+// template matching as local processes.
+class DiscoverySource {
+public:
+    virtual ~DiscoverySource() = default;
+
+    // "local" or the configured source name; shown as "source" by vp discover
+    virtual std::string name() const = 0;
+
+    // True when PIDs are in our process table (can be imported and signalled)
+    virtual bool local() const { return false; }
+
+    // Processes currently visible; throws std::runtime_error if unreachable
+    virtual std::vector<std::shared_ptr<ProcessInfo>> list() = 0;
+};
+
+// The local process table, through a ProcessCache so repeat scans are cheap
+class LocalDiscoverySource : public DiscoverySource {
+public:
+    explicit LocalDiscoverySource(ProcessCache& cache) : cache_(cache) {}
+    std::string name() const override { return "local"; }
+    bool local() const override { return true; }
+    std::vector<std::shared_ptr<ProcessInfo>> list() override { return cache_.refresh(); }
+
+private:
+    ProcessCache& cache_;
+};
+
+// Runs a shell command that prints a JSON array of processes:
+// [{"pid": 12, "ppid": 1, "name": "nginx", "command": "nginx -g ...",
+//   "cwd": "/", "exe": "/usr/sbin/nginx", "ports": [80]}]
+// Only pid and command are required.
+class ExecDiscoverySource : public DiscoverySource {
+public:
+    ExecDiscoverySource(const std::string& name, const std::string& command)
+        : name_(name), command_(command) {}
+    std::string name() const override { return name_; }
+    std::vector<std::shared_ptr<ProcessInfo>> list() override;
+
+private:
+    std::string name_;
+    std::string command_;
+};
+
+// Parse the JSON an ExecDiscoverySource command prints
+std::vector<std::shared_ptr<ProcessInfo>> parseDiscoveredProcesses(const std::string& output);
+
+// The local source followed by one ExecDiscoverySource per state.discoverySources entry
+std::vector<std::unique_ptr<DiscoverySource>> discoverySources(const State& state, ProcessCache& cache);
+
+} // namespace vp
+
+#endif // VP_DISCOVERY_HPP
@@ -0,0 +1,123 @@
+#ifndef VP_FAKEPROC_HPP
+#define VP_FAKEPROC_HPP
+
+#include "procutil.hpp"
+#include <algorithm>
+#include <atomic>
+
+namespace vp {
+
+// FakeProcessInspector is an in-memory process table for tests.
+// Install with setProcessInspector(); nothing touches /proc or spawns processes.
+class FakeProcessInspector : public ProcessInspector {
+public:
+    // Add (or replace) a process. Processes with an empty cmdline are kernel threads.
+    void addProcess(const ProcessInfo& info) {
+        processes_[info.pid] = info;
+    }
+
+    void removeProcess(int pid) {
+        processes_.erase(pid);
+    }
+
+    // Mark pid as listening on port
+    void listen(int pid, int port) {
+        ports_[port].push_back(pid);
+    }
+
+    // Number of readProcessInfo calls so far
+    int fullReads() const {
+        return fullReads_;
+    }
+
+    std::vector<int> listPids() override {
+        std::vector<int> pids;
+        for (const auto& [pid, info] : processes_) {
+            pids.push_back(pid);
+        }
+        return pids;
+    }
+
+    std::shared_ptr<ProcessInfo> readProcessStat(int pid) override {
+        auto it = processes_.find(pid);
+        if (it == processes_.end()) return nullptr;
+
+        auto info = std::make_shared<ProcessInfo>();
+        info->pid = pid;
+        info->ppid = it->second.ppid;
+        info->name = it->second.name;
+        info->exe = it->second.exe;
+        info->cpu_time = it->second.cpu_time;
+        info->rss = it->second.rss;
+        info->start_time = it->second.start_time;
+        info->threads = it->second.threads;
+        return info;
+    }
+
+    bool readFdUsage(int pid, ProcessInfo& info) override {
+        auto it = processes_.find(pid);
+        if (it == processes_.end()) return false;
+
+        info.fds = it->second.fds;
+        info.fd_limit = it->second.fd_limit;
+        return true;
+    }
+
+    bool readIoUsage(int pid, ProcessInfo& info) override {
+        auto it = processes_.find(pid);
+        if (it == processes_.end()) return false;
+
+        info.io_read = it->second.io_read;
+        info.io_write = it->second.io_write;
+        return true;
+    }
+
+    bool readCommand(int pid, ProcessInfo& info) override {
+        auto it = processes_.find(pid);
+        if (it == processes_.end()) return false;
+
+        info.cmdline = it->second.cmdline;
+        info.cwd = it->second.cwd;
+        return true;
+    }
+
+    std::shared_ptr<ProcessInfo> readProcessInfo(int pid, const std::map<int, std::vector<int>>& portMap) override {
+        auto it = processes_.find(pid);
+        if (it == processes_.end()) return nullptr;
+
+        fullReads_++;
+        auto info = std::make_shared<ProcessInfo>(it->second);
+        info->ports = info->foreign_net ? std::vector<int>() : portsForPid(pid, portMap);
+        return info;
+    }
+
+    std::map<int, std::vector<int>> buildPortToProcessMap() override {
+        std::map<int, std::vector<int>> result;
+        for (const auto& [port, pids] : ports_) {
+            for (int pid : pids) {
+                if (processes_.count(pid)) {
+                    result[port].push_back(pid);
+                }
+            }
+        }
+        return result;
+    }
+
+    bool isKernelThread(int pid, const std::string& /*cmdline*/) override {
+        auto it = processes_.find(pid);
+        return it != processes_.end() && it->second.cmdline.empty();
+    }
+
+    bool isRunning(int pid) override {
+        return processes_.count(pid) > 0;
+    }
+
+private:
+    std::map<int, ProcessInfo> processes_;
+    std::map<int, std::vector<int>> ports_;
+    std::atomic<int> fullReads_{0}; // readProcessInfo runs on ProcessCache's worker threads
+};
+
+} // namespace vp
+
+#endif // VP_FAKEPROC_HPP
@@ -0,0 +1,282 @@
+#include "helper.hpp"
+#include <algorithm>
+#include <cerrno>
+#include <csignal>
+#include <cstdio>
+#include <cstdlib>
+#include <cstring>
+#include <dirent.h>
+#include <fstream>
+#include <iostream>
+#include <map>
+#include <pwd.h>
+#include <regex>
+#include <set>
+#include <sstream>
+#include <sys/stat.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+namespace vp {
+
+std::string helperCommand() {
+    const char* env = getenv("VP_HELPER");
+    return env ? env : "";
+}
+
+// Run the helper with args; its stderr (why it refused) goes to error
+static bool runHelperCommand(const std::string& args, std::string& error) {
+    std::string cmd = helperCommand() + " " + args + " 2>&1 </dev/null";
+    FILE* pipe = popen(cmd.c_str(), "r");
+    if (!pipe) {
+        error = "cannot run the helper";
+        return false;
+    }
+    std::string output;
+    char buffer[1024];
+    size_t n;
+    while ((n = fread(buffer, 1, sizeof(buffer), pipe)) > 0) {
+        output.append(buffer, n);
+    }
+    int status = pclose(pipe);
+    while (!output.empty() && output.back() == '\n') output.pop_back();
+    if (status != 0) {
+        error = output.empty() ? "helper exited with " + std::to_string(WEXITSTATUS(status)) : output;
+        return false;
+    }
+    return true;
+}
+
+bool helperSignal(int pid, int sig, std::string& error) {
+    if (helperCommand().empty()) {
+        error = "no privileged helper configured (VP_HELPER)";
+        return false;
+    }
+    return runHelperCommand("signal " + std::to_string(pid) + " " + std::to_string(sig), error);
+}
+
+bool helperAllows(int pid) {
+    std::string error;
+    return !helperCommand().empty() && runHelperCommand("check " + std::to_string(pid), error);
+}
+
+bool helperAuthorized(const json& policy, const std::string& user, const std::string& owner,
+                      const std::string& cmdline) {
+    if (!policy.contains("rules") || !policy["rules"].is_array()) {
+        return false;
+    }
+    for (const auto& rule : policy["rules"]) {
+        if (!rule.is_object()) continue;
+        std::string ruleUser = rule.value("user", "");
+        std::string ruleOwner = rule.value("owner", "");
+        if ((ruleUser != "*" && ruleUser != user) || (ruleOwner != "*" && ruleOwner != owner)) {
+            continue;
+        }
+        std::string pattern = rule.value("cmdline", "");
+        try {
+            if (pattern.empty() || std::regex_search(cmdline, std::regex(pattern))) {
+                return true;
+            }
+        } catch (const std::regex_error&) {
+            // A broken rule allows nothing
+        }
+    }
+    return false;
+}
+
+static std::string userName(uid_t uid) {
+    struct passwd* pw = getpwuid(uid);
+    return pw ? pw->pw_name : std::to_string(uid);
+}
+
+// Who asked: sudo and pkexec say so in variables the caller can't set
+static std::string callingUser() {
+    if (const char* user = getenv("SUDO_USER")) {
+        return user;
+    }
+    if (const char* uid = getenv("PKEXEC_UID")) {
+        return userName((uid_t)atol(uid));
+    }
+    return userName(getuid());
+}
+
+// The policy, if root alone can have written it
+static bool loadPolicy(const std::string& path, json& policy, std::string& error) {
+    struct stat st;
+    if (stat(path.c_str(), &st) != 0) {
+        error = "no policy at " + path;
+        return false;
+    }
+    if (st.st_uid != 0 || (st.st_mode & (S_IWGRP | S_IWOTH))) {
+        error = path + " must be owned by root and writable only by it";
+        return false;
+    }
+    try {
+        std::ifstream file(path);
+        policy = json::parse(file);
+    } catch (const std::exception& e) {
+        error = "cannot parse " + path + ": " + e.what();
+        return false;
+    }
+    return true;
+}
+
+// What the policy is checked against, and the start time that tells the
+// process apart from a later one reusing its PID
+struct HelperTarget {
+    uid_t uid = 0;
+    std::string cmdline; // empty for kernel threads and zombies
+    std::string startTime;
+    int pgid = 0;
+};
+
+static bool readTarget(int pid, HelperTarget& target) {
+    struct stat st;
+    std::string procDir = "/proc/" + std::to_string(pid);
+    if (stat(procDir.c_str(), &st) != 0) {
+        return false;
+    }
+    target.uid = st.st_uid;
+
+    // Fields after the parenthesised comm: state ppid pgrp ... starttime (22nd)
+    std::ifstream statFile(procDir + "/stat");
+    std::string line((std::istreambuf_iterator<char>(statFile)), std::istreambuf_iterator<char>());
+    size_t comm = line.rfind(')');
+    if (comm == std::string::npos) {
+        return false;
+    }
+    std::istringstream fields(line.substr(comm + 2));
+    std::string field;
+    for (int i = 3; i <= 22 && fields >> field; i++) {
+        if (i == 5) target.pgid = atoi(field.c_str());
+        if (i == 22) target.startTime = field;
+    }
+    if (target.startTime.empty()) {
+        return false;
+    }
+
+    std::ifstream file(procDir + "/cmdline");
+    target.cmdline.assign((std::istreambuf_iterator<char>(file)), std::istreambuf_iterator<char>());
+    while (!target.cmdline.empty() && target.cmdline.back() == '\0') target.cmdline.pop_back();
+    std::replace(target.cmdline.begin(), target.cmdline.end(), '\0', ' ');
+    return true;
+}
+
+// Every process in group pgid, by PID
+static std::map<int, HelperTarget> groupTargets(int pgid) {
+    std::map<int, HelperTarget> members;
+    DIR* proc = opendir("/proc");
+    if (!proc) {
+        return members;
+    }
+    while (struct dirent* entry = readdir(proc)) {
+        int pid = atoi(entry->d_name);
+        HelperTarget target;
+        if (pid > 0 && readTarget(pid, target) && target.pgid == pgid) {
+            members[pid] = target;
+        }
+    }
+    closedir(proc);
+    return members;
+}
+
+int runHelper(const std::vector<std::string>& args, const std::string& policyPath) {
+    bool check = !args.empty() && args[0] == "check" && args.size() == 2;
+    bool signal = !args.empty() && args[0] == "signal" && args.size() == 3;
+    if (!check && !signal) {
+        std::cerr << "Usage: vp helper check <pid> | vp helper signal <pid|-pgid> <signal>\n";
+        return 2;
+    }
+    if (geteuid() != 0) {
+        std::cerr << "vp helper must run as root (through sudo or pkexec)\n";
+        return 2;
+    }
+
+    char* end;
+    long target = strtol(args[1].c_str(), &end, 10);
+    int pid = (int)labs(target);
+    if (*end || pid <= 1) {
+        std::cerr << "invalid pid: " << args[1] << "\n";
+        return 2;
+    }
+    int sig = 0;
+    if (signal) {
+        static const std::set<int> allowed = {0, SIGTERM, SIGKILL, SIGINT, SIGHUP, SIGUSR1, SIGUSR2, SIGSTOP, SIGCONT};
+        sig = atoi(args[2].c_str());
+        if (args[2].find_first_not_of("0123456789") != std::string::npos || !allowed.count(sig)) {
+            std::cerr << "signal not allowed: " << args[2] << "\n";
+            return 2;
+        }
+    }
+    // A group is signalled through its leader, and only if the policy allows
+    // every process in it
+    if (target < 0 && getpgid(pid) != pid) {
+        std::cerr << "PID " << pid << " doesn't lead a process group\n";
+        return 1;
+    }
+
+    std::map<int, HelperTarget> targets;
+    if (target < 0) {
+        targets = groupTargets(pid);
+    } else if (!readTarget(pid, targets[pid])) {
+        targets.clear();
+    }
+    if (!targets.count(pid)) {
+        std::cerr << "no such process: " << pid << "\n";
+        return 1;
+    }
+    if (targets[pid].cmdline.empty()) {
+        std::cerr << "PID " << pid << " is a kernel thread\n";
+        return 1;
+    }
+
+    json policy;
+    std::string error;
+    if (!loadPolicy(policyPath, policy, error)) {
+        std::cerr << error << "\n";
+        return 1;
+    }
+    std::string user = callingUser();
+    for (const auto& [member, info] : targets) {
+        if (info.cmdline.empty()) {
+            continue; // a zombie: nothing left to signal
+        }
+        std::string owner = userName(info.uid);
+        if (!helperAuthorized(policy, user, owner, info.cmdline)) {
+            std::cerr << user << " may not manage PID " << member << " (" << owner << ": " << info.cmdline << ")"
+                      << (member != pid ? " in group " + std::to_string(pid) : "") << "\n";
+            return 1;
+        }
+    }
+    if (!signal) {
+        return 0;
+    }
+
+    // Checked again right before the kill: the processes must be the ones the
+    // policy allowed, not new ones that reused a PID or joined the group
+    std::map<int, HelperTarget> now;
+    if (target < 0) {
+        now = groupTargets(pid);
+    } else if (!readTarget(pid, now[pid])) {
+        now.clear();
+    }
+    for (const auto& [member, info] : now) {
+        auto checked = targets.find(member);
+        if (checked == targets.end() || checked->second.startTime != info.startTime) {
+            std::cerr << "PID " << member << " changed while it was checked; not signalled\n";
+            return 1;
+        }
+    }
+    if (!now.count(pid)) {
+        std::cerr << "PID " << pid << " exited\n";
+        return 1;
+    }
+
+    if (kill((pid_t)target, sig) != 0) {
+        std::cerr << "kill " << target << ": " << strerror(errno) << "\n";
+        return 1;
+    }
+    return 0;
+}
+
+} // namespace vp
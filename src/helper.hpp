@@ -0,0 +1,47 @@
+#ifndef VP_HELPER_HPP
+#define VP_HELPER_HPP
+
+#include "json.hpp"
+#include <string>
+#include <vector>
+
+namespace vp {
+
+using json = nlohmann::json;
+
+// vp never runs as root itself. Processes of other users (root's nginx,
+// postgres's postgres) are view-only unless a privileged helper is set up:
+// $VP_HELPER is the command that runs "vp helper" as root, typically
+//   VP_HELPER="sudo -n /usr/local/bin/vp helper"
+// with a sudoers rule allowing exactly that command. vp goes through it only
+// for signals the kernel refuses it (EPERM). The helper acts only when its
+// policy, /etc/vp/helper.json (root-owned, not writable by others), lets the
+// calling user ($SUDO_USER, or $PKEXEC_UID under pkexec) manage the target:
+//   {"rules": [{"user": "alice", "owner": "root", "cmdline": "^nginx"}]}
+// user and owner may be "*"; cmdline is an optional regex on the command
+// line. PID 1 and kernel threads are never touched. Linux only (/proc).
+
+// Where the helper reads its policy
+const char* const HELPER_POLICY = "/etc/vp/helper.json";
+
+// Command prefix from $VP_HELPER, "" when no helper is configured
+std::string helperCommand();
+
+// Send sig to pid (-pid: its process group) through the helper. Returns
+// false with error set to what it said when it refuses or fails.
+bool helperSignal(int pid, int sig, std::string& error);
+
+// Whether the helper would let this user manage pid (vp helper check)
+bool helperAllows(int pid);
+
+// Whether policy lets user manage a process owned by owner running cmdline
+bool helperAuthorized(const json& policy, const std::string& user, const std::string& owner,
+                      const std::string& cmdline);
+
+// The root side: vp helper check PID | vp helper signal PID SIG. Prints why
+// it refuses to stderr; returns the exit code (0 done, 1 refused, 2 misuse).
+int runHelper(const std::vector<std::string>& args, const std::string& policyPath = HELPER_POLICY);
+
+} // namespace vp
+
+#endif // VP_HELPER_HPP
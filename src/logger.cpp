@@ -0,0 +1,124 @@
+#include "logger.hpp"
+#include <fstream>
+#include <iostream>
+#include <mutex>
+#include <sstream>
+
+namespace vp {
+
+static std::mutex g_logMutex;
+static LogLevel g_logLevel = LogLevel::Info;
+static LogFormat g_logFormat = LogFormat::Text;
+static std::ofstream g_logStream;
+static std::string g_logPath;
+
+static const char* levelName(LogLevel level) {
+    switch (level) {
+        case LogLevel::Debug: return "DEBUG";
+        case LogLevel::Info: return "INFO";
+        case LogLevel::Warn: return "WARN";
+        case LogLevel::Error: return "ERROR";
+    }
+    return "INFO";
+}
+
+void setLogLevel(LogLevel level) {
+    std::lock_guard<std::mutex> lock(g_logMutex);
+    g_logLevel = level;
+}
+
+LogLevel logLevel() {
+    std::lock_guard<std::mutex> lock(g_logMutex);
+    return g_logLevel;
+}
+
+void setLogFormat(LogFormat format) {
+    std::lock_guard<std::mutex> lock(g_logMutex);
+    g_logFormat = format;
+}
+
+bool setLogFile(const std::string& path) {
+    std::lock_guard<std::mutex> lock(g_logMutex);
+    if (g_logStream.is_open()) {
+        g_logStream.close();
+    }
+    g_logPath = path;
+    if (path.empty()) {
+        return true;
+    }
+
+    g_logStream.open(path, std::ios::app);
+    if (!g_logStream.is_open()) {
+        g_logPath.clear();
+        return false;
+    }
+    return true;
+}
+
+std::string logFile() {
+    std::lock_guard<std::mutex> lock(g_logMutex);
+    return g_logPath;
+}
+
+bool parseLogLevel(const std::string& s, LogLevel& level) {
+    if (s == "debug") level = LogLevel::Debug;
+    else if (s == "info") level = LogLevel::Info;
+    else if (s == "warn") level = LogLevel::Warn;
+    else if (s == "error") level = LogLevel::Error;
+    else return false;
+    return true;
+}
+
+bool parseLogFormat(const std::string& s, LogFormat& format) {
+    if (s == "text") format = LogFormat::Text;
+    else if (s == "json") format = LogFormat::JSON;
+    else return false;
+    return true;
+}
+
+// Quote text values containing spaces, quotes or '='
+static std::string textValue(const json& v) {
+    std::string s = v.is_string() ? v.get<std::string>() : v.dump();
+    if (s.empty() || s.find_first_of(" \"=\t\n") != std::string::npos) {
+        return json(s).dump();
+    }
+    return s;
+}
+
+std::string formatLogRecord(time_t t, LogLevel level, const std::string& msg, const json& attrs, LogFormat format) {
+    char ts[32];
+    struct tm tm;
+    localtime_r(&t, &tm);
+    strftime(ts, sizeof(ts), "%Y-%m-%dT%H:%M:%S%z", &tm);
+
+    if (format == LogFormat::JSON) {
+        json record = {{"time", ts}, {"level", levelName(level)}, {"msg", msg}};
+        for (auto it = attrs.begin(); it != attrs.end(); ++it) {
+            record[it.key()] = it.value();
+        }
+        return record.dump();
+    }
+
+    std::ostringstream oss;
+    oss << "time=" << ts << " level=" << levelName(level) << " msg=" << textValue(msg);
+    for (auto it = attrs.begin(); it != attrs.end(); ++it) {
+        oss << " " << it.key() << "=" << textValue(it.value());
+    }
+    return oss.str();
+}
+
+void logMessage(LogLevel level, const std::string& msg, const json& attrs) {
+    std::lock_guard<std::mutex> lock(g_logMutex);
+    if (level < g_logLevel) {
+        return;
+    }
+
+    std::string record = formatLogRecord(time(nullptr), level, msg, attrs, g_logFormat);
+    if (g_logStream.is_open()) {
+        g_logStream << record << std::endl;
+    } else {
+        std::cerr << record << std::endl;
+    }
+}
+
+} // namespace vp
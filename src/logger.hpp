@@ -0,0 +1,41 @@
+#ifndef VP_LOGGER_HPP
+#define VP_LOGGER_HPP
+
+#include "json.hpp"
+#include <ctime>
+#include <string>
+
+namespace vp {
+
+using json = nlohmann::json;
+
+// vp's own diagnostics (not instance output, see logs.hpp)
+enum class LogLevel { Debug, Info, Warn, Error };
+enum class LogFormat { Text, JSON };
+
+void setLogLevel(LogLevel level);
+LogLevel logLevel();
+void setLogFormat(LogFormat format);
+
+// Append records to path instead of stderr; empty path restores stderr
+bool setLogFile(const std::string& path);
+std::string logFile();
+
+// Parse "debug", "info", "warn", "error" / "text", "json"
+bool parseLogLevel(const std::string& s, LogLevel& level);
+bool parseLogFormat(const std::string& s, LogFormat& format);
+
+// One record: time=... level=WARN msg="..." key=value  or  {"time":...,"level":...,"msg":...,...}
+std::string formatLogRecord(time_t t, LogLevel level, const std::string& msg, const json& attrs, LogFormat format);
+
+// Write a record if level is enabled. attrs is a JSON object of extra key/values.
+void logMessage(LogLevel level, const std::string& msg, const json& attrs = json::object());
+
+inline void logDebug(const std::string& msg, const json& attrs = json::object()) { logMessage(LogLevel::Debug, msg, attrs); }
+inline void logInfo(const std::string& msg, const json& attrs = json::object()) { logMessage(LogLevel::Info, msg, attrs); }
+inline void logWarn(const std::string& msg, const json& attrs = json::object()) { logMessage(LogLevel::Warn, msg, attrs); }
+inline void logError(const std::string& msg, const json& attrs = json::object()) { logMessage(LogLevel::Error, msg, attrs); }
+
+} // namespace vp
+
+#endif // VP_LOGGER_HPP
@@ -0,0 +1,217 @@
+#include "logs.hpp"
+#include "logger.hpp"
+#include "registry.hpp"
+#include <fstream>
+#include <sstream>
+#include <deque>
+#include <algorithm>
+#include <cstdio>
+#include <cstdlib>
+#include <ctime>
+#include <dirent.h>
+#include <unistd.h>
+#include <sys/stat.h>
+
+namespace vp {
+
+std::string logDir() {
+    return State::getStateDir() + "/logs";
+}
+
+std::string logPath(const std::string& instance) {
+    std::string file = instance;
+    std::replace(file.begin(), file.end(), '/', '@'); // shop/api -> shop@api.log: names have no '@'
+    return logDir() + "/" + file + ".log";
+}
+
+LogPolicy logPolicyFor(const State& state, const Instance& inst) {
+    auto it = state.templates.find(inst.template_name);
+    if (it != state.templates.end() && it->second->log) {
+        return *it->second->log;
+    }
+    return state.logPolicy;
+}
+
+static bool fileExists(const std::string& path) {
+    struct stat st;
+    return stat(path.c_str(), &st) == 0;
+}
+
+// The live log a file in logDir() belongs to: name.log is itself (active),
+// name.log.N and name.log.N.gz are its rotated files. False for anything else.
+static bool parseLogFile(const std::string& file, std::string& base, bool& active) {
+    auto endsWith = [](const std::string& s, const std::string& suffix) {
+        return s.size() > suffix.size() && s.compare(s.size() - suffix.size(), suffix.size(), suffix) == 0;
+    };
+    if (endsWith(file, ".log")) {
+        base = file;
+        active = true;
+        return true;
+    }
+    std::string name = endsWith(file, ".gz") ? file.substr(0, file.size() - 3) : file;
+    size_t dot = name.rfind('.');
+    if (dot == std::string::npos || dot + 1 == name.size() ||
+        !std::all_of(name.begin() + dot + 1, name.end(), ::isdigit) || !endsWith(name.substr(0, dot), ".log")) {
+        return false;
+    }
+    base = name.substr(0, dot);
+    active = false;
+    return true;
+}
+
+std::vector<std::string> instanceLogs(const std::string& instance) {
+    std::vector<std::string> paths;
+    std::string target = logPath(instance).substr(logDir().size() + 1);
+
+    DIR* dir = opendir(logDir().c_str());
+    if (!dir) return paths;
+    struct dirent* entry;
+    while ((entry = readdir(dir)) != nullptr) {
+        std::string base;
+        bool active;
+        if (parseLogFile(entry->d_name, base, active) && base == target) {
+            paths.push_back(logDir() + "/" + entry->d_name);
+        }
+    }
+    closedir(dir);
+    std::sort(paths.begin(), paths.end());
+    return paths;
+}
+
+// Rename path.N (or path.N.gz) to path.N+1
+static void shiftRotated(const std::string& path, int from) {
+    for (const char* ext : {"", ".gz"}) {
+        std::string src = path + "." + std::to_string(from) + ext;
+        if (fileExists(src)) {
+            rename(src.c_str(), (path + "." + std::to_string(from + 1) + ext).c_str());
+        }
+    }
+}
+
+bool rotateLog(const std::string& path, const LogPolicy& policy) {
+    struct stat st;
+    if (policy.max_size <= 0 || stat(path.c_str(), &st) != 0 || st.st_size <= policy.max_size) {
+        return false;
+    }
+
+    if (policy.max_files > 0) {
+        // Drop the oldest, shift the rest up by one
+        for (const char* ext : {"", ".gz"}) {
+            unlink((path + "." + std::to_string(policy.max_files) + ext).c_str());
+        }
+        for (int i = policy.max_files - 1; i >= 1; i--) {
+            shiftRotated(path, i);
+        }
+
+        // Copy current contents to path.1
+        std::ifstream in(path, std::ios::binary);
+        std::ofstream out(path + ".1", std::ios::binary);
+        out << in.rdbuf();
+        out.close();
+
+        if (policy.compress) {
+            std::string cmd = "gzip -f -- " + shellQuote(path + ".1");
+            if (system(cmd.c_str()) != 0) {
+                logWarn("failed to compress rotated log", {{"path", path + ".1"}});
+            }
+        }
+    }
+
+    // Truncate in place; the writer's O_APPEND fd continues at offset 0
+    return truncate(path.c_str(), 0) == 0;
+}
+
+std::vector<std::string> sweepLogs(std::shared_ptr<State> state) {
+    auto data = state->lock();
+    std::vector<std::string> removed;
+
+    DIR* dir = opendir(logDir().c_str());
+    if (!dir) return removed;
+
+    // Active log path -> instance
+    std::map<std::string, std::shared_ptr<Instance>> owners;
+    for (const auto& [name, inst] : state->instances) {
+        owners[logPath(name)] = inst;
+    }
+
+    time_t now = time(nullptr);
+    struct dirent* entry;
+    while ((entry = readdir(dir)) != nullptr) {
+        std::string file = entry->d_name;
+        std::string base;
+        bool active;
+        if (!parseLogFile(file, base, active)) continue;
+
+        std::string path = logDir() + "/" + file;
+        auto it = owners.find(logDir() + "/" + base);
+        LogPolicy policy = it != owners.end() ? logPolicyFor(*state, *it->second) : state->logPolicy;
+
+        if (active && it != owners.end()) {
+            rotateLog(path, policy);
+            continue;
+        }
+
+        // Rotated files, and logs of instances that no longer exist, expire by age
+        struct stat st;
+        if (policy.max_age > 0 && stat(path.c_str(), &st) == 0 && now - st.st_mtime > policy.max_age) {
+            if (unlink(path.c_str()) == 0) {
+                removed.push_back(path);
+            }
+        }
+    }
+    closedir(dir);
+
+    return removed;
+}
+
+// Parse a size like "512", "100K", "10M", "1G" into bytes
+long parseSize(const std::string& str) {
+    size_t idx = 0;
+    double value = std::stod(str, &idx);
+    std::string unit = str.substr(idx);
+    if (unit.size() > 1 && (unit.back() == 'B' || unit.back() == 'b')) {
+        unit.pop_back(); // "2GB", "512MiB"
+        if (unit.size() > 1 && unit.back() == 'i') unit.pop_back();
+    }
+    if (unit == "K" || unit == "k") value *= 1024;
+    else if (unit == "M" || unit == "m") value *= 1024 * 1024;
+    else if (unit == "G" || unit == "g") value *= 1024 * 1024 * 1024;
+    else if (!unit.empty()) throw std::invalid_argument("invalid size: " + str);
+    return (long)value;
+}
+
+// Parse a duration like "30", "30s", "5m", "12h", "7d" into seconds
+long parseDuration(const std::string& str) {
+    size_t idx = 0;
+    double value = std::stod(str, &idx);
+    std::string unit = str.substr(idx);
+    if (unit == "m") value *= 60;
+    else if (unit == "h") value *= 3600;
+    else if (unit == "d") value *= 86400;
+    else if (!unit.empty() && unit != "s") throw std::invalid_argument("invalid duration: " + str);
+    return (long)value;
+}
+
+std::string tailLog(const std::string& path, int lines) {
+    std::ifstream file(path);
+    if (!file.is_open()) {
+        return "";
+    }
+
+    std::deque<std::string> last;
+    std::string line;
+    while (std::getline(file, line)) {
+        last.push_back(line);
+        if ((int)last.size() > lines) {
+            last.pop_front();
+        }
+    }
+
+    std::ostringstream oss;
+    for (const auto& l : last) {
+        oss << l << "\n";
+    }
+    return oss.str();
+}
+
+} // namespace vp
@@ -0,0 +1,43 @@
+#ifndef VP_LOGS_HPP
+#define VP_LOGS_HPP
+
+#include "types.hpp"
+#include "state.hpp"
+#include <memory>
+#include <string>
+#include <vector>
+
+namespace vp {
+
+// Directory holding captured output (~/.vibeprocess/logs)
+std::string logDir();
+
+// Path of an instance's captured stdout/stderr (shop/api -> shop@api.log)
+std::string logPath(const std::string& instance);
+
+// An instance's log and its rotated files (name.log.N, name.log.N.gz) that exist
+std::vector<std::string> instanceLogs(const std::string& instance);
+
+// Effective policy for an instance: its template's override or the global policy
+LogPolicy logPolicyFor(const State& state, const Instance& inst);
+
+// Rotate path if it exceeds policy.max_size. Uses copy-truncate so a running
+// child keeps writing to the same (O_APPEND) fd. Returns true if rotated.
+bool rotateLog(const std::string& path, const LogPolicy& policy);
+
+// Rotate oversized logs and delete rotated or orphaned logs older than max_age.
+// Returns the paths that were deleted.
+std::vector<std::string> sweepLogs(std::shared_ptr<State> state);
+
+// Parse a size like "512", "100K", "10M", "1G" (or "1GB", "1GiB") into bytes
+long parseSize(const std::string& str);
+
+// Parse a duration like "30", "30s", "5m", "12h", "7d" into seconds
+long parseDuration(const std::string& str);
+
+// Last n lines of a log file
+std::string tailLog(const std::string& path, int lines);
+
+} // namespace vp
+
+#endif // VP_LOGS_HPP
@@ -2,72 +2,326 @@
 #include "process.hpp"
 #include "resource.hpp"
 #include "api.hpp"
+#include "logs.hpp"
+#include "logger.hpp"
+#include "registry.hpp"
+#include "alerts.hpp"
+#include "proxy.hpp"
+#include "mdns.hpp"
+#include "registration.hpp"
+#include "systemd.hpp"
+#include "secrets.hpp"
+#include "profile.hpp"
+#include "helper.hpp"
+#include "config.hpp"
 #include "types.hpp"
 #include <iostream>
 #include <iomanip>
 #include <fstream>
+#include <sstream>
 #include <vector>
+#include <set>
 #include <string>
 #include <cstring>
+#include <unistd.h>
+#include <termios.h>
+#include <climits>
+#include <sys/stat.h>
+#include <thread>
+#include <chrono>
+#include <algorithm>
+#include <functional>
+#include <csignal>
+#include <regex>
 
 using namespace vp;
 
 std::shared_ptr<State> state;
+std::string project; // --project or $VP_PROJECT; scopes instance names
 
-void listInstances() {
+std::string command;     // The command being run, for state->discoverOn
+bool noDiscover = false; // --no-discover
+
+// Discovery before a command looks at instances: none with --no-discover,
+// else as deep as state->discoverOn says for this command
+void discover() {
+    std::string depth = noDiscover ? "off" : discoveryDepth(*state, command);
+    if (depth != "off") {
+        matchAndUpdateInstances(state, depth == "full");
+    }
+}
+
+// Check if an instance belongs to the active project (all do when none is set)
+bool inProject(const Instance& inst) {
+    return project.empty() || inst.project == project;
+}
+
+std::string formatBytes(long bytes) {
+    std::ostringstream oss;
+    oss << std::fixed << std::setprecision(1);
+    if (bytes >= 1024L * 1024 * 1024) {
+        oss << bytes / (1024.0 * 1024 * 1024) << "G";
+    } else if (bytes >= 1024L * 1024) {
+        oss << bytes / (1024.0 * 1024) << "M";
+    } else {
+        oss << bytes / 1024.0 << "K";
+    }
+    return oss.str();
+}
+
+// Local time for display
+static std::string formatTime(time_t t) {
+    char buffer[32];
+    strftime(buffer, sizeof(buffer), "%Y-%m-%d %H:%M:%S", localtime(&t));
+    return buffer;
+}
+
+std::string formatCPUTime(double seconds) {
+    std::ostringstream oss;
+    if (seconds < 60) {
+        oss << std::fixed << std::setprecision(2) << seconds << "s";
+    } else if (seconds < 3600) {
+        oss << (int)seconds / 60 << "m " << (int)seconds % 60 << "s";
+    } else {
+        oss << (int)seconds / 3600 << "h " << ((int)seconds / 60) % 60 << "m";
+    }
+    return oss.str();
+}
+
+// Percent of one core; over 100 when several cores are busy
+std::string formatPercent(double percent) {
+    std::ostringstream oss;
+    oss << std::fixed << std::setprecision(percent < 10 ? 1 : 0) << percent << "%";
+    return oss.str();
+}
+
+// A vp ps column: header, width (the last column is not padded) and its text
+struct PsColumn {
+    std::string header;
+    int width;
+    std::function<std::string(const Instance&)> value;
+};
+
+static const std::map<std::string, PsColumn>& psColumns() {
+    static const std::map<std::string, PsColumn> columns = {
+        {"name", {"NAME", 20, [](const Instance& i) { return i.name; }}},
+        {"status", {"STATUS", 13, [](const Instance& i) {
+            // "*" marks an instance whose template changed since it started,
+            // "!" one over a limit its template sets
+            return i.status + (instanceDrifted(*state, i) ? "*" : "") + (i.over_limit.empty() ? "" : "!");
+        }}},
+        {"pid", {"PID", 8, [](const Instance& i) { return std::to_string(i.pid); }}},
+        {"cpu", {"CPU%", 7, [](const Instance& i) {
+            return instanceRunning(i) ? formatPercent(i.cpu_percent) : std::string("-");
+        }}},
+        {"cputime", {"CPU TIME", 12, [](const Instance& i) {
+            return i.cpu_time > 0 ? formatCPUTime(i.cpu_time) : std::string("-");
+        }}},
+        {"rss", {"RSS", 8, [](const Instance& i) { return i.rss > 0 ? formatBytes(i.rss) : "-"; }}},
+        {"threads", {"THR", 5, [](const Instance& i) { return i.threads > 0 ? std::to_string(i.threads) : "-"; }}},
+        {"fds", {"FDS", 12, [](const Instance& i) {
+            // "!" marks an instance near its open file limit
+            if (i.fds <= 0) return std::string("-");
+            std::string fds = std::to_string(i.fds);
+            if (i.fd_limit > 0) fds += "/" + std::to_string(i.fd_limit);
+            if (!i.warning.empty()) fds += "!";
+            return fds;
+        }}},
+        {"ports", {"PORTS", 14, [](const Instance& i) {
+            std::string ports;
+            for (const auto& [rtype, value] : i.resources) {
+                if (rtype.size() >= 4 && rtype.compare(rtype.size() - 4, 4, "port") == 0) {
+                    ports += (ports.empty() ? "" : ",") + value;
+                }
+            }
+            return ports.empty() ? "-" : ports;
+        }}},
+        {"template", {"TEMPLATE", 16, [](const Instance& i) {
+            return i.template_name.empty() ? "-" : i.template_name;
+        }}},
+        {"labels", {"LABELS", 24, [](const Instance& i) {
+            std::string labels;
+            for (const auto& [k, v] : i.labels) labels += (labels.empty() ? "" : ",") + k + "=" + v;
+            return labels.empty() ? "-" : labels;
+        }}},
+        {"notes", {"NOTES", 32, [](const Instance& i) { return i.notes.empty() ? "-" : i.notes; }}},
+        {"command", {"COMMAND", 40, [](const Instance& i) { return i.command; }}},
+        {"resources", {"RESOURCES", 0, [](const Instance& i) {
+            std::string resources;
+            for (const auto& res : i.resources) {
+                resources += res.first + "=" + res.second + " ";
+            }
+            if (i.proxy_port > 0) {
+                auto port = i.resources.find("tcpport");
+                resources += "proxy=" + std::to_string(i.proxy_port) + "->" +
+                             (port != i.resources.end() ? port->second : "?") + " ";
+            }
+            return resources;
+        }}},
+    };
+    return columns;
+}
+
+static const std::vector<std::string> PS_DEFAULT_COLUMNS = {
+    "name", "status", "pid", "cpu", "cputime", "rss", "threads", "fds", "command", "resources"};
+
+// With previous (vp ps --watch), rows that differ from it are highlighted and it
+// is updated to this frame's rows, by instance name
+void listInstances(const std::string& selector = "", std::vector<std::string> columns = PS_DEFAULT_COLUMNS,
+                   bool wide = false, std::map<std::string, std::vector<std::string>>* previous = nullptr) {
     // Run discovery
-    matchAndUpdateInstances(state);
+    discover();
 
-    if (state->instances.empty()) {
+    std::vector<std::shared_ptr<Instance>> shown;
+    for (const auto& kv : state->instances) {
+        if (inProject(*kv.second) && matchesSelector(*kv.second, selector)) {
+            shown.push_back(kv.second);
+        }
+    }
+    if (shown.empty()) {
         std::cout << "No instances running\n";
+        if (previous) previous->clear();
         return;
     }
 
-    // Header
-    std::cout << std::left
-              << std::setw(20) << "NAME"
-              << std::setw(10) << "STATUS"
-              << std::setw(8) << "PID"
-              << std::setw(12) << "CPU TIME"
-              << std::setw(40) << "COMMAND"
-              << "RESOURCES\n";
-
-    // Instances
-    for (const auto& kv : state->instances) {
-        const auto& inst = kv.second;
-
-        std::string cpuTimeStr = "-";
-        if (inst->cpu_time > 0) {
-            if (inst->cpu_time < 60) {
-                cpuTimeStr = std::to_string((int)(inst->cpu_time * 100) / 100.0) + "s";
-            } else if (inst->cpu_time < 3600) {
-                int minutes = (int)inst->cpu_time / 60;
-                int secs = (int)inst->cpu_time % 60;
-                cpuTimeStr = std::to_string(minutes) + "m " + std::to_string(secs) + "s";
+    // Cells first: wide output sizes each column to its longest value instead of truncating
+    std::vector<std::vector<std::string>> rows;
+    std::vector<size_t> widths;
+    for (const auto& key : columns) {
+        widths.push_back(psColumns().at(key).width);
+    }
+    for (const auto& inst : shown) {
+        std::vector<std::string> row;
+        for (size_t c = 0; c < columns.size(); c++) {
+            std::string text = psColumns().at(columns[c]).value(*inst);
+            if (wide) {
+                widths[c] = std::max(widths[c], text.size() + 2);
+            } else if (widths[c] > 0 && text.size() >= widths[c]) {
+                text = text.substr(0, widths[c] - 4) + "...";  // Keep a space before the next column
+            }
+            row.push_back(text);
+        }
+        rows.push_back(row);
+    }
+
+    auto print = [&](const std::vector<std::string>& cells) {
+        for (size_t c = 0; c < cells.size(); c++) {
+            if (c + 1 < cells.size()) {
+                std::cout << std::left << std::setw(widths[c]) << cells[c];
             } else {
-                int hours = (int)inst->cpu_time / 3600;
-                int minutes = ((int)inst->cpu_time / 60) % 60;
-                cpuTimeStr = std::to_string(hours) + "h " + std::to_string(minutes) + "m";
+                std::cout << cells[c];
             }
         }
+        std::cout << "\n";
+    };
 
-        std::string resources;
-        for (const auto& res : inst->resources) {
-            resources += res.first + "=" + res.second + " ";
+    std::vector<std::string> header;
+    for (const auto& key : columns) {
+        header.push_back(psColumns().at(key).header);
+    }
+    print(header);
+    bool highlight = previous && !previous->empty() && isatty(STDOUT_FILENO);
+    for (size_t r = 0; r < rows.size(); r++) {
+        auto before = previous ? previous->find(shown[r]->name) : std::map<std::string, std::vector<std::string>>::iterator();
+        bool changed = highlight && (before == previous->end() || before->second != rows[r]);
+        if (changed) std::cout << "\033[1;33m";
+        print(rows[r]);
+        if (changed) std::cout << "\033[0m" << std::flush;
+    }
+    if (previous) {
+        previous->clear();
+        for (size_t r = 0; r < rows.size(); r++) {
+            (*previous)[shown[r]->name] = rows[r];
         }
+    }
+
+    bool drift = false;
+    bool over = false;
+    for (const auto& inst : shown) {
+        drift = drift || instanceDrifted(*state, *inst);
+        over = over || !inst->over_limit.empty();
+    }
+    if ((drift || over) && std::find(columns.begin(), columns.end(), "status") != columns.end()) {
+        std::cout << "\n";
+        if (drift) std::cout << "* template changed since start: vp upgrade <name>\n";
+        if (over) std::cout << "! over-limit: over a limit its template sets (vp inspect <name>)\n";
+    }
+}
 
-        std::string command = inst->command;
-        if (command.length() > 40) {
-            command = command.substr(0, 37) + "...";
+void handlePs(const std::vector<std::string>& args) {
+    std::string selector;
+    std::vector<std::string> columns = PS_DEFAULT_COLUMNS;
+    bool wide = false;
+    bool noResources = false;
+    long watch = 0;
+
+    for (size_t i = 0; i < args.size(); i++) {
+        const std::string& arg = args[i];
+        if (arg == "-l" && i + 1 < args.size()) {
+            selector = args[++i];
+        } else if ((arg == "-o" && i + 1 < args.size() && args[i + 1] == "wide") || arg == "-owide" ||
+                   arg == "--output=wide" || arg == "--wide") {
+            wide = true;
+            if (arg == "-o") i++;
+        } else if (arg.rfind("--columns=", 0) == 0) {
+            columns.clear();
+            std::istringstream list(arg.substr(10));
+            std::string key;
+            while (std::getline(list, key, ',')) {
+                if (key.empty()) continue;
+                if (!psColumns().count(key)) {
+                    std::cerr << "Unknown column: " << key << " (";
+                    for (const auto& [name, column] : psColumns()) {
+                        std::cerr << (name == psColumns().begin()->first ? "" : ", ") << name;
+                    }
+                    std::cerr << ")\n";
+                    exit(1);
+                }
+                columns.push_back(key);
+            }
+        } else if (arg == "--no-resources") {
+            noResources = true;
+        } else if (arg == "--watch" || arg.rfind("--watch=", 0) == 0) {
+            try {
+                watch = arg == "--watch" ? 2 : parseDuration(arg.substr(8));
+            } catch (const std::exception& e) {
+                std::cerr << "Error: " << e.what() << "\n";
+                exit(1);
+            }
+            if (watch <= 0) {
+                std::cerr << "Error: --watch needs an interval of at least 1s\n";
+                exit(1);
+            }
+        } else {
+            std::cerr << "Usage: vp ps [-l selector] [--columns=name,status,...] [-o wide] [--no-resources] [--watch[=2s]]\n";
+            exit(1);
         }
+    }
 
-        std::cout << std::left
-                  << std::setw(20) << inst->name
-                  << std::setw(10) << inst->status
-                  << std::setw(8) << inst->pid
-                  << std::setw(12) << cpuTimeStr
-                  << std::setw(40) << command
-                  << resources << "\n";
+    if (noResources) {
+        columns.erase(std::remove(columns.begin(), columns.end(), "resources"), columns.end());
+    }
+    if (columns.empty()) {
+        std::cerr << "Error: no columns to show\n";
+        exit(1);
+    }
+    if (watch == 0) {
+        listInstances(selector, columns, wide);
+        return;
+    }
+
+    // Each frame picks up what other vp commands and vp serve saved, then does the
+    // same per-instance refresh as vp ps (PIDs and usage, not a full process scan)
+    bool tty = isatty(STDOUT_FILENO);
+    std::map<std::string, std::vector<std::string>> previous;
+    while (true) {
+        state->reload();
+        if (tty) std::cout << "\033[H\033[2J";
+        std::cout << "Every " << watch << "s: vp ps" << std::string(20, ' ') << formatTime(time(nullptr)) << "\n\n";
+        listInstances(selector, columns, wide, &previous);
+        if (!tty) std::cout << "\n";
+        std::cout << std::flush;
+        std::this_thread::sleep_for(std::chrono::seconds(watch));
     }
 }
 
@@ -91,20 +345,109 @@ std::map<std::string, std::string> parseVars(const std::vector<std::string>& arg
     return vars;
 }
 
+// Pull "-l key=value" pairs out of args
+std::map<std::string, std::string> takeLabels(std::vector<std::string>& args) {
+    std::map<std::string, std::string> labels;
+    std::vector<std::string> rest;
+    for (size_t i = 0; i < args.size(); i++) {
+        if (args[i] == "-l" && i + 1 < args.size()) {
+            std::string pair = args[++i];
+            size_t eq = pair.find('=');
+            labels[pair.substr(0, eq)] = eq == std::string::npos ? "" : pair.substr(eq + 1);
+        } else {
+            rest.push_back(args[i]);
+        }
+    }
+    args = rest;
+    return labels;
+}
+
+// Whether args select instances with --all, --template= or --status=, which
+// need confirming (or --yes) before changing anything
+bool bulkSelection(const std::vector<std::string>& args) {
+    for (const auto& arg : args) {
+        if (arg == "--all" || arg.rfind("--template=", 0) == 0 || arg.rfind("--status=", 0) == 0) {
+            return true;
+        }
+    }
+    return false;
+}
+
+// Resolve "<name>", or any of "-l <selector>", --template=ID, --status=S and
+// --all, to instance names; exits if nothing matches
+std::vector<std::string> selectInstances(const std::vector<std::string>& args) {
+    if (args[0] == "-l" || bulkSelection(args)) {
+        std::string selector, templateId, status;
+        for (size_t i = 0; i < args.size(); i++) {
+            if (args[i] == "-l") {
+                if (i + 1 >= args.size()) {
+                    std::cerr << "Missing selector after -l\n";
+                    exit(1);
+                }
+                selector = args[++i];
+            } else if (args[i].rfind("--template=", 0) == 0) {
+                templateId = args[i].substr(11);
+            } else if (args[i].rfind("--status=", 0) == 0) {
+                status = args[i].substr(9);
+            }
+        }
+
+        const auto& statuses = instanceStatuses();
+        if (!status.empty() && std::find(statuses.begin(), statuses.end(), status) == statuses.end()) {
+            std::cerr << "Unknown status: " << status << "\n";
+            exit(1);
+        }
+        auto names = filterInstances(*state, project, selector, templateId, status);
+        if (names.empty()) {
+            std::cerr << "No instances match\n";
+            exit(1);
+        }
+        return names;
+    }
+
+    std::string name = qualifiedName(project, args[0]);
+    if (state->instances.find(name) == state->instances.end()) {
+        std::cerr << "Instance not found: " << name << "\n";
+        exit(1);
+    }
+    return {name};
+}
+
 void handleStart(const std::vector<std::string>& args) {
-    if (args.size() < 2) {
-        std::cerr << "Usage: vp start <template> <name> [--key=value...]\n";
+    if (args.empty() || args[0].rfind("-", 0) == 0) {
+        std::cerr << "Usage: vp start <template> [name] [--key=value...] [-l key=value...] [--wait] [--timeout=30s] [--dry-run] [--protect] [--notes=TEXT]\n";
+        std::cerr << "       Without a name, one is made up from the template (e.g. node-express-quiet-otter)\n";
         exit(1);
     }
 
-    matchAndUpdateInstances(state);
+    discover();
 
     std::string templateID = args[0];
-    std::string name = args[1];
+    bool named = args.size() > 1 && args[1].rfind("-", 0) != 0;
+    std::string name = named ? qualifiedName(project, args[1]) : "";
 
-    std::vector<std::string> varArgs(args.begin() + 2, args.end());
+    std::vector<std::string> varArgs(args.begin() + (named ? 2 : 1), args.end());
+    auto labels = takeLabels(varArgs);
     auto vars = parseVars(varArgs);
 
+    // --wait and --timeout gate on readiness; they are not template vars
+    bool wait = vars.count("wait") > 0;
+    long timeout = 30;
+    try {
+        if (vars.count("timeout")) timeout = parseDuration(vars["timeout"]);
+    } catch (const std::exception& e) {
+        std::cerr << "Error: " << e.what() << "\n";
+        exit(1);
+    }
+    bool dryRun = vars.count("dry-run") > 0;
+    bool protect = vars.count("protect") > 0;
+    std::string notes = vars.count("notes") ? vars["notes"] : "";
+    vars.erase("notes");
+    vars.erase("wait");
+    vars.erase("timeout");
+    vars.erase("dry-run");
+    vars.erase("protect");
+
     auto it = state->templates.find(templateID);
     if (it == state->templates.end()) {
         std::cerr << "Template not found: " << templateID << "\n";
@@ -114,10 +457,81 @@ void handleStart(const std::vector<std::string>& args) {
         }
         exit(1);
     }
+    if (name.empty()) {
+        name = generateInstanceName(*state, templateID, project);
+    }
+
+    if (dryRun) {
+        try {
+            auto inst = dryRunProcess(state, *it->second, name, vars);
+            std::cout << "Would start " << inst->name << " from " << inst->template_name
+                      << " (dry run: nothing claimed or started)\n";
+            std::cout << "Command: " << inst->command << "\n";
+            std::cout << "Resources:\n";
+            for (const auto& kv : inst->resources) {
+                std::cout << "  " << kv.first << " = " << kv.second << "\n";
+            }
+            std::cout << "Cwd: " << inst->cwd << "\n";
+            if (!inst->umask.empty()) {
+                std::cout << "Umask: " << inst->umask << "\n";
+            }
+            std::cout << "Env: inherited from vp\n";
+            for (const auto& [envName, value] : inst->env) {
+                std::cout << "  " << envName << "=" << value << "\n";
+            }
+            std::cout << "Log: " << (inst->pty ? "pty scrollback" : logPath(name)) << "\n";
+            if (!inst->pty && !inst->stdout_path.empty()) {
+                std::cout << "Stdout: " << inst->stdout_path << "\n";
+            }
+            if (!inst->pty && !inst->stderr_path.empty()) {
+                std::cout << "Stderr: " << inst->stderr_path << "\n";
+            }
+            if (!labels.empty()) {
+                std::cout << "Labels:";
+                for (const auto& [k, v] : labels) {
+                    std::cout << " " << k << "=" << v;
+                }
+                std::cout << "\n";
+            }
+            if (!inst->health.empty()) {
+                std::cout << "Health: " << inst->health << "\n";
+            }
+            if (!inst->action.empty()) {
+                std::cout << "Action: " << inst->action << "\n";
+            }
+            for (const auto& [actionName, action] : inst->actions) {
+                std::cout << "Action " << actionName << ": " << action << "\n";
+            }
+        } catch (const std::exception& e) {
+            std::cerr << "Error: " << e.what() << "\n";
+            exit(1);
+        }
+        return;
+    }
+
+    // The PTY master must outlive this command
+    if (it->second->pty) {
+        std::cerr << "Error: template " << templateID << " needs a terminal; start it from the web UI (vp serve)\n";
+        exit(1);
+    }
 
     try {
         auto inst = startProcess(state, *it->second, name, vars);
+        if (!labels.empty() || protect || !notes.empty()) {
+            inst->labels = labels;
+            inst->protect = protect;
+            inst->notes = notes;
+            state->save();
+        }
+        if (wait && !awaitReady(state, inst, timeout * 1000)) {
+            std::cerr << "Error: " << name << " not ready within " << timeout << "s, stopped and released its resources\n";
+            std::cerr << tailLog(logPath(name), 20);
+            exit(1);
+        }
         std::cout << "Started " << inst->name << " (PID " << inst->pid << ")\n";
+        if (inst->status == "starting") {
+            std::cout << "Starting: waiting for its startup probe (vp inspect " << inst->name << ")\n";
+        }
         std::cout << "Command: " << inst->command << "\n";
         std::cout << "Resources:\n";
         for (const auto& kv : inst->resources) {
@@ -129,259 +543,2863 @@ void handleStart(const std::vector<std::string>& args) {
     }
 }
 
-void handleStop(const std::vector<std::string>& args) {
-    if (args.empty()) {
-        std::cerr << "Usage: vp stop <name>\n";
+// vp run "<command>" [--name=N] [--cwd=DIR] [-l key=value] [--wait] [--timeout=30s]
+// [--protect] [--notes=TEXT]: start a command without writing a template first.
+// Its one-off template (run-<name>) lets vp restart it and goes with the instance.
+// Options come before the command; after "--" everything is the command.
+void handleRun(const std::vector<std::string>& args) {
+    std::vector<std::string> flags, words;
+    for (size_t i = 0; i < args.size(); i++) {
+        if (args[i] == "--") {
+            words.insert(words.end(), args.begin() + i + 1, args.end());
+            break;
+        }
+        if (words.empty() && args[i] == "-l" && i + 1 < args.size()) {
+            flags.push_back(args[i]);
+            flags.push_back(args[++i]);
+        } else if (words.empty() && args[i].rfind("--", 0) == 0) {
+            flags.push_back(args[i]);
+        } else {
+            words.push_back(args[i]);
+        }
+    }
+    if (words.empty()) {
+        std::cerr << "Usage: vp run [--name=N] [--cwd=DIR] [-l key=value...] [--wait] [--timeout=30s] \"<command>\"\n";
+        std::cerr << "       %tcpport (or any resource type) in the command is allocated, and ${tcpport} refers to it\n";
         exit(1);
     }
+    std::string command = words.size() == 1 ? words[0] : joinArgv(words);
 
-    matchAndUpdateInstances(state);
+    auto labels = takeLabels(flags);
+    auto vars = parseVars(flags);
+    long timeout = 30;
+    try {
+        if (vars.count("timeout")) timeout = parseDuration(vars["timeout"]);
+    } catch (const std::exception& e) {
+        std::cerr << "Error: " << e.what() << "\n";
+        exit(1);
+    }
 
-    std::string name = args[0];
-    auto it = state->instances.find(name);
+    discover();
 
-    if (it == state->instances.end()) {
-        std::cerr << "Instance not found: " << name << "\n";
+    std::string name = vars.count("name") ? qualifiedName(project, vars["name"]) : adHocName(*state, command, project);
+    std::string cwd = vars["cwd"];
+    if (cwd.empty()) {
+        char buf[PATH_MAX];
+        if (getcwd(buf, sizeof(buf))) cwd = buf;
+    }
+    auto tmpl = std::make_shared<Template>(adHocTemplate(*state, name, command, cwd));
+    if (state->templates.count(tmpl->id)) {
+        std::cerr << "Error: template " << tmpl->id << " already exists\n";
         exit(1);
     }
 
-    if (!stopProcess(state, it->second)) {
-        std::cerr << "Error stopping process\n";
+    state->templates[tmpl->id] = tmpl;
+    try {
+        auto inst = startProcess(state, *tmpl, name, {});
+        inst->labels = labels;
+        inst->protect = vars.count("protect") > 0;
+        inst->notes = vars["notes"];
+        state->save();
+        if (vars.count("wait") && !awaitReady(state, inst, timeout * 1000)) {
+            state->templates.erase(tmpl->id);
+            state->save();
+            std::cerr << "Error: " << name << " not ready within " << timeout << "s, stopped and released its resources\n";
+            std::cerr << tailLog(logPath(name), 20);
+            exit(1);
+        }
+        std::cout << "Started " << inst->name << " (PID " << inst->pid << ")\n";
+        std::cout << "Command: " << inst->command << "\n";
+        if (!inst->resources.empty()) {
+            std::cout << "Resources:\n";
+            for (const auto& kv : inst->resources) {
+                std::cout << "  " << kv.first << " = " << kv.second << "\n";
+            }
+        }
+    } catch (const std::exception& e) {
+        state->templates.erase(tmpl->id);
+        state->save();
+        std::cerr << "Error: " << e.what() << "\n";
         exit(1);
     }
+}
 
-    state->releaseResources(name);
-    state->save();
+// Ask before a bulk operation unless --yes was given; exits if not confirmed
+void confirmBulk(const std::string& verb, const std::vector<std::string>& args, const std::vector<std::string>& names) {
+    if (!bulkSelection(args) || std::find(args.begin(), args.end(), "--yes") != args.end()) {
+        return;
+    }
+    if (!isatty(STDIN_FILENO)) {
+        std::cerr << verb << " " << names.size() << " instances: confirm with --yes when not on a terminal\n";
+        exit(1);
+    }
 
-    std::cout << "Stopped " << name << "\n";
+    for (const auto& name : names) {
+        std::cout << "  " << name << "\n";
+    }
+    std::cout << verb << " " << names.size() << " instance" << (names.size() == 1 ? "" : "s") << "? [y/N] ";
+    std::string answer;
+    std::getline(std::cin, answer);
+    if (answer != "y" && answer != "Y" && answer != "yes") {
+        std::cerr << "Aborted\n";
+        exit(1);
+    }
 }
 
-void handleRestart(const std::vector<std::string>& args) {
+void handleStop(const std::vector<std::string>& args) {
     if (args.empty()) {
-        std::cerr << "Usage: vp restart <name>\n";
+        std::cerr << "Usage: vp stop <name|-l selector|--all|--template=ID|--status=S> [--yes] [--force]\n";
         exit(1);
     }
 
-    matchAndUpdateInstances(state);
-
-    std::string name = args[0];
-    auto it = state->instances.find(name);
+    discover();
+
+    // In bulk, only what is running
+    auto names = selectInstances(args);
+    if (bulkSelection(args)) {
+        names.erase(std::remove_if(names.begin(), names.end(), [](const std::string& name) {
+            auto it = state->instances.find(name);
+            return it == state->instances.end() || !instanceUp(*it->second);
+        }), names.end());
+        if (names.empty()) {
+            std::cout << "Nothing running\n";
+            return;
+        }
+    }
+    confirmBulk("Stop", args, names);
+
+    bool force = std::find(args.begin(), args.end(), "--force") != args.end();
+    bool failed = false;
+    for (const auto& name : names) {
+        std::string error = instanceOperation(state, name, "stop", force);
+        if (!error.empty()) {
+            std::cerr << "Error stopping " << name << ": " << error << "\n";
+            failed = true;
+            continue;
+        }
 
-    if (it == state->instances.end()) {
-        std::cerr << "Instance not found: " << name << "\n";
-        exit(1);
+        std::cout << "Stopped " << name << "\n";
     }
 
-    if (!restartProcess(state, it->second)) {
-        std::cerr << "Error restarting process\n";
+    if (failed) {
         exit(1);
     }
-
-    std::cout << "Restarted " << it->second->name << " (PID " << it->second->pid << ")\n";
 }
 
-void handleDelete(const std::vector<std::string>& args) {
-    if (args.empty()) {
-        std::cerr << "Usage: vp delete <name>\n";
+// vp restart --rolling <template> [--timeout=30s]: the template's running
+// instances are its replicas; restart them one at a time
+void handleRollingRestart(const std::vector<std::string>& args) {
+    if (args.size() < 2) {
+        std::cerr << "Usage: vp restart --rolling <template> [--timeout=30s] [--force]\n";
         exit(1);
     }
 
-    matchAndUpdateInstances(state);
-
-    std::string name = args[0];
-    auto it = state->instances.find(name);
-
-    if (it == state->instances.end()) {
-        std::cerr << "Instance not found: " << name << "\n";
+    auto vars = parseVars(std::vector<std::string>(args.begin() + 2, args.end()));
+    long timeout = 30;
+    try {
+        if (vars.count("timeout")) timeout = parseDuration(vars["timeout"]);
+    } catch (const std::exception& e) {
+        std::cerr << "Error: " << e.what() << "\n";
         exit(1);
     }
 
-    if (it->second->status == "running") {
-        stopProcess(state, it->second);
+    discover();
+
+    std::vector<std::shared_ptr<Instance>> group;
+    for (const auto& [name, inst] : state->instances) {
+        if (inst->template_name == args[1] && instanceRunning(*inst) && inProject(*inst)) {
+            if (inst->pty || !inst->managed) {
+                std::cerr << "Skipping " << name << (inst->pty ? " (needs a terminal)" : " (monitor only)") << "\n";
+                continue;
+            }
+            if (inst->protect && std::find(args.begin(), args.end(), "--force") == args.end()) {
+                std::cerr << "Skipping " << name << " (protected; --force to include)\n";
+                continue;
+            }
+            group.push_back(inst);
+        }
+    }
+    if (group.empty()) {
+        std::cerr << "No running instances of template: " << args[1] << "\n";
+        exit(1);
     }
 
-    state->releaseResources(name);
-    state->instances.erase(name);
-    state->save();
+    int done = rollingRestart(state, group, timeout * 1000, [timeout](const Instance& inst, bool ok) {
+        if (ok) {
+            std::cout << "Restarted " << inst.name << " (PID " << inst.pid << "), healthy\n";
+        } else {
+            std::cerr << "Error: " << inst.name << " not healthy within " << timeout << "s, stopping the rollout\n";
+        }
+    });
 
-    std::cout << "Deleted " << name << "\n";
+    if (done < (int)group.size()) {
+        std::cerr << done << " of " << group.size() << " restarted\n";
+        exit(1);
+    }
 }
 
-void handleServe(const std::vector<std::string>& args) {
-    std::string port = "8080";
-    if (!args.empty()) {
-        port = args[0];
+void handleRestart(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp restart <name|-l selector|--all|--template=ID|--status=S> [--yes] [--force]\n";
+        std::cerr << "       vp restart --rolling <template> [--timeout=30s]\n";
+        exit(1);
+    }
+    if (args[0] == "--rolling") {
+        handleRollingRestart(args);
+        return;
     }
 
-    std::cout << "Running discovery to match existing processes...\n";
-    matchAndUpdateInstances(state);
+    discover();
 
-    std::cout << "Starting web UI on http://localhost:" << port << "\n";
+    auto names = selectInstances(args);
+    confirmBulk("Restart", args, names);
 
-    if (!serveHTTP(":" + port, state)) {
-        std::cerr << "Error starting server\n";
+    bool force = std::find(args.begin(), args.end(), "--force") != args.end();
+    bool failed = false;
+    for (const auto& name : names) {
+        // Earlier restarts give up the state lock: skip what was deleted meanwhile
+        auto it = state->instances.find(name);
+        if (it == state->instances.end()) {
+            continue;
+        }
+        auto inst = it->second;
+        if (inst->pty) {
+            std::cerr << "Error: " << name << " needs a terminal; restart it from the web UI (vp serve)\n";
+            failed = true;
+            continue;
+        }
+        std::string error = instanceOperation(state, name, "restart", force);
+        if (!error.empty()) {
+            std::cerr << "Error restarting " << name << ": " << error << "\n";
+            failed = true;
+            continue;
+        }
+
+        std::cout << "Restarted " << inst->name << " (PID " << inst->pid << ")\n";
+    }
+
+    if (failed) {
         exit(1);
     }
 }
 
-void handleTemplate(const std::vector<std::string>& args) {
+void handleDelete(const std::vector<std::string>& args) {
     if (args.empty()) {
-        std::cerr << "Usage: vp template <list|add|show>\n";
+        std::cerr << "Usage: vp delete <name|-l selector|--all|--template=ID|--status=S> [--yes] [--force]\n";
         exit(1);
     }
 
-    std::string subcmd = args[0];
+    discover();
 
-    if (subcmd == "list") {
-        std::cout << std::left << std::setw(20) << "ID" << "LABEL\n";
-        for (const auto& [id, tmpl] : state->templates) {
-            std::cout << std::left << std::setw(20) << id << tmpl->label << "\n";
-        }
-    } else if (subcmd == "add") {
-        if (args.size() < 2) {
-            std::cerr << "Usage: vp template add <file.json>\n";
-            exit(1);
-        }
+    auto names = selectInstances(args);
+    confirmBulk("Delete", args, names);
 
-        std::string filename = args[1];
-        std::ifstream file(filename);
-        if (!file.is_open()) {
-            std::cerr << "Error: Cannot open file: " << filename << "\n";
-            exit(1);
+    bool force = std::find(args.begin(), args.end(), "--force") != args.end();
+    bool failed = false;
+    for (const auto& name : names) {
+        std::string error = instanceOperation(state, name, "delete", force);
+        if (!error.empty()) {
+            std::cerr << "Error deleting " << name << ": " << error << "\n";
+            failed = true;
+            continue;
         }
+        std::cout << "Deleted " << name << "\n";
+    }
 
-        try {
-            json j;
-            file >> j;
-
-            auto tmpl = std::make_shared<Template>();
-            *tmpl = j.get<Template>();
+    if (failed) {
+        exit(1);
+    }
+}
 
-            state->templates[tmpl->id] = tmpl;
-            state->save();
+// vp annotate <name> <text...> | --clear, or --template=<id>: free-text notes
+// on an instance (why it exists) or a template's description; no text shows them
+void handleAnnotate(const std::vector<std::string>& args) {
+    std::string templateId;
+    bool clear = false;
+    std::vector<std::string> words;
+    for (const auto& arg : args) {
+        if (arg.rfind("--template=", 0) == 0) {
+            templateId = arg.substr(11);
+        } else if (arg == "--clear") {
+            clear = true;
+        } else {
+            words.push_back(arg);
+        }
+    }
+    if (templateId.empty() && words.empty()) {
+        std::cerr << "Usage: vp annotate <name> [text...|--clear]\n";
+        std::cerr << "       vp annotate --template=<id> [text...|--clear]\n";
+        exit(1);
+    }
 
-            std::cout << "Added template: " << tmpl->id << "\n";
-        } catch (const std::exception& e) {
-            std::cerr << "Error parsing template: " << e.what() << "\n";
+    std::string* text;
+    std::string target;
+    if (!templateId.empty()) {
+        auto it = state->templates.find(templateId);
+        if (it == state->templates.end()) {
+            std::cerr << "Template not found: " << templateId << "\n";
             exit(1);
         }
-    } else if (subcmd == "show") {
-        if (args.size() < 2) {
-            std::cerr << "Usage: vp template show <id>\n";
+        text = &it->second->description;
+        target = "template " + templateId;
+    } else {
+        std::string name = qualifiedName(project, words[0]);
+        auto it = state->instances.find(name);
+        if (it == state->instances.end()) {
+            std::cerr << "Instance not found: " << name << "\n";
             exit(1);
         }
+        words.erase(words.begin());
+        text = &it->second->notes;
+        target = name;
+    }
 
-        std::string id = args[1];
-        auto it = state->templates.find(id);
-        if (it == state->templates.end()) {
-            std::cerr << "Template not found: " << id << "\n";
-            exit(1);
-        }
+    if (words.empty() && !clear) {
+        std::cout << (text->empty() ? "(none)" : *text) << "\n";
+        return;
+    }
 
-        json j = *it->second;
-        std::cout << j.dump(2) << "\n";
-    } else {
-        std::cerr << "Unknown template command: " << subcmd << "\n";
+    std::string joined;
+    for (const auto& word : words) {
+        joined += (joined.empty() ? "" : " ") + word;
+    }
+    *text = joined;
+    state->save();
+    std::cout << (joined.empty() ? "Cleared notes on " : "Annotated ") << target << "\n";
+}
+
+// vp lock/unlock <name|-l selector>: protected instances refuse stop, restart
+// and delete (CLI and API) unless forced
+void handleLock(const std::vector<std::string>& args, bool lock) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp " << (lock ? "lock" : "unlock") << " <name|-l selector>\n";
         exit(1);
     }
+
+    discover();
+
+    for (const auto& name : selectInstances(args)) {
+        state->instances.at(name)->protect = lock;
+        std::cout << (lock ? "Locked " : "Unlocked ") << name << "\n";
+    }
+    state->save();
 }
 
-void handleResourceType(const std::vector<std::string>& args) {
+void handleAction(const std::vector<std::string>& args) {
     if (args.empty()) {
-        std::cerr << "Usage: vp resource-type <list|add>\n";
+        std::cerr << "Usage: vp action <name> [action]\n";
         exit(1);
     }
 
-    std::string subcmd = args[0];
+    std::string name = qualifiedName(project, args[0]);
+    auto it = state->instances.find(name);
+    if (it == state->instances.end()) {
+        std::cerr << "Instance not found: " << name << "\n";
+        exit(1);
+    }
+    const auto& inst = *it->second;
+
+    // No action given: list what's available
+    if (args.size() < 2) {
+        if (!inst.action.empty()) {
+            std::cout << std::left << std::setw(20) << "default" << inst.action << "\n";
+        }
+        for (const auto& [actionName, action] : inst.actions) {
+            std::cout << std::left << std::setw(20) << actionName << action << "\n";
+        }
+        return;
+    }
+
+    std::string action = resolveAction(inst, args[1]);
+    if (action.empty()) {
+        std::cerr << "No action " << args[1] << " on " << name << "\n";
+        exit(1);
+    }
+
+    if (isURLAction(action)) {
+        std::cout << action << "\n";
+        return;
+    }
+
+    // Run in the foreground so the output and exit code reach the caller
+    ActionRun run = runAction(state, recordAction(state, name, args[1], action), &std::cout);
+    exit(run.exit_code);
+}
+
+void handleOpen(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp open <name> [action]\n";
+        exit(1);
+    }
+
+    std::string name = qualifiedName(project, args[0]);
+    auto it = state->instances.find(name);
+    if (it == state->instances.end()) {
+        std::cerr << "Instance not found: " << name << "\n";
+        exit(1);
+    }
+    const auto& inst = *it->second;
+
+    std::string url = resolveAction(inst, args.size() > 1 ? args[1] : "");
+
+    // No action named: fall back to the first URL among the named actions
+    if (args.size() < 2 && !isURLAction(url)) {
+        for (const auto& [actionName, action] : inst.actions) {
+            if (isURLAction(action)) {
+                url = action;
+                break;
+            }
+        }
+    }
+
+    if (!isURLAction(url)) {
+        std::cerr << "No URL action on " << name << (url.empty() ? "" : " (use vp action to run commands)") << "\n";
+        exit(1);
+    }
+
+#ifdef __APPLE__
+    std::string opener = "open";
+#else
+    std::string opener = "xdg-open";
+#endif
+    std::string cmd = opener + " '" + url + "' >/dev/null 2>&1";
+    if (url.find('\'') != std::string::npos || system(cmd.c_str()) != 0) {
+        std::cout << url << "\n"; // No browser available (e.g. over ssh)
+    }
+}
+
+void handleActionHistory(const std::vector<std::string>& args) {
+    auto vars = parseVars(args);
+
+    // --id=N: full record including output
+    if (vars.count("id")) {
+        for (const auto& run : state->actionRuns) {
+            if (std::to_string(run.id) == vars["id"]) {
+                std::cout << json(run).dump(2) << "\n";
+                return;
+            }
+        }
+        std::cerr << "Action run not found: " << vars["id"] << "\n";
+        exit(1);
+    }
+
+    std::string instance = !args.empty() && args[0].rfind("--", 0) != 0 ? qualifiedName(project, args[0]) : "";
+
+    std::cout << std::left
+              << std::setw(6) << "ID"
+              << std::setw(21) << "STARTED"
+              << std::setw(20) << "INSTANCE"
+              << std::setw(14) << "ACTION"
+              << std::setw(6) << "EXIT"
+              << "DURATION\n";
+
+    for (auto it = state->actionRuns.rbegin(); it != state->actionRuns.rend(); ++it) {
+        if (!instance.empty() && it->instance != instance) {
+            continue;
+        }
+
+        char started[32];
+        strftime(started, sizeof(started), "%Y-%m-%d %H:%M:%S", localtime(&it->started));
+        std::ostringstream duration;
+        duration << std::fixed << std::setprecision(1) << it->duration << "s";
+
+        std::cout << std::left
+                  << std::setw(6) << it->id
+                  << std::setw(21) << started
+                  << std::setw(20) << it->instance
+                  << std::setw(14) << it->action
+                  << std::setw(6) << (it->exit_code < 0 ? "-" : std::to_string(it->exit_code))
+                  << (it->exit_code < 0 ? "running" : duration.str()) << "\n";
+    }
+}
+
+void handleHistory(const std::vector<std::string>& args) {
+    if (args.empty() || args[0].rfind("--", 0) == 0) {
+        std::cerr << "Usage: vp history <name> [--since=12h]\n";
+        exit(1);
+    }
+
+    std::string name = qualifiedName(project, args[0]);
+    if (state->instances.find(name) == state->instances.end()) {
+        std::cerr << "Instance not found: " << name << "\n";
+        exit(1);
+    }
+
+    auto vars = parseVars(args);
+    time_t cutoff = 0;
+    if (vars.count("since")) {
+        long seconds = 0;
+        try {
+            seconds = parseDuration(vars["since"]);
+        } catch (const std::exception&) {
+        }
+        if (seconds <= 0) {
+            std::cerr << "Invalid --since: " << vars["since"] << " (e.g. 15m, 12h or 1d)\n";
+            exit(1);
+        }
+        cutoff = time(nullptr) - seconds;
+    }
+
+    auto it = state->timelines.find(name);
+    if (it == state->timelines.end() || it->second.empty()) {
+        std::cout << "No status changes recorded for " << name << "\n";
+        return;
+    }
+    for (const auto& change : it->second) {
+        if (change.time < cutoff) {
+            continue;
+        }
+        std::string transition = (change.from.empty() ? "new" : change.from) + " -> " + change.to;
+        std::cout << formatTime(change.time) << "  " << std::left << std::setw(22) << transition << change.cause << "\n";
+    }
+}
+
+void handleLabel(const std::vector<std::string>& args) {
+    if (args.size() < 2) {
+        std::cerr << "Usage: vp label <name|-l selector> key=value... [key-...]\n";
+        exit(1);
+    }
+
+    auto names = selectInstances(args);
+    size_t first = args[0] == "-l" ? 2 : 1;
+
+    for (const auto& name : names) {
+        auto& labels = state->instances.at(name)->labels;
+        for (size_t i = first; i < args.size(); i++) {
+            const std::string& arg = args[i];
+            size_t eq = arg.find('=');
+            if (eq != std::string::npos) {
+                labels[arg.substr(0, eq)] = arg.substr(eq + 1);
+            } else if (!arg.empty() && arg.back() == '-') {
+                labels.erase(arg.substr(0, arg.size() - 1));
+            }
+        }
+
+        std::cout << name << ":";
+        for (const auto& [k, v] : labels) {
+            std::cout << " " << k << "=" << v;
+        }
+        std::cout << "\n";
+    }
+
+    state->save();
+}
+
+// Discovery pass whose duration /readyz reports
+static void timedDiscovery() {
+    auto data = state->lock();
+    auto started = std::chrono::steady_clock::now();
+    matchAndUpdateInstances(state);
+    discoveryTook(std::chrono::duration<double>(std::chrono::steady_clock::now() - started).count());
+}
+
+// Written to by the signal handler so the shutdown thread can do the real work
+static int shutdownPipe[2] = {-1, -1};
+
+static void onShutdownSignal(int sig) {
+    char c = (char)sig;
+    ssize_t written = write(shutdownPipe[1], &c, 1);
+    (void)written;
+}
+
+void handleServe(const std::vector<std::string>& args) {
+    // Each profile can have its own, so two profiles can serve side by side
+    int profilePort = currentProfileSettings().serve_port;
+    std::string port = profilePort ? std::to_string(profilePort) : configValue("serve.port", "8080");
+    std::vector<std::string> flags;
+    for (const auto& arg : args) {
+        if (arg.rfind("--", 0) == 0) {
+            flags.push_back(arg);
+        } else {
+            port = arg;
+        }
+    }
+
+    // --rate=5 or --rate=5/s, --burst=N, --access-log=false
+    ServeOptions options;
+
+    // Socket activation: systemd holds the port, so restarts drop no connections
+    auto inherited = listenFds();
+    if (!inherited.empty()) {
+        options.listenFd = inherited.front();
+    }
+    auto vars = parseVars(flags);
+
+    // The config file's [serve] settings (and auth.session-ttl) for flags not given
+    for (const auto& key : configKeys()) {
+        std::string flag = key.key.substr(key.key.find('.') + 1);
+        bool serveKey = key.key.rfind("serve.", 0) == 0 && flag != "port";
+        if ((serveKey || key.key == "auth.session-ttl") && !vars.count(flag)) {
+            std::string value = configValue(key.key);
+            if (!value.empty()) vars[flag] = value;
+        }
+    }
+    try {
+        if (vars.count("rate")) options.rate = std::stod(vars["rate"].substr(0, vars["rate"].find('/')));
+        if (vars.count("burst")) options.burst = std::stod(vars["burst"]);
+    } catch (const std::exception&) {
+        std::cerr << "Invalid --rate or --burst\n";
+        exit(1);
+    }
+    if (vars.count("access-log")) options.accessLog = vars["access-log"] != "false";
+    if (vars.count("session-ttl")) {
+        try {
+            options.sessionTtl = parseDuration(vars["session-ttl"]);
+        } catch (const std::exception&) {
+            options.sessionTtl = 0;
+        }
+        if (options.sessionTtl <= 0) {
+            std::cerr << "Invalid --session-ttl: " << vars["session-ttl"] << "\n";
+            exit(1);
+        }
+    }
+    options.debug = vars.count("debug") > 0 && vars["debug"] != "false";
+
+    // --bind=127.0.0.1 (or ::1, ::, an interface's address) picks the listening
+    // address; --allow=10.0.0.0/24,fd00::/8 limits which clients are served
+    std::string bind = vars.count("bind") ? vars["bind"] : "0.0.0.0";
+    std::string bindHost = bind.find(':') != std::string::npos ? "[" + bind + "]" : bind;
+    if (vars.count("allow")) {
+        std::stringstream ss(vars["allow"]);
+        for (std::string cidr; std::getline(ss, cidr, ',');) {
+            try {
+                cidrContains(cidr, "127.0.0.1");
+            } catch (const std::exception& e) {
+                std::cerr << "Invalid --allow: " << e.what() << "\n";
+                exit(1);
+            }
+            options.allowCidrs.push_back(cidr);
+        }
+    }
+
+    // --web-dir=DIR serves a custom frontend; what it lacks falls back to the built-in UI
+    if (vars.count("web-dir")) {
+        struct stat st;
+        if (stat(vars["web-dir"].c_str(), &st) != 0 || !S_ISDIR(st.st_mode)) {
+            std::cerr << "Invalid --web-dir: not a directory: " << vars["web-dir"] << "\n";
+            exit(1);
+        }
+        options.webDir = vars["web-dir"];
+    }
+    bool subreaper = vars.count("subreaper") > 0;
+    bool mdns = vars.count("mdns") > 0 && vars["mdns"] != "false";
+
+    // --register=consul://127.0.0.1:8500 or etcd://127.0.0.1:2379, --register-address=IP
+    std::shared_ptr<ServiceRegistry> registry;
+    if (vars.count("register")) {
+        try {
+            registry = makeServiceRegistry(vars["register"], vars["register-address"]);
+        } catch (const std::exception& e) {
+            std::cerr << "Invalid --register: " << e.what() << "\n";
+            exit(1);
+        }
+    }
+
+    // --metrics-interval=15s --metrics-retention=24h
+    long metricsInterval = 15, metricsRetention = 24 * 3600;
+    try {
+        if (vars.count("metrics-interval")) metricsInterval = parseDuration(vars["metrics-interval"]);
+        if (vars.count("metrics-retention")) metricsRetention = parseDuration(vars["metrics-retention"]);
+    } catch (const std::exception&) {
+        metricsInterval = 0;
+    }
+    if (metricsInterval <= 0 || metricsRetention < metricsInterval) {
+        std::cerr << "Invalid --metrics-interval or --metrics-retention\n";
+        exit(1);
+    }
+    options.metrics = std::make_shared<MetricsHistory>(metricsInterval, metricsRetention);
+    long discoveryInterval = metricsInterval;
+    try {
+        discoveryInterval = parseDuration(configValue("discovery.interval", std::to_string(metricsInterval)));
+    } catch (const std::exception&) {
+        discoveryInterval = 0;
+    }
+    if (discoveryInterval <= 0) {
+        std::cerr << "Invalid discovery.interval in " << configPath() << "\n";
+        exit(1);
+    }
+    options.metrics->load(metricsPath());
+
+    // --proxy-http=8081 --proxy-domain=vp.localhost,dev.test
+    int proxyHttp = 0;
+    if (vars.count("proxy-http")) {
+        proxyHttp = std::atoi(vars["proxy-http"].c_str());
+        if (proxyHttp <= 0 || proxyHttp > 65535) {
+            std::cerr << "Invalid --proxy-http port\n";
+            exit(1);
+        }
+    }
+    std::vector<std::string> proxyDomains;
+    std::stringstream domainList(vars.count("proxy-domain") ? vars["proxy-domain"] : "vp.localhost");
+    for (std::string domain; std::getline(domainList, domain, ',');) {
+        if (!domain.empty()) proxyDomains.push_back(domain);
+    }
+    if (proxyDomains.empty()) {
+        std::cerr << "Invalid --proxy-domain\n";
+        exit(1);
+    }
+
+    // Daemon diagnostics go to a file unless --log-file was given
+    std::string daemonLog = logFile();
+    if (daemonLog.empty()) {
+        daemonLog = State::getStateDir() + "/vp.log";
+        State::ensureStateDir(); // Fresh install: no state saved yet
+        if (!setLogFile(daemonLog)) {
+            std::cerr << "Warning: cannot open " << daemonLog << ", logging to stderr\n";
+            daemonLog = "";
+        }
+    }
+    if (!daemonLog.empty()) {
+        std::cout << "Logging to " << daemonLog << "\n";
+    }
+
+    std::cout << "Running discovery to match existing processes...\n";
+    timedDiscovery();
+
+    // Orphaned grandchildren of instances get re-parented to us instead of init
+    if (subreaper) {
+        if (!becomeSubreaper()) {
+            std::cerr << "Warning: --subreaper is not supported on this platform\n";
+        } else {
+            std::thread([]() {
+                while (true) {
+                    reapOrphans(state);
+                    std::this_thread::sleep_for(std::chrono::seconds(5));
+                }
+            }).detach();
+        }
+    }
+
+    // Supervise instances started by an earlier vp or by CLI commands
+    adoptInstances(state);
+
+    // Bring back what the last vp serve stopped with on_shutdown "remember"
+    int autostarted = autostartInstances(state);
+    if (autostarted > 0) {
+        std::cout << "Autostarted " << autostarted << " instance" << (autostarted == 1 ? "" : "s") << "\n";
+    }
+
+    // On SIGINT/SIGTERM/SIGHUP apply each template's on_shutdown policy, then exit
+    if (pipe(shutdownPipe) == 0) {
+        std::thread([metrics = options.metrics]() {
+            char sig = 0;
+            ssize_t got = read(shutdownPipe[0], &sig, 1);
+            (void)got;
+            logInfo("shutting down", {{"signal", strsignal(sig)}});
+            sdNotify("STOPPING=1");
+            int stopped = shutdownInstances(state);
+            metrics->save(metricsPath());
+            logInfo("shutdown complete", {{"stopped", stopped}});
+            _exit(0);
+        }).detach();
+        for (int sig : {SIGINT, SIGTERM, SIGHUP}) {
+            signal(sig, onShutdownSignal);
+        }
+    }
+
+    // Pick up edits made by other vp commands or by hand
+    state->onChange = [](const StateChange& change) {
+        logInfo("state reloaded", {{"kind", change.kind}, {"name", change.name}, {"op", change.op}});
+        if (change.kind == "instance" && change.op != "removed") {
+            adoptInstances(state);
+        }
+    };
+    if (!state->watchConfig()) {
+        logWarn("not watching state file for changes");
+    }
+
+    // Restart instances whose template sets health_failures once they fail that many checks
+    std::thread([]() {
+        HealthSupervisor supervisor;
+        while (true) {
+            supervisor.check(state, time(nullptr));
+            loopAlive("health", 60);
+            std::this_thread::sleep_for(std::chrono::seconds(1));
+        }
+    }).detach();
+
+    // Forward each proxy_port to its instance's current tcpport
+    std::thread([bind, allow = options.allowCidrs]() {
+        PortProxy proxy(state, bind, allow);
+        while (true) {
+            proxy.sync();
+            loopAlive("proxy", 60);
+            std::this_thread::sleep_for(std::chrono::seconds(2));
+        }
+    }).detach();
+
+    // Route <name>.vp.localhost to each instance's tcpport
+    if (proxyHttp > 0) {
+        std::thread([proxyHttp, proxyDomains, bind, allow = options.allowCidrs]() {
+            HostProxy proxy(state, proxyDomains, bind, allow);
+            if (!proxy.serve(proxyHttp)) {
+                std::cerr << "Warning: host proxy stopped on port " << proxyHttp << "\n";
+            }
+        }).detach();
+        std::cout << "Proxying http://<instance>." << proxyDomains.front() << ":" << proxyHttp << "\n";
+    }
+
+    // Announce running instances on the LAN as <name>._vp._tcp.local
+    if (mdns) {
+        std::thread([]() {
+            MdnsAdvertiser advertiser(state);
+            while (advertiser.sync() >= 0) {
+                std::this_thread::sleep_for(std::chrono::seconds(5));
+            }
+            std::cerr << "Warning: --mdns needs avahi-publish (Linux) or dns-sd (macOS)\n";
+        }).detach();
+    }
+
+    // Register running instances with Consul/etcd, deregister stopped ones
+    if (registry) {
+        std::thread([registry]() {
+            ServiceRegistration registration(state, registry);
+            while (true) {
+                registration.sync();
+                std::this_thread::sleep_for(std::chrono::seconds(10));
+            }
+        }).detach();
+    }
+
+    // Periodic log rotation and retention
+    std::thread([daemonLog]() {
+        while (true) {
+            for (const auto& path : sweepLogs(state)) {
+                logInfo("removed expired log", {{"path", path}});
+            }
+            auto data = state->lock();
+            if (state->pruneAfter > 0) {
+                pruneInstances(state, state->pruneAfter);
+            }
+            LogPolicy policy = state->logPolicy;
+            data.unlock();
+            if (!daemonLog.empty()) {
+                rotateLog(daemonLog, policy);
+            }
+            loopAlive("logs", 300);
+            std::this_thread::sleep_for(std::chrono::seconds(60));
+        }
+    }).detach();
+
+    // Match processes to instances, by default as often as usage is sampled
+    std::thread([discoveryInterval]() {
+        while (true) {
+            timedDiscovery();
+            loopAlive("discovery", 3 * discoveryInterval + 60);
+            std::this_thread::sleep_for(std::chrono::seconds(discoveryInterval));
+        }
+    }).detach();
+
+    // Sample usage for the metrics history (persisting it every few minutes)
+    // and check alert rules against it
+    std::thread([metrics = options.metrics]() {
+        const long persistEvery = std::max(1L, 300 / metrics->interval());
+        AlertEngine alerts;
+        for (long n = 1;; n++) {
+            {
+                auto data = state->lock();
+                metrics->record(*state, time(nullptr));
+                alerts.evaluate(state, metrics.get(), time(nullptr));
+            }
+            if (n % persistEvery == 0) {
+                {
+                    auto data = state->lock();
+                    metrics->prune(*state);
+                }
+                if (!metrics->save(metricsPath())) {
+                    logWarn("failed to save metrics history", {{"path", metricsPath()}});
+                }
+            }
+            loopAlive("metrics", 3 * metrics->interval() + 60);
+            std::this_thread::sleep_for(std::chrono::seconds(metrics->interval()));
+        }
+    }).detach();
+
+    // Under systemd: ping the watchdog at half its interval
+    long long watchdog = watchdogUsec();
+    if (watchdog > 0) {
+        std::thread([watchdog]() {
+            while (true) {
+                sdNotify("WATCHDOG=1");
+                std::this_thread::sleep_for(std::chrono::microseconds(watchdog / 2));
+            }
+        }).detach();
+    }
+
+    if (options.listenFd != -1) {
+        std::cout << "Starting web UI on the socket passed by systemd\n";
+    } else {
+        std::string shown = bind == "0.0.0.0" || bind == "::" ? "localhost" : bindHost;
+        std::cout << "Starting web UI on http://" << shown << ":" << port << "\n";
+    }
+
+    if (!serveHTTP(bindHost + ":" + port, state, options)) {
+        std::cerr << "Error starting server\n";
+        exit(1);
+    }
+}
+
+void handleTemplate(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp template <list|add|show|update|render|test|from-instance>\n";
+        exit(1);
+    }
+
+    std::string subcmd = args[0];
+
+    if (subcmd == "list") {
+        std::cout << std::left << std::setw(20) << "ID" << "LABEL\n";
+        for (const auto& [id, tmpl] : state->templates) {
+            std::cout << std::left << std::setw(20) << id << tmpl->label
+                      << (tmpl->description.empty() ? "" : " - " + tmpl->description) << "\n";
+        }
+    } else if (subcmd == "add") {
+        if (args.size() < 2) {
+            std::cerr << "Usage: vp template add <file.json|https://...|git@host:repo.git//path>\n";
+            exit(1);
+        }
+
+        try {
+            for (const auto& tmpl : loadTemplates(args[1])) {
+                state->templates[tmpl->id] = tmpl;
+                std::cout << "Added template: " << tmpl->id << "\n";
+            }
+            state->save();
+        } catch (const std::exception& e) {
+            std::cerr << "Error loading template: " << e.what() << "\n";
+            exit(1);
+        }
+    } else if (subcmd == "update") {
+        // Re-fetch each distinct source (optionally only the one behind a given template)
+        std::set<std::string> sources;
+        for (const auto& [id, tmpl] : state->templates) {
+            if (!tmpl->source.empty() && (args.size() < 2 || id == args[1])) {
+                sources.insert(tmpl->source);
+            }
+        }
+
+        if (sources.empty()) {
+            std::cerr << (args.size() < 2 ? "No templates with a recorded source\n" : "Template has no recorded source: " + args[1] + "\n");
+            exit(1);
+        }
+
+        bool failed = false;
+        for (const auto& source : sources) {
+            try {
+                for (const auto& tmpl : loadTemplates(source)) {
+                    state->templates[tmpl->id] = tmpl;
+                    std::cout << "Updated template: " << tmpl->id << " from " << source << "\n";
+                }
+            } catch (const std::exception& e) {
+                std::cerr << "Error updating from " << source << ": " << e.what() << "\n";
+                failed = true;
+            }
+        }
+        state->save();
+
+        if (failed) {
+            exit(1);
+        }
+    } else if (subcmd == "show") {
+        if (args.size() < 2) {
+            std::cerr << "Usage: vp template show <id>\n";
+            exit(1);
+        }
+
+        std::string id = args[1];
+        auto it = state->templates.find(id);
+        if (it == state->templates.end()) {
+            std::cerr << "Template not found: " << id << "\n";
+            exit(1);
+        }
+
+        json j = *it->second;
+        std::cout << j.dump(2) << "\n";
+    } else if (subcmd == "from-instance") {
+        if (args.size() < 2) {
+            std::cerr << "Usage: vp template from-instance <name> [--id=ID] [--label=L] [--dry-run]\n";
+            exit(1);
+        }
+
+        discover();
+        std::string name = qualifiedName(project, args[1]);
+        auto inst = state->instances.find(name);
+        if (inst == state->instances.end()) {
+            std::cerr << "Instance not found: " << name << "\n";
+            exit(1);
+        }
+        auto vars = parseVars(std::vector<std::string>(args.begin() + 2, args.end()));
+        std::string id = vars.count("id") ? vars["id"] : name;
+        std::replace(id.begin(), id.end(), '/', '-');
+        bool dryRun = vars.count("dry-run") > 0;
+        if (!dryRun && state->templates.count(id)) {
+            std::cerr << "Error: template " << id << " already exists (pick another with --id=ID)\n";
+            exit(1);
+        }
+        if (!nameError(id, false).empty()) {
+            std::cerr << "Error: template " << nameError(id, false) << " (pick another with --id=ID)\n";
+            exit(1);
+        }
+
+        auto tmpl = std::make_shared<Template>(templateFromInstance(*state, *inst->second, id));
+        if (vars.count("label")) tmpl->label = vars["label"];
+        std::cout << json(*tmpl).dump(2) << "\n";
+        if (dryRun) {
+            return;
+        }
+
+        // The instance now runs from it: vp upgrade picks up later edits
+        std::string previous = inst->second->template_name;
+        state->templates[id] = tmpl;
+        inst->second->template_name = id;
+        inst->second->template_revision = templateRevision(*tmpl);
+        auto old = state->templates.find(previous);
+        if (old != state->templates.end() && old->second->source == RUN_TEMPLATE_SOURCE) {
+            state->templates.erase(old);
+        }
+        state->save();
+        std::cerr << "Added template: " << id << " (" << name << " now runs from it)\n";
+    } else if (subcmd == "render") {
+        if (args.size() < 2) {
+            std::cerr << "Usage: vp template render <id> [--key=value...]\n";
+            exit(1);
+        }
+
+        auto it = state->templates.find(args[1]);
+        if (it == state->templates.end()) {
+            std::cerr << "Template not found: " << args[1] << "\n";
+            exit(1);
+        }
+
+        // Nothing is allocated: resources are the given values or the start of their range
+        auto vars = parseVars(std::vector<std::string>(args.begin() + 2, args.end()));
+        auto inst = renderTemplate(*state, *it->second, vars);
+        std::cout << "Command: " << inst->command << "\n";
+        if (!inst->resources.empty()) {
+            std::cout << "Resources:\n";
+            for (const auto& kv : inst->resources) {
+                std::cout << "  " << kv.first << " = " << kv.second << "\n";
+            }
+        }
+        if (!inst->health.empty()) {
+            std::cout << "Health: " << inst->health << "\n";
+        }
+        if (!inst->action.empty()) {
+            std::cout << "Action: " << inst->action << "\n";
+        }
+        for (const auto& [actionName, action] : inst->actions) {
+            std::cout << "Action " << actionName << ": " << action << "\n";
+        }
+
+        auto unresolved = unresolvedPlaceholders(*state, *it->second, vars);
+        if (!unresolved.empty()) {
+            std::cout << "Unresolved:";
+            for (const auto& p : unresolved) {
+                std::cout << " " << p;
+            }
+            std::cout << (it->second->strict ? " (vp start will refuse)" : " (strict off: passed through)") << "\n";
+        }
+    } else if (subcmd == "test") {
+        if (args.size() < 2) {
+            std::cerr << "Usage: vp template test <id|file.json|https://...> [--key=value...] [--timeout=30s] [--keep]\n";
+            exit(1);
+        }
+
+        auto vars = parseVars(std::vector<std::string>(args.begin() + 2, args.end()));
+        long timeout = 30;
+        try {
+            if (vars.count("timeout")) timeout = parseDuration(vars["timeout"]);
+        } catch (const std::exception& e) {
+            std::cerr << "Error: " << e.what() << "\n";
+            exit(1);
+        }
+        bool keep = vars.count("keep") > 0;
+        vars.erase("timeout");
+        vars.erase("keep");
+
+        // An installed template, or every template at a source (for CI, before adding them)
+        std::vector<std::shared_ptr<Template>> templates;
+        auto it = state->templates.find(args[1]);
+        if (it != state->templates.end()) {
+            templates.push_back(it->second);
+        } else {
+            try {
+                templates = loadTemplates(args[1]);
+            } catch (const std::exception& e) {
+                std::cerr << "Template not found: " << args[1] << " (" << e.what() << ")\n";
+                exit(1);
+            }
+        }
+
+        // Throwaway state and logs: nothing here touches ~/.vibeprocess
+        char dir[] = "/tmp/vp-template-test-XXXXXX";
+        if (!mkdtemp(dir)) {
+            std::cerr << "Error: cannot create a sandbox directory\n";
+            exit(1);
+        }
+        setenv("VP_STATE_DIR", dir, 1);
+        auto sandbox = std::make_shared<State>();
+        sandbox->types = state->types;
+
+        int failed = 0;
+        for (const auto& tmpl : templates) {
+            std::string name = "test-" + tmpl->id + "-" + std::to_string(getpid());
+            sandbox->templates[tmpl->id] = tmpl;
+
+            TemplateTestResult result;
+            if (tmpl->pty) {
+                result.stage = "start";
+                result.error = "needs a terminal";
+            } else {
+                result = testTemplate(sandbox, *tmpl, name, vars, timeout * 1000);
+            }
+
+            if (result.passed) {
+                std::cout << "PASS " << tmpl->id << " (ready in " << std::fixed << std::setprecision(1)
+                          << result.readySeconds << "s" << (result.test.empty() ? ", no test command" : ", test passed")
+                          << ")\n";
+            } else {
+                failed++;
+                std::cout << "FAIL " << tmpl->id << " at " << result.stage << ": " << result.error << "\n";
+                std::cout << result.log;
+            }
+            std::cout.flush();
+        }
+
+        if (keep) {
+            std::cout << "Sandbox kept: " << dir << "\n";
+        } else {
+            system(("rm -rf " + shellQuote(dir)).c_str());
+        }
+        if (failed > 0) {
+            exit(1);
+        }
+    } else {
+        std::cerr << "Unknown template command: " << subcmd << "\n";
+        exit(1);
+    }
+}
+
+// vp resources [--type=T]: per type, the counter range, what is claimed and by
+// whom, and what is left; --type lists every claimed value with its owner
+void handleResources(const std::vector<std::string>& args) {
+    std::string type;
+    for (size_t i = 0; i < args.size(); i++) {
+        if (args[i] == "--type" && i + 1 < args.size()) {
+            type = args[++i];
+        } else if (args[i].rfind("--type=", 0) == 0) {
+            type = args[i].substr(7);
+        } else {
+            std::cerr << "Usage: vp resources [--type=T]\n";
+            exit(1);
+        }
+    }
+
+    auto usage = resourceUsage(*state);
+
+    if (type.empty()) {
+        std::cout << std::left << std::setw(15) << "TYPE" << std::setw(14) << "RANGE" << std::setw(9) << "CLAIMED"
+                  << std::setw(9) << "FREE" << std::setw(8) << "NEXT" << "OWNERS\n";
+        for (const auto& u : usage) {
+            std::set<std::string> owners;
+            for (const auto& res : u.claims) owners.insert(res.owner);
+            std::string ownerList;
+            for (const auto& owner : owners) ownerList += (ownerList.empty() ? "" : ", ") + owner;
+            if (ownerList.size() > 48) ownerList = ownerList.substr(0, 45) + "...";
+            std::cout << std::left << std::setw(15) << u.type
+                      << std::setw(14) << (u.counter ? std::to_string(u.start) + "-" + std::to_string(u.end) : "-")
+                      << std::setw(9) << u.claimed
+                      << std::setw(9) << (u.remaining >= 0 ? std::to_string(u.remaining) : "-")
+                      << std::setw(8) << (u.counter ? std::to_string(u.next) : "-")
+                      << (ownerList.empty() ? "-" : ownerList) << "\n";
+        }
+        return;
+    }
+
+    auto it = std::find_if(usage.begin(), usage.end(), [&](const ResourceUsage& u) { return u.type == type; });
+    if (it == usage.end()) {
+        std::cerr << "Resource type not found: " << type << "\n";
+        exit(1);
+    }
+    std::cout << it->type << ": ";
+    if (it->counter) {
+        std::cout << "counter " << it->start << "-" << it->end << ", " << it->claimed << " claimed, "
+                  << it->remaining << " free, next " << it->next << "\n";
+    } else {
+        std::cout << it->claimed << " claimed" << (state->types.count(type) ? "" : " (type no longer defined)") << "\n";
+    }
+    if (it->claims.empty()) {
+        return;
+    }
+
+    // Claims whose owner is gone are leaks: vp delete never ran for them
+    std::cout << "\n" << std::left << std::setw(24) << "VALUE" << std::setw(28) << "OWNER" << "STATUS\n";
+    for (const auto& res : it->claims) {
+        auto owner = state->instances.find(res.owner);
+        std::string status = owner == state->instances.end() ? (res.reserved ? "" : "no such instance")
+                                                               : owner->second->status;
+        if (res.reserved) status += status.empty() ? "reserved" : " (reserved)";
+        std::cout << std::left << std::setw(24) << res.value << std::setw(28) << res.owner << status << "\n";
+    }
+}
+
+// vp reserve <type> [value] --for <name>: claim a value ahead of time for an
+// instance that will be started later; vp unreserve <type> <value> drops it
+void handleReserve(const std::vector<std::string>& args, bool reserve) {
+    std::string owner;
+    std::vector<std::string> positional;
+    for (size_t i = 0; i < args.size(); i++) {
+        if (args[i] == "--for" && i + 1 < args.size()) {
+            owner = args[++i];
+        } else if (args[i].rfind("--for=", 0) == 0) {
+            owner = args[i].substr(6);
+        } else {
+            positional.push_back(args[i]);
+        }
+    }
+
+    if (!reserve) {
+        if (positional.size() != 2) {
+            std::cerr << "Usage: vp unreserve <type> <value>\n";
+            exit(1);
+        }
+        if (!state->unreserveResource(positional[0], positional[1])) {
+            std::cerr << "No reservation for " << positional[0] << " " << positional[1] << "\n";
+            exit(1);
+        }
+        state->save();
+        std::cout << "Released reservation " << positional[0] << " " << positional[1] << "\n";
+        return;
+    }
+
+    if (positional.empty() || positional.size() > 2 || owner.empty()) {
+        std::cerr << "Usage: vp reserve <type> [value] --for <name>\n";
+        exit(1);
+    }
+    owner = qualifiedName(project, owner);
+    try {
+        std::string value = reserveResource(state, positional[0], positional.size() > 1 ? positional[1] : "", owner);
+        state->save();
+        std::cout << "Reserved " << positional[0] << " " << value << " for " << owner << "\n";
+    } catch (const std::exception& e) {
+        std::cerr << "Error: " << e.what() << "\n";
+        exit(1);
+    }
+}
+
+void handleResourceType(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp resource-type <list|add>\n";
+        exit(1);
+    }
+
+    std::string subcmd = args[0];
+
+    if (subcmd == "list") {
+        std::cout << std::left
+                  << std::setw(15) << "NAME"
+                  << std::setw(10) << "COUNTER"
+                  << "CHECK\n";
+        for (const auto& [name, rt] : state->types) {
+            std::cout << std::left
+                      << std::setw(15) << name
+                      << std::setw(10) << (rt->counter ? "true" : "false")
+                      << (rt->ephemeral ? "ephemeral: kernel-picked port, held until exec"
+                          : rt->allocator.empty() ? rt->check : "allocator: " + rt->allocator) << "\n";
+        }
+    } else if (subcmd == "add") {
+        if (args.size() < 2) {
+            std::cerr << "Usage: vp resource-type add <name> --check=<cmd> [--counter] [--start=N] [--end=N]\n"
+                      << "       vp resource-type add <name> --allocator=<cmd>\n"
+                      << "       vp resource-type add <name> --ephemeral\n";
+            exit(1);
+        }
+
+        std::string name = args[1];
+        auto vars = parseVars(std::vector<std::string>(args.begin() + 2, args.end()));
+
+        auto rt = std::make_shared<ResourceType>();
+        rt->name = name;
+        rt->check = vars.find("check") != vars.end() ? vars["check"] : "";
+        rt->counter = vars.find("counter") != vars.end();
+        rt->start = 0;
+        rt->end = 0;
+
+        if (vars.find("start") != vars.end()) {
+            rt->start = std::stoi(vars["start"]);
+        }
+        if (vars.find("end") != vars.end()) {
+            rt->end = std::stoi(vars["end"]);
+        }
+        if (vars.find("allocator") != vars.end()) {
+            rt->allocator = vars["allocator"];
+        }
+        rt->ephemeral = vars.find("ephemeral") != vars.end();
+
+        state->types[name] = rt;
+        state->save();
+
+        std::cout << "Added resource type: " << name << "\n";
+    } else {
+        std::cerr << "Unknown resource-type command: " << subcmd << "\n";
+        exit(1);
+    }
+}
+
+void handleSecret(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp secret <encrypt|check>\n";
+        exit(1);
+    }
+
+    std::string subcmd = args[0];
+
+    if (subcmd == "encrypt") {
+        // From stdin, so the value never appears in shell history or ps
+        if (isatty(STDIN_FILENO)) {
+            std::cerr << "Value (end with Ctrl-D): ";
+        }
+        std::ostringstream value;
+        value << std::cin.rdbuf();
+        std::string plain = value.str();
+        if (!plain.empty() && plain.back() == '\n') plain.pop_back();
+        if (plain.empty()) {
+            std::cerr << "Usage: printf %s \"$VALUE\" | vp secret encrypt\n";
+            exit(1);
+        }
+        try {
+            std::cout << encryptSecret(plain) << "\n";
+        } catch (const std::exception& e) {
+            std::cerr << "Error: " << e.what() << "\n";
+            exit(1);
+        }
+    } else if (subcmd == "check") {
+        if (args.size() < 2) {
+            std::cerr << "Usage: vp secret check <template>\n";
+            exit(1);
+        }
+        auto it = state->templates.find(args[1]);
+        if (it == state->templates.end()) {
+            std::cerr << "Template not found: " << args[1] << "\n";
+            exit(1);
+        }
+
+        // Says whether each resolves, never what to
+        bool failed = false;
+        for (const auto& [name, ref] : it->second->secrets) {
+            try {
+                resolveSecret(ref);
+                std::cout << name << ": ok (" << (ref.rfind("enc:", 0) == 0 ? "enc:..." : ref) << ")\n";
+            } catch (const std::exception& e) {
+                std::cout << name << ": " << e.what() << "\n";
+                failed = true;
+            }
+        }
+        if (failed) {
+            exit(1);
+        }
+    } else {
+        std::cerr << "Unknown secret command: " << subcmd << "\n";
+        exit(1);
+    }
+}
+
+void handleState(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp state <status|encrypt|decrypt>\n";
+        exit(1);
+    }
+
+    std::string subcmd = args[0];
+    std::string stateFile = State::getStateDir() + "/state.json";
+    bool passphrase = getenv("VP_STATE_PASSPHRASE") && *getenv("VP_STATE_PASSPHRASE");
+    bool customKey = getenv("VP_STATE_KEYFILE") && *getenv("VP_STATE_KEYFILE");
+
+    if (subcmd == "status") {
+        std::ifstream file(stateFile);
+        std::string head;
+        std::getline(file, head);
+        std::cout << "State:  " << stateFile << " ("
+                  << (!file.is_open() ? "missing" : isEncryptedState(head) ? "encrypted" : "plaintext") << ")\n";
+        if (file.is_open()) {
+            std::cout << "Schema: v" << state->schemaVersion;
+            if (state->schemaVersion < State::SCHEMA_VERSION) {
+                std::cout << " (saved as v" << State::SCHEMA_VERSION << " on next change)";
+            }
+            std::cout << "\n";
+        }
+        if (passphrase) {
+            std::cout << "Key:    VP_STATE_PASSPHRASE\n";
+        } else if (access(stateKeyPath().c_str(), R_OK) == 0) {
+            std::cout << "Key:    " << stateKeyPath() << "\n";
+        } else {
+            std::cout << "Key:    none (saves are plaintext)\n";
+        }
+    } else if (subcmd == "encrypt") {
+        try {
+            if (!passphrase) {
+                bool existed = access(stateKeyPath().c_str(), R_OK) == 0;
+                ensureStateKey();
+                if (!existed) {
+                    std::cout << "Created " << stateKeyPath() << " (back it up: state cannot be read without it)\n";
+                }
+            }
+        } catch (const std::exception& e) {
+            std::cerr << "Error: " << e.what() << "\n";
+            exit(1);
+        }
+        if (!state->save()) {
+            std::cerr << "Error: failed to write " << stateFile << "\n";
+            exit(1);
+        }
+        std::cout << "Encrypted " << stateFile << " with " << (passphrase ? "VP_STATE_PASSPHRASE" : stateKeyPath()) << "\n";
+    } else if (subcmd == "decrypt") {
+        // Write plaintext first and only then drop the key, so a failed
+        // write leaves the encrypted state readable
+        std::string key = stateKeyPath();
+        std::string parked = key + ".old";
+        bool ownKey = !customKey && access(key.c_str(), F_OK) == 0;
+        unsetenv("VP_STATE_PASSPHRASE");
+        unsetenv("VP_STATE_KEYFILE");
+        if (ownKey && rename(key.c_str(), parked.c_str()) != 0) {
+            std::cerr << "Error: cannot move " << key << ": " << strerror(errno) << "\n";
+            exit(1);
+        }
+        if (!state->save()) {
+            if (ownKey) rename(parked.c_str(), key.c_str());
+            std::cerr << "Error: failed to write " << stateFile << "\n";
+            exit(1);
+        }
+        if (ownKey) unlink(parked.c_str());
+        std::cout << "Decrypted " << stateFile << "\n";
+        if (passphrase || customKey) {
+            std::cout << "Unset " << (passphrase ? "VP_STATE_PASSPHRASE" : "VP_STATE_KEYFILE")
+                      << ", or the next save encrypts it again\n";
+        }
+    } else {
+        std::cerr << "Unknown state command: " << subcmd << "\n";
+        exit(1);
+    }
+}
+
+// Runs before state is loaded, so a broken state dir setting can be fixed
+void handleConfig(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp config <path|get [key]|set <key> <value>|unset <key>>\n";
+        exit(1);
+    }
+
+    std::string subcmd = args[0];
+
+    if (subcmd == "path") {
+        std::cout << configPath() << "\n";
+    } else if (subcmd == "get") {
+        Config config;
+        try {
+            config = loadConfig();
+        } catch (const std::exception& e) {
+            std::cerr << "Error: " << e.what() << "\n";
+            exit(1);
+        }
+        if (args.size() > 1) {
+            auto it = config.find(args[1]);
+            if (it == config.end()) {
+                exit(1);
+            }
+            std::cout << it->second << "\n";
+            return;
+        }
+        std::cout << std::left << std::setw(26) << "KEY" << std::setw(24) << "VALUE" << "DESCRIPTION\n";
+        for (const auto& key : configKeys()) {
+            auto it = config.find(key.key);
+            std::cout << std::left << std::setw(26) << key.key << std::setw(24)
+                      << (it != config.end() ? it->second : "-") << key.description << "\n";
+        }
+        for (const auto& [key, value] : config) {
+            bool known = std::any_of(configKeys().begin(), configKeys().end(),
+                                     [&](const ConfigKey& k) { return k.key == key; });
+            if (!known) {
+                std::cout << std::left << std::setw(26) << key << std::setw(24) << value << "(unknown, ignored)\n";
+            }
+        }
+    } else if (subcmd == "set" || subcmd == "unset") {
+        if ((subcmd == "set" && args.size() != 3) || (subcmd == "unset" && args.size() != 2)) {
+            std::cerr << "Usage: vp config set <key> <value> | vp config unset <key>\n";
+            exit(1);
+        }
+        std::string value = subcmd == "set" ? args[2] : "";
+        if (subcmd == "set" && value.empty()) {
+            std::cerr << "Error: empty value; use vp config unset " << args[1] << "\n";
+            exit(1);
+        }
+        try {
+            setConfigValue(args[1], value);
+        } catch (const std::exception& e) {
+            std::cerr << "Error: " << e.what() << "\n";
+            exit(1);
+        }
+        if (subcmd == "set") {
+            std::cout << "Set " << args[1] << " = " << value << " in " << configPath() << "\n";
+        } else {
+            std::cout << "Unset " << args[1] << " in " << configPath() << "\n";
+        }
+        if (args[1].rfind("serve.", 0) == 0 || args[1].rfind("discovery.", 0) == 0 || args[1] == "auth.session-ttl") {
+            std::cout << "vp serve picks this up when it restarts\n";
+        }
+    } else {
+        std::cerr << "Unknown config command: " << subcmd << "\n";
+        exit(1);
+    }
+}
+
+void handleProfile(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp profile <list|current|add|remove>\n";
+        exit(1);
+    }
+
+    std::string subcmd = args[0];
+    auto profiles = loadProfiles();
 
     if (subcmd == "list") {
-        std::cout << std::left
-                  << std::setw(15) << "NAME"
-                  << std::setw(10) << "COUNTER"
-                  << "CHECK\n";
-        for (const auto& [name, rt] : state->types) {
-            std::cout << std::left
-                      << std::setw(15) << name
-                      << std::setw(10) << (rt->counter ? "true" : "false")
-                      << rt->check << "\n";
+        printf("  %-16s %-10s %-12s %s\n", "NAME", "SERVE", "PORTS", "STATE");
+        for (const auto& [name, p] : profiles) {
+            std::string ports = p.port_start ? std::to_string(p.port_start) + "-" +
+                                                   std::to_string(p.port_end ? p.port_end : p.port_start + 999)
+                                             : "-";
+            printf("%s %-16s %-10s %-12s %s\n", name == currentProfile() ? "*" : " ", name.c_str(),
+                   std::to_string(p.serve_port ? p.serve_port : 8080).c_str(), ports.c_str(),
+                   State::getProfileDir(name).c_str());
+            if (!p.description.empty()) {
+                printf("  %-16s %s\n", "", p.description.c_str());
+            }
+        }
+    } else if (subcmd == "current") {
+        std::cout << currentProfile() << " (" << State::getStateDir() << ")\n";
+        if (getenv("VP_STATE_DIR") && *getenv("VP_STATE_DIR")) {
+            std::cout << "VP_STATE_DIR is set and overrides the profile's directory\n";
+        }
+    } else if (subcmd == "add") {
+        if (args.size() < 2 || !validProfileName(args[1])) {
+            std::cerr << "Usage: vp profile add <name> [--serve-port=N] [--ports=START-END] [--description=TEXT]\n";
+            exit(1);
+        }
+        std::string name = args[1];
+        auto vars = parseVars(std::vector<std::string>(args.begin() + 2, args.end()));
+        Profile& p = profiles[name];
+        try {
+            if (vars.count("serve-port")) p.serve_port = std::stoi(vars["serve-port"]);
+            if (vars.count("ports")) {
+                std::string range = vars["ports"];
+                size_t dash = range.find('-');
+                p.port_start = std::stoi(range.substr(0, dash));
+                p.port_end = dash == std::string::npos ? 0 : std::stoi(range.substr(dash + 1));
+                if (p.port_end && p.port_end < p.port_start) {
+                    throw std::invalid_argument("empty range");
+                }
+            }
+        } catch (const std::exception&) {
+            std::cerr << "Invalid --serve-port or --ports (e.g. --ports=4000-4999)\n";
+            exit(1);
+        }
+        if (vars.count("description")) p.description = vars["description"];
+
+        // Ranges that overlap another profile's would hand out the same ports
+        for (const auto& [other, q] : profiles) {
+            if (other == name || !p.port_start || !q.port_start) continue;
+            int end = p.port_end ? p.port_end : p.port_start + 999;
+            int otherEnd = q.port_end ? q.port_end : q.port_start + 999;
+            if (p.port_start <= otherEnd && q.port_start <= end) {
+                std::cerr << "Warning: ports overlap profile " << other << "\n";
+            }
+            if (p.serve_port && p.serve_port == q.serve_port) {
+                std::cerr << "Warning: serve port " << p.serve_port << " is also profile " << other << "'s\n";
+            }
+        }
+
+        if (!saveProfiles(profiles)) {
+            std::cerr << "Error: cannot write profiles\n";
+            exit(1);
+        }
+        std::cout << "Profile " << name << ": " << State::getProfileDir(name) << "\n";
+        std::cout << "Use it with: vp --profile " << name << " ... (or VP_PROFILE=" << name << ")\n";
+    } else if (subcmd == "remove") {
+        if (args.size() < 2 || args[1] == "default") {
+            std::cerr << "Usage: vp profile remove <name> (not default)\n";
+            exit(1);
+        }
+        if (!profiles.count(args[1])) {
+            std::cerr << "Profile not found: " << args[1] << "\n";
+            exit(1);
+        }
+        profiles.erase(args[1]);
+        if (!saveProfiles(profiles)) {
+            std::cerr << "Error: cannot write profiles\n";
+            exit(1);
+        }
+        // Its state and logs may be all someone has of those instances
+        std::cout << "Removed profile " << args[1] << "'s settings; its state stays in "
+                  << State::getProfileDir(args[1]) << " (delete that to drop the profile)\n";
+    } else {
+        std::cerr << "Unknown profile command: " << subcmd << "\n";
+        exit(1);
+    }
+}
+
+void handleDiscoverySource(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp discovery-source <list|add|remove>\n";
+        exit(1);
+    }
+
+    std::string subcmd = args[0];
+
+    if (subcmd == "list") {
+        std::cout << std::left << std::setw(15) << "NAME" << "COMMAND\n";
+        std::cout << std::left << std::setw(15) << "local" << "(built in)\n";
+        for (const auto& [name, command] : state->discoverySources) {
+            std::cout << std::left << std::setw(15) << name << command << "\n";
+        }
+    } else if (subcmd == "add") {
+        if (args.size() < 2) {
+            std::cerr << "Usage: vp discovery-source add <name> --command=<cmd>\n";
+            exit(1);
+        }
+
+        std::string name = args[1];
+        auto vars = parseVars(std::vector<std::string>(args.begin() + 2, args.end()));
+        if (name == "local" || vars["command"].empty()) {
+            std::cerr << "Usage: vp discovery-source add <name> --command=<cmd> (name can't be local)\n";
+            exit(1);
+        }
+
+        state->discoverySources[name] = vars["command"];
+        state->save();
+        std::cout << "Added discovery source: " << name << "\n";
+    } else if (subcmd == "remove") {
+        if (args.size() < 2 || !state->discoverySources.erase(args[1])) {
+            std::cerr << "Discovery source not found: " << (args.size() < 2 ? "" : args[1]) << "\n";
+            exit(1);
+        }
+        state->save();
+        std::cout << "Removed discovery source: " << args[1] << "\n";
+    } else {
+        std::cerr << "Unknown discovery-source command: " << subcmd << "\n";
+        exit(1);
+    }
+}
+
+void handleToken(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp token <list|add|remove>\n";
+        exit(1);
+    }
+
+    std::string subcmd = args[0];
+
+    if (subcmd == "list") {
+        std::cout << std::left << std::setw(20) << "NAME" << std::setw(10) << "ROLE" << "TOKEN\n";
+        for (const auto& [name, t] : state->tokens) {
+            std::cout << std::left << std::setw(20) << name << std::setw(10) << t.role << t.token.substr(0, 6) << "...\n";
+        }
+    } else if (subcmd == "add") {
+        if (args.size() < 2) {
+            std::cerr << "Usage: vp token add <name> [--role=viewer|operator|admin]\n";
+            exit(1);
+        }
+
+        auto vars = parseVars(std::vector<std::string>(args.begin() + 2, args.end()));
+        std::string role = vars.count("role") ? vars["role"] : "viewer";
+        if (role != "viewer" && role != "operator" && role != "admin") {
+            std::cerr << "Invalid role: " << role << " (viewer|operator|admin)\n";
+            exit(1);
+        }
+
+        ApiToken t;
+        t.token = generateToken();
+        t.role = role;
+        state->tokens[args[1]] = t;
+        state->save();
+
+        // Printed in full only here; list shows a prefix
+        std::cout << t.token << "\n";
+    } else if (subcmd == "remove") {
+        if (args.size() < 2 || !state->tokens.erase(args[1])) {
+            std::cerr << "Token not found: " << (args.size() < 2 ? "" : args[1]) << "\n";
+            exit(1);
+        }
+        state->save();
+        std::cout << "Removed token: " << args[1] << "\n";
+    } else {
+        std::cerr << "Unknown token command: " << subcmd << "\n";
+        exit(1);
+    }
+}
+
+// Read a password: prompted twice with echo off on a terminal, else one line of stdin
+static std::string readPassword() {
+    if (!isatty(STDIN_FILENO)) {
+        std::string line;
+        std::getline(std::cin, line);
+        return line;
+    }
+
+    auto prompt = [](const char* text) {
+        std::cerr << text;
+        struct termios saved, quiet;
+        tcgetattr(STDIN_FILENO, &saved);
+        quiet = saved;
+        quiet.c_lflag &= ~ECHO;
+        tcsetattr(STDIN_FILENO, TCSANOW, &quiet);
+        std::string line;
+        std::getline(std::cin, line);
+        tcsetattr(STDIN_FILENO, TCSANOW, &saved);
+        std::cerr << "\n";
+        return line;
+    };
+    std::string password = prompt("Password: ");
+    if (prompt("Again: ") != password) {
+        std::cerr << "Passwords don't match\n";
+        exit(1);
+    }
+    return password;
+}
+
+// vp user list|add|passwd|remove: web UI logins. Each user has a role like a
+// token's; the UI asks for a login as soon as there is one.
+void handleUser(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp user <list|add|passwd|remove>\n";
+        exit(1);
+    }
+
+    std::string subcmd = args[0];
+
+    if (subcmd == "list") {
+        std::cout << std::left << std::setw(20) << "USER" << "ROLE\n";
+        for (const auto& [name, u] : state->users) {
+            std::cout << std::left << std::setw(20) << name << u.role << "\n";
+        }
+    } else if (subcmd == "add" || subcmd == "passwd") {
+        if (args.size() < 2) {
+            std::cerr << "Usage: vp user " << subcmd << " <name>" << (subcmd == "add" ? " [--role=viewer|operator|admin]" : "") << "\n";
+            exit(1);
+        }
+        std::string name = args[1];
+        auto existing = state->users.find(name);
+        if (subcmd == "add" && existing != state->users.end()) {
+            std::cerr << "User exists: " << name << " (vp user passwd " << name << " to change the password)\n";
+            exit(1);
+        }
+        if (subcmd == "passwd" && existing == state->users.end()) {
+            std::cerr << "User not found: " << name << "\n";
+            exit(1);
+        }
+
+        WebUser user = subcmd == "passwd" ? existing->second : WebUser{"", "viewer"};
+        auto vars = parseVars(std::vector<std::string>(args.begin() + 2, args.end()));
+        if (vars.count("role")) user.role = vars["role"];
+        if (user.role != "viewer" && user.role != "operator" && user.role != "admin") {
+            std::cerr << "Invalid role: " << user.role << " (viewer|operator|admin)\n";
+            exit(1);
+        }
+
+        std::string password = readPassword();
+        if (password.size() < 8) {
+            std::cerr << "Password must be at least 8 characters\n";
+            exit(1);
+        }
+        try {
+            user.password_hash = hashPassword(password);
+        } catch (const std::exception& e) {
+            std::cerr << "Error: " << e.what() << "\n";
+            exit(1);
+        }
+        state->users[name] = user;
+        state->save();
+        std::cout << (subcmd == "add" ? "Added user: " : "Changed password: ") << name << " (" << user.role << ")\n";
+    } else if (subcmd == "remove") {
+        if (args.size() < 2 || !state->users.erase(args[1])) {
+            std::cerr << "User not found: " << (args.size() < 2 ? "" : args[1]) << "\n";
+            exit(1);
+        }
+        state->save();
+        std::cout << "Removed user: " << args[1] << " (their sessions end with it)\n";
+    } else {
+        std::cerr << "Unknown user command: " << subcmd << "\n";
+        exit(1);
+    }
+}
+
+// vp remotes list|allow|block|remove <origin>: the browser origins (other than
+// the UI's own) that may use the API with CORS and attach web terminals
+void handleRemotes(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp remotes <list|allow|block|remove> [origin]\n";
+        exit(1);
+    }
+
+    std::string subcmd = args[0];
+
+    if (subcmd == "list") {
+        if (state->remotesAllowed.empty()) {
+            std::cout << "No remote origins: only the UI's own origin and non-browser clients\n";
+            return;
+        }
+        std::cout << std::left << std::setw(40) << "ORIGIN" << "ACCESS\n";
+        for (const auto& [origin, allowed] : state->remotesAllowed) {
+            std::string access = !allowed ? "blocked"
+                                 : origin == "*" ? "allowed: API without cookies, no terminals"
+                                                 : "allowed: API with cookies, terminals";
+            std::cout << std::left << std::setw(40) << origin << access << "\n";
+        }
+    } else if (subcmd == "allow" || subcmd == "block" || subcmd == "remove") {
+        if (args.size() < 2) {
+            std::cerr << "Usage: vp remotes " << subcmd << " <scheme://host[:port]|*>\n";
+            exit(1);
+        }
+        std::string origin;
+        try {
+            origin = normalizeOrigin(args[1]);
+        } catch (const std::invalid_argument& e) {
+            std::cerr << "Error: " << e.what() << "\n";
+            exit(1);
+        }
+
+        if (subcmd == "remove") {
+            if (!state->remotesAllowed.erase(origin)) {
+                std::cerr << "Origin not listed: " << origin << "\n";
+                exit(1);
+            }
+            std::cout << "Removed " << origin << "\n";
+        } else {
+            state->remotesAllowed[origin] = subcmd == "allow";
+            std::cout << (subcmd == "allow" ? "Allowed " : "Blocked ") << origin << "\n";
+        }
+        state->save();
+    } else {
+        std::cerr << "Unknown remotes command: " << subcmd << "\n";
+        exit(1);
+    }
+}
+
+void handleAlert(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp alert <list|add|remove|events>\n";
+        exit(1);
+    }
+
+    std::string subcmd = args[0];
+
+    if (subcmd == "list") {
+        std::cout << std::left << std::setw(16) << "ID" << std::setw(28) << "CONDITION" << std::setw(8) << "FOR"
+                  << std::setw(10) << "ACTION" << std::setw(16) << "SELECTOR" << "TARGET\n";
+        for (const auto& [id, rule] : state->alerts) {
+            std::cout << std::left << std::setw(16) << id << std::setw(28) << rule.condition
+                      << std::setw(8) << (std::to_string(rule.duration) + "s")
+                      << std::setw(10) << (rule.enabled ? rule.action : rule.action + "(off)")
+                      << std::setw(16) << (rule.selector.empty() ? "-" : rule.selector) << rule.target << "\n";
+        }
+    } else if (subcmd == "add") {
+        if (args.size() < 3) {
+            std::cerr << "Usage: vp alert add <id> '<metric> <op> <value>' --action=restart|webhook|command\n";
+            std::cerr << "                    [--target=URL|CMD] [--for=5m] [--selector=k=v] [--cooldown=5m] [--enabled=false]\n";
+            exit(1);
+        }
+
+        auto vars = parseVars(std::vector<std::string>(args.begin() + 3, args.end()));
+        AlertRule rule;
+        rule.id = args[1];
+        rule.condition = args[2];
+        rule.action = vars["action"];
+        rule.target = vars["target"];
+        rule.selector = vars["selector"];
+        rule.enabled = vars["enabled"] != "false";
+        try {
+            if (vars.count("for")) rule.duration = parseDuration(vars["for"]);
+            if (vars.count("cooldown")) rule.cooldown = parseDuration(vars["cooldown"]);
+            validateAlertRule(rule);
+        } catch (const std::exception& e) {
+            std::cerr << "Invalid alert rule: " << e.what() << "\n";
+            exit(1);
+        }
+
+        state->alerts[rule.id] = rule;
+        state->save();
+        std::cout << "Added alert: " << rule.id << " (checked by vp serve)\n";
+    } else if (subcmd == "remove") {
+        if (args.size() < 2 || !state->alerts.erase(args[1])) {
+            std::cerr << "Alert not found: " << (args.size() < 2 ? "" : args[1]) << "\n";
+            exit(1);
+        }
+        state->save();
+        std::cout << "Removed alert: " << args[1] << "\n";
+    } else if (subcmd == "events") {
+        auto vars = parseVars(std::vector<std::string>(args.begin() + 1, args.end()));
+        for (const auto& event : state->events) {
+            if (vars.count("instance") && event.instance != vars["instance"]) continue;
+
+            std::cout << formatTime(event.time) << "  " << std::left << std::setw(20) << event.instance
+                      << std::setw(16) << (event.rule.empty() ? event.kind : event.rule) << event.message << "\n";
+        }
+    } else {
+        std::cerr << "Unknown alert command: " << subcmd << "\n";
+        exit(1);
+    }
+}
+
+// vp discovery-policy [--<command>=off|status|full...] [--reset]: how much
+// discovery each command runs first; --default (or --'*') covers the rest
+void handleDiscoveryPolicy(const std::vector<std::string>& args) {
+    auto vars = parseVars(args);
+    if (vars.count("reset")) {
+        state->discoverOn.clear();
+        vars.erase("reset");
+    }
+    for (const auto& [key, depth] : vars) {
+        if (depth != "off" && depth != "status" && depth != "full") {
+            std::cerr << "Error: invalid depth for " << key << ": " << depth << " (off|status|full)\n";
+            exit(1);
+        }
+        state->discoverOn[key == "default" ? "*" : key] = depth;
+    }
+    if (!args.empty()) {
+        state->save();
+    }
+
+    std::cout << "Discovery: " << discoveryDepth(*state, "*") << " by default\n";
+    for (const auto& [cmd, depth] : state->discoverOn) {
+        if (cmd != "*") std::cout << "  " << cmd << ": " << depth << "\n";
+    }
+}
+
+// vp prune [--older-than=7d] [--dry-run]: delete instances stopped that long,
+// with their logs, and release resources whose owner is gone; vp prune policy
+// [--after=D|off] sets how long vp serve lets them sit before pruning itself
+void handlePrune(const std::vector<std::string>& args) {
+    auto vars = parseVars(args);
+
+    if (!args.empty() && args[0] == "policy") {
+        vars = parseVars(std::vector<std::string>(args.begin() + 1, args.end()));
+        if (vars.count("after")) {
+            try {
+                state->pruneAfter = vars["after"] == "off" ? 0 : parseDuration(vars["after"]);
+            } catch (const std::exception&) {
+                std::cerr << "Error: invalid duration: " << vars["after"] << "\n";
+                exit(1);
+            }
+            state->save();
+        }
+        std::cout << "Auto-prune: " << (state->pruneAfter > 0 ? "after " + std::to_string(state->pruneAfter) + "s"
+                                                                : "off") << "\n";
+        return;
+    }
+
+    long olderThan = state->pruneAfter > 0 ? state->pruneAfter : 7 * 86400;
+    if (vars.count("older-than")) {
+        try {
+            olderThan = parseDuration(vars["older-than"]);
+        } catch (const std::exception&) {
+            std::cerr << "Error: invalid duration: " << vars["older-than"] << "\n";
+            exit(1);
+        }
+    }
+    bool dryRun = vars.count("dry-run") > 0;
+
+    discover();
+    auto result = pruneInstances(state, olderThan, dryRun);
+
+    std::string verb = dryRun ? "Would remove " : "Removed ";
+    for (const auto& name : result.instances) std::cout << verb << "instance " << name << "\n";
+    for (const auto& path : result.logs) std::cout << verb << "log " << path << "\n";
+    for (const auto& res : result.resources) {
+        std::cout << (dryRun ? "Would release " : "Released ") << res.type << " " << res.value
+                  << " (owner " << res.owner << ")\n";
+    }
+    std::cout << (dryRun ? "Dry run: " : "Pruned: ") << result.instances.size() << " instance"
+              << (result.instances.size() == 1 ? "" : "s") << ", " << result.logs.size() << " log"
+              << (result.logs.size() == 1 ? "" : "s") << ", " << result.resources.size() << " resource"
+              << (result.resources.size() == 1 ? "" : "s") << "\n";
+}
+
+void handleLogs(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp logs <name> [--lines=N] [--follow]\n";
+        std::cerr << "       vp logs sweep\n";
+        std::cerr << "       vp logs policy [--max-size=10M] [--max-files=N] [--max-age=7d] [--compress=true|false]\n";
+        exit(1);
+    }
+
+    auto vars = parseVars(std::vector<std::string>(args.begin() + 1, args.end()));
+
+    if (args[0] == "sweep") {
+        auto removed = sweepLogs(state);
+        for (const auto& path : removed) {
+            std::cout << "Removed " << path << "\n";
+        }
+        std::cout << "Swept logs (" << removed.size() << " removed)\n";
+        return;
+    }
+
+    if (args[0] == "policy") {
+        try {
+            if (vars.count("max-size")) state->logPolicy.max_size = parseSize(vars["max-size"]);
+            if (vars.count("max-files")) state->logPolicy.max_files = std::stoi(vars["max-files"]);
+            if (vars.count("max-age")) state->logPolicy.max_age = parseDuration(vars["max-age"]);
+            if (vars.count("compress")) state->logPolicy.compress = vars["compress"] == "true";
+        } catch (const std::exception& e) {
+            std::cerr << "Error: " << e.what() << "\n";
+            exit(1);
+        }
+        if (!vars.empty()) {
+            state->save();
+        }
+        std::cout << json(state->logPolicy).dump(2) << "\n";
+        return;
+    }
+
+    std::string name = qualifiedName(project, args[0]);
+    std::string path = logPath(name);
+    if (state->instances.find(name) == state->instances.end() && access(path.c_str(), F_OK) != 0) {
+        std::cerr << "Instance not found: " << name << "\n";
+        exit(1);
+    }
+
+    int lines = vars.count("lines") ? std::stoi(vars["lines"]) : 50;
+    std::cout << tailLog(path, lines) << std::flush;
+
+    if (vars.count("follow")) {
+        std::ifstream file(path);
+        file.seekg(0, std::ios::end);
+        std::string line;
+        while (true) {
+            while (std::getline(file, line)) {
+                std::cout << line << "\n" << std::flush;
+            }
+            file.clear();
+            // Reopen after rotation truncated the file
+            std::streampos pos = file.tellg();
+            std::ifstream probe(path, std::ios::ate);
+            if (probe.tellg() < pos) {
+                file.close();
+                file.open(path);
+            }
+            std::this_thread::sleep_for(std::chrono::milliseconds(500));
+        }
+    }
+}
+
+void handleWait(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp wait <name> [--for=running|stopped|healthy] [--timeout=30s]\n";
+        exit(1);
+    }
+
+    std::string name = qualifiedName(project, args[0]);
+    auto vars = parseVars(std::vector<std::string>(args.begin() + 1, args.end()));
+    std::string condition = vars.count("for") ? vars["for"] : "running";
+
+    if (condition != "running" && condition != "stopped" && condition != "healthy") {
+        std::cerr << "Invalid condition: " << condition << " (running|stopped|healthy)\n";
+        exit(1);
+    }
+
+    long timeout = 0;
+    try {
+        if (vars.count("timeout")) timeout = parseDuration(vars["timeout"]);
+    } catch (const std::exception& e) {
+        std::cerr << "Error: " << e.what() << "\n";
+        exit(1);
+    }
+
+    if (state->instances.find(name) == state->instances.end()) {
+        std::cerr << "Instance not found: " << name << "\n";
+        exit(1);
+    }
+
+    // Re-read the state file each poll; another vp may be changing it
+    auto lookup = [&name]() -> std::shared_ptr<Instance> {
+        auto current = State::load();
+        auto it = current->instances.find(name);
+        return it != current->instances.end() ? it->second : nullptr;
+    };
+
+    if (!waitForInstance(lookup, condition, timeout * 1000)) {
+        std::cerr << "Gave up waiting for " << name << " to be " << condition << "\n";
+        exit(1);
+    }
+
+    std::cout << name << " is " << condition << "\n";
+}
+
+void printTreeNode(const json& node, const std::string& prefix, bool last) {
+    std::cout << prefix << (last ? "└─ " : "├─ ")
+              << node["pid"].get<int>() << " " << node["name"].get<std::string>()
+              << "  cpu=" << std::fixed << std::setprecision(2) << node["cputime"].get<double>() << "s"
+              << " rss=" << formatBytes(node["rss"].get<long>()) << "\n";
+
+    const auto& children = node["children"];
+    for (size_t i = 0; i < children.size(); i++) {
+        printTreeNode(children[i], prefix + (last ? "   " : "│  "), i + 1 == children.size());
+    }
+}
+
+void handleInspect(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp inspect <name>\n";
+        exit(1);
+    }
+
+    discover();
+    std::string name = selectInstances(args)[0];
+    const Instance& inst = *state->instances.at(name);
+
+    std::cout << "Name:       " << inst.name << "\n";
+    std::cout << "Template:   " << (inst.template_name.empty() ? "-" : inst.template_name);
+    if (!inst.template_revision.empty()) {
+        std::cout << " (revision " << inst.template_revision << ")";
+    }
+    if (instanceDrifted(*state, inst)) {
+        std::cout << ", drifted: now " << templateRevision(*state->templates[inst.template_name])
+                  << " (vp upgrade " << inst.name << ")";
+    }
+    std::cout << "\n";
+    std::cout << "Status:     " << inst.status;
+    if (instanceRunning(inst) || inst.status == "orphaned") {
+        std::cout << " (PID " << inst.pid << ", since " << formatTime(inst.started) << ")";
+    } else if (inst.status == "starting" && inst.startup) {
+        std::cout << " (PID " << inst.pid << ", since " << formatTime(inst.started) << ", waiting for its startup probe until "
+                  << formatTime(inst.started + inst.startup->timeout) << ")";
+    }
+    std::cout << (inst.managed ? "" : ", monitor only") << (inst.protect ? ", locked (vp unlock " + inst.name + ")" : "")
+              << "\n";
+    if (instanceRunning(inst)) {
+        std::cout << "Usage:      cpu " << formatPercent(inst.cpu_percent) << " (" << formatCPUTime(inst.cpu_time)
+                  << " total), rss " << (inst.rss > 0 ? formatBytes(inst.rss) : "-") << ", threads " << inst.threads
+                  << ", children " << inst.children << "\n";
+    }
+    if (inst.limits) {
+        const Limits& limits = *inst.limits;
+        std::vector<std::string> set;
+        if (limits.max_rss > 0) set.push_back("rss " + formatBytes(limits.max_rss));
+        if (limits.max_cpu_percent > 0) set.push_back("cpu " + formatPercent(limits.max_cpu_percent));
+        if (limits.max_fds > 0) set.push_back("fds " + std::to_string(limits.max_fds));
+        std::cout << "Limits:     ";
+        for (size_t n = 0; n < set.size(); n++) std::cout << (n ? ", " : "") << set[n];
+        if (!inst.over_limit.empty()) {
+            std::cout << " (over-limit:";
+            for (const auto& limit : inst.over_limit) std::cout << " " << limit;
+            std::cout << ")";
         }
-    } else if (subcmd == "add") {
-        if (args.size() < 2) {
-            std::cerr << "Usage: vp resource-type add <name> --check=<cmd> [--counter] [--start=N] [--end=N]\n";
-            exit(1);
+        std::cout << "\n";
+    }
+    if (!inst.warning.empty()) std::cout << "Warning:    " << inst.warning << "\n";
+    if (!inst.error.empty()) std::cout << "Error:      " << inst.error << "\n";
+    if (!inst.notes.empty()) std::cout << "Notes:      " << inst.notes << "\n";
+    std::cout << "Command:    " << inst.command << "\n";
+    if (!inst.leaf_command.empty()) std::cout << "Found by:   " << inst.leaf_command << "\n";
+    if (!inst.container.empty()) std::cout << "Container:  " << inst.container << "\n";
+    if (inst.discovered) {
+        const auto& seen = *inst.discovered;
+        std::cout << "Discovered: " << formatTime(seen.taken) << ", " << (seen.exe.empty() ? "-" : seen.exe) << " in "
+                  << (seen.cwd.empty() ? "-" : seen.cwd) << ", " << seen.environ.size() << " env vars";
+        for (size_t i = 0; i < seen.ports.size(); i++) {
+            std::cout << (i == 0 ? ", ports " : ",") << seen.ports[i];
+        }
+        std::cout << "\n";
+        for (const auto& parent : seen.parents) {
+            std::string cmdline = parent.cmdline.empty() ? parent.name : parent.cmdline;
+            if (cmdline.size() > 80) cmdline = cmdline.substr(0, 77) + "...";
+            std::cout << "  parent    " << parent.pid << " " << cmdline << "\n";
+        }
+    }
+    if (auto rule = matchRuleFor(inst)) {
+        std::cout << "Match:      " << json(*rule).dump() << (inst.match ? "" : " (default)") << "\n";
+    }
+    if (!inst.resources.empty()) {
+        std::cout << "Resources: ";
+        for (const auto& [rtype, value] : inst.resources) {
+            std::cout << " " << rtype << "=" << value;
         }
+        std::cout << "\n";
+    }
 
-        std::string name = args[1];
-        auto vars = parseVars(std::vector<std::string>(args.begin() + 2, args.end()));
+    if (!inst.secrets.empty()) {
+        // References only; the values live in the process environment
+        std::cout << "Secrets:   ";
+        for (const auto& [secretName, ref] : inst.secrets) {
+            std::cout << " " << secretName << "=" << (ref.rfind("enc:", 0) == 0 ? "enc:..." : ref);
+        }
+        std::cout << "\n";
+    }
 
-        auto rt = std::make_shared<ResourceType>();
-        rt->name = name;
-        rt->check = vars.find("check") != vars.end() ? vars["check"] : "";
-        rt->counter = vars.find("counter") != vars.end();
-        rt->start = 0;
-        rt->end = 0;
+    if (!inst.health.empty() || inst.health_failures > 0) {
+        std::cout << "Health:     " << (inst.health.empty() ? "(tcpport check)" : inst.health);
+        if (inst.health_failures > 0) {
+            std::cout << "; restart after " << inst.health_failures << " failures, checked every "
+                      << inst.health_interval << "s";
+        }
+        if (inst.failed_checks > 0) std::cout << "; " << inst.failed_checks << " failed now";
+        std::cout << "\n";
+    }
+    if (inst.startup) {
+        std::cout << "Startup:    " << json(*inst.startup).dump() << "\n";
+    }
+    if (inst.restarts > 0) {
+        std::cout << "Restarts:   " << inst.restarts;
+        if (inst.restarted_at > 0) {
+            std::cout << ", last " << formatTime(inst.restarted_at) << " (" << inst.restart_reason << ")";
+        }
+        if (inst.backoff > 0) std::cout << ", backoff " << inst.backoff << "s";
+        std::cout << "\n";
+    }
 
-        if (vars.find("start") != vars.end()) {
-            rt->start = std::stoi(vars["start"]);
+    bool header = false;
+    for (const auto& event : state->events) {
+        if (event.instance != name) continue;
+        if (!header) {
+            std::cout << "Events:\n";
+            header = true;
         }
-        if (vars.find("end") != vars.end()) {
-            rt->end = std::stoi(vars["end"]);
+        std::cout << "  " << formatTime(event.time) << "  " << event.kind << "  " << event.message << "\n";
+    }
+}
+
+void handleUpToDate(const std::vector<std::string>& args) {
+    std::vector<std::string> names;
+    if (args.empty()) {
+        for (const auto& [name, inst] : state->instances) {
+            if (inProject(*inst) && !inst->template_name.empty()) names.push_back(name);
+        }
+    } else {
+        names = selectInstances(args);
+    }
+
+    bool drifted = false;
+    for (const auto& name : names) {
+        const Instance& inst = *state->instances.at(name);
+        if (instanceDrifted(*state, inst)) {
+            drifted = true;
+            std::cout << name << ": drifted (" << inst.template_name << " " << inst.template_revision << " -> "
+                      << templateRevision(*state->templates[inst.template_name]) << ")\n";
+        } else if (inst.template_revision.empty() || !state->templates.count(inst.template_name)) {
+            std::cout << name << ": unknown (no recorded template revision)\n";
+        } else {
+            std::cout << name << ": up to date\n";
         }
+    }
 
-        state->types[name] = rt;
+    if (drifted) {
+        exit(1);
+    }
+}
+
+void handleUpgrade(const std::vector<std::string>& args) {
+    if (args.empty()) {
+        std::cerr << "Usage: vp upgrade <name|-l selector> [--force]\n";
+        exit(1);
+    }
+
+    discover();
+
+    // --force re-renders even when the template looks unchanged
+    std::vector<std::string> rest;
+    bool force = false;
+    for (const auto& arg : args) {
+        if (arg == "--force") {
+            force = true;
+        } else {
+            rest.push_back(arg);
+        }
+    }
+
+    bool failed = false;
+    for (const auto& name : selectInstances(rest)) {
+        // Earlier upgrades give up the state lock: skip what was deleted meanwhile
+        auto it = state->instances.find(name);
+        if (it == state->instances.end()) {
+            continue;
+        }
+        auto inst = it->second;
+        if (!force && !instanceDrifted(*state, *inst)) {
+            std::cout << name << ": up to date\n";
+            continue;
+        }
+        try {
+            auto fresh = upgradeInstance(state, inst);
+            std::cout << "Upgraded " << name << " to " << fresh->template_name << " " << fresh->template_revision
+                      << " (PID " << fresh->pid << ")\n";
+            std::cout << "Command: " << fresh->command << "\n";
+        } catch (const std::exception& e) {
+            std::cerr << "Error upgrading " << name << ": " << e.what() << "\n";
+            failed = true;
+        }
+    }
+
+    if (failed) {
+        exit(1);
+    }
+}
+
+void handleTree(const std::vector<std::string>& args) {
+    discover();
+
+    json trees = instanceTrees(state);
+    bool printed = false;
+
+    for (const auto& entry : trees) {
+        std::string name = entry["name"];
+        if (!args.empty() && name != qualifiedName(project, args[0])) {
+            continue;
+        }
+        if (args.empty() && !project.empty() && projectOf(name) != project) {
+            continue;
+        }
+
+        std::cout << name << " (" << entry["status"].get<std::string>() << ")\n";
+        if (!entry["tree"].is_null()) {
+            printTreeNode(entry["tree"], "", true);
+        }
+        printed = true;
+    }
+
+    if (!printed) {
+        if (!args.empty()) {
+            std::cerr << "Instance not found: " << args[0] << "\n";
+            exit(1);
+        }
+        std::cout << "No instances running\n";
+    }
+}
+
+// vp monitor <pid> <name> [--launch-script]: import a running process as an
+// instance; --launch-script takes what launched it (see vp chain) instead
+void handleMonitor(const std::vector<std::string>& args) {
+    std::vector<std::string> positional;
+    bool launchScript = false;
+    for (const auto& arg : args) {
+        if (arg == "--launch-script") {
+            launchScript = true;
+        } else {
+            positional.push_back(arg);
+        }
+    }
+    char* end = nullptr;
+    long pid = positional.size() == 2 ? strtol(positional[0].c_str(), &end, 10) : 0;
+    if (pid <= 0 || *end) {
+        std::cerr << "Usage: vp monitor <pid> <name> [--launch-script]\n";
+        exit(1);
+    }
+
+    try {
+        auto inst = monitorProcess(state, (int)pid, qualifiedName(project, positional[1]), launchScript);
+        std::cout << "Monitoring " << inst->name << " (PID " << inst->pid << "): " << inst->command << "\n";
+        if (!inst->leaf_command.empty()) {
+            std::cout << "Launch script of PID " << pid << ": " << inst->leaf_command << "\n";
+        }
+    } catch (const std::exception& e) {
+        std::cerr << "Error: " << e.what() << "\n";
+        exit(1);
+    }
+}
+
+// vp match <name> [--cmdline=RE] [--exe=P] [--cwd=D] [--env=NAME[=V]] [--port=false]
+// | --clear: how a stopped instance's process is found again; no flags shows it
+void handleMatch(const std::vector<std::string>& args) {
+    if (args.empty() || args[0].rfind("--", 0) == 0) {
+        std::cerr << "Usage: vp match <name> [--cmdline=RE] [--exe=P] [--cwd=D] [--env=NAME[=V]] [--port=false] [--clear]\n";
+        exit(1);
+    }
+
+    std::string name = qualifiedName(project, args[0]);
+    auto it = state->instances.find(name);
+    if (it == state->instances.end()) {
+        std::cerr << "Instance not found: " << name << "\n";
+        exit(1);
+    }
+    auto& inst = *it->second;
+    auto vars = parseVars(std::vector<std::string>(args.begin() + 1, args.end()));
+
+    if (vars.count("clear")) {
+        inst.match.reset();
+        state->save();
+    } else if (!vars.empty()) {
+        MatchRule rule = inst.match.value_or(MatchRule{});
+        if (vars.count("cmdline")) {
+            try {
+                std::regex check(vars["cmdline"]);
+            } catch (const std::regex_error& e) {
+                std::cerr << "Invalid --cmdline regex: " << e.what() << "\n";
+                exit(1);
+            }
+            rule.cmdline = vars["cmdline"];
+        }
+        if (vars.count("exe")) rule.exe = vars["exe"];
+        if (vars.count("cwd")) rule.cwd = vars["cwd"];
+        if (vars.count("env")) rule.env = vars["env"];
+        if (vars.count("port")) rule.port = vars["port"] != "false";
+        inst.match = rule;
         state->save();
+    }
 
-        std::cout << "Added resource type: " << name << "\n";
+    auto rule = matchRuleFor(inst);
+    if (!rule) {
+        std::cout << name << ": no rule (no tcpport to go by); not rematched\n";
+        return;
+    }
+    std::cout << name << (inst.match ? "" : " (default)") << ": " << json(*rule).dump() << "\n";
+}
+
+// vp diff <a> <b>: how two instances differ (command, env, resources, cwd,
+// limits...); vp diff <name> compares one with what its template renders to
+// now, given its vars and resources. Exits 1 when they differ, like diff(1).
+void handleDiff(const std::vector<std::string>& args) {
+    if (args.empty() || args.size() > 2) {
+        std::cerr << "Usage: vp diff <name> [other]   (without other: against its template)\n";
+        exit(1);
+    }
+
+    discover();
+    std::vector<std::shared_ptr<Instance>> sides;
+    for (const auto& arg : args) {
+        auto it = state->instances.find(qualifiedName(project, arg));
+        if (it == state->instances.end()) {
+            std::cerr << "Instance not found: " << qualifiedName(project, arg) << "\n";
+            exit(1);
+        }
+        sides.push_back(it->second);
+    }
+
+    std::string labelB;
+    bool live = sides.size() == 2;
+    if (live) {
+        labelB = sides[1]->name;
     } else {
-        std::cerr << "Unknown resource-type command: " << subcmd << "\n";
+        auto tmpl = state->templates.find(sides[0]->template_name);
+        if (tmpl == state->templates.end()) {
+            std::cerr << "Error: " << sides[0]->name << " has no template to compare with"
+                      << (sides[0]->template_name.empty() ? "" : " (" + sides[0]->template_name + " is gone)") << "\n";
+            exit(1);
+        }
+        auto vars = sides[0]->vars;
+        for (const auto& kv : sides[0]->resources) vars[kv.first] = kv.second;
+        auto rendered = renderTemplate(*state, *tmpl->second, vars);
+        rendered->labels = sides[0]->labels;
+        rendered->template_revision = templateRevision(*tmpl->second);
+        sides.push_back(rendered);
+        labelB = "template " + tmpl->first;
+    }
+
+    auto diffs = diffInstances(*sides[0], *sides[1], live);
+    if (diffs.empty()) {
+        std::cout << "No differences\n";
+        return;
+    }
+    bool tty = isatty(STDOUT_FILENO);
+    size_t width = std::max(sides[0]->name.size(), labelB.size());
+    for (const auto& d : diffs) {
+        std::cout << (tty ? "\033[1;33m" : "") << d.field << (tty ? "\033[0m" : "") << "\n";
+        std::cout << "  " << std::left << std::setw(width) << sides[0]->name << "  "
+                  << (d.a.empty() ? "(unset)" : d.a) << "\n";
+        std::cout << "  " << std::left << std::setw(width) << labelB << "  " << (d.b.empty() ? "(unset)" : d.b) << "\n";
+    }
+    exit(1);
+}
+
+// vp refresh <name>: re-read its process now and claim ports it has since opened
+void handleRefresh(const std::vector<std::string>& args) {
+    if (args.size() != 1) {
+        std::cerr << "Usage: vp refresh <name>\n";
+        exit(1);
+    }
+
+    discover();
+    std::string name = qualifiedName(project, args[0]);
+    auto it = state->instances.find(name);
+    if (it == state->instances.end()) {
+        std::cerr << "Instance not found: " << name << "\n";
+        exit(1);
+    }
+
+    std::vector<FieldDiff> changes;
+    try {
+        changes = refreshInstance(state, it->second);
+    } catch (const std::exception& e) {
+        std::cerr << "Error: " << e.what() << "\n";
+        exit(1);
+    }
+    if (changes.empty()) {
+        std::cout << "No changes\n";
+        return;
+    }
+    for (const auto& change : changes) {
+        std::cout << std::left << std::setw(20) << change.field << (change.a.empty() ? "(unset)" : change.a) << " -> "
+                  << (change.b.empty() ? "(unset)" : change.b) << "\n";
+    }
+}
+
+// vp adopt <name> [--restart]: let vp stop and restart a monitored instance
+void handleAdopt(const std::vector<std::string>& args) {
+    if (args.empty() || args[0].rfind("--", 0) == 0) {
+        std::cerr << "Usage: vp adopt <name> [--restart]\n";
+        exit(1);
+    }
+
+    discover();
+    std::string name = qualifiedName(project, args[0]);
+    auto it = state->instances.find(name);
+    if (it == state->instances.end()) {
+        std::cerr << "Instance not found: " << name << "\n";
+        exit(1);
+    }
+
+    bool restart = std::find(args.begin(), args.end(), "--restart") != args.end();
+    try {
+        manageInstance(state, it->second, restart);
+    } catch (const std::exception& e) {
+        std::cerr << "Error: " << e.what() << "\n";
+        exit(1);
+    }
+    const Instance& inst = *it->second;
+    std::cout << "Adopted " << name;
+    if (restart) {
+        std::cout << ": restarted under vp (PID " << inst.pid << ")";
+        if (!inst.template_name.empty() && inst.template_name != "discovered") {
+            std::cout << " from template " << inst.template_name;
+        }
+    }
+    std::cout << "\n";
+}
+
+// vp detach <name> [--forget]: the inverse of adopt, leaving the process running
+void handleDetach(const std::vector<std::string>& args) {
+    if (args.empty() || args[0].rfind("--", 0) == 0) {
+        std::cerr << "Usage: vp detach <name> [--forget]\n";
+        exit(1);
+    }
+
+    discover();
+    std::string name = qualifiedName(project, args[0]);
+    auto it = state->instances.find(name);
+    if (it == state->instances.end()) {
+        std::cerr << "Instance not found: " << name << "\n";
+        exit(1);
+    }
+
+    bool forget = std::find(args.begin(), args.end(), "--forget") != args.end();
+    int pid = it->second->pid;
+    try {
+        detachInstance(state, it->second, forget);
+    } catch (const std::exception& e) {
+        std::cerr << "Error: " << e.what() << "\n";
+        exit(1);
+    }
+    std::cout << "Detached " << name << " (PID " << pid << " keeps running"
+              << (forget ? ", forgotten" : ", monitor only") << ")\n";
+}
+
+// vp chain <pid|name>: what launched a process, up to init, marking the launch
+// script vp would restart it with (e.g. npm run dev inside tmux, not node)
+void handleChain(const std::vector<std::string>& args) {
+    if (args.size() != 1) {
+        std::cerr << "Usage: vp chain <pid|name>\n";
+        exit(1);
+    }
+
+    int pid = 0;
+    char* end;
+    long n = strtol(args[0].c_str(), &end, 10);
+    if (!*end && n > 0) {
+        pid = (int)n;
+    } else {
+        discover();
+        std::string name = qualifiedName(project, args[0]);
+        auto it = state->instances.find(name);
+        if (it == state->instances.end()) {
+            std::cerr << "Instance not found: " << name << "\n";
+            exit(1);
+        }
+        pid = it->second->pid;
+        if (pid <= 0) {
+            std::cerr << name << " is not running\n";
+            exit(1);
+        }
+    }
+
+    json result = parentChainJson(*state, pid);
+    if (result.is_null()) {
+        std::cerr << "No such process: " << pid << "\n";
         exit(1);
     }
+
+    int script = result["launch_script"].is_null() ? 0 : result["launch_script"].get<int>();
+    std::cout << std::left << std::setw(3) << "" << std::setw(9) << "PID" << std::setw(16) << "NAME" << "COMMAND\n";
+    for (const auto& link : result["chain"]) {
+        int linkPid = link["pid"];
+        std::string cmdline = link["cmdline"];
+        if (cmdline.size() > 80) cmdline = cmdline.substr(0, 77) + "...";
+        if (link.contains("instance")) cmdline += "  [" + link["instance"].get<std::string>() + "]";
+        std::cout << std::left << std::setw(3) << (linkPid == script ? "*" : "") << std::setw(9) << linkPid
+                  << std::setw(16) << link["name"].get<std::string>() << cmdline << "\n";
+    }
+    if (script > 0) {
+        std::cout << "\n* launch script\n";
+    }
+}
+
+// Strip global flags (logging, project) from argv; returns false on an invalid value.
+// They come before the command: parsing stops at "--" or the first non-flag, so
+// `vp run -- grep -v foo` keeps its -v
+bool parseGlobalFlags(std::vector<std::string>& argv) {
+    std::vector<std::string> rest;
+    for (size_t i = 0; i < argv.size(); i++) {
+        const std::string& arg = argv[i];
+        if (arg == "--") {
+            rest.insert(rest.end(), argv.begin() + i + 1, argv.end());
+            break;
+        } else if (arg.empty() || arg[0] != '-') {
+            rest.insert(rest.end(), argv.begin() + i, argv.end());
+            break;
+        } else if (arg == "--project" && i + 1 < argv.size()) {
+            project = argv[++i];
+        } else if (arg.rfind("--project=", 0) == 0) {
+            project = arg.substr(10);
+        } else if ((arg == "--profile" && i + 1 < argv.size()) || arg.rfind("--profile=", 0) == 0) {
+            // Through the environment, so State and any vp the instances run agree
+            std::string profile = arg == "--profile" ? argv[++i] : arg.substr(10);
+            if (!validProfileName(profile)) {
+                std::cerr << "Invalid profile name: " << profile << " (letters, digits, '-' and '_')\n";
+                return false;
+            }
+            setenv("VP_PROFILE", profile.c_str(), 1);
+        } else if (arg == "--no-discover") {
+            noDiscover = true;
+        } else if (arg == "--verbose" || arg == "-v") {
+            setLogLevel(LogLevel::Debug);
+        } else if (arg == "--quiet" || arg == "-q") {
+            setLogLevel(LogLevel::Error);
+        } else if (arg.rfind("--log-level=", 0) == 0) {
+            LogLevel level;
+            if (!parseLogLevel(arg.substr(12), level)) {
+                std::cerr << "Invalid log level: " << arg.substr(12) << " (debug|info|warn|error)\n";
+                return false;
+            }
+            setLogLevel(level);
+        } else if (arg.rfind("--log-format=", 0) == 0) {
+            LogFormat format;
+            if (!parseLogFormat(arg.substr(13), format)) {
+                std::cerr << "Invalid log format: " << arg.substr(13) << " (text|json)\n";
+                return false;
+            }
+            setLogFormat(format);
+        } else if (arg.rfind("--log-file=", 0) == 0) {
+            if (!setLogFile(arg.substr(11))) {
+                std::cerr << "Cannot open log file: " << arg.substr(11) << "\n";
+                return false;
+            }
+        } else {
+            rest.push_back(arg);
+        }
+    }
+    argv = rest;
+
+    if (project.find('/') != std::string::npos) {
+        std::cerr << "Invalid project name: " << project << " (must not contain '/')\n";
+        return false;
+    }
+    return true;
 }
 
 void printUsage() {
-    std::cerr << "Usage: vp <command> [args...]\n";
+    std::cerr << "Usage: vp [--project=P] [--profile=NAME] [--verbose|--quiet] [--no-discover] [--log-level=L] [--log-format=text|json] [--log-file=F] <command> [args...]\n";
     std::cerr << "Commands:\n";
-    std::cerr << "  start <template> <name> [--key=value...]  - Start a new process\n";
+    std::cerr << "  start <template> [name] [--key=value...]  - Start a new process (no name: one is generated)\n";
+    std::cerr << "                                               --dry-run prints the plan, claims nothing\n";
+    std::cerr << "  run [--name=N] \"<command>\"                 - Start a command without a template (%tcpport allocates)\n";
     std::cerr << "  stop <name>                                - Stop a running process\n";
     std::cerr << "  restart <name>                             - Restart a stopped process\n";
+    std::cerr << "  restart --rolling <template>               - Restart its running instances one at a time\n";
     std::cerr << "  delete <name>                              - Delete a process instance\n";
-    std::cerr << "  ps                                         - List all instances\n";
+    std::cerr << "  prune [--older-than=7d] [--dry-run]        - Delete long-stopped instances, their logs, orphaned claims\n";
+    std::cerr << "  prune policy [--after=D|off]               - Let vp serve prune on its own\n";
+    std::cerr << "  lock|unlock <name|-l selector>             - Refuse stop/restart/delete without --force\n";
+    std::cerr << "  annotate <name|--template=ID> [text]       - Notes on why an instance (or template) exists\n";
+    std::cerr << "                                               stop/restart/delete also take -l SELECTOR,\n";
+    std::cerr << "                                               --all, --template=ID or --status=S [--yes]\n";
+    std::cerr << "  label <name> key=value... [key-...]        - Set or remove labels\n";
+    std::cerr << "  action <name> [action]                     - Run a named action (lists them if omitted)\n";
+    std::cerr << "  action-history [name] [--id=N]             - Show past action runs and their output\n";
+    std::cerr << "  history <name> [--since=12h]               - Status changes over time and what caused each\n";
+    std::cerr << "  open <name> [action]                       - Open the instance's URL action in a browser\n";
+    std::cerr << "                                               stop/restart/delete/label/ps accept -l key=value,...\n";
+    std::cerr << "  ps [-l selector]                           - List all instances\n";
+    std::cerr << "                                               --columns=name,status,pid,ports,rss,... picks columns\n";
+    std::cerr << "                                               -o wide doesn't truncate; --no-resources hides RESOURCES\n";
+    std::cerr << "                                               --watch[=2s] redraws, highlighting changed rows\n";
+    std::cerr << "  tree [name]                                - Show instances with child processes\n";
+    std::cerr << "  monitor <pid> <name> [--launch-script]     - Import a running process (or what launched it)\n";
+    std::cerr << "  adopt <name> [--restart]                   - Manage a monitored instance (--restart: rerun it under vp)\n";
+    std::cerr << "  detach <name> [--forget]                   - Release it, leave it running monitor only (--forget: drop it)\n";
+    std::cerr << "  helper check|signal <pid> [sig]            - Privileged helper, run as root via $VP_HELPER (see README)\n";
+    std::cerr << "  match <name> [--cmdline=RE] [--exe=P] ...  - How a stopped instance's process is found again\n";
+    std::cerr << "  chain <pid|name>                           - Parent chain up to init, marking the launch script\n";
+    std::cerr << "  diff <name> [other]                        - How two instances differ (or one from its template)\n";
+    std::cerr << "  inspect <name>                             - Show an instance's details, restarts and events\n";
+    std::cerr << "  refresh <name>                             - Re-read its process: claim new ports, show what changed\n";
+    std::cerr << "  up-to-date [name|-l selector]              - Check instances against their templates\n";
+    std::cerr << "  upgrade <name|-l selector> [--force]       - Restart drifted instances from the new template\n";
+    std::cerr << "  logs <name|sweep|policy> [--follow]        - Show captured output, manage rotation\n";
+    std::cerr << "  wait <name> [--for=healthy] [--timeout=T]  - Block until running|stopped|healthy\n";
     std::cerr << "  serve [port]                               - Start web UI (default: 8080)\n";
-    std::cerr << "  template <list|add|show>                   - Manage templates\n";
+    std::cerr << "                                               --rate=N/s --burst=N limit mutating calls per client\n";
+    std::cerr << "                                               --bind=ADDR listen address, --allow=CIDR,... client networks\n";
+    std::cerr << "                                               --subreaper reaps orphaned grandchildren (Linux)\n";
+    std::cerr << "                                               --metrics-interval=15s --metrics-retention=24h\n";
+    std::cerr << "                                               --proxy-http=PORT routes <name>.vp.localhost to instances\n";
+    std::cerr << "                                               --proxy-domain=a,b sets the proxied domains\n";
+    std::cerr << "                                               --mdns announces instances as <name>._vp._tcp.local\n";
+    std::cerr << "                                               --register=consul://host:port|etcd://host:port\n";
+    std::cerr << "                                               --debug serves /api/v1/self (vp's own usage, cache hits)\n";
+    std::cerr << "                                               --web-dir=DIR serves a custom UI (index.html + assets)\n";
+    std::cerr << "  template <list|add|show|update>            - Manage templates (add from file, URL or git)\n";
+    std::cerr << "  template render <id> [--key=value...]      - Preview its interpolated command and actions\n";
+    std::cerr << "  template from-instance <name> [--id=ID]    - Template from a running or imported instance\n";
+    std::cerr << "  template test <id|source> [--timeout=30s]  - Start it in a sandbox, wait for ready, run its test\n";
+    std::cerr << "  resources [--type=T]                       - Claimed and free values per resource type, and owners\n";
+    std::cerr << "  reserve <type> [value] --for <name>        - Hold a resource for an instance started later\n";
+    std::cerr << "  unreserve <type> <value>                   - Drop a reservation\n";
     std::cerr << "  resource-type <list|add>                   - Manage resource types\n";
+    std::cerr << "  discovery-source <list|add|remove>         - Extra process sources (docker, agents, scripts)\n";
+    std::cerr << "  discovery-policy [--<command>=off|status|full] - Discovery each command runs first\n";
+    std::cerr << "                                               (status: liveness only; --default=D, --reset)\n";
+    std::cerr << "  secret encrypt | secret check <template>   - enc: references for template secrets, check they resolve\n";
+    std::cerr << "  profile <list|current|add|remove>          - Separate state, ports and serve port (--profile NAME)\n";
+    std::cerr << "  config <path|get [key]|set|unset>          - Daemon defaults in ~/.config/vp/config.toml (or .yaml)\n";
+    std::cerr << "  state <status|encrypt|decrypt>             - Encrypt state.json at rest (state.key or VP_STATE_PASSPHRASE)\n";
+    std::cerr << "  token <list|add|remove> [--role=R]         - API tokens (viewer|operator|admin)\n";
+    std::cerr << "  user <list|add|passwd|remove> [--role=R]   - Web UI logins (vp serve --session-ttl=12h)\n";
+    std::cerr << "  alert <list|add|remove|events>             - Alert rules (restart, webhook, command)\n";
+    std::cerr << "  remotes <list|allow|block|remove> [origin] - Browser origins allowed cross-origin API access\n";
 }
 
 int main(int argc, char* argv[]) {
-    state = State::load();
+    if (const char* env = getenv("VP_PROJECT")) {
+        project = env;
+    }
 
-    if (argc < 2) {
-        listInstances();
+    std::vector<std::string> args(argv + 1, argv + argc);
+    if (!parseGlobalFlags(args)) {
+        return 1;
+    }
+
+    // The privileged helper runs as root: it touches no state
+    if (!args.empty() && args[0] == "helper") {
+        return runHelper(std::vector<std::string>(args.begin() + 1, args.end()));
+    }
+    if (!args.empty() && args[0] == "config") {
+        handleConfig(std::vector<std::string>(args.begin() + 1, args.end()));
         return 0;
     }
 
-    std::string cmd = argv[1];
-    std::vector<std::string> args;
+    try {
+        state = State::load();
+    } catch (const std::exception& e) {
+        std::cerr << "Error: " << e.what() << "\n";
+        return 1;
+    }
 
-    for (int i = 2; i < argc; i++) {
-        args.push_back(argv[i]);
+    if (args.empty()) {
+        command = "ps";
+        listInstances();
+        return 0;
     }
 
+    std::string cmd = args[0];
+    args.erase(args.begin());
+    command = cmd;
+
     if (cmd == "start") {
         handleStart(args);
+    } else if (cmd == "run") {
+        handleRun(args);
     } else if (cmd == "stop") {
         handleStop(args);
     } else if (cmd == "restart") {
         handleRestart(args);
     } else if (cmd == "delete") {
         handleDelete(args);
+    } else if (cmd == "annotate") {
+        handleAnnotate(args);
+    } else if (cmd == "prune") {
+        handlePrune(args);
+    } else if (cmd == "discovery-policy") {
+        handleDiscoveryPolicy(args);
+    } else if (cmd == "lock" || cmd == "unlock") {
+        handleLock(args, cmd == "lock");
     } else if (cmd == "ps") {
-        listInstances();
+        handlePs(args);
+    } else if (cmd == "action") {
+        handleAction(args);
+    } else if (cmd == "open") {
+        handleOpen(args);
+    } else if (cmd == "action-history") {
+        handleActionHistory(args);
+    } else if (cmd == "history") {
+        handleHistory(args);
+    } else if (cmd == "label") {
+        handleLabel(args);
+    } else if (cmd == "logs") {
+        handleLogs(args);
+    } else if (cmd == "wait") {
+        handleWait(args);
+    } else if (cmd == "tree") {
+        handleTree(args);
+    } else if (cmd == "monitor") {
+        handleMonitor(args);
+    } else if (cmd == "match") {
+        handleMatch(args);
+    } else if (cmd == "remotes") {
+        handleRemotes(args);
+    } else if (cmd == "diff") {
+        handleDiff(args);
+    } else if (cmd == "chain") {
+        handleChain(args);
+    } else if (cmd == "refresh") {
+        handleRefresh(args);
+    } else if (cmd == "adopt") {
+        handleAdopt(args);
+    } else if (cmd == "detach") {
+        handleDetach(args);
     } else if (cmd == "serve") {
         handleServe(args);
     } else if (cmd == "template") {
         handleTemplate(args);
+    } else if (cmd == "resources") {
+        handleResources(args);
+    } else if (cmd == "reserve" || cmd == "unreserve") {
+        handleReserve(args, cmd == "reserve");
     } else if (cmd == "resource-type") {
         handleResourceType(args);
+    } else if (cmd == "secret") {
+        handleSecret(args);
+    } else if (cmd == "profile") {
+        handleProfile(args);
+    } else if (cmd == "state") {
+        handleState(args);
+    } else if (cmd == "discovery-source") {
+        handleDiscoverySource(args);
+    } else if (cmd == "token") {
+        handleToken(args);
+    } else if (cmd == "user") {
+        handleUser(args);
+    } else if (cmd == "alert") {
+        handleAlert(args);
+    } else if (cmd == "inspect") {
+        handleInspect(args);
+    } else if (cmd == "up-to-date") {
+        handleUpToDate(args);
+    } else if (cmd == "upgrade") {
+        handleUpgrade(args);
     } else {
         std::cerr << "Unknown command: " << cmd << "\n";
         printUsage();
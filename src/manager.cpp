@@ -0,0 +1,118 @@
+#include "manager.hpp"
+#include "process.hpp"
+#include <stdexcept>
+
+namespace vp {
+
+InstanceLocks::Held::Held(InstanceLocks& locks, const std::string& name,
+                          std::shared_ptr<std::recursive_mutex> mutex)
+    : locks_(locks), name_(name), mutex_(std::move(mutex)), lock_(*mutex_, std::defer_lock) {}
+
+InstanceLocks::Held::~Held() {
+    if (!mutex_) return; // Moved from
+    if (lock_.owns_lock()) {
+        lock_.unlock();
+    }
+    locks_.release(name_, mutex_);
+}
+
+InstanceLocks::Held InstanceLocks::acquire(const std::string& name, State& state) {
+    std::shared_ptr<std::recursive_mutex> lock;
+    {
+        std::lock_guard<std::mutex> guard(mutex_);
+        auto& slot = locks_[name];
+        if (!slot) {
+            slot = std::make_shared<std::recursive_mutex>();
+        }
+        lock = slot;
+    }
+    Held held(*this, name, lock);
+    if (!held.lock_.try_lock()) {
+        State::Unlocked unlocked(state);
+        held.lock_.lock();
+    }
+    return held;
+}
+
+size_t InstanceLocks::size() {
+    std::lock_guard<std::mutex> guard(mutex_);
+    return locks_.size();
+}
+
+void InstanceLocks::release(const std::string& name, std::shared_ptr<std::recursive_mutex>& mutex) {
+    std::lock_guard<std::mutex> guard(mutex_);
+    mutex.reset();
+    // Every holder and waiter copies the entry under mutex_, so only the
+    // map's own reference left means nobody else can be using it
+    auto it = locks_.find(name);
+    if (it != locks_.end() && it->second.use_count() == 1) {
+        locks_.erase(it);
+    }
+}
+
+InstanceLocks& instanceLocks() {
+    static InstanceLocks locks;
+    return locks;
+}
+
+Manager Manager::open() {
+    return Manager(State::load());
+}
+
+std::shared_ptr<Instance> Manager::start(const std::string& templateId, const std::string& name,
+                                         const std::map<std::string, std::string>& vars) {
+    auto data = state_->lock();
+    auto tmpl = state_->templates.find(templateId);
+    if (tmpl == state_->templates.end()) {
+        throw std::runtime_error("template not found: " + templateId);
+    }
+    return startProcess(state_, *tmpl->second, name, vars);
+}
+
+// Run a bulk-style operation on one instance, throwing its error
+static void operate(std::shared_ptr<State> state, const std::string& name, const std::string& op, bool force) {
+    auto data = state->lock();
+    std::string error = instanceOperation(state, name, op, force);
+    if (!error.empty()) {
+        throw std::runtime_error(name + ": " + error);
+    }
+}
+
+void Manager::stop(const std::string& name, bool force) {
+    operate(state_, name, "stop", force);
+}
+
+void Manager::restart(const std::string& name, bool force) {
+    operate(state_, name, "restart", force);
+}
+
+void Manager::remove(const std::string& name, bool force) {
+    operate(state_, name, "delete", force);
+}
+
+void Manager::lock(const std::string& name, bool locked) {
+    auto data = state_->lock();
+    auto it = state_->instances.find(name);
+    if (it == state_->instances.end()) {
+        throw std::runtime_error(name + ": not found");
+    }
+    it->second->protect = locked;
+    state_->save();
+}
+
+std::vector<std::shared_ptr<Instance>> Manager::list(const std::string& selector) {
+    auto data = state_->lock();
+    matchAndUpdateInstances(state_);
+    std::vector<std::shared_ptr<Instance>> result;
+    for (const auto& name : filterInstances(*state_, "", selector, "", "")) {
+        result.push_back(state_->instances[name]);
+    }
+    return result;
+}
+
+std::vector<std::map<std::string, std::string>> Manager::discover(bool portsOnly) {
+    auto data = state_->lock();
+    return discoverProcesses(state_, portsOnly);
+}
+
+} // namespace vp
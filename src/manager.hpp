@@ -0,0 +1,101 @@
+#ifndef VP_MANAGER_HPP
+#define VP_MANAGER_HPP
+
+#include "state.hpp"
+#include <map>
+#include <memory>
+#include <mutex>
+#include <string>
+#include <vector>
+
+namespace vp {
+
+// InstanceLocks runs lifecycle operations on one instance one at a time:
+// start, stop, restart and delete, and the reapers that record an exit, hold
+// the instance's lock while they change it. Operations on different instances
+// still run side by side. Re-entrant, so an operation can build on another
+// (restart stops first) without deadlocking. Take state's data lock first:
+// acquire gives it up while it waits, so whoever holds the instance can go on.
+// A name's entry lives only while someone holds or waits for it, so deleted
+// instances don't leave theirs behind.
+class InstanceLocks {
+public:
+    // Held is one hold on an instance's lock, released when it is destroyed
+    class Held {
+    public:
+        Held(InstanceLocks& locks, const std::string& name, std::shared_ptr<std::recursive_mutex> mutex);
+        Held(Held&&) = default;
+        ~Held();
+        Held(const Held&) = delete;
+        Held& operator=(const Held&) = delete;
+        Held& operator=(Held&&) = delete;
+
+    private:
+        friend class InstanceLocks;
+        InstanceLocks& locks_;
+        std::string name_;
+        std::shared_ptr<std::recursive_mutex> mutex_;
+        std::unique_lock<std::recursive_mutex> lock_;
+    };
+
+    // Wait for name's lock and hold it for the returned Held's lifetime
+    Held acquire(const std::string& name, State& state);
+
+    // Names with an entry (held or waited for)
+    size_t size();
+
+private:
+    std::mutex mutex_;
+    std::map<std::string, std::shared_ptr<std::recursive_mutex>> locks_;
+
+    // Drop a holder's reference, and name's entry if it was the last one
+    void release(const std::string& name, std::shared_ptr<std::recursive_mutex>& mutex);
+};
+
+// The locks every lifecycle operation in this process takes
+InstanceLocks& instanceLocks();
+
+// Manager is the entry point for using vp as a library (libvpcore): it owns
+// the state and offers the operations the CLI and HTTP API are built from.
+// Methods throw std::runtime_error with the reason on failure and are safe to
+// call from several threads: each holds the state's data lock, and lifecycle
+// methods on one instance are serialized (InstanceLocks). Hold
+// state()->lock() to read its maps yourself. Share one State with vp serve
+// only through the state file.
+class Manager {
+public:
+    explicit Manager(std::shared_ptr<State> state) : state_(state) {}
+
+    // Manager over ~/.vibeprocess/state.json (created on first save); throws
+    // std::runtime_error when the file is there but unreadable, like State::load
+    static Manager open();
+
+    std::shared_ptr<State> state() const { return state_; }
+
+    // Start a template as name ("project/name" to scope it), like vp start
+    std::shared_ptr<Instance> start(const std::string& templateId, const std::string& name,
+                                    const std::map<std::string, std::string>& vars = {});
+
+    // Stop and release resources / restart / stop and forget, like the CLI.
+    // Locked instances throw unless force is set.
+    void stop(const std::string& name, bool force = false);
+    void restart(const std::string& name, bool force = false);
+    void remove(const std::string& name, bool force = false);
+
+    // vp lock / vp unlock
+    void lock(const std::string& name, bool locked = true);
+
+    // Instances matching a label selector ("" = all), after refreshing their
+    // status and usage
+    std::vector<std::shared_ptr<Instance>> list(const std::string& selector = "");
+
+    // Running processes vp doesn't manage yet, as shown by vp discover
+    std::vector<std::map<std::string, std::string>> discover(bool portsOnly = false);
+
+private:
+    std::shared_ptr<State> state_;
+};
+
+} // namespace vp
+
+#endif // VP_MANAGER_HPP
@@ -0,0 +1,110 @@
+#include "mdns.hpp"
+#include "logger.hpp"
+#include <csignal>
+#include <fcntl.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+namespace vp {
+
+std::map<std::string, int> mdnsServices(const State& state) {
+    std::map<std::string, int> services;
+    for (const auto& [name, inst] : state.instances) {
+        if (inst->status != "running") continue;
+
+        auto it = inst->resources.find("tcpport");
+        int port = it != inst->resources.end() ? std::atoi(it->second.c_str()) : 0;
+        if (port > 0) {
+            services[name] = port;
+        }
+    }
+    return services;
+}
+
+std::vector<std::string> mdnsPublishCommand(const std::string& name, int port, const std::string& templateId) {
+#ifdef __APPLE__
+    return {"dns-sd", "-R", name, MDNS_SERVICE_TYPE, "local", std::to_string(port), "template=" + templateId};
+#else
+    return {"avahi-publish", "-s", name, MDNS_SERVICE_TYPE, std::to_string(port), "template=" + templateId};
+#endif
+}
+
+MdnsAdvertiser::~MdnsAdvertiser() {
+    while (!published_.empty()) {
+        withdraw(published_.begin()->first);
+    }
+}
+
+void MdnsAdvertiser::withdraw(const std::string& name) {
+    auto it = published_.find(name);
+    if (it == published_.end()) return;
+
+    kill(it->second.pid, SIGTERM);
+    waitpid(it->second.pid, nullptr, 0);
+    published_.erase(it);
+}
+
+int MdnsAdvertiser::sync() {
+    if (unavailable_) return -1;
+    auto data = state_->lock();
+
+    // Publishers that died (responder restarted, tool missing) are started again
+    for (auto it = published_.begin(); it != published_.end();) {
+        int status;
+        if (waitpid(it->second.pid, &status, WNOHANG) != it->second.pid) {
+            ++it;
+            continue;
+        }
+        if (WIFEXITED(status) && WEXITSTATUS(status) == 127) {
+            logWarn("mDNS publisher not found", {{"command", mdnsPublishCommand("", 0, "")[0]}});
+            unavailable_ = true;
+        }
+        it = published_.erase(it);
+    }
+    if (unavailable_) {
+        while (!published_.empty()) withdraw(published_.begin()->first);
+        return -1;
+    }
+
+    auto services = mdnsServices(*state_);
+
+    for (auto it = published_.begin(); it != published_.end();) {
+        auto wanted = services.find(it->first);
+        if (wanted != services.end() && wanted->second == it->second.port) {
+            ++it;
+            continue;
+        }
+        std::string name = (it++)->first;
+        logInfo("mDNS withdrawn", {{"instance", name}});
+        withdraw(name);
+    }
+
+    for (const auto& [name, port] : services) {
+        if (published_.count(name)) continue;
+
+        auto inst = state_->instances.at(name);
+        auto argv = mdnsPublishCommand(name, port, inst->template_name);
+        pid_t pid = fork();
+        if (pid == 0) {
+            int devnull = open("/dev/null", O_RDWR);
+            dup2(devnull, STDIN_FILENO);
+            dup2(devnull, STDOUT_FILENO);
+            dup2(devnull, STDERR_FILENO);
+
+            std::vector<char*> args;
+            for (auto& arg : argv) args.push_back(arg.data());
+            args.push_back(nullptr);
+            execvp(args[0], args.data());
+            _exit(127);
+        }
+        if (pid < 0) {
+            logWarn("mDNS publisher failed to start", {{"instance", name}});
+            continue;
+        }
+        published_[name] = {pid, port};
+        logInfo("mDNS announced", {{"instance", name}, {"port", port}});
+    }
+    return (int)published_.size();
+}
+
+} // namespace vp
@@ -0,0 +1,50 @@
+#ifndef VP_MDNS_HPP
+#define VP_MDNS_HPP
+
+#include "state.hpp"
+#include <map>
+#include <memory>
+#include <string>
+#include <sys/types.h>
+#include <vector>
+
+namespace vp {
+
+// DNS-SD service type instances are announced under (<name>._vp._tcp.local)
+constexpr const char* MDNS_SERVICE_TYPE = "_vp._tcp";
+
+// Instances to announce: name -> ${tcpport} of each running instance that has one
+std::map<std::string, int> mdnsServices(const State& state);
+
+// Command line announcing one instance through the system mDNS responder
+// (avahi-publish on Linux, dns-sd on macOS), with its template as a TXT record
+std::vector<std::string> mdnsPublishCommand(const std::string& name, int port, const std::string& templateId);
+
+// MdnsAdvertiser keeps one publisher process per running instance so phones
+// and other machines on the LAN can find dev servers by name. Publishers are
+// replaced when an instance moves port and killed when it stops.
+class MdnsAdvertiser {
+public:
+    explicit MdnsAdvertiser(std::shared_ptr<State> state) : state_(state) {}
+    ~MdnsAdvertiser();
+
+    // Bring publishers in line with state (call periodically). Returns the
+    // number of instances announced, or -1 if no publisher tool is installed.
+    int sync();
+
+private:
+    struct Publisher {
+        pid_t pid;
+        int port;
+    };
+
+    void withdraw(const std::string& name);
+
+    std::shared_ptr<State> state_;
+    std::map<std::string, Publisher> published_;
+    bool unavailable_ = false;  // Publisher tool missing (warned once)
+};
+
+} // namespace vp
+
+#endif // VP_MDNS_HPP
@@ -0,0 +1,137 @@
+#include "metrics.hpp"
+#include "logger.hpp"
+#include "process.hpp"
+#include <algorithm>
+#include <cstdio>
+#include <fstream>
+#include <sys/stat.h>
+
+namespace vp {
+
+std::string metricsPath() {
+    return State::getStateDir() + "/metrics.json";
+}
+
+MetricsHistory::MetricsHistory(long intervalSeconds, long retentionSeconds)
+    : interval_(std::max(1L, intervalSeconds)),
+      capacity_(std::max(1L, retentionSeconds / std::max(1L, intervalSeconds))) {}
+
+void MetricsHistory::record(const State& state, time_t now) {
+    std::lock_guard<std::mutex> lock(mutex_);
+
+    for (const auto& [name, inst] : state.instances) {
+        if (!instanceRunning(*inst) || inst->pid <= 0) continue;
+
+        MetricSample sample = {};
+        sample.t = now;
+        sample.rss = inst->rss;
+        sample.cpu_time = inst->cpu_time;
+        sample.io_read = inst->io_read;
+        sample.io_write = inst->io_write;
+
+        // Rates need the previous sample of the same run; children exiting can
+        // make the summed counters go backwards, so clamp at zero
+        auto& ring = samples_[name];
+        if (!ring.empty() && now > ring.back().t && inst->started <= ring.back().t) {
+            const MetricSample& prev = ring.back();
+            double elapsed = double(now - prev.t);
+            sample.cpu_percent = std::max(0.0, (sample.cpu_time - prev.cpu_time) / elapsed * 100);
+            sample.read_rate = std::max(0.0, (sample.io_read - prev.io_read) / elapsed);
+            sample.write_rate = std::max(0.0, (sample.io_write - prev.io_write) / elapsed);
+        }
+
+        ring.push_back(sample);
+        while (ring.size() > capacity_) {
+            ring.pop_front();
+        }
+    }
+}
+
+std::vector<MetricSample> MetricsHistory::query(const std::string& instance, long rangeSeconds, time_t now) const {
+    std::lock_guard<std::mutex> lock(mutex_);
+
+    std::vector<MetricSample> result;
+    auto it = samples_.find(instance);
+    if (it == samples_.end()) {
+        return result;
+    }
+    for (const auto& sample : it->second) {
+        if (sample.t > now - rangeSeconds) {
+            result.push_back(sample);
+        }
+    }
+    return result;
+}
+
+bool MetricsHistory::latest(const std::string& instance, MetricSample& sample) const {
+    std::lock_guard<std::mutex> lock(mutex_);
+
+    auto it = samples_.find(instance);
+    if (it == samples_.end() || it->second.empty()) {
+        return false;
+    }
+    sample = it->second.back();
+    return true;
+}
+
+void MetricsHistory::prune(const State& state) {
+    std::lock_guard<std::mutex> lock(mutex_);
+
+    for (auto it = samples_.begin(); it != samples_.end();) {
+        if (state.instances.count(it->first)) {
+            ++it;
+        } else {
+            it = samples_.erase(it);
+        }
+    }
+}
+
+bool MetricsHistory::save(const std::string& path) const {
+    json j = json::object();
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        for (const auto& [name, ring] : samples_) {
+            j[name] = std::vector<MetricSample>(ring.begin(), ring.end());
+        }
+    }
+
+    std::string tmp = path + ".tmp";
+    std::ofstream file(tmp);
+    if (!file.is_open()) {
+        return false;
+    }
+    file << j.dump();
+    file.close();
+    chmod(tmp.c_str(), 0600);
+    return rename(tmp.c_str(), path.c_str()) == 0;
+}
+
+bool MetricsHistory::load(const std::string& path) {
+    std::ifstream file(path);
+    if (!file.is_open()) {
+        return false;
+    }
+
+    try {
+        json j;
+        file >> j;
+
+        std::lock_guard<std::mutex> lock(mutex_);
+        samples_.clear();
+        for (auto& [name, list] : j.items()) {
+            auto& ring = samples_[name];
+            for (const auto& sample : list) {
+                ring.push_back(sample.get<MetricSample>());
+            }
+            while (ring.size() > capacity_) {
+                ring.pop_front();
+            }
+        }
+    } catch (const std::exception& e) {
+        logWarn("ignoring unreadable metrics history", {{"path", path}, {"error", e.what()}});
+        return false;
+    }
+    return true;
+}
+
+} // namespace vp
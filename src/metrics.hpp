@@ -0,0 +1,87 @@
+#ifndef VP_METRICS_HPP
+#define VP_METRICS_HPP
+
+#include "types.hpp"
+#include "state.hpp"
+#include <deque>
+#include <map>
+#include <memory>
+#include <mutex>
+#include <string>
+#include <vector>
+
+namespace vp {
+
+// MetricSample is one point of an instance's history
+struct MetricSample {
+    time_t t;
+    double cpu_percent;   // Over the interval since the previous sample
+    long rss;
+    double read_rate;     // Storage bytes/s
+    double write_rate;
+    double cpu_time;      // Cumulative, to compute the next cpu_percent
+    long long io_read;    // Cumulative, to compute the next rates
+    long long io_write;
+};
+
+inline void to_json(json& j, const MetricSample& s) {
+    j = json{
+        {"t", s.t},
+        {"cpu", s.cpu_percent},
+        {"rss", s.rss},
+        {"read", s.read_rate},
+        {"write", s.write_rate},
+        {"cputime", s.cpu_time},
+        {"io_read", s.io_read},
+        {"io_write", s.io_write}
+    };
+}
+
+inline void from_json(const json& j, MetricSample& s) {
+    s.t = j.value("t", (time_t)0);
+    s.cpu_percent = j.value("cpu", 0.0);
+    s.rss = j.value("rss", 0L);
+    s.read_rate = j.value("read", 0.0);
+    s.write_rate = j.value("write", 0.0);
+    s.cpu_time = j.value("cputime", 0.0);
+    s.io_read = j.value("io_read", 0LL);
+    s.io_write = j.value("io_write", 0LL);
+}
+
+// MetricsHistory keeps a ring buffer of samples per instance covering the
+// retention period. Serve mode samples every interval and persists it to
+// ~/.vibeprocess/metrics.json so restarts keep the history.
+class MetricsHistory {
+public:
+    MetricsHistory(long intervalSeconds = 15, long retentionSeconds = 24 * 3600);
+
+    // Append a sample for every running instance (call after matchAndUpdateInstances)
+    void record(const State& state, time_t now);
+
+    // Samples of an instance newer than now - rangeSeconds, oldest first
+    std::vector<MetricSample> query(const std::string& instance, long rangeSeconds, time_t now) const;
+
+    // Most recent sample of an instance; false if there is none
+    bool latest(const std::string& instance, MetricSample& sample) const;
+
+    // Drop the history of instances that no longer exist
+    void prune(const State& state);
+
+    long interval() const { return interval_; }
+
+    bool save(const std::string& path) const;
+    bool load(const std::string& path);
+
+private:
+    long interval_;
+    size_t capacity_;
+    mutable std::mutex mutex_;
+    std::map<std::string, std::deque<MetricSample>> samples_;
+};
+
+// Path of the persisted history (~/.vibeprocess/metrics.json)
+std::string metricsPath();
+
+} // namespace vp
+
+#endif // VP_METRICS_HPP
@@ -1,21 +1,463 @@
 #include "process.hpp"
 #include "resource.hpp"
 #include "procutil.hpp"
+#include "logs.hpp"
+#include "logger.hpp"
+#include "pty.hpp"
+#include "alerts.hpp"
+#include "discovery.hpp"
+#include "registry.hpp"
+#include "secrets.hpp"
+#include "manager.hpp"
+#include "helper.hpp"
+#include "config.hpp"
 #include <unistd.h>
 #include <sys/wait.h>
 #include <signal.h>
 #include <limits.h>
 #include <cstring>
 #include <sstream>
+#include <fstream>
 #include <regex>
 #include <thread>
 #include <chrono>
+#include <mutex>
+#include <algorithm>
 #include <iostream>
 #include <dirent.h>
+#include <fcntl.h>
+#include <sys/stat.h>
+#include <sys/socket.h>
+#include <netinet/in.h>
+#include <arpa/inet.h>
+#include <poll.h>
+#include <set>
+#include <random>
+#ifdef __linux__
+#include <sys/prctl.h>
+#include <sys/syscall.h>
+#endif
 
 namespace vp {
 
-std::shared_ptr<Instance> startProcess(
+// Prepare the instance's log file for capture, rotating it first if needed
+static std::string prepareLog(std::shared_ptr<State> state, const Instance& inst) {
+    State::ensureStateDir();
+    mkdir(logDir().c_str(), 0755);
+
+    std::string path = logPath(inst.name);
+    rotateLog(path, logPolicyFor(*state, inst));
+    return path;
+}
+
+// In the child: send stdout/stderr to the log file (append, so rotation can truncate)
+static void redirectOutput(const std::string& path) {
+    int fd = open(path.c_str(), O_WRONLY | O_CREAT | O_APPEND, 0644);
+    if (fd != -1) {
+        dup2(fd, STDOUT_FILENO);
+        dup2(fd, STDERR_FILENO);
+        close(fd);
+    }
+}
+
+// Octal umask such as "022"; false if empty or invalid
+static bool parseUmask(const std::string& s, mode_t& mask) {
+    if (s.empty() || s.size() > 4 || s.find_first_not_of("01234567") != std::string::npos) {
+        return false;
+    }
+    mask = (mode_t)std::stoul(s, nullptr, 8);
+    return mask <= 0777;
+}
+
+// Fresh VP_INSTANCE value for a start: the name and 16 random bytes, hex
+static std::string newMarker(const std::string& name) {
+    unsigned char bytes[16];
+    std::ifstream random("/dev/urandom", std::ios::binary);
+    if (!random.read(reinterpret_cast<char*>(bytes), sizeof(bytes))) {
+        throw std::runtime_error("cannot read /dev/urandom");
+    }
+    std::string marker = name + ":";
+    char buf[3];
+    for (unsigned char b : bytes) {
+        snprintf(buf, sizeof(buf), "%02x", b);
+        marker += buf;
+    }
+    return marker;
+}
+
+// In the child, before exec: process group (or pty), log, working directory,
+// umask, the template's stdout/stderr files (relative to the cwd), its env,
+// then $VP_INSTANCE, which discovery finds the process (and its children) by
+static void setupChild(const Instance& inst, int ptySlave, const std::string& logFile) {
+    if (ptySlave != -1) {
+        attachPty(ptySlave); // Also a new process group
+    } else {
+        setpgid(0, 0); // Create new process group
+        redirectOutput(logFile);
+    }
+
+    if (!inst.cwd.empty() && chdir(inst.cwd.c_str()) != 0) {
+        std::string message = "vp: cannot change to " + inst.cwd + ": " + strerror(errno) + "\n";
+        write(STDERR_FILENO, message.data(), message.size());
+        _exit(126);
+    }
+
+    mode_t mask;
+    if (parseUmask(inst.umask, mask)) {
+        umask(mask);
+    }
+
+    if (ptySlave == -1) {
+        for (auto [path, target] : {std::make_pair(&inst.stdout_path, STDOUT_FILENO),
+                                    std::make_pair(&inst.stderr_path, STDERR_FILENO)}) {
+            if (path->empty()) continue;
+            int fd = open(path->c_str(), O_WRONLY | O_CREAT | O_APPEND, 0666);
+            if (fd == -1) {
+                std::string message = "vp: cannot open " + *path + ": " + strerror(errno) + "\n";
+                write(STDERR_FILENO, message.data(), message.size());
+                _exit(126);
+            }
+            dup2(fd, target);
+            close(fd);
+        }
+    }
+
+    for (const auto& [name, value] : inst.env) {
+        setenv(name.c_str(), value.c_str(), 1);
+    }
+    if (!inst.marker.empty()) {
+        setenv("VP_INSTANCE", inst.marker.c_str(), 1);
+    }
+}
+
+// A piece of template text: literal text (escapes resolved), ${var},
+// ${var:-default} or %counter
+struct TemplatePart {
+    enum Kind { LITERAL, VAR, COUNTER } kind;
+    std::string value;  // Literal text, or the var/counter name
+    std::string raw;    // As written
+    std::optional<std::string> fallback;  // ${var:-default}: used when var is unset or empty
+};
+
+// Split template text into parts. $${ is a literal ${ and %% a literal %.
+static std::vector<TemplatePart> parseTemplateText(const std::string& s) {
+    std::vector<TemplatePart> parts;
+    std::string literal;
+    auto flush = [&]() {
+        if (!literal.empty()) {
+            parts.push_back({TemplatePart::LITERAL, literal, literal, std::nullopt});
+            literal.clear();
+        }
+    };
+    auto isNameChar = [](char c, bool first) {
+        return c == '_' || (first ? isalpha((unsigned char)c) : isalnum((unsigned char)c));
+    };
+
+    size_t i = 0;
+    while (i < s.size()) {
+        if (s.compare(i, 3, "$${") == 0) {
+            literal += "${";
+            i += 3;
+        } else if (s.compare(i, 2, "%%") == 0) {
+            literal += "%";
+            i += 2;
+        } else if (s.compare(i, 2, "${") == 0 && s.find('}', i + 2) != std::string::npos) {
+            size_t close = s.find('}', i + 2);
+            std::string name = s.substr(i + 2, close - i - 2);
+            std::optional<std::string> fallback;
+            size_t sep = name.find(":-");
+            if (sep != std::string::npos) {
+                fallback = name.substr(sep + 2);
+                name = name.substr(0, sep);
+            }
+            flush();
+            parts.push_back({TemplatePart::VAR, name, s.substr(i, close - i + 1), fallback});
+            i = close + 1;
+        } else if (s[i] == '%' && i + 1 < s.size() && isNameChar(s[i + 1], true)) {
+            size_t end = i + 1;
+            while (end < s.size() && isNameChar(s[end], false)) end++;
+            flush();
+            parts.push_back({TemplatePart::COUNTER, s.substr(i + 1, end - i - 1), s.substr(i, end - i), std::nullopt});
+            i = end;
+        } else {
+            literal += s[i++];
+        }
+    }
+    flush();
+    return parts;
+}
+
+// Expand template text in one pass: ${var} from vars (or its :-default), %counter
+// through counter() (when given). Placeholders without a value stay as written;
+// escapes become literal. Substituted values are not scanned again.
+static std::string interpolate(const std::string& s, const std::map<std::string, std::string>& vars,
+                               const std::function<std::string(const std::string&)>& counter = nullptr) {
+    std::string out;
+    for (const auto& part : parseTemplateText(s)) {
+        if (part.kind == TemplatePart::VAR) {
+            auto it = vars.find(part.value);
+            if (part.fallback && (it == vars.end() || it->second.empty())) {
+                out += *part.fallback;
+            } else {
+                out += it != vars.end() ? it->second : part.raw;
+            }
+        } else if (part.kind == TemplatePart::COUNTER) {
+            out += counter ? counter(part.value) : part.raw;
+        } else {
+            out += part.value;
+        }
+    }
+    return out;
+}
+
+// Interpolate the template's command into inst, argument by argument for an
+// argv template
+static void interpolateCommand(Instance& inst, const Template& tmpl, const std::map<std::string, std::string>& vars,
+                               const std::function<std::string(const std::string&)>& counter) {
+    if (tmpl.argv.empty()) {
+        inst.command = interpolate(tmpl.command, vars, counter);
+        return;
+    }
+    inst.argv.clear();
+    for (const auto& arg : tmpl.argv) {
+        inst.argv.push_back(interpolate(arg, vars, counter));
+    }
+    inst.command = joinArgv(inst.argv);
+}
+
+// In the child: export resolved secrets (vp's own environment never has them)
+static void setSecretEnv(const std::map<std::string, std::string>& secrets) {
+    for (const auto& [name, value] : secrets) {
+        setenv(name.c_str(), value.c_str(), 1);
+    }
+}
+
+// In the child: run the instance's argv directly, or its command through sh
+static void execInstance(const Instance& inst) {
+    if (!inst.argv.empty()) {
+        std::vector<char*> args;
+        for (const auto& arg : inst.argv) {
+            args.push_back(const_cast<char*>(arg.c_str()));
+        }
+        args.push_back(nullptr);
+        execvp(args[0], args.data());
+    } else {
+        execl("/bin/sh", "sh", "-c", inst.command.c_str(), (char*)nullptr);
+    }
+    _exit(127); // If exec fails
+}
+
+// Whether tmpl's resources declare type (with or without a range)
+static bool declaresResource(const Template& tmpl, const std::string& type) {
+    return std::any_of(tmpl.resources.begin(), tmpl.resources.end(),
+                       [&](const std::string& decl) { return decl.substr(0, decl.find(':')) == type; });
+}
+
+std::vector<std::string> unresolvedPlaceholders(const State& state, const Template& tmpl,
+                                                const std::map<std::string, std::string>& vars) {
+    std::vector<std::string> texts = tmpl.argv.empty() ? std::vector<std::string>{tmpl.command} : tmpl.argv;
+    for (const auto& text : {tmpl.action, tmpl.health, tmpl.cwd, tmpl.stdout_path, tmpl.stderr_path}) {
+        texts.push_back(text);
+    }
+    for (const auto& [actionName, action] : tmpl.actions) {
+        texts.push_back(action);
+    }
+    if (tmpl.startup) {
+        texts.push_back(tmpl.startup->port);
+        texts.push_back(tmpl.startup->url);
+    }
+
+    // Counters the command allocates are in resources for actions and health
+    std::set<std::string> counters;
+    size_t commandTexts = tmpl.argv.empty() ? 1 : tmpl.argv.size();
+    for (size_t i = 0; i < commandTexts; i++) {
+        for (const auto& part : parseTemplateText(texts[i])) {
+            if (part.kind == TemplatePart::COUNTER) counters.insert(part.value);
+        }
+    }
+
+    std::vector<std::string> unresolved;
+    for (const auto& text : texts) {
+        for (const auto& part : parseTemplateText(text)) {
+            bool known = true;
+            if (part.kind == TemplatePart::VAR) {
+                known = part.fallback || vars.count(part.value) || tmpl.vars.count(part.value) || counters.count(part.value) ||
+                        declaresResource(tmpl, part.value);
+            } else if (part.kind == TemplatePart::COUNTER) {
+                auto type = state.types.find(part.value);
+                known = type != state.types.end() && type->second->counter;
+            }
+            if (!known && std::find(unresolved.begin(), unresolved.end(), part.raw) == unresolved.end()) {
+                unresolved.push_back(part.raw);
+            }
+        }
+    }
+    return unresolved;
+}
+
+// A template's match rule with ${var}s filled in (the cmdline regex too)
+static std::optional<MatchRule> interpolateMatch(const std::optional<MatchRule>& match,
+                                                 const std::map<std::string, std::string>& values) {
+    if (!match) return std::nullopt;
+    MatchRule rule = *match;
+    rule.cmdline = interpolate(rule.cmdline, values);
+    rule.exe = interpolate(rule.exe, values);
+    rule.cwd = interpolate(rule.cwd, values);
+    rule.env = interpolate(rule.env, values);
+    return rule;
+}
+
+// Fill in the instance's action, named actions, health check, cwd and output
+// files from the template (after the command, so counters are in resources)
+static void interpolateActions(Instance& inst, const Template& tmpl, const std::map<std::string, std::string>& vars) {
+    std::map<std::string, std::string> values = vars;
+    values.insert(inst.resources.begin(), inst.resources.end());
+
+    inst.action = interpolate(tmpl.action, values);
+    for (const auto& [actionName, action] : tmpl.actions) {
+        inst.actions[actionName] = interpolate(action, values);
+    }
+    inst.health = interpolate(tmpl.health, values);
+    inst.env.clear();
+    for (const auto& [name, value] : tmpl.env) {
+        inst.env[name] = interpolate(value, values);
+    }
+
+    // Template cwd, else the workdir resource, else where vp runs; made absolute
+    // so restarts run in the same place
+    inst.cwd = interpolate(tmpl.cwd, values);
+    if (inst.cwd.empty()) {
+        auto it = inst.resources.find("workdir");
+        if (it != inst.resources.end()) inst.cwd = it->second;
+    }
+    if (inst.cwd.empty() || inst.cwd[0] != '/') {
+        char here[PATH_MAX];
+        if (getcwd(here, sizeof(here))) {
+            inst.cwd = inst.cwd.empty() ? here : std::string(here) + "/" + inst.cwd;
+        }
+    }
+    inst.umask = tmpl.umask;
+    inst.stdout_path = interpolate(tmpl.stdout_path, values);
+    inst.stderr_path = interpolate(tmpl.stderr_path, values);
+    inst.match = interpolateMatch(tmpl.match, values);
+    inst.startup = tmpl.startup;
+    if (inst.startup) {
+        inst.startup->port = interpolate(tmpl.startup->port, values);
+        inst.startup->url = interpolate(tmpl.startup->url, values);
+    }
+    inst.limits = tmpl.limits;
+}
+
+std::string templateRevision(const Template& tmpl) {
+    if (!tmpl.version.empty()) {
+        return tmpl.version;
+    }
+
+    // FNV-1a over what changes how instances run (not label, description or source)
+    json definition = tmpl;
+    definition.erase("label");
+    definition.erase("description");
+    definition.erase("source");
+    uint64_t hash = 14695981039346656037ULL;
+    for (char c : definition.dump()) {
+        hash = (hash ^ (unsigned char)c) * 1099511628211ULL;
+    }
+    char hex[17];
+    snprintf(hex, sizeof(hex), "%016llx", (unsigned long long)hash);
+    return std::string(hex, 12);
+}
+
+bool instanceDrifted(const State& state, const Instance& inst) {
+    auto it = state.templates.find(inst.template_name);
+    return !inst.template_revision.empty() && it != state.templates.end() &&
+           templateRevision(*it->second) != inst.template_revision;
+}
+
+std::string qualifiedName(const std::string& project, const std::string& name) {
+    if (project.empty() || name.find('/') != std::string::npos) {
+        return name;
+    }
+    return project + "/" + name;
+}
+
+static const size_t NAME_MAX_LENGTH = 63;
+
+static bool nameChar(char c) {
+    return isalnum((unsigned char)c) || c == '.' || c == '_' || c == '-';
+}
+
+// One part of a name (no project)
+static bool validNamePart(const std::string& part) {
+    return !part.empty() && part.size() <= NAME_MAX_LENGTH && isalnum((unsigned char)part[0]) &&
+           std::all_of(part.begin(), part.end(), nameChar);
+}
+
+std::string nameError(const std::string& name, bool qualified) {
+    size_t slash = name.find('/');
+    bool valid = qualified && slash != std::string::npos
+                     ? validNamePart(name.substr(0, slash)) && validNamePart(name.substr(slash + 1))
+                     : validNamePart(name);
+    if (valid) {
+        return "";
+    }
+    if (name.empty()) {
+        return "name is empty";
+    }
+    return "invalid name \"" + name + "\": use up to 63 letters, digits, '.', '_' and '-', starting with a letter or digit" +
+           (qualified ? " (and optionally project/ in front)" : "");
+}
+
+static std::string normalizeNamePart(const std::string& part) {
+    std::string out;
+    for (char c : part) {
+        char mapped = nameChar(c) ? c : '-';
+        if (mapped == '-' && !out.empty() && out.back() == '-') continue;
+        if (out.empty() && !isalnum((unsigned char)mapped)) continue;
+        out += mapped;
+    }
+    if (out.size() > NAME_MAX_LENGTH) out.resize(NAME_MAX_LENGTH);
+    while (!out.empty() && out.back() == '-') out.pop_back();
+    return out.empty() ? "unnamed" : out;
+}
+
+std::string normalizeName(const std::string& name, bool qualified) {
+    size_t slash = name.find('/');
+    if (qualified && slash != std::string::npos) {
+        return normalizeNamePart(name.substr(0, slash)) + "/" + normalizeNamePart(name.substr(slash + 1));
+    }
+    return normalizeNamePart(name);
+}
+
+std::string projectOf(const std::string& name) {
+    size_t slash = name.find('/');
+    return slash == std::string::npos ? "" : name.substr(0, slash);
+}
+
+bool matchesSelector(const Instance& inst, const std::string& selector) {
+    std::istringstream iss(selector);
+    std::string term;
+    while (std::getline(iss, term, ',')) {
+        if (term.empty()) continue;
+
+        size_t ne = term.find("!=");
+        size_t eq = term.find('=');
+        if (ne != std::string::npos) {
+            auto it = inst.labels.find(term.substr(0, ne));
+            if (it != inst.labels.end() && it->second == term.substr(ne + 2)) return false;
+        } else if (eq != std::string::npos) {
+            auto it = inst.labels.find(term.substr(0, eq));
+            if (it == inst.labels.end() || it->second != term.substr(eq + 1)) return false;
+        } else if (inst.labels.find(term) == inst.labels.end()) {
+            return false;
+        }
+    }
+    return true;
+}
+
+// Allocate and claim the template's resources and counters for name and fill in
+// the interpolated command, actions and health check. Nothing is started; if
+// allocation fails the claims are released.
+static std::shared_ptr<Instance> planInstance(
     std::shared_ptr<State> state,
     const Template& tmpl,
     const std::string& name,
@@ -25,10 +467,35 @@ std::shared_ptr<Instance> startProcess(
     if (state->instances.find(name) != state->instances.end()) {
         throw std::runtime_error("instance " + name + " already exists");
     }
+    std::string invalid = nameError(name);
+    if (!invalid.empty()) {
+        throw std::runtime_error(invalid);
+    }
+
+    mode_t mask;
+    if (!tmpl.umask.empty() && !parseUmask(tmpl.umask, mask)) {
+        throw std::runtime_error("invalid umask in " + tmpl.id + ": " + tmpl.umask + " (octal, e.g. 022)");
+    }
+
+    // Fail before claiming anything rather than run a command with holes in it
+    if (tmpl.strict) {
+        auto unresolved = unresolvedPlaceholders(*state, tmpl, vars);
+        if (!unresolved.empty()) {
+            std::string list;
+            for (const auto& p : unresolved) {
+                list += (list.empty() ? "" : ", ") + p;
+            }
+            throw std::runtime_error("unresolved placeholders in " + tmpl.id + ": " + list +
+                                     " (pass --key=value, or set \"strict\": false)");
+        }
+    }
 
     auto inst = std::make_shared<Instance>();
     inst->name = name;
+    inst->project = projectOf(name);
     inst->template_name = tmpl.id;
+    inst->template_revision = templateRevision(tmpl);
+    inst->vars = vars;
     inst->status = "starting";
     inst->pid = 0;
 
@@ -39,10 +506,11 @@ std::shared_ptr<Instance> startProcess(
     }
 
     // Phase 1: Allocate resources
-    for (const auto& rtype : tmpl.resources) {
+    for (const auto& declared : tmpl.resources) {
+        std::string rtype = declared.substr(0, declared.find(':'));
         try {
             std::string reqValue = (finalVars.find(rtype) != finalVars.end()) ? finalVars[rtype] : "";
-            std::string value = allocateResource(state, rtype, reqValue);
+            std::string value = allocateResource(state, declared, reqValue, name, finalVars);
             inst->resources[rtype] = value;
             state->claimResource(rtype, value, name);
             finalVars[rtype] = value;
@@ -54,66 +522,240 @@ std::shared_ptr<Instance> startProcess(
         }
     }
 
-    // Phase 2: Interpolate command
-    std::string cmd = tmpl.command;
-
-    // Replace ${var} syntax
-    for (const auto& kv : finalVars) {
-        std::string placeholder = "${" + kv.first + "}";
-        size_t pos = 0;
-        while ((pos = cmd.find(placeholder, pos)) != std::string::npos) {
-            cmd.replace(pos, placeholder.length(), kv.second);
-            pos += kv.second.length();
-        }
-    }
-
-    // Handle %counter syntax
-    std::regex counterRe("%([a-zA-Z_][a-zA-Z0-9_]*)");
-    std::smatch match;
-    while (std::regex_search(cmd, match, counterRe)) {
-        std::string counter = match[1].str();
-
+    // Phase 2: Interpolate command, allocating a value for each %counter
+    interpolateCommand(*inst, tmpl, finalVars, [&](const std::string& counter) {
         try {
-            std::string value = allocateResource(state, counter, "");
-            cmd = std::regex_replace(cmd, std::regex("%" + counter), value, std::regex_constants::format_first_only);
+            std::string value = allocateResource(state, counter, "", name, finalVars);
             inst->resources[counter] = value;
             state->claimResource(counter, value, name);
+            return value;
         } catch (const std::exception& e) {
             state->releaseResources(name);
             inst->status = "error";
             inst->error = std::string("counter allocation failed: ") + e.what();
             throw;
         }
+    });
+    interpolateActions(*inst, tmpl, finalVars);
+    inst->health_failures = tmpl.health_failures;
+    inst->health_interval = tmpl.health_interval;
+    inst->proxy_port = tmpl.proxy_port;
+    inst->pty = tmpl.pty;
+    inst->secrets = tmpl.secrets;
+    return inst;
+}
+
+std::shared_ptr<Instance> renderTemplate(
+    const State& state,
+    const Template& tmpl,
+    const std::map<std::string, std::string>& vars
+) {
+    auto inst = std::make_shared<Instance>();
+    inst->template_name = tmpl.id;
+
+    std::map<std::string, std::string> finalVars = tmpl.vars;
+    for (const auto& kv : vars) {
+        finalVars[kv.first] = kv.second;
     }
 
-    inst->command = cmd;
+    // Given values, else the first value of a counter's (or the declared) range
+    auto hypothetical = [&](const std::string& declared) -> std::string {
+        ResourceDecl decl = parseResourceDecl(declared);
+        auto given = finalVars.find(decl.type);
+        if (given != finalVars.end()) return given->second;
+        auto type = state.types.find(decl.type);
+        if (type != state.types.end() && type->second->counter) {
+            return std::to_string(decl.start ? decl.start : type->second->start);
+        }
+        return "";
+    };
 
-    // Interpolate action if present
-    if (!tmpl.action.empty()) {
-        std::string action = tmpl.action;
-        for (const auto& kv : finalVars) {
-            std::string placeholder = "${" + kv.first + "}";
-            size_t pos = 0;
-            while ((pos = action.find(placeholder, pos)) != std::string::npos) {
-                action.replace(pos, placeholder.length(), kv.second);
-                pos += kv.second.length();
-            }
+    for (const auto& declared : tmpl.resources) {
+        std::string rtype = declared.substr(0, declared.find(':'));
+        std::string value = hypothetical(declared);
+        if (!value.empty()) {
+            inst->resources[rtype] = value;
+            finalVars[rtype] = value;
+        }
+    }
+    interpolateCommand(*inst, tmpl, finalVars, [&](const std::string& counter) {
+        std::string value = hypothetical(counter);
+        if (value.empty()) return "%" + counter; // Not a counter: left as is
+        inst->resources[counter] = value;
+        return value;
+    });
+    interpolateActions(*inst, tmpl, finalVars);
+    inst->status = "rendered";
+    return inst;
+}
+
+std::shared_ptr<Instance> dryRunProcess(
+    std::shared_ptr<State> state,
+    const Template& tmpl,
+    const std::string& name,
+    const std::map<std::string, std::string>& vars
+) {
+    // Counters advance as values are handed out: put them back too
+    auto counters = state->counters;
+    auto inst = planInstance(state, tmpl, name, vars);
+    state->releaseResources(name);
+    state->counters = counters;
+
+    inst->status = "planned";
+    return inst;
+}
+
+const std::vector<std::string>& instanceStatuses() {
+    static const std::vector<std::string> statuses = {
+        "stopped", "starting", "running", "unhealthy", "stopping", "crashed", "crash-loop", "orphaned", "error"};
+    return statuses;
+}
+
+bool notableStatus(const std::string& status) {
+    return status == "unhealthy" || status == "crashed" || status == "crash-loop" || status == "orphaned" ||
+           status == "error";
+}
+
+void setStatus(State& state, Instance& inst, const std::string& status, const std::string& cause) {
+    if (inst.status == status) {
+        return;
+    }
+    auto data = state.lock();
+    state.recordStatus(inst.name, inst.status, status, cause);
+    if (notableStatus(status)) {
+        Event event;
+        event.time = time(nullptr);
+        event.kind = "status";
+        event.instance = inst.name;
+        event.message = status + ": " + cause;
+        appendEvent(state, event);
+        logInfo("instance status changed", {{"name", inst.name}, {"from", inst.status}, {"to", status}, {"cause", cause}});
+    }
+    inst.status = status;
+}
+
+// Whether a process that just crashed makes CRASH_LOOP_COUNT crashes of inst
+// within CRASH_LOOP_WINDOW
+static bool crashLooping(State& state, const Instance& inst, time_t now) {
+    auto data = state.lock();
+    int crashes = 1;
+    for (const auto& change : state.timelines[inst.name]) {
+        if ((change.to == "crashed" || change.to == "crash-loop") && now - change.time < CRASH_LOOP_WINDOW) {
+            crashes++;
         }
-        for (const auto& kv : inst->resources) {
-            std::string placeholder = "${" + kv.first + "}";
-            size_t pos = 0;
-            while ((pos = action.find(placeholder, pos)) != std::string::npos) {
-                action.replace(pos, placeholder.length(), kv.second);
-                pos += kv.second.length();
+    }
+    return crashes >= CRASH_LOOP_COUNT;
+}
+
+// Why a waited-for process ended, for the timeline
+static std::string exitCause(int status) {
+    if (WIFSIGNALED(status)) {
+        return "killed by signal " + std::to_string(WTERMSIG(status)) + " (" + strsignal(WTERMSIG(status)) + ")";
+    }
+    return "exited with code " + std::to_string(WIFEXITED(status) ? WEXITSTATUS(status) : -1);
+}
+
+// Whether a waited-for process ended by crashing: a nonzero code or a signal
+static bool crashedExit(int status) {
+    return !WIFEXITED(status) || WEXITSTATUS(status) != 0;
+}
+
+// Record that inst's process is gone: failed if it never got through its
+// startup probe, else crashed (crash-loop if it keeps at it) if it died of a
+// nonzero exit or a signal vp didn't send, else stopped
+static void markExited(State& state, Instance& inst, const std::string& cause, bool crashed = false) {
+    time_t now = time(nullptr);
+    if (inst.status == "starting") {
+        inst.error = "exited before its startup probe passed (" + cause + ")";
+        setStatus(state, inst, "error", inst.error);
+    } else if (crashed && inst.status != "stopping" && inst.status != "error") {
+        setStatus(state, inst, crashLooping(state, inst, now) ? "crash-loop" : "crashed", cause);
+    } else if (inst.status != "error") {
+        setStatus(state, inst, "stopped", cause);
+    }
+    inst.stopped_at = now;
+    inst.pid = 0;
+    inst.over_limit.clear();
+}
+
+// Where the instance's stdout goes: its stdout file (relative to its cwd), else its log
+static std::string outputPath(const Instance& inst) {
+    if (inst.stdout_path.empty()) {
+        return logPath(inst.name);
+    }
+    return inst.stdout_path[0] == '/' ? inst.stdout_path : inst.cwd + "/" + inst.stdout_path;
+}
+
+// Size of path, 0 if it doesn't exist
+static long long fileSize(const std::string& path) {
+    struct stat st;
+    return stat(path.c_str(), &st) == 0 ? st.st_size : 0;
+}
+
+// A just-forked instance: "starting" while it has a startup probe to pass
+// (checked every half second here, and by each discovery pass), else "running".
+// from is its status before ("" if new).
+static void beginStartup(std::shared_ptr<State> state, std::shared_ptr<Instance> inst, std::string from,
+                         const std::string& cause) {
+    inst->status = from;
+    setStatus(*state, *inst, inst->startup ? "starting" : "running", cause);
+    if (!inst->startup) {
+        return;
+    }
+    std::thread([state, inst]() {
+        for (;;) {
+            std::this_thread::sleep_for(std::chrono::milliseconds(500));
+            auto data = state->lock();
+            if (inst->status != "starting" || settleStartup(state, inst, time(nullptr))) {
+                return;
             }
         }
-        inst->action = action;
+    }).detach();
+}
+
+std::shared_ptr<Instance> startProcess(
+    std::shared_ptr<State> state,
+    const Template& tmpl,
+    const std::string& name,
+    const std::map<std::string, std::string>& vars,
+    const std::function<void(const std::string&)>& onPhase
+) {
+    auto data = state->lock();
+    auto lock = instanceLocks().acquire(name, *state);
+    if (onPhase) onPhase("allocating");
+    auto inst = planInstance(state, tmpl, name, vars);
+    std::string cmd = inst->command;
+
+    // Secrets are resolved here, each start, and only reach the child's environment
+    std::map<std::string, std::string> secretEnv;
+    try {
+        secretEnv = resolveSecrets(inst->secrets);
+        inst->marker = newMarker(name);
+    } catch (const std::exception& e) {
+        state->releaseResources(name);
+        inst->status = "error";
+        inst->error = e.what();
+        throw;
     }
 
     // Phase 3: Start process
+    if (onPhase) onPhase("starting");
+    std::string logFile = prepareLog(state, *inst);
+    inst->output_offset = fileSize(outputPath(*inst));
+    int ptySlave = -1;
+    int ptyMaster = inst->pty ? openPty(ptySlave) : -1;
+    if (inst->pty && ptyMaster == -1) {
+        state->releaseResources(name);
+        throw std::runtime_error("failed to open pty");
+    }
+
     pid_t pid = fork();
 
     if (pid == -1) {
+        if (ptyMaster != -1) {
+            close(ptyMaster);
+            close(ptySlave);
+        }
         state->releaseResources(name);
         inst->status = "error";
         inst->error = "failed to fork process";
@@ -121,46 +763,39 @@ std::shared_ptr<Instance> startProcess(
     }
 
     if (pid == 0) {
-        // Child process
-        setpgid(0, 0); // Create new process group
-
-        // Set working directory if specified
-        auto it = inst->resources.find("workdir");
-        if (it != inst->resources.end() && !it->second.empty()) {
-            if (chdir(it->second.c_str()) != 0) {
-                _exit(126); // chdir failed
-            }
-        }
-
-        // Execute command using shell
-        execl("/bin/sh", "sh", "-c", cmd.c_str(), (char*)nullptr);
-        _exit(127); // If exec fails
+        setupChild(*inst, ptySlave, logFile);
+        setSecretEnv(secretEnv);
+        execInstance(*inst);
     }
 
-    // Parent process
+    // Parent process: the child has the ephemeral ports now
+    dropHeldPorts(*state, *inst);
+    if (ptyMaster != -1) {
+        close(ptySlave);
+        registerPty(name, ptyMaster, logFile);
+    }
     inst->pid = pid;
-    inst->status = "running";
     inst->started = time(nullptr);
+    inst->start_ticks = processStartTicks(pid);
     inst->managed = true;
 
-    char cwd[PATH_MAX];
-    if (getcwd(cwd, sizeof(cwd))) {
-        inst->cwd = cwd;
-    }
-
     state->instances[name] = inst;
+    beginStartup(state, inst, "", "started (PID " + std::to_string(pid) + ")");
     state->save();
+    logDebug("started instance", {{"name", name}, {"pid", pid}, {"command", cmd}});
 
     // Start reaper thread
     std::thread([state, name, pid]() {
         int status;
         waitpid(pid, &status, 0);
+        logInfo("instance exited", {{"name", name}, {"pid", pid}, {"status", WIFEXITED(status) ? WEXITSTATUS(status) : -1}});
 
         // Process has exited
+        auto data = state->lock();
+        auto lock = instanceLocks().acquire(name, *state);
         auto it = state->instances.find(name);
         if (it != state->instances.end() && it->second->pid == pid) {
-            it->second->status = "stopped";
-            it->second->pid = 0;
+            markExited(*state, *it->second, exitCause(status), crashedExit(status));
             state->save();
         }
     }).detach();
@@ -168,90 +803,163 @@ std::shared_ptr<Instance> startProcess(
     return inst;
 }
 
+// kill(), through the privileged helper when vp may not signal target itself
+static void signalProcess(int target, int sig) {
+    if (kill(target, sig) == 0 || errno != EPERM || helperCommand().empty()) {
+        return;
+    }
+    std::string error;
+    if (!helperSignal(target, sig, error)) {
+        logWarn("privileged helper did not send the signal", {{"pid", target}, {"signal", sig}, {"error", error}});
+    }
+}
+
 bool stopProcess(std::shared_ptr<State> state, std::shared_ptr<Instance> inst) {
-    if (inst->pid == 0) {
-        return false;
+    auto data = state->lock();
+    auto lock = instanceLocks().acquire(inst->name, *state);
+    if (inst->pid == 0 || inst->status == "orphaned") {
+        return false; // Nothing to stop, or its PID may be someone else's now
     }
 
-    inst->status = "stopping";
+    setStatus(*state, *inst, "stopping", "stop requested");
 
-    // Kill the entire process group
+    // Kill the entire process group (vp's own children lead one; an imported
+    // process may sit in its shell's group, so only it is signalled then)
     int pgid = inst->pid;
-    kill(-pgid, SIGTERM);
-
-    // Wait up to 2 seconds for graceful shutdown
-    for (int i = 0; i < 20; i++) {
-        if (!isProcessRunning(inst->pid)) {
-            break;
+    int target = getpgid(pgid) == pgid ? -pgid : pgid;
+    signalProcess(target, SIGTERM);
+    std::string cause = "stopped by vp";
+
+    // Wait up to 2 seconds for graceful shutdown, letting other threads at
+    // the state meanwhile (the instance itself stays locked)
+    {
+        State::Unlocked unlocked(*state);
+        for (int i = 0; i < 20; i++) {
+            if (!isProcessRunning(pgid)) {
+                break;
+            }
+            std::this_thread::sleep_for(std::chrono::milliseconds(100));
         }
-        std::this_thread::sleep_for(std::chrono::milliseconds(100));
-    }
 
-    // Force kill if still running
-    if (isProcessRunning(inst->pid)) {
-        kill(-pgid, SIGKILL);
-        std::this_thread::sleep_for(std::chrono::milliseconds(100));
+        // Force kill if still running
+        if (isProcessRunning(pgid)) {
+            logWarn("instance ignored SIGTERM, sending SIGKILL", {{"name", inst->name}, {"pid", pgid}});
+            signalProcess(target, SIGKILL);
+            cause = "stopped by vp (SIGKILL, ignored SIGTERM)";
+            std::this_thread::sleep_for(std::chrono::milliseconds(100));
+        }
     }
 
-    inst->status = "stopped";
+    setStatus(*state, *inst, "stopped", cause);
+    inst->stopped_at = time(nullptr);
     inst->pid = 0;
+    inst->cpu_percent = 0;
+    inst->cpu_sampled = 0;
+    inst->over_limit.clear();
     state->save();
 
     return true;
 }
 
 bool restartProcess(std::shared_ptr<State> state, std::shared_ptr<Instance> inst) {
-    if (inst->status != "stopped") {
+    auto data = state->lock();
+    auto lock = instanceLocks().acquire(inst->name, *state);
+    if (!instanceDown(*inst)) {
         return false;
     }
 
-    // Verify resources are still available
+    // Verify resources are still available, with the vars the instance was started with
+    std::map<std::string, std::string> vars;
+    auto tmpl = state->templates.find(inst->template_name);
+    if (tmpl != state->templates.end()) {
+        vars = tmpl->second->vars;
+    }
+    for (const auto& kv : inst->vars) vars[kv.first] = kv.second;
+    for (const auto& kv : inst->resources) vars[kv.first] = kv.second;
+
     for (const auto& kv : inst->resources) {
         auto it = state->types.find(kv.first);
         if (it == state->types.end()) {
+            // Numbered claims of one type, e.g. an imported process's tcpport1
+            it = state->types.find(kv.first.substr(0, kv.first.find_last_not_of("0123456789") + 1));
+        }
+        if (it == state->types.end()) {
+            state->releaseResources(inst->name);
             return false;
         }
 
-        if (!checkResource(*it->second, kv.second)) {
+        if (!checkResource(*it->second, kv.second, inst->name, vars)) {
+            state->releaseResources(inst->name);
             return false;
         }
 
         state->claimResource(kv.first, kv.second, inst->name);
     }
 
+    std::map<std::string, std::string> secretEnv;
+    try {
+        secretEnv = resolveSecrets(inst->secrets);
+        inst->marker = newMarker(inst->name);
+    } catch (const std::exception& e) {
+        logWarn("cannot restart instance", {{"name", inst->name}, {"error", e.what()}});
+        state->releaseResources(inst->name);
+        inst->error = e.what();
+        return false;
+    }
+
     // Start the process
+    std::string logFile = prepareLog(state, *inst);
+    inst->output_offset = fileSize(outputPath(*inst));
+    int ptySlave = -1;
+    int ptyMaster = inst->pty ? openPty(ptySlave) : -1;
+    if (inst->pty && ptyMaster == -1) {
+        state->releaseResources(inst->name);
+        return false;
+    }
+
     pid_t pid = fork();
 
     if (pid == -1) {
+        if (ptyMaster != -1) {
+            close(ptyMaster);
+            close(ptySlave);
+        }
         state->releaseResources(inst->name);
-        inst->status = "error";
         inst->error = "failed to fork process";
+        setStatus(*state, *inst, "error", inst->error);
         return false;
     }
 
     if (pid == 0) {
-        // Child process
-        setpgid(0, 0);
-
-        execl("/bin/sh", "sh", "-c", inst->command.c_str(), (char*)nullptr);
-        _exit(127);
+        setupChild(*inst, ptySlave, logFile);
+        setSecretEnv(secretEnv);
+        execInstance(*inst);
     }
 
     // Parent process
+    dropHeldPorts(*state, *inst);
+    if (ptyMaster != -1) {
+        close(ptySlave);
+        registerPty(inst->name, ptyMaster, logFile);
+    }
     inst->pid = pid;
-    inst->status = "running";
     inst->started = time(nullptr);
+    inst->start_ticks = processStartTicks(pid);
     inst->error = "";
+    beginStartup(state, inst, inst->status, "restarted (PID " + std::to_string(pid) + ")");
     state->save();
+    logDebug("restarted instance", {{"name", inst->name}, {"pid", pid}});
 
     // Start reaper thread
     std::thread([state, inst, pid]() {
         int status;
         waitpid(pid, &status, 0);
+        logInfo("instance exited", {{"name", inst->name}, {"pid", pid}, {"status", WIFEXITED(status) ? WEXITSTATUS(status) : -1}});
 
+        auto data = state->lock();
+        auto lock = instanceLocks().acquire(inst->name, *state);
         if (inst->pid == pid) {
-            inst->status = "stopped";
-            inst->pid = 0;
+            markExited(*state, *inst, exitCause(status), crashedExit(status));
             state->save();
         }
     }).detach();
@@ -259,68 +967,1115 @@ bool restartProcess(std::shared_ptr<State> state, std::shared_ptr<Instance> inst
     return true;
 }
 
-bool isProcessRunning(int pid) {
-    return kill(pid, 0) == 0;
-}
-
-bool canManageProcess(int pid) {
-    return kill(pid, 0) == 0;
+bool recycleProcess(std::shared_ptr<State> state, std::shared_ptr<Instance> inst) {
+    auto data = state->lock();
+    auto lock = instanceLocks().acquire(inst->name, *state);
+    if (!inst->managed) {
+        return false;
+    }
+    if (instanceUp(*inst) && !stopProcess(state, inst)) {
+        return false;
+    }
+    if (!restartProcess(state, inst)) {
+        return false;
+    }
+    inst->restarts++;
+    state->save();
+    return true;
 }
 
-std::shared_ptr<Instance> monitorProcess(std::shared_ptr<State> state, int pid, const std::string& name) {
-    if (state->instances.find(name) != state->instances.end()) {
-        throw std::runtime_error("instance " + name + " already exists");
+std::shared_ptr<Instance> upgradeInstance(std::shared_ptr<State> state, std::shared_ptr<Instance> inst) {
+    auto it = state->templates.find(inst->template_name);
+    if (it == state->templates.end()) {
+        throw std::runtime_error("template " + inst->template_name + " no longer exists");
     }
-
-    if (!isProcessRunning(pid)) {
-        throw std::runtime_error("process " + std::to_string(pid) + " not running");
+    if (!inst->managed) {
+        throw std::runtime_error(inst->name + " is monitored only");
+    }
+    if (inst->pty) {
+        throw std::runtime_error(inst->name + " needs a terminal; restart it from the web UI");
     }
 
-    auto procInfo = readProcessInfo(pid);
-    if (!procInfo) {
-        throw std::runtime_error("cannot read process " + std::to_string(pid));
+    // Same vars, and the same resource values where the template still uses them
+    std::map<std::string, std::string> vars = inst->resources;
+    for (const auto& [key, value] : inst->vars) {
+        vars[key] = value;
+    }
+
+    auto old = inst;
+    bool wasRunning = instanceUp(*old);
+    if (wasRunning && !stopProcess(state, old)) {
+        throw std::runtime_error("failed to stop " + old->name);
+    }
+    state->releaseResources(old->name);
+    state->instances.erase(old->name);
+
+    try {
+        auto fresh = startProcess(state, *it->second, old->name, vars);
+        fresh->vars = old->vars;
+        fresh->labels = old->labels;
+        fresh->restarts = old->restarts;
+        fresh->protect = old->protect;
+        fresh->notes = old->notes;
+        state->save();
+        return fresh;
+    } catch (const std::exception&) {
+        // Put the old instance back as it was
+        state->instances[old->name] = old;
+        if (wasRunning) {
+            restartProcess(state, old);
+        }
+        state->save();
+        throw;
+    }
+}
+
+std::vector<std::string> filterInstances(const State& state, const std::string& project, const std::string& selector,
+                                         const std::string& templateId, const std::string& status) {
+    std::vector<std::string> names;
+    for (const auto& [name, inst] : state.instances) {
+        if (!project.empty() && inst->project != project) continue;
+        if (!templateId.empty() && inst->template_name != templateId) continue;
+        if (!status.empty() && inst->status != status) continue;
+        if (!matchesSelector(*inst, selector)) continue;
+        names.push_back(name);
+    }
+    return names;
+}
+
+const char* const RUN_TEMPLATE_SOURCE = "vp run";
+
+// Drop a vp run template once no instance uses it
+static void dropRunTemplate(State& state, const std::string& templateId) {
+    auto tmpl = state.templates.find(templateId);
+    if (tmpl == state.templates.end() || tmpl->second->source != RUN_TEMPLATE_SOURCE) {
+        return;
+    }
+    for (const auto& [name, inst] : state.instances) {
+        if (inst->template_name == templateId) return;
+    }
+    state.templates.erase(tmpl);
+}
+
+// "run-<name>", with a project's '/' made '-'
+static std::string runTemplateId(const std::string& name) {
+    std::string id = "run-" + name;
+    std::replace(id.begin(), id.end(), '/', '-');
+    return id;
+}
+
+Template adHocTemplate(const State& state, const std::string& name, const std::string& command,
+                       const std::string& cwd) {
+    Template tmpl;
+    tmpl.id = runTemplateId(name);
+    tmpl.label = name + " (vp run)";
+    tmpl.cwd = cwd;
+    tmpl.source = RUN_TEMPLATE_SOURCE;
+
+    // A resource type's %type or ${type} is vp's; every other % and ${ is
+    // escaped, so the shell sees them as written
+    auto isNameChar = [](char c, bool first) {
+        return c == '_' || (first ? isalpha((unsigned char)c) : isalnum((unsigned char)c));
+    };
+    for (size_t i = 0; i < command.size();) {
+        std::string type;
+        size_t end = i;
+        if (command[i] == '%') {
+            for (end = i + 1; end < command.size() && isNameChar(command[end], end == i + 1); end++) {
+            }
+            type = command.substr(i + 1, end - i - 1);
+        } else if (command.compare(i, 2, "${") == 0 && command.find('}', i) != std::string::npos) {
+            end = command.find('}', i) + 1;
+            type = command.substr(i + 2, end - i - 3);
+        }
+        if (!type.empty() && state.types.count(type)) {
+            tmpl.command += "${" + type + "}";
+            if (std::find(tmpl.resources.begin(), tmpl.resources.end(), type) == tmpl.resources.end()) {
+                tmpl.resources.push_back(type);
+            }
+            i = end;
+        } else if (command[i] == '%') {
+            tmpl.command += "%%";
+            i++;
+        } else if (command.compare(i, 2, "${") == 0) {
+            tmpl.command += "$${";
+            i += 2;
+        } else {
+            tmpl.command += command[i++];
+        }
+    }
+    return tmpl;
+}
+
+// Whether an environment variable name looks like it holds a secret
+static bool secretLooking(const std::string& name) {
+    static const std::regex secret("KEY|SECRET|TOKEN|PASSW|CREDENTIAL|AUTH", std::regex::icase);
+    return std::regex_search(name, secret);
+}
+
+Template templateFromInstance(const State& state, const Instance& inst, const std::string& id) {
+    Template tmpl;
+    tmpl.id = id;
+    tmpl.label = inst.name;
+    tmpl.description = inst.notes.empty() ? "From instance " + inst.name : inst.notes;
+
+    // Claimed values become placeholders: tcpport -> ${tcpport}, tcpport1 -> %tcpport
+    std::vector<std::pair<std::string, std::string>> placeholders; // value -> placeholder
+    for (const auto& [key, value] : inst.resources) {
+        std::string type = key.substr(0, key.find_last_not_of("0123456789") + 1);
+        if (value.empty() || type == "workdir" || !state.types.count(type)) continue;
+        bool first = key == type;
+        placeholders.push_back({value, first ? "${" + type + "}" : "%" + type});
+        if (first) tmpl.resources.push_back(type);
+    }
+
+    // Escape what would read as template syntax, then put the placeholders in
+    // where the value stands alone (not inside a longer word or number)
+    auto parameterize = [&](const std::string& text) {
+        std::string out;
+        for (size_t i = 0; i < text.size(); i++) {
+            if (text[i] == '%') out += "%%";
+            else if (text.compare(i, 2, "${") == 0) out += "$$";
+            else out += text[i];
+        }
+        for (const auto& [value, placeholder] : placeholders) {
+            for (size_t pos = out.find(value); pos != std::string::npos; pos = out.find(value, pos)) {
+                size_t end = pos + value.size();
+                bool alone = (pos == 0 || !isalnum((unsigned char)out[pos - 1])) &&
+                             (end == out.size() || !isalnum((unsigned char)out[end]));
+                if (alone) {
+                    out.replace(pos, value.size(), placeholder);
+                    pos += placeholder.size();
+                } else {
+                    pos = end;
+                }
+            }
+        }
+        return out;
+    };
+    if (!inst.argv.empty()) {
+        for (const auto& arg : inst.argv) tmpl.argv.push_back(parameterize(arg));
+        tmpl.command = joinArgv(tmpl.argv);
+    } else {
+        tmpl.command = parameterize(inst.command);
+    }
+    tmpl.health = parameterize(inst.health);
+    tmpl.action = parameterize(inst.action);
+    for (const auto& [name, action] : inst.actions) tmpl.actions[name] = parameterize(action);
+
+    // A first value the command doesn't mention (e.g. from a config file) is kept
+    for (const auto& [value, placeholder] : placeholders) {
+        std::string type = placeholder.substr(2, placeholder.size() - 3);
+        if (placeholder[0] == '$' && tmpl.command.find(placeholder) == std::string::npos) {
+            tmpl.vars[type] = value;
+        }
+    }
+
+    if (!inst.cwd.empty()) {
+        tmpl.cwd = "${cwd}";
+        tmpl.vars["cwd"] = inst.cwd;
+    }
+
+    // Environment: what the process has that vp doesn't (or has otherwise)
+    auto info = inst.pid > 0 ? readProcessInfo(inst.pid) : nullptr;
+    if (info) {
+        static const std::set<std::string> noise = {"_", "PWD", "OLDPWD", "SHLVL", "LISTEN_PID", "LISTEN_FDS",
+                                                    "LISTEN_FDNAMES"};
+        for (const auto& [name, value] : info->environ) {
+            const char* own = getenv(name.c_str());
+            if ((own && value == own) || noise.count(name) || name.rfind("VP_", 0) == 0 || inst.env.count(name) ||
+                inst.secrets.count(name)) {
+                continue;
+            }
+            if (secretLooking(name)) {
+                tmpl.secrets[name] = "env:" + name;
+            } else {
+                tmpl.env[name] = "${" + name + "}";
+                tmpl.vars[name] = value;
+            }
+        }
+    }
+    for (const auto& [name, value] : inst.env) {
+        tmpl.env[name] = "${" + name + "}";
+        tmpl.vars[name] = value;
+    }
+    for (const auto& [name, ref] : inst.secrets) tmpl.secrets[name] = ref;
+    return tmpl;
+}
+
+std::map<std::string, std::string> instanceFacts(const Instance& inst, bool live) {
+    std::map<std::string, std::string> facts = {
+        {"command", inst.command},
+        {"cwd", inst.cwd},
+        {"umask", inst.umask},
+        {"template", inst.template_name},
+        {"revision", inst.template_revision},
+        {"health", inst.health},
+        {"action", inst.action},
+        {"stdout", inst.stdout_path},
+        {"stderr", inst.stderr_path},
+    };
+    auto add = [&](const std::string& prefix, const std::map<std::string, std::string>& values) {
+        for (const auto& [key, value] : values) facts[prefix + key] = value;
+    };
+    add("resources.", inst.resources);
+    add("vars.", inst.vars);
+    add("labels.", inst.labels);
+    add("actions.", inst.actions);
+    add("secrets.", inst.secrets);
+
+    auto info = live && inst.status == "running" && inst.pid > 0 ? readProcessInfo(inst.pid) : nullptr;
+    if (info) {
+        auto environ = info->environ;
+        environ.erase("VP_INSTANCE");
+        add("env.", environ);
+        ProcessInfo limits = {};
+        if (readFdUsage(inst.pid, limits) && limits.fd_limit > 0) {
+            facts["limits.nofile"] = std::to_string(limits.fd_limit);
+        }
+    } else {
+        add("env.", inst.env);
+    }
+
+    for (auto it = facts.begin(); it != facts.end();) {
+        it = it->second.empty() ? facts.erase(it) : std::next(it);
+    }
+    return facts;
+}
+
+std::vector<FieldDiff> diffInstances(const Instance& a, const Instance& b, bool live) {
+    auto factsA = instanceFacts(a, live);
+    auto factsB = instanceFacts(b, live);
+    std::set<std::string> fields;
+    for (const auto& [field, value] : factsA) fields.insert(field);
+    for (const auto& [field, value] : factsB) fields.insert(field);
+
+    std::vector<FieldDiff> diffs;
+    for (const auto& field : fields) {
+        std::string valueA = factsA.count(field) ? factsA[field] : "";
+        std::string valueB = factsB.count(field) ? factsB[field] : "";
+        if (valueA != valueB) diffs.push_back({field, valueA, valueB});
+    }
+    return diffs;
+}
+
+std::string adHocName(const State& state, const std::string& command, const std::string& project) {
+    std::istringstream words(command);
+    std::string program;
+    // Skip leading VAR=value assignments
+    while (words >> program && program.find('=') != std::string::npos) {
+    }
+    program = program.substr(program.find_last_of('/') + 1);
+    std::string base;
+    for (char c : program) {
+        if (isalnum((unsigned char)c) || c == '-' || c == '_' || c == '.') base += c;
+    }
+    base = normalizeNamePart(base).substr(0, NAME_MAX_LENGTH - 8);
+    if (base == "unnamed") base = "run";
+
+    for (int n = 1;; n++) {
+        std::string name = qualifiedName(project, base + "-" + std::to_string(n));
+        if (!state.instances.count(name) && !state.templates.count(runTemplateId(name))) {
+            return name;
+        }
+    }
+}
+
+std::string generateInstanceName(const State& state, const std::string& templateId, const std::string& project) {
+    static const char* adjectives[] = {"amber", "bold", "brave", "calm", "clever", "cosmic", "crisp", "dusty",
+                                       "eager", "fuzzy", "gentle", "happy", "hidden", "jolly", "lively", "lucky",
+                                       "mellow", "misty", "nimble", "proud", "quiet", "rapid", "rusty", "silent",
+                                       "sunny", "swift", "tidy", "vivid", "wild", "witty"};
+    static const char* nouns[] = {"badger", "beacon", "canyon", "comet", "falcon", "fern", "fox", "glacier",
+                                  "harbor", "heron", "island", "lantern", "lynx", "maple", "meadow", "moose",
+                                  "nebula", "otter", "owl", "panda", "pebble", "pine", "raven", "river",
+                                  "sparrow", "summit", "tiger", "walrus", "willow", "zebra"};
+    static std::mutex rngMutex;
+    static std::mt19937 rng(std::random_device{}());
+    std::lock_guard<std::mutex> lock(rngMutex);
+    const size_t adjectiveCount = sizeof(adjectives) / sizeof(adjectives[0]);
+    const size_t nounCount = sizeof(nouns) / sizeof(nouns[0]);
+
+    auto taken = [&](const std::string& name) {
+        return state.instances.count(name) || state.templates.count(runTemplateId(name));
+    };
+    // Room for the longest "-adjective-noun" suffix (longer than any "-N"
+    // below) within the name length limit
+    size_t suffix = 2;
+    suffix += std::strlen(*std::max_element(std::begin(adjectives), std::end(adjectives),
+                                            [](const char* a, const char* b) { return std::strlen(a) < std::strlen(b); }));
+    suffix += std::strlen(*std::max_element(std::begin(nouns), std::end(nouns),
+                                            [](const char* a, const char* b) { return std::strlen(a) < std::strlen(b); }));
+    std::string base = normalizeNamePart(templateId.substr(0, NAME_MAX_LENGTH - suffix));
+    for (int attempt = 0; attempt < 20; attempt++) {
+        std::string name = qualifiedName(project, base + "-" + adjectives[rng() % adjectiveCount] + "-" +
+                                                      nouns[rng() % nounCount]);
+        if (!taken(name)) {
+            return name;
+        }
+    }
+    for (int n = 1;; n++) {
+        std::string name = qualifiedName(project, base + "-" + std::to_string(n));
+        if (!taken(name)) {
+            return name;
+        }
+    }
+}
+
+std::string instanceOperation(std::shared_ptr<State> state, const std::string& name, const std::string& op,
+                              bool force) {
+    auto data = state->lock();
+    auto lock = instanceLocks().acquire(name, *state);
+    auto it = state->instances.find(name);
+    if (it == state->instances.end()) {
+        return "not found";
+    }
+    auto inst = it->second;
+
+    // Starting a stopped one again takes nothing away
+    bool starting = op == "restart" && !instanceUp(*inst);
+    if (inst->protect && !force && !starting) {
+        return "protected (vp unlock " + name + ", or --force)";
+    }
+
+    if (op == "stop") {
+        if (!stopProcess(state, inst)) {
+            return "not running";
+        }
+        state->releaseResources(name);
+    } else if (op == "restart") {
+        if (!inst->managed) {
+            return "monitored only";
+        }
+        bool ok = instanceUp(*inst) ? recycleProcess(state, inst) : restartProcess(state, inst);
+        if (!ok) {
+            return inst->error.empty() ? "failed to restart" : inst->error;
+        }
+    } else if (op == "delete") {
+        if (instanceUp(*inst)) {
+            stopProcess(state, inst);
+        }
+        it = state->instances.find(name);
+        if (it != state->instances.end() && it->second == inst) {
+            state->releaseResources(name);
+            state->instances.erase(it);
+        }
+        dropRunTemplate(*state, inst->template_name);
+    } else {
+        return "unknown operation: " + op;
+    }
+    state->save();
+    return "";
+}
+
+PruneResult pruneInstances(std::shared_ptr<State> state, long olderThan, bool dryRun) {
+    auto data = state->lock();
+    PruneResult result;
+    time_t now = time(nullptr);
+    for (const auto& [name, inst] : state->instances) {
+        if (!instanceDown(*inst) || inst->protect) continue;
+        time_t since = inst->stopped_at > 0 ? inst->stopped_at : inst->started;
+        if (now - since < olderThan) continue;
+        result.instances.push_back(name);
+        for (const auto& path : instanceLogs(name)) result.logs.push_back(path);
+    }
+
+    for (const auto& name : result.instances) {
+        for (const auto& [key, res] : state->resources) {
+            if (res->owner == name && !res->reserved) result.resources.push_back(*res);
+        }
+    }
+    for (const auto& [key, res] : state->resources) {
+        if (!res->reserved && !state->instances.count(res->owner)) result.resources.push_back(*res);
+    }
+    if (dryRun) {
+        return result;
+    }
+
+    std::set<std::string> owners;
+    for (const auto& res : result.resources) owners.insert(res.owner);
+    for (const auto& owner : owners) state->releaseResources(owner);
+    for (const auto& name : result.instances) {
+        std::string templateId = state->instances[name]->template_name;
+        state->instances.erase(name);
+        dropRunTemplate(*state, templateId);
+        logInfo("pruned instance", {{"name", name}});
+    }
+    for (const auto& path : result.logs) unlink(path.c_str());
+    if (!result.instances.empty() || !result.resources.empty()) {
+        state->save();
+    }
+    return result;
+}
+
+bool isProcessRunning(int pid) {
+    return pid > 0 && processInspector().isRunning(pid);
+}
+
+unsigned long long processStartTicks(int pid) {
+    auto stat = readProcessStat(pid);
+    return stat ? stat->start_time : 0;
+}
+
+ProcessCheck checkInstanceProcess(const Instance& inst) {
+    if (!isProcessRunning(inst.pid)) {
+        return ProcessCheck::Gone;
+    }
+    // Records from before start_ticks existed can only be checked by PID
+    if (inst.start_ticks == 0) {
+        return ProcessCheck::Alive;
+    }
+    unsigned long long ticks = processStartTicks(inst.pid);
+    if (ticks == 0) {
+        return ProcessCheck::Unverified;
+    }
+    return ticks == inst.start_ticks ? ProcessCheck::Alive : ProcessCheck::Gone;
+}
+
+bool instanceProcessAlive(const Instance& inst) {
+    return checkInstanceProcess(inst) == ProcessCheck::Alive;
+}
+
+// Block until pid exits. pidfd (Linux 5.3+) wakes up immediately and is immune
+// to PID reuse; otherwise poll the start time every interval.
+static void waitForExit(int pid, unsigned long long startTicks, std::chrono::milliseconds interval) {
+#ifdef SYS_pidfd_open
+    int fd = syscall(SYS_pidfd_open, pid, 0);
+    if (fd >= 0) {
+        // The pid may have been reused between the caller's check and pidfd_open
+        if (startTicks == 0 || processStartTicks(pid) == startTicks) {
+            struct pollfd pfd = {fd, POLLIN, 0};
+            while (poll(&pfd, 1, -1) == -1 && errno == EINTR) {
+            }
+        }
+        close(fd);
+        return;
+    }
+#endif
+    while (isProcessRunning(pid) && (startTicks == 0 || processStartTicks(pid) == startTicks)) {
+        std::this_thread::sleep_for(interval);
+    }
+}
+
+// Mark the instance stopped once pid exits (for processes we cannot waitpid)
+static void watchProcess(std::shared_ptr<State> state, const std::string& name, int pid,
+                         unsigned long long startTicks, std::chrono::milliseconds interval) {
+    std::thread([state, name, pid, startTicks, interval]() {
+        waitForExit(pid, startTicks, interval);
+        logInfo("instance exited", {{"name", name}, {"pid", pid}});
+
+        auto data = state->lock();
+        auto lock = instanceLocks().acquire(name, *state);
+        auto it = state->instances.find(name);
+        if (it != state->instances.end() && it->second->pid == pid) {
+            markExited(*state, *it->second, "exited");
+            state->save();
+        }
+    }).detach();
+}
+
+int adoptInstances(std::shared_ptr<State> state) {
+    static std::mutex mutex;
+    static std::set<std::pair<std::string, int>> watched;
+    auto data = state->lock();
+    std::lock_guard<std::mutex> lock(mutex);
+
+    int adopted = 0;
+    for (const auto& [name, inst] : state->instances) {
+        if (!instanceUp(*inst) || watched.count({name, inst->pid})) {
+            continue;
+        }
+
+        // Our own children already have a reaper thread in waitpid()
+        auto stat = readProcessStat(inst->pid);
+        if (!stat || stat->ppid == getpid()) {
+            continue;
+        }
+        if (!instanceProcessAlive(*inst)) {
+            continue; // matchAndUpdateInstances() marks it stopped
+        }
+
+        watched.insert({name, inst->pid});
+        watchProcess(state, name, inst->pid, inst->start_ticks, std::chrono::seconds(1));
+        logInfo("adopted instance", {{"name", name}, {"pid", inst->pid}});
+        adopted++;
+    }
+    return adopted;
+}
+
+int shutdownInstances(std::shared_ptr<State> state) {
+    auto data = state->lock();
+    int stopped = 0;
+    auto instances = state->instances; // stopProcess lets others at the state while it waits
+    for (const auto& [name, inst] : instances) {
+        if (!instanceUp(*inst) || !inst->managed) {
+            continue;
+        }
+        auto tmpl = state->templates.find(inst->template_name);
+        std::string policy = tmpl == state->templates.end() ? "" : tmpl->second->on_shutdown;
+        if (policy.empty() || policy == "leave") {
+            continue;
+        }
+        if (policy != "stop" && policy != "remember") {
+            logWarn("unknown on_shutdown policy, leaving instance running", {{"instance", name}, {"policy", policy}});
+            continue;
+        }
+
+        if (!stopProcess(state, inst)) {
+            logWarn("failed to stop instance on shutdown", {{"instance", name}});
+            continue;
+        }
+        state->releaseResources(name);
+        inst->autostart = policy == "remember";
+        logInfo("stopped on shutdown", {{"instance", name}, {"policy", policy}});
+        stopped++;
+    }
+    state->save();
+    return stopped;
+}
+
+int autostartInstances(std::shared_ptr<State> state) {
+    auto data = state->lock();
+    int started = 0;
+    auto instances = state->instances;
+    for (const auto& [name, inst] : instances) {
+        if (!inst->autostart) {
+            continue;
+        }
+        inst->autostart = false;
+        if (inst->status != "stopped") {
+            continue;
+        }
+        if (!restartProcess(state, inst)) {
+            logWarn("autostart failed", {{"instance", name}, {"error", inst->error}});
+            continue;
+        }
+        logInfo("autostarted", {{"instance", name}, {"pid", inst->pid}});
+        started++;
+    }
+    state->save();
+    return started;
+}
+
+bool becomeSubreaper() {
+#ifdef PR_SET_CHILD_SUBREAPER
+    return prctl(PR_SET_CHILD_SUBREAPER, 1) == 0;
+#else
+    return false;
+#endif
+}
+
+int reapOrphans(std::shared_ptr<State> state) {
+    auto data = state->lock(); // Held across the scan: a start in between would look orphaned
+    std::set<int> instancePids;
+    for (const auto& [name, inst] : state->instances) {
+        instancePids.insert(inst->pid);
+    }
+
+    int reaped = 0;
+    auto children = buildChildMap();
+    for (int pid : children[getpid()]) {
+        if (instancePids.count(pid)) continue; // Its reaper thread collects the status
+
+        int status;
+        if (waitpid(pid, &status, WNOHANG) == pid) {
+            logDebug("reaped orphan", {{"pid", pid}});
+            reaped++;
+        }
+    }
+    return reaped;
+}
+
+bool portAccepting(int port) {
+    int fd = socket(AF_INET, SOCK_STREAM, 0);
+    if (fd == -1) {
+        return false;
+    }
+
+    struct sockaddr_in addr;
+    memset(&addr, 0, sizeof(addr));
+    addr.sin_family = AF_INET;
+    addr.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
+    addr.sin_port = htons(port);
+
+    bool ok = connect(fd, (struct sockaddr*)&addr, sizeof(addr)) == 0;
+    close(fd);
+    return ok;
+}
+
+bool checkHealth(const Instance& inst) {
+    if (!isProcessRunning(inst.pid)) {
+        return false;
+    }
+    if (!inst.health.empty()) {
+        return system(inst.health.c_str()) == 0;
+    }
+
+    // No health check: an allocated tcpport must accept connections
+    auto it = inst.resources.find("tcpport");
+    if (it != inst.resources.end()) {
+        return portAccepting(std::atoi(it->second.c_str()));
+    }
+    return true;
+}
+
+bool startupPassed(const Instance& inst) {
+    if (!inst.startup) {
+        return true;
+    }
+    const StartupProbe& probe = *inst.startup;
+    if (!probe.port.empty() && !portAccepting(std::atoi(probe.port.c_str()))) {
+        return false;
+    }
+    if (!probe.log.empty()) {
+        std::regex pattern;
+        try {
+            pattern = std::regex(probe.log);
+        } catch (const std::regex_error&) {
+            return false;
+        }
+        // Only what this start wrote (all of it if the log was rotated since)
+        std::string path = outputPath(inst);
+        std::ifstream file(path);
+        if (inst.output_offset <= fileSize(path)) {
+            file.seekg(inst.output_offset);
+        }
+        bool found = false;
+        for (std::string line; !found && std::getline(file, line);) {
+            found = std::regex_search(line, pattern);
+        }
+        if (!found) {
+            return false;
+        }
+    }
+    if (!probe.url.empty()) {
+        std::string cmd = "curl -fsS --max-time 5 -o /dev/null " + shellQuote(probe.url) + " 2>/dev/null";
+        if (system(cmd.c_str()) != 0) {
+            return false;
+        }
+    }
+    return true;
+}
+
+bool settleStartup(std::shared_ptr<State> state, std::shared_ptr<Instance> inst, time_t now) {
+    auto data = state->lock();
+    if (inst->status != "starting") {
+        return false;
+    }
+
+    // Probe a copy with the state unlocked: a URL check can take seconds
+    Instance probe = *inst;
+    bool passed;
+    {
+        State::Unlocked unlocked(*state);
+        passed = isProcessRunning(probe.pid) && startupPassed(probe);
+    }
+    if (inst->status != "starting" || inst->pid != probe.pid) {
+        return false; // Stopped or restarted meanwhile
+    }
+
+    if (passed) {
+        setStatus(*state, *inst, "running", "startup probe passed");
+        logInfo("instance started", {{"name", inst->name}, {"seconds", (long)(now - inst->started)}});
+    } else if (now - inst->started >= inst->startup->timeout) {
+        std::string error = "startup probe did not pass within " + std::to_string(inst->startup->timeout) + "s";
+        logWarn("instance failed to start", {{"name", inst->name}, {"error", error}});
+        if (inst->startup->kill) {
+            stopProcess(state, inst);
+            state->releaseResources(inst->name);
+        }
+        inst->error = error;
+        setStatus(*state, *inst, "error", error);
+    } else {
+        return false;
+    }
+    state->save();
+    return true;
+}
+
+bool instanceUp(const Instance& inst) {
+    if (instanceRunning(inst) || inst.status == "starting") {
+        return true;
+    }
+    return inst.status == "error" && inst.pid > 0; // Failed its startup probe, left running
+}
+
+bool instanceRunning(const Instance& inst) {
+    return inst.status == "running" || inst.status == "unhealthy";
+}
+
+bool instanceDown(const Instance& inst) {
+    if (inst.status == "stopped" || inst.status == "crashed" || inst.status == "crash-loop") {
+        return true;
+    }
+    return inst.status == "error" && inst.pid == 0;
+}
+
+std::vector<std::string> HealthSupervisor::check(std::shared_ptr<State> state, time_t now) {
+    auto data = state->lock();
+    std::vector<std::string> restarted;
+    auto instances = state->instances;
+
+    for (auto it = checked_.begin(); it != checked_.end();) {
+        it = instances.count(it->first) ? std::next(it) : checked_.erase(it);
+    }
+
+    for (const auto& [name, inst] : instances) {
+        if (!instanceRunning(*inst) || !inst->managed || inst->health_failures <= 0) continue;
+
+        auto last = checked_.find(name);
+        if (last != checked_.end() && now - last->second < inst->health_interval) continue;
+        checked_[name] = now;
+
+        // Probe a copy with the state unlocked: health commands can take a while
+        Instance probe = *inst;
+        bool healthy;
+        {
+            State::Unlocked unlocked(*state);
+            healthy = checkHealth(probe);
+        }
+        auto current = state->instances.find(name);
+        if (current == state->instances.end() || current->second != inst || !instanceRunning(*inst) ||
+            inst->pid != probe.pid) {
+            continue; // Stopped, deleted or restarted meanwhile
+        }
+        if (healthy) {
+            bool settled = inst->backoff > 0 && now - inst->restarted_at >= HEALTH_BACKOFF_MAX;
+            if (inst->failed_checks > 0 || settled) {
+                inst->failed_checks = 0;
+                if (settled) inst->backoff = 0;
+                setStatus(*state, *inst, "running", "health check passed");
+                state->save();
+            }
+            continue;
+        }
+
+        inst->failed_checks++;
+        logDebug("health check failed", {{"name", name}, {"failed_checks", inst->failed_checks}});
+        setStatus(*state, *inst, "unhealthy", "health check failed");
+        if (inst->failed_checks < inst->health_failures) {
+            state->save();
+            continue;
+        }
+        if (inst->restarted_at > 0 && now - inst->restarted_at < inst->backoff) {
+            continue; // Still backing off from the last restart
+        }
+
+        std::string reason = "health check failed " + std::to_string(inst->failed_checks) + " times";
+        Event event;
+        event.time = now;
+        event.kind = "health";
+        event.instance = name;
+
+        if (recycleProcess(state, inst)) {
+            inst->failed_checks = 0;
+            inst->restarted_at = now;
+            inst->restart_reason = reason;
+            inst->backoff = inst->backoff > 0 ? std::min(inst->backoff * 2, HEALTH_BACKOFF_MAX) : HEALTH_BACKOFF_MIN;
+            event.message = "restarted: " + reason;
+            logWarn("restarted unhealthy instance", {{"name", name}, {"reason", reason}, {"backoff", inst->backoff}});
+            restarted.push_back(name);
+        } else {
+            event.message = "restart failed: " + reason;
+            logError("failed to restart unhealthy instance", {{"name", name}, {"reason", reason}});
+        }
+        recordEvent(state, event);
+    }
+    return restarted;
+}
+
+bool instanceReached(const Instance& inst, const std::string& condition) {
+    if (condition == "running") {
+        return instanceRunning(inst) && isProcessRunning(inst.pid);
+    }
+    if (condition == "stopped") {
+        return !isProcessRunning(inst.pid);
+    }
+    if (condition == "healthy") {
+        return instanceRunning(inst) && checkHealth(inst);
+    }
+    return false;
+}
+
+bool waitForInstance(const std::function<std::shared_ptr<Instance>()>& lookup,
+                     const std::string& condition, int timeoutMs) {
+    auto deadline = std::chrono::steady_clock::now() + std::chrono::milliseconds(timeoutMs);
+
+    while (true) {
+        auto inst = lookup();
+        if (!inst) {
+            return false; // Deleted while waiting
+        }
+        if (instanceReached(*inst, condition)) {
+            return true;
+        }
+        if (timeoutMs > 0 && std::chrono::steady_clock::now() >= deadline) {
+            return false;
+        }
+        std::this_thread::sleep_for(std::chrono::milliseconds(200));
+    }
+}
+
+int rollingRestart(std::shared_ptr<State> state, const std::vector<std::shared_ptr<Instance>>& group,
+                   int timeoutMs, const std::function<void(const Instance&, bool)>& onEach) {
+    int done = 0;
+    for (const auto& inst : group) {
+        bool ok = recycleProcess(state, inst) &&
+                  waitForInstance([&inst]() { return inst; }, "healthy", timeoutMs);
+        if (ok) {
+            inst->restarted_at = time(nullptr);
+            inst->restart_reason = "rolling restart";
+            state->save();
+        }
+        logDebug("rolling restart", {{"name", inst->name}, {"healthy", ok}});
+        if (onEach) {
+            onEach(*inst, ok);
+        }
+        if (!ok) {
+            break; // Keep the rest serving
+        }
+        done++;
+    }
+    return done;
+}
+
+bool canManageProcess(int pid) {
+    if (kill(pid, 0) == 0) {
+        return true;
+    }
+    return errno == EPERM && !helperCommand().empty() && helperAllows(pid);
+}
+
+static std::string regexEscape(const std::string& s) {
+    static const std::string special = "\\^$.|?*+()[]{}";
+    std::string out;
+    for (char c : s) {
+        if (special.find(c) != std::string::npos) out += '\\';
+        out += c;
+    }
+    return out;
+}
+
+// Regex for a template command: literal text must match (any run of whitespace
+// for a space), ${var} and %counter capture. Resources are single arguments,
+// other vars may span several. Returns the number of literal characters.
+static size_t commandPattern(const Template& tmpl, std::string& pattern, std::vector<std::string>& names) {
+    // An argv template runs as its arguments joined by spaces (as /proc shows them)
+    std::string cmd = tmpl.command;
+    if (!tmpl.argv.empty()) {
+        cmd.clear();
+        for (const auto& arg : tmpl.argv) {
+            cmd += (cmd.empty() ? "" : " ") + arg;
+        }
+    }
+
+    // The executable may be run by absolute path
+    pattern = cmd.find('/') < cmd.find(' ') ? "" : "(?:\\S*/)?";
+    size_t literal = 0;
+    std::map<std::string, size_t> groups;
+
+    auto addLiteral = [&](const std::string& text) {
+        std::string word;
+        for (char c : text) {
+            if (isspace((unsigned char)c)) {
+                pattern += regexEscape(word) + "\\s+";
+                word.clear();
+            } else {
+                word += c;
+                literal++;
+            }
+        }
+        pattern += regexEscape(word);
+    };
+
+    for (const auto& part : parseTemplateText(cmd)) {
+        if (part.kind == TemplatePart::LITERAL) {
+            addLiteral(part.value);
+            continue;
+        }
+
+        const std::string& name = part.value;
+        auto seen = groups.find(name);
+        if (seen != groups.end()) {
+            pattern += "\\" + std::to_string(seen->second); // Same value again
+            continue;
+        }
+
+        bool single = part.kind == TemplatePart::COUNTER || declaresResource(tmpl, name);
+        pattern += single ? "(\\S+)" : "(.+?)";
+        names.push_back(name);
+        groups[name] = names.size();
+    }
+
+    return literal;
+}
+
+std::optional<TemplateMatch> inferTemplate(const State& state, const std::string& cmdline) {
+    std::optional<TemplateMatch> best;
+    size_t bestLiteral = 0;
+
+    for (const auto& [id, tmpl] : state.templates) {
+        if (tmpl->command.empty()) continue;
+
+        std::string pattern;
+        std::vector<std::string> names;
+        size_t literal = commandPattern(*tmpl, pattern, names);
+
+        std::smatch m;
+        try {
+            if (!std::regex_match(cmdline, m, std::regex(pattern))) continue;
+        } catch (const std::regex_error&) {
+            continue;
+        }
+
+        // Prefer the template that explains most of the command itself
+        if (!best || literal > bestLiteral) {
+            TemplateMatch match;
+            match.templateId = id;
+            for (size_t i = 0; i < names.size(); i++) {
+                match.vars[names[i]] = m[i + 1].str();
+            }
+            best = match;
+            bestLiteral = literal;
+        }
+    }
+
+    return best;
+}
+
+// Attach an imported instance to the template its command matches, so it
+// carries the template's resources, actions and health check and can be
+// restarted like one vp started
+static void applyInferredTemplate(std::shared_ptr<State> state, Instance& inst) {
+    auto match = inferTemplate(*state, inst.command);
+    if (!match) return;
+
+    const Template& tmpl = *state->templates[match->templateId];
+    std::map<std::string, std::string> vars = tmpl.vars;
+    for (const auto& [key, value] : match->vars) {
+        vars[key] = value;
+    }
+
+    inst.template_name = tmpl.id;
+    inst.template_revision = templateRevision(tmpl);
+    for (const auto& declared : tmpl.resources) {
+        std::string rtype = declared.substr(0, declared.find(':'));
+        auto it = match->vars.find(rtype);
+        if (it != match->vars.end()) {
+            inst.resources[rtype] = it->second;
+            state->claimResource(rtype, it->second, inst.name);
+        }
+    }
+    inst.action = interpolate(tmpl.action, vars);
+    for (const auto& [actionName, action] : tmpl.actions) {
+        inst.actions[actionName] = interpolate(action, vars);
+    }
+    inst.health = interpolate(tmpl.health, vars);
+    inst.umask = tmpl.umask;
+    inst.stdout_path = interpolate(tmpl.stdout_path, vars);
+    inst.stderr_path = interpolate(tmpl.stderr_path, vars);
+    inst.health_failures = tmpl.health_failures;
+    inst.health_interval = tmpl.health_interval;
+    inst.proxy_port = tmpl.proxy_port;
+    inst.match = interpolateMatch(tmpl.match, vars);
+    inst.managed = canManageProcess(inst.pid);
+    logInfo("matched imported process to template", {{"instance", inst.name}, {"template", tmpl.id}});
+}
+
+// What discovery saw of info, to keep with the instance imported from it
+static ProcessSnapshot snapshotProcess(const ProcessInfo& info) {
+    ProcessSnapshot snapshot;
+    snapshot.taken = time(nullptr);
+    snapshot.exe = info.exe;
+    snapshot.cwd = info.cwd;
+    snapshot.ports = info.ports;
+    for (const auto& [name, value] : info.environ) {
+        snapshot.environ[name] = secretLooking(name) ? "(redacted)" : value;
+    }
+    auto chain = getParentChain(info.pid);
+    for (size_t i = 1; i < chain.size(); i++) {
+        snapshot.parents.push_back({chain[i].pid, chain[i].name, chain[i].cmdline});
+    }
+    return snapshot;
+}
+
+// Claim the ports an imported process listens on as tcpport, tcpport1, ...
+// (first, if given, as tcpport), unless they're in a container's network namespace
+static void claimDiscoveredPorts(State& state, Instance& inst, const ProcessInfo& info, int first = 0) {
+    if (info.foreign_net) {
+        logInfo("not claiming ports in the container's network namespace", {{"instance", inst.name}, {"container", info.container}});
+        return;
+    }
+    std::vector<int> ports = info.ports;
+    if (first > 0) {
+        ports.erase(std::remove(ports.begin(), ports.end(), first), ports.end());
+        ports.insert(ports.begin(), first);
+    }
+    for (size_t i = 0; i < ports.size(); i++) {
+        std::string key = (i == 0) ? "tcpport" : "tcpport" + std::to_string(i);
+        std::string value = std::to_string(ports[i]);
+        inst.resources[key] = value;
+        state.claimResource(key, value, inst.name);
+    }
+}
+
+std::shared_ptr<Instance> monitorProcess(std::shared_ptr<State> state, int pid, const std::string& name,
+                                         bool launchScript) {
+    if (state->instances.find(name) != state->instances.end()) {
+        throw std::runtime_error("instance " + name + " already exists");
+    }
+    if (!nameError(name).empty()) {
+        throw std::runtime_error(nameError(name));
+    }
+
+    if (!isProcessRunning(pid)) {
+        throw std::runtime_error("process " + std::to_string(pid) + " not running");
+    }
+
+    auto procInfo = readProcessInfo(pid);
+    if (!procInfo) {
+        throw std::runtime_error("cannot read process " + std::to_string(pid));
+    }
+
+    // Run what the user typed, not the deep child it spawned; the ports stay the leaf's
+    auto target = procInfo;
+    if (launchScript) {
+        auto script = findLaunchScript(getParentChain(pid));
+        if (script && script->pid != pid && script->pid != 1) {
+            target = script;
+        }
     }
 
     auto inst = std::make_shared<Instance>();
     inst->name = name;
-    inst->command = procInfo->cmdline;
-    inst->pid = pid;
-    inst->status = "running";
-    inst->cwd = procInfo->cwd;
-    inst->managed = canManageProcess(pid);
+    inst->command = target->cmdline;
+    inst->pid = target->pid;
+    inst->cwd = target->cwd;
+    inst->managed = canManageProcess(target->pid);
     inst->started = time(nullptr);
+    inst->start_ticks = target->start_time;
+    inst->container = procInfo->container;
+    if (target != procInfo) {
+        inst->leaf_command = procInfo->cmdline;
+        logInfo("importing launch script", {{"instance", name}, {"pid", target->pid}, {"leaf", pid}});
+    }
+    inst->discovered = snapshotProcess(*target);
+    inst->discovered->ports = procInfo->ports;
 
     // Add ports as resources
-    for (size_t i = 0; i < procInfo->ports.size(); i++) {
-        std::string key = (i == 0) ? "tcpport" : "tcpport" + std::to_string(i);
-        std::string value = std::to_string(procInfo->ports[i]);
-        inst->resources[key] = value;
-        state->claimResource(key, value, name);
-    }
+    claimDiscoveredPorts(*state, *inst, *procInfo);
 
     if (!procInfo->cwd.empty()) {
         inst->resources["workdir"] = procInfo->cwd;
     }
 
+    applyInferredTemplate(state, *inst);
     state->instances[name] = inst;
+    setStatus(*state, *inst, "running", "monitored (PID " + std::to_string(inst->pid) + ")");
     state->save();
 
     // Start monitoring thread
-    std::thread([state, name, pid]() {
-        while (true) {
-            std::this_thread::sleep_for(std::chrono::seconds(2));
-
-            if (!isProcessRunning(pid)) {
-                auto it = state->instances.find(name);
-                if (it != state->instances.end() && it->second->pid == pid) {
-                    it->second->status = "stopped";
-                    it->second->pid = 0;
-                    state->save();
-                }
-                break;
-            }
-        }
-    }).detach();
+    watchProcess(state, name, inst->pid, inst->start_ticks, std::chrono::seconds(2));
 
     return inst;
 }
@@ -329,6 +2084,9 @@ std::shared_ptr<Instance> discoverAndImportProcess(std::shared_ptr<State> state,
     if (state->instances.find(name) != state->instances.end()) {
         throw std::runtime_error("instance " + name + " already exists");
     }
+    if (!nameError(name).empty()) {
+        throw std::runtime_error(nameError(name));
+    }
 
     auto procInfo = discoverProcess(pid);
     if (!procInfo) {
@@ -340,11 +2098,17 @@ std::shared_ptr<Instance> discoverAndImportProcess(std::shared_ptr<State> state,
     inst->template_name = "discovered";
     inst->command = procInfo->cmdline;
     inst->pid = pid;
-    inst->status = "running";
+    inst->cwd = procInfo->cwd;
     inst->started = time(nullptr);
+    inst->start_ticks = procInfo->start_time;
+    inst->container = procInfo->container;
     inst->managed = false;
+    inst->discovered = snapshotProcess(*procInfo);
+    claimDiscoveredPorts(*state, *inst, *procInfo);
+    applyInferredTemplate(state, *inst);
 
     state->instances[name] = inst;
+    setStatus(*state, *inst, "running", "imported (PID " + std::to_string(inst->pid) + ")");
     state->save();
 
     return inst;
@@ -354,6 +2118,9 @@ std::shared_ptr<Instance> discoverAndImportProcessOnPort(std::shared_ptr<State>
     if (state->instances.find(name) != state->instances.end()) {
         throw std::runtime_error("instance " + name + " already exists");
     }
+    if (!nameError(name).empty()) {
+        throw std::runtime_error(nameError(name));
+    }
 
     auto procInfo = discoverProcessOnPort(port);
     if (!procInfo) {
@@ -365,120 +2132,792 @@ std::shared_ptr<Instance> discoverAndImportProcessOnPort(std::shared_ptr<State>
     inst->template_name = "discovered";
     inst->command = procInfo->cmdline;
     inst->pid = procInfo->pid;
-    inst->status = "running";
+    inst->cwd = procInfo->cwd;
     inst->started = time(nullptr);
+    inst->start_ticks = procInfo->start_time;
+    inst->container = procInfo->container;
     inst->managed = false;
-    inst->resources["tcpport"] = std::to_string(port);
+    inst->discovered = snapshotProcess(*procInfo);
+    claimDiscoveredPorts(*state, *inst, *procInfo, port);
+    applyInferredTemplate(state, *inst);
 
     state->instances[name] = inst;
+    setStatus(*state, *inst, "running", "imported (PID " + std::to_string(inst->pid) + ")");
     state->save();
 
     return inst;
 }
 
+void manageInstance(std::shared_ptr<State> state, std::shared_ptr<Instance> inst, bool restart) {
+    auto data = state->lock();
+    auto lock = instanceLocks().acquire(inst->name, *state);
+    if (inst->managed && !restart) {
+        throw std::runtime_error(inst->name + " is already managed");
+    }
+    if (!instanceUp(*inst) || !instanceProcessAlive(*inst)) {
+        throw std::runtime_error(inst->name + " is not running");
+    }
+    if (!canManageProcess(inst->pid)) {
+        throw std::runtime_error("cannot signal PID " + std::to_string(inst->pid) + ": " + strerror(errno) +
+                                 " (run vp as its user, or root)");
+    }
+    if (restart && inst->pty) {
+        throw std::runtime_error(inst->name + " needs a terminal; restart it from the web UI");
+    }
+    if (restart && inst->command.empty() && inst->argv.empty()) {
+        throw std::runtime_error(inst->name + " has no command to restart with");
+    }
+
+    if (restart && !state->templates.count(inst->template_name)) {
+        applyInferredTemplate(state, *inst);
+    }
+    inst->managed = true;
+    logInfo("adopted instance", {{"name", inst->name}, {"pid", inst->pid}, {"restart", restart}});
+
+    if (restart) {
+        if (!stopProcess(state, inst)) {
+            throw std::runtime_error("failed to stop " + inst->name);
+        }
+        if (!restartProcess(state, inst)) {
+            throw std::runtime_error("stopped " + inst->name + ", but the restart failed" +
+                                     (inst->error.empty() ? "" : ": " + inst->error));
+        }
+    }
+    state->save();
+}
+
+void detachInstance(std::shared_ptr<State> state, std::shared_ptr<Instance> inst, bool forget) {
+    auto data = state->lock();
+    auto lock = instanceLocks().acquire(inst->name, *state);
+    if (!instanceUp(*inst) || !instanceProcessAlive(*inst)) {
+        throw std::runtime_error(inst->name + " is not running (vp delete removes it)");
+    }
+    if (inst->pty) {
+        throw std::runtime_error(inst->name + " runs on a terminal vp holds; it can't outlive vp");
+    }
+
+    state->releaseResources(inst->name);
+    logInfo("detached instance", {{"name", inst->name}, {"pid", inst->pid}, {"forget", forget}});
+    if (forget) {
+        std::string templateId = inst->template_name;
+        state->instances.erase(inst->name);
+        dropRunTemplate(*state, templateId);
+    } else {
+        inst->managed = false;
+        inst->autostart = false;
+        inst->resources.clear();
+        inst->proxy_port = 0;
+        inst->failed_checks = 0;
+        inst->backoff = 0;
+    }
+    state->save();
+}
+
+std::vector<FieldDiff> refreshInstance(std::shared_ptr<State> state, std::shared_ptr<Instance> inst) {
+    auto data = state->lock();
+    auto lock = instanceLocks().acquire(inst->name, *state);
+    if (!instanceUp(*inst) || !instanceProcessAlive(*inst)) {
+        throw std::runtime_error("instance " + inst->name + " is not running");
+    }
+    auto info = readProcessInfo(inst->pid);
+    if (!info) {
+        throw std::runtime_error("cannot read process " + std::to_string(inst->pid));
+    }
+
+    std::vector<FieldDiff> changes;
+    auto note = [&](const std::string& field, const std::string& was, const std::string& now) {
+        if (was != now) changes.push_back({field, was, now});
+    };
+    auto joined = [](const std::vector<int>& ports) {
+        std::string out;
+        for (int port : ports) out += (out.empty() ? "" : ",") + std::to_string(port);
+        return out;
+    };
+
+    // Ports of the whole tree: the listener is often a child (npm run dev -> node)
+    auto children = buildChildMap();
+    std::set<int> listening(info->ports.begin(), info->ports.end());
+    for (int pid : getDescendants(inst->pid, children)) {
+        auto child = readProcessInfo(pid);
+        if (child && !child->foreign_net) listening.insert(child->ports.begin(), child->ports.end());
+    }
+    if (info->foreign_net) listening.clear();
+
+    std::vector<int> was = inst->discovered ? inst->discovered->ports : std::vector<int>{};
+    std::set<int> claimed;
+    for (const auto& [key, value] : inst->resources) {
+        if (key.rfind("tcpport", 0) == 0 && key.find_first_not_of("0123456789", 7) == std::string::npos) {
+            claimed.insert(std::atoi(value.c_str()));
+            if (!inst->discovered) was.push_back(std::atoi(value.c_str()));
+        }
+    }
+    std::sort(was.begin(), was.end());
+    note("ports", joined(was), joined(std::vector<int>(listening.begin(), listening.end())));
+
+    // Claim ports it started listening on, as the next free tcpportN, unless someone else has them
+    for (int port : listening) {
+        if (claimed.count(port)) continue;
+        std::string value = std::to_string(port);
+        bool taken = std::any_of(state->resources.begin(), state->resources.end(), [&](const auto& kv) {
+            return kv.second->value == value && kv.second->owner != inst->name && kv.second->type.rfind("tcpport", 0) == 0;
+        });
+        if (taken) {
+            logWarn("port claimed by another instance, not claiming", {{"instance", inst->name}, {"port", port}});
+            continue;
+        }
+        std::string key = "tcpport";
+        for (int i = 1; inst->resources.count(key); i++) key = "tcpport" + std::to_string(i);
+        inst->resources[key] = value;
+        state->claimResource(key, value, inst->name);
+        note("resources." + key, "", value);
+    }
+
+    if (!info->cwd.empty()) {
+        note("cwd", inst->cwd, info->cwd);
+        inst->cwd = info->cwd;
+        if (inst->resources.count("workdir") && inst->discovered) {
+            note("resources.workdir", inst->resources["workdir"], info->cwd);
+            inst->resources["workdir"] = info->cwd;
+        }
+    }
+
+    int childCount = inst->children, threads = inst->threads;
+    updateInstanceMetrics(*inst, children);
+    note("children", std::to_string(childCount), std::to_string(inst->children));
+    note("threads", std::to_string(threads), std::to_string(inst->threads));
+
+    if (inst->discovered) {
+        auto snapshot = snapshotProcess(*info);
+        snapshot.ports.assign(listening.begin(), listening.end());
+        inst->discovered = snapshot;
+    }
+    state->save();
+    return changes;
+}
+
+// Re-reads only new or changed PIDs between calls (serve mode polls this)
+static ProcessCache& discoveryCache() {
+    static ProcessCache cache;
+    return cache;
+}
+
+ProcessCache::Stats discoveryCacheStats() {
+    return discoveryCache().stats();
+}
+
 std::vector<std::map<std::string, std::string>> discoverProcesses(std::shared_ptr<State> state, bool portsOnly) {
     std::vector<std::map<std::string, std::string>> result;
 
-    // Read all PIDs from /proc
-    DIR* procDir = opendir("/proc");
-    if (!procDir) {
-        return result;
+    // Command lines the config file's discovery.ignore hides
+    std::vector<std::regex> ignore;
+    std::stringstream patterns(configValue("discovery.ignore"));
+    for (std::string pattern; std::getline(patterns, pattern, ',');) {
+        try {
+            if (!pattern.empty()) ignore.emplace_back(pattern);
+        } catch (const std::regex_error&) {
+            logWarn("ignoring invalid discovery.ignore pattern", {{"pattern", pattern}});
+        }
     }
 
-    struct dirent* entry;
-    while ((entry = readdir(procDir)) != nullptr) {
-        // Check if entry is a PID (numeric)
-        int pid = atoi(entry->d_name);
-        if (pid <= 0) {
+    for (const auto& source : discoverySources(*state, discoveryCache())) {
+        std::vector<std::shared_ptr<ProcessInfo>> procs;
+        try {
+            procs = source->list();
+        } catch (const std::exception& e) {
+            // One unreachable source shouldn't hide the others
+            logWarn("discovery source failed", {{"source", source->name()}, {"error", e.what()}});
             continue;
         }
 
-        // Skip if already monitored
-        bool alreadyMonitored = false;
-        for (const auto& [name, inst] : state->instances) {
-            if (inst->pid == pid) {
-                alreadyMonitored = true;
-                break;
+        for (const auto& procInfo : procs) {
+            int pid = procInfo->pid;
+
+            // Other sources' PIDs aren't ours to compare or inspect
+            if (source->local()) {
+                // Skip if already monitored
+                bool alreadyMonitored = false;
+                for (const auto& [name, inst] : state->instances) {
+                    if (inst->pid == pid) {
+                        alreadyMonitored = true;
+                        break;
+                    }
+                }
+                if (alreadyMonitored) {
+                    continue;
+                }
+
+                // Skip kernel threads
+                if (isKernelThread(pid, procInfo->cmdline)) {
+                    continue;
+                }
+            }
+
+            // If portsOnly, skip processes not listening on ports
+            if (portsOnly && procInfo->ports.empty()) {
+                continue;
+            }
+            if (std::any_of(ignore.begin(), ignore.end(),
+                            [&](const std::regex& re) { return std::regex_search(procInfo->cmdline, re); })) {
+                continue;
+            }
+
+            // Build result entry
+            std::map<std::string, std::string> procMap;
+            procMap["pid"] = std::to_string(procInfo->pid);
+            procMap["ppid"] = std::to_string(procInfo->ppid);
+            procMap["name"] = procInfo->name;
+            procMap["command"] = procInfo->cmdline;
+            procMap["cwd"] = procInfo->cwd;
+            procMap["exe"] = procInfo->exe;
+            procMap["source"] = source->name();
+            if (!procInfo->container.empty()) {
+                procMap["container"] = procInfo->container;
+                procMap["container_runtime"] = procInfo->container_runtime;
             }
+            if (auto match = inferTemplate(*state, procInfo->cmdline)) {
+                procMap["template"] = match->templateId;
+            }
+
+            // Add ports as comma-separated string
+            if (!procInfo->ports.empty()) {
+                std::ostringstream portStream;
+                for (size_t i = 0; i < procInfo->ports.size(); ++i) {
+                    if (i > 0) portStream << ",";
+                    portStream << procInfo->ports[i];
+                }
+                procMap["ports"] = portStream.str();
+            } else {
+                procMap["ports"] = "";
+            }
+
+            result.push_back(procMap);
         }
-        if (alreadyMonitored) {
-            continue;
+    }
+
+    return result;
+}
+
+// Samples closer together than this give a noisy rate
+static const double CPU_SAMPLE_MIN_SECONDS = 0.2;
+
+double cpuPercent(double prevCpu, double prevAt, double cpu, double now, time_t started) {
+    if (prevAt > 0 && cpu >= prevCpu && now > prevAt) {
+        if (now - prevAt < CPU_SAMPLE_MIN_SECONDS) {
+            return -1;
         }
+        return (cpu - prevCpu) / (now - prevAt) * 100;
+    }
+    if (started > 0 && now > started) {
+        return cpu / (now - started) * 100;
+    }
+    return 0;
+}
 
-        // Read process info
-        auto procInfo = readProcessInfo(pid);
-        if (!procInfo) {
-            continue; // Skip processes we can't read
+void updateInstanceMetrics(Instance& inst, const std::map<int, std::vector<int>>& children) {
+    auto top = readProcessStat(inst.pid);
+    if (!top) {
+        return;
+    }
+
+    double cpuTime = top->cpu_time;
+    long rss = top->rss;
+    int threads = top->threads;
+
+    auto descendants = getDescendants(inst.pid, children);
+    for (int pid : descendants) {
+        auto info = readProcessStat(pid);
+        if (info) {
+            cpuTime += info->cpu_time;
+            rss += info->rss;
+            threads += info->threads;
         }
+    }
 
-        // Skip kernel threads
-        if (isKernelThread(pid, procInfo->cmdline)) {
-            continue;
+    // Keep the previous sample (and rate) when this one came too soon after it
+    double now = std::chrono::duration<double>(std::chrono::system_clock::now().time_since_epoch()).count();
+    double percent = cpuPercent(inst.cpu_time, inst.cpu_sampled, cpuTime, now, inst.started);
+    if (percent >= 0) {
+        inst.cpu_percent = percent;
+        inst.cpu_time = cpuTime;
+        inst.cpu_sampled = now;
+    }
+    inst.rss = rss;
+    inst.threads = threads;
+    inst.children = descendants.size();
+
+    // I/O is summed; the nofile limit is per process, so report the one with the least headroom
+    inst.fds = 0;
+    inst.fd_limit = 0;
+    inst.io_read = 0;
+    inst.io_write = 0;
+    double worst = -1;
+    std::vector<int> tree = descendants;
+    tree.insert(tree.begin(), inst.pid);
+    for (int pid : tree) {
+        ProcessInfo usage = {};
+        if (readIoUsage(pid, usage)) {
+            inst.io_read += usage.io_read;
+            inst.io_write += usage.io_write;
         }
+        if (!readFdUsage(pid, usage)) continue;
 
-        // If portsOnly, skip processes not listening on ports
-        if (portsOnly && procInfo->ports.empty()) {
-            continue;
+        double ratio = usage.fd_limit > 0 ? double(usage.fds) / usage.fd_limit : 0;
+        if (ratio > worst || (ratio == worst && usage.fds > inst.fds)) {
+            worst = ratio;
+            inst.fds = usage.fds;
+            inst.fd_limit = usage.fd_limit;
         }
+    }
 
-        // Build result entry
-        std::map<std::string, std::string> procMap;
-        procMap["pid"] = std::to_string(procInfo->pid);
-        procMap["ppid"] = std::to_string(procInfo->ppid);
-        procMap["name"] = procInfo->name;
-        procMap["command"] = procInfo->cmdline;
-        procMap["cwd"] = procInfo->cwd;
-        procMap["exe"] = procInfo->exe;
-
-        // Add ports as comma-separated string
-        if (!procInfo->ports.empty()) {
-            std::ostringstream portStream;
-            for (size_t i = 0; i < procInfo->ports.size(); ++i) {
-                if (i > 0) portStream << ",";
-                portStream << procInfo->ports[i];
-            }
-            procMap["ports"] = portStream.str();
-        } else {
-            procMap["ports"] = "";
+    if (inst.fd_limit > 0 && inst.fds >= inst.fd_limit * FD_WARN_RATIO) {
+        if (inst.warning.empty()) {
+            logWarn("instance near open file limit", {{"name", inst.name}, {"fds", inst.fds}, {"limit", inst.fd_limit}});
         }
+        inst.warning = "open files near limit (" + std::to_string(inst.fds) + "/" + std::to_string(inst.fd_limit) + ")";
+    } else {
+        inst.warning.clear();
+    }
+}
+
+std::optional<MatchRule> matchRuleFor(const Instance& inst) {
+    if (inst.match) return inst.match;
 
-        result.push_back(procMap);
+    auto port = inst.resources.find("tcpport");
+    std::string command = !inst.argv.empty() ? inst.argv[0] : inst.command.substr(0, inst.command.find(' '));
+    if (port == inst.resources.end() || command.empty()) {
+        return std::nullopt; // Too little to tell one process from another
     }
+    MatchRule rule;
+    rule.exe = command.substr(command.find_last_of('/') + 1);
+    rule.cwd = inst.cwd;
+    return rule;
+}
 
-    closedir(procDir);
-    return result;
+bool processMatches(const MatchRule& rule, const Instance& inst, const ProcessInfo& proc) {
+    if (!rule.exe.empty()) {
+        std::string exe = proc.exe.empty() ? proc.cmdline.substr(0, proc.cmdline.find(' ')) : proc.exe;
+        std::string base = exe.substr(exe.find_last_of('/') + 1);
+        bool byName = rule.exe.find('/') == std::string::npos;
+        if (byName ? base != rule.exe && proc.name != rule.exe : exe != rule.exe) return false;
+    }
+    if (!rule.cwd.empty() && proc.cwd != rule.cwd) {
+        return false;
+    }
+    if (!rule.env.empty()) {
+        size_t eq = rule.env.find('=');
+        auto it = proc.environ.find(rule.env.substr(0, eq));
+        if (it == proc.environ.end() || (eq != std::string::npos && it->second != rule.env.substr(eq + 1))) {
+            return false;
+        }
+    }
+    if (!rule.cmdline.empty()) {
+        try {
+            if (!std::regex_search(proc.cmdline, std::regex(rule.cmdline))) return false;
+        } catch (const std::regex_error&) {
+            return false;
+        }
+    }
+    auto port = inst.resources.find("tcpport");
+    if (rule.port && port != inst.resources.end() &&
+        std::find(proc.ports.begin(), proc.ports.end(), atoi(port->second.c_str())) == proc.ports.end()) {
+        return false;
+    }
+    return true;
+}
+
+int rematchInstances(std::shared_ptr<State> state) {
+    std::vector<std::pair<std::shared_ptr<Instance>, std::optional<MatchRule>>> lost;
+    std::set<int> owned;
+    std::set<std::string> markers;
+    for (const auto& [name, inst] : state->instances) {
+        if (!inst->marker.empty()) markers.insert(inst->marker);
+        if ((instanceUp(*inst) || inst->status == "orphaned") && inst->pid > 0) {
+            owned.insert(inst->pid);
+        } else if (inst->status == "stopped") {
+            auto rule = matchRuleFor(*inst);
+            if (rule || !inst->marker.empty()) lost.push_back({inst, rule});
+        }
+    }
+    if (lost.empty()) {
+        return 0;
+    }
+
+    auto procs = discoveryCache().refresh();
+    int rematched = 0;
+    for (auto& [inst, rule] : lost) {
+        // $VP_INSTANCE is certain; the rule is a guess, for processes whose
+        // environment can't be read or that vp didn't start, and never takes
+        // one marked as another instance's
+        std::vector<std::shared_ptr<ProcessInfo>> found;
+        std::set<int> foundPids;
+        auto collect = [&](auto&& matches) {
+            for (const auto& proc : procs) {
+                if (!owned.count(proc->pid) && matches(*proc)) {
+                    found.push_back(proc);
+                    foundPids.insert(proc->pid);
+                }
+            }
+        };
+        if (!inst->marker.empty()) {
+            collect([&](const ProcessInfo& proc) {
+                auto env = proc.environ.find("VP_INSTANCE");
+                return env != proc.environ.end() && env->second == inst->marker;
+            });
+        }
+        if (found.empty() && rule) {
+            collect([&](const ProcessInfo& proc) {
+                auto env = proc.environ.find("VP_INSTANCE");
+                return (env == proc.environ.end() || !markers.count(env->second)) && processMatches(*rule, *inst, proc);
+            });
+        }
+        // Workers that inherited the listening socket (or the marker) match too: keep the topmost
+        found.erase(std::remove_if(found.begin(), found.end(),
+                                   [&](const std::shared_ptr<ProcessInfo>& p) { return foundPids.count(p->ppid) > 0; }),
+                    found.end());
+        if (found.size() != 1) {
+            if (found.size() > 1) {
+                logDebug("ambiguous match, not rematching", {{"instance", inst->name}, {"candidates", (int)found.size()}});
+            }
+            continue;
+        }
+
+        inst->pid = found[0]->pid;
+        inst->start_ticks = found[0]->start_time;
+        inst->container = found[0]->container;
+        setStatus(*state, *inst, "running", "rematched to PID " + std::to_string(inst->pid));
+        inst->started = time(nullptr);
+        inst->managed = inst->managed && canManageProcess(inst->pid);
+        owned.insert(inst->pid);
+        rematched++;
+        logInfo("rematched instance to running process", {{"instance", inst->name}, {"pid", inst->pid}});
+    }
+    return rematched;
 }
 
-bool matchAndUpdateInstances(std::shared_ptr<State> state) {
-    // Update CPU time and check if processes are still running
+bool matchAndUpdateInstances(std::shared_ptr<State> state, bool rematch) {
+    // Update metrics and check if processes are still running
+    std::map<int, std::vector<int>> children;
+    bool haveChildren = false;
+    std::vector<std::shared_ptr<Instance>> starting;
+
     for (auto& kv : state->instances) {
         auto& inst = kv.second;
 
-        if (inst->status == "running") {
-            if (isProcessRunning(inst->pid)) {
-                auto procInfo = readProcessInfo(inst->pid);
-                if (procInfo) {
-                    inst->cpu_time = procInfo->cpu_time;
+        // Its PID couldn't be verified last time: see whether it can now
+        if (inst->status == "orphaned") {
+            ProcessCheck check = checkInstanceProcess(*inst);
+            if (check == ProcessCheck::Alive) {
+                setStatus(*state, *inst, "running", "PID " + std::to_string(inst->pid) + " verified again");
+            } else if (check == ProcessCheck::Gone) {
+                markExited(*state, *inst, "process no longer running");
+            }
+            continue;
+        }
+
+        if (instanceUp(*inst)) {
+            ProcessCheck check = checkInstanceProcess(*inst);
+            if (check == ProcessCheck::Unverified) {
+                logWarn("cannot verify instance's process", {{"name", inst->name}, {"pid", inst->pid}});
+                setStatus(*state, *inst, "orphaned",
+                          "cannot verify PID " + std::to_string(inst->pid) + " is still its process");
+            } else if (check == ProcessCheck::Alive) {
+                if (!haveChildren) {
+                    children = buildChildMap();
+                    haveChildren = true;
+                }
+                updateInstanceMetrics(*inst, children);
+                checkLimits(*state, *inst, time(nullptr));
+                if (inst->status == "starting") {
+                    starting.push_back(inst);
                 }
             } else {
-                inst->status = "stopped";
-                inst->pid = 0;
+                logInfo("instance no longer running", {{"name", inst->name}, {"pid", inst->pid}});
+                markExited(*state, *inst, "process no longer running");
                 inst->cpu_time = 0;
+                inst->cpu_percent = 0;
+                inst->cpu_sampled = 0;
+                inst->rss = 0;
+                inst->children = 0;
+                inst->threads = 0;
+                inst->fds = 0;
+                inst->fd_limit = 0;
+                inst->io_read = 0;
+                inst->io_write = 0;
+                inst->warning.clear();
             }
         }
     }
 
+    // Settle the ones waiting on a startup probe whose probe passed or deadline
+    // went by (this may step out of the lock, so not while iterating above)
+    for (const auto& inst : starting) {
+        settleStartup(state, inst, time(nullptr));
+    }
+
+    // Then find the processes of stopped instances again
+    if (rematch) {
+        rematchInstances(state);
+    }
+
     state->save();
     return true;
 }
 
-bool executeAction(const std::string& action) {
-    if (action.empty()) {
+std::string discoveryDepth(const State& state, const std::string& command) {
+    auto it = state.discoverOn.find(command);
+    if (it == state.discoverOn.end()) {
+        it = state.discoverOn.find("*");
+    }
+    return it != state.discoverOn.end() ? it->second : "full";
+}
+
+TemplateTestResult testTemplate(std::shared_ptr<State> state, const Template& tmpl, const std::string& name,
+                                const std::map<std::string, std::string>& vars, int timeoutMs) {
+    TemplateTestResult result;
+    auto started = std::chrono::steady_clock::now();
+
+    std::shared_ptr<Instance> inst;
+    try {
+        inst = startProcess(state, tmpl, name, vars);
+    } catch (const std::exception& e) {
+        result.stage = "start";
+        result.error = e.what();
+        state->releaseResources(name);
+        state->instances.erase(name);
+        return result;
+    }
+
+    // awaitReady rolls back by itself when the instance never becomes healthy
+    if (!awaitReady(state, inst, timeoutMs)) {
+        result.stage = "ready";
+        result.error = "not healthy within " + std::to_string(timeoutMs / 1000) + "s";
+        result.log = tailLog(logPath(name), 20);
+        return result;
+    }
+    result.readySeconds = std::chrono::duration<double>(std::chrono::steady_clock::now() - started).count();
+
+    std::map<std::string, std::string> values = tmpl.vars;
+    for (const auto& kv : vars) values[kv.first] = kv.second;
+    for (const auto& kv : inst->resources) values[kv.first] = kv.second;
+    result.test = interpolate(tmpl.test, values);
+
+    result.passed = true;
+    if (!result.test.empty()) {
+        std::string cmd = "cd " + shellQuote(inst->cwd) + " && export VP_INSTANCE=" + shellQuote(name) +
+                          " && " + result.test;
+        int status = system(cmd.c_str());
+        if (status != 0) {
+            result.passed = false;
+            result.stage = "test";
+            result.error = "test command exited with " +
+                           std::to_string(WIFEXITED(status) ? WEXITSTATUS(status) : status);
+            result.log = tailLog(logPath(name), 20);
+        }
+    }
+
+    stopProcess(state, inst);
+    state->releaseResources(name);
+    state->instances.erase(name);
+    state->save();
+    return result;
+}
+
+bool awaitReady(std::shared_ptr<State> state, std::shared_ptr<Instance> inst, int timeoutMs) {
+    // Stop waiting as soon as the process exits or fails its startup probe.
+    // Probe snapshots, so the state can stay unlocked for the wait.
+    auto lookup = [state, inst]() -> std::shared_ptr<Instance> {
+        auto data = state->lock();
+        bool failed = inst->status == "error" || !isProcessRunning(inst->pid);
+        return failed ? nullptr : std::make_shared<Instance>(*inst);
+    };
+    bool ready;
+    {
+        State::Unlocked unlocked(*state);
+        ready = waitForInstance(lookup, "healthy", timeoutMs);
+    }
+    if (ready) {
+        return true;
+    }
+
+    // Deleted, or replaced by a new instance of the same name, meanwhile:
+    // nothing of ours left to roll back
+    auto current = state->instances.find(inst->name);
+    if (current == state->instances.end() || current->second != inst) {
         return false;
     }
+    logWarn("instance not ready, rolling back", {{"name", inst->name}, {"timeout_ms", timeoutMs}});
+    if (isProcessRunning(inst->pid)) {
+        stopProcess(state, inst);
+    }
+    current = state->instances.find(inst->name);
+    if (current != state->instances.end() && current->second == inst) {
+        state->releaseResources(inst->name);
+        state->instances.erase(current);
+    }
+    state->save();
+    return false;
+}
+
+json buildProcessTree(int pid, const std::map<int, std::vector<int>>& children) {
+    auto info = readProcessStat(pid);
+    if (!info) {
+        return nullptr;
+    }
+
+    json node = {
+        {"pid", info->pid},
+        {"name", info->name},
+        {"cputime", info->cpu_time},
+        {"rss", info->rss},
+        {"children", json::array()}
+    };
+
+    auto it = children.find(pid);
+    if (it != children.end()) {
+        for (int child : it->second) {
+            json childNode = buildProcessTree(child, children);
+            if (!childNode.is_null()) {
+                node["children"].push_back(childNode);
+            }
+        }
+    }
+
+    return node;
+}
+
+json parentChainJson(const State& state, int pid) {
+    auto chain = getParentChain(pid);
+    if (chain.empty()) {
+        return nullptr;
+    }
+
+    std::map<int, std::string> owners;
+    for (const auto& [name, inst] : state.instances) {
+        if (inst->pid > 0) owners[inst->pid] = name;
+    }
+
+    json links = json::array();
+    for (const auto& info : chain) {
+        json link = {
+            {"pid", info.pid},
+            {"ppid", info.ppid},
+            {"name", info.name},
+            {"cmdline", info.cmdline},
+            {"exe", info.exe},
+            {"cwd", info.cwd},
+            {"ports", info.ports}
+        };
+        if (!info.container.empty()) link["container"] = info.container;
+        auto owner = owners.find(info.pid);
+        if (owner != owners.end()) link["instance"] = owner->second;
+        links.push_back(link);
+    }
+
+    auto script = findLaunchScript(chain);
+    return {
+        {"pid", pid},
+        {"chain", links},
+        {"launch_script", script ? json(script->pid) : json(nullptr)}
+    };
+}
+
+json instanceTrees(std::shared_ptr<State> state) {
+    auto children = buildChildMap();
+
+    json result = json::array();
+    for (const auto& [name, inst] : state->instances) {
+        json entry = {
+            {"name", name},
+            {"status", inst->status},
+            {"managed", inst->managed},
+            {"tree", nullptr}
+        };
+        if (inst->pid > 0) {
+            entry["tree"] = buildProcessTree(inst->pid, children);
+        }
+        result.push_back(entry);
+    }
+
+    return result;
+}
+
+std::string resolveAction(const Instance& inst, const std::string& actionName) {
+    if (actionName.empty() || actionName == "default") {
+        return inst.action;
+    }
+    auto it = inst.actions.find(actionName);
+    return it != inst.actions.end() ? it->second : "";
+}
+
+bool isURLAction(const std::string& action) {
+    return action.rfind("http://", 0) == 0 || action.rfind("https://", 0) == 0;
+}
+
+static std::mutex g_actionRunsMutex;
+
+// Insert or replace run in history, dropping the oldest beyond MAX_ACTION_RUNS
+static void recordActionRun(std::shared_ptr<State> state, ActionRun& run) {
+    std::lock_guard<std::mutex> lock(g_actionRunsMutex);
+    auto& runs = state->actionRuns;
+
+    if (run.id == 0) {
+        run.id = runs.empty() ? 1 : runs.back().id + 1;
+        runs.push_back(run);
+        if (runs.size() > MAX_ACTION_RUNS) {
+            runs.erase(runs.begin(), runs.end() - MAX_ACTION_RUNS);
+        }
+    } else {
+        for (auto& r : runs) {
+            if (r.id == run.id) {
+                r = run;
+            }
+        }
+    }
+    state->save();
+}
+
+ActionRun recordAction(std::shared_ptr<State> state, const std::string& instance,
+                       const std::string& actionName, const std::string& command) {
+    ActionRun run;
+    run.instance = instance;
+    run.action = actionName.empty() ? "default" : actionName;
+    run.command = command;
+    run.started = time(nullptr);
+    recordActionRun(state, run);
+    return run;
+}
+
+ActionRun runAction(std::shared_ptr<State> state, ActionRun run, std::ostream* echo) {
+    auto begin = std::chrono::steady_clock::now();
+    std::string wrapped = "{ " + run.command + "\n} 2>&1";
+    FILE* pipe = popen(wrapped.c_str(), "r");
+    if (!pipe) {
+        run.exit_code = 127;
+        run.output = "failed to run action";
+    } else {
+        char buffer[4096];
+        size_t n;
+        while ((n = fread(buffer, 1, sizeof(buffer), pipe)) > 0) {
+            if (echo) {
+                echo->write(buffer, n);
+                echo->flush();
+            }
+            size_t room = MAX_ACTION_OUTPUT - std::min(run.output.size(), MAX_ACTION_OUTPUT);
+            run.output.append(buffer, std::min(n, room));
+            run.truncated = run.truncated || n > room;
+        }
+        int status = pclose(pipe);
+        run.exit_code = WIFEXITED(status) ? WEXITSTATUS(status) : 128 + WTERMSIG(status);
+
+        // Truncation may split a UTF-8 sequence, which json refuses to serialize
+        run.output = json::parse(json(run.output).dump(-1, ' ', false, json::error_handler_t::replace)).get<std::string>();
+    }
+    run.duration = std::chrono::duration<double>(std::chrono::steady_clock::now() - begin).count();
 
-    std::string cmd = action + " &";
-    return system(cmd.c_str()) == 0;
+    auto data = state->lock();
+    recordActionRun(state, run);
+    logDebug("action finished", {{"instance", run.instance}, {"action", run.action}, {"exit_code", run.exit_code}});
+    return run;
 }
 
 std::string extractProcessName(const std::string& command) {
@@ -3,46 +3,414 @@
 
 #include "types.hpp"
 #include "state.hpp"
+#include "procutil.hpp"
 #include <memory>
 #include <vector>
 #include <map>
+#include <functional>
+#include <optional>
+#include <ostream>
 
 namespace vp {
 
-// Start a process from a template
+// Instance key for name within project: "project/name". Names that already
+// contain '/' are taken as qualified; an empty project is the global scope.
+std::string qualifiedName(const std::string& project, const std::string& name);
+
+// Project part of a qualified name ("" if unqualified)
+std::string projectOf(const std::string& name);
+
+// Instance names and template IDs end up in table columns, resource owners,
+// log file names, URLs and host names (vp serve's proxy, mDNS), so they are
+// 1-63 letters, digits, '.', '_' and '-', starting with a letter or digit.
+// An instance name may be qualified with a project named the same way.
+// Returns what is wrong with name, "" if it is fine.
+std::string nameError(const std::string& name, bool qualified = true);
+
+// name made valid: other characters become '-', runs of '-' collapse, and it
+// is trimmed to start with a letter or digit and cut to 63 ("my app!" -> "my-app")
+std::string normalizeName(const std::string& name, bool qualified = true);
+
+// Check labels against a selector: comma-separated "key=value", "key!=value" or "key" (exists)
+bool matchesSelector(const Instance& inst, const std::string& selector);
+
+// Names of the instances in project ("" = any) matching every criterion given:
+// label selector, template ID and status (empty = any)
+std::vector<std::string> filterInstances(const State& state, const std::string& project, const std::string& selector,
+                                         const std::string& templateId, const std::string& status);
+
+// Stop, restart or delete one instance for bulk operations. stop releases its
+// resources; restart stops it first if running; delete stops it if running and
+// forgets it. Protected instances (vp lock) are refused unless force is set.
+// Returns "" on success, else why it failed.
+std::string instanceOperation(std::shared_ptr<State> state, const std::string& name, const std::string& op,
+                              bool force = false);
+
+// What pruneInstances removed, or would remove on a dry run
+struct PruneResult {
+    std::vector<std::string> instances;  // Stopped (or failed) for longer than the cutoff
+    std::vector<std::string> logs;       // Their log files, rotations included
+    std::vector<Resource> resources;     // Claims whose owner no longer exists
+};
+
+// Delete instances stopped or in error for more than olderThan seconds (since
+// stopped_at, else since they were started) with their logs, and release
+// resources owned by no instance. Locked instances and reservations are kept.
+PruneResult pruneInstances(std::shared_ptr<State> state, long olderThan, bool dryRun = false);
+
+// Template source marking the one-off templates vp run creates; they go when
+// their instance is deleted or pruned
+extern const char* const RUN_TEMPLATE_SOURCE;
+
+// One-off template for vp run: ID "run-<name>", the shell command run in cwd.
+// %type or ${type} for a resource type (e.g. %tcpport) becomes ${type} with
+// the type claimed as a resource; any other % or ${ reaches the shell as is.
+Template adHocTemplate(const State& state, const std::string& name, const std::string& command,
+                       const std::string& cwd);
+
+// Template reproducing inst (vp template from-instance): its command, health
+// and actions with claimed values of a resource type put back as ${type} (the
+// first of each type; one not in the command stays its default) or %type,
+// cwd as the default of ${cwd}, and environment variables that differ from
+// vp's own as env defaults (secret-looking names as env: secret references)
+Template templateFromInstance(const State& state, const Instance& inst, const std::string& id);
+
+// One field where two instances differ (vp diff); "" where it isn't set
+struct FieldDiff {
+    std::string field;  // e.g. "command", "cwd", "env.NODE_ENV", "resources.tcpport"
+    std::string a;
+    std::string b;
+};
+
+// Comparable facts about inst: command, cwd, umask, template and revision,
+// health, stdout/stderr, and resources.*, vars.*, labels.*, actions.* and
+// secrets.* (references). env.* is its template env, or with live set and the
+// process running, the whole environment it has (without VP_INSTANCE), plus
+// limits.nofile.
+std::map<std::string, std::string> instanceFacts(const Instance& inst, bool live = true);
+
+// Fields where a and b differ, in field order (see instanceFacts)
+std::vector<FieldDiff> diffInstances(const Instance& a, const Instance& b, bool live = true);
+
+// Free name for a vp run instance in project: the command's program and the
+// first free number, e.g. "python-1" (qualified, see qualifiedName)
+std::string adHocName(const State& state, const std::string& command, const std::string& project = "");
+
+// Name for an instance started without one: the template's id and a random
+// adjective-noun pair, e.g. "node-express-quiet-otter", else its id and the
+// first free number ("node-express-3"). Qualified, see qualifiedName.
+std::string generateInstanceName(const State& state, const std::string& templateId, const std::string& project = "");
+
+// Start a process from a template (name may be qualified, see qualifiedName).
+// onPhase, if given, hears "allocating" (resources, checks) and then "starting" (fork).
 std::shared_ptr<Instance> startProcess(
+    std::shared_ptr<State> state,
+    const Template& tmpl,
+    const std::string& name,
+    const std::map<std::string, std::string>& vars,
+    const std::function<void(const std::string&)>& onPhase = nullptr
+);
+
+// ${var}s in the template's command, actions and health check that neither vars,
+// its defaults nor its resources provide, and %counters that are not counter
+// resource types, in order of appearance. startProcess refuses to start a
+// strict template (the default) while any remain.
+std::vector<std::string> unresolvedPlaceholders(const State& state, const Template& tmpl,
+                                                const std::map<std::string, std::string>& vars);
+
+// Interpolate a template the way startProcess does, against hypothetical values
+// and without touching state: resources and counters take the given vars, else
+// the first value of their range; anything else stays unresolved.
+std::shared_ptr<Instance> renderTemplate(
+    const State& state,
+    const Template& tmpl,
+    const std::map<std::string, std::string>& vars
+);
+
+// What startProcess would do, without doing it: the instance with its command,
+// actions and health interpolated against a trial allocation of its resources,
+// which is rolled back (claims and counters). Its cwd is where it would run.
+std::shared_ptr<Instance> dryRunProcess(
     std::shared_ptr<State> state,
     const Template& tmpl,
     const std::string& name,
     const std::map<std::string, std::string>& vars
 );
 
-// Stop a running process
+// Revision of a template: its "version", else a hash of everything that affects
+// how instances run. Instances record the one they were started from.
+std::string templateRevision(const Template& tmpl);
+
+// Whether the instance's template changed since it was started (false when
+// either side is unknown)
+bool instanceDrifted(const State& state, const Instance& inst);
+
+// Re-render an instance from its current template and start it in place of
+// the old one, keeping its name, vars, resource values, labels and restart
+// count. Throws (and brings the old instance back) if the new one fails to start.
+std::shared_ptr<Instance> upgradeInstance(std::shared_ptr<State> state, std::shared_ptr<Instance> inst);
+
+// Stop a running process (not an orphaned one: its PID may be another's now)
 bool stopProcess(std::shared_ptr<State> state, std::shared_ptr<Instance> inst);
 
-// Restart a stopped process
+// Restart a stopped, crashed or failed process (see instanceDown)
 bool restartProcess(std::shared_ptr<State> state, std::shared_ptr<Instance> inst);
 
-// Monitor an existing process (add as monitored instance)
-std::shared_ptr<Instance> monitorProcess(std::shared_ptr<State> state, int pid, const std::string& name);
+// Stop a running managed instance and start it again, counting it in inst->restarts
+bool recycleProcess(std::shared_ptr<State> state, std::shared_ptr<Instance> inst);
+
+// Monitor an existing process (add as monitored instance). With launchScript,
+// the instance is the launch script findLaunchScript picks for pid (e.g. "npm
+// run dev" rather than the node it runs), so restart repeats the user's
+// invocation; pid's ports are still claimed and leaf_command records it.
+std::shared_ptr<Instance> monitorProcess(std::shared_ptr<State> state, int pid, const std::string& name,
+                                         bool launchScript = false);
 
 // Check if a process is running
 bool isProcessRunning(int pid);
 
+// Start time of pid as reported by the process inspector (0 if unreadable)
+unsigned long long processStartTicks(int pid);
+
+// Whether an instance's PID is still its process: Alive, Gone (exited, or
+// reused by another process), or Unverified when the PID is alive but its
+// start time can't be read to tell
+enum class ProcessCheck { Alive, Gone, Unverified };
+ProcessCheck checkInstanceProcess(const Instance& inst);
+
+// Check if the instance's PID is still the process it recorded (not reused)
+bool instanceProcessAlive(const Instance& inst);
+
+// Watch running instances that are not our children (started by an earlier vp,
+// or by a CLI command) and mark them stopped when they exit. Uses pidfd where
+// available, polling otherwise. Returns the number of newly watched instances.
+int adoptInstances(std::shared_ptr<State> state);
+
+// Outcome of testTemplate
+struct TemplateTestResult {
+    bool passed = false;
+    std::string stage;          // Where it failed: "start", "ready" or "test"
+    std::string error;
+    double readySeconds = 0;    // Start to ready
+    std::string test;           // The interpolated test command ("" = none)
+    std::string log;            // Tail of the instance's output when it failed
+};
+
+// Start tmpl as name, wait up to timeoutMs for it to be healthy, run its test
+// command (in its cwd, with $VP_INSTANCE set), then stop it and remove it from
+// state whatever happened. Meant for a throwaway state (see VP_STATE_DIR).
+TemplateTestResult testTemplate(std::shared_ptr<State> state, const Template& tmpl, const std::string& name,
+                                const std::map<std::string, std::string>& vars, int timeoutMs);
+
+// Apply each instance's template on_shutdown policy as vp serve exits: "leave"
+// (default) keeps it running, "stop" stops it, "remember" stops it and sets
+// autostart. Returns the number stopped.
+int shutdownInstances(std::shared_ptr<State> state);
+
+// Start the stopped instances marked autostart, clearing the mark. Returns the
+// number started.
+int autostartInstances(std::shared_ptr<State> state);
+
+// Become a child sub-reaper so orphaned descendants of our instances are
+// re-parented to us (Linux only). Returns false if unsupported.
+bool becomeSubreaper();
+
+// Reap exited children that no instance's reaper thread is waiting for
+int reapOrphans(std::shared_ptr<State> state);
+
+// Check if something accepts TCP connections on localhost:port
+bool portAccepting(int port);
+
+// Run the instance's health command (exit 0 = healthy). Without one, an allocated
+// tcpport must accept connections; with neither, running counts as healthy.
+bool checkHealth(const Instance& inst);
+
+// Whether the instance's startup probe passes now (true without one)
+bool startupPassed(const Instance& inst);
+
+// Move a "starting" instance on: to "running" once its startup probe passes,
+// or to "error" (stopped too if the probe says kill) once its timeout since
+// the start has gone by. Returns true if its status changed.
+bool settleStartup(std::shared_ptr<State> state, std::shared_ptr<Instance> inst, time_t now);
+
+// Instance statuses:
+//   stopped     not running: stopped by vp, or exited with code 0
+//   starting    started, waiting for its startup probe to pass
+//   running     up (and passing its health checks, if it has any)
+//   unhealthy   up, but its last health check failed
+//   stopping    being stopped by vp
+//   crashed     exited by itself with a nonzero code or a signal
+//   crash-loop  crashed CRASH_LOOP_COUNT times within CRASH_LOOP_WINDOW seconds
+//   orphaned    its PID is alive but can't be verified as its process; vp
+//               won't signal it until it can (or the PID is gone)
+//   error       failed to start, or its startup probe didn't pass
+const std::vector<std::string>& instanceStatuses();
+
+constexpr int CRASH_LOOP_COUNT = 3;
+constexpr long CRASH_LOOP_WINDOW = 300;
+
+// Statuses whose arrival is recorded as a "status" event too
+bool notableStatus(const std::string& status);
+
+// Set the instance's status, adding the change to its timeline with cause and,
+// for a notable status, to state.events (nothing if the status is already
+// that). Every status change goes through here.
+void setStatus(State& state, Instance& inst, const std::string& status, const std::string& cause);
+
+// Whether the instance has a live process as far as vp knows: running,
+// unhealthy, starting, or failed its startup probe but left running
+bool instanceUp(const Instance& inst);
+
+// Whether the instance is up past its startup: running or unhealthy
+bool instanceRunning(const Instance& inst);
+
+// Whether the instance has no process and can be started again: stopped,
+// crashed, crash-loop, or failed to start
+bool instanceDown(const Instance& inst);
+
+// Backoff between automatic health restarts of an instance: starts at
+// HEALTH_BACKOFF_MIN seconds and doubles up to HEALTH_BACKOFF_MAX, reset once
+// the instance has stayed up for HEALTH_BACKOFF_MAX
+constexpr long HEALTH_BACKOFF_MIN = 10;
+constexpr long HEALTH_BACKOFF_MAX = 300;
+
+// HealthSupervisor probes running managed instances whose template sets
+// health_failures, each every health_interval, and restarts those that fail
+// that many checks in a row (recording a "health" event)
+class HealthSupervisor {
+public:
+    // Run the checks due at time now. Returns the names of restarted instances.
+    std::vector<std::string> check(std::shared_ptr<State> state, time_t now);
+
+private:
+    std::map<std::string, time_t> checked_; // Instance -> last check
+};
+
+// Check if an instance is "running" (or unhealthy), "stopped" or "healthy"
+bool instanceReached(const Instance& inst, const std::string& condition);
+
+// Poll lookup() until the instance reaches condition. timeoutMs <= 0 waits forever.
+// Returns false on timeout or if lookup() returns nullptr (instance deleted).
+bool waitForInstance(const std::function<std::shared_ptr<Instance>()>& lookup,
+                     const std::string& condition, int timeoutMs);
+
+// TemplateMatch is a template a running command line was reverse-matched against
+struct TemplateMatch {
+    std::string templateId;
+    std::map<std::string, std::string> vars; // ${var} and %counter values recovered from the command
+};
+
+// Find the template whose command best explains cmdline, comparing the executable
+// (by basename) and argument shape, and recover its variables (e.g. ${tcpport})
+std::optional<TemplateMatch> inferTemplate(const State& state, const std::string& cmdline);
+
 // Discover and import a process by PID
 std::shared_ptr<Instance> discoverAndImportProcess(std::shared_ptr<State> state, int pid, const std::string& name);
 
 // Discover and import a process on a port
 std::shared_ptr<Instance> discoverAndImportProcessOnPort(std::shared_ptr<State> state, int port, const std::string& name);
 
+// Take a monitored instance into full management (vp adopt): check vp may
+// signal its process, then mark it managed so stop and restart work. With
+// restart it is also stopped and started again as vp's child, matched to a
+// template first if it has none, so vp supervises it from then on. Throws
+// std::runtime_error saying why it can't.
+void manageInstance(std::shared_ptr<State> state, std::shared_ptr<Instance> inst, bool restart);
+
+// Hand a running instance's process off (vp detach), e.g. to systemd: vp
+// releases its resource claims and stops supervising it, leaving the process
+// running and the instance monitor only, or with forget removing it. Throws
+// std::runtime_error if it isn't running or depends on vp (a pty).
+void detachInstance(std::shared_ptr<State> state, std::shared_ptr<Instance> inst, bool forget);
+
+// Re-read inst's process (vp refresh): the ports its tree listens on (new
+// ones are claimed as the next tcpportN), cwd, children and usage. Returns
+// what changed; throws std::runtime_error if it isn't running.
+std::vector<FieldDiff> refreshInstance(std::shared_ptr<State> state, std::shared_ptr<Instance> inst);
+
 // Discover all running processes
 std::vector<std::map<std::string, std::string>> discoverProcesses(std::shared_ptr<State> state, bool portsOnly);
 
-// Match and update instances with running processes
-bool matchAndUpdateInstances(std::shared_ptr<State> state);
+// Hit counts of the process cache behind discoverProcesses
+ProcessCache::Stats discoveryCacheStats();
+
+// Restart instances one at a time, waiting up to timeoutMs for each to be healthy
+// before moving on, so a load-balanced group keeps serving. Stops at the first
+// that fails to come back; onEach reports every attempt. Returns how many succeeded.
+int rollingRestart(std::shared_ptr<State> state, const std::vector<std::shared_ptr<Instance>>& group,
+                   int timeoutMs, const std::function<void(const Instance&, bool)>& onEach = nullptr);
+
+// Block until a just-started instance is healthy (past its startup probe, if
+// any). If it exits, fails the probe or timeoutMs passes,
+// stop it, release its resources and remove it from state. Returns true if ready.
+bool awaitReady(std::shared_ptr<State> state, std::shared_ptr<Instance> inst, int timeoutMs);
+
+// CPU use in percent of one core: the CPU time used between two samples over
+// the wall time between them. Without a usable previous sample (none yet, or
+// the counter went backwards as a child exited) it is the average since
+// started, like ps. Returns -1 when samples are too close to say.
+double cpuPercent(double prevCpu, double prevAt, double cpu, double now, time_t started);
+
+// Update CPU time and rate, RSS, threads and child count summed over the instance's
+// descendants, and open fds of the process closest to its nofile limit
+void updateInstanceMetrics(Instance& inst, const std::map<int, std::vector<int>>& children);
+
+// The rule an instance is re-identified by: its own (from its template, or vp
+// match), else its command's executable name in its cwd listening on its
+// tcpport. Without a tcpport there is no default: it is not rematched.
+std::optional<MatchRule> matchRuleFor(const Instance& inst);
+
+// Whether proc satisfies every part of rule for inst (see MatchRule)
+bool processMatches(const MatchRule& rule, const Instance& inst, const ProcessInfo& proc);
+
+// Point stopped instances at the running process carrying their $VP_INSTANCE
+// marker or, failing that, the one their match rule picks out, when exactly
+// one does and no other instance has it. Returns how many.
+int rematchInstances(std::shared_ptr<State> state);
+
+// Match and update instances with running processes: mark the ones whose
+// process exited stopped, and those whose PID can't be verified orphaned
+// (running again once it can), settle the ones starting (settleStartup), then
+// (unless rematch is false, a status-only pass) rematchInstances
+bool matchAndUpdateInstances(std::shared_ptr<State> state, bool rematch = true);
+
+// How much discovery a CLI command runs first, from state.discoverOn (the
+// command's entry, else "*"): "off", "status" or "full" (the default)
+std::string discoveryDepth(const State& state, const std::string& command);
+
+// Build a process tree (pid, name, cputime, rss, children) rooted at pid
+json buildProcessTree(int pid, const std::map<int, std::vector<int>>& children);
+
+// Parent chain of pid, the process first and init last: {"pid", "chain":
+// [{pid, ppid, name, cmdline, exe, cwd, ports, instance?}], "launch_script":
+// pid or null}, where launch_script is what findLaunchScript picks (e.g.
+// "npm run dev" rather than the node it runs). null if pid does not exist.
+json parentChainJson(const State& state, int pid);
+
+// Build process trees for all instances
+json instanceTrees(std::shared_ptr<State> state);
+
+// Interpolated action by name; "" or "default" is the template's single action.
+// Returns "" if the instance has no such action.
+std::string resolveAction(const Instance& inst, const std::string& actionName);
+
+// Check if an action is a URL (opened rather than executed)
+bool isURLAction(const std::string& action);
+
+// Action runs kept in state, and bytes of output captured per run
+constexpr size_t MAX_ACTION_RUNS = 100;
+constexpr size_t MAX_ACTION_OUTPUT = 16 * 1024;
+
+// Warn when an instance's process uses this share of its nofile limit
+constexpr double FD_WARN_RATIO = 0.9;
+
+// Add a pending run (exit_code -1) to state->actionRuns and return it with its ID
+ActionRun recordAction(std::shared_ptr<State> state, const std::string& instance,
+                       const std::string& actionName, const std::string& command);
 
-// Execute an action command
-bool executeAction(const std::string& action);
+// Execute a recorded run to completion, capturing its output (also written to echo
+// if given), and update it in state->actionRuns. Returns the finished run.
+ActionRun runAction(std::shared_ptr<State> state, ActionRun run, std::ostream* echo = nullptr);
 
 // Extract process name from command
 std::string extractProcessName(const std::string& command);
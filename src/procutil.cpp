@@ -1,12 +1,11 @@
 #include "procutil.hpp"
-#include <fstream>
-#include <sstream>
-#include <dirent.h>
-#include <unistd.h>
-#include <cstring>
 #include <algorithm>
-#include <sys/stat.h>
-#include <iostream>
+#include <cerrno>
+#include <thread>
+#include <atomic>
+#include <regex>
+#include <sstream>
+#include <signal.h>
 
 namespace vp {
 
@@ -15,232 +14,167 @@ const std::map<std::string, bool> SHELL_NAMES = {
     {"dash", true}, {"ksh", true}, {"tcsh", true}, {"csh", true}
 };
 
-std::map<int, std::vector<int>> buildPortToProcessMap() {
-    std::map<int, std::vector<int>> portToPIDs;
-    std::map<std::string, int> inodeToPort;
-
-    // Parse /proc/net/tcp and /proc/net/tcp6
-    const char* tcpFiles[] = {"/proc/net/tcp", "/proc/net/tcp6"};
-
-    for (const char* tcpFile : tcpFiles) {
-        std::ifstream file(tcpFile);
-        if (!file.is_open()) continue;
-
-        std::string line;
-        std::getline(file, line); // Skip header
-
-        while (std::getline(file, line)) {
-            std::istringstream iss(line);
-            std::vector<std::string> fields;
-            std::string field;
-            while (iss >> field) {
-                fields.push_back(field);
-            }
-
-            if (fields.size() < 10) continue;
-
-            // Field 3 is connection state (0A = LISTEN)
-            if (fields[3] != "0A") continue;
-
-            // Parse port from local_address (IP:PORT in hex)
-            std::string localAddr = fields[1];
-            size_t colonPos = localAddr.find(':');
-            if (colonPos == std::string::npos) continue;
-
-            std::string portHex = localAddr.substr(colonPos + 1);
-            int portNum = std::stoi(portHex, nullptr, 16);
-
-            // Store inode -> port mapping
-            std::string inode = fields[9];
-            inodeToPort[inode] = portNum;
+std::vector<int> portsForPid(int pid, const std::map<int, std::vector<int>>& portMap) {
+    std::vector<int> ports;
+    for (const auto& [port, pids] : portMap) {
+        if (std::find(pids.begin(), pids.end(), pid) != pids.end()) {
+            ports.push_back(port);
         }
     }
+    return ports;
+}
 
-    // Scan /proc to find PIDs for each inode
-    DIR* procDir = opendir("/proc");
-    if (!procDir) return portToPIDs;
-
-    struct dirent* entry;
-    while ((entry = readdir(procDir)) != nullptr) {
-        // Check if entry is a PID (numeric)
-        if (!isdigit(entry->d_name[0])) continue;
-
-        int pid = atoi(entry->d_name);
-
-        // Read all FDs for this PID
-        std::string fdDir = std::string("/proc/") + entry->d_name + "/fd";
-        DIR* fdDirPtr = opendir(fdDir.c_str());
-        if (!fdDirPtr) continue;
-
-        struct dirent* fdEntry;
-        while ((fdEntry = readdir(fdDirPtr)) != nullptr) {
-            if (fdEntry->d_name[0] == '.') continue;
-
-            std::string fdPath = fdDir + "/" + fdEntry->d_name;
-            char link[256];
-            ssize_t len = readlink(fdPath.c_str(), link, sizeof(link) - 1);
-            if (len == -1) continue;
-            link[len] = '\0';
+static std::unique_ptr<ProcessInspector>& inspectorSlot() {
+    static std::unique_ptr<ProcessInspector> inspector = newPlatformInspector();
+    return inspector;
+}
 
-            // Check if it's a socket
-            std::string linkStr(link);
-            if (linkStr.find("socket:[") != 0) continue;
+ProcessInspector& processInspector() {
+    return *inspectorSlot();
+}
 
-            // Extract inode
-            std::string inode = linkStr.substr(8);
-            inode = inode.substr(0, inode.length() - 1);
+std::unique_ptr<ProcessInspector> setProcessInspector(std::unique_ptr<ProcessInspector> inspector) {
+    std::swap(inspectorSlot(), inspector);
+    return inspector;
+}
 
-            // Check if this inode corresponds to a listening port
-            auto it = inodeToPort.find(inode);
-            if (it != inodeToPort.end()) {
-                portToPIDs[it->second].push_back(pid);
-            }
-        }
-        closedir(fdDirPtr);
-    }
-    closedir(procDir);
+bool ProcessInspector::isRunning(int pid) {
+    return kill(pid, 0) == 0 || errno == EPERM; // EPERM: another user's, but there
+}
 
-    return portToPIDs;
+std::vector<int> listPids() {
+    return processInspector().listPids();
 }
 
-bool isKernelThread(int pid, const std::string& cmdline) {
-    if (pid == 2) return true;
+std::shared_ptr<ProcessInfo> readProcessStat(int pid) {
+    return processInspector().readProcessStat(pid);
+}
 
-    if (cmdline.empty() || cmdline.find_first_not_of(" \t\n\r") == std::string::npos) {
-        std::string statPath = "/proc/" + std::to_string(pid) + "/stat";
-        std::ifstream file(statPath);
-        if (!file.is_open()) return false;
+bool readFdUsage(int pid, ProcessInfo& info) {
+    return processInspector().readFdUsage(pid, info);
+}
 
-        std::string line;
-        std::getline(file, line);
+bool readIoUsage(int pid, ProcessInfo& info) {
+    return processInspector().readIoUsage(pid, info);
+}
 
-        size_t lastParen = line.rfind(')');
-        if (lastParen == std::string::npos) return false;
+bool readCommand(int pid, ProcessInfo& info) {
+    return processInspector().readCommand(pid, info);
+}
 
-        std::istringstream iss(line.substr(lastParen + 1));
-        std::string state;
-        int ppid;
-        iss >> state >> ppid;
+std::shared_ptr<ProcessInfo> readProcessInfo(int pid, const std::map<int, std::vector<int>>& portMap) {
+    return processInspector().readProcessInfo(pid, portMap);
+}
 
-        if (ppid == 2 || ppid == 0) return true;
-    }
+std::map<int, std::vector<int>> buildPortToProcessMap() {
+    return processInspector().buildPortToProcessMap();
+}
 
-    return false;
+bool isKernelThread(int pid, const std::string& cmdline) {
+    return processInspector().isKernelThread(pid, cmdline);
 }
 
 std::shared_ptr<ProcessInfo> readProcessInfo(int pid) {
-    auto info = std::make_shared<ProcessInfo>();
-    info->pid = pid;
-
-    std::string procDir = "/proc/" + std::to_string(pid);
-
-    // Check if process exists
-    struct stat st;
-    if (stat(procDir.c_str(), &st) != 0) {
-        return nullptr;
-    }
-
-    // Read stat file
-    std::string statPath = procDir + "/stat";
-    std::ifstream statFile(statPath);
-    if (!statFile.is_open()) return nullptr;
+    return readProcessInfo(pid, buildPortToProcessMap());
+}
 
-    std::string statLine;
-    std::getline(statFile, statLine);
+std::vector<std::shared_ptr<ProcessInfo>> readProcessInfos(const std::vector<int>& pids, int workers) {
+    return readProcessInfos(pids, buildPortToProcessMap(), workers);
+}
 
-    // Parse stat file
-    size_t lastParen = statLine.rfind(')');
-    if (lastParen == std::string::npos) return nullptr;
+std::vector<std::shared_ptr<ProcessInfo>> readProcessInfos(const std::vector<int>& pids,
+                                                           const std::map<int, std::vector<int>>& portMap,
+                                                           int workers) {
+    std::vector<std::shared_ptr<ProcessInfo>> result(pids.size());
 
-    // Extract name from (name)
-    size_t firstParen = statLine.find('(');
-    if (firstParen != std::string::npos && lastParen > firstParen) {
-        info->name = statLine.substr(firstParen + 1, lastParen - firstParen - 1);
+    if (workers <= 0) {
+        workers = std::min(16u, std::max(1u, std::thread::hardware_concurrency()));
     }
+    workers = std::min<int>(workers, pids.size());
+
+    // Workers pull the next index until the list is exhausted
+    std::atomic<size_t> next(0);
+    auto worker = [&]() {
+        size_t i;
+        while ((i = next++) < pids.size()) {
+            result[i] = readProcessInfo(pids[i], portMap);
+        }
+    };
 
-    // Parse fields after name
-    std::istringstream iss(statLine.substr(lastParen + 1));
-    std::string state;
-    iss >> state >> info->ppid;
-
-    // Skip to utime and stime (fields 14 and 15, now at positions 11 and 12)
-    std::vector<std::string> fields;
-    std::string field;
-    while (iss >> field) {
-        fields.push_back(field);
+    std::vector<std::thread> threads;
+    for (int i = 1; i < workers; i++) {
+        threads.emplace_back(worker);
     }
-
-    if (fields.size() >= 13) {
-        long utime = std::stol(fields[11]);
-        long stime = std::stol(fields[12]);
-        info->cpu_time = static_cast<double>(utime + stime) / 100.0;
+    worker();
+    for (auto& t : threads) {
+        t.join();
     }
 
-    // Read cmdline
-    std::string cmdlinePath = procDir + "/cmdline";
-    std::ifstream cmdlineFile(cmdlinePath);
-    if (cmdlineFile.is_open()) {
-        std::string cmdline;
-        std::getline(cmdlineFile, cmdline, '\0');
+    return result;
+}
+
+std::vector<std::shared_ptr<ProcessInfo>> ProcessCache::refresh() {
+    std::lock_guard<std::mutex> lock(mutex_);
 
-        // Replace null bytes with spaces
-        for (char& c : cmdline) {
-            if (c == '\0') c = ' ';
+    auto portMap = buildPortToProcessMap();
+    std::map<int, std::shared_ptr<ProcessInfo>> entries;
+    std::vector<int> changed;
+
+    for (int pid : listPids()) {
+        auto stat = readProcessStat(pid);
+        if (!stat) continue;
+
+        // New or recycled PID, or one that exec'd something else
+        auto it = entries_.find(pid);
+        if (it == entries_.end() || it->second->start_time != stat->start_time ||
+            it->second->name != stat->name || it->second->exe != stat->exe) {
+            changed.push_back(pid);
+            continue;
         }
 
-        // Trim trailing whitespace
-        cmdline.erase(cmdline.find_last_not_of(" \t\n\r") + 1);
-        info->cmdline = cmdline;
+        // Unchanged process: keep environ and the like, refresh the cheap fields
+        // (ppid too: a process is reparented when its parent exits), and its
+        // command line and cwd, which it can change without an exec (kept as
+        // cached when they can't be read)
+        auto info = std::make_shared<ProcessInfo>(*it->second);
+        readCommand(pid, *info);
+        info->ppid = stat->ppid;
+        info->cpu_time = stat->cpu_time;
+        info->rss = stat->rss;
+        info->threads = stat->threads;
+        info->ports = info->foreign_net ? std::vector<int>() : portsForPid(pid, portMap);
+        entries[pid] = info;
     }
 
-    if (!isKernelThread(pid, info->cmdline)) {
-        // Read exe
-        std::string exePath = procDir + "/exe";
-        char exe[PATH_MAX];
-        ssize_t len = readlink(exePath.c_str(), exe, sizeof(exe) - 1);
-        if (len != -1) {
-            exe[len] = '\0';
-            info->exe = exe;
-        }
-
-        // Read cwd
-        std::string cwdPath = procDir + "/cwd";
-        char cwd[PATH_MAX];
-        len = readlink(cwdPath.c_str(), cwd, sizeof(cwd) - 1);
-        if (len != -1) {
-            cwd[len] = '\0';
-            info->cwd = cwd;
+    size_t hits = entries.size();
+    for (const auto& info : readProcessInfos(changed, portMap)) {
+        if (info) {
+            entries[info->pid] = info;
         }
+    }
 
-        // Read environ
-        std::string environPath = procDir + "/environ";
-        std::ifstream environFile(environPath);
-        if (environFile.is_open()) {
-            std::string environData((std::istreambuf_iterator<char>(environFile)),
-                                    std::istreambuf_iterator<char>());
-
-            size_t pos = 0;
-            while (pos < environData.size()) {
-                size_t nextNull = environData.find('\0', pos);
-                if (nextNull == std::string::npos) break;
-
-                std::string pair = environData.substr(pos, nextNull - pos);
-                size_t eqPos = pair.find('=');
-                if (eqPos != std::string::npos) {
-                    std::string key = pair.substr(0, eqPos);
-                    std::string value = pair.substr(eqPos + 1);
-                    info->environ[key] = value;
-                }
-
-                pos = nextNull + 1;
-            }
-        }
+    stats_.refreshes++;
+    stats_.hits += hits;
+    stats_.fullReads += changed.size();
+    entries_ = std::move(entries);
+    lastFullReads_ = changed.size();
 
-        // Get ports
-        info->ports = getPortsForProcess(pid);
+    std::vector<std::shared_ptr<ProcessInfo>> result;
+    for (const auto& [pid, info] : entries_) {
+        result.push_back(info);
     }
+    return result;
+}
 
-    return info;
+size_t ProcessCache::lastFullReads() const {
+    return lastFullReads_;
+}
+
+ProcessCache::Stats ProcessCache::stats() {
+    std::lock_guard<std::mutex> lock(mutex_);
+    Stats stats = stats_;
+    stats.entries = entries_.size();
+    return stats;
 }
 
 std::vector<int> getPortsForProcess(int pid) {
@@ -273,6 +207,39 @@ std::vector<int> getProcessesListeningOnPort(int port) {
     return {};
 }
 
+std::map<int, std::vector<int>> buildChildMap() {
+    std::map<int, std::vector<int>> children;
+
+    for (int pid : listPids()) {
+        auto info = readProcessStat(pid);
+        if (!info) continue;
+
+        children[info->ppid].push_back(info->pid);
+    }
+
+    return children;
+}
+
+std::vector<int> getDescendants(int pid, const std::map<int, std::vector<int>>& children) {
+    std::vector<int> result;
+    std::vector<int> stack = {pid};
+
+    while (!stack.empty()) {
+        int current = stack.back();
+        stack.pop_back();
+
+        auto it = children.find(current);
+        if (it == children.end()) continue;
+
+        for (int child : it->second) {
+            result.push_back(child);
+            stack.push_back(child);
+        }
+    }
+
+    return result;
+}
+
 std::vector<ProcessInfo> getParentChain(int pid) {
     std::vector<ProcessInfo> chain;
     int currentPID = pid;
@@ -297,12 +264,14 @@ std::vector<ProcessInfo> getParentChain(int pid) {
 }
 
 std::shared_ptr<ProcessInfo> findLaunchScript(const std::vector<ProcessInfo>& chain) {
-    for (size_t i = 0; i < chain.size(); i++) {
-        if (i + 1 < chain.size()) {
-            const ProcessInfo& parent = chain[i + 1];
-            if (isShell(parent.name) || isShell(parent.exe.substr(parent.exe.find_last_of('/') + 1))) {
-                return std::make_shared<ProcessInfo>(chain[i]);
-            }
+    auto shell = [](const ProcessInfo& p) {
+        return isShell(p.name) || isShell(p.exe.substr(p.exe.find_last_of('/') + 1));
+    };
+
+    // The outermost command typed at a shell: npm in tmux > bash > npm > sh > node
+    for (size_t i = chain.size(); i-- > 1;) {
+        if (shell(chain[i]) && !shell(chain[i - 1])) {
+            return std::make_shared<ProcessInfo>(chain[i - 1]);
         }
     }
 
@@ -338,4 +307,34 @@ std::shared_ptr<ProcessInfo> discoverProcessOnPort(int port) {
     return discoverProcess(pids[0]);
 }
 
+bool parseContainerCgroup(const std::string& cgroup, std::string& id, std::string& runtime) {
+    // Most specific first: kubepods paths also contain the runtime's scope
+    static const std::vector<std::pair<std::regex, std::string>> patterns = {
+        {std::regex("/kubepods[^\\n]*[/-]([0-9a-f]{64})"), "kubepods"},
+        {std::regex("(?:/docker/|docker-)([0-9a-f]{64})"), "docker"},
+        {std::regex("libpod-([0-9a-f]{64})"), "podman"},
+        {std::regex("cri-containerd-([0-9a-f]{64})"), "containerd"},
+        {std::regex("crio-([0-9a-f]{64})"), "crio"},
+        {std::regex("/lxc(?:\\.payload)?[./]([^/\\n]+)"), "lxc"},
+    };
+
+    std::istringstream lines(cgroup);
+    std::string line;
+    while (std::getline(lines, line)) {
+        // hierarchy-ID:controllers:path
+        size_t colon = line.find(':', line.find(':') + 1);
+        if (colon == std::string::npos) continue;
+        std::string path = line.substr(colon + 1);
+        for (const auto& [pattern, name] : patterns) {
+            std::smatch m;
+            if (std::regex_search(path, m, pattern)) {
+                id = name == "lxc" ? m[1].str() : m[1].str().substr(0, 12);
+                runtime = name;
+                return true;
+            }
+        }
+    }
+    return false;
+}
+
 } // namespace vp
@@ -5,22 +5,133 @@
 #include <vector>
 #include <map>
 #include <memory>
+#include <mutex>
 
 namespace vp {
 
 // Shell names for common shells
 extern const std::map<std::string, bool> SHELL_NAMES;
 
+// ProcessInspector abstracts the platform process table.
+// Linux reads /proc (procutil_linux.cpp), macOS uses libproc/sysctl (procutil_darwin.cpp).
+class ProcessInspector {
+public:
+    virtual ~ProcessInspector() = default;
+
+    // List all PIDs
+    virtual std::vector<int> listPids() = 0;
+
+    // Cheap read: name, exe, ppid, cpu time, rss, start time, threads
+    virtual std::shared_ptr<ProcessInfo> readProcessStat(int pid) = 0;
+
+    // Count open fds and read the soft nofile limit into info (limit 0 if unknown).
+    // Returns false if the fd table is unreadable (e.g. another user's process).
+    virtual bool readFdUsage(int pid, ProcessInfo& info) = 0;
+
+    // Read cumulative storage I/O bytes into info; false if not permitted
+    virtual bool readIoUsage(int pid, ProcessInfo& info) = 0;
+
+    // Read cmdline and cwd into info: both change without an exec (setproctitle,
+    // chdir). False if the process is gone.
+    virtual bool readCommand(int pid, ProcessInfo& info) = 0;
+
+    // Full read: stat plus cmdline, exe, cwd, environ and ports from portMap
+    virtual std::shared_ptr<ProcessInfo> readProcessInfo(int pid, const std::map<int, std::vector<int>>& portMap) = 0;
+
+    // Map of listening TCP port -> PIDs holding the socket
+    virtual std::map<int, std::vector<int>> buildPortToProcessMap() = 0;
+
+    // Check if a process is a kernel thread
+    virtual bool isKernelThread(int pid, const std::string& cmdline) = 0;
+
+    // Check if a process exists (default: kill(pid, 0))
+    virtual bool isRunning(int pid);
+};
+
+// Create the inspector for the platform we were built for
+std::unique_ptr<ProcessInspector> newPlatformInspector();
+
+// Inspector used by the free functions below
+ProcessInspector& processInspector();
+
+// Replace the inspector (e.g. with FakeProcessInspector in tests); returns the previous one
+std::unique_ptr<ProcessInspector> setProcessInspector(std::unique_ptr<ProcessInspector> inspector);
+
+// Ports from portMap that pid is listening on
+std::vector<int> portsForPid(int pid, const std::map<int, std::vector<int>>& portMap);
+
 // Build a map of all listening ports to PIDs
 std::map<int, std::vector<int>> buildPortToProcessMap();
 
-// Read process information from /proc/[pid]
+// Read process information for a PID
 std::shared_ptr<ProcessInfo> readProcessInfo(int pid);
 
+// Read process information using a prebuilt port map (see buildPortToProcessMap)
+std::shared_ptr<ProcessInfo> readProcessInfo(int pid, const std::map<int, std::vector<int>>& portMap);
+
+// Read process information for many PIDs on a bounded worker pool.
+// Result is index-aligned with pids; unreadable processes are nullptr.
+// workers <= 0 picks min(hardware threads, 16).
+std::vector<std::shared_ptr<ProcessInfo>> readProcessInfos(const std::vector<int>& pids, int workers = 0);
+std::vector<std::shared_ptr<ProcessInfo>> readProcessInfos(const std::vector<int>& pids,
+                                                           const std::map<int, std::vector<int>>& portMap,
+                                                           int workers = 0);
+
+// ProcessCache remembers ProcessInfo between refreshes, keyed by PID + start time,
+// so only new or recycled PIDs get a full read (environ, container, ...).
+// Unchanged PIDs have stat, cmdline, cwd and ports refreshed.
+class ProcessCache {
+public:
+    // Totals since creation: a hit is a PID served from the cache on refresh
+    struct Stats {
+        size_t refreshes = 0;
+        size_t hits = 0;
+        size_t fullReads = 0;
+        size_t entries = 0;  // Processes currently cached
+    };
+
+    // Rescan the process table and return info for all readable processes
+    std::vector<std::shared_ptr<ProcessInfo>> refresh();
+
+    // Number of PIDs fully read during the last refresh
+    size_t lastFullReads() const;
+
+    Stats stats();
+
+private:
+    std::mutex mutex_;
+    std::map<int, std::shared_ptr<ProcessInfo>> entries_;
+    size_t lastFullReads_ = 0;
+    Stats stats_;
+};
+
+// List all PIDs
+std::vector<int> listPids();
+
+// Read only name, exe, ppid, cpu, rss, start time, threads - cheap, no fd scan
+std::shared_ptr<ProcessInfo> readProcessStat(int pid);
+
+// Fill info.fds and info.fd_limit for pid
+bool readFdUsage(int pid, ProcessInfo& info);
+
+// Fill info.io_read and info.io_write for pid
+bool readIoUsage(int pid, ProcessInfo& info);
+
+// Fill info.cmdline and info.cwd for pid
+bool readCommand(int pid, ProcessInfo& info);
+
+// Build a map of parent PID to child PIDs
+std::map<int, std::vector<int>> buildChildMap();
+
+// Get all descendants of a process (not including the process itself)
+std::vector<int> getDescendants(int pid, const std::map<int, std::vector<int>>& children);
+
 // Get parent chain for a process
 std::vector<ProcessInfo> getParentChain(int pid);
 
-// Find launch script in parent chain
+// Find launch script in parent chain (process first): the outermost non-shell
+// process whose parent is a shell, i.e. what the user typed ("npm run dev"),
+// else the topmost process below init
 std::shared_ptr<ProcessInfo> findLaunchScript(const std::vector<ProcessInfo>& chain);
 
 // Check if a process name is a known shell
@@ -41,6 +152,10 @@ std::shared_ptr<ProcessInfo> discoverProcessOnPort(int port);
 // Check if a process is a kernel thread
 bool isKernelThread(int pid, const std::string& cmdline);
 
+// Container named by a /proc/<pid>/cgroup file: sets id (first 12 hex digits,
+// or the lxc container's name) and runtime; false if no container is named
+bool parseContainerCgroup(const std::string& cgroup, std::string& id, std::string& runtime);
+
 } // namespace vp
 
 #endif // VP_PROCUTIL_HPP
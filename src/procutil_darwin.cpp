@@ -0,0 +1,216 @@
+#ifdef __APPLE__
+
+#include "procutil.hpp"
+#include <libproc.h>
+#include <sys/proc_info.h>
+#include <sys/sysctl.h>
+#include <mach/mach_time.h>
+#include <arpa/inet.h>
+#include <cstring>
+#include <vector>
+
+namespace vp {
+
+// DarwinProcessInspector uses libproc (proc_pidinfo, proc_pidfdinfo) and
+// sysctl(KERN_PROCARGS2). Port mapping walks each process's socket fds
+// directly, so no lsof is needed.
+class DarwinProcessInspector : public ProcessInspector {
+public:
+    std::vector<int> listPids() override;
+    std::shared_ptr<ProcessInfo> readProcessStat(int pid) override;
+    bool readFdUsage(int pid, ProcessInfo& info) override;
+    bool readIoUsage(int pid, ProcessInfo& info) override;
+    std::shared_ptr<ProcessInfo> readProcessInfo(int pid, const std::map<int, std::vector<int>>& portMap) override;
+    std::map<int, std::vector<int>> buildPortToProcessMap() override;
+    bool isKernelThread(int pid, const std::string& cmdline) override;
+    bool readCommand(int pid, ProcessInfo& info) override;
+};
+
+// Convert mach absolute time units (pti_total_user/system) to seconds
+static double machTimeToSeconds(uint64_t t) {
+    static mach_timebase_info_data_t timebase = [] {
+        mach_timebase_info_data_t tb;
+        mach_timebase_info(&tb);
+        return tb;
+    }();
+    return static_cast<double>(t) * timebase.numer / timebase.denom / 1e9;
+}
+
+// Read argv and environment from KERN_PROCARGS2:
+// int argc, exec path, NUL padding, argv[0..argc), environ...
+// The environment is only parsed when withEnviron is set.
+static bool readProcArgs(int pid, ProcessInfo& info, bool withEnviron) {
+    int mib[3] = {CTL_KERN, KERN_PROCARGS2, pid};
+    size_t size = 0;
+    if (sysctl(mib, 3, nullptr, &size, nullptr, 0) != 0 || size < sizeof(int)) return false;
+
+    std::vector<char> buffer(size);
+    if (sysctl(mib, 3, buffer.data(), &size, nullptr, 0) != 0) return false;
+
+    int argc;
+    memcpy(&argc, buffer.data(), sizeof(argc));
+
+    size_t pos = sizeof(argc);
+    pos += strnlen(buffer.data() + pos, size - pos); // Skip exec path
+    while (pos < size && buffer[pos] == '\0') pos++;  // Skip padding
+
+    std::string cmdline;
+    for (int i = 0; i < argc && pos < size; i++) {
+        std::string arg(buffer.data() + pos, strnlen(buffer.data() + pos, size - pos));
+        if (!cmdline.empty()) cmdline += " ";
+        cmdline += arg;
+        pos += arg.size() + 1;
+    }
+    info.cmdline = cmdline;
+    if (!withEnviron) return true;
+
+    while (pos < size && buffer[pos] != '\0') {
+        std::string pair(buffer.data() + pos, strnlen(buffer.data() + pos, size - pos));
+        size_t eqPos = pair.find('=');
+        if (eqPos != std::string::npos) {
+            info.environ[pair.substr(0, eqPos)] = pair.substr(eqPos + 1);
+        }
+        pos += pair.size() + 1;
+    }
+    return true;
+}
+
+// Current working directory from PROC_PIDVNODEPATHINFO
+static void readCwd(int pid, ProcessInfo& info) {
+    struct proc_vnodepathinfo vpi;
+    if (proc_pidinfo(pid, PROC_PIDVNODEPATHINFO, 0, &vpi, sizeof(vpi)) == sizeof(vpi)) {
+        info.cwd = vpi.pvi_cdir.vip_path;
+    }
+}
+
+std::vector<int> DarwinProcessInspector::listPids() {
+    int count = proc_listallpids(nullptr, 0);
+    if (count <= 0) return {};
+
+    std::vector<int> pids(count + 64); // Headroom for processes started meanwhile
+    count = proc_listallpids(pids.data(), pids.size() * sizeof(int));
+    if (count <= 0) return {};
+
+    pids.resize(count);
+    return pids;
+}
+
+std::shared_ptr<ProcessInfo> DarwinProcessInspector::readProcessStat(int pid) {
+    struct proc_taskallinfo task;
+    int n = proc_pidinfo(pid, PROC_PIDTASKALLINFO, 0, &task, sizeof(task));
+
+    if (n != sizeof(task)) {
+        // Processes of other users only expose BSD info without privileges
+        struct proc_bsdinfo bsd;
+        if (proc_pidinfo(pid, PROC_PIDTBSDINFO, 0, &bsd, sizeof(bsd)) != sizeof(bsd)) {
+            return nullptr;
+        }
+        memset(&task, 0, sizeof(task));
+        task.pbsd = bsd;
+    }
+
+    auto info = std::make_shared<ProcessInfo>();
+    info->pid = pid;
+    info->ppid = task.pbsd.pbi_ppid;
+    info->name = task.pbsd.pbi_name[0] ? task.pbsd.pbi_name : task.pbsd.pbi_comm;
+    info->cpu_time = machTimeToSeconds(task.ptinfo.pti_total_user + task.ptinfo.pti_total_system);
+    info->rss = task.ptinfo.pti_resident_size;
+    info->threads = task.ptinfo.pti_threadnum;
+    info->start_time = task.pbsd.pbi_start_tvsec * 1000000ULL + task.pbsd.pbi_start_tvusec;
+
+    // exe, so an exec within the same PID shows
+    char path[PROC_PIDPATHINFO_MAXSIZE];
+    if (proc_pidpath(pid, path, sizeof(path)) > 0) {
+        info->exe = path;
+    }
+
+    return info;
+}
+
+bool DarwinProcessInspector::readFdUsage(int pid, ProcessInfo& info) {
+    int size = proc_pidinfo(pid, PROC_PIDLISTFDS, 0, nullptr, 0);
+    if (size <= 0) return false;
+
+    std::vector<struct proc_fdinfo> fds(size / sizeof(struct proc_fdinfo));
+    size = proc_pidinfo(pid, PROC_PIDLISTFDS, 0, fds.data(), fds.size() * sizeof(struct proc_fdinfo));
+    if (size <= 0) return false;
+
+    info.fds = size / sizeof(struct proc_fdinfo);
+    info.fd_limit = 0; // Another process's rlimits aren't exposed
+    return true;
+}
+
+bool DarwinProcessInspector::readIoUsage(int pid, ProcessInfo& info) {
+    struct rusage_info_v2 ri;
+    if (proc_pid_rusage(pid, RUSAGE_INFO_V2, reinterpret_cast<rusage_info_t*>(&ri)) != 0) {
+        return false;
+    }
+    info.io_read = ri.ri_diskio_bytesread;
+    info.io_write = ri.ri_diskio_byteswritten;
+    return true;
+}
+
+std::shared_ptr<ProcessInfo> DarwinProcessInspector::readProcessInfo(int pid, const std::map<int, std::vector<int>>& portMap) {
+    auto info = readProcessStat(pid);
+    if (!info) return nullptr;
+
+    readProcArgs(pid, *info, true);
+
+    if (!isKernelThread(pid, info->cmdline)) {
+        readCwd(pid, *info);
+        info->ports = portsForPid(pid, portMap);
+    }
+
+    return info;
+}
+
+bool DarwinProcessInspector::readCommand(int pid, ProcessInfo& info) {
+    if (!readProcArgs(pid, info, false)) return false;
+    if (!isKernelThread(pid, info.cmdline)) {
+        readCwd(pid, info);
+    }
+    return true;
+}
+
+std::map<int, std::vector<int>> DarwinProcessInspector::buildPortToProcessMap() {
+    std::map<int, std::vector<int>> portToPIDs;
+
+    for (int pid : listPids()) {
+        int size = proc_pidinfo(pid, PROC_PIDLISTFDS, 0, nullptr, 0);
+        if (size <= 0) continue;
+
+        std::vector<struct proc_fdinfo> fds(size / sizeof(struct proc_fdinfo));
+        size = proc_pidinfo(pid, PROC_PIDLISTFDS, 0, fds.data(), fds.size() * sizeof(struct proc_fdinfo));
+        if (size <= 0) continue;
+        fds.resize(size / sizeof(struct proc_fdinfo));
+
+        for (const auto& fd : fds) {
+            if (fd.proc_fdtype != PROX_FDTYPE_SOCKET) continue;
+
+            struct socket_fdinfo si;
+            if (proc_pidfdinfo(pid, fd.proc_fd, PROC_PIDFDSOCKETINFO, &si, sizeof(si)) != sizeof(si)) continue;
+            if (si.psi.soi_kind != SOCKINFO_TCP) continue;
+            if (si.psi.soi_proto.pri_tcp.tcpsi_state != TSI_S_LISTEN) continue;
+
+            int port = ntohs(si.psi.soi_proto.pri_tcp.tcpsi_ini.insi_lport);
+            auto& pids = portToPIDs[port];
+            if (pids.empty() || pids.back() != pid) {
+                pids.push_back(pid);
+            }
+        }
+    }
+
+    return portToPIDs;
+}
+
+bool DarwinProcessInspector::isKernelThread(int pid, const std::string& /*cmdline*/) {
+    return pid == 0; // kernel_task
+}
+
+std::unique_ptr<ProcessInspector> newPlatformInspector() {
+    return std::make_unique<DarwinProcessInspector>();
+}
+
+} // namespace vp
+
+#endif // __APPLE__
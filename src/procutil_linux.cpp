@@ -0,0 +1,478 @@
+#ifdef __linux__
+
+#include "procutil.hpp"
+#include <fstream>
+#include <sstream>
+#include <iterator>
+#include <dirent.h>
+#include <unistd.h>
+#include <cstring>
+#include <limits.h>
+#include <sys/stat.h>
+#include <sys/socket.h>
+#include <netinet/in.h>
+#include <arpa/inet.h>
+#include <linux/netlink.h>
+#include <linux/sock_diag.h>
+#include <linux/inet_diag.h>
+
+namespace vp {
+
+// LinuxProcessInspector reads everything from /proc
+class LinuxProcessInspector : public ProcessInspector {
+public:
+    std::vector<int> listPids() override;
+    std::shared_ptr<ProcessInfo> readProcessStat(int pid) override;
+    bool readFdUsage(int pid, ProcessInfo& info) override;
+    bool readIoUsage(int pid, ProcessInfo& info) override;
+    std::shared_ptr<ProcessInfo> readProcessInfo(int pid, const std::map<int, std::vector<int>>& portMap) override;
+    std::map<int, std::vector<int>> buildPortToProcessMap() override;
+    bool isKernelThread(int pid, const std::string& cmdline) override;
+    bool readCommand(int pid, ProcessInfo& info) override;
+};
+
+// Read listening TCP sockets (inode -> port) via netlink SOCK_DIAG
+static bool readListeningSocketsNetlink(int family, std::map<std::string, int>& inodeToPort) {
+    int fd = socket(AF_NETLINK, SOCK_DGRAM | SOCK_CLOEXEC, NETLINK_SOCK_DIAG);
+    if (fd == -1) return false;
+
+    struct {
+        struct nlmsghdr nlh;
+        struct inet_diag_req_v2 req;
+    } request;
+    memset(&request, 0, sizeof(request));
+    request.nlh.nlmsg_len = sizeof(request);
+    request.nlh.nlmsg_type = SOCK_DIAG_BY_FAMILY;
+    request.nlh.nlmsg_flags = NLM_F_REQUEST | NLM_F_DUMP;
+    request.req.sdiag_family = family;
+    request.req.sdiag_protocol = IPPROTO_TCP;
+    request.req.idiag_states = 1 << 10; // TCP_LISTEN
+
+    struct sockaddr_nl addr;
+    memset(&addr, 0, sizeof(addr));
+    addr.nl_family = AF_NETLINK;
+
+    if (sendto(fd, &request, sizeof(request), 0, (struct sockaddr*)&addr, sizeof(addr)) == -1) {
+        close(fd);
+        return false;
+    }
+
+    char buffer[16384];
+    bool ok = true;
+    bool done = false;
+
+    while (!done) {
+        int len = recv(fd, buffer, sizeof(buffer), 0);
+        if (len <= 0) {
+            ok = false;
+            break;
+        }
+
+        for (struct nlmsghdr* h = (struct nlmsghdr*)buffer; NLMSG_OK(h, len); h = NLMSG_NEXT(h, len)) {
+            if (h->nlmsg_type == NLMSG_DONE) {
+                done = true;
+                break;
+            }
+            if (h->nlmsg_type == NLMSG_ERROR) {
+                ok = false;
+                done = true;
+                break;
+            }
+
+            auto* msg = (struct inet_diag_msg*)NLMSG_DATA(h);
+            inodeToPort[std::to_string(msg->idiag_inode)] = ntohs(msg->id.idiag_sport);
+        }
+    }
+
+    close(fd);
+    return ok;
+}
+
+// Read listening TCP sockets (inode -> port) from /proc/net/tcp and /proc/net/tcp6
+static void readListeningSocketsProcNet(std::map<std::string, int>& inodeToPort) {
+    const char* tcpFiles[] = {"/proc/net/tcp", "/proc/net/tcp6"};
+
+    for (const char* tcpFile : tcpFiles) {
+        std::ifstream file(tcpFile);
+        if (!file.is_open()) continue;
+
+        std::string line;
+        std::getline(file, line); // Skip header
+
+        while (std::getline(file, line)) {
+            std::istringstream iss(line);
+            std::vector<std::string> fields;
+            std::string field;
+            while (iss >> field) {
+                fields.push_back(field);
+            }
+
+            if (fields.size() < 10) continue;
+
+            // Field 3 is connection state (0A = LISTEN)
+            if (fields[3] != "0A") continue;
+
+            // Parse port from local_address (IP:PORT in hex)
+            std::string localAddr = fields[1];
+            size_t colonPos = localAddr.find(':');
+            if (colonPos == std::string::npos) continue;
+
+            std::string portHex = localAddr.substr(colonPos + 1);
+            int portNum = std::stoi(portHex, nullptr, 16);
+
+            // Store inode -> port mapping
+            std::string inode = fields[9];
+            inodeToPort[inode] = portNum;
+        }
+    }
+}
+
+std::map<int, std::vector<int>> LinuxProcessInspector::buildPortToProcessMap() {
+    std::map<int, std::vector<int>> portToPIDs;
+    std::map<std::string, int> inodeToPort;
+
+    // Prefer netlink SOCK_DIAG, fall back to parsing /proc/net/tcp{,6}
+    if (!readListeningSocketsNetlink(AF_INET, inodeToPort) ||
+        !readListeningSocketsNetlink(AF_INET6, inodeToPort)) {
+        inodeToPort.clear();
+        readListeningSocketsProcNet(inodeToPort);
+    }
+
+    if (inodeToPort.empty()) return portToPIDs;
+
+    // Scan /proc to find PIDs for each inode. Every process is looked at:
+    // the socket's owner says nothing about who holds it (fds survive
+    // setuid() and are passed over unix sockets), and the kernel has no
+    // inode -> pid lookup.
+    DIR* procDir = opendir("/proc");
+    if (!procDir) return portToPIDs;
+
+    struct dirent* entry;
+    while ((entry = readdir(procDir)) != nullptr) {
+        // Check if entry is a PID (numeric)
+        if (!isdigit(entry->d_name[0])) continue;
+
+        int pid = atoi(entry->d_name);
+
+        // Read all FDs for this PID
+        std::string fdDir = std::string("/proc/") + entry->d_name + "/fd";
+        DIR* fdDirPtr = opendir(fdDir.c_str());
+        if (!fdDirPtr) continue;
+
+        struct dirent* fdEntry;
+        while ((fdEntry = readdir(fdDirPtr)) != nullptr) {
+            if (fdEntry->d_name[0] == '.') continue;
+
+            std::string fdPath = fdDir + "/" + fdEntry->d_name;
+            char link[256];
+            ssize_t len = readlink(fdPath.c_str(), link, sizeof(link) - 1);
+            if (len == -1) continue;
+            link[len] = '\0';
+
+            // Check if it's a socket
+            std::string linkStr(link);
+            if (linkStr.find("socket:[") != 0) continue;
+
+            // Extract inode
+            std::string inode = linkStr.substr(8);
+            inode = inode.substr(0, inode.length() - 1);
+
+            // Check if this inode corresponds to a listening port
+            auto it = inodeToPort.find(inode);
+            if (it != inodeToPort.end()) {
+                portToPIDs[it->second].push_back(pid);
+            }
+        }
+        closedir(fdDirPtr);
+    }
+    closedir(procDir);
+
+    return portToPIDs;
+}
+
+bool LinuxProcessInspector::isKernelThread(int pid, const std::string& cmdline) {
+    if (pid == 2) return true;
+
+    if (cmdline.empty() || cmdline.find_first_not_of(" \t\n\r") == std::string::npos) {
+        std::string statPath = "/proc/" + std::to_string(pid) + "/stat";
+        std::ifstream file(statPath);
+        if (!file.is_open()) return false;
+
+        std::string line;
+        std::getline(file, line);
+
+        size_t lastParen = line.rfind(')');
+        if (lastParen == std::string::npos) return false;
+
+        std::istringstream iss(line.substr(lastParen + 1));
+        std::string state;
+        int ppid;
+        iss >> state >> ppid;
+
+        if (ppid == 2 || ppid == 0) return true;
+    }
+
+    return false;
+}
+
+std::shared_ptr<ProcessInfo> LinuxProcessInspector::readProcessStat(int pid) {
+    auto info = std::make_shared<ProcessInfo>();
+    info->pid = pid;
+
+    // Read stat file
+    std::string statPath = "/proc/" + std::to_string(pid) + "/stat";
+    std::ifstream statFile(statPath);
+    if (!statFile.is_open()) return nullptr;
+
+    std::string statLine;
+    std::getline(statFile, statLine);
+
+    // Parse stat file
+    size_t lastParen = statLine.rfind(')');
+    if (lastParen == std::string::npos) return nullptr;
+
+    // Extract name from (name)
+    size_t firstParen = statLine.find('(');
+    if (firstParen != std::string::npos && lastParen > firstParen) {
+        info->name = statLine.substr(firstParen + 1, lastParen - firstParen - 1);
+    }
+
+    // Parse fields after name
+    std::istringstream iss(statLine.substr(lastParen + 1));
+    std::string state;
+    iss >> state >> info->ppid;
+
+    // Skip to utime and stime (fields 14 and 15, now at positions 9 and 10)
+    std::vector<std::string> fields;
+    std::string field;
+    while (iss >> field) {
+        fields.push_back(field);
+    }
+
+    if (fields.size() >= 11) {
+        static const long ticksPerSecond = sysconf(_SC_CLK_TCK) > 0 ? sysconf(_SC_CLK_TCK) : 100;
+        long utime = std::stol(fields[9]);
+        long stime = std::stol(fields[10]);
+        info->cpu_time = static_cast<double>(utime + stime) / ticksPerSecond;
+    }
+
+    // Thread count (field 20, now at position 15)
+    if (fields.size() >= 16) {
+        info->threads = std::stoi(fields[15]);
+    }
+
+    // Start time in clock ticks since boot (field 22, now at position 17)
+    if (fields.size() >= 18) {
+        info->start_time = std::stoull(fields[17]);
+    }
+
+    // RSS in pages (field 24, now at position 19)
+    if (fields.size() >= 20) {
+        info->rss = std::stol(fields[19]) * sysconf(_SC_PAGESIZE);
+    }
+
+    // exe, so an exec within the same PID shows (none for kernel threads)
+    char exe[PATH_MAX];
+    ssize_t len = readlink(("/proc/" + std::to_string(pid) + "/exe").c_str(), exe, sizeof(exe) - 1);
+    if (len != -1) {
+        exe[len] = '\0';
+        info->exe = exe;
+    }
+
+    return info;
+}
+
+bool LinuxProcessInspector::readFdUsage(int pid, ProcessInfo& info) {
+    std::string procDir = "/proc/" + std::to_string(pid);
+
+    DIR* dir = opendir((procDir + "/fd").c_str());
+    if (!dir) return false;
+    int fds = 0;
+    struct dirent* entry;
+    while ((entry = readdir(dir)) != nullptr) {
+        if (entry->d_name[0] != '.') fds++;
+    }
+    closedir(dir);
+    info.fds = fds;
+
+    // "Max open files            1024                 1048576              files"
+    info.fd_limit = 0;
+    std::ifstream limits(procDir + "/limits");
+    std::string line;
+    while (std::getline(limits, line)) {
+        if (line.rfind("Max open files", 0) == 0) {
+            std::istringstream iss(line.substr(14));
+            std::string soft;
+            iss >> soft;
+            if (soft != "unlimited") {
+                info.fd_limit = std::stol(soft);
+            }
+            break;
+        }
+    }
+    return true;
+}
+
+bool LinuxProcessInspector::readIoUsage(int pid, ProcessInfo& info) {
+    std::ifstream io("/proc/" + std::to_string(pid) + "/io");
+    if (!io.is_open()) return false;
+
+    std::string key;
+    long long value;
+    bool found = false;
+    while (io >> key >> value) {
+        if (key == "read_bytes:") {
+            info.io_read = value;
+            found = true;
+        } else if (key == "write_bytes:") {
+            info.io_write = value;
+        }
+    }
+    return found;
+}
+
+// Namespace a /proc/<pid>/ns link points at ("net:[4026531840]"), empty if unreadable
+static std::string namespaceOf(const std::string& link) {
+    char target[64];
+    ssize_t len = readlink(link.c_str(), target, sizeof(target) - 1);
+    if (len == -1) return "";
+    target[len] = '\0';
+    return target;
+}
+
+// Container a process runs in, unless vp runs in the same one: by its cgroup,
+// else by a pid namespace other than vp's. Sets foreign_net when its network
+// namespace isn't vp's.
+static void readContainer(const std::string& procDir, ProcessInfo& info) {
+    auto cgroupOf = [](const std::string& dir, std::string& id, std::string& runtime) {
+        std::ifstream file(dir + "/cgroup");
+        std::string cgroup((std::istreambuf_iterator<char>(file)), std::istreambuf_iterator<char>());
+        return parseContainerCgroup(cgroup, id, runtime);
+    };
+    static std::string selfId, selfRuntime;
+    static bool selfInContainer = cgroupOf("/proc/self", selfId, selfRuntime);
+    static std::string selfPidNs = namespaceOf("/proc/self/ns/pid");
+    static std::string selfNetNs = namespaceOf("/proc/self/ns/net");
+
+    std::string pidNs = namespaceOf(procDir + "/ns/pid");
+    std::string netNs = namespaceOf(procDir + "/ns/net");
+    info.foreign_net = !netNs.empty() && !selfNetNs.empty() && netNs != selfNetNs;
+
+    if (cgroupOf(procDir, info.container, info.container_runtime)) {
+        if (selfInContainer && info.container == selfId) {
+            info.container.clear();
+            info.container_runtime.clear();
+        }
+    } else if (!pidNs.empty() && !selfPidNs.empty() && pidNs != selfPidNs) {
+        size_t open = pidNs.find('[');
+        info.container = open != std::string::npos ? "pidns-" + pidNs.substr(open + 1, pidNs.size() - open - 2) : pidNs;
+        info.container_runtime = "namespace";
+    }
+}
+
+bool LinuxProcessInspector::readCommand(int pid, ProcessInfo& info) {
+    std::string procDir = "/proc/" + std::to_string(pid);
+
+    // Read cmdline
+    std::ifstream cmdlineFile(procDir + "/cmdline");
+    if (!cmdlineFile.is_open()) {
+        return false;
+    }
+    // Arguments are NUL-separated; read them all, not just argv[0]
+    std::string cmdline((std::istreambuf_iterator<char>(cmdlineFile)), std::istreambuf_iterator<char>());
+
+    // Replace null bytes with spaces
+    for (char& c : cmdline) {
+        if (c == '\0') c = ' ';
+    }
+
+    // Trim trailing whitespace
+    cmdline.erase(cmdline.find_last_not_of(" \t\n\r") + 1);
+    info.cmdline = cmdline;
+
+    // Read cwd
+    if (!isKernelThread(pid, info.cmdline)) {
+        char cwd[PATH_MAX];
+        ssize_t len = readlink((procDir + "/cwd").c_str(), cwd, sizeof(cwd) - 1);
+        if (len != -1) {
+            cwd[len] = '\0';
+            info.cwd = cwd;
+        }
+    }
+    return true;
+}
+
+std::shared_ptr<ProcessInfo> LinuxProcessInspector::readProcessInfo(int pid, const std::map<int, std::vector<int>>& portMap) {
+    std::string procDir = "/proc/" + std::to_string(pid);
+
+    // Check if process exists
+    struct stat st;
+    if (stat(procDir.c_str(), &st) != 0) {
+        return nullptr;
+    }
+
+    auto info = readProcessStat(pid);
+    if (!info) return nullptr;
+
+    readCommand(pid, *info);
+
+    if (!isKernelThread(pid, info->cmdline)) {
+        // Read environ
+        std::string environPath = procDir + "/environ";
+        std::ifstream environFile(environPath);
+        if (environFile.is_open()) {
+            std::string environData((std::istreambuf_iterator<char>(environFile)),
+                                    std::istreambuf_iterator<char>());
+
+            size_t pos = 0;
+            while (pos < environData.size()) {
+                size_t nextNull = environData.find('\0', pos);
+                if (nextNull == std::string::npos) break;
+
+                std::string pair = environData.substr(pos, nextNull - pos);
+                size_t eqPos = pair.find('=');
+                if (eqPos != std::string::npos) {
+                    std::string key = pair.substr(0, eqPos);
+                    std::string value = pair.substr(eqPos + 1);
+                    info->environ[key] = value;
+                }
+
+                pos = nextNull + 1;
+            }
+        }
+
+        // Get container, and ports unless they're in its own network namespace
+        readContainer(procDir, *info);
+        if (!info->foreign_net) {
+            info->ports = portsForPid(pid, portMap);
+        }
+    }
+
+    return info;
+}
+
+std::vector<int> LinuxProcessInspector::listPids() {
+    std::vector<int> pids;
+
+    DIR* procDir = opendir("/proc");
+    if (!procDir) return pids;
+
+    struct dirent* entry;
+    while ((entry = readdir(procDir)) != nullptr) {
+        int pid = atoi(entry->d_name);
+        if (pid > 0) {
+            pids.push_back(pid);
+        }
+    }
+    closedir(procDir);
+
+    return pids;
+}
+
+std::unique_ptr<ProcessInspector> newPlatformInspector() {
+    return std::make_unique<LinuxProcessInspector>();
+}
+
+} // namespace vp
+
+#endif // __linux__
@@ -0,0 +1,102 @@
+#include "profile.hpp"
+#include "state.hpp"
+#include "logger.hpp"
+#include <cctype>
+#include <cstdlib>
+#include <dirent.h>
+#include <fstream>
+#include <sys/stat.h>
+
+namespace vp {
+
+std::string currentProfile() {
+    const char* profile = getenv("VP_PROFILE");
+    return profile && *profile ? profile : "default";
+}
+
+bool validProfileName(const std::string& name) {
+    if (name.empty()) return false;
+    for (char c : name) {
+        if (!isalnum((unsigned char)c) && c != '-' && c != '_') return false;
+    }
+    return true;
+}
+
+static std::string profilesPath() {
+    return State::getBaseDir() + "/profiles.json";
+}
+
+std::map<std::string, Profile> loadProfiles() {
+    std::map<std::string, Profile> profiles;
+    profiles["default"] = Profile{};
+
+    std::ifstream file(profilesPath());
+    if (file.is_open()) {
+        try {
+            json j;
+            file >> j;
+            for (const auto& [name, value] : j.items()) {
+                profiles[name] = value.get<Profile>();
+            }
+        } catch (const std::exception& e) {
+            logWarn("ignoring unreadable profiles.json", {{"error", e.what()}});
+        }
+    }
+
+    // Profiles used without vp profile add exist only as directories
+    if (DIR* dir = opendir((State::getBaseDir() + "/profiles").c_str())) {
+        while (struct dirent* entry = readdir(dir)) {
+            std::string name = entry->d_name;
+            if (validProfileName(name) && !profiles.count(name)) {
+                profiles[name] = Profile{};
+            }
+        }
+        closedir(dir);
+    }
+    return profiles;
+}
+
+bool saveProfiles(const std::map<std::string, Profile>& profiles) {
+    json j = json::object();
+    for (const auto& [name, profile] : profiles) {
+        json p = profile;
+        if (name != "default" || !p.empty()) {
+            j[name] = p;
+        }
+    }
+    mkdir(State::getBaseDir().c_str(), 0755);
+    std::string tmp = profilesPath() + ".tmp";
+    std::ofstream file(tmp);
+    if (!file.is_open()) {
+        return false;
+    }
+    file << j.dump(2);
+    file.close();
+    return rename(tmp.c_str(), profilesPath().c_str()) == 0;
+}
+
+Profile currentProfileSettings() {
+    auto profiles = loadProfiles();
+    auto it = profiles.find(currentProfile());
+    return it != profiles.end() ? it->second : Profile{};
+}
+
+void applyProfile(State& state) {
+    const char* dir = getenv("VP_STATE_DIR");
+    if (dir && *dir) {
+        return;
+    }
+    Profile profile = currentProfileSettings();
+    auto it = state.types.find("tcpport");
+    if (!profile.port_start || it == state.types.end()) {
+        return;
+    }
+    it->second->start = profile.port_start;
+    it->second->end = profile.port_end ? profile.port_end : profile.port_start + 999;
+    int next = state.counters["tcpport"];
+    if (next < it->second->start || next > it->second->end) {
+        state.counters["tcpport"] = 0;
+    }
+}
+
+} // namespace vp
@@ -0,0 +1,59 @@
+#ifndef VP_PROFILE_HPP
+#define VP_PROFILE_HPP
+
+#include "types.hpp"
+#include <map>
+#include <string>
+
+namespace vp {
+
+// A profile is a separate state context: its own state.json, counters and
+// logs under ~/.vibeprocess/profiles/<name>, selected with --profile or
+// $VP_PROFILE. "default" is ~/.vibeprocess itself. Settings that must be known
+// before a profile's state is read live in ~/.vibeprocess/profiles.json.
+struct Profile {
+    std::string description;
+    int serve_port = 0;  // vp serve's default port (0 = 8080)
+    int port_start = 0;  // Range for its port counter (0 = the port type's own)
+    int port_end = 0;
+};
+
+inline void to_json(json& j, const Profile& p) {
+    j = json::object();
+    if (!p.description.empty()) j["description"] = p.description;
+    if (p.serve_port) j["serve_port"] = p.serve_port;
+    if (p.port_start) j["port_start"] = p.port_start;
+    if (p.port_end) j["port_end"] = p.port_end;
+}
+
+inline void from_json(const json& j, Profile& p) {
+    p.description = j.value("description", "");
+    p.serve_port = j.value("serve_port", 0);
+    p.port_start = j.value("port_start", 0);
+    p.port_end = j.value("port_end", 0);
+}
+
+// The selected profile ($VP_PROFILE), "default" when unset
+std::string currentProfile();
+
+// Letters, digits, '-' and '_'
+bool validProfileName(const std::string& name);
+
+// Registered profiles plus any profile directory without an entry, and "default"
+std::map<std::string, Profile> loadProfiles();
+
+// Write ~/.vibeprocess/profiles.json
+bool saveProfiles(const std::map<std::string, Profile>& profiles);
+
+// Settings of the selected profile (empty when it has none)
+Profile currentProfileSettings();
+
+class State;
+
+// Narrow state's tcpport range to the selected profile's, so profiles hand
+// out ports from separate spaces. No-op with $VP_STATE_DIR set.
+void applyProfile(State& state);
+
+} // namespace vp
+
+#endif // VP_PROFILE_HPP
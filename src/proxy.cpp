@@ -0,0 +1,349 @@
+#include "proxy.hpp"
+#include "api.hpp"
+#include "logger.hpp"
+#include "process.hpp"
+#include <sys/socket.h>
+#include <netinet/in.h>
+#include <arpa/inet.h>
+#include <unistd.h>
+#include <poll.h>
+#include <algorithm>
+#include <cctype>
+#include <cerrno>
+#include <cstring>
+#include <set>
+#include <sstream>
+#include <thread>
+
+namespace vp {
+
+std::vector<int> proxyTargets(const State& state, int port) {
+    std::vector<int> targets;
+    for (const auto& [name, inst] : state.instances) {
+        if (inst->proxy_port != port || !instanceRunning(*inst)) continue;
+
+        auto it = inst->resources.find("tcpport");
+        if (it != inst->resources.end()) {
+            targets.push_back(std::atoi(it->second.c_str()));
+        }
+    }
+    return targets;
+}
+
+std::string hostInstance(const State& state, const std::string& host,
+                         const std::vector<std::string>& domains) {
+    std::string name = host.substr(0, host.find(':'));
+    std::transform(name.begin(), name.end(), name.begin(), ::tolower);
+
+    for (const auto& domain : domains) {
+        std::string suffix = "." + domain;
+        if (name.size() <= suffix.size() ||
+            name.compare(name.size() - suffix.size(), suffix.size(), suffix) != 0) {
+            continue;
+        }
+
+        std::string label = name.substr(0, name.size() - suffix.size());
+        size_t dot = label.find('.');
+        if (dot != std::string::npos) {
+            label = qualifiedName(label.substr(dot + 1), label.substr(0, dot));
+        }
+        if (state.instances.count(label)) {
+            return label;
+        }
+    }
+    return "";
+}
+
+// Copy bytes both ways until both sides have closed, sending pending (bytes
+// already read from the client) upstream first
+static void relay(int client, int targetPort, const std::string& pending = "") {
+    int upstream = socket(AF_INET, SOCK_STREAM, 0);
+    struct sockaddr_in addr;
+    memset(&addr, 0, sizeof(addr));
+    addr.sin_family = AF_INET;
+    addr.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
+    addr.sin_port = htons(targetPort);
+
+    if (upstream == -1 || connect(upstream, (struct sockaddr*)&addr, sizeof(addr)) != 0) {
+        logDebug("proxy target refused connection", {{"port", targetPort}});
+        if (upstream != -1) close(upstream);
+        close(client);
+        return;
+    }
+
+    if (!pending.empty() && write(upstream, pending.data(), pending.size()) != (ssize_t)pending.size()) {
+        close(upstream);
+        close(client);
+        return;
+    }
+
+    struct pollfd fds[2] = {{client, POLLIN, 0}, {upstream, POLLIN, 0}};
+    bool open[2] = {true, true};
+    char buffer[16384];
+
+    while (open[0] || open[1]) {
+        if (poll(fds, 2, -1) < 0) {
+            if (errno == EINTR) continue;
+            break;
+        }
+        for (int i = 0; i < 2; i++) {
+            if (!open[i] || !(fds[i].revents & (POLLIN | POLLHUP | POLLERR))) continue;
+
+            int to = fds[1 - i].fd;
+            ssize_t n = read(fds[i].fd, buffer, sizeof(buffer));
+            if (n <= 0) {
+                // Half-close: pass the EOF on, keep the other direction going
+                open[i] = false;
+                fds[i].fd = -1;
+                shutdown(to, SHUT_WR);
+                continue;
+            }
+            for (ssize_t done = 0; done < n;) {
+                ssize_t w = write(to, buffer + done, n - done);
+                if (w <= 0) {
+                    open[0] = open[1] = false;
+                    break;
+                }
+                done += w;
+            }
+        }
+    }
+
+    close(client);
+    close(upstream);
+}
+
+// Listening socket on bind (IPv4 unless it has a colon) and port, -1 with
+// errno set on failure
+static int listenOn(const std::string& bind, int port) {
+    struct sockaddr_storage addr;
+    socklen_t addrLen;
+    memset(&addr, 0, sizeof(addr));
+    if (bind.find(':') != std::string::npos) {
+        auto* v6 = (struct sockaddr_in6*)&addr;
+        v6->sin6_family = AF_INET6;
+        v6->sin6_port = htons(port);
+        addrLen = sizeof(*v6);
+        if (inet_pton(AF_INET6, bind.c_str(), &v6->sin6_addr) != 1) {
+            errno = EINVAL;
+            return -1;
+        }
+    } else {
+        auto* v4 = (struct sockaddr_in*)&addr;
+        v4->sin_family = AF_INET;
+        v4->sin_port = htons(port);
+        addrLen = sizeof(*v4);
+        if (inet_pton(AF_INET, bind.c_str(), &v4->sin_addr) != 1) {
+            errno = EINVAL;
+            return -1;
+        }
+    }
+
+    int listener = socket(addr.ss_family, SOCK_STREAM, 0);
+    if (listener == -1) return -1;
+    int opt = 1;
+    setsockopt(listener, SOL_SOCKET, SO_REUSEADDR, &opt, sizeof(opt));
+    if (::bind(listener, (struct sockaddr*)&addr, addrLen) != 0 || listen(listener, 64) != 0) {
+        int saved = errno;
+        close(listener);
+        errno = saved;
+        return -1;
+    }
+    return listener;
+}
+
+// Accept the next client vp serve --allow lets in, closing the rest; -1 once
+// the listener fails
+static int acceptAllowed(int listener, const std::vector<std::string>& allow) {
+    while (true) {
+        struct sockaddr_storage peer;
+        socklen_t peerLen = sizeof(peer);
+        int client = accept(listener, (struct sockaddr*)&peer, &peerLen);
+        if (client == -1) {
+            if (errno == EINTR || errno == ECONNABORTED) continue;
+            return -1;
+        }
+
+        char ip[INET6_ADDRSTRLEN] = "";
+        if (peer.ss_family == AF_INET) {
+            inet_ntop(AF_INET, &((struct sockaddr_in*)&peer)->sin_addr, ip, sizeof(ip));
+        } else if (peer.ss_family == AF_INET6) {
+            inet_ntop(AF_INET6, &((struct sockaddr_in6*)&peer)->sin6_addr, ip, sizeof(ip));
+        }
+        if (remoteAllowed(allow, ip)) {
+            return client;
+        }
+        logDebug("proxy client not allowed", {{"remote", ip}});
+        close(client);
+    }
+}
+
+PortProxy::~PortProxy() {
+    std::lock_guard<std::mutex> lock(mutex_);
+    for (const auto& [port, listener] : listeners_) {
+        shutdown(listener, SHUT_RDWR); // Wakes accept()
+        close(listener);
+    }
+}
+
+std::vector<int> PortProxy::sync() {
+    std::set<int> wanted;
+    {
+        auto data = state_->lock();
+        for (const auto& [name, inst] : state_->instances) {
+            if (inst->proxy_port > 0) {
+                wanted.insert(inst->proxy_port);
+            }
+        }
+    }
+
+    std::lock_guard<std::mutex> lock(mutex_);
+    std::vector<int> ports;
+
+    for (auto it = listeners_.begin(); it != listeners_.end();) {
+        if (wanted.count(it->first)) {
+            ++it;
+            continue;
+        }
+        logInfo("proxy closed", {{"port", it->first}});
+        shutdown(it->second, SHUT_RDWR);
+        close(it->second);
+        next_.erase(it->first);
+        it = listeners_.erase(it);
+    }
+
+    for (int port : wanted) {
+        if (listeners_.count(port)) {
+            ports.push_back(port);
+            continue;
+        }
+
+        int listener = listenOn(bind_, port);
+        if (listener == -1) {
+            // Retried on the next sync; only the first failure is worth a warning
+            if (failed_.insert(port).second) {
+                logWarn("proxy cannot listen", {{"port", port}, {"error", strerror(errno)}});
+            }
+            continue;
+        }
+
+        failed_.erase(port);
+        listeners_[port] = listener;
+        ports.push_back(port);
+        logInfo("proxy listening", {{"address", bind_}, {"port", port}});
+        std::thread(&PortProxy::acceptLoop, this, port, listener).detach();
+    }
+    return ports;
+}
+
+void PortProxy::acceptLoop(int port, int listener) {
+    while (true) {
+        int client = acceptAllowed(listener, allow_);
+        if (client == -1) {
+            return; // Listener closed
+        }
+
+        int target = 0;
+        {
+            auto data = state_->lock();
+            std::lock_guard<std::mutex> lock(mutex_);
+            auto targets = proxyTargets(*state_, port);
+            if (!targets.empty()) {
+                target = targets[next_[port]++ % targets.size()];
+            }
+        }
+        if (target <= 0) {
+            logDebug("proxy has no running target", {{"port", port}});
+            close(client);
+            continue;
+        }
+        std::thread(relay, client, target, "").detach();
+    }
+}
+
+// Answer a request we cannot route and close the connection
+static void sendError(int client, const std::string& status, const std::string& message) {
+    std::string response = "HTTP/1.1 " + status + "\r\n"
+                           "Content-Type: text/plain\r\n"
+                           "Content-Length: " + std::to_string(message.size() + 1) + "\r\n"
+                           "Connection: close\r\n\r\n" + message + "\n";
+    write(client, response.data(), response.size());
+    close(client);
+}
+
+bool HostProxy::serve(int port) {
+    int listener = listenOn(bind_, port);
+    if (listener == -1) {
+        logWarn("host proxy cannot listen", {{"port", port}, {"error", strerror(errno)}});
+        return false;
+    }
+    logInfo("host proxy listening", {{"address", bind_}, {"port", port}});
+
+    while (true) {
+        int client = acceptAllowed(listener, allow_);
+        if (client == -1) {
+            close(listener);
+            return false;
+        }
+        std::thread(&HostProxy::handle, this, client).detach();
+    }
+}
+
+void HostProxy::handle(int client) {
+    // Read the first request's headers to find its Host
+    std::string head;
+    char buffer[4096];
+    while (head.find("\r\n\r\n") == std::string::npos) {
+        if (head.size() > 65536) {
+            sendError(client, "431 Request Header Fields Too Large", "headers too large");
+            return;
+        }
+        ssize_t n = read(client, buffer, sizeof(buffer));
+        if (n <= 0) {
+            close(client);
+            return;
+        }
+        head.append(buffer, n);
+    }
+
+    std::string host;
+    std::istringstream lines(head.substr(0, head.find("\r\n\r\n")));
+    std::string line;
+    std::getline(lines, line); // Request line
+    while (std::getline(lines, line)) {
+        size_t colon = line.find(':');
+        if (colon == std::string::npos) continue;
+        std::string key = line.substr(0, colon);
+        std::transform(key.begin(), key.end(), key.begin(), ::tolower);
+        if (key == "host") {
+            host = line.substr(colon + 1);
+            host.erase(0, host.find_first_not_of(" \t"));
+            host.erase(host.find_last_not_of(" \t\r") + 1);
+            break;
+        }
+    }
+
+    int target = 0;
+    std::string name;
+    {
+        auto data = state_->lock();
+        name = hostInstance(*state_, host, domains_);
+        if (!name.empty()) {
+            auto inst = state_->instances.at(name);
+            auto it = inst->resources.find("tcpport");
+            if (instanceRunning(*inst) && it != inst->resources.end()) {
+                target = std::atoi(it->second.c_str());
+            }
+        }
+    }
+
+    if (name.empty()) {
+        sendError(client, "404 Not Found", "no instance for host " + host);
+    } else if (target <= 0) {
+        sendError(client, "502 Bad Gateway", name + " is not running on a tcpport");
+    } else {
+        relay(client, target, head);
+    }
+}
+
+} // namespace vp
@@ -0,0 +1,74 @@
+#ifndef VP_PROXY_HPP
+#define VP_PROXY_HPP
+
+#include "state.hpp"
+#include <map>
+#include <memory>
+#include <mutex>
+#include <set>
+#include <string>
+#include <vector>
+
+namespace vp {
+
+// Current ${tcpport} of each running instance whose proxy_port is port
+std::vector<int> proxyTargets(const State& state, int port);
+
+// Instance a Host header names: "<name>.<domain>", or "<name>.<project>.<domain>"
+// for project-scoped instances, with any :port ignored. "" if none matches.
+std::string hostInstance(const State& state, const std::string& host,
+                         const std::vector<std::string>& domains);
+
+// PortProxy forwards TCP connections on instances' proxy_port to their current
+// ${tcpport}, looked up per connection, so clients keep one port across restarts
+// on new ports. Instances sharing a proxy_port are balanced round-robin.
+// Listens on bind and serves only clients allow (vp serve --allow) lets in.
+class PortProxy {
+public:
+    explicit PortProxy(std::shared_ptr<State> state, std::string bind = "0.0.0.0",
+                       std::vector<std::string> allow = {})
+        : state_(state), bind_(bind), allow_(allow) {}
+    ~PortProxy();
+
+    // Listen on every proxy_port in state and close listeners no instance uses
+    // any more (call periodically). Returns the ports now listened on.
+    std::vector<int> sync();
+
+private:
+    void acceptLoop(int port, int listener);
+
+    std::shared_ptr<State> state_;
+    std::string bind_;               // Listening address, as vp serve --bind
+    std::vector<std::string> allow_; // Client networks, as vp serve --allow (empty = any)
+    std::mutex mutex_;
+    std::map<int, int> listeners_;  // proxy port -> listening socket
+    std::map<int, size_t> next_;    // proxy port -> round-robin position
+    std::set<int> failed_;          // Ports we could not listen on (warned once)
+};
+
+// HostProxy is an HTTP reverse proxy: requests for <name>.vp.localhost (or the
+// configured domains) go to that instance's current ${tcpport}, so dev services
+// keep a URL across restarts. Connections are relayed as bytes after the first
+// request's headers, so keep-alive and WebSocket upgrades pass through.
+// Like PortProxy it listens on bind and serves only clients allow lets in.
+class HostProxy {
+public:
+    HostProxy(std::shared_ptr<State> state, std::vector<std::string> domains,
+              std::string bind = "0.0.0.0", std::vector<std::string> allow = {})
+        : state_(state), domains_(domains), bind_(bind), allow_(allow) {}
+
+    // Listen on port and serve until the listener fails (blocks)
+    bool serve(int port);
+
+private:
+    void handle(int client);
+
+    std::shared_ptr<State> state_;
+    std::vector<std::string> domains_;
+    std::string bind_;
+    std::vector<std::string> allow_;
+};
+
+} // namespace vp
+
+#endif // VP_PROXY_HPP
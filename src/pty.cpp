@@ -0,0 +1,154 @@
+#include "pty.hpp"
+#include "logger.hpp"
+#include <fcntl.h>
+#include <unistd.h>
+#include <sys/ioctl.h>
+#include <cerrno>
+#include <cstdlib>
+#include <thread>
+
+namespace vp {
+
+static const size_t MAX_SCROLLBACK = 64 * 1024;
+
+static std::mutex g_ptyMutex;
+static std::map<std::string, std::shared_ptr<PtySession>> g_ptys;
+
+PtySession::PtySession(int master, const std::string& logFile) : master_(master), logFile_(logFile) {}
+
+PtySession::~PtySession() {
+    close(master_);
+}
+
+std::string PtySession::scrollback() {
+    std::lock_guard<std::mutex> lock(mutex_);
+    return scrollback_;
+}
+
+int PtySession::subscribe(Listener listener) {
+    std::lock_guard<std::mutex> lock(mutex_);
+    if (closed_) {
+        listener("");
+        return 0;
+    }
+    int id = nextId_++;
+    listeners_[id] = listener;
+    return id;
+}
+
+void PtySession::unsubscribe(int id) {
+    std::lock_guard<std::mutex> lock(mutex_);
+    listeners_.erase(id);
+}
+
+bool PtySession::write(const std::string& data) {
+    size_t done = 0;
+    while (done < data.size()) {
+        ssize_t n = ::write(master_, data.data() + done, data.size() - done);
+        if (n < 0) {
+            if (errno == EINTR) continue;
+            return false;
+        }
+        done += n;
+    }
+    return true;
+}
+
+void PtySession::resize(int cols, int rows) {
+    struct winsize ws = {};
+    ws.ws_col = cols;
+    ws.ws_row = rows;
+    ioctl(master_, TIOCSWINSZ, &ws);
+}
+
+void PtySession::pump() {
+    int log = open(logFile_.c_str(), O_WRONLY | O_CREAT | O_APPEND | O_CLOEXEC, 0644);
+    char buffer[4096];
+
+    while (true) {
+        ssize_t n = read(master_, buffer, sizeof(buffer));
+        if (n < 0 && errno == EINTR) continue;
+        if (n <= 0) break; // EIO once the last slave fd is closed
+
+        std::string data(buffer, n);
+        if (log != -1 && ::write(log, buffer, n) < 0) {
+            logWarn("failed to write pty output to log", {{"path", logFile_}});
+        }
+
+        std::lock_guard<std::mutex> lock(mutex_);
+        scrollback_ += data;
+        if (scrollback_.size() > MAX_SCROLLBACK) {
+            scrollback_.erase(0, scrollback_.size() - MAX_SCROLLBACK);
+        }
+        for (const auto& [id, listener] : listeners_) {
+            listener(data);
+        }
+    }
+
+    if (log != -1) {
+        close(log);
+    }
+
+    std::lock_guard<std::mutex> lock(mutex_);
+    closed_ = true;
+    for (const auto& [id, listener] : listeners_) {
+        listener("");
+    }
+    listeners_.clear();
+}
+
+int openPty(int& slave) {
+    int master = posix_openpt(O_RDWR | O_NOCTTY);
+    if (master == -1) {
+        return -1;
+    }
+    const char* path = nullptr;
+    if (grantpt(master) != 0 || unlockpt(master) != 0 || !(path = ptsname(master))) {
+        close(master);
+        return -1;
+    }
+    slave = open(path, O_RDWR | O_NOCTTY | O_CLOEXEC);
+    if (slave == -1) {
+        close(master);
+        return -1;
+    }
+    fcntl(master, F_SETFD, FD_CLOEXEC); // Other instances must not inherit it
+    return master;
+}
+
+void attachPty(int slave) {
+    setsid(); // New session and process group, like setpgid(0, 0)
+    ioctl(slave, TIOCSCTTY, 0);
+    dup2(slave, STDIN_FILENO);
+    dup2(slave, STDOUT_FILENO);
+    dup2(slave, STDERR_FILENO);
+    if (slave > STDERR_FILENO) {
+        close(slave);
+    }
+}
+
+void registerPty(const std::string& instance, int master, const std::string& logFile) {
+    auto session = std::make_shared<PtySession>(master, logFile);
+    {
+        std::lock_guard<std::mutex> lock(g_ptyMutex);
+        g_ptys[instance] = session;
+    }
+
+    std::thread([instance, session]() {
+        session->pump();
+
+        std::lock_guard<std::mutex> lock(g_ptyMutex);
+        auto it = g_ptys.find(instance);
+        if (it != g_ptys.end() && it->second == session) {
+            g_ptys.erase(it);
+        }
+    }).detach();
+}
+
+std::shared_ptr<PtySession> findPty(const std::string& instance) {
+    std::lock_guard<std::mutex> lock(g_ptyMutex);
+    auto it = g_ptys.find(instance);
+    return it != g_ptys.end() ? it->second : nullptr;
+}
+
+} // namespace vp
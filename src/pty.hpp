@@ -0,0 +1,65 @@
+#ifndef VP_PTY_HPP
+#define VP_PTY_HPP
+
+#include <functional>
+#include <map>
+#include <memory>
+#include <mutex>
+#include <string>
+
+namespace vp {
+
+// PtySession owns the master side of an instance's pseudo-terminal. A reader
+// thread copies output to the instance log, a scrollback buffer and attached
+// terminals. Only a long-running vp (serve) can keep one open.
+class PtySession {
+public:
+    // Called with output; "" means the process side closed
+    using Listener = std::function<void(const std::string& data)>;
+
+    PtySession(int master, const std::string& logFile);
+    ~PtySession();
+
+    // Recent output, so a new terminal shows context
+    std::string scrollback();
+
+    // Attach a listener; returns an id for unsubscribe()
+    int subscribe(Listener listener);
+    void unsubscribe(int id);
+
+    // Send keyboard input to the process
+    bool write(const std::string& data);
+
+    // Set the terminal size (SIGWINCH to the foreground process group)
+    void resize(int cols, int rows);
+
+    // Copy output until the slave side closes; runs on its own thread
+    void pump();
+
+private:
+    int master_;
+    std::string logFile_;
+    std::mutex mutex_;
+    std::string scrollback_;
+    std::map<int, Listener> listeners_;
+    int nextId_ = 1;
+    bool closed_ = false;
+};
+
+// Open a PTY pair (both close-on-exec). Returns the master fd and sets slave, or -1.
+// The parent closes slave after fork(), so the master sees EIO when the child exits.
+int openPty(int& slave);
+
+// In the child after fork(): start a new session with the slave as controlling
+// terminal and stdin/stdout/stderr. Async-signal-safe.
+void attachPty(int slave);
+
+// Register the master fd of a just-forked instance and start pumping its output
+void registerPty(const std::string& instance, int master, const std::string& logFile);
+
+// Session of a PTY-attached instance, or nullptr
+std::shared_ptr<PtySession> findPty(const std::string& instance);
+
+} // namespace vp
+
+#endif // VP_PTY_HPP
@@ -0,0 +1,228 @@
+#include "registration.hpp"
+#include "process.hpp"
+#include "registry.hpp"
+#include "websocket.hpp"
+#include "logger.hpp"
+#include <cstdio>
+#include <map>
+#include <stdexcept>
+#include <unistd.h>
+
+namespace vp {
+
+// Send a JSON request with curl; the response body goes to response
+static bool httpJSON(const std::string& method, const std::string& url, const json& body,
+                     std::string* response = nullptr) {
+    std::string cmd = "curl -fsS --max-time 5 -X " + method +
+                      " -H 'Content-Type: application/json' --data-binary " + shellQuote(body.dump()) +
+                      " " + shellQuote(url) + " 2>/dev/null";
+    FILE* pipe = popen(cmd.c_str(), "r");
+    if (!pipe) return false;
+
+    std::string output;
+    char buffer[4096];
+    size_t n;
+    while ((n = fread(buffer, 1, sizeof(buffer), pipe)) > 0) {
+        output.append(buffer, n);
+    }
+    if (response) *response = output;
+    return pclose(pipe) == 0;
+}
+
+// Consul service IDs end up in URL paths: no '/'
+static std::string consulID(const std::string& name) {
+    std::string id = "vp-" + name;
+    for (char& c : id) {
+        if (c == '/') c = '-';
+    }
+    return id;
+}
+
+json consulService(const Instance& inst, int port, const std::string& address) {
+    json service = {
+        {"ID", consulID(inst.name)},
+        {"Name", inst.template_name.empty() ? inst.name : inst.template_name},
+        {"Port", port},
+        {"Tags", {"vp"}},
+        {"Meta", {{"vp_instance", inst.name}, {"template", inst.template_name}}},
+        // vp reports health through the TTL check; if vp goes away Consul
+        // marks the service critical and eventually drops it
+        {"Check", {{"TTL", "30s"}, {"DeregisterCriticalServiceAfter", "10m"}}}
+    };
+    if (!address.empty()) {
+        service["Address"] = address;
+    }
+    return service;
+}
+
+std::string etcdKey(const std::string& name) {
+    return "/vp/services/" + name;
+}
+
+json etcdValue(const Instance& inst, int port, const std::string& address, bool healthy) {
+    return {
+        {"name", inst.name},
+        {"template", inst.template_name},
+        {"address", address},
+        {"port", port},
+        {"healthy", healthy}
+    };
+}
+
+class ConsulRegistry : public ServiceRegistry {
+public:
+    ConsulRegistry(const std::string& base, const std::string& address) : base_(base), address_(address) {}
+
+    bool publish(const Instance& inst, int port, bool healthy) override {
+        // Registering resets the check to critical: only when new or moved
+        auto it = ports_.find(inst.name);
+        if (it == ports_.end() || it->second != port) {
+            if (!httpJSON("PUT", base_ + "/v1/agent/service/register", consulService(inst, port, address_))) {
+                return false;
+            }
+            ports_[inst.name] = port;
+        }
+
+        if (!httpJSON("PUT", base_ + "/v1/agent/check/update/service:" + consulID(inst.name),
+                      {{"Status", healthy ? "passing" : "critical"}})) {
+            ports_.erase(inst.name); // Agent restarted and forgot it: register again
+            return false;
+        }
+        return true;
+    }
+
+    bool withdraw(const std::string& name) override {
+        ports_.erase(name);
+        return httpJSON("PUT", base_ + "/v1/agent/service/deregister/" + consulID(name), json::object());
+    }
+
+private:
+    std::string base_;
+    std::string address_;
+    std::map<std::string, int> ports_;  // Instance -> port registered with
+};
+
+// etcd v3 through its JSON gateway. Keys are attached to a lease kept alive
+// each round, so they expire if vp stops.
+class EtcdRegistry : public ServiceRegistry {
+public:
+    EtcdRegistry(const std::string& base, const std::string& address) : base_(base), address_(address) {
+        if (address_.empty()) {
+            char host[256] = {};
+            gethostname(host, sizeof(host) - 1);
+            address_ = host;
+        }
+    }
+
+    bool publish(const Instance& inst, int port, bool healthy) override {
+        if (lease_.empty() && !grant()) return false;
+
+        json put = {
+            {"key", base64(etcdKey(inst.name))},
+            {"value", base64(etcdValue(inst, port, address_, healthy).dump())},
+            {"lease", lease_}
+        };
+        return httpJSON("POST", base_ + "/v3/kv/put", put);
+    }
+
+    bool withdraw(const std::string& name) override {
+        return httpJSON("POST", base_ + "/v3/kv/deleterange", {{"key", base64(etcdKey(name))}});
+    }
+
+    void heartbeat() override {
+        if (lease_.empty()) return;
+
+        std::string response;
+        bool ok = httpJSON("POST", base_ + "/v3/lease/keepalive", {{"ID", lease_}}, &response);
+        json reply = json::parse(response, nullptr, false);
+        // An expired lease comes back without a TTL: keys are gone, start over
+        if (!ok || reply.is_discarded() || !reply.contains("result") || !reply["result"].contains("TTL")) {
+            logWarn("etcd lease lost", {{"lease", lease_}});
+            lease_.clear();
+        }
+    }
+
+private:
+    bool grant() {
+        std::string response;
+        if (!httpJSON("POST", base_ + "/v3/lease/grant", {{"TTL", 30}}, &response)) return false;
+
+        json reply = json::parse(response, nullptr, false);
+        if (reply.is_discarded() || !reply.contains("ID")) return false;
+        lease_ = reply["ID"].get<std::string>();
+        return true;
+    }
+
+    std::string base_;
+    std::string address_;
+    std::string lease_;
+};
+
+std::unique_ptr<ServiceRegistry> makeServiceRegistry(const std::string& url, const std::string& address) {
+    size_t sep = url.find("://");
+    std::string scheme = sep == std::string::npos ? "" : url.substr(0, sep);
+    std::string host = sep == std::string::npos ? "" : url.substr(sep + 3);
+    if (host.empty()) {
+        throw std::invalid_argument("expected consul://host:port or etcd://host:port");
+    }
+
+    if (scheme == "consul") {
+        return std::make_unique<ConsulRegistry>("http://" + host, address);
+    }
+    if (scheme == "etcd") {
+        return std::make_unique<EtcdRegistry>("http://" + host, address);
+    }
+    throw std::invalid_argument("unknown registry: " + scheme + " (consul or etcd)");
+}
+
+ServiceRegistration::~ServiceRegistration() {
+    for (const auto& name : registered_) {
+        registry_->withdraw(name);
+    }
+}
+
+int ServiceRegistration::sync() {
+    // Copies: publishing and health checks block, the state stays unlocked
+    std::vector<Instance> instances;
+    {
+        auto data = state_->lock();
+        for (const auto& [name, inst] : state_->instances) {
+            instances.push_back(*inst);
+        }
+    }
+
+    std::set<std::string> running;
+    for (const auto& inst : instances) {
+        const std::string& name = inst.name;
+        auto it = inst.resources.find("tcpport");
+        int port = it != inst.resources.end() ? std::atoi(it->second.c_str()) : 0;
+        if (inst.status != "running" || port <= 0) continue;
+
+        running.insert(name);
+        if (!registry_->publish(inst, port, checkHealth(inst))) {
+            logWarn("service registration failed", {{"instance", name}});
+            continue;
+        }
+        if (registered_.insert(name).second) {
+            logInfo("service registered", {{"instance", name}, {"port", port}});
+        }
+    }
+
+    for (auto it = registered_.begin(); it != registered_.end();) {
+        if (running.count(*it)) {
+            ++it;
+            continue;
+        }
+        if (registry_->withdraw(*it)) {
+            logInfo("service deregistered", {{"instance", *it}});
+            it = registered_.erase(it);
+        } else {
+            ++it; // Retried next round
+        }
+    }
+
+    registry_->heartbeat();
+    return (int)registered_.size();
+}
+
+} // namespace vp
@@ -0,0 +1,60 @@
+#ifndef VP_REGISTRATION_HPP
+#define VP_REGISTRATION_HPP
+
+#include "types.hpp"
+#include "state.hpp"
+#include <memory>
+#include <set>
+#include <string>
+
+namespace vp {
+
+// ServiceRegistry is an external service-discovery system running instances
+// are registered with (serve --register=consul://... or etcd://...)
+class ServiceRegistry {
+public:
+    virtual ~ServiceRegistry() = default;
+
+    // Register an instance serving on port, or refresh it. Called every sync
+    // round for every running instance, so it must be idempotent.
+    virtual bool publish(const Instance& inst, int port, bool healthy) = 0;
+
+    // Remove an instance registered earlier
+    virtual bool withdraw(const std::string& name) = 0;
+
+    // Called once per sync round, after publishing (lease keepalives, TTL checks)
+    virtual void heartbeat() {}
+};
+
+// Registry for consul://host:port or etcd://host:port; address is the IP other
+// hosts reach instances on ("" = the agent's address for Consul, hostname for etcd).
+// Throws std::invalid_argument on other schemes.
+std::unique_ptr<ServiceRegistry> makeServiceRegistry(const std::string& url, const std::string& address);
+
+// Consul agent service definition for an instance (ID "vp-<name>", TTL check)
+json consulService(const Instance& inst, int port, const std::string& address);
+
+// etcd key and value for an instance: /vp/services/<name> -> {name, template, address, port, healthy}
+std::string etcdKey(const std::string& name);
+json etcdValue(const Instance& inst, int port, const std::string& address, bool healthy);
+
+// ServiceRegistration keeps the registry in line with state: running instances
+// with a tcpport are published with their health, stopped ones withdrawn.
+class ServiceRegistration {
+public:
+    ServiceRegistration(std::shared_ptr<State> state, std::shared_ptr<ServiceRegistry> registry)
+        : state_(state), registry_(registry) {}
+    ~ServiceRegistration();
+
+    // Call periodically; returns the number of instances registered
+    int sync();
+
+private:
+    std::shared_ptr<State> state_;
+    std::shared_ptr<ServiceRegistry> registry_;
+    std::set<std::string> registered_;
+};
+
+} // namespace vp
+
+#endif // VP_REGISTRATION_HPP
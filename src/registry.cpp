@@ -0,0 +1,129 @@
+#include "registry.hpp"
+#include "resource.hpp"
+#include "process.hpp"
+#include "alerts.hpp"
+#include <cstdio>
+#include <cstdlib>
+#include <climits>
+#include <fstream>
+#include <sstream>
+#include <stdexcept>
+
+namespace vp {
+
+std::string shellQuote(const std::string& s) {
+    std::string out = "'";
+    for (char c : s) {
+        if (c == '\'') out += "'\\''";
+        else out += c;
+    }
+    return out + "'";
+}
+
+// Run cmd and return its stdout; throws if it exits non-zero
+static std::string runCapture(const std::string& cmd) {
+    FILE* pipe = popen(cmd.c_str(), "r");
+    if (!pipe) {
+        throw std::runtime_error("failed to run: " + cmd);
+    }
+
+    std::string out;
+    char buffer[4096];
+    size_t n;
+    while ((n = fread(buffer, 1, sizeof(buffer), pipe)) > 0) {
+        out.append(buffer, n);
+    }
+
+    if (pclose(pipe) != 0) {
+        throw std::runtime_error("command failed: " + cmd);
+    }
+    return out;
+}
+
+// Split "repo//path" at the "//" that is not part of "scheme://"
+static size_t gitPathSeparator(const std::string& source) {
+    size_t from = 0;
+    size_t scheme = source.find("://");
+    if (scheme != std::string::npos) {
+        from = scheme + 3;
+    }
+    return source.find("//", from);
+}
+
+static bool isURLSource(const std::string& source) {
+    return source.rfind("http://", 0) == 0 || source.rfind("https://", 0) == 0;
+}
+
+bool isGitSource(const std::string& source) {
+    return gitPathSeparator(source) != std::string::npos &&
+           (source.rfind("git@", 0) == 0 || source.find(".git//") != std::string::npos);
+}
+
+std::string fetchSource(const std::string& source) {
+    if (isGitSource(source)) {
+        size_t sep = gitPathSeparator(source);
+        std::string repo = source.substr(0, sep);
+        std::string path = source.substr(sep + 2);
+
+        // The file must be inside the clone
+        std::istringstream parts(path);
+        std::string part;
+        while (std::getline(parts, part, '/')) {
+            if (part == "..") {
+                throw std::runtime_error("path in git source must not contain '..': " + path);
+            }
+        }
+
+        // -- so a repo starting with '-' can't be taken for an option
+        std::string cmd =
+            "d=$(mktemp -d) && "
+            "git clone -q --depth 1 -- " + shellQuote(repo) + " \"$d\" >&2 && "
+            "cat \"$d\"/" + shellQuote(path) + "; rc=$?; rm -rf \"$d\"; exit $rc";
+        return runCapture(cmd);
+    }
+
+    if (isURLSource(source)) {
+        return runCapture("curl -fsSL --max-time 30 " + shellQuote(source));
+    }
+
+    std::ifstream file(source);
+    if (!file.is_open()) {
+        throw std::runtime_error("cannot open file: " + source);
+    }
+    std::ostringstream oss;
+    oss << file.rdbuf();
+    return oss.str();
+}
+
+std::vector<std::shared_ptr<Template>> loadTemplates(const std::string& source) {
+    json j = json::parse(fetchSource(source));
+    if (!j.is_array()) {
+        j = json::array({j});
+    }
+
+    // Record local files by absolute path so update works from any directory
+    std::string recorded = source;
+    char resolved[PATH_MAX];
+    if (!isGitSource(source) && !isURLSource(source) && realpath(source.c_str(), resolved)) {
+        recorded = resolved;
+    }
+
+    std::vector<std::shared_ptr<Template>> result;
+    for (const auto& entry : j) {
+        auto tmpl = std::make_shared<Template>(entry.get<Template>());
+        if (!nameError(tmpl->id, false).empty()) {
+            throw std::runtime_error("template " + nameError(tmpl->id, false));
+        }
+        for (const auto& decl : tmpl->resources) {
+            parseResourceDecl(decl);  // Throws on a bad range
+        }
+        if (tmpl->limits && !tmpl->limits->webhook.empty()) {
+            validateWebhookUrl(tmpl->limits->webhook);
+        }
+        tmpl->source = recorded;
+        result.push_back(tmpl);
+    }
+    return result;
+}
+
+} // namespace vp
@@ -0,0 +1,33 @@
+#ifndef VP_REGISTRY_HPP
+#define VP_REGISTRY_HPP
+
+#include "types.hpp"
+#include <memory>
+#include <string>
+#include <vector>
+
+namespace vp {
+
+// Template sources:
+//   ./qemu.json                               local file
+//   https://example.com/templates/qemu.json   fetched with curl
+//   git@github.com:team/templates.git//qemu.json
+//   https://github.com/team/templates.git//db/postgres.json
+//                                             shallow git clone, then read path
+// A source may hold one template object or an array of them.
+
+// Quote for sh: 'it'\''s'
+std::string shellQuote(const std::string& s);
+
+// Check if source is a git repo//path reference
+bool isGitSource(const std::string& source);
+
+// Fetch the raw contents of a source; throws on failure
+std::string fetchSource(const std::string& source);
+
+// Fetch and parse templates from a source, recording source on each
+std::vector<std::shared_ptr<Template>> loadTemplates(const std::string& source);
+
+} // namespace vp
+
+#endif // VP_REGISTRY_HPP
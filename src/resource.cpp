@@ -1,5 +1,13 @@
 #include "resource.hpp"
+#include "logger.hpp"
+#include "registry.hpp"
+#include "process.hpp"
+#include <algorithm>
 #include <cstdlib>
+#include <mutex>
+#include <netinet/in.h>
+#include <sys/socket.h>
+#include <unistd.h>
 #include <sstream>
 #include <stdexcept>
 
@@ -32,6 +40,16 @@ std::map<std::string, std::shared_ptr<ResourceType>> defaultResourceTypes() {
     serialport->end = 9699;
     types["serialport"] = serialport;
 
+    // Any free port, picked by the kernel: no range to run out of, no check race
+    auto ephemeralport = std::make_shared<ResourceType>();
+    ephemeralport->name = "ephemeralport";
+    ephemeralport->check = "";
+    ephemeralport->counter = false;
+    ephemeralport->start = 0;
+    ephemeralport->end = 0;
+    ephemeralport->ephemeral = true;
+    types["ephemeralport"] = ephemeralport;
+
     auto dbfile = std::make_shared<ResourceType>();
     dbfile->name = "dbfile";
     dbfile->check = "test -f ${value}";
@@ -67,28 +85,167 @@ std::map<std::string, std::shared_ptr<ResourceType>> defaultResourceTypes() {
     return types;
 }
 
-bool checkResource(const ResourceType& rt, const std::string& value) {
+json callAllocator(const ResourceType& rt, const std::string& op, const json& request) {
+    std::string cmd = "printf '%s' " + shellQuote(request.dump()) + " | " + rt.allocator + " " + op;
+    FILE* pipe = popen(cmd.c_str(), "r");
+    if (!pipe) {
+        throw std::runtime_error("cannot run allocator for " + rt.name);
+    }
+
+    std::string output;
+    char buffer[4096];
+    size_t n;
+    while ((n = fread(buffer, 1, sizeof(buffer), pipe)) > 0) {
+        output.append(buffer, n);
+    }
+    int status = pclose(pipe);
+
+    json reply = json::parse(output, nullptr, false);
+    if (reply.is_object() && reply.contains("error")) {
+        throw std::runtime_error(rt.name + " allocator: " + reply["error"].get<std::string>());
+    }
+    if (status != 0) {
+        throw std::runtime_error(rt.name + " allocator " + op + " failed");
+    }
+    if (!reply.is_object()) {
+        throw std::runtime_error(rt.name + " allocator " + op + ": reply is not a JSON object");
+    }
+    return reply;
+}
+
+static std::mutex heldMutex;
+static std::map<std::string, int> heldPorts; // port -> bound socket
+
+// Bind port (0 = any free one) and keep the socket; returns the port, 0 if taken
+static int holdPort(int port) {
+    int fd = socket(AF_INET, SOCK_STREAM | SOCK_CLOEXEC, 0);
+    if (fd == -1) {
+        return 0;
+    }
+    struct sockaddr_in addr = {};
+    addr.sin_family = AF_INET;
+    addr.sin_addr.s_addr = htonl(INADDR_ANY);
+    addr.sin_port = htons(port);
+    socklen_t len = sizeof(addr);
+    if (bind(fd, (struct sockaddr*)&addr, sizeof(addr)) != 0 ||
+        getsockname(fd, (struct sockaddr*)&addr, &len) != 0) {
+        close(fd);
+        return 0;
+    }
+    port = ntohs(addr.sin_port);
+
+    std::lock_guard<std::mutex> lock(heldMutex);
+    auto& held = heldPorts[std::to_string(port)];
+    if (held > 0) close(held);
+    held = fd;
+    return port;
+}
+
+static void dropHeldPort(const std::string& value) {
+    std::lock_guard<std::mutex> lock(heldMutex);
+    auto it = heldPorts.find(value);
+    if (it != heldPorts.end()) {
+        close(it->second);
+        heldPorts.erase(it);
+    }
+}
+
+void dropHeldPorts(const State& state, const Instance& inst) {
+    for (const auto& [rtype, value] : inst.resources) {
+        auto rt = state.types.find(rtype);
+        if (rt != state.types.end() && rt->second->ephemeral) {
+            dropHeldPort(value);
+        }
+    }
+}
+
+void releaseResource(const ResourceType& rt, const std::string& value, const std::string& owner) {
+    if (rt.ephemeral) dropHeldPort(value);
+    if (rt.allocator.empty()) return;
+    try {
+        callAllocator(rt, "release", {{"type", rt.name}, {"value", value}, {"owner", owner}});
+    } catch (const std::exception& e) {
+        logWarn("allocator release failed", {{"type", rt.name}, {"value", value}, {"error", e.what()}});
+    }
+}
+
+bool checkResource(const ResourceType& rt, const std::string& value, const std::string& owner,
+                   const std::map<std::string, std::string>& vars) {
+    std::string project = owner.empty() ? "" : projectOf(owner);
+    if (rt.ephemeral) {
+        // Available if we can bind it, and then it stays ours until exec
+        char* end;
+        long port = strtol(value.c_str(), &end, 10);
+        return !*end && port > 0 && port < 65536 && holdPort((int)port) != 0;
+    }
+    if (!rt.allocator.empty()) {
+        json reply = callAllocator(rt, "check", {{"type", rt.name}, {"value", value}, {"owner", owner}, {"vars", vars}});
+        return reply.value("available", false);
+    }
+
     if (rt.check.empty()) {
         return true; // No check command = always available
     }
 
-    // Interpolate check command
+    // Interpolate check command; our own names win over the owner's vars
+    std::map<std::string, std::string> values = vars;
+    values["value"] = value;
+    values["type"] = rt.name;
+    values["owner"] = owner;
+    values["project"] = project;
+
     std::string check = rt.check;
-    size_t pos = 0;
-    while ((pos = check.find("${value}", pos)) != std::string::npos) {
-        check.replace(pos, 8, value);
-        pos += value.length();
+    for (const auto& [name, v] : values) {
+        std::string placeholder = "${" + name + "}";
+        size_t pos = 0;
+        while ((pos = check.find(placeholder, pos)) != std::string::npos) {
+            check.replace(pos, placeholder.length(), v);
+            pos += v.length();
+        }
     }
 
     // Execute check
-    int result = system(check.c_str());
+    std::string cmd = "export VP_VALUE=" + shellQuote(value) + " VP_TYPE=" + shellQuote(rt.name) +
+                      " VP_OWNER=" + shellQuote(owner) + " VP_PROJECT=" + shellQuote(project) + "; " + check;
+    int result = system(cmd.c_str());
 
     // Natural command behavior: exit 0 = exists/in-use (not available)
     // exit 1 = free/doesn't exist (available)
     return result != 0; // Resource is available if check command fails
 }
 
-std::string allocateResource(std::shared_ptr<State> state, const std::string& rtype, const std::string& requestedValue) {
+// Who value is reserved for (vp reserve), "" if nobody
+static std::string reservedFor(const State& state, const std::string& rtype, const std::string& value) {
+    auto it = state.resources.find(rtype + ":" + value);
+    return it != state.resources.end() && it->second->reserved ? it->second->owner : "";
+}
+
+ResourceDecl parseResourceDecl(const std::string& decl) {
+    ResourceDecl parsed;
+    auto colon = decl.find(':');
+    parsed.type = decl.substr(0, colon);
+    if (colon == std::string::npos) {
+        return parsed;
+    }
+    std::string range = decl.substr(colon + 1);
+    auto dash = range.find('-');
+    bool digits = dash != std::string::npos && dash > 0 && dash + 1 < range.size() &&
+                  range.find_first_not_of("0123456789-") == std::string::npos && range.find('-', dash + 1) == std::string::npos;
+    if (!digits) {
+        throw std::runtime_error("invalid range in resource " + decl + " (expected " + parsed.type + ":START-END)");
+    }
+    parsed.start = std::stoi(range.substr(0, dash));
+    parsed.end = std::stoi(range.substr(dash + 1));
+    if (parsed.start <= 0 || parsed.end < parsed.start) {
+        throw std::runtime_error("invalid range in resource " + decl + " (START must be positive and at most END)");
+    }
+    return parsed;
+}
+
+std::string allocateResource(std::shared_ptr<State> state, const std::string& declared, const std::string& requestedValue,
+                             const std::string& owner, const std::map<std::string, std::string>& vars) {
+    ResourceDecl decl = parseResourceDecl(declared);
+    const std::string& rtype = decl.type;
     auto it = state->types.find(rtype);
     if (it == state->types.end()) {
         throw std::runtime_error("unknown resource type: " + rtype);
@@ -96,19 +253,65 @@ std::string allocateResource(std::shared_ptr<State> state, const std::string& rt
 
     auto rt = it->second;
     std::string value;
+    if (decl.start && (!rt->counter || !rt->allocator.empty() || rt->ephemeral)) {
+        throw std::runtime_error(rtype + " isn't a counter, so " + declared + " has no range to narrow");
+    }
+
+    // A value reserved for this owner is theirs, in place of a fresh one
+    if (requestedValue.empty() && !owner.empty()) {
+        for (const auto& [key, res] : state->resources) {
+            if (!res->reserved || res->type != rtype || res->owner != owner) continue;
+            if (rt->allocator.empty() && !checkResource(*rt, res->value, owner, vars)) {
+                throw std::runtime_error(rtype + " " + res->value + " reserved for " + owner + " is in use");
+            }
+            return res->value;
+        }
+    }
+
+    std::string holder = requestedValue.empty() ? "" : reservedFor(*state, rtype, requestedValue);
+    if (!holder.empty() && holder != owner) {
+        throw std::runtime_error(rtype + " " + requestedValue + " is reserved for " + holder);
+    }
+
+    // The allocator picks (or confirms) the value itself
+    if (!rt->allocator.empty()) {
+        json reply = callAllocator(*rt, "alloc",
+                                   {{"type", rtype}, {"value", requestedValue}, {"owner", owner}, {"vars", vars}});
+        if (!reply.contains("value") || !reply["value"].is_string() || reply["value"].get<std::string>().empty()) {
+            throw std::runtime_error(rtype + " allocator returned no value");
+        }
+        return reply["value"].get<std::string>();
+    }
+
+    // The kernel picks a free port; bound until the child's exec, so no race
+    if (rt->ephemeral && requestedValue.empty()) {
+        int port = holdPort(0);
+        if (port == 0) {
+            throw std::runtime_error("cannot bind an ephemeral port for " + rtype);
+        }
+        return std::to_string(port);
+    }
 
     if (rt->counter && requestedValue.empty()) {
-        // Auto-increment counter
-        int current = state->counters[rtype];
-        if (current == 0) {
-            current = rt->start;
+        // Auto-increment counter; a declared range has its own, which wraps
+        int start = decl.start ? decl.start : rt->start;
+        int end = decl.start ? decl.end : rt->end;
+        std::string counter = decl.start ? rtype + ":" + std::to_string(start) + "-" + std::to_string(end) : rtype;
+        int current = state->counters[counter];
+        if (current == 0 || (decl.start && (current < start || current > end))) {
+            current = start;
         }
 
         bool found = false;
-        for (int v = current; v <= rt->end; v++) {
+        int last = decl.start ? current + (end - start) : end;
+        for (int n = current; n <= last; n++) {
+            int v = n > end ? n - (end - start + 1) : n;
             value = std::to_string(v);
-            if (checkResource(*rt, value)) {
-                state->counters[rtype] = v + 1;
+            if (!reservedFor(*state, rtype, value).empty()) continue;
+            // Having wrapped, skip values still claimed by owners not listening yet
+            if (decl.start && state->resources.count(rtype + ":" + value)) continue;
+            if (checkResource(*rt, value, owner, vars)) {
+                state->counters[counter] = v + 1;
                 found = true;
                 break;
             }
@@ -116,7 +319,7 @@ std::string allocateResource(std::shared_ptr<State> state, const std::string& rt
 
         if (!found) {
             std::stringstream ss;
-            ss << "no available " << rtype << " in range " << rt->start << "-" << rt->end;
+            ss << "no available " << rtype << " in range " << start << "-" << end;
             throw std::runtime_error(ss.str());
         }
     } else {
@@ -127,7 +330,7 @@ std::string allocateResource(std::shared_ptr<State> state, const std::string& rt
             throw std::runtime_error("resource type " + rtype + " requires explicit value");
         }
 
-        if (!checkResource(*rt, value)) {
+        if (!checkResource(*rt, value, owner, vars)) {
             throw std::runtime_error(rtype + " " + value + " not available");
         }
     }
@@ -135,4 +338,60 @@ std::string allocateResource(std::shared_ptr<State> state, const std::string& rt
     return value;
 }
 
+std::string reserveResource(std::shared_ptr<State> state, const std::string& rtype, const std::string& value,
+                            const std::string& owner) {
+    auto held = state->resources.find(rtype + ":" + value);
+    if (!value.empty() && held != state->resources.end() && held->second->owner != owner) {
+        throw std::runtime_error(rtype + " " + value + " is already claimed by " + held->second->owner);
+    }
+    std::string reserved = held != state->resources.end() && held->second->owner == owner
+                               ? value : allocateResource(state, rtype, value, owner);
+    state->claimResource(rtype, reserved, owner, true);
+    return reserved;
+}
+
+std::vector<ResourceUsage> resourceUsage(const State& state) {
+    std::map<std::string, ResourceUsage> byType;
+    for (const auto& [name, rt] : state.types) {
+        ResourceUsage& u = byType[name];
+        u.type = name;
+        u.counter = rt->counter && rt->allocator.empty();
+        if (u.counter) {
+            u.start = rt->start;
+            u.end = rt->end;
+            auto next = state.counters.find(name);
+            u.next = next != state.counters.end() && next->second != 0 ? next->second : rt->start;
+        }
+    }
+    for (const auto& [key, res] : state.resources) {
+        ResourceUsage& u = byType[res->type];
+        u.type = res->type;
+        u.claims.push_back(*res);
+    }
+
+    std::vector<ResourceUsage> usage;
+    for (auto& [name, u] : byType) {
+        std::sort(u.claims.begin(), u.claims.end(), [](const Resource& a, const Resource& b) {
+            char* endA;
+            char* endB;
+            long na = strtol(a.value.c_str(), &endA, 10);
+            long nb = strtol(b.value.c_str(), &endB, 10);
+            if (!*endA && !*endB && !a.value.empty() && !b.value.empty()) return na < nb;
+            return a.value < b.value;
+        });
+        u.claimed = (int)u.claims.size();
+        if (u.counter) {
+            int inRange = 0;
+            for (const auto& res : u.claims) {
+                char* end;
+                long v = strtol(res.value.c_str(), &end, 10);
+                if (!*end && v >= u.start && v <= u.end) inRange++;
+            }
+            u.remaining = std::max(0, u.end - u.start + 1 - inRange);
+        }
+        usage.push_back(u);
+    }
+    return usage;
+}
+
 } // namespace vp
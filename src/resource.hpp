@@ -11,11 +11,77 @@ namespace vp {
 // Get default resource types
 std::map<std::string, std::shared_ptr<ResourceType>> defaultResourceTypes();
 
-// Allocate a resource of the given type
-std::string allocateResource(std::shared_ptr<State> state, const std::string& rtype, const std::string& requestedValue);
+// An entry of a template's resources: a type, optionally with its own range
+// for a counter type ("tcpport:3000-3099"). The template's counter values then
+// come from that range, handed out in turn and reused from its start once it
+// reaches the end, without defining a whole new type.
+struct ResourceDecl {
+    std::string type;
+    int start = 0;  // 0 = the type's own range
+    int end = 0;
+};
 
-// Check if a resource is available using the check command
-bool checkResource(const ResourceType& rt, const std::string& value);
+// Parse "type" or "type:START-END"; throws std::runtime_error on a bad range
+ResourceDecl parseResourceDecl(const std::string& decl);
+
+// Allocate a resource of the given type for owner, whose vars the check command
+// can use. rtype may be a declaration with a range (see ResourceDecl).
+std::string allocateResource(std::shared_ptr<State> state, const std::string& rtype, const std::string& requestedValue,
+                             const std::string& owner = "", const std::map<std::string, std::string>& vars = {});
+
+// Reserve a value (the counter's next free one if empty) for owner ahead of
+// time: allocation skips it for everyone else, the owner's instance gets it in
+// place of a fresh value, and it outlives stops until vp unreserve. A value
+// the owner already holds becomes reserved as is. Returns the value.
+std::string reserveResource(std::shared_ptr<State> state, const std::string& rtype, const std::string& value,
+                            const std::string& owner);
+
+// Check if a resource is available using the check command or allocator.
+// The check command sees ${value}, ${type}, ${owner}, ${project} and the
+// owner's ${vars}; $VP_VALUE, $VP_TYPE, $VP_OWNER and $VP_PROJECT are exported.
+bool checkResource(const ResourceType& rt, const std::string& value, const std::string& owner = "",
+                   const std::map<std::string, std::string>& vars = {});
+
+// Allocator plugins: "<allocator> alloc|release|check" reads a JSON request
+// ({"type", "value", "owner"}) on stdin and writes a JSON reply on stdout.
+// alloc replies {"value": "..."}, check {"available": bool}; a non-zero exit
+// or {"error": "..."} is a failure.
+json callAllocator(const ResourceType& rt, const std::string& op, const json& request);
+
+// Hand a value back to the type's allocator (no-op without one); failures are logged.
+// An ephemeral port still held by vp is let go.
+void releaseResource(const ResourceType& rt, const std::string& value, const std::string& owner);
+
+// Ephemeral port types: allocating binds port 0 (checking binds the given
+// port) on a close-on-exec socket that vp keeps, so nothing else can take the
+// port between allocation and the child's exec, where the kernel closes it.
+// Call this in the parent once the child is forked to drop vp's copy.
+void dropHeldPorts(const State& state, const Instance& inst);
+
+// How much of one resource type is in use (vp resources, /api/resources/usage)
+struct ResourceUsage {
+    std::string type;
+    bool counter = false;          // Counter types have a range
+    int start = 0;
+    int end = 0;
+    int next = 0;                  // Where the counter resumes
+    int claimed = 0;
+    int remaining = -1;            // Unclaimed values in the range; -1 = unbounded
+    std::vector<Resource> claims;  // By value, numerically where they are numbers
+};
+
+inline void to_json(json& j, const ResourceUsage& u) {
+    j = json{{"type", u.type}, {"counter", u.counter}, {"claimed", u.claimed}, {"claims", u.claims}};
+    if (u.counter) {
+        j["start"] = u.start;
+        j["end"] = u.end;
+        j["next"] = u.next;
+    }
+    j["remaining"] = u.remaining >= 0 ? json(u.remaining) : json(nullptr);
+}
+
+// Usage of every type, plus any type that has claims but is no longer defined
+std::vector<ResourceUsage> resourceUsage(const State& state);
 
 } // namespace vp
 
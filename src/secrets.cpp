@@ -0,0 +1,452 @@
+#include "secrets.hpp"
+#include "config.hpp"
+#include "registry.hpp"
+#include "state.hpp"
+#include <cerrno>
+#include <csignal>
+#include <cstdio>
+#include <cstdlib>
+#include <fcntl.h>
+#include <fstream>
+#include <map>
+#include <mutex>
+#include <openssl/evp.h>
+#include <openssl/rand.h>
+#include <pthread.h>
+#include <sys/stat.h>
+#include <sstream>
+#include <stdexcept>
+#include <sys/wait.h>
+#include <thread>
+#include <unistd.h>
+
+namespace vp {
+
+std::string secretKeyPath() {
+    return State::getStateDir() + "/secret.key";
+}
+
+// Create a key file if there is none: 32 random bytes, hex, readable only by us
+static std::string ensureKeyFile(const std::string& path) {
+    if (access(path.c_str(), R_OK) == 0) {
+        return path;
+    }
+
+    unsigned char bytes[32];
+    std::ifstream random("/dev/urandom", std::ios::binary);
+    if (!random.read(reinterpret_cast<char*>(bytes), sizeof(bytes))) {
+        throw std::runtime_error("cannot read /dev/urandom");
+    }
+    std::string hex;
+    char buf[3];
+    for (unsigned char b : bytes) {
+        snprintf(buf, sizeof(buf), "%02x", b);
+        hex += buf;
+    }
+
+    int fd = open(path.c_str(), O_WRONLY | O_CREAT | O_EXCL, 0600);
+    if (fd == -1) {
+        throw std::runtime_error("cannot create " + path);
+    }
+    hex += "\n";
+    bool ok = write(fd, hex.data(), hex.size()) == (ssize_t)hex.size();
+    close(fd);
+    if (!ok) {
+        unlink(path.c_str());
+        throw std::runtime_error("cannot write " + path);
+    }
+    return path;
+}
+
+// Run cmd (through sh, so it must not hold anything secret) with input
+// written to its stdin over a pipe, so the input never appears in an argv
+// (ps, /proc/<pid>/cmdline). Returns its exit code, -1 if it couldn't run or
+// was killed, with what it wrote to stdout in output.
+static int runWithInput(const std::string& cmd, const std::string& input, std::string& output) {
+    int in[2], out[2];
+    if (pipe(in) == -1) {
+        return -1;
+    }
+    if (pipe(out) == -1) {
+        close(in[0]);
+        close(in[1]);
+        return -1;
+    }
+    pid_t pid = fork();
+    if (pid == -1) {
+        close(in[0]);
+        close(in[1]);
+        close(out[0]);
+        close(out[1]);
+        return -1;
+    }
+    if (pid == 0) {
+        dup2(in[0], STDIN_FILENO);
+        dup2(out[1], STDOUT_FILENO);
+        close(in[0]);
+        close(in[1]);
+        close(out[0]);
+        close(out[1]);
+        execl("/bin/sh", "sh", "-c", cmd.c_str(), (char*)nullptr);
+        _exit(127);
+    }
+    close(in[0]);
+    close(out[1]);
+
+    // Written from another thread: the command may fill its stdout before it
+    // has read all of its stdin
+    std::thread writer([fd = in[1], &input]() {
+        sigset_t pipeSignal;
+        sigemptyset(&pipeSignal);
+        sigaddset(&pipeSignal, SIGPIPE);
+        pthread_sigmask(SIG_BLOCK, &pipeSignal, nullptr); // EPIPE, not death, if it exits early
+        size_t done = 0;
+        while (done < input.size()) {
+            ssize_t n = write(fd, input.data() + done, input.size() - done);
+            if (n == -1 && errno == EINTR) continue;
+            if (n <= 0) break;
+            done += n;
+        }
+        close(fd);
+    });
+    char buffer[4096];
+    for (;;) {
+        ssize_t n = read(out[0], buffer, sizeof(buffer));
+        if (n == -1 && errno == EINTR) continue;
+        if (n <= 0) break;
+        output.append(buffer, n);
+    }
+    close(out[0]);
+    writer.join();
+
+    int status;
+    while (waitpid(pid, &status, 0) == -1) {
+        if (errno != EINTR) return -1;
+    }
+    return WIFEXITED(status) ? WEXITSTATUS(status) : -1;
+}
+
+// First line of a key file, which is what keys it (as openssl -pass file: reads it)
+static std::string readKeyLine(const std::string& path) {
+    std::ifstream key(path);
+    std::string line;
+    if (!std::getline(key, line)) {
+        throw std::runtime_error("cannot read " + path);
+    }
+    return line;
+}
+
+// Sealed values (enc: references and the encrypted state file) are
+// "aes256gcm:" + base64(salt | nonce | ciphertext | tag): AES-256-GCM under a
+// PBKDF2-SHA256 key of the secret, so a modified value fails to open rather
+// than decrypting to garbage
+static const std::string SEALED_PREFIX = "aes256gcm:";
+static const int SALT_SIZE = 16, NONCE_SIZE = 12, TAG_SIZE = 16, KDF_ITERATIONS = 200000;
+
+static std::string base64Encode(const std::string& data) {
+    std::string out(4 * ((data.size() + 2) / 3) + 1, '\0');
+    int n = EVP_EncodeBlock(reinterpret_cast<unsigned char*>(&out[0]),
+                            reinterpret_cast<const unsigned char*>(data.data()), data.size());
+    out.resize(n);
+    return out;
+}
+
+static std::string base64Decode(const std::string& text) {
+    if (text.empty() || text.size() % 4 != 0) {
+        throw std::runtime_error("not base64");
+    }
+    std::string out(3 * text.size() / 4, '\0');
+    int n = EVP_DecodeBlock(reinterpret_cast<unsigned char*>(&out[0]),
+                            reinterpret_cast<const unsigned char*>(text.data()), text.size());
+    if (n < 0) {
+        throw std::runtime_error("not base64");
+    }
+    out.resize(n - (text[text.size() - 1] == '=') - (text[text.size() - 2] == '='));
+    return out;
+}
+
+// PBKDF2 is slow on purpose; keys are kept per secret and salt so a save or
+// a restart doesn't pay for it again. sealingSalt is the salt new values
+// under secret use: fresh per process, while every value gets its own nonce.
+static std::mutex keyMutex;
+static std::map<std::pair<std::string, std::string>, std::string> derivedKeys;
+static std::map<std::string, std::string> sealingSalts;
+
+static std::string deriveKey(const std::string& secret, const std::string& salt) {
+    std::lock_guard<std::mutex> lock(keyMutex);
+    auto it = derivedKeys.find({secret, salt});
+    if (it != derivedKeys.end()) {
+        return it->second;
+    }
+    std::string key(32, '\0');
+    if (PKCS5_PBKDF2_HMAC(secret.data(), secret.size(), reinterpret_cast<const unsigned char*>(salt.data()),
+                          salt.size(), KDF_ITERATIONS, EVP_sha256(), key.size(),
+                          reinterpret_cast<unsigned char*>(&key[0])) != 1) {
+        throw std::runtime_error("cannot derive a key");
+    }
+    if (derivedKeys.size() >= 64) derivedKeys.clear();
+    derivedKeys[{secret, salt}] = key;
+    return key;
+}
+
+static std::string randomBytes(int size) {
+    std::string bytes(size, '\0');
+    if (RAND_bytes(reinterpret_cast<unsigned char*>(&bytes[0]), size) != 1) {
+        throw std::runtime_error("no random bytes");
+    }
+    return bytes;
+}
+
+static std::string sealingSalt(const std::string& secret) {
+    std::lock_guard<std::mutex> lock(keyMutex);
+    auto it = sealingSalts.find(secret);
+    if (it == sealingSalts.end()) {
+        it = sealingSalts.emplace(secret, randomBytes(SALT_SIZE)).first;
+    }
+    return it->second;
+}
+
+static std::string sealValue(const std::string& secret, const std::string& plaintext) {
+    std::string salt = sealingSalt(secret);
+    std::string key = deriveKey(secret, salt);
+    std::string nonce = randomBytes(NONCE_SIZE);
+    std::string ciphertext(plaintext.size(), '\0');
+    std::string tag(TAG_SIZE, '\0');
+
+    EVP_CIPHER_CTX* ctx = EVP_CIPHER_CTX_new();
+    int n = 0, rest = 0;
+    bool ok = ctx && EVP_EncryptInit_ex(ctx, EVP_aes_256_gcm(), nullptr, reinterpret_cast<const unsigned char*>(key.data()),
+                                        reinterpret_cast<const unsigned char*>(nonce.data())) == 1 &&
+              EVP_EncryptUpdate(ctx, reinterpret_cast<unsigned char*>(&ciphertext[0]), &n,
+                                reinterpret_cast<const unsigned char*>(plaintext.data()), plaintext.size()) == 1 &&
+              EVP_EncryptFinal_ex(ctx, reinterpret_cast<unsigned char*>(&ciphertext[0]) + n, &rest) == 1 &&
+              EVP_CIPHER_CTX_ctrl(ctx, EVP_CTRL_GCM_GET_TAG, TAG_SIZE, &tag[0]) == 1;
+    EVP_CIPHER_CTX_free(ctx);
+    if (!ok) {
+        throw std::runtime_error("cannot encrypt");
+    }
+    return SEALED_PREFIX + base64Encode(salt + nonce + ciphertext + tag);
+}
+
+// Open a sealed value; throws std::runtime_error if it doesn't authenticate
+// (wrong secret, or modified)
+static std::string openSealed(const std::string& secret, const std::string& sealed) {
+    std::string raw;
+    try {
+        raw = base64Decode(sealed.substr(SEALED_PREFIX.size()));
+    } catch (const std::exception&) {
+        raw.clear();
+    }
+    if (raw.size() < (size_t)(SALT_SIZE + NONCE_SIZE + TAG_SIZE)) {
+        throw std::runtime_error("malformed");
+    }
+    std::string key = deriveKey(secret, raw.substr(0, SALT_SIZE));
+    std::string nonce = raw.substr(SALT_SIZE, NONCE_SIZE);
+    std::string ciphertext = raw.substr(SALT_SIZE + NONCE_SIZE, raw.size() - SALT_SIZE - NONCE_SIZE - TAG_SIZE);
+    std::string tag = raw.substr(raw.size() - TAG_SIZE);
+    std::string plaintext(ciphertext.size(), '\0');
+
+    EVP_CIPHER_CTX* ctx = EVP_CIPHER_CTX_new();
+    int n = 0, rest = 0;
+    bool ok = ctx && EVP_DecryptInit_ex(ctx, EVP_aes_256_gcm(), nullptr, reinterpret_cast<const unsigned char*>(key.data()),
+                                        reinterpret_cast<const unsigned char*>(nonce.data())) == 1 &&
+              EVP_DecryptUpdate(ctx, reinterpret_cast<unsigned char*>(&plaintext[0]), &n,
+                                reinterpret_cast<const unsigned char*>(ciphertext.data()), ciphertext.size()) == 1 &&
+              EVP_CIPHER_CTX_ctrl(ctx, EVP_CTRL_GCM_SET_TAG, TAG_SIZE, &tag[0]) == 1 &&
+              EVP_DecryptFinal_ex(ctx, reinterpret_cast<unsigned char*>(&plaintext[0]) + n, &rest) == 1;
+    EVP_CIPHER_CTX_free(ctx);
+    if (!ok) {
+        throw std::runtime_error("failed its integrity check");
+    }
+    return plaintext;
+}
+
+// Values encrypted by older versions (openssl enc, AES-256-CBC) can't be
+// authenticated: they are only read with VP_STATE_ACCEPT_UNAUTHENTICATED=1
+static bool acceptUnauthenticated() {
+    const char* accept = getenv("VP_STATE_ACCEPT_UNAUTHENTICATED");
+    return accept && std::string(accept) == "1";
+}
+
+// Decrypt an older value with openssl enc; passArg says where the secret is
+static std::string openLegacy(const std::string& passArg, const std::string& ciphertext) {
+    std::string cmd = "openssl enc -d -aes-256-cbc -pbkdf2 -a -A " + passArg + " 2>/dev/null";
+    std::string output;
+    if (runWithInput(cmd, ciphertext, output) != 0) {
+        throw std::runtime_error("cannot decrypt");
+    }
+    return output;
+}
+
+std::string encryptSecret(const std::string& value) {
+    ensureKeyFile(secretKeyPath());
+    return "enc:" + sealValue(readKeyLine(secretKeyPath()), value);
+}
+
+std::string hashPassword(const std::string& password, const std::string& salt) {
+    // openssl reads one line
+    if (password.find_first_of("\r\n") != std::string::npos) {
+        throw std::invalid_argument("password must not contain a newline");
+    }
+    // The password goes over stdin; only the (public) salt is in the command
+    std::string cmd = "openssl passwd -6 -stdin" + (salt.empty() ? "" : " -salt " + shellQuote(salt)) + " 2>/dev/null";
+    std::string output;
+    int code = runWithInput(cmd, password + "\n", output);
+    while (!output.empty() && (output.back() == '\n' || output.back() == '\r')) output.pop_back();
+    if (code != 0 || output.rfind("$6$", 0) != 0) {
+        throw std::runtime_error("openssl passwd failed");
+    }
+    return output;
+}
+
+bool verifyPassword(const std::string& password, const std::string& hash) {
+    size_t end = hash.find('$', 3);
+    if (hash.rfind("$6$", 0) != 0 || end == std::string::npos) {
+        return false;
+    }
+    std::string computed;
+    try {
+        computed = hashPassword(password, hash.substr(3, end - 3));
+    } catch (const std::exception&) {
+        return false;
+    }
+
+    // Constant time, like token checks
+    if (computed.size() != hash.size()) return false;
+    unsigned char diff = 0;
+    for (size_t i = 0; i < hash.size(); i++) {
+        diff |= computed[i] ^ hash[i];
+    }
+    return diff == 0;
+}
+
+std::string resolveSecret(const std::string& ref) {
+    if (ref.rfind("env:", 0) == 0) {
+        const char* value = getenv(ref.substr(4).c_str());
+        if (!value) {
+            throw std::runtime_error("environment variable " + ref.substr(4) + " is not set");
+        }
+        return value;
+    }
+    if (ref.rfind("file:", 0) == 0) {
+        std::ifstream file(ref.substr(5));
+        if (!file.is_open()) {
+            throw std::runtime_error("cannot read " + ref.substr(5));
+        }
+        std::ostringstream ss;
+        ss << file.rdbuf();
+        std::string value = ss.str();
+        if (!value.empty() && value.back() == '\n') value.pop_back();
+        return value;
+    }
+    if (ref.rfind("enc:", 0) == 0) {
+        if (access(secretKeyPath().c_str(), R_OK) != 0) {
+            throw std::runtime_error("no key to decrypt it (" + secretKeyPath() + ")");
+        }
+        std::string blob = ref.substr(4);
+        if (blob.rfind(SEALED_PREFIX, 0) == 0) {
+            try {
+                return openSealed(readKeyLine(secretKeyPath()), blob);
+            } catch (const std::runtime_error& e) {
+                throw std::runtime_error(std::string("cannot decrypt it: ") + e.what() + " (wrong " +
+                                         secretKeyPath() + ", or the value was modified)");
+            }
+        }
+        if (!acceptUnauthenticated()) {
+            throw std::runtime_error("encrypted by an older vp, without an integrity check: re-encrypt it with "
+                                     "vp secret encrypt, or set VP_STATE_ACCEPT_UNAUTHENTICATED=1");
+        }
+        try {
+            return openLegacy("-pass file:" + shellQuote(secretKeyPath()), blob);
+        } catch (const std::runtime_error&) {
+            throw std::runtime_error("cannot decrypt it (wrong " + secretKeyPath() + "?)");
+        }
+    }
+    throw std::runtime_error("not a secret reference (env:, file: or enc:)");
+}
+
+std::string stateKeyPath() {
+    const char* path = getenv("VP_STATE_KEYFILE");
+    return path && *path ? path : configValue("state.keyfile", State::getStateDir() + "/state.key");
+}
+
+static bool havePassphrase() {
+    const char* passphrase = getenv("VP_STATE_PASSPHRASE");
+    return passphrase && *passphrase;
+}
+
+bool stateEncryptionEnabled() {
+    return havePassphrase() || access(stateKeyPath().c_str(), R_OK) == 0;
+}
+
+bool isEncryptedState(const std::string& content) {
+    // Ours, or base64 of openssl's "Salted__" header (older versions)
+    return content.rfind(SEALED_PREFIX, 0) == 0 || content.rfind("U2FsdGVkX1", 0) == 0;
+}
+
+std::string ensureStateKey() {
+    return ensureKeyFile(stateKeyPath());
+}
+
+// What the state is encrypted with: the passphrase wins over the key file
+static std::string stateSecret() {
+    return havePassphrase() ? getenv("VP_STATE_PASSPHRASE") : readKeyLine(stateKeyPath());
+}
+
+void writeEncryptedState(const std::string& path, const std::string& plaintext) {
+    std::string content = sealValue(stateSecret(), plaintext) + "\n";
+
+    int fd = open(path.c_str(), O_WRONLY | O_CREAT | O_TRUNC, 0600);
+    if (fd == -1) {
+        throw std::runtime_error("cannot write " + path);
+    }
+    bool ok = fchmod(fd, 0600) == 0 && write(fd, content.data(), content.size()) == (ssize_t)content.size();
+    ok = close(fd) == 0 && ok;
+    if (!ok) {
+        throw std::runtime_error("cannot write " + path);
+    }
+}
+
+std::string readEncryptedState(const std::string& path) {
+    if (!stateEncryptionEnabled()) {
+        throw std::runtime_error("state is encrypted: set VP_STATE_PASSPHRASE or provide " + stateKeyPath());
+    }
+    std::ifstream file(path);
+    std::string sealed;
+    std::getline(file, sealed);
+    std::string keyName = havePassphrase() ? "VP_STATE_PASSPHRASE" : stateKeyPath();
+
+    if (sealed.rfind(SEALED_PREFIX, 0) == 0) {
+        try {
+            return openSealed(stateSecret(), sealed);
+        } catch (const std::runtime_error&) {
+            throw std::runtime_error("state failed its integrity check (wrong " + keyName + ", or the file was modified)");
+        }
+    }
+
+    // Written by an older vp: only read with consent, the next save seals it
+    if (!acceptUnauthenticated()) {
+        throw std::runtime_error("state has no integrity check (written by an older vp); "
+                                 "set VP_STATE_ACCEPT_UNAUTHENTICATED=1 once to load and re-save it");
+    }
+    try {
+        return openLegacy(havePassphrase() ? "-pass env:VP_STATE_PASSPHRASE" : "-pass file:" + shellQuote(stateKeyPath()),
+                          sealed);
+    } catch (const std::runtime_error&) {
+        throw std::runtime_error("cannot decrypt state (wrong " + keyName + "?)");
+    }
+}
+
+std::map<std::string, std::string> resolveSecrets(const std::map<std::string, std::string>& refs) {
+    std::map<std::string, std::string> values;
+    for (const auto& [name, ref] : refs) {
+        try {
+            values[name] = resolveSecret(ref);
+        } catch (const std::exception& e) {
+            throw std::runtime_error("secret " + name + ": " + e.what());
+        }
+    }
+    return values;
+}
+
+} // namespace vp
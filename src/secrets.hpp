@@ -0,0 +1,67 @@
+#ifndef VP_SECRETS_HPP
+#define VP_SECRETS_HPP
+
+#include <map>
+#include <string>
+
+namespace vp {
+
+// Template secrets are references, never values, so state.json, the API and
+// vp inspect only ever show the reference:
+//   env:VAR     vp's own environment variable VAR
+//   file:/path  the file's contents (one trailing newline dropped)
+//   enc:BLOB    encrypted with vp secret encrypt (AES-256-GCM, key in secret.key)
+// They are resolved when an instance starts and go into its environment only.
+
+// Resolve one reference; throws std::runtime_error saying what is missing
+std::string resolveSecret(const std::string& ref);
+
+// Resolve every NAME -> reference; errors name the secret
+std::map<std::string, std::string> resolveSecrets(const std::map<std::string, std::string>& refs);
+
+// Encrypt a value into an enc: reference, creating the key on first use
+std::string encryptSecret(const std::string& value);
+
+// Key for enc: references (<state dir>/secret.key, mode 0600)
+std::string secretKeyPath();
+
+// Encrypted state at rest: state.json is sealed with AES-256-GCM (key from
+// PBKDF2-SHA256) when $VP_STATE_PASSPHRASE is set or the state key file
+// exists, so a modified file is refused rather than read. The key file is
+// $VP_STATE_KEYFILE, or <state dir>/state.key; keep it elsewhere (or use the
+// passphrase) if the disk itself is what you are protecting against.
+
+// Key file used for state encryption
+std::string stateKeyPath();
+
+// True when saves should be encrypted
+bool stateEncryptionEnabled();
+
+// True when content is an encrypted state file rather than JSON
+bool isEncryptedState(const std::string& content);
+
+// Create the state key file if there is none; returns its path
+std::string ensureStateKey();
+
+// Encrypt plaintext into path; throws std::runtime_error on failure
+void writeEncryptedState(const std::string& path, const std::string& plaintext);
+
+// Verify and decrypt the state file at path; throws std::runtime_error saying
+// which key is missing or wrong, or that the file was modified. Files from an
+// older vp (AES-256-CBC, unauthenticated) load only with
+// VP_STATE_ACCEPT_UNAUTHENTICATED=1, as do its enc: references
+std::string readEncryptedState(const std::string& path);
+
+// Web UI passwords are stored as SHA-512 crypt hashes ($6$salt$hash, as in
+// /etc/shadow), computed by openssl passwd.
+
+// Hash a password with a random salt, or the given one; throws
+// std::runtime_error if openssl fails, std::invalid_argument on a newline
+std::string hashPassword(const std::string& password, const std::string& salt = "");
+
+// Check a password against a hashPassword hash
+bool verifyPassword(const std::string& password, const std::string& hash);
+
+} // namespace vp
+
+#endif // VP_SECRETS_HPP
@@ -1,11 +1,27 @@
 #include "state.hpp"
 #include "resource.hpp"
+#include "logger.hpp"
+#include "secrets.hpp"
+#include "profile.hpp"
+#include "config.hpp"
+#include "process.hpp"
+#include "logs.hpp"
 #include <fstream>
+#include <sstream>
+#include <algorithm>
+#include <functional>
+#include <set>
+#include <thread>
+#include <cstdio>
+#include <cctype>
+#include <ctime>
 #include <sys/stat.h>
+#include <fcntl.h>
+#ifdef __linux__
 #include <sys/inotify.h>
+#endif
 #include <unistd.h>
 #include <pwd.h>
-#include <iostream>
 
 namespace vp {
 
@@ -15,15 +31,40 @@ State::State() : inotify_fd_(-1), watch_fd_(-1) {
 }
 
 State::~State() {
+#ifdef __linux__
     if (watch_fd_ != -1) {
         inotify_rm_watch(inotify_fd_, watch_fd_);
     }
+#endif
     if (inotify_fd_ != -1) {
         close(inotify_fd_);
     }
 }
 
 std::string State::getStateDir() {
+    if (const char* dir = getenv("VP_STATE_DIR")) {
+        if (*dir) return dir;
+    }
+    return getProfileDir(currentProfile());
+}
+
+std::string State::getProfileDir(const std::string& profile) {
+    if (profile == "default") {
+        return getBaseDir();
+    }
+    return getBaseDir() + "/profiles/" + profile;
+}
+
+void State::ensureStateDir() {
+    std::string dir = getStateDir();
+    if (getenv("VP_STATE_DIR") == nullptr || !*getenv("VP_STATE_DIR")) {
+        mkdir(getBaseDir().c_str(), 0755);
+        mkdir((getBaseDir() + "/profiles").c_str(), 0755);
+    }
+    mkdir(dir.c_str(), 0755);
+}
+
+std::string State::getBaseDir() {
     const char* home = getenv("HOME");
     if (!home) {
         struct passwd* pw = getpwuid(getuid());
@@ -33,94 +74,467 @@ std::string State::getStateDir() {
             home = "/tmp";
         }
     }
-    return std::string(home) + "/.vibeprocess";
+    std::string dir = configValue("state.dir");
+    if (dir.rfind("~/", 0) == 0) {
+        dir = home + dir.substr(1);
+    }
+    return dir.empty() ? std::string(home) + "/.vibeprocess" : dir;
 }
 
 std::string State::getStateFilePath() {
     return getStateDir() + "/state.json";
 }
 
-std::shared_ptr<State> State::load() {
-    auto state = std::make_shared<State>();
-
-    std::string stateFile = getStateFilePath();
-    std::ifstream file(stateFile);
+// Go's encoding/json writes nil maps and slices as null, which from_json
+// can't read: required collections become empty, other nulls are dropped so
+// the field keeps its default
+static void dropNulls(json& section, const std::map<std::string, json>& required) {
+    if (!section.is_object()) return;
+    for (auto& [name, entry] : section.items()) {
+        if (!entry.is_object()) continue;
+        for (auto it = entry.begin(); it != entry.end();) {
+            if (!it->is_null()) {
+                ++it;
+            } else if (required.count(it.key())) {
+                *it = required.at(it.key());
+                ++it;
+            } else {
+                it = entry.erase(it);
+            }
+        }
+    }
+}
 
-    if (!file.is_open()) {
-        // Return defaults if file doesn't exist
-        return state;
+// Go's time.Time is RFC 3339 text ("2024-05-01T12:00:00.5+02:00"); we keep
+// Unix seconds
+static time_t parseRFC3339(const std::string& text) {
+    struct tm tm = {};
+    const char* rest = strptime(text.c_str(), "%Y-%m-%dT%H:%M:%S", &tm);
+    if (!rest) return 0;
+    time_t t = timegm(&tm);
+    while (*rest == '.' || isdigit((unsigned char)*rest)) rest++;
+    int hours, minutes;
+    if ((*rest == '+' || *rest == '-') && sscanf(rest + 1, "%d:%d", &hours, &minutes) == 2) {
+        t -= (*rest == '+' ? 1 : -1) * (hours * 3600 + minutes * 60);
     }
+    return t;
+}
 
-    try {
-        json j;
-        file >> j;
-
-        // Load instances
-        if (j.contains("instances") && j["instances"].is_object()) {
-            for (auto& [key, value] : j["instances"].items()) {
-                auto inst = std::make_shared<Instance>();
-                *inst = value.get<Instance>();
-                state->instances[key] = inst;
+// Files without a schema_version: this C++ vp before versioning, or the Go vp
+static void migrateV0(json& j) {
+    if (j.contains("instances")) {
+        dropNulls(j["instances"], {{"resources", json::object()}});
+        for (auto& [name, inst] : j["instances"].items()) {
+            if (inst.is_object() && inst.contains("started") && inst["started"].is_string()) {
+                inst["started"] = parseRFC3339(inst["started"].get<std::string>());
             }
         }
+    }
+    if (j.contains("templates")) {
+        dropNulls(j["templates"], {{"resources", json::array()}, {"vars", json::object()}});
+    }
+    if (j.contains("types")) {
+        dropNulls(j["types"], {});
+    }
+    for (const char* key : {"instances", "templates", "resources", "counters", "types"}) {
+        if (j.contains(key) && j[key].is_null()) {
+            j.erase(key);
+        }
+    }
+}
 
-        // Load templates
-        if (j.contains("templates") && j["templates"].is_object()) {
-            for (auto& [key, value] : j["templates"].items()) {
-                auto tmpl = std::make_shared<Template>();
-                *tmpl = value.get<Template>();
-                state->templates[key] = tmpl;
-            }
+// The first key like key (key, key-2, ...) not in taken, which then has it
+static std::string freeName(std::set<std::string>& taken, const std::string& key) {
+    std::string name = key;
+    for (int n = 2; taken.count(name); n++) {
+        name = key + "-" + std::to_string(n);
+    }
+    taken.insert(name);
+    return name;
+}
+
+// vp run's templates are "run-" and their instance's flattened name
+static std::string runTemplateName(std::string name) {
+    std::replace(name.begin(), name.end(), '/', '-');
+    return "run-" + name;
+}
+
+// Version 1 took any name. Instances and templates whose names nameError
+// rejects get their normalizeName form, and what refers to them follows.
+static void migrateV1(json& j) {
+    json empty = json::object();
+    json& instances = j.contains("instances") && j["instances"].is_object() ? j["instances"] : empty;
+    json& templates = j.contains("templates") && j["templates"].is_object() ? j["templates"] : empty;
+
+    std::set<std::string> takenTemplates;
+    for (const auto& [id, tmpl] : templates.items()) takenTemplates.insert(id);
+    auto renameTemplate = [&](const std::string& from, const std::string& to) {
+        json tmpl = templates[from];
+        templates.erase(from);
+        if (tmpl.is_object()) tmpl["id"] = to;
+        templates[to] = tmpl;
+        for (auto& [name, inst] : instances.items()) {
+            if (inst.is_object() && inst.value("template_name", "") == from) inst["template_name"] = to;
         }
+        logWarn("renamed template with an invalid ID", {{"from", from}, {"to", to}});
+    };
 
-        // Load resources
+    std::set<std::string> takenInstances;
+    std::vector<std::string> invalid;
+    for (const auto& [name, inst] : instances.items()) {
+        takenInstances.insert(name);
+        if (!nameError(name).empty()) invalid.push_back(name);
+    }
+    for (const auto& from : invalid) {
+        std::string to = freeName(takenInstances, normalizeName(from));
+        json inst = instances[from];
+        instances.erase(from);
+        if (inst.is_object()) {
+            inst["name"] = to;
+            if (!projectOf(to).empty()) inst["project"] = projectOf(to);
+        }
+        instances[to] = inst;
         if (j.contains("resources") && j["resources"].is_object()) {
-            for (auto& [key, value] : j["resources"].items()) {
-                auto res = std::make_shared<Resource>();
-                *res = value.get<Resource>();
-                state->resources[key] = res;
+            for (auto& [key, res] : j["resources"].items()) {
+                if (res.is_object() && res.value("owner", "") == from) res["owner"] = to;
             }
         }
-
-        // Load counters
-        if (j.contains("counters") && j["counters"].is_object()) {
-            state->counters = j["counters"].get<std::map<std::string, int>>();
+        if (j.contains("timelines") && j["timelines"].is_object() && j["timelines"].contains(from)) {
+            j["timelines"][to] = j["timelines"][from];
+            j["timelines"].erase(from);
         }
+        logWarn("renamed instance with an invalid name", {{"from", from}, {"to", to}});
 
-        // Load types
-        if (j.contains("types") && j["types"].is_object()) {
-            for (auto& [key, value] : j["types"].items()) {
-                auto rt = std::make_shared<ResourceType>();
-                *rt = value.get<ResourceType>();
-                state->types[key] = rt;
+        // Its logs too. A running process keeps writing to the renamed file
+        // through its open fd, and its VP_INSTANCE marker (kept as it was) still
+        // finds it again
+        std::string oldLog = logPath(from);
+        for (const auto& path : instanceLogs(from)) {
+            std::string moved = logPath(to) + path.substr(oldLog.size());
+            if (access(moved.c_str(), F_OK) != 0 && rename(path.c_str(), moved.c_str()) != 0) {
+                logWarn("cannot move log", {{"from", path}, {"to", moved}});
             }
         }
 
-        // Load remotes_allowed
-        if (j.contains("remotes_allowed") && j["remotes_allowed"].is_object()) {
-            state->remotesAllowed = j["remotes_allowed"].get<std::map<std::string, bool>>();
+        // Its vp run template goes with it
+        std::string runFrom = runTemplateName(from);
+        if (templates.contains(runFrom)) {
+            takenTemplates.erase(runFrom);
+            renameTemplate(runFrom, freeName(takenTemplates, runTemplateName(to)));
+        }
+    }
+
+    // vp run's IDs carry their instance's whole name, so may be longer
+    auto validId = [](const std::string& id) {
+        if (id.rfind("run-", 0) != 0) {
+            return nameError(id, false).empty();
+        }
+        return std::all_of(id.begin(), id.end(), [](char c) {
+            return isalnum((unsigned char)c) || c == '.' || c == '_' || c == '-';
+        });
+    };
+    std::vector<std::string> invalidIds;
+    for (const auto& [id, tmpl] : templates.items()) {
+        if (!validId(id)) invalidIds.push_back(id);
+    }
+    for (const auto& from : invalidIds) {
+        takenTemplates.erase(from);
+        renameTemplate(from, freeName(takenTemplates, normalizeName(from, false)));
+    }
+}
+
+// migrations[N] takes a version N file to N + 1; append one (and bump
+// SCHEMA_VERSION) whenever save() changes the format incompatibly
+static const std::vector<std::function<void(json&)>> migrations = {
+    migrateV0,
+    migrateV1,
+};
+
+int State::migrate(json& j) {
+    int version = j.value("schema_version", 0);
+    if (version > SCHEMA_VERSION) {
+        throw std::runtime_error("state file is schema version " + std::to_string(version) +
+                                 ", newer than this vp understands (" + std::to_string(SCHEMA_VERSION) +
+                                 "); upgrade vp");
+    }
+    for (int v = version; v < SCHEMA_VERSION; v++) {
+        migrations[v](j);
+    }
+    j["schema_version"] = SCHEMA_VERSION;
+    return version;
+}
+
+// Fill state from the state file's JSON
+static void readState(State* state, const json& j) {
+    // Load instances
+    if (j.contains("instances") && j["instances"].is_object()) {
+        for (auto& [key, value] : j["instances"].items()) {
+            auto inst = std::make_shared<Instance>();
+            *inst = value.get<Instance>();
+            state->instances[key] = inst;
+        }
+    }
+
+    // Load templates
+    if (j.contains("templates") && j["templates"].is_object()) {
+        for (auto& [key, value] : j["templates"].items()) {
+            auto tmpl = std::make_shared<Template>();
+            *tmpl = value.get<Template>();
+            state->templates[key] = tmpl;
+        }
+    }
+
+    // Load resources
+    if (j.contains("resources") && j["resources"].is_object()) {
+        for (auto& [key, value] : j["resources"].items()) {
+            auto res = std::make_shared<Resource>();
+            *res = value.get<Resource>();
+            state->resources[key] = res;
+        }
+    }
+
+    // Load counters
+    if (j.contains("counters") && j["counters"].is_object()) {
+        state->counters = j["counters"].get<std::map<std::string, int>>();
+    }
+
+    // Load types
+    if (j.contains("types") && j["types"].is_object()) {
+        for (auto& [key, value] : j["types"].items()) {
+            auto rt = std::make_shared<ResourceType>();
+            *rt = value.get<ResourceType>();
+            state->types[key] = rt;
+        }
+    }
+
+    // Load remotes_allowed
+    if (j.contains("remotes_allowed") && j["remotes_allowed"].is_object()) {
+        state->remotesAllowed = j["remotes_allowed"].get<std::map<std::string, bool>>();
+    }
+
+    // Load log_policy
+    if (j.contains("log_policy") && j["log_policy"].is_object()) {
+        state->logPolicy = j["log_policy"].get<LogPolicy>();
+    }
+    state->pruneAfter = j.value("prune_after", 0L);
+    if (j.contains("discover_on") && j["discover_on"].is_object()) {
+        state->discoverOn = j["discover_on"].get<std::map<std::string, std::string>>();
+    }
+
+    // Load tokens
+    if (j.contains("tokens") && j["tokens"].is_object()) {
+        state->tokens = j["tokens"].get<std::map<std::string, ApiToken>>();
+    }
+    if (j.contains("users") && j["users"].is_object()) {
+        state->users = j["users"].get<std::map<std::string, WebUser>>();
+    }
+
+    // Load action_runs
+    if (j.contains("action_runs") && j["action_runs"].is_array()) {
+        state->actionRuns = j["action_runs"].get<std::vector<ActionRun>>();
+    }
+
+    // Load alerts
+    if (j.contains("alerts") && j["alerts"].is_object()) {
+        state->alerts = j["alerts"].get<std::map<std::string, AlertRule>>();
+    }
+
+    // Load discovery_sources
+    if (j.contains("discovery_sources") && j["discovery_sources"].is_object()) {
+        state->discoverySources = j["discovery_sources"].get<std::map<std::string, std::string>>();
+    }
+
+    // Load events
+    if (j.contains("events") && j["events"].is_array()) {
+        state->events = j["events"].get<std::vector<Event>>();
+    }
+
+    // Load timelines
+    if (j.contains("timelines") && j["timelines"].is_object()) {
+        state->timelines = j["timelines"].get<std::map<std::string, std::vector<StatusChange>>>();
+    }
+}
+
+std::shared_ptr<State> State::load() {
+    auto state = std::make_shared<State>();
+
+    std::string stateFile = getStateFilePath();
+    bool legacy = false;
+    std::ifstream file(stateFile);
+
+    if (!file.is_open()) {
+        // The Go vp kept its state in ~/.config/vp
+        const char* home = getenv("HOME");
+        const char* dir = getenv("VP_STATE_DIR");
+        if (home && !(dir && *dir) && currentProfile() == "default") {
+            stateFile = std::string(home) + "/.config/vp/state.json";
+            file.open(stateFile);
+            legacy = file.is_open();
+        }
+        if (!legacy) {
+            // Return defaults if file doesn't exist
+            applyConfig(*state);
+            applyProfile(*state);
+            return state;
         }
+    }
+    std::stringstream buffer;
+    buffer << file.rdbuf();
+    std::string content = buffer.str();
 
+    // Never fall back to defaults: the next save would replace whatever is
+    // there with an empty state
+    bool encrypted = isEncryptedState(content);
+    if (encrypted) {
+        content = readEncryptedState(stateFile);
+    }
+    json j;
+    try {
+        j = json::parse(content);
+    } catch (const json::exception& e) {
+        throw std::runtime_error("cannot parse " + stateFile + (encrypted ? " (wrong key?)" : "") + ": " +
+                                 e.what() + "; fix or move it aside to start over");
+    }
+    state->schemaVersion = migrate(j);
+    try {
+        readState(state.get(), j);
     } catch (const std::exception& e) {
-        std::cerr << "Error parsing state file: " << e.what() << std::endl;
-        // Return default state on parse error
+        throw std::runtime_error("cannot read " + stateFile + ": " + e.what() + "; fix or move it aside to start over");
     }
 
+    applyConfig(*state);
+    applyProfile(*state);
+
+    if (legacy) {
+        if (state->save()) {
+            logInfo("migrated legacy state", {{"from", stateFile}, {"to", getStateFilePath()}});
+        }
+    }
     return state;
 }
 
-bool State::save() {
+void DataLock::lock() {
+    std::unique_lock<std::mutex> guard(mutex_);
+    auto self = std::this_thread::get_id();
+    free_.wait(guard, [&] { return depth_ == 0 || owner_ == self; });
+    owner_ = self;
+    depth_++;
+}
+
+bool DataLock::try_lock() {
+    std::lock_guard<std::mutex> guard(mutex_);
+    auto self = std::this_thread::get_id();
+    if (depth_ > 0 && owner_ != self) {
+        return false;
+    }
+    owner_ = self;
+    depth_++;
+    return true;
+}
+
+void DataLock::unlock() {
+    std::lock_guard<std::mutex> guard(mutex_);
+    if (--depth_ == 0) {
+        owner_ = std::thread::id();
+        free_.notify_all();
+    }
+}
+
+int DataLock::release() {
+    std::lock_guard<std::mutex> guard(mutex_);
+    if (depth_ == 0 || owner_ != std::this_thread::get_id()) {
+        return 0;
+    }
+    int depth = depth_;
+    depth_ = 0;
+    owner_ = std::thread::id();
+    free_.notify_all();
+    return depth;
+}
+
+void DataLock::reacquire(int depth) {
+    if (depth == 0) {
+        return;
+    }
+    std::unique_lock<std::mutex> guard(mutex_);
+    free_.wait(guard, [&] { return depth_ == 0; });
+    owner_ = std::this_thread::get_id();
+    depth_ = depth;
+}
+
+void State::recordStatus(const std::string& name, const std::string& from, const std::string& to,
+                         const std::string& cause) {
+    auto data = lock();
+    auto& timeline = timelines[name];
+    timeline.push_back({time(nullptr), from, to, cause});
+    if (timeline.size() > TIMELINE_SIZE) {
+        timeline.erase(timeline.begin());
+    }
+}
+
+std::shared_ptr<Instance> State::findInstance(const std::string& name) {
+    auto data = lock();
+    auto it = instances.find(name);
+    return it == instances.end() ? nullptr : it->second;
+}
+
+std::vector<std::shared_ptr<Instance>> State::instanceList() {
+    auto data = lock();
+    std::vector<std::shared_ptr<Instance>> list;
+    for (const auto& [name, inst] : instances) {
+        list.push_back(inst);
+    }
+    return list;
+}
+
+void State::putInstance(std::shared_ptr<Instance> inst) {
+    auto data = lock();
+    instances[inst->name] = inst;
+}
+
+bool State::eraseInstance(const std::string& name) {
+    auto data = lock();
+    return instances.erase(name) > 0;
+}
+
+std::shared_ptr<Template> State::findTemplate(const std::string& id) {
+    auto data = lock();
+    auto it = templates.find(id);
+    return it == templates.end() ? nullptr : it->second;
+}
+
+void State::beginSaveBatch() {
     std::lock_guard<std::mutex> lock(mutex_);
+    saveBatch_++;
+}
 
-    std::string stateDir = getStateDir();
+bool State::endSaveBatch() {
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (--saveBatch_ > 0 || !savePending_) {
+            return true;
+        }
+        savePending_ = false;
+    }
+    return save();
+}
+
+bool State::save() {
+    auto data = lock();
+    std::lock_guard<std::mutex> guard(mutex_);
+    if (saveBatch_ > 0) {
+        savePending_ = true;
+        return true;
+    }
 
     // Create directory if it doesn't exist
-    mkdir(stateDir.c_str(), 0755);
+    ensureStateDir();
 
     std::string stateFile = getStateFilePath();
 
     try {
         json j;
+        j["schema_version"] = SCHEMA_VERSION;
 
         // Serialize instances
         json instances_json = json::object();
@@ -151,30 +565,158 @@ bool State::save() {
         for (const auto& [key, value] : types) {
             types_json[key] = *value;
         }
-        j["types"] = types_json;
 
         // Serialize remotes_allowed
         j["remotes_allowed"] = remotesAllowed;
 
-        // Write to file
-        std::ofstream file(stateFile);
-        if (!file.is_open()) {
-            return false;
+        // Serialize log_policy
+        LogPolicy policy = logPolicy;
+        long prune = pruneAfter;
+
+        // Put back what the config file overrode, unless it was changed since
+        const ConfigOverlay& overlay = configOverlay;
+        auto tcpport = types.find("tcpport");
+        if (overlay.ports && tcpport != types.end() &&
+            tcpport->second->start == overlay.start && tcpport->second->end == overlay.end) {
+            types_json["tcpport"]["start"] = overlay.savedStart;
+            types_json["tcpport"]["end"] = overlay.savedEnd;
+            int next = counters.count("tcpport") ? counters.at("tcpport") : 0;
+            if (next < overlay.savedStart || next > overlay.savedEnd) {
+                j["counters"]["tcpport"] = overlay.savedCounter;
+            }
+        }
+        for (const auto& origin : overlay.origins) {
+            auto it = remotesAllowed.find(origin);
+            if (it != remotesAllowed.end() && it->second) j["remotes_allowed"].erase(origin);
+        }
+        if (overlay.logs) {
+            if (policy.max_size == overlay.configLogs.max_size) policy.max_size = overlay.logs->max_size;
+            if (policy.max_files == overlay.configLogs.max_files) policy.max_files = overlay.logs->max_files;
+            if (policy.max_age == overlay.configLogs.max_age) policy.max_age = overlay.logs->max_age;
+            if (policy.compress == overlay.configLogs.compress) policy.compress = overlay.logs->compress;
+        }
+        if (overlay.pruneAfter && prune == overlay.configPruneAfter) prune = *overlay.pruneAfter;
+
+        j["types"] = types_json;
+        j["log_policy"] = policy;
+        if (prune > 0) j["prune_after"] = prune;
+        if (!discoverOn.empty()) j["discover_on"] = discoverOn;
+
+        // Serialize tokens
+        j["tokens"] = tokens;
+        if (!users.empty()) j["users"] = users;
+
+        // Serialize action_runs
+        j["action_runs"] = actionRuns;
+
+        // Serialize alerts
+        j["alerts"] = alerts;
+
+        // Serialize events
+        j["events"] = events;
+
+        // Timelines of the instances that still exist
+        for (auto it = timelines.begin(); it != timelines.end();) {
+            it = instances.count(it->first) ? std::next(it) : timelines.erase(it);
         }
+        if (!timelines.empty()) j["timelines"] = timelines;
 
-        file << j.dump(2);  // Pretty print with 2-space indent
-        file.close();
+        // Serialize discovery_sources
+        j["discovery_sources"] = discoverySources;
 
-        chmod(stateFile.c_str(), 0600);
+        // Write to a temp file and rename, so readers never see a partial file
+        std::string content = j.dump(2);  // Pretty print with 2-space indent
+        std::string tmpFile = stateFile + ".tmp";
+        if (stateEncryptionEnabled()) {
+            writeEncryptedState(tmpFile, content);
+        } else {
+            std::ofstream file(tmpFile);
+            if (!file.is_open()) {
+                return false;
+            }
+
+            file << content;
+            file.close();
+        }
+
+        chmod(tmpFile.c_str(), 0600);
+        if (rename(tmpFile.c_str(), stateFile.c_str()) != 0) {
+            return false;
+        }
+        size_t hash = std::hash<std::string>()(content);
+        if (savedHashes_.empty() || savedHashes_.back() != hash) {
+            std::vector<StateChange> changes;
+            static const std::vector<std::pair<std::string, std::string>> sections = {
+                {"instance", "instances"}, {"template", "templates"}, {"type", "types"},
+                {"token", "tokens"}, {"user", "users"}, {"remote", "remotes_allowed"}, {"alert", "alerts"},
+                {"discovery_source", "discovery_sources"}};
+            for (const auto& [kind, key] : sections) {
+                const json& before = savedSections_.contains(key) ? savedSections_[key] : json::object();
+                for (const auto& [name, value] : j[key].items()) {
+                    if (!before.contains(name)) {
+                        changes.push_back({kind, name, "added"});
+                    } else if (before[name] != value) {
+                        changes.push_back({kind, name, "changed"});
+                    }
+                }
+                for (const auto& [name, value] : before.items()) {
+                    if (!j[key].contains(name)) {
+                        changes.push_back({kind, name, "removed"});
+                    }
+                }
+            }
+            if (savedSections_.contains("log_policy") && savedSections_["log_policy"] != j["log_policy"]) {
+                changes.push_back({"log_policy", "", "changed"});
+            }
+            savedSections_ = j;
+            bumpRevision(changes);
+        }
+        savedHashes_.push_back(hash);
+        if (savedHashes_.size() > 16) {
+            savedHashes_.pop_front();
+        }
 
         return true;
 
     } catch (const std::exception& e) {
-        std::cerr << "Error saving state: " << e.what() << std::endl;
+        logError("failed to save state", {{"error", e.what()}});
         return false;
     }
 }
 
+static constexpr size_t CHANGE_LOG_SIZE = 1024;
+
+void State::bumpRevision(const std::vector<StateChange>& changes) {
+    unsigned long long revision = ++revision_;
+    for (const auto& change : changes) {
+        changeLog_.push_back({revision, change});
+    }
+    while (changeLog_.size() > CHANGE_LOG_SIZE) {
+        logStart_ = changeLog_.front().revision;
+        changeLog_.pop_front();
+    }
+    revisionChanged_.notify_all();
+}
+
+std::vector<RevisionChange> State::changesSince(unsigned long long since, bool& complete) {
+    std::lock_guard<std::mutex> lock(mutex_);
+    std::vector<RevisionChange> result;
+    complete = since >= logStart_;
+    for (const auto& entry : changeLog_) {
+        if (entry.revision > since) {
+            result.push_back(entry);
+        }
+    }
+    return result;
+}
+
+bool State::waitForRevision(unsigned long long since, int timeoutMs) {
+    Unlocked unlocked(*this); // The revision moves on only when others can save
+    std::unique_lock<std::mutex> guard(mutex_);
+    return revisionChanged_.wait_for(guard, std::chrono::milliseconds(timeoutMs),
+                                     [&] { return revision_ > since; });
+}
+
 std::string State::toJson() const {
     // This method is now deprecated in favor of direct JSON serialization in save()
     return "{}";
@@ -185,28 +727,59 @@ bool State::fromJson(const std::string& /*json_str*/) {
     return true;
 }
 
-void State::claimResource(const std::string& rtype, const std::string& value, const std::string& owner) {
-    std::lock_guard<std::mutex> lock(mutex_);
+void State::claimResource(const std::string& rtype, const std::string& value, const std::string& owner,
+                          bool reserved) {
+    auto data = lock();
 
     std::string key = rtype + ":" + value;
+    auto existing = resources.find(key);
+    if (existing != resources.end() && existing->second->reserved && existing->second->owner == owner) {
+        reserved = true;
+    }
     auto res = std::make_shared<Resource>();
     res->type = rtype;
     res->value = value;
     res->owner = owner;
+    res->reserved = reserved;
     resources[key] = res;
 }
 
-void State::releaseResources(const std::string& owner) {
-    std::lock_guard<std::mutex> lock(mutex_);
+bool State::unreserveResource(const std::string& rtype, const std::string& value) {
+    auto data = lock();
+    auto it = resources.find(rtype + ":" + value);
+    if (it == resources.end() || !it->second->reserved) {
+        return false;
+    }
+    auto res = it->second;
+    resources.erase(it);
 
+    auto t = types.find(rtype);
+    if (t != types.end()) {
+        releaseResource(*t->second, res->value, res->owner);
+    }
+    return true;
+}
+
+void State::releaseResources(const std::string& owner) {
+    auto data = lock();
+    std::vector<std::shared_ptr<Resource>> released;
     auto it = resources.begin();
     while (it != resources.end()) {
-        if (it->second->owner == owner) {
+        if (it->second->owner == owner && !it->second->reserved) {
+            released.push_back(it->second);
             it = resources.erase(it);
         } else {
             ++it;
         }
     }
+
+    // Plugin-backed values go back to their allocator
+    for (const auto& res : released) {
+        auto t = types.find(res->type);
+        if (t != types.end()) {
+            releaseResource(*t->second, res->value, owner);
+        }
+    }
 }
 
 void State::loadDefaultTemplates() {
@@ -238,35 +811,227 @@ void State::loadDefaultResourceTypes() {
     types = defaultResourceTypes();
 }
 
+template <typename T>
+static json asJson(const std::shared_ptr<T>& value) {
+    return *value;
+}
+
+template <typename T>
+static json asJson(const T& value) {
+    return value;
+}
+
+// Replace current with next, recording added/removed/changed keys
+template <typename T>
+static void applyMap(const std::string& kind, std::map<std::string, T>& current,
+                     const std::map<std::string, T>& next, std::vector<StateChange>& changes) {
+    for (const auto& [key, value] : next) {
+        auto it = current.find(key);
+        if (it == current.end()) {
+            changes.push_back({kind, key, "added"});
+        } else if (asJson(it->second) != asJson(value)) {
+            changes.push_back({kind, key, "changed"});
+        }
+    }
+    for (const auto& [key, value] : current) {
+        if (!next.count(key)) {
+            changes.push_back({kind, key, "removed"});
+        }
+    }
+    current = next;
+}
+
+static bool runningHere(const Instance& inst) {
+    return inst.pid > 0 && (instanceUp(inst) || inst.status == "orphaned");
+}
+
+std::vector<StateChange> State::reload() {
+    std::vector<StateChange> changes;
+
+    std::ifstream file(getStateFilePath());
+    if (!file.is_open()) {
+        return changes;
+    }
+    std::stringstream buffer;
+    buffer << file.rdbuf();
+    std::string content = buffer.str();
+
+    auto data = lock();
+    State next;
+    try {
+        if (isEncryptedState(content)) {
+            content = readEncryptedState(getStateFilePath());
+        }
+        json j = json::parse(content);
+        next.schemaVersion = migrate(j);
+        readState(&next, j);
+        applyConfig(next);
+    } catch (const std::exception& e) {
+        // Keep what we have rather than fall back to defaults
+        logWarn("ignoring unreadable state file", {{"error", e.what()}});
+        return changes;
+    }
+
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (std::find(savedHashes_.begin(), savedHashes_.end(), std::hash<std::string>()(content)) != savedHashes_.end()) {
+            return changes; // Our own write
+        }
+
+        // Instances: take the file's config, but keep what only we know about
+        // processes we are supervising
+        std::map<std::string, std::shared_ptr<Instance>> merged = next.instances;
+        for (const auto& [name, inst] : instances) {
+            if (!runningHere(*inst)) continue;
+
+            auto it = merged.find(name);
+            if (it == merged.end()) {
+                logWarn("instance removed from state file while running, keeping it", {{"instance", name}});
+                merged[name] = inst;
+            } else if (it->second->pid == 0 || it->second->pid == inst->pid) {
+                auto updated = std::make_shared<Instance>(*it->second);
+                updated->pid = inst->pid;
+                updated->status = inst->status;
+                updated->started = inst->started;
+                updated->cpu_time = inst->cpu_time;
+                updated->cpu_percent = inst->cpu_percent;
+                updated->cpu_sampled = inst->cpu_sampled;
+                updated->rss = inst->rss;
+                updated->over_limit = inst->over_limit;
+                updated->children = inst->children;
+                updated->error = inst->error;
+                updated->restarts = inst->restarts;
+                updated->failed_checks = inst->failed_checks;
+                updated->backoff = inst->backoff;
+                updated->restarted_at = inst->restarted_at;
+                updated->restart_reason = inst->restart_reason;
+                it->second = updated;
+            }
+        }
+        // Update instances in place: reaper and watcher threads hold on to them
+        auto previous = instances;
+        applyMap("instance", instances, merged, changes);
+        for (auto& [name, inst] : instances) {
+            auto it = previous.find(name);
+            if (it != previous.end() && it->second != inst) {
+                *it->second = *inst;
+                inst = it->second;
+            }
+        }
+
+        applyMap("template", templates, next.templates, changes);
+        applyMap("type", types, next.types, changes);
+        applyMap("token", tokens, next.tokens, changes);
+        applyMap("user", users, next.users, changes);
+        applyMap("remote", remotesAllowed, next.remotesAllowed, changes);
+        applyMap("alert", alerts, next.alerts, changes);
+        applyMap("discovery_source", discoverySources, next.discoverySources, changes);
+
+        if (json(logPolicy) != json(next.logPolicy)) {
+            changes.push_back({"log_policy", "", "changed"});
+            logPolicy = next.logPolicy;
+        }
+        pruneAfter = next.pruneAfter;
+        discoverOn = next.discoverOn;
+        configOverlay = next.configOverlay;
+
+        // Resources: the file's claims plus those of instances we kept
+        for (const auto& [key, res] : resources) {
+            auto owner = instances.find(res->owner);
+            if (owner != instances.end() && runningHere(*owner->second)) {
+                next.resources[key] = res;
+            }
+        }
+        resources = next.resources;
+
+        // Counters only move forward
+        for (const auto& [name, value] : next.counters) {
+            counters[name] = std::max(counters[name], value);
+        }
+
+        // Action runs: union by id, ours win (they may still be running)
+        std::map<int, ActionRun> runs;
+        for (const auto& run : next.actionRuns) runs[run.id] = run;
+        for (const auto& run : actionRuns) runs[run.id] = run;
+        actionRuns.clear();
+        for (const auto& [id, run] : runs) actionRuns.push_back(run);
+
+        // Events: union by id
+        std::map<int, Event> merged_events;
+        for (const auto& event : next.events) merged_events[event.id] = event;
+        for (const auto& event : events) merged_events[event.id] = event;
+        events.clear();
+        for (const auto& [id, event] : merged_events) events.push_back(event);
+
+        // Timelines: union of both, in time order
+        for (const auto& [name, changes] : next.timelines) {
+            auto& timeline = timelines[name];
+            for (const auto& change : changes) {
+                bool known = std::any_of(timeline.begin(), timeline.end(), [&](const StatusChange& c) {
+                    return c.time == change.time && c.to == change.to && c.cause == change.cause;
+                });
+                if (!known) timeline.push_back(change);
+            }
+            std::stable_sort(timeline.begin(), timeline.end(),
+                             [](const StatusChange& a, const StatusChange& b) { return a.time < b.time; });
+            if (timeline.size() > TIMELINE_SIZE) {
+                timeline.erase(timeline.begin(), timeline.end() - TIMELINE_SIZE);
+            }
+        }
+        bumpRevision(changes);
+    }
+
+    if (onChange) {
+        for (const auto& change : changes) {
+            onChange(change);
+        }
+    }
+    return changes;
+}
+
 bool State::watchConfig() {
+#ifndef __linux__
+    return false; // inotify is Linux-only
+#else
     inotify_fd_ = inotify_init();
     if (inotify_fd_ == -1) {
         return false;
     }
 
-    std::string stateFile = getStateFilePath();
+    // Watch the directory: save() replaces the file by rename, and editors
+    // often do the same, so a watch on the file itself would go stale
     std::string stateDir = getStateDir();
-
-    // Try to watch the file first
-    watch_fd_ = inotify_add_watch(inotify_fd_, stateFile.c_str(), IN_MODIFY | IN_CREATE);
+    ensureStateDir();
+    watch_fd_ = inotify_add_watch(inotify_fd_, stateDir.c_str(), IN_CLOSE_WRITE | IN_MOVED_TO);
 
     if (watch_fd_ == -1) {
-        // If file doesn't exist, watch the directory
-        mkdir(stateDir.c_str(), 0755);
-        watch_fd_ = inotify_add_watch(inotify_fd_, stateDir.c_str(), IN_MODIFY | IN_CREATE);
-
-        if (watch_fd_ == -1) {
-            close(inotify_fd_);
-            inotify_fd_ = -1;
-            return false;
-        }
+        close(inotify_fd_);
+        inotify_fd_ = -1;
+        return false;
     }
 
-    // Start watcher thread
-    // TODO: Implement file watching thread
-    // For now, just return success
+    std::thread([this]() {
+        alignas(struct inotify_event) char buffer[4096];
+        while (true) {
+            ssize_t len = read(inotify_fd_, buffer, sizeof(buffer));
+            if (len <= 0) return;
+
+            bool stateChanged = false;
+            for (char* p = buffer; p < buffer + len;) {
+                auto* event = reinterpret_cast<struct inotify_event*>(p);
+                if (event->len > 0 && std::string(event->name) == "state.json") {
+                    stateChanged = true;
+                }
+                p += sizeof(struct inotify_event) + event->len;
+            }
+            if (stateChanged) {
+                reload();
+            }
+        }
+    }).detach();
 
     return true;
+#endif
 }
 
 } // namespace vp
@@ -2,42 +2,210 @@
 #define VP_STATE_HPP
 
 #include "types.hpp"
+#include <atomic>
+#include <condition_variable>
+#include <deque>
+#include <functional>
 #include <mutex>
 #include <memory>
+#include <thread>
+#include <vector>
 
 namespace vp {
 
-// State holds all application state
+// StateChange is one difference picked up by State::reload
+struct StateChange {
+    std::string kind;  // instance|template|type|token|remote|alert|log_policy
+    std::string name;
+    std::string op;    // added|removed|changed
+};
+
+// RevisionChange is a StateChange recorded with the revision it produced
+struct RevisionChange {
+    unsigned long long revision;
+    StateChange change;
+};
+
+// DataLock is State's re-entrant lock over its data. Unlike a
+// std::recursive_mutex, a thread can give up every level it holds for a
+// blocking wait and take them back afterwards (State::Unlocked).
+class DataLock {
+public:
+    void lock();
+    void unlock();
+    bool try_lock();
+
+    // Release all levels this thread holds and return how many (0 if none)
+    int release();
+
+    // Take back the levels release() returned
+    void reacquire(int depth);
+
+private:
+    std::mutex mutex_;
+    std::condition_variable free_;
+    std::thread::id owner_;
+    int depth_ = 0;
+};
+
+// State holds all application state. Threads that touch its data (the HTTP
+// server's, vp serve's loops, reapers, jobs) hold lock() while they do; it is
+// re-entrant, and lifecycle operations take it themselves. Anything that
+// blocks for long while holding it steps out with an Unlocked.
 class State {
 public:
     State();
     ~State();
 
-    // Load state from ~/.vibeprocess/state.json
+    // Version of the state file format save() writes
+    static constexpr int SCHEMA_VERSION = 2;
+
+    // Status changes kept per instance (timelines)
+    static constexpr size_t TIMELINE_SIZE = 200;
+
+    // Load state from ~/.vibeprocess/state.json, migrating older formats (and
+    // a Go-era ~/.config/vp/state.json). Throws std::runtime_error rather than
+    // start from defaults when the file cannot be decrypted, parsed or is newer
+    // than this vp.
     static std::shared_ptr<State> load();
 
-    // Save state to ~/.vibeprocess/state.json
+    // Upgrade a state file's JSON in place to SCHEMA_VERSION; returns the
+    // version it was at. Throws std::runtime_error if it is newer.
+    static int migrate(json& j);
+
+    // Save state to ~/.vibeprocess/state.json (encrypted when enabled)
     bool save();
 
-    // Resource management
-    void claimResource(const std::string& rtype, const std::string& value, const std::string& owner);
+    // Hold off save()s until the matching endSaveBatch(), which then saves once
+    // if any were asked for: operations on many instances write the file once,
+    // not per instance. Nests; see SaveBatch.
+    void beginSaveBatch();
+    bool endSaveBatch();
+
+    // Resource management. Claiming a value the owner has reserved keeps the
+    // reservation, and releaseResources leaves reservations in place.
+    void claimResource(const std::string& rtype, const std::string& value, const std::string& owner,
+                       bool reserved = false);
     void releaseResources(const std::string& owner);
 
-    // Watch config file for changes and reload automatically
+    // Drop a reservation made with vp reserve; false if there is none
+    bool unreserveResource(const std::string& rtype, const std::string& value);
+
+    // Merge external edits of the state file into memory. Runtime fields
+    // (pid, status, metrics) of instances running here are kept, and running
+    // instances missing from the file are not dropped. Returns what changed.
+    std::vector<StateChange> reload();
+
+    // Watch the state file and reload() on external changes (Linux only)
     bool watchConfig();
 
-    // State data
+    // Called for each change applied by reload()
+    std::function<void(const StateChange&)> onChange;
+
+    // Bumped by every save() that changes the content and every reload() that
+    // picks up an external edit; the API's ETag
+    unsigned long long revision() const { return revision_; }
+
+    // Changes after revision since, oldest first. complete is false when the
+    // log no longer reaches back that far (the caller should re-read everything).
+    std::vector<RevisionChange> changesSince(unsigned long long since, bool& complete);
+
+    // Block until revision() passes since or timeoutMs elapses; true if it did
+    bool waitForRevision(unsigned long long since, int timeoutMs);
+
+    // Hold the data lock for the returned guard's lifetime
+    std::unique_lock<DataLock> lock() { return std::unique_lock<DataLock>(data_); }
+
+    // Give up the data lock, if this thread holds it, for the Unlocked's
+    // lifetime: around sleeps, waits on processes and probes
+    class Unlocked {
+    public:
+        explicit Unlocked(State& state) : lock_(state.data_), depth_(lock_.release()) {}
+        ~Unlocked() { lock_.reacquire(depth_); }
+        Unlocked(const Unlocked&) = delete;
+        Unlocked& operator=(const Unlocked&) = delete;
+
+    private:
+        DataLock& lock_;
+        int depth_;
+    };
+
+    // Add a status change to instance name's timeline, keeping the last TIMELINE_SIZE
+    void recordStatus(const std::string& name, const std::string& from, const std::string& to,
+                      const std::string& cause);
+
+    // Locked accessors for callers that only need one lookup or change
+    std::shared_ptr<Instance> findInstance(const std::string& name);
+    std::vector<std::shared_ptr<Instance>> instanceList();
+    void putInstance(std::shared_ptr<Instance> inst);
+    bool eraseInstance(const std::string& name);
+    std::shared_ptr<Template> findTemplate(const std::string& id);
+
+    // State data (hold lock() to use directly)
     std::map<std::string, std::shared_ptr<Instance>> instances;
     std::map<std::string, std::shared_ptr<Template>> templates;
     std::map<std::string, std::shared_ptr<Resource>> resources;    // type:value -> Resource
     std::map<std::string, int> counters;                            // counter_name -> current
     std::map<std::string, std::shared_ptr<ResourceType>> types;    // Resource type definitions
     std::map<std::string, bool> remotesAllowed;                    // origin -> allowed
+    LogPolicy logPolicy;                                           // Global log rotation/retention
+    long pruneAfter = 0;                                           // vp serve prunes instances stopped this long (s, 0 = never)
+    std::map<std::string, std::string> discoverOn;                 // CLI command -> discovery depth (off|status|full, "*" = rest)
+    std::vector<ActionRun> actionRuns;                             // Recent action runs, oldest first
+    std::map<std::string, ApiToken> tokens;                        // API tokens by name (none = open API)
+    std::map<std::string, WebUser> users;                          // Web UI logins by username
+    std::map<std::string, AlertRule> alerts;                       // Alert rules by ID
+    std::vector<Event> events;                                     // Recent events, oldest first
+    std::map<std::string, std::vector<StatusChange>> timelines;    // Instance -> status changes, oldest first
+    std::map<std::string, std::string> discoverySources;           // Extra discovery sources: name -> command
+    int schemaVersion = SCHEMA_VERSION;                            // Version the file was at when loaded
+
+    // What applyConfig() laid over the state file. Config is never saved:
+    // save() writes the file's own values back wherever the config's still
+    // hold, so unsetting a key undoes it on the next load.
+    struct ConfigOverlay {
+        std::vector<std::string> origins;      // auth.origins the file didn't have
+        bool ports = false;                    // ports.start replaced tcpport's range
+        int start = 0, end = 0;                // ...the range config set
+        int savedStart = 0, savedEnd = 0;      // ...and the file's range and counter
+        int savedCounter = 0;
+        std::optional<LogPolicy> logs;         // The file's policy, if logs.* changed it
+        LogPolicy configLogs;                  // ...and what config made it
+        std::optional<long> pruneAfter;        // The file's, if logs.prune-after set it
+        long configPruneAfter = 0;
+    };
+    ConfigOverlay configOverlay;
+
+    // Get state directory ($VP_STATE_DIR, else the selected profile's)
+    static std::string getStateDir();
+
+    // ~/.vibeprocess (or the config file's state.dir), the default profile's
+    // directory and parent of the others
+    static std::string getBaseDir();
+
+    // Directory a profile's state lives in
+    static std::string getProfileDir(const std::string& profile);
+
+    // Create the state directory (and a profile's parents) if missing
+    static void ensureStateDir();
 
 private:
-    std::mutex mutex_;
+    DataLock data_;
+    std::mutex mutex_;        // Guards the revision log below
+    int saveBatch_ = 0;       // Open beginSaveBatch() calls
+    bool savePending_ = false; // save() was asked for during the batch
     int inotify_fd_;
     int watch_fd_;
+    std::deque<size_t> savedHashes_; // Hashes of recent save()s, so our own writes don't trigger
+                                     // reloads even when their events arrive late
+    std::atomic<unsigned long long> revision_{1};
+    std::deque<RevisionChange> changeLog_;  // Last CHANGE_LOG_SIZE changes, for watchers
+    unsigned long long logStart_ = 1;       // changeLog_ has every change after this revision
+    json savedSections_;                    // What save() last wrote, to diff against
+    std::condition_variable revisionChanged_;
+
+    // Record changes under a new revision (mutex_ held)
+    void bumpRevision(const std::vector<StateChange>& changes);
 
     // Load default templates
     void loadDefaultTemplates();
@@ -53,7 +221,18 @@ private:
 
     // Get state file path
     static std::string getStateFilePath();
-    static std::string getStateDir();
+};
+
+// SaveBatch holds a State's saves for its lifetime (State::beginSaveBatch)
+class SaveBatch {
+public:
+    explicit SaveBatch(State& state) : state_(state) { state_.beginSaveBatch(); }
+    ~SaveBatch() { state_.endSaveBatch(); }
+    SaveBatch(const SaveBatch&) = delete;
+    SaveBatch& operator=(const SaveBatch&) = delete;
+
+private:
+    State& state_;
 };
 
 } // namespace vp
@@ -0,0 +1,72 @@
+#include "systemd.hpp"
+#include <cstddef>
+#include <cstdlib>
+#include <cstring>
+#include <fcntl.h>
+#include <sys/socket.h>
+#include <sys/un.h>
+#include <unistd.h>
+
+namespace vp {
+
+static constexpr int SD_LISTEN_FDS_START = 3;
+
+// Whether $LISTEN_PID / $WATCHDOG_PID (if set) names this process
+static bool meantForUs(const char* pidVar) {
+    const char* pid = getenv(pidVar);
+    return !pid || std::atol(pid) == (long)getpid();
+}
+
+std::vector<int> listenFds() {
+    std::vector<int> fds;
+    const char* count = getenv("LISTEN_FDS");
+    if (count && getenv("LISTEN_PID") && meantForUs("LISTEN_PID")) {
+        int n = std::atoi(count);
+        for (int fd = SD_LISTEN_FDS_START; fd < SD_LISTEN_FDS_START + n; fd++) {
+            fcntl(fd, F_SETFD, FD_CLOEXEC);
+            fds.push_back(fd);
+        }
+    }
+    unsetenv("LISTEN_PID");
+    unsetenv("LISTEN_FDS");
+    unsetenv("LISTEN_FDNAMES");
+    return fds;
+}
+
+bool sdNotify(const std::string& state) {
+    const char* path = getenv("NOTIFY_SOCKET");
+    if (!path || (path[0] != '/' && path[0] != '@')) {
+        return false;
+    }
+
+    struct sockaddr_un addr;
+    memset(&addr, 0, sizeof(addr));
+    addr.sun_family = AF_UNIX;
+    size_t len = strlen(path);
+    if (len >= sizeof(addr.sun_path)) {
+        return false;
+    }
+    memcpy(addr.sun_path, path, len);
+    if (path[0] == '@') {
+        addr.sun_path[0] = '\0'; // Abstract namespace
+    }
+
+    int fd = socket(AF_UNIX, SOCK_DGRAM, 0);
+    if (fd == -1) {
+        return false;
+    }
+    socklen_t addrLen = offsetof(struct sockaddr_un, sun_path) + len;
+    ssize_t sent = sendto(fd, state.data(), state.size(), 0, (struct sockaddr*)&addr, addrLen);
+    close(fd);
+    return sent == (ssize_t)state.size();
+}
+
+long long watchdogUsec() {
+    const char* usec = getenv("WATCHDOG_USEC");
+    if (!usec || !meantForUs("WATCHDOG_PID")) {
+        return 0;
+    }
+    return std::atoll(usec);
+}
+
+} // namespace vp
@@ -0,0 +1,25 @@
+#ifndef VP_SYSTEMD_HPP
+#define VP_SYSTEMD_HPP
+
+#include <string>
+#include <vector>
+
+namespace vp {
+
+// Sockets passed by systemd socket activation: fds 3.. when LISTEN_PID is us
+// and LISTEN_FDS says how many. Empty when not socket-activated. The variables
+// are unset so instances started later don't inherit them.
+std::vector<int> listenFds();
+
+// Send a state to the service manager over $NOTIFY_SOCKET: "READY=1",
+// "STOPPING=1", "WATCHDOG=1", "STATUS=...". Returns false when not running
+// under systemd (or the send failed).
+bool sdNotify(const std::string& state);
+
+// Microseconds within which systemd expects a WATCHDOG=1 ping (WatchdogSec=),
+// or 0 when the watchdog is off or meant for another process
+long long watchdogUsec();
+
+} // namespace vp
+
+#endif // VP_SYSTEMD_HPP
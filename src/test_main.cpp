@@ -3,11 +3,44 @@
 #include "process.hpp"
 #include "resource.hpp"
 #include "procutil.hpp"
+#include "fakeproc.hpp"
+#include "logger.hpp"
+#include "registry.hpp"
+#include "logs.hpp"
+#include "api.hpp"
+#include "pty.hpp"
+#include "websocket.hpp"
+#include "metrics.hpp"
+#include "alerts.hpp"
+#include "proxy.hpp"
+#include "mdns.hpp"
+#include "registration.hpp"
+#include "systemd.hpp"
+#include "manager.hpp"
+#include "discovery.hpp"
+#include "secrets.hpp"
+#include "profile.hpp"
+#include "helper.hpp"
+#include "config.hpp"
+#include <fstream>
+#include <set>
+#include <cmath>
 #include <unistd.h>
 #include <signal.h>
 #include <sys/wait.h>
 #include <thread>
 #include <chrono>
+#include <algorithm>
+#include <cstring>
+#include <sys/socket.h>
+#include <netinet/in.h>
+#include <arpa/inet.h>
+#include <poll.h>
+#include <sys/stat.h>
+#include <sys/un.h>
+#include <utime.h>
+#include <fcntl.h>
+#include <ifaddrs.h>
 
 using namespace vp;
 using namespace vp::test;
@@ -33,6 +66,35 @@ void killTestProcess(pid_t pid) {
     }
 }
 
+// Installs a FakeProcessInspector for the lifetime of the guard
+struct FakeProc {
+    FakeProcessInspector* fake;
+    std::unique_ptr<ProcessInspector> previous;
+
+    FakeProc() {
+        auto inspector = std::make_unique<FakeProcessInspector>();
+        fake = inspector.get();
+        previous = setProcessInspector(std::move(inspector));
+    }
+
+    ~FakeProc() {
+        setProcessInspector(std::move(previous));
+    }
+
+    void add(int pid, int ppid, const std::string& name, const std::string& cmdline,
+             double cpu = 0, long rss = 0, unsigned long long start = 1) {
+        ProcessInfo info = {};
+        info.pid = pid;
+        info.ppid = ppid;
+        info.name = name;
+        info.cmdline = cmdline;
+        info.cpu_time = cpu;
+        info.rss = rss;
+        info.start_time = start;
+        fake->addProcess(info);
+    }
+};
+
 TEST(EmptyStateNoError) {
     auto state = State::load();
     bool result = matchAndUpdateInstances(state);
@@ -165,6 +227,416 @@ TEST(StartAndStopProcess) {
     }
 }
 
+TEST(ArgvTemplateRunsWithoutShell) {
+    auto state = std::make_shared<State>();
+    Template tmpl = json::parse(R"({
+        "id": "argv", "label": "argv", "resources": [], "vars": {},
+        "command": ["/bin/sh", "-c", "printf %%s \"$1\" > \"$0\"", "${out}", "${msg}"]
+    })").get<Template>();
+    assertEqual(5, (int)tmpl.argv.size(), "Array command kept as arguments");
+    assertTrue(json(tmpl)["command"].is_array(), "Saved as an array");
+
+    std::string out = "/tmp/vp-argv-test-" + std::to_string(getpid());
+    std::string msg = "it's a $HOME \"test\" ; true";
+    auto inst = startProcess(state, tmpl, "argv-test", {{"out", out}, {"msg", msg}});
+    assertEqual(msg, inst->argv[4], "Each argument interpolated on its own");
+    assertEqual("/bin/sh -c 'printf %s \"$1\" > \"$0\"' " + out + " 'it'\\''s a $HOME \"test\" ; true'",
+                inst->command, "Displayed shell-quoted");
+
+    waitForInstance([&]() { return inst; }, "stopped", 2000);
+    std::ifstream file(out);
+    std::string written((std::istreambuf_iterator<char>(file)), std::istreambuf_iterator<char>());
+    assertEqual(msg, written, "Argument reaches the process untouched");
+    unlink(out.c_str());
+}
+
+TEST(TemplateCwdUmaskAndStdio) {
+    auto state = std::make_shared<State>();
+    char dir[] = "/tmp/vp-cwd-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+
+    Template tmpl;
+    tmpl.id = "stdio";
+    tmpl.command = "pwd; touch made; echo oops >&2";
+    tmpl.cwd = "${dir}";
+    tmpl.umask = "077";
+    tmpl.stdout_path = "out-${name}.txt";
+    tmpl.stderr_path = std::string(dir) + "/err.txt";
+
+    auto inst = startProcess(state, tmpl, "stdio-test", {{"dir", dir}, {"name", "a"}});
+    assertEqual(std::string(dir), inst->cwd, "Cwd interpolated");
+    waitForInstance([&]() { return inst; }, "stopped", 2000);
+
+    auto slurp = [](const std::string& path) {
+        std::ifstream file(path);
+        return std::string((std::istreambuf_iterator<char>(file)), std::istreambuf_iterator<char>());
+    };
+    assertEqual(std::string(dir) + "\n", slurp(std::string(dir) + "/out-a.txt"), "Stdout to a file under cwd");
+    assertEqual("oops\n", slurp(std::string(dir) + "/err.txt"), "Stderr to its own file");
+    struct stat st;
+    assertTrue(stat((std::string(dir) + "/made").c_str(), &st) == 0 && (st.st_mode & 0777) == 0600, "Umask applied");
+
+    // Restarts run in the same place with the same settings
+    unlink((std::string(dir) + "/made").c_str());
+    assertTrue(restartProcess(state, inst), "Restart");
+    waitForInstance([&]() { return inst; }, "stopped", 2000);
+    assertTrue(stat((std::string(dir) + "/made").c_str(), &st) == 0 && (st.st_mode & 0777) == 0600, "Umask on restart");
+
+    tmpl.umask = "999";
+    bool threw = false;
+    try {
+        startProcess(state, tmpl, "stdio-bad", {{"dir", dir}, {"name", "b"}});
+    } catch (const std::runtime_error&) {
+        threw = true;
+    }
+    assertTrue(threw, "Invalid umask rejected");
+    system(("rm -rf " + std::string(dir)).c_str());
+}
+
+TEST(TemplateDriftAndUpgrade) {
+    auto state = std::make_shared<State>();
+    auto tmpl = std::make_shared<Template>();
+    tmpl->id = "drift";
+    tmpl->label = "Drift";
+    tmpl->command = "sleep ${secs}";
+    state->templates["drift"] = tmpl;
+
+    std::string revision = templateRevision(*tmpl);
+    tmpl->label = "Renamed";
+    assertEqual(revision, templateRevision(*tmpl), "Label does not count");
+
+    auto inst = startProcess(state, *tmpl, "drift-test", {{"secs", "300"}});
+    inst->labels["team"] = "web";
+    assertEqual(revision, inst->template_revision, "Revision recorded");
+    assertTrue(!instanceDrifted(*state, *inst), "Not drifted yet");
+
+    tmpl->command = "sleep ${secs}.5";
+    assertTrue(instanceDrifted(*state, *inst), "Command change is drift");
+
+    int oldPid = inst->pid;
+    auto fresh = upgradeInstance(state, inst);
+    assertEqual("sleep 300.5", fresh->command, "Re-rendered with the same vars");
+    assertEqual("web", fresh->labels["team"], "Labels kept");
+    assertTrue(!instanceDrifted(*state, *fresh), "Up to date after upgrade");
+    assertTrue(!isProcessRunning(oldPid) || processStartTicks(oldPid) != inst->start_ticks, "Old process stopped");
+
+    tmpl->version = "2";
+    assertEqual("2", templateRevision(*tmpl), "Explicit version wins");
+    tmpl->command = "false-command-${missing}";
+    bool threw = false;
+    try {
+        upgradeInstance(state, fresh);
+    } catch (const std::exception&) {
+        threw = true;
+    }
+    assertTrue(threw, "Failed upgrade throws");
+    assertTrue(state->instances["drift-test"] == fresh && fresh->status == "running", "Old instance back");
+    stopProcess(state, fresh);
+}
+
+TEST(ConcurrentOperationsOnOneInstance) {
+    auto state = std::make_shared<State>();
+    Template sleeper;
+    sleeper.id = "race-sleep";
+    sleeper.command = "sleep 300";
+
+    // Concurrent starts of one name: exactly one gets it
+    std::atomic<int> started{0};
+    std::vector<std::thread> threads;
+    for (int n = 0; n < 4; n++) {
+        threads.emplace_back([&]() {
+            try {
+                if (startProcess(state, sleeper, "race", {})) started++;
+            } catch (const std::exception&) {
+            }
+        });
+    }
+    for (auto& t : threads) t.join();
+    assertEqual(1, started.load(), "One start wins");
+
+    // Stop, restart and delete racing: each sees the result of the one before
+    threads.clear();
+    std::vector<std::string> errors(3);
+    const char* ops[] = {"stop", "restart", "delete"};
+    for (int n = 0; n < 3; n++) {
+        threads.emplace_back([&, n]() { errors[n] = instanceOperation(state, "race", ops[n]); });
+    }
+    for (auto& t : threads) t.join();
+    int ok = 0;
+    for (const auto& error : errors) {
+        ok += error.empty();
+        assertTrue(error.empty() || error == "not found" || error == "not running", "Clean refusal: " + error);
+    }
+    assertTrue(ok >= 1, "At least one went through");
+    if (state->instances.count("race")) {
+        instanceOperation(state, "race", "delete");
+    }
+    assertTrue(!state->instances.count("race"), "Gone");
+}
+
+TEST(InstanceLocksForgetUnheldNames) {
+    State state;
+    InstanceLocks locks;
+    {
+        auto held = locks.acquire("gone", state);
+        auto again = locks.acquire("gone", state); // Re-entrant
+        assertEqual(1, (int)locks.size(), "One entry while held");
+    }
+    assertEqual(0, (int)locks.size(), "Dropped with its last holder");
+
+    // A waiter keeps the entry (and the mutex it waits on) past the holder
+    std::atomic<bool> waited{false};
+    std::thread waiter;
+    {
+        auto held = locks.acquire("busy", state);
+        waiter = std::thread([&]() {
+            auto mine = locks.acquire("busy", state);
+            waited = true;
+        });
+        std::this_thread::sleep_for(std::chrono::milliseconds(50));
+        assertTrue(!waited, "Waiter blocks");
+    }
+    waiter.join();
+    assertTrue(waited.load(), "Waiter got it");
+    assertEqual(0, (int)locks.size(), "Dropped once the waiter is done");
+
+    // Deleting instances leaves nothing behind in the shared locks
+    auto shared = std::make_shared<State>();
+    Template sleeper;
+    sleeper.id = "locks-sleep";
+    sleeper.command = "sleep 300";
+    for (int n = 0; n < 5; n++) {
+        std::string name = "locks-" + std::to_string(n);
+        startProcess(shared, sleeper, name, {});
+        assertEqual("", instanceOperation(shared, name, "delete"), "Deleted " + name);
+    }
+    // Reapers recording the exits hold them briefly
+    for (int n = 0; n < 100 && instanceLocks().size() > 0; n++) {
+        std::this_thread::sleep_for(std::chrono::milliseconds(20));
+    }
+    assertEqual(0, (int)instanceLocks().size(), "No entries left for deleted instances");
+}
+
+TEST(BulkFilterAndOperations) {
+    auto state = std::make_shared<State>();
+    Template sleeper;
+    sleeper.id = "bulk-sleep";
+    sleeper.command = "sleep 300";
+    Template other = sleeper;
+    other.id = "bulk-other";
+
+    auto a = startProcess(state, sleeper, "bulk-a", {});
+    startProcess(state, sleeper, "bulk-b", {});
+    auto c = startProcess(state, other, "bulk-c", {});
+    c->labels["tier"] = "db";
+
+    auto byTemplate = filterInstances(*state, "", "", "bulk-sleep", "");
+    assertEqual(2, (int)byTemplate.size(), "Two from bulk-sleep");
+    assertEqual(1, (int)filterInstances(*state, "", "tier=db", "", "running").size(), "Selector and status combine");
+
+    for (const auto& name : byTemplate) {
+        assertEqual("", instanceOperation(state, name, "stop"), "Stopped " + name);
+    }
+    assertEqual(2, (int)filterInstances(*state, "", "", "", "stopped").size(), "Both stopped");
+    assertEqual("not running", instanceOperation(state, "bulk-a", "stop"), "Already stopped");
+
+    assertEqual("", instanceOperation(state, "bulk-a", "restart"), "Restart a stopped one");
+    assertTrue(a->status == "running", "Running again");
+
+    for (const auto& name : filterInstances(*state, "", "", "", "")) {
+        assertEqual("", instanceOperation(state, name, "delete"), "Deleted " + name);
+    }
+    assertTrue(state->instances.empty(), "All deleted");
+    assertTrue(!isProcessRunning(c->pid) || processStartTicks(c->pid) != c->start_ticks, "Running one stopped on delete");
+    assertEqual("not found", instanceOperation(state, "bulk-b", "stop"), "Gone");
+}
+
+TEST(LockedInstancesNeedForce) {
+    auto state = std::make_shared<State>();
+    Template sleeper;
+    sleeper.id = "lock-sleep";
+    sleeper.command = "sleep 300";
+    auto vm = startProcess(state, sleeper, "lock-vm", {});
+    vm->protect = true;
+
+    for (const std::string op : {"stop", "restart", "delete"}) {
+        assertTrue(instanceOperation(state, "lock-vm", op).find("protected") == 0, op + " refused");
+    }
+    assertTrue(vm->status == "running" && state->instances.count("lock-vm") == 1, "Untouched");
+    assertTrue(json(*vm).value("protected", false), "Saved as protected");
+    assertTrue(!json::parse(R"({"name": "x", "template": "", "command": "x", "pid": 0, "status": "stopped",
+                                "resources": {}, "started": 0, "managed": true})").get<Instance>().protect,
+               "Unlocked by default");
+
+    assertEqual("", instanceOperation(state, "lock-vm", "stop", true), "Forced stop");
+    assertEqual("", instanceOperation(state, "lock-vm", "restart"), "Starting a stopped one is allowed");
+    assertEqual("", instanceOperation(state, "lock-vm", "delete", true), "Forced delete");
+    assertTrue(state->instances.empty(), "Deleted");
+}
+
+TEST(NotesAndDescriptionsPersist) {
+    Template tmpl;
+    tmpl.id = "noted";
+    tmpl.command = "sleep 1";
+    std::string before = templateRevision(tmpl);
+    tmpl.description = "Dev VMs for the flaky USB tests";
+    assertEqual(before, templateRevision(tmpl), "Descriptions don't count as drift");
+    assertEqual(tmpl.description, json(tmpl).get<Template>().description, "Template description round trip");
+
+    Instance inst = json::parse(R"({"name": "qemu-weird-test-3", "template": "", "command": "x", "pid": 0,
+                                    "status": "stopped", "resources": {}, "started": 0, "managed": true})").get<Instance>();
+    assertTrue(inst.notes.empty() && !json(inst).contains("notes"), "No notes, none saved");
+    inst.notes = "repro for issue 41, delete after the fix";
+    assertEqual(inst.notes, json(inst).get<Instance>().notes, "Instance notes round trip");
+}
+
+TEST(ShutdownPolicyAndAutostart) {
+    auto state = std::make_shared<State>();
+    for (std::string policy : {"leave", "stop", "remember"}) {
+        auto tmpl = std::make_shared<Template>();
+        tmpl->id = "shutdown-" + policy;
+        tmpl->command = "sleep 300";
+        tmpl->on_shutdown = policy;
+        state->templates[tmpl->id] = tmpl;
+        startProcess(state, *tmpl, policy, {});
+    }
+
+    assertEqual(2, shutdownInstances(state), "stop and remember stopped");
+    assertTrue(state->instances["leave"]->status == "running", "leave keeps running");
+    assertTrue(state->instances["stop"]->status == "stopped" && !state->instances["stop"]->autostart, "stop forgets");
+    assertTrue(state->instances["remember"]->status == "stopped" && state->instances["remember"]->autostart, "remember marks");
+    json j = *state->instances["remember"];
+    assertTrue(j["autostart"].get<bool>(), "Mark is persisted");
+
+    assertEqual(1, autostartInstances(state), "Only the remembered one starts");
+    assertTrue(state->instances["remember"]->status == "running" && !state->instances["remember"]->autostart, "Started, mark cleared");
+    assertTrue(state->instances["stop"]->status == "stopped", "stop stays stopped");
+
+    stopProcess(state, state->instances["leave"]);
+    stopProcess(state, state->instances["remember"]);
+}
+
+TEST(ManagerLibraryLifecycle) {
+    Manager manager(std::make_shared<State>());
+    auto tmpl = std::make_shared<Template>();
+    tmpl->id = "lib-sleep";
+    tmpl->command = "sleep 300";
+    manager.state()->templates["lib-sleep"] = tmpl;
+
+    auto inst = manager.start("lib-sleep", "lib", {});
+    inst->labels["via"] = "lib";
+    assertTrue(inst->status == "running" && isProcessRunning(inst->pid), "Started");
+    assertEqual(1, (int)manager.list("via=lib").size(), "Listed by selector");
+
+    manager.stop("lib");
+    assertEqual("stopped", inst->status, "Stopped");
+    manager.restart("lib");
+    assertEqual("running", inst->status, "Restarted");
+    manager.remove("lib");
+    assertTrue(manager.list().empty(), "Removed");
+
+    bool threw = false;
+    try {
+        manager.start("no-such-template", "x");
+    } catch (const std::runtime_error& e) {
+        threw = std::string(e.what()).find("no-such-template") != std::string::npos;
+    }
+    assertTrue(threw, "Errors are exceptions with the reason");
+}
+
+TEST(HealthSupervisorRestartsWithBackoff) {
+    auto state = std::make_shared<State>();
+    std::string flag = std::string(getenv("HOME")) + "/healthy";
+    std::ofstream(flag).close();
+
+    Template tmpl;
+    tmpl.id = "test-health";
+    tmpl.command = "sleep 300";
+    tmpl.health = "test -e " + flag;
+    tmpl.health_failures = 2;
+    tmpl.health_interval = 1;
+    auto inst = startProcess(state, tmpl, "test-health", {});
+
+    HealthSupervisor supervisor;
+    assertTrue(supervisor.check(state, 1000).empty(), "Healthy");
+
+    unlink(flag.c_str());
+    assertTrue(supervisor.check(state, 1000).empty(), "Not due within the interval");
+    assertTrue(supervisor.check(state, 1001).empty(), "One failure is tolerated");
+    assertEqual(1, inst->failed_checks, "Failure counted");
+    int pid = inst->pid;
+    assertEqual(1, (int)supervisor.check(state, 1002).size(), "Restarted after two failures");
+    assertTrue(inst->pid != pid && inst->status == "running", "New process");
+    assertEqual(1, inst->restarts, "Restart counted");
+    assertEqual("health check failed 2 times", inst->restart_reason, "Reason recorded");
+    assertEqual("health", state->events.back().kind, "Event recorded");
+
+    supervisor.check(state, 1003);
+    assertTrue(supervisor.check(state, 1004).empty(), "Backing off for 10s after the last restart");
+    assertEqual(1, (int)supervisor.check(state, 1012).size(), "Restarted once the backoff passed");
+    assertTrue(inst->backoff == 2 * HEALTH_BACKOFF_MIN, "Backoff doubles");
+
+    stopProcess(state, inst);
+}
+
+TEST(HealthSupervisorIgnoresProbesOfStoppedInstances) {
+    auto state = std::make_shared<State>();
+    Template tmpl;
+    tmpl.id = "test-health-race";
+    tmpl.command = "sleep 300";
+    tmpl.health = "sleep 0.5; false";
+    tmpl.health_failures = 1;
+    tmpl.health_interval = 1;
+    auto inst = startProcess(state, tmpl, "test-health-race", {});
+
+    // Stopped while its (failing) probe runs unlocked
+    HealthSupervisor supervisor;
+    std::vector<std::string> restarted;
+    std::thread checker([&]() { restarted = supervisor.check(state, 1000); });
+    std::this_thread::sleep_for(std::chrono::milliseconds(150));
+    assertTrue(stopProcess(state, inst), "Stopped during the probe");
+    checker.join();
+
+    assertTrue(restarted.empty(), "Not restarted");
+    assertEqual("stopped", inst->status, "Still stopped");
+    assertEqual(0, inst->pid, "No new process");
+
+    // Deleted during the probe: nothing is applied to it
+    state->instances.erase("test-health-race");
+    inst = startProcess(state, tmpl, "test-health-race-2", {});
+    std::thread deleter([&]() { restarted = supervisor.check(state, 1010); });
+    std::this_thread::sleep_for(std::chrono::milliseconds(150));
+    assertEqual("", instanceOperation(state, "test-health-race-2", "delete", false), "Deleted during the probe");
+    deleter.join();
+    assertTrue(restarted.empty(), "Not restarted");
+    assertTrue(!state->instances.count("test-health-race-2"), "Stays deleted");
+    assertEqual(0, inst->failed_checks, "The result wasn't counted");
+}
+
+TEST(RollingRestartStopsAtUnhealthyReplica) {
+    auto state = std::make_shared<State>();
+    Template tmpl;
+    tmpl.id = "test-replica";
+    tmpl.command = "sleep 300";
+    auto a = startProcess(state, tmpl, "replica-a", {});
+    auto b = startProcess(state, tmpl, "replica-b", {});
+    auto c = startProcess(state, tmpl, "replica-c", {});
+    b->health = "false"; // Never comes back healthy
+    int pidA = a->pid, pidC = c->pid;
+
+    std::vector<std::string> seen;
+    int done = rollingRestart(state, {a, b, c}, 500, [&](const Instance& inst, bool) { seen.push_back(inst.name); });
+    assertEqual(1, done, "Only the first succeeded");
+    assertEqual(2, (int)seen.size(), "Stopped after the unhealthy one");
+    assertTrue(a->pid != pidA && a->status == "running", "First replica restarted");
+    assertEqual("rolling restart", a->restart_reason, "Reason recorded");
+    assertEqual(pidC, c->pid, "Rest left serving");
+
+    for (const auto& inst : {a, b, c}) {
+        stopProcess(state, inst);
+    }
+}
+
 TEST(ExtractProcessName) {
     std::string name = extractProcessName("sleep 300");
     assertEqual("sleep", name, "Should extract process name");
@@ -187,6 +659,134 @@ TEST(BuildPortToProcessMap) {
     }
 }
 
+TEST(BuildPortToProcessMap_FindsOwnListener) {
+    int fd = socket(AF_INET, SOCK_STREAM, 0);
+    assertTrue(fd != -1, "Should create socket");
+
+    struct sockaddr_in addr;
+    memset(&addr, 0, sizeof(addr));
+    addr.sin_family = AF_INET;
+    addr.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
+    addr.sin_port = 0;
+    socklen_t addrLen = sizeof(addr);
+
+    bool ok = bind(fd, (struct sockaddr*)&addr, sizeof(addr)) == 0 &&
+              listen(fd, 1) == 0 &&
+              getsockname(fd, (struct sockaddr*)&addr, &addrLen) == 0;
+    int port = ntohs(addr.sin_port);
+
+    auto portMap = buildPortToProcessMap();
+    close(fd);
+
+    assertTrue(ok, "Should listen on ephemeral port");
+    auto it = portMap.find(port);
+    assertTrue(it != portMap.end(), "Listening port should be in map");
+    assertTrue(std::find(it->second.begin(), it->second.end(), getpid()) != it->second.end(),
+               "Port should map to this process");
+}
+
+// A socket's owner needn't be who holds it: one user listens, hands the fd to
+// a process of another user over a unix socket and exits
+TEST(BuildPortToProcessMap_FindsPassedListener) {
+    if (geteuid() != 0) return; // Needs two other users
+
+    int pair[2], ready[2];
+    assertTrue(socketpair(AF_UNIX, SOCK_STREAM, 0, pair) == 0 && pipe(ready) == 0, "Should create channels");
+
+    pid_t holder = fork();
+    if (holder == 0) {
+        if (setuid(65533) != 0) _exit(1);
+        char port[8] = {};
+        char control[CMSG_SPACE(sizeof(int))];
+        struct iovec iov = {port, sizeof(port)};
+        struct msghdr msg = {};
+        msg.msg_iov = &iov;
+        msg.msg_iovlen = 1;
+        msg.msg_control = control;
+        msg.msg_controllen = sizeof(control);
+        if (recvmsg(pair[1], &msg, 0) <= 0) _exit(1);
+        write(ready[1], port, sizeof(port));
+        pause();
+        _exit(0);
+    }
+
+    pid_t creator = fork();
+    if (creator == 0) {
+        if (setuid(65534) != 0) _exit(1);
+        int fd = socket(AF_INET, SOCK_STREAM, 0);
+        struct sockaddr_in addr;
+        memset(&addr, 0, sizeof(addr));
+        addr.sin_family = AF_INET;
+        addr.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
+        socklen_t addrLen = sizeof(addr);
+        if (bind(fd, (struct sockaddr*)&addr, sizeof(addr)) != 0 || listen(fd, 1) != 0 ||
+            getsockname(fd, (struct sockaddr*)&addr, &addrLen) != 0) {
+            _exit(1);
+        }
+        char port[8] = {};
+        snprintf(port, sizeof(port), "%d", ntohs(addr.sin_port));
+        char control[CMSG_SPACE(sizeof(int))] = {};
+        struct iovec iov = {port, sizeof(port)};
+        struct msghdr msg = {};
+        msg.msg_iov = &iov;
+        msg.msg_iovlen = 1;
+        msg.msg_control = control;
+        msg.msg_controllen = sizeof(control);
+        struct cmsghdr* cmsg = CMSG_FIRSTHDR(&msg);
+        cmsg->cmsg_level = SOL_SOCKET;
+        cmsg->cmsg_type = SCM_RIGHTS;
+        cmsg->cmsg_len = CMSG_LEN(sizeof(int));
+        memcpy(CMSG_DATA(cmsg), &fd, sizeof(int));
+        _exit(sendmsg(pair[0], &msg, 0) > 0 ? 0 : 1);
+    }
+
+    int status = 0;
+    waitpid(creator, &status, 0);
+    char port[8] = {};
+    struct pollfd p = {ready[0], POLLIN, 0};
+    bool passed = WIFEXITED(status) && WEXITSTATUS(status) == 0 && poll(&p, 1, 5000) == 1 &&
+                  read(ready[0], port, sizeof(port)) == (ssize_t)sizeof(port);
+
+    auto portMap = buildPortToProcessMap();
+    kill(holder, SIGKILL);
+    waitpid(holder, nullptr, 0);
+    for (int fd : {pair[0], pair[1], ready[0], ready[1]}) close(fd);
+
+    assertTrue(passed, "Listener handed over");
+    auto it = portMap.find(std::atoi(port));
+    assertTrue(it != portMap.end() &&
+               std::find(it->second.begin(), it->second.end(), holder) != it->second.end(),
+               "Port maps to the process holding it, not its creator's user");
+}
+
+TEST(ProcessCache_OnlyRereadsNewPids) {
+    ProcessCache cache;
+
+    auto first = cache.refresh();
+    size_t firstReads = cache.lastFullReads();
+
+    pid_t pid = startTestProcess("sleep 300");
+    auto second = cache.refresh();
+    size_t secondReads = cache.lastFullReads();
+    killTestProcess(pid);
+
+    assertTrue(!first.empty(), "Should find processes");
+    assertTrue(secondReads >= 1, "New process should be fully read");
+    assertTrue(secondReads < firstReads, "Unchanged processes should come from cache");
+
+    bool found = false;
+    for (const auto& info : second) {
+        if (info->pid == pid) found = true;
+    }
+    assertTrue(found, "New process should be in second refresh");
+
+    auto stats = cache.stats();
+    assertEqual(2, (int)stats.refreshes, "Refreshes counted");
+    assertEqual((int)(firstReads + secondReads), (int)stats.fullReads, "Full reads summed");
+    assertTrue(stats.hits > 0, "Second refresh hits the cache");
+    assertEqual((int)second.size(), (int)stats.entries, "Entries are the last refresh");
+}
+
 TEST(ResourceCheck_Available) {
     ResourceType rt;
     rt.name = "tcpport";
@@ -265,6 +865,245 @@ TEST(MonitorProcess) {
     killTestProcess(pid);
 }
 
+TEST(AdoptMonitoredInstance) {
+    auto state = std::make_shared<State>();
+    pid_t pid = startTestProcess("exec sleep 300");
+    std::thread([pid]() { waitpid(pid, nullptr, 0); }).detach(); // Reap it once vp stops it
+
+    auto inst = discoverAndImportProcess(state, pid, "adoptee");
+    assertTrue(!inst->managed, "Imported monitor only");
+    manageInstance(state, inst, false);
+    assertTrue(inst->managed, "Managed now");
+    assertEqual(pid, inst->pid, "Same process");
+    bool threw = false;
+    try {
+        manageInstance(state, inst, false);
+    } catch (const std::runtime_error& e) {
+        threw = std::string(e.what()).find("already managed") != std::string::npos;
+    }
+    assertTrue(threw, "Nothing to do twice");
+
+    manageInstance(state, inst, true);
+    assertTrue(inst->pid > 0 && inst->pid != pid, "Restarted as a new process");
+    assertEqual("running", inst->status, "Running under vp");
+    for (int i = 0; i < 20 && isProcessRunning(pid); i++) {
+        std::this_thread::sleep_for(std::chrono::milliseconds(50)); // Until the reaper above has it
+    }
+    assertTrue(!isProcessRunning(pid), "Old process stopped");
+    stopProcess(state, inst);
+
+    threw = false;
+    try {
+        manageInstance(state, inst, true);
+    } catch (const std::runtime_error& e) {
+        threw = std::string(e.what()).find("not running") != std::string::npos;
+    }
+    assertTrue(threw, "Stopped instances can't be adopted");
+}
+
+TEST(DetachLeavesProcessRunning) {
+    auto state = std::make_shared<State>();
+    state->types = defaultResourceTypes();
+    Template tmpl;
+    tmpl.id = "handoff";
+    tmpl.command = "sleep 300";
+    tmpl.resources = {"tcpport"};
+
+    auto inst = startProcess(state, tmpl, "handoff", {});
+    int pid = inst->pid;
+    assertTrue(!state->resources.empty(), "Port claimed");
+    detachInstance(state, inst, false);
+    assertTrue(!inst->managed, "Monitor only");
+    assertTrue(inst->resources.empty() && state->resources.empty(), "Claims released");
+    assertTrue(isProcessRunning(pid), "Still running");
+    assertEqual("running", inst->status, "Still shown running");
+
+    auto other = startProcess(state, tmpl, "handoff-2", {});
+    detachInstance(state, other, true);
+    assertTrue(!state->instances.count("handoff-2"), "Forgotten");
+    assertTrue(isProcessRunning(other->pid), "Forgotten but running");
+
+    kill(pid, SIGKILL);
+    kill(other->pid, SIGKILL);
+    for (int i = 0; i < 20 && isProcessRunning(pid); i++) {
+        std::this_thread::sleep_for(std::chrono::milliseconds(50));
+    }
+    bool threw = false;
+    try {
+        detachInstance(state, inst, false);
+    } catch (const std::runtime_error&) {
+        threw = true;
+    }
+    assertTrue(threw, "Nothing to detach once it's gone");
+}
+
+TEST(HelperPolicyAndChecks) {
+    json policy = json::parse(R"({"rules": [
+        {"user": "alice", "owner": "root", "cmdline": "^sleep"},
+        {"user": "*", "owner": "postgres"},
+        {"user": "bob", "owner": "root", "cmdline": "("}
+    ]})");
+    assertTrue(helperAuthorized(policy, "alice", "root", "sleep 300"), "Rule matches");
+    assertTrue(!helperAuthorized(policy, "alice", "root", "sshd"), "Command line must match");
+    assertTrue(helperAuthorized(policy, "carol", "postgres", "postgres -D /data"), "Any user, no regex");
+    assertTrue(!helperAuthorized(policy, "bob", "root", "sleep 300"), "Broken regex allows nothing");
+    assertTrue(!helperAuthorized(json::object(), "alice", "root", "sleep 300"), "No rules, nothing allowed");
+
+    if (geteuid() != 0) {
+        assertEqual(2, runHelper({"check", "1234"}), "Refuses to run unprivileged");
+        return;
+    }
+    std::string path = "/tmp/vp-helper-" + std::to_string(getpid()) + ".json";
+    std::ofstream(path) << policy.dump();
+    chmod(path.c_str(), 0644);
+    pid_t pid = startTestProcess("exec sleep 300");
+    std::string pidStr = std::to_string(pid);
+    setenv("SUDO_USER", "alice", 1);
+
+    assertEqual(0, runHelper({"check", pidStr}, path), "alice may manage root's sleep");
+    assertEqual(2, runHelper({"signal", pidStr, "9x"}, path), "Bad signal");
+    assertEqual(2, runHelper({"signal", pidStr, "11"}, path), "Signal not on the list");
+    assertEqual(2, runHelper({"check", "1"}, path), "Never init");
+    chmod(path.c_str(), 0666);
+    assertEqual(1, runHelper({"check", pidStr}, path), "Policy others can write is ignored");
+    chmod(path.c_str(), 0644);
+    setenv("SUDO_USER", "mallory", 1);
+    assertEqual(1, runHelper({"signal", pidStr, "15"}, path), "mallory may not");
+    assertTrue(isProcessRunning(pid), "Untouched");
+    setenv("SUDO_USER", "alice", 1);
+    assertEqual(0, runHelper({"signal", "-" + pidStr, std::to_string(SIGTERM)}, path), "Group through its leader");
+    waitpid(pid, nullptr, 0);
+    assertTrue(!isProcessRunning(pid), "Signalled");
+
+    // A sleep leading a group with a shell in it: alice may signal the
+    // sleep, not the whole group
+    pid = startTestProcess("sh -c 'sleep 302' & exec sleep 300");
+    pidStr = std::to_string(pid);
+    assertEqual(1, runHelper({"signal", "-" + pidStr, std::to_string(SIGTERM)}, path), "Mixed group refused");
+    assertTrue(isProcessRunning(pid), "Group untouched");
+    assertEqual(0, runHelper({"signal", pidStr, std::to_string(SIGTERM)}, path), "Its leader alone is fine");
+    waitpid(pid, nullptr, 0);
+    kill(-pid, SIGKILL);
+
+    unsetenv("SUDO_USER");
+    unlink(path.c_str());
+}
+
+TEST(ConfigFileParseAndSet) {
+    Config toml = parseConfig("port = 1\n[serve]\nport = 8090 # comment\nbind = \"127.0.0.1\"\n"
+                              "allow = [\"10.0.0.0/8\", '::1/128']\n\n[logs]\ncompress = true\n", false);
+    assertEqual("1", toml["port"], "Top-level key");
+    assertEqual("8090", toml["serve.port"], "Comment stripped");
+    assertEqual("127.0.0.1", toml["serve.bind"], "Quoted string");
+    assertEqual("10.0.0.0/8,::1/128", toml["serve.allow"], "List joined");
+    assertEqual("true", toml["logs.compress"], "Bool");
+    Config yaml = parseConfig("serve:\n  port: 8090\n  bind: \"::1\"\ndiscovery:\n  ignore:\n    - ^sshd\n"
+                              "    - 'chrome #1'\n  interval: 30s\n", true);
+    assertEqual("8090", yaml["serve.port"], "YAML key");
+    assertEqual("::1", yaml["serve.bind"], "YAML quoted");
+    assertEqual("^sshd,chrome #1", yaml["discovery.ignore"], "Block list");
+    assertEqual("30s", yaml["discovery.interval"], "Key after a list");
+    assertTrue(!yaml.count("serve") && !yaml.count("discovery"), "Sections aren't keys");
+
+    bool threw = false;
+    try {
+        parseConfig("[serve]\nbind = 127.0.0.1 x\n", false);
+    } catch (const std::exception& e) {
+        threw = std::string(e.what()).find("line 2") != std::string::npos;
+    }
+    assertTrue(threw, "Errors name the line");
+
+    std::string path = "/tmp/vp-config-" + std::to_string(getpid()) + ".toml";
+    std::ofstream(path) << "# vp settings\n[serve]\nport = 9000\n";
+    setenv("VP_CONFIG", path.c_str(), 1);
+    setConfigValue("serve.port", "9001");
+    setConfigValue("serve.allow", "10.0.0.0/8,127.0.0.1/32");
+    setConfigValue("ports.start", "4200");
+    setConfigValue("logs.max-age", "7d");
+    assertEqual("9001", configValue("serve.port"), "Replaced in place");
+    assertEqual("10.0.0.0/8,127.0.0.1/32", configValue("serve.allow"), "List round trip");
+    std::ifstream file(path);
+    std::string text((std::istreambuf_iterator<char>(file)), std::istreambuf_iterator<char>());
+    assertTrue(text.rfind("# vp settings\n[serve]\nport = 9001\n", 0) == 0, "Comments and order kept");
+    threw = false;
+    try {
+        setConfigValue("serve.port", "eighty");
+    } catch (const std::exception&) {
+        threw = true;
+    }
+    assertTrue(threw, "Values are checked");
+    threw = false;
+    try {
+        setConfigValue("serve.colour", "blue");
+    } catch (const std::exception&) {
+        threw = true;
+    }
+    assertTrue(threw, "Unknown keys refused");
+    setConfigValue("serve.allow", "");
+    assertEqual("", configValue("serve.allow"), "Unset");
+
+    // Config wins over state.json for the settings it has
+    State state;
+    state.counters["tcpport"] = 3005;
+    applyConfig(state);
+    assertEqual(4200, state.types["tcpport"]->start, "Port range from the config");
+    assertEqual(5199, state.types["tcpport"]->end, "1000 ports when no end given");
+    assertEqual(0, state.counters["tcpport"], "Counter restarts in the new range");
+    assertEqual(7 * 86400L, state.logPolicy.max_age, "Log retention");
+
+    unsetenv("VP_CONFIG");
+    unlink(path.c_str());
+}
+
+TEST(ConfigIsNotSaved) {
+    char dir[] = "/tmp/vp-config-state-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+    setenv("VP_STATE_DIR", dir, 1);
+    std::string path = std::string(dir) + "/config.toml";
+    setenv("VP_CONFIG", path.c_str(), 1);
+
+    auto state = std::make_shared<State>();
+    state->remotesAllowed["http://blocked.test"] = false;
+    state->logPolicy.max_files = 3;
+    state->counters["tcpport"] = 3005;
+    state->save();
+
+    setConfigValue("ports.start", "4200");
+    setConfigValue("logs.max-age", "7d");
+    setConfigValue("logs.prune-after", "1d");
+    setConfigValue("auth.origins", "http://blocked.test,http://config.test");
+    auto loaded = State::load();
+    assertEqual(4200, loaded->types["tcpport"]->start, "Config applies on load");
+    assertTrue(loaded->remotesAllowed["http://config.test"], "Config origin allowed");
+    assertTrue(!loaded->remotesAllowed["http://blocked.test"], "A block wins over the config");
+    loaded->logPolicy.max_files = 4; // A change of our own while config is set
+    loaded->save();
+
+    std::ifstream file(std::string(dir) + "/state.json");
+    json saved = json::parse(file);
+    assertEqual(3000, saved["types"]["tcpport"]["start"].get<int>(), "File keeps its own range");
+    assertEqual(3005, saved["counters"]["tcpport"].get<int>(), "...and counter");
+    assertTrue(!saved["remotes_allowed"].contains("http://config.test"), "Config origin not saved");
+    assertEqual(0L, saved["log_policy"]["max_age"].get<long>(), "Config retention not saved");
+    assertEqual(4, saved["log_policy"]["max_files"].get<int>(), "Own change saved");
+    assertTrue(!saved.contains("prune_after"), "Config pruning not saved");
+
+    for (const char* key : {"ports.start", "logs.max-age", "logs.prune-after", "auth.origins"}) {
+        setConfigValue(key, "");
+    }
+    loaded = State::load();
+    assertEqual(3000, loaded->types["tcpport"]->start, "Unset ports.start undone");
+    assertEqual(3005, loaded->counters["tcpport"], "Counter back");
+    assertTrue(!loaded->remotesAllowed.count("http://config.test"), "Unset origin undone");
+    assertTrue(!loaded->remotesAllowed["http://blocked.test"], "Block kept");
+    assertEqual(0L, loaded->logPolicy.max_age, "Unset retention undone");
+    assertEqual(0L, loaded->pruneAfter, "Unset pruning undone");
+
+    unsetenv("VP_CONFIG");
+    unsetenv("VP_STATE_DIR");
+    system(("rm -rf " + std::string(dir)).c_str());
+}
+
 TEST(DefaultResourceTypes) {
     auto types = defaultResourceTypes();
 
@@ -277,6 +1116,3112 @@ TEST(DefaultResourceTypes) {
     assertEqual(3000, tcpport->start, "tcpport should start at 3000");
 }
 
+TEST(GetDescendants) {
+    std::map<int, std::vector<int>> children = {
+        {1, {10, 20}},
+        {10, {11}},
+        {11, {12}},
+        {30, {31}}
+    };
+
+    auto desc = getDescendants(1, children);
+    assertEqual(4, (int)desc.size(), "Should find all descendants");
+    assertTrue(std::find(desc.begin(), desc.end(), 12) != desc.end(), "Should include grandchildren");
+    assertTrue(std::find(desc.begin(), desc.end(), 31) == desc.end(), "Should not include unrelated");
+
+    assertEqual(0, (int)getDescendants(99, children).size(), "Leaf has no descendants");
+}
+
+TEST(ProcessTreeSelf) {
+    auto children = buildChildMap();
+    json tree = buildProcessTree(getpid(), children);
+
+    assertTrue(!tree.is_null(), "Should build tree for self");
+    assertEqual(getpid(), tree["pid"].get<int>(), "Root should be self");
+    assertTrue(tree["rss"].get<long>() > 0, "Should report RSS");
+}
+
+TEST(Fake_MatchAggregatesAndDetectsExit) {
+    FakeProc proc;
+    proc.add(90001, 1, "puma", "puma -p 3000", 1.5, 1000);
+    proc.add(90002, 90001, "puma", "puma: worker 0", 2.0, 2000);
+    proc.add(90003, 90002, "ruby", "ruby helper", 0.5, 500);
+
+    auto state = std::make_shared<State>();
+    auto inst = std::make_shared<Instance>();
+    inst->name = "web";
+    inst->status = "running";
+    inst->pid = 90001;
+    state->instances["web"] = inst;
+
+    matchAndUpdateInstances(state);
+    assertEqual(2, inst->children, "Should count descendants");
+    assertEqual(3500, (int)inst->rss, "Should sum RSS");
+    assertTrue(inst->cpu_time > 3.99 && inst->cpu_time < 4.01, "Should sum CPU time");
+    assertTrue(inst->cpu_sampled > 0, "Sample time is recorded");
+
+    // 2 CPU seconds over the last 10s of wall time
+    inst->cpu_time = 2.0;
+    inst->cpu_sampled -= 10;
+    matchAndUpdateInstances(state);
+    assertTrue(inst->cpu_percent > 19.9 && inst->cpu_percent < 20.1, "Rate between samples");
+
+    proc.fake->removeProcess(90001);
+    matchAndUpdateInstances(state);
+    assertEqual("stopped", inst->status, "Should detect exit");
+    assertEqual(0, inst->pid, "PID should be cleared");
+}
+
+TEST(CpuPercentBetweenSamples) {
+    auto near = [](double expected, double actual) { return std::abs(expected - actual) < 1e-6; };
+    assertTrue(near(50, cpuPercent(10, 100, 11, 102, 50)), "One CPU second over two");
+    assertTrue(near(250, cpuPercent(0, 100, 5, 102, 50)), "Several cores go over 100");
+    assertTrue(near(20, cpuPercent(0, 0, 2, 110, 100)), "No previous sample: average since start");
+    assertTrue(near(20, cpuPercent(9, 100, 2, 110, 100)), "Counter went back: average since start");
+    assertTrue(near(-1, cpuPercent(1, 100, 1.1, 100.1, 50)), "Too soon to say");
+    assertTrue(near(0, cpuPercent(0, 0, 2, 110, 0)), "Nothing to go on");
+
+    // Our own utime + stime in seconds, whatever the tick rate
+    auto before = readProcessStat(getpid());
+    auto until = std::chrono::steady_clock::now() + std::chrono::milliseconds(300);
+    volatile unsigned long spin = 0;
+    while (std::chrono::steady_clock::now() < until) spin++;
+    auto after = readProcessStat(getpid());
+    double used = after->cpu_time - before->cpu_time;
+    assertTrue(used > 0.15 && used < 0.6, "Busy 0.3s shows as about 0.3 CPU seconds");
+}
+
+TEST(Fake_FdAndThreadMetrics) {
+    FakeProc proc;
+    ProcessInfo server = {};
+    server.pid = 90050;
+    server.ppid = 1;
+    server.name = "node";
+    server.cmdline = "node server.js";
+    server.threads = 11;
+    server.fds = 40;
+    server.fd_limit = 1024;
+    proc.fake->addProcess(server);
+
+    ProcessInfo worker = server;
+    worker.pid = 90051;
+    worker.ppid = 90050;
+    worker.threads = 4;
+    worker.fds = 250;
+    worker.fd_limit = 256;
+    proc.fake->addProcess(worker);
+
+    auto state = std::make_shared<State>();
+    auto inst = std::make_shared<Instance>();
+    inst->name = "node";
+    inst->status = "running";
+    inst->pid = 90050;
+    state->instances["node"] = inst;
+
+    matchAndUpdateInstances(state);
+    assertEqual(15, inst->threads, "Threads summed over the tree");
+    assertEqual(250, inst->fds, "Process closest to its limit is reported");
+    assertEqual(256L, inst->fd_limit, "With its own limit");
+    assertTrue(!inst->warning.empty(), "Warning near the limit");
+    assertEqual("running", inst->status, "Status is unchanged");
+
+    worker.fds = 5;
+    proc.fake->addProcess(worker);
+    matchAndUpdateInstances(state);
+    assertEqual(40, inst->fds, "Headroom is back");
+    assertEqual("", inst->warning, "Warning cleared");
+}
+
+TEST(Fake_DiscoverProcesses) {
+    FakeProc proc;
+    proc.add(90011, 1, "node", "node server.js");
+    proc.add(90012, 1, "bash", "bash");
+    proc.add(90013, 2, "kworker", "");
+    proc.add(90014, 1, "redis", "redis-server");
+    proc.fake->listen(90011, 3000);
+    proc.fake->listen(90014, 6379);
+
+    auto state = std::make_shared<State>();
+    auto inst = std::make_shared<Instance>();
+    inst->name = "cache";
+    inst->status = "running";
+    inst->pid = 90014;
+    state->instances["cache"] = inst;
+
+    auto all = discoverProcesses(state, false);
+    assertEqual(2, (int)all.size(), "Should skip kernel threads and monitored PIDs");
+
+    auto withPorts = discoverProcesses(state, true);
+    assertEqual(1, (int)withPorts.size(), "portsOnly should keep listeners");
+    assertEqual("90011", withPorts[0]["pid"], "Should find node");
+    assertEqual("3000", withPorts[0]["ports"], "Should report port");
+}
+
+TEST(Fake_DiscoverFromExecSources) {
+    FakeProc proc;
+    proc.add(90015, 1, "node", "node server.js");
+
+    auto state = std::make_shared<State>();
+    state->discoverySources["docker"] =
+        R"(echo '[{"pid": 90015, "command": "node server.js --port 3001", "ports": [3001]},)"
+        R"( {"pid": 7, "ppid": 1, "name": "pg", "command": "postgres", "cwd": "/data"}]')";
+    state->discoverySources["broken"] = "echo not-json";
+
+    auto all = discoverProcesses(state, false);
+    assertEqual(3, (int)all.size(), "Local plus docker; a failing source is skipped");
+    assertEqual("local", all[0]["source"], "Local comes first");
+    assertEqual("docker", all[1]["source"], "Source is reported");
+    assertEqual("90015", all[1]["pid"], "Same PID in another source isn't a duplicate");
+    assertEqual("node-express", all[1]["template"], "Remote processes go through template matching");
+    assertEqual("3001", all[1]["ports"], "Ports come from the source");
+    assertEqual("pg", all[2]["name"], "Name is taken when given");
+    assertEqual("node", all[1]["name"], "Name falls back to the command");
+    bool threw = false;
+    try {
+        parseDiscoveredProcesses(R"([{"command": "x"}])");
+    } catch (const std::exception&) {
+        threw = true;
+    }
+    assertTrue(threw, "pid is required");
+}
+
+TEST(Fake_ProcessCacheRereadsRecycledPid) {
+    FakeProc proc;
+    proc.add(90021, 1, "a", "a", 0, 0, 100);
+    proc.add(90022, 1, "b", "b", 0, 0, 200);
+
+    ProcessCache cache;
+    cache.refresh();
+    assertEqual(2, proc.fake->fullReads(), "First refresh reads everything");
+
+    cache.refresh();
+    assertEqual(2, proc.fake->fullReads(), "Unchanged PIDs come from cache");
+
+    proc.add(90022, 1, "c", "c", 0, 0, 300); // PID reused by a new process
+    auto infos = cache.refresh();
+    assertEqual(3, proc.fake->fullReads(), "Recycled PID should be re-read");
+    assertEqual("c", infos[1]->name, "Should see the new process");
+}
+
+TEST(Fake_ProcessCacheRereadsAfterExec) {
+    FakeProc proc;
+    proc.add(90031, 500, "sh", "sh -c 'exec python3 app.py'", 0, 0, 100);
+
+    ProcessCache cache;
+    cache.refresh();
+    assertEqual(1, proc.fake->fullReads(), "First refresh reads it");
+
+    proc.add(90031, 500, "python3", "python3 app.py", 0, 0, 100); // exec: same PID and start time
+    auto infos = cache.refresh();
+    assertEqual(2, proc.fake->fullReads(), "A new comm means a re-read");
+    assertEqual("python3 app.py", infos[0]->cmdline, "Sees the exec'd command line");
+
+    ProcessInfo info = {};
+    info.pid = 90031;
+    info.ppid = 500;
+    info.name = "python3";
+    info.cmdline = "python3 worker.py";
+    info.exe = "/opt/python/bin/python3";
+    info.start_time = 100;
+    proc.fake->addProcess(info); // exec of another binary with the same name
+    infos = cache.refresh();
+    assertEqual(3, proc.fake->fullReads(), "A new exe means a re-read");
+    assertEqual("python3 worker.py", infos[0]->cmdline, "Sees the new command line");
+
+    info.ppid = 1; // Parent exited: reparented, nothing else changed
+    proc.fake->addProcess(info);
+    infos = cache.refresh();
+    assertEqual(3, proc.fake->fullReads(), "Reparenting needs no full read");
+    assertEqual(1, infos[0]->ppid, "ppid comes from the fresh stat");
+}
+
+TEST(Fake_ProcessCacheSeesRetitleAndChdir) {
+    FakeProc proc;
+    ProcessInfo info = {};
+    info.pid = 90041;
+    info.ppid = 1;
+    info.name = "postgres";
+    info.cmdline = "postgres -D /data";
+    info.cwd = "/";
+    info.start_time = 100;
+    proc.fake->addProcess(info);
+
+    ProcessCache cache;
+    cache.refresh();
+    assertEqual(1, proc.fake->fullReads(), "First refresh reads it");
+
+    info.cmdline = "postgres: checkpointer"; // setproctitle: no exec
+    info.cwd = "/data";                      // chdir
+    proc.fake->addProcess(info);
+    auto infos = cache.refresh();
+    assertEqual(1, proc.fake->fullReads(), "Retitling needs no full read");
+    assertEqual("postgres: checkpointer", infos[0]->cmdline, "Sees the new title");
+    assertEqual("/data", infos[0]->cwd, "Sees the new cwd");
+}
+
+TEST(ResourceAllocation_SkipsInUseValues) {
+    auto state = std::make_shared<State>();
+    auto rt = std::make_shared<ResourceType>();
+    rt->name = "slot";
+    rt->check = "test ${value} -lt 12";  // 10 and 11 are "in use"
+    rt->counter = true;
+    rt->start = 10;
+    rt->end = 13;
+    state->types["slot"] = rt;
+
+    assertEqual("12", allocateResource(state, "slot", ""), "Should skip in-use values");
+    assertEqual("13", allocateResource(state, "slot", ""), "Counter should advance");
+
+    bool threw = false;
+    try {
+        allocateResource(state, "slot", "");
+    } catch (const std::exception&) {
+        threw = true;
+    }
+    assertTrue(threw, "Exhausted range should throw");
+}
+
+TEST(TemplateRangeOverride) {
+    auto decl = parseResourceDecl("tcpport:3000-3099");
+    assertEqual("tcpport", decl.type, "Type before the range");
+    assertEqual(3000, decl.start, "Range start");
+    assertEqual(3099, decl.end, "Range end");
+    assertEqual(0, parseResourceDecl("datadir").start, "No range");
+    for (const auto& bad : {"tcpport:3000", "tcpport:3099-3000", "tcpport:a-b", "tcpport:0-5", "tcpport:1-2-3"}) {
+        bool threw = false;
+        try {
+            parseResourceDecl(bad);
+        } catch (const std::exception&) {
+            threw = true;
+        }
+        assertTrue(threw, std::string("Rejects ") + bad);
+    }
+
+    auto state = std::make_shared<State>();
+    auto rt = std::make_shared<ResourceType>();
+    rt->name = "slot";
+    rt->check = "false";
+    rt->counter = true;
+    rt->start = 10;
+    rt->end = 100;
+    state->types["slot"] = rt;
+
+    for (const auto& owner : {"a", "b", "c"}) {
+        state->claimResource("slot", allocateResource(state, "slot:20-22", "", owner), owner);
+    }
+    assertTrue(state->resources.count("slot:20") && state->resources.count("slot:22"), "Values from the range");
+    bool threw = false;
+    try {
+        allocateResource(state, "slot:20-22", "", "d");
+    } catch (const std::exception&) {
+        threw = true;
+    }
+    assertTrue(threw, "Exhausted once every value is claimed");
+    state->releaseResources("b");
+    assertEqual("21", allocateResource(state, "slot:20-22", "", "d"), "Wraps to the freed value");
+    assertEqual("10", allocateResource(state, "slot", ""), "The type's own counter is untouched");
+    assertEqual("40", allocateResource(state, "slot:20-22", "40"), "Explicit values still win");
+
+    threw = false;
+    try {
+        allocateResource(state, "workdir:1-2", "", "e");
+    } catch (const std::exception&) {
+        threw = true;
+    }
+    assertTrue(threw, "Only counters have ranges");
+
+    Template tmpl;
+    tmpl.id = "vnc";
+    tmpl.command = "vncserver :${slot}";
+    tmpl.resources = {"slot:50-60"};
+    auto rendered = renderTemplate(*state, tmpl, {});
+    assertEqual("vncserver :50", rendered->command, "Render starts at the declared range");
+    assertTrue(unresolvedPlaceholders(*state, tmpl, {}).empty(), "${slot} resolves through the declaration");
+}
+
+TEST(ResourceCheck_SeesOwnerTypeAndVars) {
+    std::string out = "/tmp/vp-check-vars-" + std::to_string(getpid());
+    ResourceType rt;
+    rt.name = "datadir";
+    rt.counter = false;
+    rt.start = rt.end = 0;
+    rt.check = "echo ${value} ${type} ${owner} ${project} ${tcpport} $VP_OWNER $VP_TYPE > " + out + "; false";
+
+    assertTrue(checkResource(rt, "/data/pg", "shop/db", {{"tcpport", "5433"}, {"value", "ignored"}}),
+               "Failing check means available");
+    std::ifstream in(out);
+    std::string line;
+    std::getline(in, line);
+    assertEqual("/data/pg datadir shop/db shop 5433 shop/db datadir", line,
+                "Check sees value, type, owner, project, vars and environment");
+    unlink(out.c_str());
+
+    // Allocation passes the owner's vars through
+    auto state = std::make_shared<State>();
+    auto slot = std::make_shared<ResourceType>();
+    slot->name = "slot";
+    slot->check = "test ${value} -lt ${min}";
+    slot->counter = true;
+    slot->start = 1;
+    slot->end = 9;
+    state->types["slot"] = slot;
+    assertEqual("4", allocateResource(state, "slot", "", "a", {{"min", "4"}}), "Vars reach the check");
+}
+
+TEST(ResourceUsageReport) {
+    State state;
+    state.counters["vncport"] = 5902;
+    state.claimResource("vncport", "5900", "vm1");
+    state.claimResource("vncport", "5910", "vm2");
+    state.claimResource("vncport", "5901", "vm1");
+    state.claimResource("gone", "x", "old");
+
+    auto usage = resourceUsage(state);
+    auto find = [&](const std::string& type) {
+        return *std::find_if(usage.begin(), usage.end(), [&](const ResourceUsage& u) { return u.type == type; });
+    };
+    auto vnc = find("vncport");
+    assertEqual(3, vnc.claimed, "Three claimed");
+    assertEqual(100 - 3, vnc.remaining, "The rest of 5900-5999 free");
+    assertEqual(5902, vnc.next, "Counter position");
+    assertEqual("5900,5901,5910", vnc.claims[0].value + "," + vnc.claims[1].value + "," + vnc.claims[2].value,
+                "Sorted numerically");
+    assertEqual(-1, find("workdir").remaining, "Non-counter types are unbounded");
+    assertEqual(1, find("gone").claimed, "Claims of undefined types still show");
+}
+
+TEST(EphemeralPortsAreHeldUntilExec) {
+    auto canBind = [](int port) {
+        int fd = socket(AF_INET, SOCK_STREAM, 0);
+        struct sockaddr_in addr = {};
+        addr.sin_family = AF_INET;
+        addr.sin_addr.s_addr = htonl(INADDR_ANY);
+        addr.sin_port = htons(port);
+        bool ok = bind(fd, (struct sockaddr*)&addr, sizeof(addr)) == 0;
+        close(fd);
+        return ok;
+    };
+
+    auto state = std::make_shared<State>();
+    std::string value = allocateResource(state, "ephemeralport", "", "eph-a");
+    int port = std::stoi(value);
+    assertTrue(port > 0, "Kernel picked a port");
+    assertTrue(!canBind(port), "Held by vp after allocation");
+    state->claimResource("ephemeralport", value, "eph-a");
+    state->releaseResources("eph-a");
+    assertTrue(canBind(port), "Let go on release");
+
+    Template tmpl;
+    tmpl.id = "eph";
+    tmpl.command = "sleep 300";
+    tmpl.resources = {"ephemeralport"};
+    auto inst = startProcess(state, tmpl, "eph-b", {});
+    port = std::stoi(inst->resources["ephemeralport"]);
+    assertTrue(canBind(port), "Closed at the child's exec, vp's copy dropped");
+    stopProcess(state, inst);
+}
+
+TEST(ReservedResourcesGoToTheirOwner) {
+    auto state = std::make_shared<State>();
+    auto rt = std::make_shared<ResourceType>();
+    rt->name = "slot";
+    rt->check = "";
+    rt->counter = true;
+    rt->start = 1;
+    rt->end = 3;
+    state->types["slot"] = rt;
+
+    assertEqual("2", reserveResource(state, "slot", "2", "app"), "Explicit value reserved");
+    assertEqual("1", allocateResource(state, "slot", "", "other"), "Counter hands out 1");
+    assertEqual("3", allocateResource(state, "slot", "", "other"), "Counter skips the reservation");
+    assertEqual("2", allocateResource(state, "slot", "", "app"), "Owner gets its reservation");
+
+    bool threw = false;
+    try {
+        allocateResource(state, "slot", "2", "other");
+    } catch (const std::exception& e) {
+        threw = std::string(e.what()).find("reserved for app") != std::string::npos;
+    }
+    assertTrue(threw, "Explicit request for someone else's reservation fails");
+
+    state->claimResource("slot", "2", "app");
+    state->releaseResources("app");
+    assertTrue(state->resources.count("slot:2") && state->resources["slot:2"]->reserved, "Survives release");
+    assertTrue(json(*state->resources["slot:2"]).value("reserved", false), "Persisted as reserved");
+
+    assertTrue(state->unreserveResource("slot", "2"), "Unreserve");
+    assertTrue(!state->resources.count("slot:2"), "Gone after unreserve");
+    assertTrue(!state->unreserveResource("slot", "2"), "Nothing left to unreserve");
+}
+
+TEST(PruneRemovesLongStoppedInstancesAndOrphans) {
+    char dir[] = "/tmp/vp-prune-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+    setenv("VP_STATE_DIR", dir, 1);
+    auto state = std::make_shared<State>();
+    time_t now = time(nullptr);
+    auto add = [&](const std::string& name, const std::string& status, time_t stoppedAt) {
+        auto inst = std::make_shared<Instance>();
+        inst->name = name;
+        inst->status = status;
+        inst->started = now - 30 * 86400;
+        inst->stopped_at = stoppedAt;
+        state->instances[name] = inst;
+        return inst;
+    };
+    add("old", "stopped", now - 10 * 86400);
+    add("recent", "stopped", now - 60);
+    add("locked", "stopped", now - 10 * 86400)->protect = true;
+    add("legacy", "error", 0); // No stop time: falls back to started
+    state->claimResource("tcpport", "3100", "old");
+    state->claimResource("tcpport", "3101", "gone");
+    state->claimResource("tcpport", "3102", "later", true);
+
+    mkdir(logDir().c_str(), 0755);
+    std::ofstream(logPath("old")) << "x\n";
+    std::ofstream(logPath("old") + ".1") << "x\n";
+    std::ofstream(logPath("recent")) << "x\n";
+
+    auto plan = pruneInstances(state, 7 * 86400, true);
+    assertEqual(2, (int)plan.instances.size(), "old and legacy");
+    assertEqual(2, (int)plan.logs.size(), "old's log and its rotation");
+    assertEqual(2, (int)plan.resources.size(), "old's claim and the orphan");
+    assertEqual(4, (int)state->instances.size(), "Dry run changes nothing");
+
+    pruneInstances(state, 7 * 86400);
+    assertTrue(!state->instances.count("old") && !state->instances.count("legacy"), "Pruned");
+    assertTrue(state->instances.count("recent") && state->instances.count("locked"), "Recent and locked kept");
+    assertTrue(access(logPath("old").c_str(), F_OK) != 0 && access(logPath("recent").c_str(), F_OK) == 0,
+               "Only the pruned instance's logs removed");
+    assertEqual(1, (int)state->resources.size(), "Only the reservation left");
+    assertTrue(state->resources.count("tcpport:3102"), "Reservation kept");
+    unsetenv("VP_STATE_DIR");
+    system(("rm -rf " + std::string(dir)).c_str());
+}
+
+TEST(SaveBatchWritesOnce) {
+    char dir[] = "/tmp/vp-batch-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+    setenv("VP_STATE_DIR", dir, 1);
+    auto state = std::make_shared<State>();
+    for (const char* name : {"a", "b", "c"}) {
+        auto inst = std::make_shared<Instance>();
+        inst->name = name;
+        inst->status = "stopped";
+        state->instances[name] = inst;
+    }
+    state->save();
+    unsigned long long before = state->revision();
+
+    {
+        SaveBatch batch(*state);
+        assertEqual("", instanceOperation(state, "a", "delete"), "Delete a");
+        {
+            SaveBatch nested(*state);
+            assertEqual("", instanceOperation(state, "b", "delete"), "Delete b");
+        }
+        assertEqual(before, state->revision(), "Nothing written inside the batch");
+    }
+    assertEqual(before + 1, state->revision(), "One write at the end");
+    assertEqual(1, (int)State::load()->instances.size(), "Both deletes saved");
+    unsetenv("VP_STATE_DIR");
+    system(("rm -rf " + std::string(dir)).c_str());
+}
+
+TEST(DiscoveryDepthPerCommand) {
+    char dir[] = "/tmp/vp-discover-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+    setenv("VP_STATE_DIR", dir, 1);
+    auto state = std::make_shared<State>();
+    assertEqual(std::string("full"), discoveryDepth(*state, "ps"), "Full by default");
+
+    state->discoverOn["*"] = "status";
+    state->discoverOn["tree"] = "off";
+    assertEqual(std::string("off"), discoveryDepth(*state, "tree"), "Command's own entry");
+    assertEqual(std::string("status"), discoveryDepth(*state, "ps"), "Else the default");
+
+    state->save();
+    auto loaded = State::load();
+    assertEqual(2, (int)loaded->discoverOn.size(), "Policy persisted");
+    assertEqual(std::string("off"), discoveryDepth(*loaded, "tree"), "Loaded policy applies");
+    unsetenv("VP_STATE_DIR");
+    system(("rm -rf " + std::string(dir)).c_str());
+}
+
+TEST(ResourceAllocation_ExternalAllocator) {
+    char tmp[] = "/tmp/vp-alloc-XXXXXX";
+    assertTrue(mkdtemp(tmp) != nullptr, "Should create temp dir");
+    std::string dir = tmp;
+    std::string script = dir + "/lic";
+    // Hands out lic-1, lic-2 and records releases; refuses explicit values
+    std::ofstream(script) << "#!/bin/sh\n"
+        "req=$(cat); d=$(dirname \"$0\")\n"
+        "case \"$1\" in\n"
+        "alloc) echo \"$req\" | grep -q '\"value\":\"\"' || { echo '{\"error\":\"no explicit values\"}'; exit 1; }\n"
+        "  n=$(($(cat \"$d/n\" 2>/dev/null || echo 0) + 1)); echo $n > \"$d/n\"; echo \"{\\\"value\\\":\\\"lic-$n\\\"}\" ;;\n"
+        "release) echo \"$req\" >> \"$d/released\"; echo '{}' ;;\n"
+        "check) echo '{\"available\":true}' ;;\n"
+        "esac\n";
+    system(("chmod +x " + script).c_str());
+
+    auto state = std::make_shared<State>();
+    auto rt = std::make_shared<ResourceType>();
+    rt->name = "license";
+    rt->counter = false;
+    rt->start = rt->end = 0;
+    rt->allocator = script;
+    state->types["license"] = rt;
+
+    assertEqual("lic-1", allocateResource(state, "license", "", "a"), "Allocator picks the value");
+    assertTrue(checkResource(*rt, "lic-9"), "check goes to the allocator");
+
+    bool threw = false;
+    try {
+        allocateResource(state, "license", "lic-7", "b");
+    } catch (const std::exception& e) {
+        threw = std::string(e.what()).find("no explicit values") != std::string::npos;
+    }
+    assertTrue(threw, "Allocator errors surface");
+
+    state->claimResource("license", "lic-1", "a");
+    state->releaseResources("a");
+    std::ifstream released(dir + "/released");
+    std::string line;
+    std::getline(released, line);
+    assertTrue(line.find("\"lic-1\"") != std::string::npos && line.find("\"a\"") != std::string::npos,
+               "Release is sent to the allocator");
+
+    json j = *rt;
+    assertEqual(script, j.value("allocator", ""), "Allocator persists");
+    system(("rm -rf " + dir).c_str());
+}
+
+TEST(Fake_WaitForInstance) {
+    FakeProc proc;
+    proc.add(90030, 1, "db", "db --port 5432");
+
+    auto inst = std::make_shared<Instance>();
+    inst->name = "db";
+    inst->pid = 90030;
+    inst->status = "running";
+    auto lookup = [&inst]() { return inst; };
+
+    assertTrue(waitForInstance(lookup, "running", 1000), "Running instance is running");
+    assertTrue(waitForInstance(lookup, "healthy", 1000), "No health check: running is healthy");
+    assertTrue(!waitForInstance(lookup, "stopped", 300), "Should time out waiting for stop");
+
+    inst->health = "false";
+    assertTrue(!waitForInstance(lookup, "healthy", 300), "Failing health check is not healthy");
+
+    proc.fake->removeProcess(90030);
+    assertTrue(waitForInstance(lookup, "stopped", 1000), "Exited process is stopped");
+    assertTrue(!waitForInstance([]() { return std::shared_ptr<Instance>(); }, "running", 0), "Deleted instance stops the wait");
+}
+
+TEST(Fake_ParentChainFindsLaunchScript) {
+    FakeProc proc;
+    proc.add(1, 0, "systemd", "/sbin/init");
+    proc.add(90060, 1, "tmux: server", "tmux");
+    proc.add(90061, 90060, "bash", "-bash");
+    proc.add(90062, 90061, "npm run dev", "npm run dev");
+    proc.add(90063, 90062, "sh", "sh -c next dev");
+    proc.add(90064, 90063, "node", "node /app/node_modules/.bin/next dev");
+
+    State state;
+    auto inst = std::make_shared<Instance>();
+    inst->pid = 90064;
+    state.instances["web"] = inst;
+
+    json result = parentChainJson(state, 90064);
+    assertEqual(6, (int)result["chain"].size(), "Up to init");
+    assertEqual(90064, result["chain"][0]["pid"].get<int>(), "Process first");
+    assertEqual("web", result["chain"][0].value("instance", ""), "Owning instance named");
+    assertEqual(90062, result["launch_script"].get<int>(), "npm run dev, not node");
+    assertTrue(parentChainJson(state, 90099).is_null(), "No such process");
+}
+
+TEST(Fake_MonitorByLaunchScript) {
+    FakeProc proc;
+    proc.add(1, 0, "systemd", "/sbin/init");
+    proc.add(90071, 1, "bash", "-bash");
+    proc.add(90072, 90071, "npm run dev", "npm run dev");
+    proc.add(90073, 90072, "node", "node server.js --port 3456");
+    proc.fake->listen(90073, 3456);
+
+    auto state = std::make_shared<State>();
+    auto inst = monitorProcess(state, 90073, "launch-web", true);
+    assertEqual(90072, inst->pid, "The launch script is the instance");
+    assertEqual("npm run dev", inst->command, "Restart repeats the user's invocation");
+    assertEqual("node server.js --port 3456", inst->leaf_command, "The leaf is recorded");
+    assertEqual("3456", inst->resources["tcpport"], "The leaf's port is claimed");
+
+    auto leaf = monitorProcess(state, 90073, "leaf-web");
+    assertEqual(90073, leaf->pid, "Without the flag the leaf itself");
+    assertTrue(leaf->leaf_command.empty(), "Nothing to record");
+}
+
+TEST(ParseContainerCgroup) {
+    std::string hex = "3f4e8a1b2c9d" + std::string(52, 'a');
+    std::string id, runtime;
+    assertTrue(parseContainerCgroup("12:memory:/docker/" + hex + "\n", id, runtime), "cgroup v1 docker");
+    assertEqual("3f4e8a1b2c9d", id, "Short ID");
+    assertEqual("docker", runtime, "Runtime");
+    assertTrue(parseContainerCgroup("0::/system.slice/docker-" + hex + ".scope\n", id, runtime), "cgroup v2 docker");
+    assertTrue(parseContainerCgroup("0::/user.slice/user-1000.slice/user@1000.service/user.slice/libpod-" + hex + ".scope\n",
+                                    id, runtime) && runtime == "podman", "podman");
+    assertTrue(parseContainerCgroup("0::/kubepods.slice/kubepods-pod1.slice/cri-containerd-" + hex + ".scope\n",
+                                    id, runtime) && runtime == "kubepods", "Kubernetes before its runtime");
+    assertTrue(parseContainerCgroup("0::/lxc.payload.web1/init.scope\n", id, runtime), "lxc");
+    assertEqual("web1", id, "lxc by name");
+    assertTrue(!parseContainerCgroup("0::/user.slice/user-1000.slice/session-2.scope\n", id, runtime), "Host session");
+}
+
+TEST(Fake_ContainerProcessKeepsItsPorts) {
+    FakeProc proc;
+    ProcessInfo info = {};
+    info.pid = 90095;
+    info.ppid = 1;
+    info.name = "nginx";
+    info.cmdline = "nginx -g daemon off;";
+    info.container = "3f4e8a1b2c9d";
+    info.container_runtime = "docker";
+    info.foreign_net = true;
+    info.start_time = 1;
+    proc.fake->addProcess(info);
+    proc.fake->listen(90095, 80); // In the container's network namespace
+
+    auto state = std::make_shared<State>();
+    auto discovered = discoverProcesses(state, false);
+    auto it = std::find_if(discovered.begin(), discovered.end(), [](auto& p) { return p["pid"] == "90095"; });
+    assertTrue(it != discovered.end(), "Discovered");
+    assertEqual("3f4e8a1b2c9d", (*it)["container"], "Labelled with its container");
+    assertEqual("", (*it)["ports"], "Its namespace's ports aren't listed");
+
+    auto inst = monitorProcess(state, 90095, "container-nginx");
+    assertEqual("3f4e8a1b2c9d", inst->container, "Instance records the container");
+    assertTrue(!inst->resources.count("tcpport") && state->resources.empty(), "Port 80 isn't claimed");
+}
+
+TEST(Fake_ImportKeepsDiscoverySnapshot) {
+    FakeProc proc;
+    proc.add(1, 0, "systemd", "/sbin/init");
+    proc.add(90081, 1, "bash", "-bash");
+    ProcessInfo info = {};
+    info.pid = 90082;
+    info.ppid = 90081;
+    info.name = "api";
+    info.cmdline = "./api --http 8080 --admin 8081";
+    info.exe = "/srv/api/api";
+    info.cwd = "/srv/api";
+    info.environ = {{"APP_ENV", "prod"}, {"API_TOKEN", "hunter2"}};
+    info.start_time = 1;
+    proc.fake->addProcess(info);
+    proc.fake->listen(90082, 8080);
+    proc.fake->listen(90082, 8081);
+
+    auto state = std::make_shared<State>();
+    auto inst = discoverAndImportProcessOnPort(state, 8081, "api");
+    assertEqual("/srv/api", inst->cwd, "Restart runs where it ran");
+    assertEqual("8081", inst->resources["tcpport"], "The port it was found on first");
+    assertEqual("8080", inst->resources["tcpport1"], "Its other port too");
+    assertEqual(2, (int)state->resources.size(), "Both claimed");
+
+    assertTrue(inst->discovered.has_value(), "Snapshot kept");
+    assertEqual("/srv/api/api", inst->discovered->exe, "Executable");
+    assertEqual("prod", inst->discovered->environ["APP_ENV"], "Environment");
+    assertEqual("(redacted)", inst->discovered->environ["API_TOKEN"], "Secrets aren't");
+    assertEqual(2, (int)inst->discovered->parents.size(), "Parents up to init");
+    assertEqual(90081, inst->discovered->parents[0].pid, "Nearest first");
+
+    Instance loaded = json(*inst).get<Instance>();
+    assertTrue(loaded.discovered.has_value(), "Round trip");
+    assertEqual("-bash", loaded.discovered->parents[0].cmdline, "Parents kept");
+    assertEqual(2, (int)loaded.discovered->ports.size(), "Ports kept");
+
+    bool threw = false;
+    try {
+        discoverAndImportProcess(state, 90082, "api");
+    } catch (const std::runtime_error&) {
+        threw = true;
+    }
+    assertTrue(threw, "Name taken");
+}
+
+TEST(Fake_RefreshClaimsPortsOpenedLater) {
+    FakeProc proc;
+    proc.add(1, 0, "systemd", "/sbin/init");
+    proc.add(90101, 1, "npm run dev", "npm run dev");
+    proc.fake->listen(90101, 3456);
+
+    auto state = std::make_shared<State>();
+    auto inst = monitorProcess(state, 90101, "warm-web");
+    assertEqual("3456", inst->resources["tcpport"], "Port at import");
+    assertTrue(refreshInstance(state, inst).empty(), "Nothing changed yet");
+
+    // After warmup a child opens an admin port
+    proc.add(90102, 90101, "node", "node server.js");
+    proc.fake->listen(90102, 3457);
+    auto changes = refreshInstance(state, inst);
+    auto changed = [&](const std::string& field) {
+        return std::find_if(changes.begin(), changes.end(), [&](const FieldDiff& d) { return d.field == field; });
+    };
+    assertTrue(changed("ports") != changes.end(), "Ports reported");
+    assertEqual("3456,3457", changed("ports")->b, "Both now");
+    assertTrue(changed("resources.tcpport1") != changes.end(), "New claim reported");
+    assertEqual("3457", inst->resources["tcpport1"], "Child's port claimed");
+    assertTrue(state->resources.count("tcpport1:3457"), "In the resource table");
+    assertEqual("1", changed("children")->b, "Child counted");
+    assertEqual(2, (int)inst->discovered->ports.size(), "Snapshot updated");
+    assertTrue(refreshInstance(state, inst).empty(), "Stable after that");
+
+    proc.fake->removeProcess(90102);
+    proc.fake->removeProcess(90101);
+    bool threw = false;
+    try {
+        refreshInstance(state, inst);
+    } catch (const std::runtime_error&) {
+        threw = true;
+    }
+    assertTrue(threw, "Gone process can't be refreshed");
+}
+
+TEST(Fake_RematchStoppedInstancesByRule) {
+    FakeProc proc;
+    auto addProc = [&](int pid, int ppid, const std::string& cmdline, const std::string& cwd,
+                       std::map<std::string, std::string> env = {}) {
+        ProcessInfo info = {};
+        info.pid = pid;
+        info.ppid = ppid;
+        info.name = "node";
+        info.exe = "/usr/bin/node";
+        info.cmdline = cmdline;
+        info.cwd = cwd;
+        info.environ = env;
+        info.start_time = 1;
+        proc.fake->addProcess(info);
+    };
+    addProc(90081, 1, "node api.js", "/srv/api");
+    addProc(90082, 1, "node web.js", "/srv/web");
+    addProc(90083, 90082, "node web.js --worker", "/srv/web"); // Shares the listening socket
+    addProc(90084, 1, "node other.js", "/srv/web", {{"APP", "admin"}});
+    proc.fake->listen(90081, 4001);
+    proc.fake->listen(90082, 4002);
+    proc.fake->listen(90083, 4002);
+
+    auto state = std::make_shared<State>();
+    auto add = [&](const std::string& name, const std::string& command, const std::string& cwd, const std::string& port) {
+        auto inst = std::make_shared<Instance>();
+        inst->name = name;
+        inst->command = command;
+        inst->cwd = cwd;
+        inst->status = "stopped";
+        if (!port.empty()) inst->resources["tcpport"] = port;
+        state->instances[name] = inst;
+        return inst;
+    };
+    auto web = add("web", "/usr/bin/node web.js", "/srv/web", "4002");
+    auto wrongCwd = add("api", "node api.js", "/srv/elsewhere", "4001");
+    auto noPort = add("noport", "node other.js", "/srv/web", "");
+    auto admin = add("admin", "node other.js", "/srv/web", "");
+    admin->match = MatchRule{"other\\.js", "node", "", "APP=admin", false};
+
+    assertTrue(!matchRuleFor(*noPort), "No tcpport, no default rule");
+    assertEqual(2, rematchInstances(state), "web and admin found");
+    assertEqual(90082, web->pid, "The parent, not the worker sharing its port");
+    assertEqual("running", web->status, "Running again");
+    assertEqual(90084, admin->pid, "Matched by cmdline regex and env marker");
+    assertEqual("stopped", wrongCwd->status, "Default rule checks cwd");
+    assertEqual("stopped", noPort->status, "Not rematched");
+    assertEqual(0, rematchInstances(state), "Nothing left to find");
+
+    json j = *admin;
+    assertEqual("APP=admin", j["match"].value("env", ""), "Rule persists");
+    assertTrue(!j["match"].value("port", true), "port: false persists");
+}
+
+TEST(Fake_RematchByInstanceMarker) {
+    FakeProc proc;
+    auto addProc = [&](int pid, int ppid, const std::string& cwd, const std::string& marker) {
+        ProcessInfo info = {};
+        info.pid = pid;
+        info.ppid = ppid;
+        info.name = "node";
+        info.exe = "/usr/bin/node";
+        info.cmdline = "node server.js";
+        info.cwd = cwd;
+        if (!marker.empty()) info.environ["VP_INSTANCE"] = marker;
+        info.start_time = 1;
+        proc.fake->addProcess(info);
+    };
+    // Two identical servers: only their markers tell them apart
+    addProc(90091, 1, "/srv/app", "blue:aa");
+    addProc(90092, 90091, "/srv/app", "blue:aa"); // Child inherits the marker
+    addProc(90093, 1, "/srv/app", "green:bb");
+    proc.fake->listen(90091, 4101);
+    proc.fake->listen(90093, 4101);
+
+    auto state = std::make_shared<State>();
+    auto add = [&](const std::string& name, const std::string& marker) {
+        auto inst = std::make_shared<Instance>();
+        inst->name = name;
+        inst->command = "node server.js";
+        inst->cwd = "/srv/app";
+        inst->status = "stopped";
+        inst->marker = marker;
+        inst->resources["tcpport"] = "4101";
+        state->instances[name] = inst;
+        return inst;
+    };
+    auto blue = add("blue", "blue:aa");
+    auto green = add("green", "green:bb");
+    auto other = add("other", "");
+
+    assertEqual(2, rematchInstances(state), "Both found by marker despite matching the same rule");
+    assertEqual(90091, blue->pid, "Topmost process with blue's marker");
+    assertEqual(90093, green->pid, "green's marked process");
+    assertEqual("stopped", other->status, "Rule doesn't take processes marked for other instances");
+
+    json j = *blue;
+    assertEqual("blue:aa", j.value("marker", ""), "Marker persists");
+}
+
+TEST(Fake_DiffInstances) {
+    FakeProc proc;
+    auto addProc = [&](int pid, const std::string& mode, long fdLimit) {
+        ProcessInfo info = {};
+        info.pid = pid;
+        info.ppid = 1;
+        info.name = "node";
+        info.cmdline = "node server.js";
+        info.environ = {{"NODE_ENV", mode}, {"VP_INSTANCE", "x:" + std::to_string(pid)}};
+        info.fd_limit = fdLimit;
+        info.start_time = 1;
+        proc.fake->addProcess(info);
+    };
+    addProc(90111, "production", 1024);
+    addProc(90112, "development", 65536);
+
+    auto make = [](const std::string& name, int pid, const std::string& port) {
+        Instance inst = {};
+        inst.name = name;
+        inst.pid = pid;
+        inst.status = "running";
+        inst.command = "node server.js --port " + port;
+        inst.cwd = "/srv/app";
+        inst.template_name = "node";
+        inst.resources = {{"tcpport", port}};
+        return inst;
+    };
+    auto a = make("web-1", 90111, "3001");
+    auto b = make("web-2", 90112, "3002");
+    b.labels["canary"] = "true";
+
+    std::map<std::string, FieldDiff> diffs;
+    for (const auto& d : diffInstances(a, b)) diffs[d.field] = d;
+    assertEqual(5, (int)diffs.size(), "command, port, env, limit and label differ");
+    assertEqual("development", diffs["env.NODE_ENV"].b, "Live environment compared");
+    assertEqual("1024", diffs["limits.nofile"].a, "Limits compared");
+    assertEqual("", diffs["labels.canary"].a, "Unset on one side");
+    assertTrue(!diffs.count("cwd") && !diffs.count("env.VP_INSTANCE"), "Same cwd; markers always differ");
+    assertEqual(0, (int)diffInstances(a, a).size(), "Nothing against itself");
+    assertTrue(!instanceFacts(a, false).count("env.NODE_ENV"), "Not live: template env only");
+}
+
+TEST(Fake_TemplateFromInstance) {
+    FakeProc proc;
+    ProcessInfo info = {};
+    info.pid = 90101;
+    info.ppid = 1;
+    info.name = "node";
+    info.cmdline = "node server.js --port 3001 --admin 3002 --retries 30010";
+    info.environ = {{"NODE_ENV", "production"}, {"API_TOKEN", "hunter2"}, {"VP_INSTANCE", "web:aa"}};
+    if (getenv("PATH")) info.environ["PATH"] = getenv("PATH"); // Same as vp's: not captured
+    info.start_time = 1;
+    proc.fake->addProcess(info);
+
+    auto state = std::make_shared<State>();
+    state->types = defaultResourceTypes();
+    Instance inst = {};
+    inst.name = "web";
+    inst.pid = 90101;
+    inst.command = info.cmdline + " 100%";
+    inst.cwd = "/srv/app";
+    inst.health = "curl -sf localhost:3001/health";
+    inst.resources = {{"tcpport", "3001"}, {"tcpport1", "3002"}, {"workdir", "/srv/app"}};
+
+    auto tmpl = templateFromInstance(*state, inst, "web");
+    assertEqual("node server.js --port ${tcpport} --admin %tcpport --retries 30010 100%%", tmpl.command,
+                "Ports parameterized, the rest escaped");
+    assertEqual("curl -sf localhost:${tcpport}/health", tmpl.health, "Health check too");
+    assertEqual(1, (int)tmpl.resources.size(), "tcpport claimed; workdir is the cwd");
+    assertEqual("${cwd}", tmpl.cwd, "cwd is a var");
+    assertEqual("/srv/app", tmpl.vars["cwd"], "Defaulting to where it ran");
+    assertEqual("production", tmpl.vars["NODE_ENV"], "Env captured as a default");
+    assertEqual("${NODE_ENV}", tmpl.env["NODE_ENV"], "And passed on");
+    assertEqual("env:API_TOKEN", tmpl.secrets["API_TOKEN"], "Secret-looking names stay references");
+    assertTrue(!tmpl.env.count("PATH") && !tmpl.env.count("VP_INSTANCE"), "Inherited and vp's own left out");
+
+    auto rendered = renderTemplate(*state, tmpl, {});
+    assertEqual("production", rendered->env["NODE_ENV"], "Template env is interpolated into the instance");
+}
+
+TEST(AdHocRunTemplate) {
+    char dir[] = "/tmp/vp-run-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+    setenv("VP_STATE_DIR", dir, 1);
+    auto state = std::make_shared<State>();
+    state->types = defaultResourceTypes();
+
+    auto tmpl = adHocTemplate(*state, "web", "python3 -m http.server %tcpport # ${tcpport} ${HOME} %s %%", dir);
+    assertEqual("run-web", tmpl.id, "One-off template ID");
+    assertEqual("python3 -m http.server ${tcpport} # ${tcpport} $${HOME} %%s %%%%", tmpl.command,
+                "Resource types are vp's, the rest is escaped for the shell");
+    assertEqual(1, (int)tmpl.resources.size(), "tcpport claimed once");
+    assertEqual("run-proj-web", adHocTemplate(*state, "proj/web", "true", dir).id, "Project names flattened");
+
+    assertEqual("sleep-1", adHocName(*state, "FOO=1 /bin/sleep 30"), "Named after the program");
+    state->templates[tmpl.id] = std::make_shared<Template>(tmpl);
+    auto inst = startProcess(state, tmpl, "web", {});
+    assertTrue(!inst->resources["tcpport"].empty(), "Port allocated");
+    assertTrue(inst->command.find("http.server " + inst->resources["tcpport"] + " # " + inst->resources["tcpport"] +
+                                  " ${HOME} %s %%") != std::string::npos, "Shell text comes through unchanged");
+    assertEqual(std::string(dir), inst->cwd, "Runs in the given directory");
+
+    assertEqual("", instanceOperation(state, "web", "delete", false), "Deleted");
+    assertTrue(!state->templates.count("run-web"), "Its template goes with it");
+    unsetenv("VP_STATE_DIR");
+    system(("rm -rf " + std::string(dir)).c_str());
+}
+
+TEST(GeneratedInstanceNames) {
+    State state;
+    std::set<std::string> seen;
+    for (int i = 0; i < 50; i++) {
+        std::string name = generateInstanceName(state, "node-express");
+        assertTrue(name.rfind("node-express-", 0) == 0, "Starts with the template: " + name);
+        std::string words = name.substr(13);
+        auto dash = words.find('-');
+        bool pair = dash != std::string::npos && dash > 0 && words.find('-', dash + 1) == std::string::npos;
+        bool number = words.find_first_not_of("0123456789") == std::string::npos;
+        assertTrue(pair || number, "adjective-noun or a number: " + name);
+        assertTrue(!seen.count(name), "Never one that's taken: " + name);
+        seen.insert(name);
+        auto inst = std::make_shared<Instance>();
+        inst->name = name;
+        state.instances[name] = inst;
+    }
+    assertTrue(generateInstanceName(state, "api", "shop").rfind("shop/api-", 0) == 0, "Qualified with the project");
+
+    // A long template ID is cut to leave room for the words, never mid-way at a '-'
+    std::string longId = std::string(47, 'a') + "-" + std::string(12, 'b');
+    assertEqual(60, (int)longId.size(), "60 characters");
+    for (int i = 0; i < 50; i++) {
+        std::string name = generateInstanceName(state, longId, i % 2 ? "shop" : "");
+        assertEqual("", nameError(name, true), "Valid: " + name);
+        assertTrue(name.find("--") == std::string::npos, "No empty part: " + name);
+        auto inst = std::make_shared<Instance>();
+        inst->name = name;
+        state.instances[name] = inst;
+    }
+}
+
+TEST(StartSetsInstanceMarker) {
+    auto state = std::make_shared<State>();
+    Template tmpl;
+    tmpl.id = "marked";
+    tmpl.command = "sleep 5";
+    auto inst = startProcess(state, tmpl, "marked-test", {});
+    assertTrue(inst->marker.rfind("marked-test:", 0) == 0, "Marker is name:random");
+    assertEqual(12 + 32, (int)inst->marker.size(), "128 random bits");
+
+    std::string environ;
+    for (int i = 0; i < 20 && environ.find("VP_INSTANCE=") == std::string::npos; i++) {
+        std::this_thread::sleep_for(std::chrono::milliseconds(50));
+        std::ifstream file("/proc/" + std::to_string(inst->pid) + "/environ");
+        environ.assign(std::istreambuf_iterator<char>(file), {});
+    }
+    assertTrue(environ.find("VP_INSTANCE=" + inst->marker) != std::string::npos, "Child has the marker");
+    stopProcess(state, inst);
+}
+
+TEST(Fake_PidReuseIsDetected) {
+    FakeProc proc;
+    proc.add(90040, 1, "api", "api --port 8000", 0, 0, 1000);
+
+    auto state = std::make_shared<State>();
+    auto inst = std::make_shared<Instance>();
+    inst->name = "api";
+    inst->pid = 90040;
+    inst->status = "running";
+    inst->start_ticks = 1000;
+    state->instances["api"] = inst;
+
+    assertTrue(instanceProcessAlive(*inst), "Same pid and start time");
+
+    // The process exits and an unrelated one gets its PID
+    proc.add(90040, 1, "other", "other", 0, 0, 2000);
+    assertTrue(!instanceProcessAlive(*inst), "Reused PID is not our process");
+
+    matchAndUpdateInstances(state);
+    assertEqual("stopped", inst->status, "Instance with reused PID is stopped");
+    assertEqual(0, inst->pid, "PID cleared");
+}
+
+TEST(AwaitReady_RollsBackWhenNotReady) {
+    auto state = std::make_shared<State>();
+    Template tmpl;
+    tmpl.id = "never-ready";
+    tmpl.command = "sleep 300";
+    tmpl.health = "false";
+
+    auto inst = startProcess(state, tmpl, "await-test", {});
+    state->claimResource("slot", "1", "await-test");
+    int pid = inst->pid;
+
+    assertTrue(!awaitReady(state, inst, 300), "Failing health check should not be ready");
+    assertTrue(state->instances.find("await-test") == state->instances.end(), "Instance should be removed");
+    assertTrue(state->resources.empty(), "Resources should be released");
+    assertTrue(!isProcessRunning(pid), "Process should be stopped");
+}
+
+TEST(StartupProbeHoldsStartingUntilReady) {
+    auto state = std::make_shared<State>();
+    auto tmpl = json::parse(R"({
+        "id": "slow-start", "label": "", "resources": [], "vars": {},
+        "command": "sleep 0.3; echo 'server ready'; sleep 300",
+        "startup": {"log": "ready$", "port": 0, "timeout": 10}
+    })").get<Template>();
+    assertEqual("0", tmpl.startup->port, "Port given as a number");
+    tmpl.startup->port.clear();
+
+    auto inst = startProcess(state, tmpl, "slow-start", {});
+    assertEqual("starting", inst->status, "Not running until the probe passes");
+    assertTrue(!settleStartup(state, inst, inst->started + 1), "Nothing logged yet, deadline ahead");
+    auto snapshot = [&]() {
+        auto data = state->lock();
+        return std::make_shared<Instance>(*inst);
+    };
+    assertTrue(waitForInstance(snapshot, "running", 3000), "Running once the line is logged");
+
+    // Restarting starts over: the line from the last run doesn't count
+    stopProcess(state, inst);
+    assertTrue(restartProcess(state, inst), "Restart");
+    assertEqual("starting", inst->status, "Starting again");
+    assertTrue(!startupPassed(*inst), "Earlier output ignored");
+    stopProcess(state, inst);
+
+    // Past the deadline: error, and with kill the process goes too
+    Template never;
+    never.id = "never-up";
+    never.command = "sleep 300";
+    never.resources = {"slot"};
+    never.startup = StartupProbe{"1", "", "", 2, true};
+    state->types["slot"] = std::make_shared<ResourceType>();
+    state->types["slot"]->name = "slot";
+    auto failed = startProcess(state, never, "never-up", {{"slot", "1"}});
+    int pid = failed->pid;
+    assertTrue(settleStartup(state, failed, failed->started + 2), "Deadline passed");
+    assertEqual("error", failed->status, "Marked error");
+    assertTrue(failed->error.find("within 2s") != std::string::npos, "Says why");
+    assertTrue(!isProcessRunning(pid), "Killed");
+    assertTrue(state->resources.empty(), "Resources released");
+    assertTrue(restartProcess(state, failed), "Can be started again");
+    assertEqual("starting", failed->status, "Probing again");
+    stopProcess(state, failed);
+}
+
+TEST(TimelineRecordsStatusChangesWithCauses) {
+    char dir[] = "/tmp/vp-timeline-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+    setenv("VP_STATE_DIR", dir, 1);
+    auto state = std::make_shared<State>();
+    Template tmpl;
+    tmpl.id = "flaky";
+    tmpl.command = "sleep 0.2; exit 3";
+
+    auto inst = startProcess(state, tmpl, "flaky", {});
+    auto snapshot = [&]() {
+        auto data = state->lock();
+        return std::make_shared<Instance>(*inst);
+    };
+    assertTrue(waitForInstance(snapshot, "stopped", 3000), "Exits");
+    for (int i = 0; i < 20 && snapshot()->status != "crashed"; i++) {
+        std::this_thread::sleep_for(std::chrono::milliseconds(50)); // Reaper marks it
+    }
+    {
+        auto data = state->lock();
+        auto& timeline = state->timelines["flaky"];
+        assertEqual(2, (int)timeline.size(), "Start and exit");
+        assertEqual("", timeline[0].from, "New instance");
+        assertEqual("running", timeline[0].to, "Started");
+        assertEqual("running", timeline[1].from, "From running");
+        assertEqual("crashed", timeline[1].to, "A nonzero exit is a crash");
+        assertEqual("exited with code 3", timeline[1].cause, "Exit code as the cause");
+    }
+
+    inst->command = "sleep 300";
+    assertTrue(restartProcess(state, inst), "Restart");
+    stopProcess(state, inst);
+    auto timeline = state->timelines["flaky"];
+    assertEqual(5, (int)timeline.size(), "Restart, stopping and stop added");
+    assertTrue(timeline[2].cause.rfind("restarted (PID", 0) == 0, "Restart cause");
+    assertEqual("crashed", timeline[2].from, "Restarted from crashed");
+    assertEqual("stopping", timeline[3].to, "Stopping on the way");
+    assertEqual("stopped by vp", timeline[4].cause, "Stop cause");
+
+    // Persisted with the state, and dropped with the instance
+    auto loaded = State::load();
+    assertEqual(5, (int)loaded->timelines["flaky"].size(), "Round trip");
+    assertEqual("exited with code 3", loaded->timelines["flaky"][1].cause, "Causes kept");
+    state->instances.erase("flaky");
+    state->save();
+    assertTrue(!State::load()->timelines.count("flaky"), "Deleted instance's timeline gone");
+    unsetenv("VP_STATE_DIR");
+    system(("rm -rf " + std::string(dir)).c_str());
+}
+
+TEST(StatusModelCrashesUnhealthyAndOrphaned) {
+    char dir[] = "/tmp/vp-status-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+    setenv("VP_STATE_DIR", dir, 1);
+    auto state = std::make_shared<State>();
+    auto settle = [&](std::shared_ptr<Instance> inst, const std::string& status) {
+        for (int i = 0; i < 60; i++) {
+            {
+                auto data = state->lock();
+                if (inst->status == status) return true;
+            }
+            std::this_thread::sleep_for(std::chrono::milliseconds(50));
+        }
+        return false;
+    };
+
+    // A clean exit is a stop, a nonzero one a crash; repeated crashes a loop
+    Template tmpl;
+    tmpl.id = "exits";
+    tmpl.command = "exit 0";
+    auto clean = startProcess(state, tmpl, "clean", {});
+    assertTrue(settle(clean, "stopped"), "Exit 0 stops");
+    tmpl.command = "exit 1";
+    auto crashy = startProcess(state, tmpl, "crashy", {});
+    assertTrue(settle(crashy, "crashed"), "Exit 1 crashes");
+    assertTrue(instanceDown(*crashy), "A crashed instance can start again");
+    assertTrue(restartProcess(state, crashy), "Restart after one crash");
+    assertTrue(settle(crashy, "crashed"), "Second crash");
+    assertTrue(restartProcess(state, crashy), "Restart after two crashes");
+    assertTrue(settle(crashy, "crash-loop"), "Third crash within the window is a loop");
+    {
+        auto data = state->lock();
+        int statusEvents = 0;
+        for (const auto& event : state->events) {
+            if (event.kind == "status" && event.instance == "crashy") statusEvents++;
+        }
+        assertEqual(3, statusEvents, "One event per crash");
+        assertEqual("crash-loop: exited with code 1", state->events.back().message, "Status and cause");
+    }
+
+    // A failed health check marks it unhealthy until one passes
+    tmpl.id = "checked";
+    tmpl.command = "sleep 300";
+    tmpl.health = "false";
+    tmpl.health_failures = 3;
+    tmpl.health_interval = 1;
+    auto checked = startProcess(state, tmpl, "checked", {});
+    HealthSupervisor supervisor;
+    supervisor.check(state, 1000);
+    assertEqual("unhealthy", checked->status, "Failed check");
+    assertTrue(instanceUp(*checked) && instanceRunning(*checked), "Still up");
+    checked->health = "true";
+    supervisor.check(state, 1001);
+    assertEqual("running", checked->status, "Passed check");
+    stopProcess(state, checked);
+
+    // A PID whose start time can't be read is orphaned until it can be
+    {
+        FakeProc proc;
+        proc.add(90050, 1, "api", "api", 0, 0, 0);
+        auto inst = std::make_shared<Instance>();
+        inst->name = "api";
+        inst->pid = 90050;
+        inst->status = "running";
+        inst->start_ticks = 1000;
+        state->instances["api"] = inst;
+
+        matchAndUpdateInstances(state, false);
+        assertEqual("orphaned", inst->status, "Unverifiable PID");
+        assertEqual(90050, inst->pid, "PID kept");
+        assertTrue(!stopProcess(state, inst), "Not signalled");
+
+        proc.add(90050, 1, "api", "api", 0, 0, 1000);
+        matchAndUpdateInstances(state, false);
+        assertEqual("running", inst->status, "Verified again");
+
+        proc.add(90050, 1, "api", "api", 0, 0, 0);
+        matchAndUpdateInstances(state, false);
+        proc.fake->removeProcess(90050);
+        matchAndUpdateInstances(state, false);
+        assertEqual("stopped", inst->status, "Gone");
+        assertEqual(0, inst->pid, "PID cleared");
+        state->instances.erase("api");
+    }
+
+    AlertCondition cond = parseAlertCondition("status == crash-loop");
+    assertTrue(conditionHolds(cond, *crashy, 0, nullptr), "Status alert condition");
+    bool threw = false;
+    try {
+        parseAlertCondition("status == sleepy");
+    } catch (const std::invalid_argument&) {
+        threw = true;
+    }
+    assertTrue(threw, "Unknown status refused");
+
+    unsetenv("VP_STATE_DIR");
+    system(("rm -rf " + std::string(dir)).c_str());
+}
+
+TEST(TemplateLimitsWarnWhenExceeded) {
+    Template tmpl = json::parse(R"({"id": "hog", "label": "", "command": "hog", "resources": [], "vars": {},
+                                    "limits": {"max_rss": 1048576, "max_cpu_percent": 150, "max_fds": 10}})")
+                        .get<Template>();
+    assertTrue(tmpl.limits && tmpl.limits->max_cpu_percent == 150, "Parsed");
+    assertEqual(10, json(tmpl)["limits"]["max_fds"].get<int>(), "Round trip");
+
+    auto state = std::make_shared<State>();
+    Instance inst;
+    inst.name = "hog";
+    inst.limits = tmpl.limits;
+    inst.rss = 2 * 1048576;
+    inst.fds = 5;
+    assertEqual(1, (int)exceededLimits(inst).size(), "Only rss");
+    assertTrue(checkLimits(*state, inst, 1000), "Went over");
+    assertEqual("max_rss", inst.over_limit[0], "Marked");
+    assertEqual("limit", state->events.back().kind, "Event recorded");
+    assertEqual("rss 2MB over max_rss 1MB", state->events.back().message, "Says by how much");
+    size_t events = state->events.size();
+    assertTrue(!checkLimits(*state, inst, 1001), "Still over: no change");
+    assertEqual((int)events, (int)state->events.size(), "Once per crossing");
+
+    inst.fds = 20;
+    assertTrue(checkLimits(*state, inst, 1002), "Another limit");
+    assertEqual(2, (int)inst.over_limit.size(), "Both marked");
+    assertEqual("max_fds", state->events.back().rule, "Only the new one recorded");
+    inst.rss = 0;
+    inst.fds = 0;
+    assertTrue(checkLimits(*state, inst, 1003) && inst.over_limit.empty(), "Back under");
+    assertEqual((int)events + 1, (int)state->events.size(), "No event for going back under");
+
+    // Checked as discovery samples usage
+    FakeProc proc;
+    proc.add(90060, 1, "hog", "hog", 0, 5 * 1048576, 1000);
+    auto running = std::make_shared<Instance>(inst);
+    running->pid = 90060;
+    running->status = "running";
+    running->start_ticks = 1000;
+    state->instances["hog"] = running;
+    matchAndUpdateInstances(state, false);
+    assertEqual(1, (int)running->over_limit.size(), "Over after sampling");
+    proc.fake->removeProcess(90060);
+    matchAndUpdateInstances(state, false);
+    assertTrue(running->over_limit.empty(), "Cleared when it exits");
+}
+
+TEST(SecretsReachOnlyTheChildEnvironment) {
+    setenv("VP_TEST_SECRET", "s3cret-env", 1);
+    std::string file = "/tmp/vp-secret-" + std::to_string(getpid());
+    std::ofstream(file) << "s3cret-file\n";
+
+    assertEqual("s3cret-env", resolveSecret("env:VP_TEST_SECRET"), "env: reference");
+    assertEqual("s3cret-file", resolveSecret("file:" + file), "file: reference drops the newline");
+    bool threw = false;
+    try {
+        resolveSecrets({{"DB_PASSWORD", "env:VP_TEST_UNSET"}});
+    } catch (const std::runtime_error& e) {
+        threw = std::string(e.what()).find("DB_PASSWORD") != std::string::npos;
+    }
+    assertTrue(threw, "Errors name the secret");
+
+    if (system("command -v openssl >/dev/null 2>&1") == 0) {
+        std::string blob = encryptSecret("s3cret 'enc' $x");
+        assertTrue(blob.rfind("enc:", 0) == 0 && blob.find("s3cret") == std::string::npos, "Encrypted reference");
+        assertEqual("s3cret 'enc' $x", resolveSecret(blob), "Round trip");
+        std::string big(200000, 'k');
+        assertEqual(big, resolveSecret(encryptSecret(big)), "Large value round trip");
+
+        // enc:aes256gcm:<base64 of salt, nonce, ciphertext, tag>
+        std::string sealed = encryptSecret(std::string(64, 'v'));
+        size_t end = std::min(sealed.find('='), sealed.size());
+        auto refused = [](const std::string& ref) {
+            try {
+                resolveSecret(ref);
+                return false;
+            } catch (const std::runtime_error&) {
+                return true;
+            }
+        };
+        auto flip = [](std::string text, size_t i) {
+            text[i] = text[i] == 'A' ? 'B' : 'A';
+            return text;
+        };
+        assertTrue(refused(flip(sealed, 14 + 60)), "Modified ciphertext refused");
+        assertTrue(refused(flip(sealed, end - 3)), "Modified tag refused");
+        assertEqual(std::string(64, 'v'), resolveSecret(sealed), "Intact value resolves");
+
+        // Encrypted by an older vp with openssl enc
+        std::string legacy;
+        FILE* pipe = popen(("printf s3cret | openssl enc -aes-256-cbc -pbkdf2 -a -A -salt -pass file:" +
+                            shellQuote(secretKeyPath())).c_str(), "r");
+        char buffer[256];
+        while (pipe && fgets(buffer, sizeof(buffer), pipe)) legacy += buffer;
+        if (pipe) pclose(pipe);
+        assertTrue(refused("enc:" + legacy), "Unauthenticated value refused by default");
+        setenv("VP_STATE_ACCEPT_UNAUTHENTICATED", "1", 1);
+        assertEqual("s3cret", resolveSecret("enc:" + legacy), "Resolves with consent");
+        unsetenv("VP_STATE_ACCEPT_UNAUTHENTICATED");
+    }
+
+    std::string out = file + ".out";
+    auto state = std::make_shared<State>();
+    Template tmpl;
+    tmpl.id = "secretive";
+    tmpl.command = "echo \"$A $B\" > " + out + "; sleep 300";
+    tmpl.secrets = {{"A", "env:VP_TEST_SECRET"}, {"B", "file:" + file}};
+    auto inst = startProcess(state, tmpl, "secretive", {});
+    for (int i = 0; i < 20 && access(out.c_str(), F_OK) != 0; i++) usleep(50000);
+    usleep(50000);
+    std::ifstream in(out);
+    std::string line;
+    std::getline(in, line);
+    assertEqual("s3cret-env s3cret-file", line, "Child sees the values");
+    assertTrue(getenv("A") == nullptr, "vp's own environment doesn't");
+
+    std::string saved = json(*inst).dump();
+    assertTrue(saved.find("s3cret") == std::string::npos && saved.find("env:VP_TEST_SECRET") != std::string::npos,
+               "State keeps references, not values");
+    stopProcess(state, inst);
+
+    threw = false;
+    try {
+        json::parse(R"({"id": "t", "label": "", "command": "x", "resources": [], "vars": {},
+                        "secrets": {"P": "plaintext"}})").get<Template>();
+    } catch (const std::invalid_argument&) {
+        threw = true;
+    }
+    assertTrue(threw, "Plain values are refused");
+
+    unsetenv("VP_TEST_SECRET");
+    unlink(file.c_str());
+    unlink(out.c_str());
+}
+
+TEST(StateMigratesOldSchemasAndRefusesBadOnes) {
+    // Unversioned, as the Go vp wrote it: nulls for empty maps, RFC 3339 times
+    json j = json::parse(R"({
+        "instances": {"web": {"name": "web", "template": "node", "command": "node app.js", "pid": 0,
+                              "status": "stopped", "resources": null, "labels": null,
+                              "started": "2024-05-01T12:00:00.25+02:00", "managed": true}},
+        "templates": {"node": {"id": "node", "label": "Node", "command": "node app.js",
+                               "resources": null, "vars": null}},
+        "counters": null
+    })");
+    assertEqual(0, State::migrate(j), "Unversioned is v0");
+    assertEqual(State::SCHEMA_VERSION, j["schema_version"].get<int>(), "Now current");
+    Instance inst = j["instances"]["web"].get<Instance>();
+    assertEqual(1714557600, (int)inst.started, "RFC 3339 time to Unix seconds");
+    assertTrue(inst.resources.empty() && inst.labels.empty(), "Nulls read as empty");
+    assertTrue(j["templates"]["node"].get<Template>().vars.empty(), "Template nulls too");
+    assertTrue(!j.contains("counters"), "Null section dropped");
+
+    json newer = {{"schema_version", State::SCHEMA_VERSION + 1}};
+    bool threw = false;
+    try {
+        State::migrate(newer);
+    } catch (const std::runtime_error&) {
+        threw = true;
+    }
+    assertTrue(threw, "Newer schema refused");
+
+    // A corrupt file is an error, not a silent reset to defaults
+    State::load()->save();
+    std::string stateFile = State::getStateDir() + "/state.json";
+    std::ifstream in(stateFile);
+    std::stringstream saved;
+    saved << in.rdbuf();
+    std::ofstream(stateFile) << "{\"instances\": ";
+    threw = false;
+    try {
+        State::load();
+    } catch (const std::runtime_error&) {
+        threw = true;
+    }
+    assertTrue(threw, "Corrupt state refused");
+    std::ofstream(stateFile) << saved.str();
+    assertEqual(State::SCHEMA_VERSION, State::load()->schemaVersion, "Saved files are current");
+}
+
+TEST(NameValidationAndMigration) {
+    assertTrue(nameError("web-1.v2_x").empty(), "Plain name");
+    assertTrue(nameError("shop/api").empty(), "Qualified name");
+    assertTrue(!nameError("shop/api", false).empty(), "No project on template IDs");
+    assertTrue(!nameError("my app").empty(), "Spaces refused");
+    assertTrue(!nameError("a/b/c").empty(), "One project only");
+    assertTrue(!nameError("-x").empty(), "Leading dash refused");
+    assertTrue(!nameError("").empty(), "Empty refused");
+    assertTrue(!nameError(std::string(64, 'a')).empty(), "Too long");
+    assertEqual(std::string("my-app"), normalizeName("my app!"), "Normalized");
+    assertEqual(std::string("shop/a-b"), normalizeName("shop/a b"), "Project kept");
+    assertEqual(std::string("unnamed"), normalizeName("!!!"), "Nothing left");
+
+    json j = json::parse(R"({
+        "schema_version": 1,
+        "instances": {
+            "my app": {"name": "my app", "template": "run-my app", "template_name": "run-my app",
+                       "command": "sleep 1", "pid": 0, "status": "stopped"},
+            "my-app": {"name": "my-app", "template": "bad id", "template_name": "bad id",
+                       "command": "sleep 1", "pid": 0, "status": "stopped"}
+        },
+        "templates": {
+            "run-my app": {"id": "run-my app", "label": "", "command": "sleep 1"},
+            "bad id": {"id": "bad id", "label": "", "command": "sleep 1"}
+        },
+        "resources": {"tcpport:3000": {"type": "tcpport", "value": "3000", "owner": "my app"}},
+        "timelines": {"my app": []}
+    })");
+    assertEqual(1, State::migrate(j), "Was v1");
+    assertTrue(!j["instances"].contains("my app"), "Invalid name gone");
+    assertTrue(j["instances"].contains("my-app-2"), "Renamed past the clash");
+    assertEqual(std::string("my-app-2"), j["instances"]["my-app-2"]["name"].get<std::string>(), "Name follows");
+    assertEqual(std::string("my-app-2"), j["resources"]["tcpport:3000"]["owner"].get<std::string>(), "Owner follows");
+    assertTrue(j["timelines"].contains("my-app-2") && !j["timelines"].contains("my app"), "Timeline follows");
+    assertTrue(j["templates"].contains("run-my-app-2"), "Run template follows");
+    assertEqual(std::string("run-my-app-2"), j["instances"]["my-app-2"]["template_name"].get<std::string>(), "Reference follows");
+    assertTrue(j["templates"].contains("bad-id"), "Template ID normalized");
+    assertEqual(std::string("bad-id"), j["instances"]["my-app"]["template_name"].get<std::string>(), "Its user follows");
+
+    auto state = State::load();
+    Template tmpl;
+    tmpl.id = "sleeper";
+    tmpl.command = "sleep 1";
+    bool threw = false;
+    try {
+        startProcess(state, tmpl, "bad name", {});
+    } catch (const std::runtime_error& e) {
+        threw = std::string(e.what()).find("invalid name") != std::string::npos;
+    }
+    assertTrue(threw, "Invalid name refused at start");
+    assertTrue(!state->instances.count("bad name"), "Nothing created");
+}
+
+TEST(MigrationKeepsRunningInstanceAndLogs) {
+    // Put the real state back however this ends
+    struct Restore {
+        std::string file = State::getStateDir() + "/state.json";
+        std::string content;
+        pid_t pid = 0;
+        Restore() {
+            std::ifstream in(file);
+            std::stringstream ss;
+            ss << in.rdbuf();
+            content = ss.str();
+        }
+        ~Restore() {
+            killTestProcess(pid);
+            for (const auto& path : instanceLogs("my-job")) unlink(path.c_str());
+            std::ofstream(file, std::ios::trunc) << content;
+        }
+    } restore;
+
+    // Started by a v1 vp as "my job": its marker carries the old name
+    restore.pid = startTestProcess("VP_INSTANCE='my job:0123abcd' exec sleep 300");
+    mkdir(logDir().c_str(), 0755);
+    std::ofstream(logPath("my job")) << "live\n";
+    std::ofstream(logPath("my job") + ".1") << "rotated\n";
+    std::ofstream(restore.file, std::ios::trunc) << json({
+        {"schema_version", 1},
+        {"instances", {{"my job", {{"name", "my job"}, {"template", "sleeper"}, {"template_name", "sleeper"},
+                                   {"command", "sleep 300"}, {"pid", 0}, {"status", "stopped"},
+                                   {"resources", json::object()}, {"started", 0}, {"managed", true},
+                                   {"marker", "my job:0123abcd"}}}}}}).dump();
+
+    auto state = State::load();
+    assertTrue(state->instances.count("my-job") == 1, "Renamed");
+    assertEqual("my job:0123abcd", state->instances["my-job"]->marker, "Marker kept as it was");
+    assertTrue(access(logPath("my job").c_str(), F_OK) != 0, "Old log gone");
+    assertEqual("live\n", tailLog(logPath("my-job"), 10), "Log moved");
+    assertEqual("rotated\n", tailLog(logPath("my-job") + ".1", 10), "Rotated log moved");
+
+    assertEqual(1, rematchInstances(state), "Found by its old marker");
+    assertEqual((int)restore.pid, state->instances["my-job"]->pid, "The process it was running");
+}
+
+TEST(LogPathsKeepProjectsApart) {
+    assertTrue(logPath("a/b") != logPath("a.b"), "a/b and a.b log separately");
+    assertEqual(logDir() + "/logs-test@api.log", logPath("logs-test/api"), "Project separator");
+}
+
+TEST(RotateLogCopiesAndTruncates) {
+    mkdir(logDir().c_str(), 0755);
+    std::string path = logPath("rotate-test");
+    auto size = [](const std::string& file) {
+        struct stat st;
+        return stat(file.c_str(), &st) == 0 ? (long)st.st_size : -1L;
+    };
+    LogPolicy policy;
+    policy.max_size = 50;
+    policy.max_files = 2;
+
+    std::ofstream(path) << std::string(20, 'a') << "\n";
+    assertTrue(!rotateLog(path, policy), "Under the limit: left alone");
+
+    // The child's fd, as it is after a start
+    int fd = open(path.c_str(), O_WRONLY | O_APPEND);
+    std::string first(60, 'b');
+    assertTrue(write(fd, first.data(), first.size()) == (ssize_t)first.size(), "Written past the limit");
+    assertTrue(rotateLog(path, policy), "Rotated");
+    assertEqual(0L, size(path), "Live log truncated");
+    assertEqual(81L, size(path + ".1"), "Contents moved to .1");
+    std::string second(70, 'c');
+    assertTrue(write(fd, second.data(), second.size()) == (ssize_t)second.size(), "Writer keeps going");
+    assertEqual(70L, size(path), "From the start, not the old offset");
+
+    assertTrue(rotateLog(path, policy), "Rotated again");
+    assertEqual(70L, size(path + ".1"), "Newest is .1");
+    assertEqual(81L, size(path + ".2"), "Older shifted to .2");
+    assertTrue(write(fd, second.data(), second.size()) == (ssize_t)second.size(), "More output");
+    assertTrue(rotateLog(path, policy), "And again");
+    assertEqual(70L, size(path + ".2"), "Oldest dropped");
+    assertEqual(-1L, size(path + ".3"), "No more than max_files");
+    close(fd);
+
+    for (const auto& file : instanceLogs("rotate-test")) unlink(file.c_str());
+
+    // Compressed, whatever the name holds
+    std::string odd = "/tmp/vp-rotate-it's $(touch x)-" + std::to_string(getpid()) + ".log";
+    policy.compress = true;
+    std::ofstream(odd) << std::string(60, 'd') << "\n";
+    assertTrue(rotateLog(odd, policy), "Rotated with a quote in the name");
+    assertTrue(size(odd + ".1.gz") > 0, "Compressed to .1.gz");
+    assertEqual(-1L, size(odd + ".1"), "Uncompressed copy gone");
+    unlink(odd.c_str());
+    unlink((odd + ".1.gz").c_str());
+}
+
+TEST(SweepLogsExpiresOnlyOldRotatedAndOrphanedLogs) {
+    mkdir(logDir().c_str(), 0755);
+    auto state = std::make_shared<State>();
+    auto inst = std::make_shared<Instance>();
+    inst->name = "sweep-live";
+    state->instances[inst->name] = inst;
+    state->logPolicy.max_age = 3600;
+
+    std::string live = logPath("sweep-live"), gone = logPath("sweep-gone");
+    std::string oldRotated = live + ".1", newRotated = live + ".2.gz";
+    time_t old = time(nullptr) - 7200;
+    for (const auto& path : {live, oldRotated, newRotated, gone}) {
+        std::ofstream(path) << "output\n";
+    }
+    struct utimbuf times = {old, old};
+    for (const auto& path : {live, oldRotated, gone}) {
+        utime(path.c_str(), &times);
+    }
+
+    // Other tests' old logs in the same directory may go too
+    auto removed = sweepLogs(state);
+    auto wasRemoved = [&](const std::string& path) {
+        return std::find(removed.begin(), removed.end(), path) != removed.end();
+    };
+    assertTrue(wasRemoved(oldRotated) && access(oldRotated.c_str(), F_OK) != 0, "Expired rotated file removed");
+    assertTrue(wasRemoved(gone) && access(gone.c_str(), F_OK) != 0, "Expired orphaned log removed");
+    assertTrue(!wasRemoved(live) && access(live.c_str(), F_OK) == 0, "A live instance's log never expires");
+    assertTrue(!wasRemoved(newRotated) && access(newRotated.c_str(), F_OK) == 0, "Recent rotated file kept");
+
+    state->logPolicy.max_age = 0;
+    utime(newRotated.c_str(), &times);
+    assertTrue(sweepLogs(state).empty(), "No max_age, nothing expires");
+
+    for (const auto& path : instanceLogs("sweep-live")) unlink(path.c_str());
+}
+
+TEST(ProfilesSeparateStateAndPorts) {
+    std::string base = State::getStateDir();
+    auto profiles = loadProfiles();
+    profiles["client-a"].port_start = 4100;
+    profiles["client-a"].serve_port = 8181;
+    assertTrue(saveProfiles(profiles), "Profiles saved");
+
+    setenv("VP_PROFILE", "client-a", 1);
+    assertEqual(base + "/profiles/client-a", State::getStateDir(), "Own directory");
+    assertEqual(8181, currentProfileSettings().serve_port, "Own serve port");
+    auto state = State::load();
+    assertEqual(4100, state->types["tcpport"]->start, "Own port range");
+    assertEqual(5099, state->types["tcpport"]->end, "1000 ports when no end given");
+    assertTrue(state->save(), "Saved into the profile");
+    unsetenv("VP_PROFILE");
+
+    assertEqual(base, State::getStateDir(), "Default profile unchanged");
+    assertEqual(3000, State::load()->types["tcpport"]->start, "Default range unchanged");
+    assertTrue(loadProfiles().count("client-a") == 1, "Listed");
+    assertTrue(!validProfileName("a/b") && validProfileName("client_b-2"), "Names are path-safe");
+}
+
+TEST(EncryptedStateRoundTrip) {
+    if (system("command -v openssl >/dev/null 2>&1") != 0) {
+        return;
+    }
+    setenv("VP_STATE_PASSPHRASE", "correct horse", 1);
+    auto state = State::load();
+    auto tmpl = std::make_shared<Template>();
+    tmpl->id = "enc-tmpl";
+    tmpl->command = "sleep 1";
+    state->templates["enc-tmpl"] = tmpl;
+    assertTrue(state->save(), "Encrypted save");
+
+    std::ifstream in(State::getStateDir() + "/state.json");
+    std::stringstream raw;
+    raw << in.rdbuf();
+    assertTrue(isEncryptedState(raw.str()), "File is encrypted");
+    assertTrue(raw.str().find("enc-tmpl") == std::string::npos, "No plaintext on disk");
+
+    auto other = State::load();
+    assertTrue(other->templates.count("enc-tmpl") == 1, "Load decrypts");
+    assertEqual(0, (int)state->reload().size(), "Own encrypted write ignored");
+    other->templates.erase("enc-tmpl");
+    other->save();
+    assertEqual(1, (int)state->reload().size(), "Reload decrypts other writers");
+
+    setenv("VP_STATE_PASSPHRASE", "wrong", 1);
+    bool threw = false;
+    try {
+        State::load();
+    } catch (const std::runtime_error&) {
+        threw = true;
+    }
+    assertTrue(threw, "Wrong key refuses to load instead of starting empty");
+
+    // aes256gcm:<base64 of salt, nonce, ciphertext, tag>
+    setenv("VP_STATE_PASSPHRASE", "correct horse", 1);
+    std::string stateFile = State::getStateDir() + "/state.json";
+    std::string saved = raw.str();
+    size_t end = saved.find_first_of("=\n");
+    auto rewrite = [&](const std::string& content) {
+        std::ofstream out(stateFile, std::ios::trunc);
+        out << content;
+    };
+    auto loads = [&]() {
+        try {
+            State::load();
+            return true;
+        } catch (const std::runtime_error&) {
+            return false;
+        }
+    };
+    auto flip = [](std::string text, size_t i) {
+        text[i] = text[i] == 'A' ? 'B' : 'A';
+        return text;
+    };
+    rewrite(flip(saved, end / 2));
+    assertTrue(!loads(), "Modified ciphertext refused");
+    rewrite(flip(saved, end - 3));
+    assertTrue(!loads(), "Modified tag refused");
+    rewrite(saved);
+    assertTrue(loads(), "Intact file loads");
+
+    // Written by an older vp: openssl enc, which can't tell if it was modified
+    system(("printf '{\"schema_version\": 2}' | openssl enc -aes-256-cbc -pbkdf2 -a -A -salt "
+            "-pass env:VP_STATE_PASSPHRASE > " + stateFile).c_str());
+    assertTrue(!loads(), "Unauthenticated state refused by default");
+    setenv("VP_STATE_ACCEPT_UNAUTHENTICATED", "1", 1);
+    assertTrue(loads(), "Loads with consent");
+    unsetenv("VP_STATE_ACCEPT_UNAUTHENTICATED");
+
+    // Back to plaintext for the tests that follow
+    unsetenv("VP_STATE_PASSPHRASE");
+    state->save();
+    assertTrue(State::load()->templates.count("enc-tmpl") == 0, "Plaintext again");
+}
+
+TEST(TemplateTestStartsTestsAndTearsDown) {
+    auto state = std::make_shared<State>();
+    Template tmpl;
+    tmpl.id = "tested";
+    tmpl.command = "sleep 300";
+    tmpl.health = "true";
+    tmpl.vars["greeting"] = "hi";
+    tmpl.test = "test \"${greeting} $VP_INSTANCE\" = \"hi tt\"";
+
+    auto result = testTemplate(state, tmpl, "tt", {}, 2000);
+    assertTrue(result.passed, "Test command passes");
+    assertEqual("test \"hi $VP_INSTANCE\" = \"hi tt\"", result.test, "Test command is interpolated");
+    assertTrue(state->instances.empty(), "Instance removed after a pass");
+
+    tmpl.test = "exit 4";
+    result = testTemplate(state, tmpl, "tt", {}, 2000);
+    assertTrue(!result.passed, "Failing test fails");
+    assertEqual("test", result.stage, "At the test stage");
+    assertTrue(state->instances.empty(), "Instance removed after a failure");
+
+    tmpl.health = "false";
+    result = testTemplate(state, tmpl, "tt", {}, 300);
+    assertEqual("ready", result.stage, "Never healthy fails at ready");
+
+    tmpl.command = "run ${missing}";
+    result = testTemplate(state, tmpl, "tt", {}, 300);
+    assertEqual("start", result.stage, "Unresolved placeholder fails at start");
+    assertTrue(state->instances.empty(), "Nothing left behind");
+}
+
+TEST(DryRunRollsBackAllocation) {
+    auto state = State::load();
+    Template tmpl;
+    tmpl.id = "web";
+    tmpl.command = "serve --port ${tcpport} --root ${workdir}";
+    tmpl.resources = {"tcpport", "workdir"};
+    tmpl.health = "curl -fs localhost:${tcpport}";
+    auto counters = state->counters;
+
+    auto inst = dryRunProcess(state, tmpl, "dry-run-test", {{"workdir", "/tmp"}});
+    std::string port = inst->resources["tcpport"];
+    assertTrue(!port.empty(), "Trial allocation picks a port");
+    assertEqual("serve --port " + port + " --root /tmp", inst->command, "Command interpolated");
+    assertEqual("curl -fs localhost:" + port, inst->health, "Health interpolated");
+    assertEqual("/tmp", inst->cwd, "Runs in workdir");
+    assertTrue(state->resources.empty(), "Claims rolled back");
+    assertTrue(state->counters == counters, "Counters rolled back");
+    assertTrue(state->instances.find("dry-run-test") == state->instances.end(), "Nothing started");
+}
+
+TEST(RenderTemplateWithoutState) {
+    auto state = State::load();
+    Template tmpl;
+    tmpl.id = "qemu";
+    tmpl.command = "qemu -vnc :%vncport -drive ${image} -m ${mem} %nosuchcounter";
+    tmpl.resources = {"tcpport"};
+    tmpl.vars = {{"mem", "2G"}};
+    tmpl.actions = {{"ssh", "ssh -p ${tcpport} localhost"}};
+    auto counters = state->counters;
+
+    auto inst = renderTemplate(*state, tmpl, {{"image", "disk.img"}, {"mem", "4G"}});
+    assertEqual("qemu -vnc :5900 -drive disk.img -m 4G %nosuchcounter", inst->command,
+                "Vars override defaults, counters take their range start");
+    assertEqual("ssh -p 3000 localhost", inst->actions["ssh"], "Actions interpolated");
+    assertTrue(state->resources.empty() && state->counters == counters, "Nothing allocated");
+}
+
+TEST(StrictInterpolationFailsBeforeClaiming) {
+    auto state = State::load();
+    Template tmpl;
+    tmpl.id = "strict";
+    tmpl.command = "serve --port ${tcpport} --db ${dburl} --date %Y";
+    tmpl.resources = {"tcpport"};
+    tmpl.health = "check ${dburl} ${token}";
+
+    auto unresolved = unresolvedPlaceholders(*state, tmpl, {});
+    assertEqual(3, (int)unresolved.size(), "Each missing placeholder once");
+    assertEqual("${dburl}", unresolved[0], "In order of appearance");
+    assertEqual("%Y", unresolved[1], "Unknown counter");
+    assertEqual("${token}", unresolved[2], "From the health check");
+    assertTrue(unresolvedPlaceholders(*state, tmpl, {{"dburl", "x"}, {"token", "t"}}).size() == 1, "Vars resolve");
+
+    bool threw = false;
+    try {
+        startProcess(state, tmpl, "strict-test", {{"token", "t"}});
+    } catch (const std::runtime_error& e) {
+        threw = std::string(e.what()).find("${dburl}, %Y") != std::string::npos;
+    }
+    assertTrue(threw, "Start lists the unresolved placeholders");
+    assertTrue(state->resources.empty(), "Nothing claimed");
+    assertTrue(state->instances.find("strict-test") == state->instances.end(), "Nothing started");
+}
+
+TEST(InterpolationEscapes) {
+    auto state = State::load();
+    Template tmpl;
+    tmpl.id = "escapes";
+    tmpl.command = "sh -c 'echo $${HOME} ${msg} $(date +%%Y-%%m-%%d) %%tcpport' --port %tcpport";
+    tmpl.action = "echo $${USER} ${tcpport} 100%%";
+    tmpl.vars = {{"msg", "%tcpport ${msg}"}};
+
+    assertTrue(unresolvedPlaceholders(*state, tmpl, {}).empty(), "Escapes are not placeholders");
+
+    auto inst = renderTemplate(*state, tmpl, {});
+    assertEqual("sh -c 'echo ${HOME} %tcpport ${msg} $(date +%Y-%m-%d) %tcpport' --port 3000", inst->command,
+                "Escapes become literal; values are not expanded again");
+    assertEqual("echo ${USER} 3000 100%", inst->action, "Escapes in actions");
+
+    tmpl.command = "serve --port ${tcpport} --date %%Y";
+    tmpl.resources = {"tcpport"};
+    auto match = inferTemplate(State(), "serve --port 3001 --date %Y");
+    assertTrue(!match, "No templates to match");
+    State withTemplate;
+    withTemplate.templates["escapes"] = std::make_shared<Template>(tmpl);
+    match = inferTemplate(withTemplate, "serve --port 3001 --date %Y");
+    assertTrue(match && match->vars["tcpport"] == "3001", "Inference reads escapes as literals");
+}
+
+TEST(InterpolationDefaults) {
+    auto state = State::load();
+    Template tmpl;
+    tmpl.id = "defaults";
+    tmpl.command = "app --log-level ${loglevel:-info} --port ${tcpport} --name ${name:-}";
+    tmpl.resources = {"tcpport"};
+    tmpl.health = "curl -fs localhost:${tcpport}${healthpath:-/healthz}";
+
+    assertTrue(unresolvedPlaceholders(*state, tmpl, {}).empty(), "Defaults count as resolved");
+
+    auto inst = renderTemplate(*state, tmpl, {});
+    assertEqual("app --log-level info --port 3000 --name ", inst->command, "Defaults fill in");
+    assertEqual("curl -fs localhost:3000/healthz", inst->health, "Defaults in health checks");
+
+    inst = renderTemplate(*state, tmpl, {{"loglevel", "debug"}, {"healthpath", ""}});
+    assertEqual("app --log-level debug --port 3000 --name ", inst->command, "Given values win");
+    assertEqual("curl -fs localhost:3000/healthz", inst->health, "Empty values take the default");
+
+    State withTemplate;
+    withTemplate.templates["defaults"] = std::make_shared<Template>(tmpl);
+    auto match = inferTemplate(withTemplate, "app --log-level warn --port 3005 --name x");
+    assertTrue(match && match->vars["loglevel"] == "warn", "Inference captures the var by name");
+}
+
+TEST(TemplateSources) {
+    assertTrue(isGitSource("git@github.com:team/templates.git//db/postgres.json"), "ssh git source");
+    assertTrue(isGitSource("https://github.com/team/templates.git//qemu.json"), "https git source");
+    assertTrue(!isGitSource("https://example.com/templates/qemu.json"), "plain URL is not git");
+    assertTrue(!isGitSource("./qemu.json"), "local file is not git");
+    bool threw = false;
+    try {
+        fetchSource("git@github.com:team/templates.git//db/../../../etc/passwd");
+    } catch (const std::runtime_error& e) {
+        threw = std::string(e.what()).find("'..'") != std::string::npos;
+    }
+    assertTrue(threw, "Path can't leave the clone");
+
+    char dir[] = "/tmp/vp-registry-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+    std::string path = std::string(dir) + "/catalog.json";
+    std::ofstream(path) << R"([
+        {"id": "a", "label": "A", "command": "a", "resources": [], "vars": {}},
+        {"id": "b", "label": "B", "command": "b", "resources": [], "vars": {}, "health": "true"}
+    ])";
+
+    auto templates = loadTemplates(path);
+    unlink(path.c_str());
+    rmdir(dir);
+
+    assertEqual(2, (int)templates.size(), "Catalog array yields every template");
+    assertEqual("b", templates[1]->id, "Templates keep file order");
+    assertEqual(path, templates[0]->source, "Source is recorded");
+}
+
+TEST(ProjectScopedNames) {
+    assertEqual("shop/api", qualifiedName("shop", "api"), "Name is scoped to project");
+    assertEqual("api", qualifiedName("", "api"), "No project: global name");
+    assertEqual("blog/api", qualifiedName("shop", "blog/api"), "Qualified names pass through");
+    assertEqual("shop", projectOf("shop/api"), "Project of qualified name");
+    assertEqual("", projectOf("api"), "Unqualified name has no project");
+
+    auto state = std::make_shared<State>();
+    Template tmpl;
+    tmpl.id = "sleeper";
+    tmpl.command = "sleep 300";
+
+    auto shop = startProcess(state, tmpl, qualifiedName("shop", "api"), {});
+    auto blog = startProcess(state, tmpl, qualifiedName("blog", "api"), {});
+    assertEqual("shop", shop->project, "Instance records its project");
+    assertEqual(2, (int)state->instances.size(), "Same name in two projects does not collide");
+    assertTrue(logPath("shop/api") != logPath("blog/api"), "Each project gets its own log");
+
+    stopProcess(state, shop);
+    stopProcess(state, blog);
+}
+
+TEST(MatchesSelector) {
+    Instance inst;
+    inst.labels = {{"env", "dev"}, {"tier", "web"}};
+
+    assertTrue(matchesSelector(inst, ""), "Empty selector matches everything");
+    assertTrue(matchesSelector(inst, "env=dev"), "Equality");
+    assertTrue(matchesSelector(inst, "env=dev,tier=web"), "All terms must match");
+    assertTrue(!matchesSelector(inst, "env=dev,tier=db"), "One failing term fails");
+    assertTrue(matchesSelector(inst, "env!=prod"), "Inequality");
+    assertTrue(!matchesSelector(inst, "env!=dev"), "Inequality against same value");
+    assertTrue(matchesSelector(inst, "tier"), "Existence");
+    assertTrue(!matchesSelector(inst, "owner"), "Missing key");
+}
+
+TEST(NamedActionsAreInterpolated) {
+    auto state = std::make_shared<State>();
+    Template tmpl;
+    tmpl.id = "web";
+    tmpl.command = "sleep 300";
+    tmpl.vars["port"] = "4000";
+    tmpl.action = "http://localhost:${port}/";
+    tmpl.actions["admin-ui"] = "http://localhost:${port}/admin";
+    tmpl.actions["migrate"] = "echo migrate ${port}";
+
+    auto inst = startProcess(state, tmpl, "actions-test", {});
+    stopProcess(state, inst);
+
+    assertEqual("http://localhost:4000/", resolveAction(*inst, ""), "Unnamed resolves to the single action");
+    assertEqual("http://localhost:4000/", resolveAction(*inst, "default"), "default is the single action");
+    assertEqual("http://localhost:4000/admin", resolveAction(*inst, "admin-ui"), "Named URL action");
+    assertEqual("echo migrate 4000", resolveAction(*inst, "migrate"), "Named command action");
+    assertEqual("", resolveAction(*inst, "missing"), "Unknown action");
+    assertTrue(isURLAction(resolveAction(*inst, "admin-ui")), "URL action is opened");
+    assertTrue(!isURLAction(resolveAction(*inst, "migrate")), "Command action is executed");
+}
+
+TEST(RunActionRecordsHistory) {
+    auto state = std::make_shared<State>();
+
+    auto ok = runAction(state, recordAction(state, "web", "migrate", "echo migrated; echo oops >&2"));
+    assertEqual(0, ok.exit_code, "Exit code recorded");
+    assertEqual("migrated\noops\n", ok.output, "stdout and stderr captured");
+
+    auto failed = runAction(state, recordAction(state, "web", "", "exit 3"));
+    assertEqual(3, failed.exit_code, "Failure exit code recorded");
+    assertEqual("default", failed.action, "Unnamed action is recorded as default");
+
+    auto big = runAction(state, recordAction(state, "web", "dump", "head -c 100000 /dev/zero | tr '\\0' x"));
+    assertTrue(big.truncated, "Large output is truncated");
+    assertEqual((int)MAX_ACTION_OUTPUT, (int)big.output.size(), "Output capped");
+
+    assertEqual(3, (int)state->actionRuns.size(), "Every run is in history");
+    assertEqual(ok.id + 1, failed.id, "IDs increase");
+    assertEqual(3, state->actionRuns[1].exit_code, "History holds the finished run");
+}
+
+TEST(RoleBasedAuthorization) {
+    Request req = parseRequest("POST /api/instances?x=1 HTTP/1.1\r\n"
+                               "Host: localhost\r\n"
+                               "Authorization: Bearer abc123\r\n"
+                               "Cookie: theme=dark; vp_token=fromcookie\r\n"
+                               "\r\n"
+                               "{\"action\": \"stop\"}");
+    assertEqual("POST", req.method, "Method");
+    assertEqual("/api/instances?x=1", req.path, "Path keeps query");
+    assertEqual("localhost", req.headers["host"], "Header names are lowercased");
+    assertEqual("{\"action\": \"stop\"}", req.body, "Body");
+    assertEqual("abc123", requestToken(req), "Bearer token wins");
+
+    req.headers.erase("authorization");
+    assertEqual("fromcookie", requestToken(req), "Cookie token");
+
+    assertEqual("viewer", requiredRole("GET", "/api/templates"), "Reads need viewer");
+    assertEqual("operator", requiredRole("POST", "/api/instances"), "Lifecycle needs operator");
+    assertEqual("operator", requiredRole("POST", "/api/instances/batch"), "So does it in bulk");
+    assertEqual("admin", requiredRole("POST", "/api/templates"), "Templates need admin");
+
+    assertTrue(roleAllows("viewer", "viewer"), "viewer can read");
+    assertTrue(!roleAllows("viewer", "operator"), "viewer cannot stop");
+    assertTrue(roleAllows("admin", "operator"), "admin can do everything");
+    assertTrue(!roleAllows("bogus", "viewer"), "Unknown role gets nothing");
+    assertEqual(32, (int)generateToken().size(), "Token is 32 hex digits");
+}
+
+TEST(CidrAllowlist) {
+    assertTrue(cidrContains("10.1.0.0/16", "10.1.2.3"), "Inside IPv4 network");
+    assertTrue(!cidrContains("10.1.0.0/16", "10.2.0.1"), "Outside IPv4 network");
+    assertTrue(cidrContains("10.1.0.0/16", "::ffff:10.1.9.9"), "IPv4-mapped client");
+    assertTrue(cidrContains("192.168.1.7", "192.168.1.7"), "Single address");
+    assertTrue(!cidrContains("192.168.1.7", "192.168.1.8"), "Other address");
+    assertTrue(cidrContains("fd00::/8", "fd12::1"), "Inside IPv6 network");
+    assertTrue(!cidrContains("fd00::/8", "fe80::1"), "Outside IPv6 network");
+    assertTrue(cidrContains("0.0.0.0/0", "8.8.8.8"), "Any IPv4");
+
+    for (const char* bad : {"10.0.0.0/33", "10.0.0/8", "office", "10.0.0.0/"}) {
+        bool threw = false;
+        try {
+            cidrContains(bad, "10.0.0.1");
+        } catch (const std::invalid_argument&) {
+            threw = true;
+        }
+        assertTrue(threw, std::string("Rejected: ") + bad);
+    }
+
+    std::vector<std::string> office = {"192.168.10.0/24"};
+    assertTrue(remoteAllowed(office, "192.168.10.40"), "Office client");
+    assertTrue(!remoteAllowed(office, "192.168.11.40"), "Other subnet");
+    assertTrue(remoteAllowed(office, "127.0.0.1") && remoteAllowed(office, "::1"), "Loopback always");
+    assertTrue(remoteAllowed({}, "203.0.113.9"), "No list: anyone");
+}
+
+TEST(CsrfCheck) {
+    std::map<std::string, bool> remotes = {{"http://dash.local:3000", true}};
+    auto request = [](std::map<std::string, std::string> headers) {
+        Request req;
+        req.method = "POST";
+        req.path = "/api/instances";
+        req.headers = headers;
+        req.headers["host"] = "vp.lan:8080";
+        return req;
+    };
+
+    assertEqual("", csrfError(request({}), remotes), "Scripts without cookies or Origin");
+    assertEqual("", csrfError(request({{"origin", "http://vp.lan:8080"}}), remotes), "Same origin, no cookies");
+    assertEqual("", csrfError(request({{"origin", "http://dash.local:3000"}}), remotes), "Allowlisted origin");
+    assertTrue(!csrfError(request({{"origin", "http://evil.example"}}), remotes).empty(), "Foreign origin");
+    assertTrue(!csrfError(request({{"cookie", "vp_session=abc"}}), remotes).empty(), "Session cookie without token");
+    assertTrue(!csrfError(request({{"cookie", "vp_session=abc; vp_csrf=123"}, {"x-vp-csrf", "124"}}), remotes).empty(),
+               "Wrong token");
+    assertEqual("", csrfError(request({{"cookie", "vp_session=abc; vp_csrf=123"}, {"x-vp-csrf", "123"}}), remotes),
+                "Echoed token");
+    assertEqual("", csrfError(request({{"cookie", "vp_token=abc"}, {"authorization", "Bearer xyz"}}), remotes),
+                "Bearer token");
+
+    // "*" lets any origin in anonymously, not with the user's cookies
+    std::map<std::string, bool> anyone = {{"*", true}};
+    assertEqual("", csrfError(request({{"origin", "http://localhost:9999"}}), anyone), "Wildcard, no cookies");
+    assertTrue(!csrfError(request({{"origin", "http://localhost:9999"}, {"cookie", "vp_session=abc"}}), anyone).empty(),
+               "Wildcard origin with a session cookie and no X-VP-CSRF");
+    assertEqual("", csrfError(request({{"origin", "http://localhost:9999"}, {"cookie", "vp_session=abc; vp_csrf=1"},
+                                       {"x-vp-csrf", "1"}}), anyone),
+                "Wildcard origin echoing the token");
+}
+
+TEST(PasswordHash) {
+    std::string hash = hashPassword("correct horse");
+    assertTrue(hash.rfind("$6$", 0) == 0, "SHA-512 crypt");
+    assertTrue(verifyPassword("correct horse", hash), "Right password");
+    assertTrue(!verifyPassword("correct horsE", hash), "Wrong password");
+    assertTrue(hashPassword("correct horse") != hash, "Salted");
+    assertTrue(!verifyPassword("", "plaintext"), "Not a hash");
+    assertTrue(verifyPassword("it's $HOME `x`", hashPassword("it's $HOME `x`")), "Shell characters reach openssl as is");
+}
+
+TEST(SessionStoreExpiry) {
+    SessionStore sessions;
+    Session in;
+    in.user = "alice";
+    std::string id = sessions.create(in, 60, 1000);
+
+    Session out;
+    assertTrue(sessions.find(id, 1059, out), "Live before expiry");
+    assertEqual("alice", out.user, "Session user");
+    assertTrue(!sessions.find(id + "0", 1000, out), "Unknown ID");
+    assertTrue(!sessions.find(id, 1060, out), "Expired");
+
+    id = sessions.create(in, 60, 2000);
+    sessions.remove(id);
+    assertTrue(!sessions.find(id, 2000, out), "Logged out");
+}
+
+TEST(JobStorePhases) {
+    JobStore jobs;
+    int id = jobs.create("start", "web");
+    Job job;
+    assertTrue(jobs.get(id, job), "Created");
+    assertEqual("queued", job.phase, "Starts queued");
+
+    jobs.update(id, "allocating");
+    jobs.update(id, "failed", "resource allocation failed: no free tcpport");
+    jobs.get(id, job);
+    assertEqual("failed", job.phase, "Failed");
+    assertEqual("resource allocation failed: no free tcpport", job.error, "Keeps the error");
+    assertTrue(!jobs.get(id + 1, job), "Unknown ID");
+
+    // Finished jobs beyond the cap are dropped oldest first; running ones stay
+    int running = jobs.create("start", "slow");
+    for (size_t n = 0; n < JobStore::MAX_FINISHED + 5; n++) {
+        jobs.update(jobs.create("start", "x"), "done");
+    }
+    assertTrue(!jobs.get(id, job), "Oldest finished dropped");
+    assertTrue(jobs.get(running, job), "Unfinished kept");
+    assertEqual((int)JobStore::MAX_FINISHED + 1, (int)jobs.list().size(), "Cap plus the running one");
+}
+
+TEST(OriginAllowlist) {
+    std::map<std::string, bool> remotes = {{"http://dash.local:3000", true}, {"http://evil.example", false}};
+    assertTrue(originAllowed(remotes, "http://dash.local:3000"), "Listed origin is allowed");
+    assertTrue(!originAllowed(remotes, "http://evil.example"), "Blocked origin");
+    assertTrue(!originAllowed(remotes, "http://other.example"), "Unlisted origin is not allowed by default");
+
+    remotes["*"] = true;
+    assertTrue(originAllowed(remotes, "http://other.example"), "Wildcard allows unlisted origins");
+    assertTrue(!originAllowed(remotes, "http://evil.example"), "Explicit block beats wildcard");
+}
+
+TEST(NormalizeOrigin) {
+    assertEqual("http://dash.local:3000", normalizeOrigin("HTTP://Dash.Local:3000/"), "Lowercased, slash dropped");
+    assertEqual("*", normalizeOrigin("*"), "Wildcard");
+    assertEqual("http://[::1]:8080", normalizeOrigin("http://[::1]:8080"), "IPv6 host");
+    for (const char* bad : {"dash.local", "http://dash.local/app", "http://", "http://host:port"}) {
+        bool threw = false;
+        try {
+            normalizeOrigin(bad);
+        } catch (const std::invalid_argument&) {
+            threw = true;
+        }
+        assertTrue(threw, std::string("Rejected: ") + bad);
+    }
+}
+
+TEST(InferTemplate) {
+    State state; // Default templates
+
+    auto match = inferTemplate(state, "/usr/bin/node server.js --port 3001");
+    assertTrue(match.has_value(), "node-express matched by basename");
+    assertEqual("node-express", match->templateId, "Template id");
+    assertEqual("3001", match->vars["tcpport"], "Port recovered");
+
+    match = inferTemplate(state, "qemu-system-x86_64 -vnc :5 -serial tcp::4555,server,nowait -m 4G -smp 2");
+    assertTrue(match.has_value(), "qemu matched");
+    assertEqual("5", match->vars["vncport"], "vncport");
+    assertEqual("4555", match->vars["serialport"], "serialport");
+    assertEqual("-m 4G -smp 2", match->vars["args"], "Free-form vars span arguments");
+
+    assertTrue(!inferTemplate(state, "node other.js --port 3001").has_value(), "Different arguments");
+    assertTrue(!inferTemplate(state, "python3 -m http.server 8000").has_value(), "Unknown command");
+}
+
+TEST(ReloadKeepsRuntimeFields) {
+    auto state = State::load();
+    auto inst = std::make_shared<Instance>();
+    inst->name = "reload-web";
+    inst->template_name = "node-express";
+    inst->pid = 4242;
+    inst->status = "running";
+    inst->started = 0;
+    inst->managed = true;
+    inst->cpu_time = 0;
+    inst->rss = 0;
+    inst->children = 0;
+    state->instances["reload-web"] = inst;
+    state->save();
+
+    // Another vp process rewrites the file: new label, stale runtime fields,
+    // a new template and a removed token
+    auto other = State::load();
+    other->instances["reload-web"]->labels["env"] = "dev";
+    other->instances["reload-web"]->pid = 0;
+    other->instances["reload-web"]->status = "stopped";
+    auto tmpl = std::make_shared<Template>();
+    tmpl->id = "reload-tmpl";
+    tmpl->command = "sleep 1";
+    other->templates["reload-tmpl"] = tmpl;
+    other->save();
+
+    std::vector<StateChange> events;
+    state->onChange = [&](const StateChange& c) { events.push_back(c); };
+    auto changes = state->reload();
+
+    assertEqual(4242, state->instances["reload-web"]->pid, "Runtime pid kept");
+    assertEqual("running", state->instances["reload-web"]->status, "Runtime status kept");
+    assertEqual("dev", state->instances["reload-web"]->labels["env"], "Config from file applied");
+    assertTrue(state->templates.count("reload-tmpl") == 1, "New template picked up");
+    assertEqual(2, (int)changes.size(), "Instance changed, template added");
+    assertEqual((int)changes.size(), (int)events.size(), "One event per change");
+
+    // Our own save is not a change
+    state->save();
+    assertEqual(0, (int)state->reload().size(), "Own write ignored");
+
+    // Running instances deleted from the file survive
+    other = State::load();
+    other->instances.erase("reload-web");
+    other->save();
+    state->reload();
+    assertTrue(state->instances.count("reload-web") == 1, "Running instance kept");
+
+    state->instances.erase("reload-web");
+    state->templates.erase("reload-tmpl");
+    state->save();
+}
+
+TEST(WebsocketHandshakeAndFrames) {
+    // Example from RFC 6455 section 1.3
+    assertEqual("s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), "Accept key");
+
+    int fds[2];
+    assertTrue(pipe(fds) == 0, "pipe");
+
+    // Client frames are masked
+    std::string payload(300, 'x');
+    std::string frame = websocketFrame(payload, WS_BINARY);
+    frame[1] |= 0x80;
+    frame.insert(4, "\x01\x02\x03\x04");
+    for (size_t i = 0; i < payload.size(); i++) frame[8 + i] ^= "\x01\x02\x03\x04"[i % 4];
+    assertTrue(write(fds[1], frame.data(), frame.size()) == (ssize_t)frame.size(), "write frame");
+    close(fds[1]);
+
+    int opcode;
+    std::string read;
+    assertTrue(readWebsocketFrame(fds[0], opcode, read), "Frame read");
+    assertEqual((int)WS_BINARY, opcode, "Opcode");
+    assertEqual(payload, read, "Payload unmasked, 16-bit length");
+    assertTrue(!readWebsocketFrame(fds[0], opcode, read), "EOF");
+    close(fds[0]);
+}
+
+TEST(PtySessionCapturesOutputAndInput) {
+    int slave;
+    int master = openPty(slave);
+    assertTrue(master != -1, "openPty");
+
+    pid_t pid = fork();
+    if (pid == 0) {
+        attachPty(slave);
+        execl("/bin/sh", "sh", "-c", "read line; echo \"got $line\"", (char*)nullptr);
+        _exit(127);
+    }
+    close(slave);
+
+    std::string logFile = State::getStateDir() + "/pty-test.log";
+    registerPty("pty-test", master, logFile);
+    auto session = findPty("pty-test");
+    assertTrue(session != nullptr, "Session registered");
+
+    std::mutex mutex;
+    std::string output;
+    bool closed = false;
+    session->subscribe([&](const std::string& data) {
+        std::lock_guard<std::mutex> lock(mutex);
+        if (data.empty()) closed = true;
+        output += data;
+    });
+    session->write("hello\n");
+
+    waitpid(pid, nullptr, 0);
+    for (int i = 0; i < 50; i++) {
+        {
+            std::lock_guard<std::mutex> lock(mutex);
+            if (closed) break;
+        }
+        std::this_thread::sleep_for(std::chrono::milliseconds(50));
+    }
+
+    std::lock_guard<std::mutex> lock(mutex);
+    assertTrue(closed, "Listener told when the process side closes");
+    assertTrue(output.find("got hello") != std::string::npos, "Output: " + output);
+    assertTrue(tailLog(logFile, 5).find("got hello") != std::string::npos, "Output copied to the log");
+}
+
+TEST(RateLimiterTokenBucket) {
+    RateLimiter limiter(2, 3); // 2/s, burst of 3
+    assertTrue(limiter.allow("10.0.0.1", 100), "First request");
+    assertTrue(limiter.allow("10.0.0.1", 100), "Second request");
+    assertTrue(limiter.allow("10.0.0.1", 100), "Third request uses up the burst");
+    assertTrue(!limiter.allow("10.0.0.1", 100), "Fourth request is limited");
+    assertTrue(limiter.allow("10.0.0.2", 100), "Other clients have their own bucket");
+    assertTrue(limiter.allow("10.0.0.1", 100.5), "One token refilled after 0.5s");
+    assertTrue(!limiter.allow("10.0.0.1", 100.5), "Only one");
+
+    RateLimiter unlimited;
+    for (int i = 0; i < 100; i++) {
+        assertTrue(unlimited.allow("10.0.0.1", 100), "Rate 0 never limits");
+    }
+}
+
+TEST(MetricsHistoryRatesAndRetention) {
+    State state;
+    auto inst = std::make_shared<Instance>();
+    inst->name = "web";
+    inst->status = "running";
+    inst->pid = 1234;
+    inst->started = 900;
+    state.instances["web"] = inst;
+
+    MetricsHistory history(10, 30); // Keeps 3 samples
+    inst->cpu_time = 5;
+    inst->io_write = 1000;
+    history.record(state, 1000);
+
+    inst->cpu_time = 7.5;
+    inst->io_write = 6000;
+    inst->rss = 4096;
+    history.record(state, 1010);
+
+    auto samples = history.query("web", 3600, 1010);
+    assertEqual(2, (int)samples.size(), "Two samples");
+    assertTrue(samples[0].cpu_percent == 0, "First sample has no rate");
+    assertTrue(std::abs(samples[1].cpu_percent - 25) < 0.001, "2.5s of CPU over 10s is 25%");
+    assertTrue(std::abs(samples[1].write_rate - 500) < 0.001, "5000 bytes over 10s");
+    assertTrue(samples[1].rss == 4096, "RSS is recorded as is");
+
+    inst->cpu_time = 1; // Counter went backwards (a child exited)
+    history.record(state, 1020);
+    history.record(state, 1030);
+    samples = history.query("web", 3600, 1030);
+    assertEqual(3, (int)samples.size(), "Ring keeps retention / interval samples");
+    assertTrue(samples[0].t == 1010, "Oldest sample dropped");
+    assertTrue(samples[1].cpu_percent == 0, "Negative deltas clamp to zero");
+    assertEqual(2, (int)history.query("web", 15, 1030).size(), "Range limits the samples");
+
+    inst->status = "stopped";
+    history.record(state, 1040);
+    assertEqual(3, (int)history.query("web", 3600, 1040).size(), "Stopped instances are not sampled");
+
+    state.instances.erase("web");
+    history.prune(state);
+    assertTrue(history.query("web", 3600, 1040).empty(), "Deleted instances are pruned");
+}
+
+TEST(AlertRulesFireAfterDurationWithCooldown) {
+    auto rss = parseAlertCondition("rss > 2GB");
+    assertTrue(rss.number == 2.0 * 1024 * 1024 * 1024, "Sizes are parsed for rss");
+    assertEqual("==", parseAlertCondition("health=unhealthy").op, "= means ==");
+    bool rejected = false;
+    try {
+        parseAlertCondition("load > 3");
+    } catch (const std::invalid_argument&) {
+        rejected = true;
+    }
+    assertTrue(rejected, "Unknown metrics are rejected");
+
+    Instance inst = {};
+    inst.restarts = 4;
+    assertTrue(conditionHolds(parseAlertCondition("restart_count > 3"), inst, 0, []() { return true; }), "Restarts");
+    assertTrue(conditionHolds(parseAlertCondition("health == unhealthy"), inst, 0, []() { return false; }), "Unhealthy");
+    assertTrue(!conditionHolds(parseAlertCondition("cpu_percent > 90"), inst, 50, []() { return true; }), "CPU below");
+
+    auto state = std::make_shared<State>();
+    auto web = std::make_shared<Instance>();
+    web->name = "web";
+    web->status = "running";
+    web->pid = getpid();
+    web->labels["tier"] = "web";
+    state->instances["web"] = web;
+    auto db = std::make_shared<Instance>(*web);
+    db->name = "db";
+    db->labels["tier"] = "db";
+    state->instances["db"] = db;
+
+    AlertRule rule;
+    rule.id = "hot";
+    rule.condition = "cpu_percent > 90";
+    rule.duration = 60;
+    rule.cooldown = 300;
+    rule.selector = "tier=web";
+    rule.action = "command";
+    rule.target = "true";
+    validateAlertRule(rule);
+    state->alerts["hot"] = rule;
+
+    MetricsHistory metrics(10, 3600);
+    web->cpu_time = 0;
+    db->cpu_time = 0;
+    metrics.record(*state, 1000);
+    web->cpu_time = 10; // 100% over 10s
+    db->cpu_time = 10;
+    metrics.record(*state, 1010);
+
+    AlertEngine engine;
+    assertEqual(0, (int)engine.evaluate(state, &metrics, 1010).size(), "Condition must hold for 60s");
+    assertEqual(0, (int)engine.evaluate(state, &metrics, 1060).size(), "Still under 60s");
+    auto fired = engine.evaluate(state, &metrics, 1070);
+    assertEqual(1, (int)fired.size(), "Fires after 60s, only for the selected instance");
+    assertEqual("web", fired[0].instance, "Event names the instance");
+    assertEqual("hot", state->events.back().rule, "Firing is recorded as an event");
+    assertEqual(0, (int)engine.evaluate(state, &metrics, 1200).size(), "Cooldown");
+    assertEqual(1, (int)engine.evaluate(state, &metrics, 1370).size(), "Fires again after the cooldown");
+}
+
+// Listen on an ephemeral loopback port; returns the socket and sets port
+static int listenEphemeral(int& port) {
+    int fd = socket(AF_INET, SOCK_STREAM, 0);
+    struct sockaddr_in addr;
+    memset(&addr, 0, sizeof(addr));
+    addr.sin_family = AF_INET;
+    addr.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
+    socklen_t addrLen = sizeof(addr);
+    bind(fd, (struct sockaddr*)&addr, sizeof(addr));
+    listen(fd, 4);
+    getsockname(fd, (struct sockaddr*)&addr, &addrLen);
+    port = ntohs(addr.sin_port);
+    return fd;
+}
+
+static int connectLocal(int port) {
+    int fd = socket(AF_INET, SOCK_STREAM, 0);
+    struct sockaddr_in addr;
+    memset(&addr, 0, sizeof(addr));
+    addr.sin_family = AF_INET;
+    addr.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
+    addr.sin_port = htons(port);
+    if (connect(fd, (struct sockaddr*)&addr, sizeof(addr)) != 0) {
+        close(fd);
+        return -1;
+    }
+    return fd;
+}
+
+// Accept on fd within a second (-1 if nothing arrives)
+static int acceptWithin(int fd) {
+    struct pollfd p = {fd, POLLIN, 0};
+    return poll(&p, 1, 1000) == 1 ? accept(fd, nullptr, nullptr) : -1;
+}
+
+// One request to the API on port; returns the whole response. headers are
+// extra header lines, each ending in \r\n.
+static std::string apiRequest(int port, const std::string& method, const std::string& path,
+                              const std::string& body = "", const std::string& headers = "") {
+    int fd = connectLocal(port);
+    if (fd == -1) return "";
+    std::string request = method + " " + path + " HTTP/1.1\r\nHost: localhost\r\n" + headers +
+                          "Content-Type: application/json\r\nContent-Length: " +
+                          std::to_string(body.size()) + "\r\n\r\n" + body;
+    ssize_t written = write(fd, request.data(), request.size());
+    (void)written;
+    // Read by Content-Length: instances started meanwhile inherit the socket,
+    // so EOF may be a while
+    std::string response;
+    char buffer[4096];
+    for (ssize_t n; (n = read(fd, buffer, sizeof(buffer))) > 0;) {
+        response.append(buffer, n);
+        size_t end = response.find("\r\n\r\n");
+        size_t length = response.find("Content-Length: ");
+        if (end != std::string::npos && length != std::string::npos &&
+            response.size() >= end + 4 + std::stoul(response.substr(length + 16))) {
+            break;
+        }
+    }
+    close(fd);
+    return response;
+}
+
+TEST(WebhooksMustBeHttp) {
+    AlertRule rule;
+    rule.id = "hook";
+    rule.condition = "cpu_percent > 90";
+    rule.action = "webhook";
+    for (const std::string& bad : {"file:///etc/passwd", "-o/tmp/x", "gopher://example.com/", "example.com"}) {
+        rule.target = bad;
+        bool threw = false;
+        try {
+            validateAlertRule(rule);
+        } catch (const std::invalid_argument&) {
+            threw = true;
+        }
+        assertTrue(threw, "Refused: " + bad);
+        assertTrue(!postWebhook(bad, json::object()), "Not posted: " + bad);
+    }
+    rule.target = "HTTPS://hooks.example.com/vp";
+    validateAlertRule(rule);
+
+    char dir[] = "/tmp/vp-hook-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Temp dir");
+    std::string file = std::string(dir) + "/t.json";
+    std::ofstream(file) << R"({"id": "hooked", "label": "", "command": "true", "resources": [], "vars": {},
+                               "limits": {"max_fds": 10, "webhook": "file:///etc/passwd"}})";
+    bool threw = false;
+    try {
+        loadTemplates(file);
+    } catch (const std::invalid_argument&) {
+        threw = true;
+    }
+    assertTrue(threw, "Template limits webhook is checked too");
+    system(("rm -rf " + std::string(dir)).c_str());
+
+    // An http URL still goes out, after the -- that ends curl's options
+    int port = 0;
+    int listener = listenEphemeral(port);
+    bool posted = false;
+    std::thread poster([&]() {
+        posted = postWebhook("http://127.0.0.1:" + std::to_string(port) + "/hook", json{{"ok", true}});
+    });
+    int conn = acceptWithin(listener);
+    if (conn == -1) conn = acceptWithin(listener); // curl may take a moment to start
+    assertTrue(conn != -1, "curl connected");
+    std::string request;
+    char buf[4096];
+    while (request.find("{\"ok\":true}") == std::string::npos) {
+        ssize_t n = read(conn, buf, sizeof(buf));
+        if (n <= 0) break;
+        request.append(buf, n);
+    }
+    std::string reply = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n";
+    ssize_t written = write(conn, reply.data(), reply.size());
+    (void)written;
+    close(conn);
+    poster.join();
+    close(listener);
+    assertTrue(request.rfind("POST /hook ", 0) == 0, "POSTed to the path");
+    assertTrue(posted, "2xx is success");
+}
+
+// Build with -DVP_SANITIZE=thread to have races here reported
+TEST(ChangedCredentialsEndSessions) {
+    char dir[] = "/tmp/vp-api-session-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+    setenv("VP_STATE_DIR", dir, 1);
+
+    auto state = std::make_shared<State>();
+    state->users["alice"] = WebUser{hashPassword("old secret"), "operator"};
+    state->tokens["screen"] = ApiToken{"0123456789abcdef0123456789abcdef", "viewer"};
+    state->save();
+
+    int port;
+    int listener = listenEphemeral(port);
+    listen(listener, 16);
+    ServeOptions options;
+    options.accessLog = false;
+    options.listenFd = listener;
+    std::thread([state, options]() { serveHTTP("", state, options); }).detach();
+
+    auto login = [&](const std::string& body) {
+        std::string response = apiRequest(port, "POST", "/api/login", body);
+        size_t at = response.find("vp_session=");
+        if (at == std::string::npos) return std::string();
+        return "Cookie: " + response.substr(at, response.find(';', at) - at) + "\r\n";
+    };
+    auto loggedIn = [&](const std::string& cookie) {
+        return apiRequest(port, "GET", "/api/session", "", cookie).rfind("HTTP/1.1 200", 0) == 0;
+    };
+
+    std::string user = login(R"({"username": "alice", "password": "old secret"})");
+    std::string token = login(R"({"token": "0123456789abcdef0123456789abcdef"})");
+    assertTrue(loggedIn(user), "Password login works");
+    assertTrue(loggedIn(token), "Token login works");
+
+    {
+        auto data = state->lock(); // As a reload of vp user passwd's edit leaves it
+        state->users["alice"].password_hash = hashPassword("new secret");
+    }
+    assertTrue(!loggedIn(user), "New password ends the session");
+    assertTrue(loggedIn(token), "Other sessions stay");
+    assertTrue(loggedIn(login(R"({"username": "alice", "password": "new secret"})")), "New password logs in");
+
+    {
+        auto data = state->lock();
+        state->tokens["screen"].token = "fedcba9876543210fedcba9876543210";
+    }
+    assertTrue(!loggedIn(token), "New token ends the session");
+
+    unsetenv("VP_STATE_DIR");
+    system(("rm -rf " + std::string(dir)).c_str());
+}
+
+TEST(ConcurrentApiRequests) {
+    char dir[] = "/tmp/vp-api-race-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+    setenv("VP_STATE_DIR", dir, 1);
+
+    auto state = std::make_shared<State>();
+    auto sleeper = std::make_shared<Template>();
+    sleeper->id = "api-race";
+    sleeper->command = "sleep 300";
+    state->templates[sleeper->id] = sleeper;
+    state->save();
+
+    int port;
+    int listener = listenEphemeral(port);
+    listen(listener, 64);
+    ServeOptions options;
+    options.accessLog = false;
+    options.listenFd = listener;
+    std::thread([state, options]() { serveHTTP("", state, options); }).detach();
+
+    // A long-poll must not keep the others out while it waits
+    std::string watched;
+    auto watchStarted = std::chrono::steady_clock::now();
+    std::thread watcher([&]() {
+        watched = apiRequest(port, "GET", "/api/watch?since=" + std::to_string(state->revision()) + "&timeout=20");
+    });
+
+    std::vector<std::thread> clients;
+    std::atomic<int> failures{0};
+    for (int n = 0; n < 4; n++) {
+        clients.emplace_back([&, n]() {
+            std::string name = "api-race-" + std::to_string(n);
+            for (const auto& [method, path, body] : std::vector<std::tuple<std::string, std::string, std::string>>{
+                     {"POST", "/api/instances", R"({"action": "start", "template": "api-race", "name": ")" + name + "\"}"},
+                     {"GET", "/api/instances", ""},
+                     {"POST", "/api/instances", R"({"action": "stop", "name": ")" + name + "\"}"},
+                     {"GET", "/api/instances/" + name, ""},
+                     {"POST", "/api/instances", R"({"action": "delete", "name": ")" + name + "\"}"}}) {
+                if (apiRequest(port, method, path, body).rfind("HTTP/1.1 200", 0) != 0) failures++;
+            }
+        });
+    }
+    // Meanwhile: the file changing under us, and vp serve's own loops
+    clients.emplace_back([&]() {
+        HealthSupervisor supervisor;
+        for (int i = 0; i < 20; i++) {
+            state->reload();
+            supervisor.check(state, time(nullptr));
+            adoptInstances(state);
+            std::this_thread::sleep_for(std::chrono::milliseconds(10));
+        }
+    });
+    for (auto& t : clients) t.join();
+    watcher.join();
+
+    assertEqual(0, failures.load(), "Every request succeeded");
+    assertTrue(watched.rfind("HTTP/1.1 200", 0) == 0, "Watch answered");
+    assertTrue(std::chrono::steady_clock::now() - watchStarted < std::chrono::seconds(15),
+               "Watch woke up on the first change, not at its timeout");
+    auto data = state->lock();
+    for (int n = 0; n < 4; n++) {
+        assertTrue(!state->instances.count("api-race-" + std::to_string(n)), "Deleted");
+    }
+    data.unlock();
+    unsetenv("VP_STATE_DIR");
+    system(("rm -rf " + std::string(dir)).c_str());
+}
+
+TEST(ApiTemplateRoundTrip) {
+    char dir[] = "/tmp/vp-api-template-XXXXXX";
+    assertTrue(mkdtemp(dir) != nullptr, "Should create temp dir");
+    setenv("VP_STATE_DIR", dir, 1);
+    auto state = std::make_shared<State>();
+
+    int port;
+    int listener = listenEphemeral(port);
+    listen(listener, 8);
+    ServeOptions options;
+    options.accessLog = false;
+    options.listenFd = listener;
+    std::thread([state, options]() { serveHTTP("", state, options); }).detach();
+
+    Template tmpl;
+    tmpl.id = "api-roundtrip";
+    tmpl.label = "Round trip";
+    tmpl.description = "Every field survives the API";
+    tmpl.command = "sleep ${secs}";
+    tmpl.resources = {"tcpport"};
+    tmpl.vars = {{"secs", "60"}};
+    tmpl.test = "true";
+    tmpl.secrets = {{"TOKEN", "env:API_TOKEN"}};
+    tmpl.env = {{"MODE", "test"}};
+    tmpl.health = "true";
+    tmpl.health_failures = 2;
+    tmpl.log = LogPolicy{1024, 2, 0, true};
+    tmpl.limits = Limits{64 * 1024 * 1024, 50, 0, ""};
+    json sent = tmpl;
+
+    std::string response = apiRequest(port, "POST", "/api/templates", sent.dump());
+    assertTrue(response.rfind("HTTP/1.1 200", 0) == 0, "Template added");
+    auto stored = state->findTemplate("api-roundtrip");
+    assertTrue(stored != nullptr, "Stored");
+    assertEqual(sent.dump(), json(*stored).dump(), "Nothing dropped");
+
+    response = apiRequest(port, "POST", "/api/templates", R"({"id": "api-minimal", "command": "true"})");
+    assertTrue(response.rfind("HTTP/1.1 200", 0) == 0, "Label, resources and vars still optional");
+    response = apiRequest(port, "POST", "/api/templates", R"({"id": "api-bad", "secrets": {"X": "plain"}})");
+    assertTrue(response.rfind("HTTP/1.1 400", 0) == 0, "Plain secrets refused as in vp add");
+
+    unsetenv("VP_STATE_DIR");
+    system(("rm -rf " + std::string(dir)).c_str());
+}
+
+TEST(PortProxyForwardsRoundRobin) {
+    int portA, portB, proxyPort;
+    int upstreamA = listenEphemeral(portA);
+    int upstreamB = listenEphemeral(portB);
+    close(listenEphemeral(proxyPort));
+
+    auto state = std::make_shared<State>();
+    for (auto [name, port] : {std::make_pair("api-1", portA), std::make_pair("api-2", portB)}) {
+        auto inst = std::make_shared<Instance>();
+        inst->name = name;
+        inst->status = "running";
+        inst->resources["tcpport"] = std::to_string(port);
+        inst->proxy_port = proxyPort;
+        state->instances[name] = inst;
+    }
+    assertEqual(2, (int)proxyTargets(*state, proxyPort).size(), "Both replicas are targets");
+
+    PortProxy proxy(state);
+    assertEqual(1, (int)proxy.sync().size(), "One listener for the shared proxy port");
+
+    int client = connectLocal(proxyPort);
+    int server = acceptWithin(upstreamA);
+    assertTrue(client != -1 && server != -1, "First connection goes to the first replica");
+    assertEqual(4, (int)write(client, "ping", 4), "Write through the proxy");
+    char buffer[8] = {};
+    assertEqual(4, (int)read(server, buffer, sizeof(buffer)), "Upstream reads");
+    assertEqual("ping", std::string(buffer), "Bytes forwarded");
+    write(server, "pong", 4);
+    memset(buffer, 0, sizeof(buffer));
+    assertEqual(4, (int)read(client, buffer, sizeof(buffer)), "Reply forwarded");
+    close(client);
+    close(server);
+
+    client = connectLocal(proxyPort);
+    server = acceptWithin(upstreamB);
+    assertTrue(server != -1, "Second connection goes to the second replica");
+    close(client);
+    close(server);
+
+    // Restarted on a new port: the next connection follows it
+    state->instances["api-2"]->status = "stopped";
+    state->instances["api-1"]->resources["tcpport"] = std::to_string(portB);
+    client = connectLocal(proxyPort);
+    server = acceptWithin(upstreamB);
+    assertTrue(server != -1, "Re-pointed to the new tcpport");
+    close(client);
+    close(server);
+
+    for (auto& [name, inst] : state->instances) inst->proxy_port = 0;
+    assertTrue(proxy.sync().empty(), "Unused listeners close");
+    close(upstreamA);
+    close(upstreamB);
+}
+
+TEST(ProxiesFollowServeBindAndAllow) {
+    int upstreamPort, proxyPort;
+    int upstream = listenEphemeral(upstreamPort);
+    close(listenEphemeral(proxyPort));
+    auto state = std::make_shared<State>();
+    auto inst = std::make_shared<Instance>();
+    inst->name = "bind-proxy";
+    inst->status = "running";
+    inst->resources["tcpport"] = std::to_string(upstreamPort);
+    inst->proxy_port = proxyPort;
+    state->instances[inst->name] = inst;
+
+    // This host's first non-loopback IPv4 address, if it has one
+    std::string lan;
+    struct ifaddrs* addrs = nullptr;
+    if (getifaddrs(&addrs) == 0) {
+        for (auto* a = addrs; a && lan.empty(); a = a->ifa_next) {
+            if (!a->ifa_addr || a->ifa_addr->sa_family != AF_INET) continue;
+            char ip[INET_ADDRSTRLEN];
+            inet_ntop(AF_INET, &((struct sockaddr_in*)a->ifa_addr)->sin_addr, ip, sizeof(ip));
+            if (std::string(ip).rfind("127.", 0) != 0) lan = ip;
+        }
+        freeifaddrs(addrs);
+    }
+    auto connectTo = [&](const std::string& ip) {
+        int fd = socket(AF_INET, SOCK_STREAM, 0);
+        struct sockaddr_in addr;
+        memset(&addr, 0, sizeof(addr));
+        addr.sin_family = AF_INET;
+        inet_pton(AF_INET, ip.c_str(), &addr.sin_addr);
+        addr.sin_port = htons(proxyPort);
+        if (connect(fd, (struct sockaddr*)&addr, sizeof(addr)) != 0) {
+            close(fd);
+            return -1;
+        }
+        return fd;
+    };
+
+    {
+        PortProxy proxy(state, "127.0.0.1");
+        assertEqual(1, (int)proxy.sync().size(), "Listening");
+        int client = connectLocal(proxyPort);
+        int server = acceptWithin(upstream);
+        assertTrue(client != -1 && server != -1, "Forwarded on the bind address");
+        close(client);
+        close(server);
+        if (!lan.empty()) {
+            int other = connectTo(lan);
+            assertEqual(-1, other, "Not listening on " + lan);
+            if (other != -1) close(other);
+        }
+    }
+
+    {
+        PortProxy proxy(state, "0.0.0.0", {"198.51.100.0/24"});
+        assertEqual(1, (int)proxy.sync().size(), "Listening again");
+        int client = connectLocal(proxyPort);
+        int server = acceptWithin(upstream);
+        assertTrue(server != -1, "Loopback always allowed");
+        close(client);
+        close(server);
+        if (!lan.empty() && !cidrContains("198.51.100.0/24", lan)) {
+            client = connectTo(lan);
+            char byte;
+            assertTrue(client != -1 && read(client, &byte, 1) == 0, "Client from another network closed");
+            server = acceptWithin(upstream);
+            assertEqual(-1, server, "...without reaching the instance");
+            if (server != -1) close(server);
+            close(client);
+        }
+    }
+    close(upstream);
+}
+
+TEST(HostInstanceFromHostHeader) {
+    State state;
+    for (const std::string name : {"web", "shop/api"}) {
+        auto inst = std::make_shared<Instance>();
+        inst->name = name;
+        state.instances[name] = inst;
+    }
+    std::vector<std::string> domains = {"vp.localhost", "dev.test"};
+
+    assertEqual("web", hostInstance(state, "web.vp.localhost", domains), "Name under the domain");
+    assertEqual("web", hostInstance(state, "WEB.dev.test:8081", domains), "Case and port ignored");
+    assertEqual("shop/api", hostInstance(state, "api.shop.vp.localhost", domains), "Project-scoped name");
+    assertEqual("", hostInstance(state, "api.vp.localhost", domains), "Unqualified miss");
+    assertEqual("", hostInstance(state, "web.example.com", domains), "Other domain");
+    assertEqual("", hostInstance(state, "vp.localhost", domains), "Bare domain");
+}
+
+TEST(MdnsServicesOfRunningInstances) {
+    State state;
+    auto add = [&](const std::string& name, const std::string& status, const std::string& port) {
+        auto inst = std::make_shared<Instance>();
+        inst->name = name;
+        inst->status = status;
+        if (!port.empty()) inst->resources["tcpport"] = port;
+        state.instances[name] = inst;
+    };
+    add("web", "running", "3000");
+    add("db", "stopped", "5432");
+    add("worker", "running", "");
+
+    auto services = mdnsServices(state);
+    assertEqual(1, (int)services.size(), "Only running instances with a tcpport");
+    assertEqual(3000, services["web"], "Announced on its current port");
+
+    auto cmd = mdnsPublishCommand("web", 3000, "node");
+    assertTrue(std::find(cmd.begin(), cmd.end(), "_vp._tcp") != cmd.end(), "Service type");
+    assertEqual("template=node", cmd.back(), "Template in TXT record");
+}
+
+TEST(ServiceRegistrationPayloads) {
+    Instance inst;
+    inst.name = "shop/api";
+    inst.template_name = "node";
+
+    json service = consulService(inst, 41000, "");
+    assertEqual("vp-shop-api", service["ID"].get<std::string>(), "Consul ID usable in URL paths");
+    assertEqual("node", service["Name"].get<std::string>(), "Service named after the template");
+    assertEqual(41000, service["Port"].get<int>(), "Current port");
+    assertTrue(!service.contains("Address"), "Agent address by default");
+    assertEqual("30s", service["Check"]["TTL"].get<std::string>(), "Health via TTL check");
+
+    assertEqual("/vp/services/shop/api", etcdKey(inst.name), "etcd key");
+    json value = etcdValue(inst, 41000, "10.0.0.5", false);
+    assertEqual("10.0.0.5", value["address"].get<std::string>(), "Address");
+    assertTrue(!value["healthy"].get<bool>(), "Health");
+
+    assertTrue(makeServiceRegistry("etcd://127.0.0.1:2379", "") != nullptr, "etcd URL");
+    bool threw = false;
+    try {
+        makeServiceRegistry("zookeeper://x:2181", "");
+    } catch (const std::invalid_argument&) {
+        threw = true;
+    }
+    assertTrue(threw, "Unknown scheme rejected");
+}
+
+TEST(SystemdNotifyAndListenFds) {
+    unsetenv("NOTIFY_SOCKET");
+    assertTrue(!sdNotify("READY=1"), "Not under systemd");
+
+    std::string path = std::string(getenv("HOME")) + "/notify.sock";
+    int fd = socket(AF_UNIX, SOCK_DGRAM, 0);
+    struct sockaddr_un addr;
+    memset(&addr, 0, sizeof(addr));
+    addr.sun_family = AF_UNIX;
+    strncpy(addr.sun_path, path.c_str(), sizeof(addr.sun_path) - 1);
+    unlink(path.c_str());
+    assertTrue(bind(fd, (struct sockaddr*)&addr, sizeof(addr)) == 0, "Bind notify socket");
+
+    setenv("NOTIFY_SOCKET", path.c_str(), 1);
+    assertTrue(sdNotify("READY=1"), "Sent");
+    char buf[64] = {0};
+    ssize_t n = recv(fd, buf, sizeof(buf) - 1, MSG_DONTWAIT);
+    assertEqual("READY=1", std::string(buf, n > 0 ? n : 0), "Received as one datagram");
+    unsetenv("NOTIFY_SOCKET");
+    close(fd);
+    unlink(path.c_str());
+
+    setenv("WATCHDOG_USEC", "3000000", 1);
+    setenv("WATCHDOG_PID", "1", 1);
+    assertTrue(watchdogUsec() == 0, "Watchdog for another PID");
+    setenv("WATCHDOG_PID", std::to_string(getpid()).c_str(), 1);
+    assertTrue(watchdogUsec() == 3000000, "Watchdog for us");
+    unsetenv("WATCHDOG_USEC");
+    unsetenv("WATCHDOG_PID");
+
+    setenv("LISTEN_FDS", "2", 1);
+    setenv("LISTEN_PID", "1", 1);
+    assertTrue(listenFds().empty(), "Sockets for another PID");
+    assertTrue(getenv("LISTEN_FDS") == nullptr, "Variables cleared");
+    setenv("LISTEN_FDS", "2", 1);
+    setenv("LISTEN_PID", std::to_string(getpid()).c_str(), 1);
+    auto fds = listenFds();
+    assertEqual(2, (int)fds.size(), "Two sockets");
+    assertEqual(3, fds[0], "Starting at fd 3");
+}
+
+TEST(SelfCheckLoopsAndReadiness) {
+    time_t now = time(nullptr);
+    loopAlive("test-loop", 5);
+    json health = selfCheck(false, now);
+    assertEqual("ok", health["status"].get<std::string>(), "Fresh loop is alive");
+    assertTrue(!health["checks"].contains("state_writable"), "healthz skips readiness checks");
+
+    json stalled = selfCheck(false, now + 10);
+    assertEqual("fail", stalled["status"].get<std::string>(), "Stalled loop fails");
+    assertTrue(!stalled["checks"]["loop:test-loop"]["ok"].get<bool>(), "Stalled loop named");
+
+    mkdir((std::string(getenv("HOME")) + "/.vibeprocess").c_str(), 0755);
+    discoveryTook(0.25);
+    json ready = selfCheck(true, now);
+    assertEqual("ok", ready["status"].get<std::string>(), "Ready: " + ready.dump());
+    assertEqual(250.0, ready["checks"]["discovery"]["latency_ms"].get<double>(), "Latency in ms");
+
+    discoveryTook(DISCOVERY_SLOW_SECONDS + 1);
+    assertEqual("fail", selfCheck(true, now)["status"].get<std::string>(), "Slow discovery is not ready");
+    discoveryTook(0);
+}
+
+TEST(SelfStatsReportsOwnUsage) {
+    State state;
+    state.templates["t"] = std::make_shared<Template>();
+    json self = selfStats(state);
+    assertEqual((int)getpid(), self["pid"].get<int>(), "Own PID");
+    assertTrue(self["threads"].get<int>() >= 1, "Thread count");
+    assertTrue(self["rss"].get<long>() > 0, "RSS");
+    assertEqual((int)state.templates.size(), self["state"]["templates"].get<int>(), "State size");
+    assertTrue(self["process_cache"].contains("hit_rate"), "Cache hit rate");
+}
+
+TEST(ShapeListFieldsAndPaging) {
+    json items = {
+        {"a", {{"name", "a"}, {"pid", 1}, {"resources", {{"tcpport", "3000"}}}}},
+        {"b", {{"name", "b"}, {"pid", 2}, {"resources", json::object()}}},
+        {"c", {{"name", "c"}, {"pid", 3}, {"resources", json::object()}}}
+    };
+    size_t total = 0;
+
+    json page = shapeList(items, "/api/instances?offset=1&limit=1&fields=name,pid", total);
+    assertEqual(3, (int)total, "Total before paging");
+    assertEqual(1, (int)page.size(), "One item");
+    assertEqual(json({{"name", "b"}, {"pid", 2}}).dump(), page["b"].dump(), "Second by name, only fields");
+
+    json omitted = shapeList(items, "/api/instances?omit=resources", total);
+    assertEqual(3, (int)omitted.size(), "All items");
+    assertTrue(!omitted["a"].contains("resources") && omitted["a"].contains("pid"), "resources omitted");
+
+    json array = shapeList(json::array({1, 2, 3, 4}), "/api/discover?offset=3", total);
+    assertEqual("[4]", array.dump(), "Arrays page too");
+
+    bool threw = false;
+    try {
+        shapeList(items, "/api/instances?limit=-1", total);
+    } catch (const std::invalid_argument&) {
+        threw = true;
+    }
+    assertTrue(threw, "Bad limit rejected");
+}
+
+TEST(ETagRevisionAndNotModified) {
+    State state;
+    unsigned long long before = state.revision();
+    state.save();
+    unsigned long long saved = state.revision();
+    assertTrue(saved > before, "First save bumps the revision");
+    state.save();
+    assertTrue(state.revision() == saved, "Saving the same content doesn't");
+    state.counters["x"] = 1;
+    state.save();
+    assertTrue(state.revision() > saved, "A change does");
+
+    assertTrue(etagRoute("/api/instances?project=p") && etagRoute("/api/config"), "Polled routes");
+    assertTrue(!etagRoute("/api/events"), "Others not");
+
+    std::string ok = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n{}";
+    Request req;
+    std::string tagged = applyETag(req, "\"a-7\"", ok);
+    assertTrue(tagged.find("ETag: \"a-7\"\r\n") != std::string::npos, "ETag added");
+
+    req.headers["if-none-match"] = "\"a-6\", \"a-7\"";
+    std::string notModified = applyETag(req, "\"a-7\"", ok);
+    assertTrue(notModified.rfind("HTTP/1.1 304 ", 0) == 0 && notModified.find("{}") == std::string::npos, "304 without body");
+    req.headers["if-none-match"] = "\"a-6\"";
+    assertTrue(applyETag(req, "\"a-7\"", ok).rfind("HTTP/1.1 200 ", 0) == 0, "Stale tag gets the body");
+    assertEqual(std::string("HTTP/1.1 404 Not Found\r\n\r\n"), applyETag(req, "\"a-7\"", "HTTP/1.1 404 Not Found\r\n\r\n"), "Errors untouched");
+}
+
+TEST(ApiVersionNegotiation) {
+    bool deprecated = true;
+    Request req;
+    req.path = "/api/v1/instances?project=shop";
+    assertEqual("", negotiateVersion(req, deprecated), "v1 accepted");
+    assertEqual("/api/instances?project=shop", req.path, "Routed internally");
+    assertTrue(!deprecated, "Versioned path is current");
+
+    req.path = "/api/templates";
+    assertEqual("", negotiateVersion(req, deprecated), "Alias still served");
+    assertTrue(deprecated, "Alias is deprecated");
+
+    req.path = "/api/v2/instances";
+    assertTrue(negotiateVersion(req, deprecated).rfind("HTTP/1.1 400", 0) == 0, "Unknown version in path");
+
+    req.path = "/api/v1/instances";
+    req.headers["x-vp-api-version"] = "2";
+    assertTrue(negotiateVersion(req, deprecated).find("Unsupported API version 2") != std::string::npos, "Unknown version in header");
+
+    req.path = "/healthz";
+    assertEqual("", negotiateVersion(req, deprecated), "Non-API paths untouched");
+    assertEqual("/healthz", req.path, "Path kept");
+}
+
+TEST(WatchChangesSinceRevision) {
+    State state;
+    state.save();
+    unsigned long long start = state.revision();
+
+    auto tmpl = std::make_shared<Template>();
+    tmpl->id = "watched";
+    tmpl->command = "true";
+    state.templates["watched"] = tmpl;
+    std::thread([&state]() {
+        std::this_thread::sleep_for(std::chrono::milliseconds(100));
+        state.save();
+    }).join();
+    assertTrue(state.waitForRevision(start, 1000), "Woken by the save");
+    assertTrue(!state.waitForRevision(state.revision(), 50), "Times out without changes");
+
+    json result = watchResult(state, start);
+    assertEqual((int)state.revision(), result["revision"].get<int>(), "Current revision");
+    assertEqual(1, (int)result["changes"].size(), "One change: " + result.dump());
+    json change = result["changes"][0];
+    assertEqual("template", change["kind"].get<std::string>(), "Kind");
+    assertEqual("watched", change["name"].get<std::string>(), "Name");
+    assertEqual("added", change["op"].get<std::string>(), "Op");
+    assertEqual("true", change["value"]["command"].get<std::string>(), "Current value");
+
+    state.templates.erase("watched");
+    state.save();
+    json removed = watchResult(state, result["revision"].get<unsigned long long>());
+    assertEqual("removed", removed["changes"][0]["op"].get<std::string>(), "Removal");
+    assertTrue(!removed["changes"][0].contains("value"), "No value for removals");
+
+    assertTrue(watchResult(state, 0)["reset"].get<bool>(), "From scratch: re-read");
+}
+
+TEST(StaticFilesFromWebDir) {
+    std::string dir = std::string(getenv("HOME")) + "/webdir";
+    mkdir(dir.c_str(), 0755);
+    mkdir((dir + "/js").c_str(), 0755);
+    std::ofstream(dir + "/index.html") << "<html></html>";
+    std::ofstream(dir + "/js/app.js") << "1;";
+    std::ofstream(std::string(getenv("HOME")) + "/secret.txt") << "no";
+    symlink((std::string(getenv("HOME")) + "/secret.txt").c_str(), (dir + "/leak.txt").c_str());
+
+    assertTrue(staticFilePath(dir, "/").find("/index.html") != std::string::npos, "/ is index.html");
+    assertTrue(staticFilePath(dir, "/js/app.js?v=2").find("/js/app.js") != std::string::npos, "Nested, query ignored");
+    assertEqual("", staticFilePath(dir, "/missing.css"), "Missing file");
+    assertEqual("", staticFilePath(dir, "/js"), "Directories are not served");
+    assertEqual("", staticFilePath(dir, "/../secret.txt"), "No climbing out");
+    assertEqual("", staticFilePath(dir, "/leak.txt"), "No symlinks out");
+
+    assertEqual("text/javascript", staticContentType("app.js"), "JS");
+    assertEqual("text/html", staticContentType("/x/index.html"), "HTML");
+    assertEqual("application/octet-stream", staticContentType("blob"), "Unknown");
+}
+
+TEST(FormatLogRecord) {
+    std::string text = formatLogRecord(0, LogLevel::Warn, "discovery failed", {{"pid", 42}, {"error", "no such file"}}, LogFormat::Text);
+    assertTrue(text.find("level=WARN msg=\"discovery failed\"") != std::string::npos, "Text record: " + text);
+    assertTrue(text.find(" error=\"no such file\"") != std::string::npos, "Values with spaces are quoted: " + text);
+    assertTrue(text.find(" pid=42") != std::string::npos, "Plain values are not quoted: " + text);
+
+    json j = json::parse(formatLogRecord(0, LogLevel::Error, "boom", {{"pid", 42}}, LogFormat::JSON));
+    assertEqual("ERROR", j["level"].get<std::string>(), "JSON level");
+    assertEqual("boom", j["msg"].get<std::string>(), "JSON msg");
+    assertEqual(42, j["pid"].get<int>(), "JSON attrs are merged");
+
+    LogLevel level;
+    assertTrue(parseLogLevel("debug", level) && level == LogLevel::Debug, "Should parse debug");
+    assertTrue(!parseLogLevel("loud", level), "Should reject unknown level");
+}
+
 int main() {
     return TestRunner::instance().run();
 }
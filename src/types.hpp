@@ -5,28 +5,55 @@
 #include <map>
 #include <vector>
 #include <ctime>
+#include <optional>
 #include "json.hpp"
 
 namespace vp {
 
 using json = nlohmann::json;
 
+// Shell-equivalent form of an argument list for display: arguments that are
+// empty or contain anything but plain characters are single-quoted
+inline std::string joinArgv(const std::vector<std::string>& argv) {
+    std::string out;
+    for (const auto& arg : argv) {
+        bool plain = !arg.empty();
+        for (char c : arg) {
+            if (!isalnum((unsigned char)c) && std::string("_-./:=,@%+").find(c) == std::string::npos) plain = false;
+        }
+        if (!out.empty()) out += " ";
+        if (plain) {
+            out += arg;
+            continue;
+        }
+        out += "'";
+        for (char c : arg) {
+            out += c == '\'' ? std::string("'\\''") : std::string(1, c);
+        }
+        out += "'";
+    }
+    return out;
+}
+
 // Resource represents an allocated resource
 struct Resource {
     std::string type;   // tcpport|vncport|gpu|license|whatever
     std::string value;  // "3000" or "/path" or "0"
     std::string owner;  // Instance name
+    bool reserved = false; // Claimed ahead of time (vp reserve): kept across stops, handed to owner only
 };
 
 // JSON serialization for Resource
 inline void to_json(json& j, const Resource& r) {
     j = json{{"type", r.type}, {"value", r.value}, {"owner", r.owner}};
+    if (r.reserved) j["reserved"] = true;
 }
 
 inline void from_json(const json& j, Resource& r) {
     j.at("type").get_to(r.type);
     j.at("value").get_to(r.value);
     j.at("owner").get_to(r.owner);
+    r.reserved = j.value("reserved", false);
 }
 
 // ResourceType defines a type of resource with validation
@@ -36,6 +63,8 @@ struct ResourceType {
     bool counter;        // Is this auto-incrementing?
     int start;           // Counter start value
     int end;             // Counter end value
+    std::string allocator; // External allocator command (alloc/release/check); replaces check and counter
+    bool ephemeral = false; // TCP port from the kernel (bind port 0), held by vp until the owner's exec
 };
 
 // JSON serialization for ResourceType
@@ -47,6 +76,8 @@ inline void to_json(json& j, const ResourceType& rt) {
         {"start", rt.start},
         {"end", rt.end}
     };
+    if (!rt.allocator.empty()) j["allocator"] = rt.allocator;
+    if (rt.ephemeral) j["ephemeral"] = true;
 }
 
 inline void from_json(const json& j, ResourceType& rt) {
@@ -55,16 +86,150 @@ inline void from_json(const json& j, ResourceType& rt) {
     j.at("counter").get_to(rt.counter);
     j.at("start").get_to(rt.start);
     j.at("end").get_to(rt.end);
+    rt.allocator = j.value("allocator", "");
+    rt.ephemeral = j.value("ephemeral", false);
+}
+
+// LogPolicy controls rotation and retention of captured output
+struct LogPolicy {
+    long max_size = 10 * 1024 * 1024;  // Rotate when log exceeds this many bytes (0 = never)
+    int max_files = 5;                 // Rotated files to keep (name.log.1 .. name.log.N)
+    long max_age = 0;                  // Delete rotated/orphaned logs older than this many seconds (0 = never)
+    bool compress = false;             // gzip rotated files
+};
+
+// JSON serialization for LogPolicy
+inline void to_json(json& j, const LogPolicy& p) {
+    j = json{
+        {"max_size", p.max_size},
+        {"max_files", p.max_files},
+        {"max_age", p.max_age},
+        {"compress", p.compress}
+    };
+}
+
+inline void from_json(const json& j, LogPolicy& p) {
+    p.max_size = j.value("max_size", p.max_size);
+    p.max_files = j.value("max_files", p.max_files);
+    p.max_age = j.value("max_age", p.max_age);
+    p.compress = j.value("compress", p.compress);
+}
+
+// MatchRule says how to re-identify an instance's process once vp has lost
+// track of it (the process was restarted by hand, vp's state was reset).
+// Every field that is set must hold.
+struct MatchRule {
+    std::string cmdline;  // Regex searched for in the full command line
+    std::string exe;      // Executable path, or its basename when there is no '/'
+    std::string cwd;      // Working directory
+    std::string env;      // "NAME" (set at all) or "NAME=VALUE" in the environment
+    bool port = true;     // Listens on the instance's tcpport (when it has one)
+};
+
+// JSON serialization for MatchRule
+inline void to_json(json& j, const MatchRule& m) {
+    j = json::object();
+    if (!m.cmdline.empty()) j["cmdline"] = m.cmdline;
+    if (!m.exe.empty()) j["exe"] = m.exe;
+    if (!m.cwd.empty()) j["cwd"] = m.cwd;
+    if (!m.env.empty()) j["env"] = m.env;
+    if (!m.port) j["port"] = false;
+}
+
+inline void from_json(const json& j, MatchRule& m) {
+    m.cmdline = j.value("cmdline", "");
+    m.exe = j.value("exe", "");
+    m.cwd = j.value("cwd", "");
+    m.env = j.value("env", "");
+    m.port = j.value("port", true);
+}
+
+// StartupProbe keeps a new instance "starting" until it is up: every check
+// that is set must pass. Past the deadline it is marked "error".
+struct StartupProbe {
+    std::string port;     // Port that must accept connections, interpolated (e.g. "${tcpport}")
+    std::string log;      // Regex a line of its output must match
+    std::string url;      // URL that must answer with a 2xx status (curl), interpolated
+    long timeout = 60;    // Seconds from the start before it is marked error
+    bool kill = false;    // Also stop it then
+};
+
+// JSON serialization for StartupProbe
+inline void to_json(json& j, const StartupProbe& p) {
+    j = json{{"timeout", p.timeout}};
+    if (!p.port.empty()) j["port"] = p.port;
+    if (!p.log.empty()) j["log"] = p.log;
+    if (!p.url.empty()) j["url"] = p.url;
+    if (p.kill) j["kill"] = true;
+}
+
+inline void from_json(const json& j, StartupProbe& p) {
+    p.port = j.contains("port") && j.at("port").is_number() ? std::to_string(j.at("port").get<int>())
+                                                             : j.value("port", "");
+    p.log = j.value("log", "");
+    p.url = j.value("url", "");
+    p.timeout = j.value("timeout", 60L);
+    p.kill = j.value("kill", false);
+}
+
+// Limits are soft usage thresholds for an instance, checked at each sample.
+// Going over one records a "limit" event (POSTed to webhook, if set) and marks
+// the instance over-limit until it is back under. Nothing is stopped or
+// throttled: that takes cgroups.
+struct Limits {
+    long max_rss = 0;             // Bytes, summed over its process tree (0 = none)
+    double max_cpu_percent = 0;   // Percent of one core, over the tree (0 = none)
+    int max_fds = 0;              // Open fds of any one process in the tree (0 = none)
+    std::string webhook;          // URL each event is POSTed to as JSON
+};
+
+// JSON serialization for Limits
+inline void to_json(json& j, const Limits& l) {
+    j = json::object();
+    if (l.max_rss > 0) j["max_rss"] = l.max_rss;
+    if (l.max_cpu_percent > 0) j["max_cpu_percent"] = l.max_cpu_percent;
+    if (l.max_fds > 0) j["max_fds"] = l.max_fds;
+    if (!l.webhook.empty()) j["webhook"] = l.webhook;
+}
+
+inline void from_json(const json& j, Limits& l) {
+    l.max_rss = j.value("max_rss", 0L);
+    l.max_cpu_percent = j.value("max_cpu_percent", 0.0);
+    l.max_fds = j.value("max_fds", 0);
+    l.webhook = j.value("webhook", "");
 }
 
 // Template defines how to start a process
 struct Template {
     std::string id;                          // Unique template ID
     std::string label;                       // Human-readable label
+    std::string description;                 // Free text: what it is for (vp annotate --template)
+    std::string version;                     // Revision label (default: a hash of the definition)
     std::string command;                     // Template with ${var} and %counter
+    std::vector<std::string> argv;           // "command" given as a JSON array: run without a shell
     std::vector<std::string> resources;      // Resource types this needs
     std::map<std::string, std::string> vars; // Default variables
     std::string action;                      // Action to execute (URL or command)
+    std::map<std::string, std::string> actions; // Named actions, e.g. "admin-ui", "migrate"
+    std::string health;                      // Health check command, exit 0 = healthy
+    std::string test;                        // Run once ready by vp template test, exit 0 = pass
+    std::map<std::string, std::string> secrets; // Env var -> reference (env:VAR, file:/path, enc:BLOB), see secrets.hpp
+    std::map<std::string, std::string> env;  // Env var -> value, interpolated (not for secrets: kept in state.json)
+    int health_failures = 0;                 // Restart after this many failed checks in a row (0 = never)
+    long health_interval = 10;               // Seconds between checks (vp serve)
+    int proxy_port = 0;                      // Stable port vp serve forwards to ${tcpport} (0 = none)
+    bool pty = false;                        // Run attached to a pseudo-terminal (web terminal)
+    bool strict = true;                      // Refuse to start with unresolved ${var} or %counter
+    std::string on_shutdown;                 // When vp serve exits: leave (default), stop, or remember (stop, autostart next time)
+    std::string cwd;                         // Working directory, interpolated (default: workdir resource, else vp's)
+    std::string umask;                       // Octal, e.g. "027" (default: inherited)
+    std::string stdout_path;                 // File for stdout, interpolated, relative to cwd (default: log)
+    std::string stderr_path;                 // File for stderr (default: log)
+    std::optional<LogPolicy> log;            // Log rotation override (default: global policy)
+    std::optional<MatchRule> match;          // How instances are re-identified, interpolated (default: see matchRuleFor)
+    std::optional<StartupProbe> startup;     // When a new instance counts as running (default: once forked)
+    std::optional<Limits> limits;            // Soft usage thresholds (warnings, not enforcement)
+    std::string source;                      // Where it was added from (file, URL, git repo//path)
 };
 
 // JSON serialization for Template
@@ -76,36 +241,249 @@ inline void to_json(json& j, const Template& t) {
         {"resources", t.resources},
         {"vars", t.vars}
     };
+    if (!t.version.empty()) {
+        j["version"] = t.version;
+    }
+    if (!t.argv.empty()) {
+        j["command"] = t.argv;
+    }
     if (!t.action.empty()) {
         j["action"] = t.action;
     }
+    if (!t.actions.empty()) {
+        j["actions"] = t.actions;
+    }
+    if (!t.health.empty()) {
+        j["health"] = t.health;
+    }
+    if (!t.test.empty()) {
+        j["test"] = t.test;
+    }
+    if (!t.secrets.empty()) {
+        j["secrets"] = t.secrets;
+    }
+    if (!t.env.empty()) {
+        j["env"] = t.env;
+    }
+    if (t.health_failures > 0) {
+        j["health_failures"] = t.health_failures;
+        j["health_interval"] = t.health_interval;
+    }
+    if (t.proxy_port > 0) {
+        j["proxy_port"] = t.proxy_port;
+    }
+    if (t.pty) {
+        j["pty"] = true;
+    }
+    if (!t.strict) {
+        j["strict"] = false;
+    }
+    if (!t.on_shutdown.empty()) j["on_shutdown"] = t.on_shutdown;
+    if (!t.cwd.empty()) j["cwd"] = t.cwd;
+    if (!t.umask.empty()) j["umask"] = t.umask;
+    if (!t.stdout_path.empty()) j["stdout"] = t.stdout_path;
+    if (!t.stderr_path.empty()) j["stderr"] = t.stderr_path;
+    if (t.log) {
+        j["log"] = *t.log;
+    }
+    if (t.match) {
+        j["match"] = *t.match;
+    }
+    if (t.startup) {
+        j["startup"] = *t.startup;
+    }
+    if (t.limits) {
+        j["limits"] = *t.limits;
+    }
+    if (!t.source.empty()) {
+        j["source"] = t.source;
+    }
+    if (!t.description.empty()) {
+        j["description"] = t.description;
+    }
 }
 
 inline void from_json(const json& j, Template& t) {
     j.at("id").get_to(t.id);
     j.at("label").get_to(t.label);
-    j.at("command").get_to(t.command);
+    if (j.contains("version")) {
+        t.version = j.at("version").is_string() ? j.at("version").get<std::string>() : j.at("version").dump();
+    }
+    if (j.at("command").is_array()) {
+        j.at("command").get_to(t.argv);
+        t.command = joinArgv(t.argv);
+    } else {
+        j.at("command").get_to(t.command);
+    }
     j.at("resources").get_to(t.resources);
     j.at("vars").get_to(t.vars);
     if (j.contains("action")) {
         j.at("action").get_to(t.action);
     }
+    if (j.contains("actions")) {
+        j.at("actions").get_to(t.actions);
+    }
+    if (j.contains("health")) {
+        j.at("health").get_to(t.health);
+    }
+    if (j.contains("test")) {
+        j.at("test").get_to(t.test);
+    }
+    if (j.contains("secrets")) {
+        j.at("secrets").get_to(t.secrets);
+        // Only references: a plain value would end up in state.json and the API
+        for (const auto& [name, ref] : t.secrets) {
+            if (ref.rfind("env:", 0) != 0 && ref.rfind("file:", 0) != 0 && ref.rfind("enc:", 0) != 0) {
+                throw std::invalid_argument("secret " + name + " of template " + t.id +
+                                            " must be env:VAR, file:/path or enc:... (see vp secret encrypt)");
+            }
+        }
+    }
+    if (j.contains("env")) {
+        j.at("env").get_to(t.env);
+    }
+    if (j.contains("health_failures")) {
+        j.at("health_failures").get_to(t.health_failures);
+    }
+    if (j.contains("health_interval")) {
+        j.at("health_interval").get_to(t.health_interval);
+    }
+    if (j.contains("proxy_port")) {
+        j.at("proxy_port").get_to(t.proxy_port);
+    }
+    if (j.contains("pty")) {
+        j.at("pty").get_to(t.pty);
+    }
+    if (j.contains("strict")) {
+        j.at("strict").get_to(t.strict);
+    }
+    if (j.contains("on_shutdown")) j.at("on_shutdown").get_to(t.on_shutdown);
+    if (j.contains("cwd")) j.at("cwd").get_to(t.cwd);
+    if (j.contains("umask")) j.at("umask").get_to(t.umask);
+    if (j.contains("stdout")) j.at("stdout").get_to(t.stdout_path);
+    if (j.contains("stderr")) j.at("stderr").get_to(t.stderr_path);
+    if (j.contains("log")) {
+        t.log = j.at("log").get<LogPolicy>();
+    }
+    if (j.contains("match")) {
+        t.match = j.at("match").get<MatchRule>();
+    }
+    if (j.contains("startup")) {
+        t.startup = j.at("startup").get<StartupProbe>();
+    }
+    if (j.contains("limits")) {
+        t.limits = j.at("limits").get<Limits>();
+    }
+    if (j.contains("source")) {
+        j.at("source").get_to(t.source);
+    }
+    if (j.contains("description")) {
+        j.at("description").get_to(t.description);
+    }
+}
+
+// ProcessSnapshot is what discovery saw of a process when it was imported
+// (vp monitor), kept for vp inspect and to restart it the way it ran
+struct ProcessSnapshot {
+    struct Parent {
+        int pid = 0;
+        std::string name;
+        std::string cmdline;
+    };
+
+    time_t taken = 0;                        // When it was read
+    std::string exe;                         // Executable path
+    std::string cwd;                         // Working directory
+    std::map<std::string, std::string> environ; // Environment, secret-looking values redacted
+    std::vector<int> ports;                  // TCP ports it listened on
+    std::vector<Parent> parents;             // Parent chain up to init, nearest first
+};
+
+// JSON serialization for ProcessSnapshot
+inline void to_json(json& j, const ProcessSnapshot::Parent& p) {
+    j = json{{"pid", p.pid}, {"name", p.name}, {"cmdline", p.cmdline}};
+}
+
+inline void from_json(const json& j, ProcessSnapshot::Parent& p) {
+    p.pid = j.value("pid", 0);
+    p.name = j.value("name", "");
+    p.cmdline = j.value("cmdline", "");
+}
+
+inline void to_json(json& j, const ProcessSnapshot& s) {
+    j = json{{"taken", s.taken}, {"exe", s.exe}, {"cwd", s.cwd}, {"ports", s.ports}};
+    if (!s.environ.empty()) j["environ"] = s.environ;
+    if (!s.parents.empty()) j["parents"] = s.parents;
+}
+
+inline void from_json(const json& j, ProcessSnapshot& s) {
+    s.taken = j.value("taken", (time_t)0);
+    s.exe = j.value("exe", "");
+    s.cwd = j.value("cwd", "");
+    s.environ = j.value("environ", std::map<std::string, std::string>{});
+    s.ports = j.value("ports", std::vector<int>{});
+    s.parents = j.value("parents", std::vector<ProcessSnapshot::Parent>{});
 }
 
 // Instance represents a running or stopped process instance
 struct Instance {
-    std::string name;                        // User-provided name
+    std::string name;                        // User-provided name, "project/name" inside a project
+    std::string project;                     // Project scope (empty = global)
+    std::map<std::string, std::string> labels; // Free-form key=value labels for selection
+    std::string notes;                       // Free text: why it exists (--notes at start, vp annotate)
     std::string template_name;               // Template ID
+    std::string template_revision;           // templateRevision() it was started from (drift detection)
+    std::map<std::string, std::string> vars; // Vars given at start, reused by vp upgrade
     std::string command;                     // Final interpolated command
+    std::vector<std::string> argv;           // Interpolated arguments, run without a shell (argv templates)
+    std::string leaf_command;                // Imported by launch script: the process it was found by
+    std::string marker;                      // $VP_INSTANCE it was last started with: "<name>:<random>"
+    std::string container;                   // Container its process was found in (see ProcessInfo)
     int pid;                                 // Process ID
-    std::string status;                      // stopped|starting|running|stopping|error
+    std::string status;                      // See instanceStatuses() (process.hpp)
     std::map<std::string, std::string> resources; // resource_type -> value
     time_t started;                          // Unix timestamp
+    time_t stopped_at;                       // When it last stopped (vp prune); 0 = unknown
+    unsigned long long start_ticks;          // Process start time from the inspector, detects PID reuse
     std::string cwd;                         // Working directory
+    std::string umask;                       // From the template: octal file mode mask
+    std::string stdout_path;                 // From the template: stdout file instead of the log
+    std::string stderr_path;                 // From the template: stderr file instead of the log
     bool managed;                            // true=can stop/restart, false=monitor only
-    double cpu_time;                         // CPU time in seconds
+    bool pty;                                // Attached to a pseudo-terminal held by vp serve
+    bool autostart;                          // Start it when vp serve next starts (set by on_shutdown "remember")
+    bool protect;                            // vp lock: stop/restart/delete refused without force
+    double cpu_time;                         // CPU time in seconds (incl. descendants)
+    double cpu_percent;                      // CPU use since the previous sample (100 = one core)
+    double cpu_sampled;                      // When cpu_time was read (Unix time, fractional)
+    long rss;                                // Resident set size in bytes (incl. descendants)
+    int children;                            // Number of descendant processes
+    int threads;                             // Threads summed over the process tree
+    int fds;                                 // Open fds of the process closest to its limit
+    long fd_limit;                           // That process's soft nofile limit (0 = unknown)
+    std::string warning;                     // e.g. "open files near limit" (status stays running)
+    long long io_read;                       // Storage bytes read, summed over the tree
+    long long io_write;                      // Storage bytes written, summed over the tree
     std::string error;                       // Error message if status=error
     std::string action;                      // Action to execute (URL or command)
+    std::map<std::string, std::string> actions; // Interpolated named actions
+    std::string health;                      // Interpolated health check command
+    std::map<std::string, std::string> secrets; // From the template: env var -> reference, resolved at each start
+    std::map<std::string, std::string> env;  // Interpolated template env, set in the process
+    int restarts;                            // Times vp restarted it while running (alerts, supervision)
+    int health_failures;                     // From the template: restart after this many failed checks
+    long health_interval;                    // From the template: seconds between checks
+    int failed_checks;                       // Consecutive failed health checks
+    long backoff;                            // Seconds the next health restart must wait after the last
+    time_t restarted_at;                     // Last automatic restart
+    std::string restart_reason;              // Why, e.g. "health check failed 3 times"
+    int proxy_port;                          // From the template: stable port forwarded to tcpport
+    std::optional<MatchRule> match;          // From the template or vp match: how to re-identify it
+    std::optional<StartupProbe> startup;     // From the template, interpolated: checked while "starting"
+    std::optional<Limits> limits;            // From the template: soft usage thresholds
+    std::vector<std::string> over_limit;     // Limits exceeded at the last sample, e.g. "max_rss"
+    long long output_offset;                 // Size of its output when it last started: the startup log probe reads on from there
+    std::optional<ProcessSnapshot> discovered; // Imported: the process as discovery found it
 };
 
 // JSON serialization for Instance
@@ -120,10 +498,57 @@ inline void to_json(json& j, const Instance& i) {
         {"started", i.started},
         {"managed", i.managed}
     };
+    if (!i.template_revision.empty()) j["template_revision"] = i.template_revision;
+    if (!i.vars.empty()) j["vars"] = i.vars;
+    if (!i.argv.empty()) j["argv"] = i.argv;
+    if (!i.leaf_command.empty()) j["leaf_command"] = i.leaf_command;
+    if (!i.marker.empty()) j["marker"] = i.marker;
+    if (!i.container.empty()) j["container"] = i.container;
+    if (!i.project.empty()) j["project"] = i.project;
+    if (!i.labels.empty()) j["labels"] = i.labels;
     if (!i.cwd.empty()) j["cwd"] = i.cwd;
+    if (!i.umask.empty()) j["umask"] = i.umask;
+    if (!i.stdout_path.empty()) j["stdout"] = i.stdout_path;
+    if (!i.stderr_path.empty()) j["stderr"] = i.stderr_path;
     if (i.cpu_time > 0) j["cputime"] = i.cpu_time;
+    if (i.cpu_percent > 0) j["cpu_percent"] = i.cpu_percent;
+    if (i.cpu_sampled > 0) j["cpu_sampled"] = i.cpu_sampled;
+    if (i.rss > 0) j["rss"] = i.rss;
+    if (i.children > 0) j["children"] = i.children;
+    if (i.threads > 0) j["threads"] = i.threads;
+    if (i.fds > 0) j["fds"] = i.fds;
+    if (i.fd_limit > 0) j["fd_limit"] = i.fd_limit;
+    if (!i.warning.empty()) j["warning"] = i.warning;
+    if (i.io_read > 0) j["io_read"] = i.io_read;
+    if (i.io_write > 0) j["io_write"] = i.io_write;
     if (!i.error.empty()) j["error"] = i.error;
     if (!i.action.empty()) j["action"] = i.action;
+    if (!i.actions.empty()) j["actions"] = i.actions;
+    if (!i.health.empty()) j["health"] = i.health;
+    if (i.start_ticks > 0) j["start_ticks"] = i.start_ticks;
+    if (i.stopped_at > 0) j["stopped_at"] = i.stopped_at;
+    if (i.pty) j["pty"] = true;
+    if (i.autostart) j["autostart"] = true;
+    if (i.protect) j["protected"] = true;
+    if (!i.notes.empty()) j["notes"] = i.notes;
+    if (!i.secrets.empty()) j["secrets"] = i.secrets;
+    if (!i.env.empty()) j["env"] = i.env;
+    if (i.restarts > 0) j["restarts"] = i.restarts;
+    if (i.health_failures > 0) {
+        j["health_failures"] = i.health_failures;
+        j["health_interval"] = i.health_interval;
+    }
+    if (i.failed_checks > 0) j["failed_checks"] = i.failed_checks;
+    if (i.backoff > 0) j["backoff"] = i.backoff;
+    if (i.restarted_at > 0) j["restarted_at"] = i.restarted_at;
+    if (!i.restart_reason.empty()) j["restart_reason"] = i.restart_reason;
+    if (i.proxy_port > 0) j["proxy_port"] = i.proxy_port;
+    if (i.match) j["match"] = *i.match;
+    if (i.startup) j["startup"] = *i.startup;
+    if (i.limits) j["limits"] = *i.limits;
+    if (!i.over_limit.empty()) j["over_limit"] = i.over_limit;
+    if (i.output_offset > 0) j["output_offset"] = i.output_offset;
+    if (i.discovered) j["discovered"] = *i.discovered;
 }
 
 inline void from_json(const json& j, Instance& i) {
@@ -136,10 +561,217 @@ inline void from_json(const json& j, Instance& i) {
     j.at("started").get_to(i.started);
     j.at("managed").get_to(i.managed);
 
+    if (j.contains("template_revision")) j.at("template_revision").get_to(i.template_revision);
+    if (j.contains("vars")) j.at("vars").get_to(i.vars);
+    if (j.contains("argv")) j.at("argv").get_to(i.argv);
+    i.leaf_command = j.value("leaf_command", "");
+    i.marker = j.value("marker", "");
+    i.container = j.value("container", "");
+    if (j.contains("project")) j.at("project").get_to(i.project);
+    if (j.contains("labels")) j.at("labels").get_to(i.labels);
     if (j.contains("cwd")) j.at("cwd").get_to(i.cwd);
+    if (j.contains("umask")) j.at("umask").get_to(i.umask);
+    if (j.contains("stdout")) j.at("stdout").get_to(i.stdout_path);
+    if (j.contains("stderr")) j.at("stderr").get_to(i.stderr_path);
     if (j.contains("cputime")) j.at("cputime").get_to(i.cpu_time);
+    if (j.contains("cpu_percent")) j.at("cpu_percent").get_to(i.cpu_percent);
+    if (j.contains("cpu_sampled")) j.at("cpu_sampled").get_to(i.cpu_sampled);
+    if (j.contains("rss")) j.at("rss").get_to(i.rss);
+    if (j.contains("children")) j.at("children").get_to(i.children);
+    if (j.contains("threads")) j.at("threads").get_to(i.threads);
+    if (j.contains("fds")) j.at("fds").get_to(i.fds);
+    if (j.contains("fd_limit")) j.at("fd_limit").get_to(i.fd_limit);
+    if (j.contains("warning")) j.at("warning").get_to(i.warning);
+    if (j.contains("io_read")) j.at("io_read").get_to(i.io_read);
+    if (j.contains("io_write")) j.at("io_write").get_to(i.io_write);
     if (j.contains("error")) j.at("error").get_to(i.error);
     if (j.contains("action")) j.at("action").get_to(i.action);
+    if (j.contains("actions")) j.at("actions").get_to(i.actions);
+    if (j.contains("health")) j.at("health").get_to(i.health);
+    if (j.contains("start_ticks")) j.at("start_ticks").get_to(i.start_ticks);
+    if (j.contains("stopped_at")) j.at("stopped_at").get_to(i.stopped_at);
+    if (j.contains("pty")) j.at("pty").get_to(i.pty);
+    if (j.contains("autostart")) j.at("autostart").get_to(i.autostart);
+    i.protect = j.value("protected", false);
+    i.notes = j.value("notes", "");
+    if (j.contains("secrets")) j.at("secrets").get_to(i.secrets);
+    if (j.contains("env")) j.at("env").get_to(i.env);
+    if (j.contains("restarts")) j.at("restarts").get_to(i.restarts);
+    if (j.contains("health_failures")) j.at("health_failures").get_to(i.health_failures);
+    if (j.contains("health_interval")) j.at("health_interval").get_to(i.health_interval);
+    if (j.contains("failed_checks")) j.at("failed_checks").get_to(i.failed_checks);
+    if (j.contains("backoff")) j.at("backoff").get_to(i.backoff);
+    if (j.contains("restarted_at")) j.at("restarted_at").get_to(i.restarted_at);
+    if (j.contains("restart_reason")) j.at("restart_reason").get_to(i.restart_reason);
+    if (j.contains("proxy_port")) j.at("proxy_port").get_to(i.proxy_port);
+    if (j.contains("match")) i.match = j.at("match").get<MatchRule>();
+    if (j.contains("startup")) i.startup = j.at("startup").get<StartupProbe>();
+    if (j.contains("limits")) i.limits = j.at("limits").get<Limits>();
+    if (j.contains("over_limit")) j.at("over_limit").get_to(i.over_limit);
+    i.output_offset = j.value("output_offset", 0LL);
+    if (j.contains("discovered")) i.discovered = j.at("discovered").get<ProcessSnapshot>();
+}
+
+// ApiToken grants API access with a role: viewer (GET only), operator
+// (+ start/stop/restart/actions), admin (+ templates, resource types, config)
+struct ApiToken {
+    std::string token;
+    std::string role;
+};
+
+// JSON serialization for ApiToken
+inline void to_json(json& j, const ApiToken& t) {
+    j = json{{"token", t.token}, {"role", t.role}};
+}
+
+inline void from_json(const json& j, ApiToken& t) {
+    j.at("token").get_to(t.token);
+    j.at("role").get_to(t.role);
+}
+
+// WebUser can log in to the web UI with a password, getting a session with
+// the user's role (as for ApiToken)
+struct WebUser {
+    std::string password_hash; // SHA-512 crypt ($6$salt$hash), see hashPassword
+    std::string role;
+};
+
+// JSON serialization for WebUser
+inline void to_json(json& j, const WebUser& u) {
+    j = json{{"password_hash", u.password_hash}, {"role", u.role}};
+}
+
+inline void from_json(const json& j, WebUser& u) {
+    j.at("password_hash").get_to(u.password_hash);
+    j.at("role").get_to(u.role);
+}
+
+// ActionRun records one execution of an instance action
+struct ActionRun {
+    int id = 0;                              // Increasing run ID
+    std::string instance;                    // Instance name
+    std::string action;                      // Action name ("default" for the single action)
+    std::string command;                     // Interpolated command that ran
+    time_t started = 0;                      // Unix timestamp
+    double duration = 0;                     // Seconds
+    int exit_code = -1;                      // -1 while running
+    std::string output;                      // Combined stdout/stderr, truncated
+    bool truncated = false;                  // Output exceeded the capture limit
+};
+
+// JSON serialization for ActionRun
+inline void to_json(json& j, const ActionRun& r) {
+    j = json{
+        {"id", r.id},
+        {"instance", r.instance},
+        {"action", r.action},
+        {"command", r.command},
+        {"started", r.started},
+        {"duration", r.duration},
+        {"exit_code", r.exit_code},
+        {"output", r.output},
+        {"truncated", r.truncated}
+    };
+}
+
+inline void from_json(const json& j, ActionRun& r) {
+    r.id = j.value("id", 0);
+    r.instance = j.value("instance", "");
+    r.action = j.value("action", "");
+    r.command = j.value("command", "");
+    r.started = j.value("started", (time_t)0);
+    r.duration = j.value("duration", 0.0);
+    r.exit_code = j.value("exit_code", -1);
+    r.output = j.value("output", "");
+    r.truncated = j.value("truncated", false);
+}
+
+// AlertRule triggers an action when a condition holds on matching instances
+struct AlertRule {
+    std::string id;
+    std::string condition;                   // e.g. "cpu_percent > 90", "rss > 2GB", "health == unhealthy"
+    long duration = 0;                       // Seconds the condition must hold before firing
+    std::string selector;                    // Label selector (empty = every instance)
+    std::string action;                      // webhook|command|restart
+    std::string target;                      // Webhook URL or shell command
+    long cooldown = 300;                     // Seconds before firing again for the same instance
+    bool enabled = true;
+};
+
+// JSON serialization for AlertRule
+inline void to_json(json& j, const AlertRule& r) {
+    j = json{
+        {"id", r.id},
+        {"condition", r.condition},
+        {"for", r.duration},
+        {"action", r.action},
+        {"cooldown", r.cooldown},
+        {"enabled", r.enabled}
+    };
+    if (!r.selector.empty()) j["selector"] = r.selector;
+    if (!r.target.empty()) j["target"] = r.target;
+}
+
+inline void from_json(const json& j, AlertRule& r) {
+    j.at("id").get_to(r.id);
+    j.at("condition").get_to(r.condition);
+    j.at("action").get_to(r.action);
+    r.duration = j.value("for", 0L);
+    r.selector = j.value("selector", "");
+    r.target = j.value("target", "");
+    r.cooldown = j.value("cooldown", 300L);
+    r.enabled = j.value("enabled", true);
+}
+
+// Event records something vp noticed or did on its own, e.g. an alert firing
+struct Event {
+    int id = 0;                              // Increasing event ID
+    time_t time = 0;                         // Unix timestamp
+    std::string kind;                        // alert|health|status|limit
+    std::string instance;
+    std::string rule;                        // Alert rule ID (kind=alert), limit (kind=limit)
+    std::string message;
+};
+
+// JSON serialization for Event
+inline void to_json(json& j, const Event& e) {
+    j = json{
+        {"id", e.id},
+        {"time", e.time},
+        {"kind", e.kind},
+        {"instance", e.instance},
+        {"message", e.message}
+    };
+    if (!e.rule.empty()) j["rule"] = e.rule;
+}
+
+inline void from_json(const json& j, Event& e) {
+    e.id = j.value("id", 0);
+    e.time = j.value("time", (time_t)0);
+    e.kind = j.value("kind", "");
+    e.instance = j.value("instance", "");
+    e.rule = j.value("rule", "");
+    e.message = j.value("message", "");
+}
+
+// StatusChange is one entry in an instance's timeline (vp history)
+struct StatusChange {
+    time_t time = 0;
+    std::string from;    // "" when the instance was new
+    std::string to;
+    std::string cause;   // e.g. "exited with code 1", "stopped by vp", "startup probe passed"
+};
+
+// JSON serialization for StatusChange
+inline void to_json(json& j, const StatusChange& c) {
+    j = json{{"time", c.time}, {"from", c.from}, {"to", c.to}, {"cause", c.cause}};
+}
+
+inline void from_json(const json& j, StatusChange& c) {
+    c.time = j.value("time", (time_t)0);
+    c.from = j.value("from", "");
+    c.to = j.value("to", "");
+    c.cause = j.value("cause", "");
 }
 
 // ProcessInfo contains detailed information about a discovered process
@@ -151,8 +783,18 @@ struct ProcessInfo {
     std::string exe;                         // Executable path
     std::string cwd;                         // Working directory
     std::map<std::string, std::string> environ; // Environment variables
-    std::vector<int> ports;                  // TCP ports this process listens on
+    std::vector<int> ports;                  // TCP ports this process listens on (none in another network namespace)
+    std::string container;                   // Container it runs in: ID (12 hex digits) or lxc name
+    std::string container_runtime;           // docker|podman|containerd|crio|kubepods|lxc, "namespace" if only its namespaces tell
+    bool foreign_net;                        // In another network namespace than vp: its ports aren't ours
     double cpu_time;                         // CPU time in seconds
+    long rss;                                // Resident set size in bytes
+    unsigned long long start_time;           // Start time in clock ticks since boot
+    int threads;                             // Thread count
+    int fds;                                 // Open file descriptors (see readFdUsage)
+    long fd_limit;                           // Soft RLIMIT_NOFILE (0 = unknown)
+    long long io_read;                       // Bytes read from storage since start
+    long long io_write;                      // Bytes written to storage since start
 };
 
 } // namespace vp
@@ -0,0 +1,165 @@
+#include "websocket.hpp"
+#include <unistd.h>
+#include <cerrno>
+#include <cstdint>
+#include <vector>
+
+namespace vp {
+
+static uint32_t rotl(uint32_t x, int n) {
+    return (x << n) | (x >> (32 - n));
+}
+
+static std::string sha1(const std::string& input) {
+    uint32_t h[5] = {0x67452301, 0xEFCDAB89, 0x98BADCFE, 0x10325476, 0xC3D2E1F0};
+
+    // Pad: 0x80, zeros, then the bit length as 64-bit big endian
+    std::string msg = input;
+    uint64_t bits = static_cast<uint64_t>(input.size()) * 8;
+    msg += static_cast<char>(0x80);
+    while (msg.size() % 64 != 56) msg += '\0';
+    for (int i = 7; i >= 0; i--) msg += static_cast<char>(bits >> (i * 8));
+
+    for (size_t chunk = 0; chunk < msg.size(); chunk += 64) {
+        uint32_t w[80];
+        for (int i = 0; i < 16; i++) {
+            const unsigned char* p = reinterpret_cast<const unsigned char*>(msg.data() + chunk + i * 4);
+            w[i] = (uint32_t(p[0]) << 24) | (uint32_t(p[1]) << 16) | (uint32_t(p[2]) << 8) | p[3];
+        }
+        for (int i = 16; i < 80; i++) {
+            w[i] = rotl(w[i - 3] ^ w[i - 8] ^ w[i - 14] ^ w[i - 16], 1);
+        }
+
+        uint32_t a = h[0], b = h[1], c = h[2], d = h[3], e = h[4];
+        for (int i = 0; i < 80; i++) {
+            uint32_t f, k;
+            if (i < 20) {
+                f = (b & c) | (~b & d);
+                k = 0x5A827999;
+            } else if (i < 40) {
+                f = b ^ c ^ d;
+                k = 0x6ED9EBA1;
+            } else if (i < 60) {
+                f = (b & c) | (b & d) | (c & d);
+                k = 0x8F1BBCDC;
+            } else {
+                f = b ^ c ^ d;
+                k = 0xCA62C1D6;
+            }
+            uint32_t t = rotl(a, 5) + f + e + k + w[i];
+            e = d;
+            d = c;
+            c = rotl(b, 30);
+            b = a;
+            a = t;
+        }
+        h[0] += a;
+        h[1] += b;
+        h[2] += c;
+        h[3] += d;
+        h[4] += e;
+    }
+
+    std::string digest;
+    for (uint32_t v : h) {
+        for (int i = 3; i >= 0; i--) digest += static_cast<char>(v >> (i * 8));
+    }
+    return digest;
+}
+
+std::string base64(const std::string& input) {
+    static const char* chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+    std::string out;
+    size_t i = 0;
+    for (; i + 2 < input.size(); i += 3) {
+        uint32_t n = (uint8_t(input[i]) << 16) | (uint8_t(input[i + 1]) << 8) | uint8_t(input[i + 2]);
+        out += chars[n >> 18];
+        out += chars[(n >> 12) & 63];
+        out += chars[(n >> 6) & 63];
+        out += chars[n & 63];
+    }
+    if (i + 1 == input.size()) {
+        uint32_t n = uint8_t(input[i]) << 16;
+        out += chars[n >> 18];
+        out += chars[(n >> 12) & 63];
+        out += "==";
+    } else if (i + 2 == input.size()) {
+        uint32_t n = (uint8_t(input[i]) << 16) | (uint8_t(input[i + 1]) << 8);
+        out += chars[n >> 18];
+        out += chars[(n >> 12) & 63];
+        out += chars[(n >> 6) & 63];
+        out += '=';
+    }
+    return out;
+}
+
+std::string websocketAccept(const std::string& key) {
+    return base64(sha1(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"));
+}
+
+std::string websocketFrame(const std::string& payload, int opcode) {
+    std::string frame;
+    frame += static_cast<char>(0x80 | opcode); // FIN
+    uint64_t len = payload.size();
+    if (len < 126) {
+        frame += static_cast<char>(len);
+    } else if (len <= 0xFFFF) {
+        frame += static_cast<char>(126);
+        frame += static_cast<char>(len >> 8);
+        frame += static_cast<char>(len);
+    } else {
+        frame += static_cast<char>(127);
+        for (int i = 7; i >= 0; i--) frame += static_cast<char>(len >> (i * 8));
+    }
+    return frame + payload;
+}
+
+static bool readFull(int fd, char* buffer, size_t len) {
+    size_t done = 0;
+    while (done < len) {
+        ssize_t n = read(fd, buffer + done, len - done);
+        if (n < 0 && errno == EINTR) continue;
+        if (n <= 0) return false;
+        done += n;
+    }
+    return true;
+}
+
+bool readWebsocketFrame(int fd, int& opcode, std::string& payload, size_t maxPayload) {
+    unsigned char header[2];
+    if (!readFull(fd, reinterpret_cast<char*>(header), 2)) {
+        return false;
+    }
+    opcode = header[0] & 0x0F;
+    bool masked = header[1] & 0x80;
+
+    uint64_t len = header[1] & 0x7F;
+    if (len == 126 || len == 127) {
+        unsigned char ext[8];
+        int n = len == 126 ? 2 : 8;
+        if (!readFull(fd, reinterpret_cast<char*>(ext), n)) {
+            return false;
+        }
+        len = 0;
+        for (int i = 0; i < n; i++) len = (len << 8) | ext[i];
+    }
+    if (len > maxPayload) {
+        return false;
+    }
+
+    char mask[4] = {0, 0, 0, 0};
+    if (masked && !readFull(fd, mask, 4)) {
+        return false;
+    }
+
+    payload.assign(len, '\0');
+    if (len > 0 && !readFull(fd, &payload[0], len)) {
+        return false;
+    }
+    for (size_t i = 0; i < len; i++) {
+        payload[i] ^= mask[i % 4];
+    }
+    return true;
+}
+
+} // namespace vp
@@ -0,0 +1,35 @@
+#ifndef VP_WEBSOCKET_HPP
+#define VP_WEBSOCKET_HPP
+
+#include <string>
+
+namespace vp {
+
+// Minimal RFC 6455 server side: handshake and unfragmented frames,
+// enough for the web terminal.
+
+enum WebsocketOpcode {
+    WS_CONTINUATION = 0x0,
+    WS_TEXT = 0x1,
+    WS_BINARY = 0x2,
+    WS_CLOSE = 0x8,
+    WS_PING = 0x9,
+    WS_PONG = 0xA,
+};
+
+// Standard base64 with padding
+std::string base64(const std::string& input);
+
+// Sec-WebSocket-Accept value for a client's Sec-WebSocket-Key
+std::string websocketAccept(const std::string& key);
+
+// Encode a server-to-client (unmasked) frame
+std::string websocketFrame(const std::string& payload, int opcode);
+
+// Read one client frame (unmasking it). Returns false on EOF, error or
+// a payload over maxPayload bytes.
+bool readWebsocketFrame(int fd, int& opcode, std::string& payload, size_t maxPayload = 1 << 20);
+
+} // namespace vp
+
+#endif // VP_WEBSOCKET_HPP